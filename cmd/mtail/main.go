@@ -8,12 +8,17 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/mtail/programtest"
 	"github.com/google/mtail/internal/watcher"
 	"go.opencensus.io/trace"
 )
@@ -31,19 +36,70 @@ func (f *seqStringFlag) Set(value string) error {
 	return nil
 }
 
+// repeatedStringFlag is a flag that collects each value given to a repeated
+// flag, without splitting on commas.
+type repeatedStringFlag []string
+
+func (f *repeatedStringFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *repeatedStringFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 var logs seqStringFlag
+var logRegexps repeatedStringFlag
+var logCommands repeatedStringFlag
+var labelRenames seqStringFlag
+var knownEnvVars seqStringFlag
+var staticLabels seqStringFlag
+var journalUnits seqStringFlag
 
 var (
 	port               = flag.String("port", "3903", "HTTP port to listen on.")
 	address            = flag.String("address", "", "Host or IP address on which to bind HTTP listener")
-	progs              = flag.String("progs", "", "Name of the directory containing mtail programs")
+	bindIface          = flag.String("bind_iface", "", "If set, the name of the network interface whose first non-loopback unicast address the HTTP listener binds to, instead of --address.")
+	bindIfaceIPv6      = flag.Bool("bind_iface_ipv6", false, "Prefer the IPv6 addresses of --bind_iface to its IPv4 addresses.")
+	metricsPath        = flag.String("metrics_path", "/metrics", "URL path to serve Prometheus metrics at.")
+	jsonPath           = flag.String("json_path", "/json", "URL path to serve JSON metrics at.")
+	httpPrefix         = flag.String("http_prefix", "", "URL path prefix to serve all HTTP endpoints under, e.g. /mtail when behind a reverse proxy that routes by path.  Requests for / are redirected to the prefix.")
+	progs              = flag.String("progs", "", "Name of the directory containing mtail programs, or a comma separated list of directories.  Programs with the same filename in more than one directory are named by their full path after the first.")
+	watchProgs         = flag.Bool("watch_progs", true, "Watch the programs directory and reload programs when they are created, changed, or removed.  Metrics of removed programs are removed.")
+	maxProgs           = flag.Int("max_progs", 0, "Maximum number of programs to load; the first in alphabetical order are loaded, and any more are skipped with a warning.  Zero means no limit.")
 	ignoreRegexPattern = flag.String("ignore_filename_regex_pattern", "", "")
+	ignoreOlderThan    = flag.Duration("ignore_files_older_than", 0, "If positive, log files last modified longer ago than this aren't tailed, until they are modified again.  Zero tails all files.")
+	logFileBlacklist   = flag.String("log_file_blacklist", "", "If set, a regular expression matching the absolute paths of files that aren't tailed when expanding --logs and --logs_regexp, like \\.(old|bak)$.")
+	logFileWhitelist   = flag.String("log_file_whitelist", "", "If set, a regular expression that the absolute paths of files expanded from --logs and --logs_regexp must also match to be tailed.  --log_file_blacklist takes precedence.")
+	stripControl       = flag.Bool("strip_control", false, "Strip ANSI escape sequences, such as colours, and other control characters except tabs from log lines before programs see them.")
+	journald           = flag.Bool("journald", false, "Read the messages of the systemd journal as log lines, with the filename \"journald\", by running journalctl.  The journal entries' fields can be read with journalfield().")
+	journalctlPath     = flag.String("journalctl_path", "journalctl", "Path of the journalctl command used to read the journal with --journald.")
+	syslogTLSAddress   = flag.String("syslog_tls_address", "", "If set, the address to receive syslog messages over TLS on, as sent by RFC 5425 transports, for example :6514.  Each message is read as a log line, with the filename \"syslog\".")
+	syslogTLSCertFile  = flag.String("syslog_tls_cert_file", "", "Path of the PEM encoded certificate presented to syslog clients with --syslog_tls_address.")
+	syslogTLSKeyFile   = flag.String("syslog_tls_key_file", "", "Path of the PEM encoded private key of --syslog_tls_cert_file.")
+	syslogTLSCAFile    = flag.String("syslog_tls_ca_file", "", "If set, path of the PEM encoded CA certificates that syslog clients' certificates must be signed by.  If not set, clients aren't authenticated.")
+	tlsMinVersion      = flag.String("tls_min_version", "tls12", "Oldest TLS version accepted by the TLS listeners, one of tls10, tls11, tls12 or tls13.")
+	tlsCipherSuites    = flag.String("tls_cipher_suites", "", "If set, a comma separated list of the names of the cipher suites accepted by the TLS listeners for TLS 1.2 and earlier, like TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384.  The cipher suites of TLS 1.3 can't be configured.")
+	flushOnExit        = flag.Bool("flush_on_exit", true, "Push the metrics to any configured collectors one last time on shutdown, waiting up to --flush_timeout, so that the updates since the last push aren't lost.")
+	noFollow           = flag.Bool("no_follow", false, "Read the logs from start until EOF, push the metrics to any configured collectors, write a snapshot if --snapshot_path is set, and exit.  Useful for collecting metrics from logs in batch jobs.")
+
+	// HTTP server flags
+	httpReadTimeout    = flag.Duration("http_read_timeout", 10*time.Second, "Maximum duration for reading an entire HTTP request, including the body.  Zero means no timeout.")
+	httpWriteTimeout   = flag.Duration("http_write_timeout", 0, "Maximum duration before timing out writes of an HTTP response.  Zero means no timeout.")
+	httpIdleTimeout    = flag.Duration("http_idle_timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive HTTP connection.  Zero means no timeout.")
+	pprofPort          = flag.Int("pprof_port", 0, "If positive, the port to serve the Go profiling endpoints under /debug/pprof on, listening only on localhost.  Zero disables profiling.")
+	httpMaxHeaderBytes = flag.Int("http_max_header_bytes", 1<<20, "Maximum size in bytes of the HTTP request headers.")
 
 	version = flag.Bool("version", false, "Print mtail version information.")
 
+	configFile           = flag.String("config", "", "If set, path of a file of flags, one to a line in the form name=value, that are used when not set on the commandline.  Lines beginning with # are ignored.")
+	configReloadOnChange = flag.Bool("config_reload_on_change", false, "Reload --config when it changes, applying changes to --logs, --static_labels and --metric_push_interval_seconds.  Changes to other flags are logged and ignored until mtail is restarted.")
+
 	// Compiler behaviour flags
 	oneShot      = flag.Bool("one_shot", false, "Compile the programs, then read the contents of the provided logs from start until EOF, print the values of the metrics store and exit. This is a debugging flag only, not for production use.")
 	compileOnly  = flag.Bool("compile_only", false, "Compile programs only, do not load the virtual machine.")
+	testPrograms = flag.Bool("test_programs", false, "Run the tests embedded in the programs' comments, print the results and exit, with a non-zero status if any test failed.  See the Testing document for the format of the tests.")
 	dumpAst      = flag.Bool("dump_ast", false, "Dump AST of programs after parse (to INFO log).")
 	dumpAstTypes = flag.Bool("dump_ast_types", false, "Dump AST of programs with type annotation after typecheck (to INFO log).")
 	dumpBytecode = flag.Bool("dump_bytecode", false, "Dump bytecode of programs (to INFO log).")
@@ -52,17 +108,55 @@ var (
 	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
 	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
 	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
+	hostname             = flag.String("hostname", "", "Hostname to export metrics as, in the --instance_label label and to collectd.  If empty, the system hostname is used.")
+	instanceLabel        = flag.String("instance_label", "", "If set, the key of a label with the hostname as its value that is added to every exported metric, to tell apart metrics from many mtail instances.")
 	emitMetricTimestamp  = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
+	emitStaleMarkers     = flag.Bool("emit_stale_markers", false, "Export each series removed by expiry, eviction, or the unloading of its program once more to Prometheus, with the staleness marker as its value, so that it is marked stale on the next scrape.  Only scrapes in the protobuf format carry the marker.")
+	exportAllowMetrics   = flag.String("export_allow_metrics", "", "If set, a regular expression that the whole name of a metric must match for it to be exported.")
+	exportDenyMetrics    = flag.String("export_deny_metrics", "", "If set, a regular expression; metrics whose whole name matches are not exported.")
+	rulesFile            = flag.String("rules_file", "", "If set, the path of a YAML file of relabel rules, applied to the labels of every exported metric.  A rule with an empty replacement drops the series it matches.")
+	exportDeltaCounters  = flag.Bool("export_delta_counters", false, "Push counters to collectd, graphite, statsd and OpenTSDB as the change in their value since the last push, rather than their cumulative value.  The Prometheus endpoint always serves cumulative values.")
+	exportCounterRates   = flag.String("export_counter_rates", "", "If set, a regular expression; alongside each counter whose whole name matches, push a gauge named with a _rate suffix to collectd, graphite, statsd and OpenTSDB, with the counter's increase per second since the last push as its value.")
+	emitInitialValues    = flag.Bool("emit_initial_values", false, "Export all metrics without keys with their initial values as soon as programs are loaded, before any log lines are processed.")
+	sanitizeLabelValues  = flag.Bool("sanitize_label_values", false, "Sanitize exported labels: escape null bytes in label values, truncate them to --max_label_value_length characters, and replace invalid characters in label keys with --sanitize_replace_char.")
+	maxLabelValueLength  = flag.Int("max_label_value_length", 256, "Maximum length in characters of exported label values when --sanitize_label_values is set.")
+	sanitizeReplaceChar  = flag.String("sanitize_replace_char", "_", "Replacement for characters other than letters, digits and underscores in exported label keys when --sanitize_label_values is set.")
 
 	// Ops flags
 	pollInterval                = flag.Duration("poll_interval", 0, "Set the interval to poll all log files for data; must be positive, or zero to disable polling.  With polling mode, only the files found at mtail startup will be polled.")
 	disableFsnotify             = flag.Bool("disable_fsnotify", false, "EXPERIMENTAL: When enabled no fsnotify watcher is created, and mtail falls back to polling mode only.  Only the files known at program startup will be polled.")
 	expiredMetricGcTickInterval = flag.Duration("expired_metrics_gc_interval", time.Hour, "interval between expired metric garbage collection runs")
+	maxMetricSeries             = flag.Int("max_metric_series", 0, "If positive, the maximum number of series, that is label sets of all metrics, to keep.  The least recently updated series over the maximum are evicted as new series are added.  Zero means no limit.")
 	staleLogGcTickInterval      = flag.Duration("stale_log_gc_interval", time.Hour, "interval between stale log garbage collection runs")
+	logWatchdogTimeout          = flag.Duration("log_watchdog_timeout", 0, "If positive, reopen a log file when no lines have been read from it for this long while it is still growing, to recover from filesystems that stop delivering reads.  Zero disables the watchdog.")
+	recordDelimiter             = flag.String("record_delimiter", `\n`, "Byte that ends each record read from the logs, as a single character or a Go escape sequence like \\x00 for NUL delimited records.")
+	gracefulShutdownTimeout     = flag.Duration("graceful_shutdown_timeout", 30*time.Second, "Time to wait on shutdown for the logs to be closed, the programs to finish the lines they're processing, the final push with --flush_on_exit, and the HTTP server to stop, before giving up and exiting with an error.  Zero waits for as long as it takes.")
+	staleFileThreshold          = flag.Duration("stale_file_threshold", 0, "If positive, close and stop watching a log file when no lines have been read from it for this long, so that deleted files still held open by their writer don't leak file descriptors.  The file is opened again when it is modified or recreated.  Zero disables closing stale files.")
+	idleFileTimeout             = flag.Duration("idle_file_timeout", 0, "If positive, close the file descriptor of a log file when no lines have been read from it for this long, to limit the number of files held open when tailing many idle logs.  The file is still watched, and opened again when it is modified.  Zero disables closing idle files.")
+	logRotationCheckInterval    = flag.Duration("log_rotation_check_interval", time.Second, "Interval between checks of each log file for rotation, that is replacement by a new file of the same name, or truncation.  Rotations are also noticed from filesystem events; the checks catch those that are missed.  Zero disables the checks.")
+	snapshotPath                = flag.String("snapshot_path", "", "Path to write a JSON snapshot of the metrics store to when mtail receives SIGUSR1.  If empty, the snapshot is written to standard error.")
+	internalMetricsPrefix       = flag.String("internal_metrics_prefix", "mtail", "Prefix of the names of mtail's own metrics exported to Prometheus.  Change this to distinguish multiple mtail instances on one host.")
+	dropUnparseableLines        = flag.Bool("drop_unparseable_lines", false, "Write lines that aren't matched by any program to the file named by --unparseable_log_path.")
+	unparseableLogPath          = flag.String("unparseable_log_path", "", "Path of the file to write unparseable lines to when --drop_unparseable_lines is set.")
+	unparseableLogMaxSize       = flag.Int("unparseable_log_max_size", 100, "Size in megabytes at which the unparseable log is rotated to the same name with a .1 suffix.  Zero means never rotate.")
+	sdOutputFile                = flag.String("sd_output_file", "", "If set, path to write a Prometheus file-based service discovery file to, with this instance's hostname and port as its target and --static_labels as the target's labels.")
+	sdRefreshInterval           = flag.Duration("sd_refresh_interval", 30*time.Second, "Interval between rewrites of the --sd_output_file service discovery file.")
+	lineWorkers                 = flag.Int("line_workers", 1, "Number of copies of each program that process lines in parallel, to use more than one CPU for a busy log.  Lines may then be processed out of order.  1 processes lines one at a time, in order.")
+	lineQueueSize               = flag.Int("line_queue_size", 0, "Number of lines read that can wait to be processed by the programs.  0 means one per --line_workers.")
+	lineQueuePolicy             = flag.String("line_queue_policy", "block", "What to do with a line read when --line_queue_size lines are already waiting to be processed: \"block\" stops reading logs until there's room, \"drop-oldest\" drops the line that has waited longest, and \"drop-newest\" drops the line just read.  Dropped lines are counted in dropped_lines_total.")
+	dedupWindow                 = flag.Duration("dedup_window", 0, "If positive, each program ignores a log line identical to one it processed from the same log within this window.  Zero disables deduplication.")
+	dedupMaxLines               = flag.Int("dedup_max_lines", 100000, "Maximum number of lines each program remembers for --dedup_window.  Beyond it the oldest lines are forgotten, so repeats of them are processed again.  Zero means no limit.")
+	hllPrecision                = flag.Int("hll_precision", datum.DefaultHLLPrecision, "Precision of the HyperLogLog sketches of hll metrics, 14 or 16.  Each sketch of each label set takes up to 2^precision bytes, and estimates with a standard error of about 1.04/sqrt(2^precision): 0.8% at 14, or 0.4% at 16.")
+	geoipDatabase               = flag.String("geoip_database", "", "Path of a MaxMind DB file, such as a GeoLite2 Country, City or ASN database, that programs look IP addresses up in with geoip().  The file is loaded once at startup.")
+	apiKeyFile                  = flag.String("api_key_file", "", "Path of a file holding a key that requests to the management endpoints, like /quitquitquit, must present as \"Authorization: Bearer <key>\" or \"X-API-Key: <key>\".  If not set, the endpoints aren't authenticated.  The file is read once at startup.")
+	hashSecretFile              = flag.String("hash_secret_file", "", "Path of a file holding a secret key, which makes hash() compute HMACs so that hashed values can't be recovered by hashing guesses.  The file is read once at startup.")
 
 	// Debugging flags
 	blockProfileRate     = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
 	mutexProfileFraction = flag.Int("mutex_profile_fraction", 0, "Fraction of mutex contention events reported.  0 turns off.  See http://golang.org/pkg/runtime/#SetMutexProfileFraction")
+	cpuProfile           = flag.String("cpu_profile", "", "If set, write a CPU profile of the first --profile_duration after startup to this file.")
+	memProfile           = flag.String("mem_profile", "", "If set, write a heap profile to this file after --profile_duration.")
+	profileDuration      = flag.Duration("profile_duration", 30*time.Second, "Duration after startup at which the --cpu_profile is stopped and the --mem_profile written, or earlier if mtail exits first.")
 
 	// Tracing
 	jaegerEndpoint    = flag.String("jaeger_endpoint", "", "If set, collector endpoint URL of jaeger thrift service")
@@ -71,6 +165,116 @@ var (
 
 func init() {
 	flag.Var(&logs, "logs", "List of log files to monitor, separated by commas.  This flag may be specified multiple times.")
+	flag.Var(&labelRenames, "export_label_rename", "Rename a label key of a metric on export, in the form metric:from=to, e.g. http_requests:code=status_code.  Renames are separated by commas, and this flag may be specified multiple times.")
+	flag.Var(&knownEnvVars, "known_env_vars", "Names of the environment variables that programs are expected to read with getenv(), separated by commas.  If set, programs reading any other variable are warned about when loaded.  This flag may be specified multiple times.")
+	flag.Var(&staticLabels, "static_labels", "Labels of the form key=value, separated by commas, of this instance's target in the --sd_output_file service discovery file.  This flag may be specified multiple times.")
+	flag.Var(&journalUnits, "journald_units", "Units whose journal entries are read with --journald, separated by commas, e.g. nginx.service.  All units are read if empty.  This flag may be specified multiple times.")
+	flag.Var(&logCommands, "logs_command", "A command to run, whose standard output is read as a log with the command line as its filename, e.g. \"kubectl logs -f deploy/web\".  The command line is split at spaces, and isn't run by a shell.  The command is run again when it exits, and what it writes to its standard error is logged.  This flag may be specified multiple times.")
+	flag.Var(&logRegexps, "logs_regexp", "A directory and filename regular expression of log files to monitor, e.g. /var/log/app-\\d{8}\\.log.  The final path element must match the whole filename.  This flag may be specified multiple times.")
+}
+
+// envFlags maps the names of flags to the environment variables that set
+// them when they're not given on the commandline.
+var envFlags = map[string]string{
+	"logs":  "MTAIL_LOGS",
+	"progs": "MTAIL_PROGS",
+	"port":  "MTAIL_PORT",
+}
+
+// setFlagsFromEnv sets each flag in envFlags that was not set on the
+// commandline from its environment variable, if that is not empty.  Flags on
+// the commandline take precedence.
+func setFlagsFromEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, env := range envFlags {
+		if set[name] {
+			continue
+		}
+		value, ok := lookupEnv(env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", value, env, err)
+		}
+	}
+	return nil
+}
+
+// setFlagsFromConfig sets each flag in config that was not set on the
+// commandline, and returns the names of those that were.  Flags on the
+// commandline take precedence.
+func setFlagsFromConfig(fs *flag.FlagSet, config []mtail.ConfigFlag) (commandline []string, err error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		commandline = append(commandline, f.Name)
+	})
+	for _, f := range config {
+		if set[f.Name] {
+			continue
+		}
+		if err := fs.Set(f.Name, f.Value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s in config file: %s", f.Value, f.Name, err)
+		}
+	}
+	return commandline, nil
+}
+
+// startProfiles starts a CPU profile written to cpuPath, if set, and returns
+// a function that stops it and writes a heap profile to memPath, if set.  The
+// function is called after duration, and should also be called on exit in
+// case that comes first; only the first call has any effect.
+func startProfiles(cpuPath, memPath string, duration time.Duration) (stop func(), err error) {
+	var cpu *os.File
+	if cpuPath != "" {
+		if cpu, err = os.Create(cpuPath); err != nil {
+			return nil, err
+		}
+		if err = pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+		glog.Infof("Writing a CPU profile to %s for %s", cpuPath, duration)
+	}
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				if err := cpu.Close(); err != nil {
+					glog.Warning(err)
+				}
+				glog.Infof("Wrote CPU profile to %s", cpuPath)
+			}
+			if memPath != "" {
+				if err := writeHeapProfile(memPath); err != nil {
+					glog.Warning(err)
+					return
+				}
+				glog.Infof("Wrote heap profile to %s", memPath)
+			}
+		})
+	}
+	time.AfterFunc(duration, stop)
+	return stop, nil
+}
+
+// writeHeapProfile writes a profile of the live heap to path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 var (
@@ -96,6 +300,20 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	var config []mtail.ConfigFlag
+	var commandline []string
+	if *configFile != "" {
+		var err error
+		if config, err = mtail.ReadConfigFile(*configFile); err != nil {
+			glog.Exit(err)
+		}
+		if commandline, err = setFlagsFromConfig(flag.CommandLine, config); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		glog.Exit(err)
+	}
 	if *version {
 		fmt.Println(buildInfo.String())
 		os.Exit(0)
@@ -118,36 +336,112 @@ func main() {
 		glog.Infof("Setting mutex profile fraction to %d", *mutexProfileFraction)
 		runtime.SetMutexProfileFraction(*mutexProfileFraction)
 	}
+	stopProfiles := func() {}
+	if *cpuProfile != "" || *memProfile != "" {
+		if stopProfiles, err = startProfiles(*cpuProfile, *memProfile, *profileDuration); err != nil {
+			glog.Exitf("Failed to start profiling: %s", err)
+		}
+	}
+	// Every exit from here on stops the profiles first, so they're written out.
+	exit := func(code int) {
+		stopProfiles()
+		glog.Flush()
+		os.Exit(code)
+	}
+	exitf := func(format string, args ...interface{}) {
+		stopProfiles()
+		glog.Exitf(format, args...)
+	}
 	if *progs == "" {
-		glog.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
+		exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
+	}
+	if *testPrograms {
+		failed, err := programtest.Run(*progs, os.Stdout)
+		if err != nil {
+			exitf("%s", err)
+		}
+		if failed > 0 {
+			fmt.Printf("FAIL: %d tests failed\n", failed)
+			exit(1)
+		}
+		fmt.Println("PASS")
+		exit(0)
 	}
 	if !(*dumpBytecode || *dumpAst || *dumpAstTypes || *compileOnly) {
-		if len(logs) == 0 {
-			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
+		if len(logs) == 0 && len(logRegexps) == 0 && len(logCommands) == 0 && !*journald && *syslogTLSAddress == "" {
+			exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
 		}
 	}
 
+	if *bindIface != "" && *address != "" {
+		exitf("The --address and --bind_iface flags can't both be set.")
+	}
+
 	if *traceSamplePeriod > 0 {
 		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1 / float64(*traceSamplePeriod))})
 	}
 
 	w, err := watcher.NewLogWatcher(*pollInterval, !*disableFsnotify)
 	if err != nil {
-		glog.Exitf("Failure to create log watcher: %s", err)
+		exitf("Failure to create log watcher: %s", err)
 	}
 	opts := []func(*mtail.Server) error{
 		mtail.ProgramPath(*progs),
+		mtail.MaxProgs(*maxProgs),
 		mtail.LogPathPatterns(logs...),
+		mtail.LogPathRegexps(logRegexps...),
+		mtail.LogCommands(logCommands...),
 		mtail.IgnoreRegexPattern(*ignoreRegexPattern),
-		mtail.BindAddress(*address, *port),
+		mtail.IgnoreFilesOlderThan(*ignoreOlderThan),
+		mtail.LogFileBlacklist(*logFileBlacklist),
+		mtail.LogFileWhitelist(*logFileWhitelist),
+		mtail.MetricsPath(*metricsPath),
+		mtail.JSONPath(*jsonPath),
+		mtail.HTTPPrefix(*httpPrefix),
+		mtail.HTTPTimeouts(*httpReadTimeout, *httpWriteTimeout, *httpIdleTimeout),
+		mtail.HTTPMaxHeaderBytes(*httpMaxHeaderBytes),
 		mtail.SetBuildInfo(buildInfo),
 		mtail.OverrideLocation(loc),
 		mtail.ExpiredMetricGcTickInterval(*expiredMetricGcTickInterval),
+		mtail.MaxMetricSeries(*maxMetricSeries),
 		mtail.StaleLogGcTickInterval(*staleLogGcTickInterval),
+		mtail.LogWatchdogTimeout(*logWatchdogTimeout),
+		mtail.StaleFileThreshold(*staleFileThreshold),
+		mtail.IdleFileTimeout(*idleFileTimeout),
+		mtail.LogRotationCheckInterval(*logRotationCheckInterval),
+		mtail.RecordDelimiter(*recordDelimiter),
+		mtail.GracefulShutdownTimeout(*gracefulShutdownTimeout),
+		mtail.DedupWindow(*dedupWindow, *dedupMaxLines),
+		mtail.GeoIPDatabase(*geoipDatabase),
+		mtail.HashSecretFile(*hashSecretFile),
+		mtail.HLLPrecision(*hllPrecision),
+		mtail.LineWorkers(*lineWorkers),
+		mtail.LineQueue(*lineQueueSize, *lineQueuePolicy),
+		mtail.InternalMetricsPrefix(*internalMetricsPrefix),
+		mtail.SnapshotPath(*snapshotPath),
+		mtail.KnownEnvVars(knownEnvVars...),
+		mtail.ExportLabelRenames(labelRenames...),
+		mtail.ExportRelabelRules(*rulesFile),
+		mtail.ExportAllowMetrics(*exportAllowMetrics),
+		mtail.ExportDenyMetrics(*exportDenyMetrics),
+		mtail.ExportCounterRates(*exportCounterRates),
+		mtail.ExportHostname(*hostname),
+		mtail.ExportInstanceLabel(*instanceLabel),
+	}
+	if *bindIface != "" {
+		opts = append(opts, mtail.BindInterface(*bindIface, *port, *bindIfaceIPv6))
+	} else {
+		opts = append(opts, mtail.BindAddress(*address, *port))
 	}
 	if *oneShot {
 		opts = append(opts, mtail.OneShot)
 	}
+	if *noFollow {
+		opts = append(opts, mtail.NoFollow)
+	}
+	if *flushOnExit {
+		opts = append(opts, mtail.FlushOnExit)
+	}
 	if *compileOnly {
 		opts = append(opts, mtail.CompileOnly)
 	}
@@ -169,17 +463,63 @@ func main() {
 	if *emitMetricTimestamp {
 		opts = append(opts, mtail.EmitMetricTimestamp)
 	}
+	if *emitStaleMarkers {
+		opts = append(opts, mtail.EmitStaleMarkers)
+	}
+	if !*watchProgs {
+		opts = append(opts, mtail.DisableProgramWatch)
+	}
+	if *stripControl {
+		opts = append(opts, mtail.StripControl)
+	}
+	if *journald {
+		opts = append(opts, mtail.Journal(*journalctlPath, journalUnits...))
+	}
+	if *apiKeyFile != "" {
+		opts = append(opts, mtail.APIKeyFile(*apiKeyFile))
+	}
+	if *syslogTLSAddress != "" {
+		opts = append(opts, mtail.SyslogTLS(*syslogTLSAddress, *syslogTLSCertFile, *syslogTLSKeyFile, *syslogTLSCAFile))
+	}
+	opts = append(opts, mtail.TLSMinVersion(*tlsMinVersion))
+	if *tlsCipherSuites != "" {
+		opts = append(opts, mtail.TLSCipherSuites(strings.Split(*tlsCipherSuites, ",")...))
+	}
+	if *exportDeltaCounters {
+		opts = append(opts, mtail.ExportDeltaCounters)
+	}
+	if *emitInitialValues {
+		opts = append(opts, mtail.EmitInitialValues)
+	}
+	if *dropUnparseableLines {
+		opts = append(opts, mtail.UnparseableLog(*unparseableLogPath, *unparseableLogMaxSize))
+	}
+	if *sdOutputFile != "" {
+		opts = append(opts, mtail.ServiceDiscoveryFile(*sdOutputFile, *sdRefreshInterval), mtail.StaticLabels(staticLabels...))
+	}
+	if *sanitizeLabelValues {
+		opts = append(opts, mtail.SanitizeLabels(*maxLabelValueLength, *sanitizeReplaceChar))
+	}
+	if *pprofPort > 0 {
+		opts = append(opts, mtail.PprofPort(strconv.Itoa(*pprofPort)))
+	}
 	if *jaegerEndpoint != "" {
 		opts = append(opts, mtail.JaegerReporter(*jaegerEndpoint))
 	}
+	if *configReloadOnChange {
+		if *configFile == "" {
+			exitf("--config_reload_on_change needs a config file, set with --config.")
+		}
+		opts = append(opts, mtail.ReloadConfigOnChange(*configFile, config, commandline...))
+	}
 	m, err := mtail.New(metrics.NewStore(), w, opts...)
 	if err != nil {
 		glog.Error(err)
-		os.Exit(1)
+		exit(1)
 	}
-	err = m.Run()
-	if err != nil {
+	if err := m.Run(); err != nil {
 		glog.Error(err)
-		os.Exit(1)
+		exit(1)
 	}
+	stopProfiles()
 }
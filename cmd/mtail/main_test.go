@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"MTAIL_LOGS":  "/var/log/a.log,/var/log/b.log",
+		"MTAIL_PROGS": "/etc/mtail",
+		"MTAIL_PORT":  "4000",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	for _, tc := range []struct {
+		name          string
+		args          []string
+		expectedLogs  []string
+		expectedProgs string
+		expectedPort  string
+	}{
+		{"env only",
+			[]string{},
+			[]string{"/var/log/a.log", "/var/log/b.log"},
+			"/etc/mtail",
+			"4000",
+		},
+		{"flags take precedence",
+			[]string{"--progs", "/opt/progs", "--port", "3903"},
+			[]string{"/var/log/a.log", "/var/log/b.log"},
+			"/opt/progs",
+			"3903",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("mtail", flag.ContinueOnError)
+			var logs seqStringFlag
+			fs.Var(&logs, "logs", "")
+			progs := fs.String("progs", "", "")
+			port := fs.String("port", "3903", "")
+			testutil.FatalIfErr(t, fs.Parse(tc.args))
+
+			testutil.FatalIfErr(t, setFlagsFromEnv(fs, lookupEnv))
+			if diff := testutil.Diff(tc.expectedLogs, []string(logs)); diff != "" {
+				t.Errorf("logs didn't match:\n%s", diff)
+			}
+			if *progs != tc.expectedProgs {
+				t.Errorf("progs: expected %q, got %q", tc.expectedProgs, *progs)
+			}
+			if *port != tc.expectedPort {
+				t.Errorf("port: expected %q, got %q", tc.expectedPort, *port)
+			}
+		})
+	}
+}
+
+func TestSetFlagsFromConfig(t *testing.T) {
+	fs := flag.NewFlagSet("mtail", flag.ContinueOnError)
+	var logs seqStringFlag
+	fs.Var(&logs, "logs", "")
+	progs := fs.String("progs", "", "")
+	port := fs.String("port", "3903", "")
+	oneShot := fs.Bool("one_shot", false, "")
+	testutil.FatalIfErr(t, fs.Parse([]string{"--port", "3905"}))
+
+	commandline, err := setFlagsFromConfig(fs, []mtail.ConfigFlag{
+		{Name: "logs", Value: "/var/log/a.log,/var/log/b.log"},
+		{Name: "logs", Value: "/var/log/c.log"},
+		{Name: "progs", Value: "/etc/mtail"},
+		{Name: "port", Value: "4000"},
+		{Name: "one_shot", Value: "true"},
+	})
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff([]string{"port"}, commandline); diff != "" {
+		t.Errorf("commandline flags didn't match:\n%s", diff)
+	}
+	if diff := testutil.Diff([]string{"/var/log/a.log", "/var/log/b.log", "/var/log/c.log"}, []string(logs)); diff != "" {
+		t.Errorf("logs didn't match:\n%s", diff)
+	}
+	if *progs != "/etc/mtail" {
+		t.Errorf("progs: expected %q, got %q", "/etc/mtail", *progs)
+	}
+	if *port != "3905" {
+		t.Errorf("port: expected %q, got %q", "3905", *port)
+	}
+	if !*oneShot {
+		t.Error("one_shot: expected true")
+	}
+
+	if _, err := setFlagsFromConfig(fs, []mtail.ConfigFlag{{Name: "no_such_flag", Value: "1"}}); err == nil {
+		t.Error("expected error for an unknown flag")
+	}
+}
+
+func TestStartProfiles(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "mtail_profile")
+	testutil.FatalIfErr(t, err)
+	defer os.RemoveAll(workdir)
+	cpuPath := filepath.Join(workdir, "cpu.prof")
+	memPath := filepath.Join(workdir, "mem.mprof")
+
+	stop, err := startProfiles(cpuPath, memPath, time.Hour)
+	testutil.FatalIfErr(t, err)
+	stop()
+	// Stopping again, as on exit after the duration, does nothing.
+	stop()
+	for _, path := range []string{cpuPath, memPath} {
+		fi, err := os.Stat(path)
+		testutil.FatalIfErr(t, err)
+		if fi.Size() == 0 {
+			t.Errorf("profile %s is empty", path)
+		}
+	}
+
+	if _, err := startProfiles(filepath.Join(workdir, "missing", "cpu.prof"), "", time.Hour); err == nil {
+		t.Error("expected error for a CPU profile in a missing directory")
+	}
+}
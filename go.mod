@@ -4,15 +4,22 @@ go 1.13
 
 require (
 	contrib.go.opencensus.io/exporter/jaeger v0.2.0
+	github.com/antchfx/xpath v1.1.10
+	github.com/axiomhq/hyperloglog v0.1.0
 	github.com/dvyukov/go-fuzz v0.0.0-20191206100749-a378175e205c // indirect
 	github.com/flazz/togo v0.0.0-20170320145504-babdbf21cff0 // indirect
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e
+	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.4.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.4.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.9.1
+	github.com/segmentio/kafka-go v0.4.10
 	github.com/uber/jaeger-client-go v2.22.1+incompatible // indirect
 	go.opencensus.io v0.22.2
 	golang.org/x/net v0.0.0-20191204025024-5ee1b9f4859a // indirect
@@ -21,4 +28,5 @@ require (
 	google.golang.org/api v0.15.0 // indirect
 	google.golang.org/genproto v0.0.0-20200117163144-32f20d992d24 // indirect
 	google.golang.org/grpc v1.26.0 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
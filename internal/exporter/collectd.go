@@ -8,12 +8,13 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/mtail/internal/metrics"
 )
 
 const (
-	collectdFormat = "PUTVAL \"%s/%smtail-%s/%s-%s\" interval=%d %s:%s\n"
+	collectdFormat = "PUTVAL \"%s/%smtail-%s/%s-%s\" interval=%d %d:%s\n"
 )
 
 var (
@@ -28,20 +29,20 @@ var (
 
 // metricToCollectd encodes the metric data in the collectd text protocol format.  The
 // metric lock is held before entering this function.
-func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+func metricToCollectd(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string {
 	return fmt.Sprintf(collectdFormat,
 		hostname,
 		*collectdPrefix,
 		m.Program,
 		kindToCollectdType(m.Kind),
-		formatLabels(m.Name, l.Labels, "-", "-", "_"),
+		formatLabels(name, l.Labels, "-", "-", "_"),
 		*pushInterval,
-		l.Datum.TimeString(),
+		exportTime(m, l, time.Now()).Unix(),
 		l.Datum.ValueString())
 }
 
 func kindToCollectdType(kind metrics.Kind) string {
-	if kind != metrics.Timer {
+	if kind != metrics.Timer && kind != metrics.Window && kind != metrics.Info && kind != metrics.HLL {
 		return strings.ToLower(kind.String())
 	}
 	return "gauge"
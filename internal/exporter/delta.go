@@ -0,0 +1,161 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// counterDeltas holds the values of the counters last pushed to each push
+// target, so that counters can be pushed as the change since the last push,
+// or with their rate over the time since the last push.
+type counterDeltas struct {
+	mu      sync.Mutex
+	targets map[string]*targetDeltas // by target
+}
+
+// targetDeltas holds the values of the counters last pushed to a target.  Its
+// lock is held by a push to the target from begin to end, so that concurrent
+// pushes to a target take turns.
+type targetDeltas struct {
+	mu       sync.Mutex
+	last     map[string]interface{} // series key to last pushed value
+	lastTime time.Time              // time of the last push, or zero if there was none
+}
+
+// deltaPush converts the counters of one push to a target to deltas, and
+// computes their rates.
+type deltaPush struct {
+	target *targetDeltas          // the state of the target pushed to
+	next   map[string]interface{} // values pushed this time
+
+	now     time.Time     // time of this push
+	elapsed time.Duration // time since the last push, or zero if there was none
+
+	deltas bool           // if set, counters are pushed as deltas
+	rates  *regexp.Regexp // if not nil, counters whose names match also have their rate pushed
+}
+
+// begin starts a push to target at now, waiting for any other push to target
+// to end first.  The push must be ended with end.
+func (c *counterDeltas) begin(target string, now time.Time) *deltaPush {
+	c.mu.Lock()
+	t, ok := c.targets[target]
+	if !ok {
+		if c.targets == nil {
+			c.targets = make(map[string]*targetDeltas)
+		}
+		t = &targetDeltas{}
+		c.targets[target] = t
+	}
+	c.mu.Unlock()
+	t.mu.Lock()
+	p := &deltaPush{target: t, next: make(map[string]interface{}), now: now}
+	if !t.lastTime.IsZero() {
+		p.elapsed = now.Sub(t.lastTime)
+	}
+	return p
+}
+
+// end ends the push p.  If it completed, its values are recorded for the
+// next push to the target, and series that weren't pushed are forgotten.
+// Nothing is done if p is nil.
+func (p *deltaPush) end(completed bool) {
+	if p == nil {
+		return
+	}
+	if completed {
+		p.target.last = p.next
+		p.target.lastTime = p.now
+	}
+	p.target.mu.Unlock()
+}
+
+// apply returns the exported label set l of metric m with the change in its
+// value since the last push as its datum, if m is a counter and deltas are
+// pushed.  A counter lower than last pushed has been reset, so its whole value
+// is the change.  Other kinds of metric are returned unchanged, as is
+// everything if p is nil.  If the rate of m is pushed, apply also returns a
+// label set with the change per second since the last push as its datum, or
+// nil if there is none, as on the first push.
+func (p *deltaPush) apply(m *metrics.Metric, l *metrics.LabelSet) (*metrics.LabelSet, *metrics.LabelSet) {
+	if p == nil || m.Kind != metrics.Counter {
+		return l, nil
+	}
+	key := seriesKey(m.Name, l.Labels)
+	var (
+		d      datum.Datum
+		change float64
+		seen   bool
+	)
+	switch v := l.Datum.(type) {
+	case *datum.Int:
+		cur := v.Get()
+		p.next[key] = cur
+		var last int64
+		if last, seen = p.target.last[key].(int64); seen && last <= cur {
+			cur -= last
+		}
+		d = datum.MakeInt(cur, v.TimeUTC())
+		change = float64(cur)
+	case *datum.Float:
+		cur := v.Get()
+		p.next[key] = cur
+		var last float64
+		if last, seen = p.target.last[key].(float64); seen && last <= cur {
+			cur -= last
+		}
+		d = datum.MakeFloat(cur, v.TimeUTC())
+		change = cur
+	default:
+		return l, nil
+	}
+	var rate *metrics.LabelSet
+	if p.rates != nil && p.rates.MatchString(m.Name) && seen && p.elapsed > 0 {
+		rate = &metrics.LabelSet{Labels: l.Labels, Datum: datum.MakeFloat(change/p.elapsed.Seconds(), d.TimeUTC())}
+	}
+	if !p.deltas {
+		return l, rate
+	}
+	return &metrics.LabelSet{Labels: l.Labels, Datum: d}, rate
+}
+
+// seriesKey returns the key of the series of the metric name with labels as
+// it is exported, so that a series keeps its key when the program that
+// declared it changes.
+func seriesKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// rateMetric returns the gauge that the rate of counter m is pushed as.
+func rateMetric(m *metrics.Metric) *metrics.Metric {
+	return &metrics.Metric{
+		Name:       m.Name + "_rate",
+		Program:    m.Program,
+		Kind:       metrics.Gauge,
+		Type:       metrics.Float,
+		Keys:       m.Keys,
+		TimeSource: m.TimeSource,
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeltaCounters(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	store := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(requests))
+	seconds := metrics.NewMetric("seconds", "prog", metrics.Counter, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(seconds))
+	queue := metrics.NewMetric("queue", "prog", metrics.Gauge, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(queue))
+	set := func(r200, r500 int64, s float64, q int64) {
+		d, _ := requests.GetDatum("200")
+		datum.SetInt(d, r200, ts)
+		d, _ = requests.GetDatum("500")
+		datum.SetInt(d, r500, ts)
+		d, _ = seconds.GetDatum()
+		datum.SetFloat(d, s, ts)
+		d, _ = queue.GetDatum()
+		datum.SetInt(d, q, ts)
+	}
+
+	e, err := New(store, Hostname("gunstar"), DeltaCounters)
+	testutil.FatalIfErr(t, err)
+	format := func(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string {
+		return fmt.Sprintf("%s %v %s\n", name, l.Labels, l.Datum.ValueString())
+	}
+	total, success := new(expvar.Int), new(expvar.Int)
+	push := func() []string {
+		var b strings.Builder
+		p := e.beginPush("target", time.Now())
+		testutil.FatalIfErr(t, e.writeSocketMetrics(&b, format, total, success, p))
+		p.end(true)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+
+	for _, tc := range []struct {
+		name          string
+		r200, r500    int64
+		s             float64
+		q             int64
+		expectedLines []string
+	}{
+		{"first push is the whole value", 10, 1, 1.5, 4, []string{
+			"queue map[] 4",
+			"requests map[code:200] 10",
+			"requests map[code:500] 1",
+			"seconds map[] 1.5",
+		}},
+		{"then the change", 15, 1, 2.25, 3, []string{
+			"queue map[] 3",
+			"requests map[code:200] 5",
+			"requests map[code:500] 0",
+			"seconds map[] 0.75",
+		}},
+		{"reset counters push their value", 2, 1, 2.25, 3, []string{
+			"queue map[] 3",
+			"requests map[code:200] 2",
+			"requests map[code:500] 0",
+			"seconds map[] 0",
+		}},
+	} {
+		set(tc.r200, tc.r500, tc.s, tc.q)
+		if diff := testutil.Diff(tc.expectedLines, push()); diff != "" {
+			t.Errorf("%s: diff:\n%s", tc.name, diff)
+		}
+	}
+
+	// A push to another target gets the whole values.
+	p := e.beginPush("other", time.Now())
+	d, _ := requests.GetDatum("200")
+	if l, _ := p.apply(requests, &metrics.LabelSet{Labels: map[string]string{"code": "200"}, Datum: d}); datum.GetInt(l.Datum) != 2 {
+		t.Errorf("expected whole value 2 for another target, got %d", datum.GetInt(l.Datum))
+	}
+	p.end(false)
+
+	// A series keeps its deltas when the program it's exported with changes.
+	requests.Program = "other"
+	datum.SetInt(d, 7, ts)
+	if diff := testutil.Diff([]string{
+		"queue map[] 3",
+		"requests map[code:200] 5",
+		"requests map[code:500] 0",
+		"seconds map[] 0",
+	}, push()); diff != "" {
+		t.Errorf("program changed: diff:\n%s", diff)
+	}
+	requests.Program = "prog"
+
+	// Prometheus is served the cumulative values.
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{code="200",prog="prog"} 7
+requests{code="500",prog="prog"} 1
+`
+	if err := promtest.CollectAndCompare(e, strings.NewReader(expected), "requests"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateCounters(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	store := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(requests))
+	seconds := metrics.NewMetric("seconds", "prog", metrics.Counter, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(seconds))
+	set := func(r200 int64, s float64) {
+		d, _ := requests.GetDatum("200")
+		datum.SetInt(d, r200, ts)
+		d, _ = seconds.GetDatum()
+		datum.SetFloat(d, s, ts)
+	}
+
+	e, err := New(store, Hostname("gunstar"), RateCounters("requests"))
+	testutil.FatalIfErr(t, err)
+	format := func(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string {
+		return fmt.Sprintf("%s %s %v %s\n", m.Kind, name, l.Labels, l.Datum.ValueString())
+	}
+	total, success := new(expvar.Int), new(expvar.Int)
+	now := time.Unix(1343124900, 0)
+	push := func(elapsed time.Duration) []string {
+		now = now.Add(elapsed)
+		var b strings.Builder
+		p := e.beginPush("target", now)
+		testutil.FatalIfErr(t, e.writeSocketMetrics(&b, format, total, success, p))
+		p.end(true)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+
+	for _, tc := range []struct {
+		name          string
+		elapsed       time.Duration
+		r200          int64
+		s             float64
+		expectedLines []string
+	}{
+		{"first push has no rate", 0, 10, 1.5, []string{
+			"Counter requests map[code:200] 10",
+			"Counter seconds map[] 1.5",
+		}},
+		{"then the change per second", 10 * time.Second, 25, 2.5, []string{
+			"Counter requests map[code:200] 25",
+			"Counter seconds map[] 2.5",
+			"Gauge requests_rate map[code:200] 1.5",
+		}},
+		{"reset counters count from zero", 4 * time.Second, 2, 2.5, []string{
+			"Counter requests map[code:200] 2",
+			"Counter seconds map[] 2.5",
+			"Gauge requests_rate map[code:200] 0.5",
+		}},
+	} {
+		set(tc.r200, tc.s)
+		if diff := testutil.Diff(tc.expectedLines, push(tc.elapsed)); diff != "" {
+			t.Errorf("%s: diff:\n%s", tc.name, diff)
+		}
+	}
+
+	// Prometheus isn't served the rates.
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{code="200",prog="prog"} 2
+`
+	if err := promtest.CollectAndCompare(e, strings.NewReader(expected), "requests", "requests_rate"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeltaPushesTakeTurns(t *testing.T) {
+	var c counterDeltas
+	p := c.begin("target", time.Unix(10, 0))
+	p.next["a"] = int64(1)
+	second := make(chan *deltaPush)
+	go func() { second <- c.begin("target", time.Unix(20, 0)) }()
+	select {
+	case <-second:
+		t.Fatal("second push began before the first ended")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.end(true)
+	q := <-second
+	defer q.end(false)
+	if q.elapsed != 10*time.Second || q.target.last["a"] != int64(1) {
+		t.Errorf("second push didn't see the first: elapsed %s, last %v", q.elapsed, q.target.last)
+	}
+}
@@ -6,25 +6,49 @@
 package exporter
 
 import (
+	"context"
 	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/kafka"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Commandline Flags.
 var (
 	pushInterval = flag.Int("metric_push_interval_seconds", 60,
 		"Interval between metric pushes, in seconds.")
+	pushIntervalJitter = flag.Float64("metric_push_interval_jitter", 0,
+		"Fraction of --metric_push_interval_seconds by which each interval between metric pushes is varied at random, so that many mtail instances started together don't push at once.  For example, 0.1 varies each interval by up to 10% either way.")
+	pushAlign = flag.Bool("metric_push_align", false,
+		"Push metrics at multiples of --metric_push_interval_seconds on the wall clock, such as at :00 and :30 past each minute for an interval of 30, rather than an interval after mtail started.  Combined with --metric_push_interval_jitter, each push is varied at random around its aligned time.")
 	writeDeadline = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
+	scrapeTimeout = flag.Duration("scrape_timeout", 30*time.Second, "Time to wait for a push of metrics over HTTP, such as to OpenTSDB, to complete.  Pushes that time out are retried with exponential backoff.")
+	flushTimeout  = flag.Duration("flush_timeout", 10*time.Second, "Time to wait for the final push of metrics on shutdown to complete.")
+)
+
+// pushTimeouts counts the pushes to collectors that timed out.
+var pushTimeouts = expvar.NewInt("exporter_push_timeouts_total")
+
+// pushRetries is the number of times a push that times out is retried, and
+// pushRetryBackoff the delay before the first retry.
+var (
+	pushRetries      = 3
+	pushRetryBackoff = time.Second
 )
 
 // Exporter manages the export of metrics to passive and active collectors.
@@ -34,6 +58,43 @@ type Exporter struct {
 	omitProgLabel bool
 	emitTimestamp bool
 	pushTargets   []pushOptions
+	labelRenames  map[string]map[string]string // metric name to label key to exported label key
+	relabelRules  []relabelRule                // applied in order to the labels of each exported series
+	allowMetrics  *regexp.Regexp               // if not nil, only metrics with matching names are exported
+	denyMetrics   *regexp.Regexp               // if not nil, metrics with matching names are not exported
+
+	maxLabelValueLength int      // if positive, label keys and values are sanitized, and values truncated to this many characters
+	labelReplaceChar    string   // replaces invalid characters in label keys when sanitizing
+	labelKeyCollisions  sync.Map // metric names and sanitized label keys already reported as colliding
+
+	instanceLabel string // if set, the key of a label with the hostname as its value added to every exported metric
+
+	openTSDBURL string // if set, the OpenTSDB put endpoint to push metrics to
+
+	remoteWriteURL      string               // if set, the Prometheus remote write endpoint to push metrics to
+	remoteWriteRegistry *prometheus.Registry // gathers the metrics for remote write
+
+	kafka                 kafkaProducer // if not nil, the producer of the Kafka topic to push metrics to
+	kafkaTopic            string        // the Kafka topic to push metrics to
+	kafkaMessagePerMetric bool          // if set, each metric is a Kafka message of its own
+	kafkaMaxMessageBytes  int           // the largest Kafka message produced
+
+	emitStaleMarkers bool // if set, series removed from the store are served once more with the staleness marker value
+
+	pushIntervalMu sync.Mutex
+	pushInterval   time.Duration // interval between metric pushes
+
+	deltaCounters bool           // if set, counters are pushed as the change since the last push
+	rateCounters  *regexp.Regexp // if not nil, counters with matching names also have their rate pushed
+	deltas        counterDeltas  // the counter values last pushed to each target
+
+	outputFile         string               // if set, the file to write the metrics to at each push
+	outputFileMu       sync.Mutex           // serialises writes of the output file
+	outputFileRegistry *prometheus.Registry // gathers the metrics for the output file
+
+	takeMu  sync.Mutex                  // serialises the exports that take the values of @reset_on_export metrics
+	takenMu sync.RWMutex                // protects taken
+	taken   map[datum.Datum]datum.Datum // the values taken from @reset_on_export metrics for the export in progress
 }
 
 // Hostname is an option that specifies the mtail hostname to use in exported metrics.
@@ -56,12 +117,122 @@ func EmitTimestamp(e *Exporter) error {
 	return nil
 }
 
+// EmitStaleMarkers instructs the exporter to serve each series removed from
+// the store, by expiry, eviction, or the unloading of its program, once more
+// with the Prometheus staleness marker as its value, so that it is marked
+// stale as soon as the next scrape in the protobuf format.
+func EmitStaleMarkers(e *Exporter) error {
+	e.emitStaleMarkers = true
+	return nil
+}
+
+// DeltaCounters instructs the exporter to push counters to collectors as the
+// change in their value since the last push to the same collector, rather than
+// their cumulative value.  Metrics collected by Prometheus are unaffected.
+func DeltaCounters(e *Exporter) error {
+	e.deltaCounters = true
+	return nil
+}
+
+// RateCounters instructs the exporter to push a gauge named with a "_rate"
+// suffix alongside each counter whose name matches the regular expression
+// pattern in full, with the counter's change per second since the last push
+// to the same collector as its value.  Metrics collected by Prometheus are
+// unaffected.
+func RateCounters(pattern string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "invalid counter rate pattern %q", pattern)
+		}
+		e.rateCounters = re
+		return nil
+	}
+}
+
+// RenameLabel instructs the exporter to export the label key from of the
+// metric named metric as the key to, leaving the label values unchanged.
+func RenameLabel(metric, from, to string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if metric == "" || from == "" || to == "" {
+			return errors.Errorf("invalid label rename of %q from %q to %q", metric, from, to)
+		}
+		if e.labelRenames == nil {
+			e.labelRenames = make(map[string]map[string]string)
+		}
+		if e.labelRenames[metric] == nil {
+			e.labelRenames[metric] = make(map[string]string)
+		}
+		e.labelRenames[metric][from] = to
+		return nil
+	}
+}
+
+// AllowMetrics instructs the exporter to export only the metrics whose names
+// match the regular expression pattern in full.
+func AllowMetrics(pattern string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "invalid metric allow pattern %q", pattern)
+		}
+		e.allowMetrics = re
+		return nil
+	}
+}
+
+// DenyMetrics instructs the exporter not to export the metrics whose names
+// match the regular expression pattern in full.
+func DenyMetrics(pattern string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "invalid metric deny pattern %q", pattern)
+		}
+		e.denyMetrics = re
+		return nil
+	}
+}
+
+// SanitizeLabels instructs the exporter to clean up the labels of exported
+// metrics, which may contain arbitrary text from the logs.  Null bytes in
+// label values are escaped, and values are truncated to maxValueLength
+// characters.  Characters other than letters, digits and underscores in label
+// keys are replaced with replaceChar, which must itself be made of those.
+func SanitizeLabels(maxValueLength int, replaceChar string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if maxValueLength <= 0 {
+			return errors.Errorf("invalid maximum label value length %d", maxValueLength)
+		}
+		if replaceChar == "" || invalidLabelKeyChars.MatchString(replaceChar) {
+			return errors.Errorf("invalid label key replacement %q: must be letters, digits and underscores", replaceChar)
+		}
+		e.maxLabelValueLength = maxValueLength
+		e.labelReplaceChar = replaceChar
+		return nil
+	}
+}
+
+// InstanceLabel instructs the exporter to add a label with the given key and
+// the hostname as its value to every exported metric, so that metrics from
+// many mtail instances can be told apart.  A metric's own label of the same
+// key takes precedence.
+func InstanceLabel(key string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		if key == "" || key == "prog" {
+			return errors.Errorf("invalid instance label key %q", key)
+		}
+		e.instanceLabel = key
+		return nil
+	}
+}
+
 // New creates a new Exporter.
 func New(store *metrics.Store, options ...func(*Exporter) error) (*Exporter, error) {
 	if store == nil {
 		return nil, errors.New("exporter needs a Store")
 	}
-	e := &Exporter{store: store}
+	e := &Exporter{store: store, pushInterval: time.Duration(*pushInterval) * time.Second, kafkaMaxMessageBytes: *kafkaMaxMessageBytes}
 	if err := e.SetOption(options...); err != nil {
 		return nil, err
 	}
@@ -74,6 +245,10 @@ func New(store *metrics.Store, options ...func(*Exporter) error) (*Exporter, err
 		}
 	}
 
+	if *pushIntervalJitter < 0 || *pushIntervalJitter >= 1 {
+		return nil, errors.Errorf("metric push interval jitter must be at least 0 and less than 1: %g", *pushIntervalJitter)
+	}
+
 	if *collectdSocketPath != "" {
 		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
 		e.RegisterPushExport(o)
@@ -86,6 +261,35 @@ func New(store *metrics.Store, options ...func(*Exporter) error) (*Exporter, err
 		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
 		e.RegisterPushExport(o)
 	}
+	e.openTSDBURL = *openTSDBURL
+	if *remoteWriteURL != "" {
+		e.remoteWriteURL = *remoteWriteURL
+		e.remoteWriteRegistry = prometheus.NewRegistry()
+		e.remoteWriteRegistry.MustRegister(pushCollector{e})
+	}
+	if *kafkaBrokers != "" {
+		if *kafkaTopic == "" {
+			return nil, errors.New("Kafka brokers given without a topic")
+		}
+		if *kafkaMaxMessageBytes <= kafka.MessageOverhead {
+			return nil, errors.Errorf("Kafka max message bytes must be more than %d: %d", kafka.MessageOverhead, *kafkaMaxMessageBytes)
+		}
+		p, err := newKafkaProducer()
+		if err != nil {
+			return nil, err
+		}
+		e.kafka = p
+		e.kafkaTopic = *kafkaTopic
+		e.kafkaMessagePerMetric = *kafkaMessagePerMetric
+	}
+	if *outputFile != "" {
+		e.outputFile = *outputFile
+		e.outputFileRegistry = prometheus.NewRegistry()
+		e.outputFileRegistry.MustRegister(pushCollector{e})
+	}
+	if e.emitStaleMarkers {
+		store.TrackStaleSeries(true)
+	}
 
 	return e, nil
 }
@@ -118,15 +322,135 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 	return r
 }
 
-// Format a LabelSet into a string to be written to one of the timeseries
-// sockets.
-type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
+// exported returns true if the metric named name passes the allow and deny
+// patterns of the Exporter.
+func (e *Exporter) exported(name string) bool {
+	if e.allowMetrics != nil && !e.allowMetrics.MatchString(name) {
+		return false
+	}
+	if e.denyMetrics != nil && e.denyMetrics.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// exportNames returns the names that metric m is exported under: its own
+// name, followed by any aliases.
+func exportNames(m *metrics.Metric) []string {
+	if len(m.Aliases) == 0 {
+		return []string{m.Name}
+	}
+	return append([]string{m.Name}, m.Aliases...)
+}
+
+// exportTime returns the timestamp to export the datum of LabelSet l of
+// metric m with: the time it was last updated, or now if m is timestamped
+// with the scrape time.
+func exportTime(m *metrics.Metric, l *metrics.LabelSet, now time.Time) time.Time {
+	if m.TimeSource == metrics.ScrapeTime {
+		return now
+	}
+	return l.Datum.TimeUTC()
+}
+
+// rewritesLabels returns true if exportLabels may change the labels of metric m.
+func (e *Exporter) rewritesLabels(m *metrics.Metric) bool {
+	_, ok := e.labelRenames[m.Name]
+	return ok || len(e.relabelRules) > 0 || e.maxLabelValueLength > 0 || e.instanceLabel != ""
+}
+
+// exportLabels returns the LabelSet l of metric m as it is to be exported,
+// with its label keys renamed and its labels sanitized as configured, and for
+// a metric reset on export, the value taken for the export in progress.  l is
+// returned unchanged if there is nothing to do.  The relabel rules and the
+// instance label are applied here too; nil is returned if a rule drops l.
+func (e *Exporter) exportLabels(m *metrics.Metric, l *metrics.LabelSet) *metrics.LabelSet {
+	if m.ResetOnExport {
+		l = &metrics.LabelSet{Labels: l.Labels, Datum: e.takenDatum(l.Datum)}
+	}
+	if !e.rewritesLabels(m) {
+		return l
+	}
+	renames := e.labelRenames[m.Name]
+	labels := make(map[string]string, len(l.Labels)+1)
+	for k, v := range l.Labels {
+		if to, ok := renames[k]; ok {
+			k = to
+		}
+		labels[k] = v
+	}
+	if !relabel(e.relabelRules, m.Name, labels) {
+		return nil
+	}
+	if e.maxLabelValueLength > 0 {
+		sanitized := make(map[string]string, len(labels)+1)
+		from := make(map[string]string, len(labels)) // the original key of each sanitized key
+		for k, v := range labels {
+			sk, sv := e.sanitizeLabel(m.Name, k, v)
+			if o, ok := from[sk]; ok {
+				e.reportLabelKeyCollision(m.Name, o, k, sk)
+				// Keep the label whose key needed no replacing, or else the
+				// first in order, so the choice doesn't change between exports.
+				if o == sk || (k != sk && o < k) {
+					continue
+				}
+			}
+			from[sk] = k
+			sanitized[sk] = sv
+		}
+		labels = sanitized
+	}
+	if e.instanceLabel != "" {
+		if _, ok := labels[e.instanceLabel]; !ok {
+			labels[e.instanceLabel] = e.hostname
+		}
+	}
+	return &metrics.LabelSet{Labels: labels, Datum: l.Datum}
+}
+
+var invalidLabelKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// sanitizeLabel returns the label key k and value v of the metric named name
+// with invalid characters in k replaced, null bytes in v escaped, and v
+// truncated to the maximum label value length.
+func (e *Exporter) sanitizeLabel(name, k, v string) (string, string) {
+	k = invalidLabelKeyChars.ReplaceAllLiteralString(k, e.labelReplaceChar)
+	s := strings.Replace(v, "\x00", `\x00`, -1)
+	if r := []rune(s); len(r) > e.maxLabelValueLength {
+		s = string(r[:e.maxLabelValueLength])
+	}
+	if s != v {
+		glog.V(2).Infof("Sanitized value of label %q of metric %q: %q", k, name, v)
+	}
+	return k, s
+}
+
+// reportLabelKeyCollision logs, once per metric and key, that the label keys a
+// and b of the metric named name are both sanitized to k.
+func (e *Exporter) reportLabelKeyCollision(name, a, b, k string) {
+	if _, reported := e.labelKeyCollisions.LoadOrStore(name+"\x00"+k, true); reported {
+		return
+	}
+	if a > b {
+		a, b = b, a
+	}
+	glog.Warningf("Label keys %q and %q of metric %q are both sanitized to %q, so only one is exported", a, b, name, k)
+}
+
+// Format a LabelSet of a metric, exported under the given name, into a string
+// to be written to one of the timeseries sockets.
+type formatter func(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+// writeSocketMetrics writes all the exported metrics to c, formatted by f.
+// Counters are converted to deltas, and their rates added, by p, if not nil.
+func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int, p *deltaPush) error {
 	e.store.RLock()
 	defer e.store.RUnlock()
 
-	for _, ml := range e.store.Metrics {
+	for name, ml := range e.store.Metrics {
+		if !e.exported(name) {
+			continue
+		}
 		for _, m := range ml {
 			m.RLock()
 			// Don't try to send text metrics to any push service.
@@ -138,13 +462,30 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
 			for l := range lc {
-				line := f(e.hostname, m, l)
-				n, err := fmt.Fprint(c, line)
-				glog.V(2).Infof("Sent %d bytes\n", n)
-				if err == nil {
+				if l = e.exportLabels(m, l); l == nil {
+					continue
+				}
+				l, rate := p.apply(m, l)
+				lines := make([]string, 0, 2*len(exportNames(m)))
+				for _, exportName := range exportNames(m) {
+					lines = append(lines, f(e.hostname, exportName, m, l))
+				}
+				if rate != nil {
+					for _, exportName := range exportNames(m) {
+						lines = append(lines, f(e.hostname, exportName+"_rate", rateMetric(m), rate))
+					}
+				}
+				for _, line := range lines {
+					n, err := fmt.Fprint(c, line)
+					glog.V(2).Infof("Sent %d bytes\n", n)
+					if err != nil {
+						// Let the label set emitter finish before unlocking.
+						for range lc {
+						}
+						m.RUnlock()
+						return errors.Wrap(err, "write error")
+					}
 					exportSuccess.Add(1)
-				} else {
-					return errors.Errorf("write error: %s\n", err)
 				}
 			}
 			m.RUnlock()
@@ -153,42 +494,303 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 	return nil
 }
 
-// PushMetrics sends metrics to each of the configured services.
+// PushMetrics sends metrics to each of the configured services.  Pushes that
+// time out are retried.
 func (e *Exporter) PushMetrics() {
+	e.pushMetrics(context.Background())
+}
+
+// pushMetrics pushes the metrics as PushMetrics does, giving up on the pushes
+// that haven't completed when ctx is done.
+func (e *Exporter) pushMetrics(ctx context.Context) {
+	defer e.takeResetMetrics()()
 	for _, target := range e.pushTargets {
+		target := target
 		glog.V(2).Infof("pushing to %s", target.addr)
-		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
-		if err != nil {
-			glog.Infof("pusher dial error: %s", err)
-			continue
+		if err := withRetries(ctx, func(ctx context.Context) error { return e.pushSocket(ctx, target) }); err != nil {
+			glog.Infof("pusher error: %s", err)
 		}
-		err = conn.SetDeadline(time.Now().Add(*writeDeadline))
-		if err != nil {
-			glog.Infof("Couldn't set deadline on connection: %s", err)
+	}
+	if e.openTSDBURL != "" {
+		glog.V(2).Infof("pushing to %s", e.openTSDBURL)
+		if err := withRetries(ctx, e.pushOpenTSDB); err != nil {
+			glog.Infof("pusher write error: %s", err)
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
-		if err != nil {
+	}
+	if e.remoteWriteURL != "" {
+		glog.V(2).Infof("pushing to %s", e.remoteWriteURL)
+		if err := withRetries(ctx, e.pushRemoteWrite); err != nil {
 			glog.Infof("pusher write error: %s", err)
 		}
-		err = conn.Close()
-		if err != nil {
+	}
+	if e.kafka != nil {
+		glog.V(2).Infof("pushing to Kafka topic %s", e.kafkaTopic)
+		if err := withRetries(ctx, e.pushKafka); err != nil {
+			glog.Infof("pusher write error: %s", err)
+		}
+	}
+	if e.outputFile != "" {
+		glog.V(2).Infof("writing to %s", e.outputFile)
+		if err := e.writeOutputFile(); err != nil {
+			fileWriteErrors.Add(1)
+			glog.Infof("output file write error: %s", err)
+		}
+	}
+}
+
+// takeResetMetrics takes the values of the metrics declared @reset_on_export
+// for an export, returning them to their initial values.  Until done is
+// called, the exported metrics have the values taken, so that every push of
+// the export sends the same ones, and updates made meanwhile are kept for the
+// next export.
+func (e *Exporter) takeResetMetrics() (done func()) {
+	e.takeMu.Lock()
+	taken := make(map[datum.Datum]datum.Datum)
+	e.store.RLock()
+	for _, ml := range e.store.Metrics {
+		for _, m := range ml {
+			if m.ResetOnExport {
+				for d, t := range m.Take() {
+					taken[d] = t
+				}
+			}
+		}
+	}
+	e.store.RUnlock()
+	e.takenMu.Lock()
+	e.taken = taken
+	e.takenMu.Unlock()
+	return func() {
+		e.takenMu.Lock()
+		e.taken = nil
+		e.takenMu.Unlock()
+		e.takeMu.Unlock()
+	}
+}
 
+// takenDatum returns the value taken from d for the export in progress, or d
+// itself if none was.
+func (e *Exporter) takenDatum(d datum.Datum) datum.Datum {
+	e.takenMu.RLock()
+	defer e.takenMu.RUnlock()
+	if t, ok := e.taken[d]; ok {
+		return t
+	}
+	return d
+}
+
+// pushes returns true if metrics are pushed to any services or files.
+func (e *Exporter) pushes() bool {
+	return len(e.pushTargets) > 0 || e.openTSDBURL != "" || e.remoteWriteURL != "" || e.kafka != nil || e.outputFile != ""
+}
+
+// pushSocket sends metrics to the service described by target over a new
+// connection.
+func (e *Exporter) pushSocket(ctx context.Context, target pushOptions) error {
+	d := net.Dialer{Timeout: *writeDeadline}
+	conn, err := d.DialContext(ctx, target.net, target.addr)
+	if err != nil {
+		return errors.Wrap(err, "dial error")
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
 			glog.Infof("connection close failed: %s", err)
 		}
+	}()
+	deadline := time.Now().Add(*writeDeadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		glog.Infof("Couldn't set deadline on connection: %s", err)
+	}
+	p := e.beginPush(target.addr, time.Now())
+	err = e.writeSocketMetrics(conn, target.f, target.total, target.success, p)
+	p.end(err == nil)
+	if err != nil {
+		return partialPushError{err}
+	}
+	return nil
+}
+
+// beginPush starts a push to target at now, returning the deltaPush that
+// converts its counters to deltas and computes their rates, or nil if neither
+// is pushed.  The push must be ended with its end method.
+func (e *Exporter) beginPush(target string, now time.Time) *deltaPush {
+	if !e.deltaCounters && e.rateCounters == nil {
+		return nil
+	}
+	p := e.deltas.begin(target, now)
+	p.deltas = e.deltaCounters
+	p.rates = e.rateCounters
+	return p
+}
+
+// isTimeout returns true if err was caused by a network operation timing out.
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
+// isTemporary returns true if err was caused by a failure that may not
+// recur, such as a Kafka broker being unavailable.
+func isTemporary(err error) bool {
+	te, ok := errors.Cause(err).(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// partialPushError is the error of a push that may have delivered some of the
+// metrics before failing, such as a write to a line protocol collector, so
+// that retrying it could deliver them twice.
+type partialPushError struct {
+	error
+}
+
+// Cause returns the error that the push failed with.
+func (e partialPushError) Cause() error {
+	return e.error
+}
+
+// withRetries calls push, and while it times out or fails temporarily
+// retries it up to pushRetries times, doubling the delay before each retry
+// from pushRetryBackoff.  Timeouts are counted.  Other errors, and those of
+// pushes that may have partly succeeded, aren't retried.  No retry is made
+// that would wait past the deadline of ctx.
+func withRetries(ctx context.Context, push func(context.Context) error) error {
+	backoff := pushRetryBackoff
+	for i := 0; ; i++ {
+		err := push(ctx)
+		if err == nil {
+			return nil
+		}
+		timeout := isTimeout(err)
+		if timeout {
+			pushTimeouts.Add(1)
+		}
+		if _, ok := err.(partialPushError); ok {
+			return err
+		}
+		if !timeout && !isTemporary(err) {
+			return err
+		}
+		if i == pushRetries {
+			return err
+		}
+		if d, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(d) {
+			return err
+		}
+		glog.Infof("push failed, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// Flush pushes the metrics to the configured services one last time, and
+// waits for the push to complete or --flush_timeout to elapse, so that the
+// updates since the last periodic push aren't lost on shutdown.  A push still
+// in progress at the timeout is cancelled.
+func (e *Exporter) Flush() error {
+	if !e.pushes() {
+		return nil
+	}
+	glog.Info("Flushing metrics to push targets.")
+	ctx, cancel := context.WithTimeout(context.Background(), *flushTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		e.pushMetrics(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Errorf("final metric push didn't complete within %s", *flushTimeout)
 	}
 }
 
 // StartMetricPush pushes metrics to the configured services each interval.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) > 0 {
+	if e.pushes() {
 		glog.Info("Started metric push.")
-		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
-		go func() {
-			for range ticker.C {
-				e.PushMetrics()
-			}
-		}()
+		r := rand.New(rand.NewSource(jitterSeed(e.hostname, os.Getpid(), time.Now())))
+		go e.pushMetricsForever(realClock{}, r)
+	}
+}
+
+// jitterSeed returns a seed for the push interval jitter that differs between
+// instances started together, even in containers where they all have the same
+// PID, by mixing the hostname, PID and start time.
+func jitterSeed(hostname string, pid int, now time.Time) int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d/%d", hostname, pid, now.UnixNano())
+	return int64(h.Sum64())
+}
+
+// clock is the source of time of the metric push schedule.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// pushMetricsForever pushes metrics to the configured services each interval,
+// as measured by c.  Each push, with its retries, is given up after an
+// interval, so that it doesn't run into the next.
+func (e *Exporter) pushMetricsForever(c clock, r *rand.Rand) {
+	for {
+		e.pushIntervalMu.Lock()
+		interval := e.pushInterval
+		e.pushIntervalMu.Unlock()
+		c.Sleep(nextPushDelay(c.Now(), interval, *pushAlign, *pushIntervalJitter, r))
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		e.pushMetrics(ctx)
+		cancel()
+	}
+}
+
+// SetPushInterval changes the interval between metric pushes, once the
+// current interval has elapsed.
+func (e *Exporter) SetPushInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("metric push interval must be positive: %s", interval)
+	}
+	e.pushIntervalMu.Lock()
+	e.pushInterval = interval
+	e.pushIntervalMu.Unlock()
+	return nil
+}
+
+// jitterInterval returns interval varied uniformly at random by up to jitter
+// times interval either way.
+func jitterInterval(interval time.Duration, jitter float64, r *rand.Rand) time.Duration {
+	if jitter == 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * (1 + jitter*(2*r.Float64()-1)))
+}
+
+// nextPushDelay returns the time from now until the next metric push.  If
+// align is set, the push is at the next multiple of interval on the wall
+// clock, varied by the jitter; the multiple is chosen so that a push made
+// early by the jitter isn't repeated for the same multiple.  Otherwise it is
+// the jittered interval.
+func nextPushDelay(now time.Time, interval time.Duration, align bool, jitter float64, r *rand.Rand) time.Duration {
+	d := jitterInterval(interval, jitter, r)
+	if !align {
+		return d
 	}
+	next := now.Add(time.Duration(float64(interval) * jitter)).Truncate(interval).Add(interval)
+	return next.Sub(now) + d - interval
 }
 
 type pushOptions struct {
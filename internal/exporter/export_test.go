@@ -4,9 +4,17 @@
 package exporter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
 	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -42,7 +50,7 @@ func FakeSocketWrite(f formatter, m *metrics.Metric) []string {
 	lc := make(chan *metrics.LabelSet)
 	go m.EmitLabelSets(lc)
 	for l := range lc {
-		ret = append(ret, f("gunstar", m, l))
+		ret = append(ret, f("gunstar", m.Name, m, l))
 	}
 	sort.Strings(ret)
 	return ret
@@ -103,6 +111,20 @@ func TestMetricToCollectd(t *testing.T) {
 	if diff != "" {
 		t.Errorf("prefixed string didn't match:\n%s", diff)
 	}
+
+	// Metrics timestamped with the scrape time are sent with the time of
+	// the push.
+	*graphitePrefix = ""
+	scalarMetric.TimeSource = metrics.ScrapeTime
+	start := time.Now().Unix()
+	r = FakeSocketWrite(metricToGraphite, scalarMetric)
+	var pushed int64
+	if _, err := fmt.Sscanf(r[0], "prog.foo 37 %d\n", &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if pushed < start || pushed > time.Now().Unix() {
+		t.Errorf("expected the push time, got %d", pushed)
+	}
 }
 
 func TestMetricToGraphite(t *testing.T) {
@@ -135,7 +157,7 @@ func TestMetricToGraphite(t *testing.T) {
 		t.Errorf("String didn't match:\n%s", diff)
 	}
 
-	*graphitePrefix = prefix
+	defer testutil.TestSetFlag(t, "graphite_prefix", prefix)()
 	r = FakeSocketWrite(metricToGraphite, dimensionedMetric)
 	expected = []string{
 		"prefixprog.bar.host.quux_com 37 1343124840\n",
@@ -146,6 +168,36 @@ func TestMetricToGraphite(t *testing.T) {
 	}
 }
 
+func TestMetricToGraphiteTagged(t *testing.T) {
+	defer testutil.TestSetFlag(t, "graphite_tagged", "true")()
+	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
+	if terr != nil {
+		t.Errorf("time parse error: %s", terr)
+	}
+
+	scalarMetric := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := scalarMetric.GetDatum()
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(metricToGraphite, scalarMetric)
+	expected := []string{"prog.foo 37 1343124840\n"}
+	if diff := testutil.Diff(expected, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	dimensionedMetric := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int, "host", "code")
+	d, _ = dimensionedMetric.GetDatum("quux.com", "200")
+	datum.SetInt(d, 37, ts)
+	d, _ = dimensionedMetric.GetDatum("~snuh;teevee", "")
+	datum.SetInt(d, 42, ts)
+	r = FakeSocketWrite(metricToGraphite, dimensionedMetric)
+	expected = []string{
+		"prog.bar;code=200;host=quux.com 37 1343124840\n",
+		"prog.bar;host=_snuh_teevee 42 1343124840\n"}
+	if diff := testutil.Diff(expected, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
 func TestMetricToStatsd(t *testing.T) {
 	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
 	if terr != nil {
@@ -190,3 +242,319 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestJitterInterval(t *testing.T) {
+	interval := time.Minute
+	if got := jitterInterval(interval, 0, nil); got != interval {
+		t.Errorf("no jitter: expected %s, got %s", interval, got)
+	}
+
+	// Sample the jittered interval, and check it's uniformly distributed
+	// across 54s to 66s.
+	const (
+		jitter  = 0.1
+		samples = 10000
+		bins    = 10
+	)
+	r := rand.New(rand.NewSource(1))
+	min := time.Duration(float64(interval) * (1 - jitter))
+	max := time.Duration(float64(interval) * (1 + jitter))
+	width := (max - min) / bins
+	var counts [bins]int
+	var sum time.Duration
+	for i := 0; i < samples; i++ {
+		d := jitterInterval(interval, jitter, r)
+		if d < min || d > max {
+			t.Fatalf("jittered interval %s out of range [%s, %s]", d, min, max)
+		}
+		sum += d
+		bin := int((d - min) / width)
+		if bin == bins {
+			bin--
+		}
+		counts[bin]++
+	}
+	if mean := sum / samples; mean < interval-time.Second/4 || mean > interval+time.Second/4 {
+		t.Errorf("mean jittered interval %s not close to %s", mean, interval)
+	}
+	for i, n := range counts {
+		// Expect 1000 per bin; allow for more than four standard deviations of
+		// variation.
+		if n < 850 || n > 1150 {
+			t.Errorf("bin %d of jittered intervals has %d samples, expected about %d: %v", i, n, samples/bins, counts)
+		}
+	}
+}
+
+func TestJitterSeed(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	seed := jitterSeed("host-a", 1, now)
+	// Containers started together all have PID 1.
+	for _, other := range []int64{
+		jitterSeed("host-b", 1, now),
+		jitterSeed("host-a", 1, now.Add(time.Millisecond)),
+		jitterSeed("host-a", 2, now),
+	} {
+		if other == seed {
+			t.Errorf("expected seeds to differ, both %d", seed)
+		}
+	}
+}
+
+func TestNextPushDelay(t *testing.T) {
+	base := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		now      time.Time
+		align    bool
+		expected time.Duration
+	}{
+		{"unaligned", base.Add(10 * time.Second), false, 30 * time.Second},
+		{"aligned", base.Add(10 * time.Second), true, 20 * time.Second},
+		{"aligned on boundary", base, true, 30 * time.Second},
+		{"aligned just before boundary", base.Add(-time.Millisecond), true, time.Millisecond},
+	} {
+		if got := nextPushDelay(tc.now, 30*time.Second, tc.align, 0, nil); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// fakeClock is a clock whose time passes only when it sleeps.  It records the
+// time at the end of each sleep, and stops the goroutine sleeping once it has
+// slept cycles times.
+type fakeClock struct {
+	now         time.Time
+	cycles      int
+	wakes       []time.Time
+	nonPositive bool // Set if asked to sleep for a duration that isn't positive.
+	done        chan struct{}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		c.nonPositive = true
+	}
+	c.now = c.now.Add(d)
+	c.wakes = append(c.wakes, c.now)
+	if len(c.wakes) >= c.cycles {
+		close(c.done)
+		runtime.Goexit()
+	}
+}
+
+func TestPushSchedule(t *testing.T) {
+	const (
+		interval = 30 * time.Second
+		jitter   = 0.1
+		maxDelta = time.Duration(float64(interval) * jitter)
+		cycles   = 200
+	)
+	// The clock starts between aligned times.
+	start := time.Date(2020, 5, 1, 12, 0, 7, 0, time.UTC)
+	for _, align := range []bool{false, true} {
+		align := align
+		t.Run(fmt.Sprintf("align=%v", align), func(t *testing.T) {
+			defer testutil.TestSetFlag(t, "metric_push_interval_jitter", fmt.Sprint(jitter))()
+			defer testutil.TestSetFlag(t, "metric_push_align", fmt.Sprint(align))()
+			e, err := New(metrics.NewStore())
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, e.SetPushInterval(interval))
+			c := &fakeClock{now: start, cycles: cycles, done: make(chan struct{})}
+			go e.pushMetricsForever(c, rand.New(rand.NewSource(1)))
+			<-c.done
+
+			if c.nonPositive {
+				t.Error("slept for a non-positive duration")
+			}
+			last := start
+			lastBoundary := start.Truncate(interval)
+			for i, wake := range c.wakes {
+				if align {
+					// Each push is within the jitter of the next aligned time.
+					boundary := wake.Add(interval / 2).Truncate(interval)
+					if d := wake.Sub(boundary); d < -maxDelta || d > maxDelta {
+						t.Errorf("push %d at %s is %s from aligned time %s, more than %s", i, wake, d, boundary, maxDelta)
+					}
+					if boundary != lastBoundary.Add(interval) {
+						t.Errorf("push %d at %s for aligned time %s, expected %s", i, wake, boundary, lastBoundary.Add(interval))
+					}
+					lastBoundary = boundary
+				} else if d := wake.Sub(last); d < interval-maxDelta || d > interval+maxDelta {
+					t.Errorf("push %d at %s is %s after the last, out of range [%s, %s]", i, wake, d, interval-maxDelta, interval+maxDelta)
+				}
+				last = wake
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("lines", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	pushed := make(chan struct{}, 1)
+	cancelled := make(chan struct{})
+	var block int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed <- struct{}{}
+		if atomic.LoadInt32(&block) != 0 {
+			// The server only notices the client going away once the body is read.
+			_, _ = ioutil.ReadAll(r.Body)
+			<-r.Context().Done()
+			close(cancelled)
+		}
+	}))
+	defer srv.Close()
+
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, e.Flush())
+	select {
+	case <-pushed:
+		t.Fatal("pushed without any push targets")
+	default:
+	}
+
+	e.openTSDBURL = srv.URL
+	testutil.FatalIfErr(t, e.Flush())
+	select {
+	case <-pushed:
+	default:
+		t.Fatal("metrics not pushed on flush")
+	}
+
+	// A push that doesn't complete is cancelled after the flush timeout.
+	atomic.StoreInt32(&block, 1)
+	defer func(old time.Duration) { *flushTimeout = old }(*flushTimeout)
+	*flushTimeout = 10 * time.Millisecond
+	if err := e.Flush(); err == nil {
+		t.Error("expected flush timeout error")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("push not cancelled after the flush timeout")
+	}
+}
+
+func TestPushRetries(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("lines", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	// The first two pushes stall until they time out.
+	var n int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) <= 2 {
+			<-release
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	defer func(old time.Duration) { *scrapeTimeout = old }(*scrapeTimeout)
+	*scrapeTimeout = 50 * time.Millisecond
+	defer func(old time.Duration) { pushRetryBackoff = old }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+	e.openTSDBURL = srv.URL
+	timeouts := pushTimeouts.Value()
+	testutil.FatalIfErr(t, withRetries(context.Background(), e.pushOpenTSDB))
+	if got := pushTimeouts.Value() - timeouts; got != 2 {
+		t.Errorf("expected 2 timeouts, got %d", got)
+	}
+	if got := atomic.LoadInt32(&n); got != 3 {
+		t.Errorf("expected 3 requests, got %d", got)
+	}
+
+	// Other errors aren't retried.
+	calls := 0
+	if err := withRetries(context.Background(), func(context.Context) error { calls++; return errors.New("refused") }); err == nil || calls != 1 {
+		t.Errorf("expected a single failed call, got %d calls and error %v", calls, err)
+	}
+
+	// Nor are timeouts of pushes that may have partly succeeded.
+	calls = 0
+	timeouts = pushTimeouts.Value()
+	if err := withRetries(context.Background(), func(context.Context) error {
+		calls++
+		return partialPushError{timeoutError{}}
+	}); err == nil || calls != 1 {
+		t.Errorf("expected a single partial push, got %d calls and error %v", calls, err)
+	}
+	if got := pushTimeouts.Value() - timeouts; got != 1 {
+		t.Errorf("expected the partial push timeout counted, got %d", got)
+	}
+
+	// Nor are pushes whose backoff would pass the deadline.
+	calls = 0
+	ctx, cancel := context.WithTimeout(context.Background(), pushRetryBackoff/2)
+	defer cancel()
+	if err := withRetries(ctx, func(context.Context) error { calls++; return timeoutError{} }); err == nil || calls != 1 {
+		t.Errorf("expected a single call before the deadline, got %d calls and error %v", calls, err)
+	}
+}
+
+// timeoutError is a network error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// produceFunc is a Kafka producer that calls itself to produce.
+type produceFunc func(ctx context.Context, topic string, values [][]byte) error
+
+func (f produceFunc) Produce(ctx context.Context, topic string, values [][]byte) error {
+	return f(ctx, topic, values)
+}
+
+func TestPushMetricsResetOnExport(t *testing.T) {
+	store := metrics.NewStore()
+	peak := metrics.NewMetric("peak", "test", metrics.Gauge, metrics.Int)
+	peak.ResetOnExport = true
+	d, err := peak.GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, store.Add(peak))
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+
+	var pushed []string
+	e.kafka = produceFunc(func(ctx context.Context, topic string, values [][]byte) error {
+		for _, v := range values {
+			pushed = append(pushed, string(v))
+		}
+		// An update made while the metrics are pushed is kept for the next
+		// push.
+		datum.MaxInt(d, 4, time.Unix(0, 0))
+		return nil
+	})
+	e.kafkaTopic = "metrics"
+
+	datum.MaxInt(d, 10, time.Unix(0, 0))
+	e.PushMetrics()
+	if r := datum.GetInt(d); r != 4 {
+		t.Errorf("expected 4 after the first push, got %d", r)
+	}
+	e.PushMetrics()
+	expected := []string{
+		`[{"Name":"peak","Program":"test","Kind":2,"Type":0,"LabelValues":[{"Value":{"Value":10,"Time":0}}],"ResetOnExport":true,"PrometheusType":"gauge"}]`,
+		`[{"Name":"peak","Program":"test","Kind":2,"Type":0,"LabelValues":[{"Value":{"Value":4,"Time":0}}],"ResetOnExport":true,"PrometheusType":"gauge"}]`,
+	}
+	if diff := testutil.Diff(expected, pushed); diff != "" {
+		t.Errorf("pushed didn't match:\n%s", diff)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	outputFile = flag.String("output_file", "",
+		"Path of a file to write the metrics to in the Prometheus text exposition format at each push interval, e.g. for the node_exporter textfile collector.  The file is gzip compressed if the path ends in .gz.")
+
+	fileWriteErrors = expvar.NewInt("exporter_file_write_errors_total")
+)
+
+// pushCollector collects the exported metrics for the output file and
+// remote write.  It doesn't emit staleness markers, which would otherwise be
+// taken from the Prometheus scrape.  It describes no metrics, making it an
+// unchecked collector, as the metrics change when programs are loaded.
+type pushCollector struct {
+	e *Exporter
+}
+
+func (p pushCollector) Describe(c chan<- *prometheus.Desc) {}
+
+func (p pushCollector) Collect(c chan<- prometheus.Metric) {
+	p.e.collect(c)
+}
+
+// writeOutputFile writes the metrics to the output file in the Prometheus text
+// exposition format.  The metrics are written to a temporary file in the same
+// directory, which is then renamed over the output file, so that readers never
+// see a partly written file.
+func (e *Exporter) writeOutputFile() error {
+	e.outputFileMu.Lock()
+	defer e.outputFileMu.Unlock()
+	mfs, err := e.outputFileRegistry.Gather()
+	if err != nil {
+		return errors.Wrap(err, "gathering metrics")
+	}
+	dir, base := filepath.Split(e.outputFile)
+	f, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	bw := bufio.NewWriter(f)
+	w := io.Writer(bw)
+	var gz *gzip.Writer
+	if strings.HasSuffix(e.outputFile, ".gz") {
+		gz = gzip.NewWriter(bw)
+		w = gz
+	}
+	err = writeText(w, mfs, e.learnedBuckets())
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "writing %s", tmp)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Temporary files are only readable by their owner, but the output file
+	// is meant to be read by other processes.
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, e.outputFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
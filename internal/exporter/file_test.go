@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestWriteOutputFile(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Unix(0, 0))
+
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{code="200",prog="prog"} 37
+`
+	for _, name := range []string{"mtail.prom", "mtail.prom.gz"} {
+		path := filepath.Join(tmpDir, name)
+		defer func(old string) { *outputFile = old }(*outputFile)
+		*outputFile = path
+		e, err := New(store, Hostname("gunstar"))
+		testutil.FatalIfErr(t, err)
+
+		errors := fileWriteErrors.Value()
+		e.PushMetrics()
+		if got := fileWriteErrors.Value() - errors; got != 0 {
+			t.Errorf("%s: expected no write errors, got %d", name, got)
+		}
+		fi, err := os.Stat(path)
+		testutil.FatalIfErr(t, err)
+		if fi.Mode().Perm() != 0644 {
+			t.Errorf("%s: expected mode 0644, got %s", name, fi.Mode())
+		}
+		f, err := os.Open(path)
+		testutil.FatalIfErr(t, err)
+		var r io.Reader = f
+		if filepath.Ext(name) == ".gz" {
+			r, err = gzip.NewReader(f)
+			testutil.FatalIfErr(t, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		testutil.FatalIfErr(t, err)
+		f.Close()
+		if diff := testutil.Diff(expected, string(b)); diff != "" {
+			t.Errorf("%s: contents diff:\n%s", name, diff)
+		}
+	}
+
+	// Only the output files are left; the temporary files were renamed.
+	fis, err := ioutil.ReadDir(tmpDir)
+	testutil.FatalIfErr(t, err)
+	if len(fis) != 2 {
+		t.Errorf("expected only the output files, got %d files", len(fis))
+	}
+
+	// A file that can't be written is counted.
+	defer func(old string) { *outputFile = old }(*outputFile)
+	*outputFile = filepath.Join(tmpDir, "missing", "mtail.prom")
+	e, err := New(store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	errors := fileWriteErrors.Value()
+	e.PushMetrics()
+	if got := fileWriteErrors.Value() - errors; got != 1 {
+		t.Errorf("expected 1 write error, got %d", got)
+	}
+}
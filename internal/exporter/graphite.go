@@ -7,6 +7,9 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/mtail/internal/metrics"
 )
@@ -16,6 +19,8 @@ var (
 		"Host:port to graphite carbon server to write metrics to.")
 	graphitePrefix = flag.String("graphite_prefix", "",
 		"Prefix to use for graphite metrics.")
+	graphiteTagged = flag.Bool("graphite_tagged", false,
+		"Write labels to graphite as tags, in the tagged carbon format name;tag=value, instead of as parts of the dotted metric name.")
 
 	graphiteExportTotal   = expvar.NewInt("graphite_export_total")
 	graphiteExportSuccess = expvar.NewInt("graphite_export_success")
@@ -23,11 +28,49 @@ var (
 
 // metricToGraphite encodes a metric in the graphite text protocol format.  The
 // metric lock is held before entering this function.
-func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+func metricToGraphite(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string {
+	path := formatLabels(name, l.Labels, ".", ".", "_")
+	if *graphiteTagged {
+		path = name + formatGraphiteTags(l.Labels)
+	}
 	return fmt.Sprintf("%s%s.%s %v %v\n",
 		*graphitePrefix,
 		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
+		path,
 		l.Datum.ValueString(),
-		l.Datum.TimeString())
+		exportTime(m, l, time.Now()).Unix())
+}
+
+// The characters that graphite doesn't allow in tag names and values are
+// replaced, as are spaces, which would end the metric path.
+var (
+	graphiteTagNameReplacer  = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_")
+	graphiteTagValueReplacer = strings.NewReplacer(";", "_", " ", "_")
+)
+
+// formatGraphiteTags formats labels as graphite tags, ;key=value for each
+// label, sorted by key.  Graphite doesn't allow empty tag values, so those
+// labels are left out.
+func formatGraphiteTags(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		v := labels[k]
+		if v == "" {
+			continue
+		}
+		// A value can't start with a tilde.
+		if v[0] == '~' {
+			v = "_" + v[1:]
+		}
+		b.WriteString(";")
+		b.WriteString(graphiteTagNameReplacer.Replace(k))
+		b.WriteString("=")
+		b.WriteString(graphiteTagValueReplacer.Replace(v))
+	}
+	return b.String()
 }
@@ -6,18 +6,135 @@ package exporter
 import (
 	"encoding/json"
 	"expvar"
+	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
 )
 
 var (
 	exportJSONErrors = expvar.NewInt("exporter_json_errors")
 )
 
+// jsonMetric is a metric as it's exported as JSON, with the metadata it's
+// exported to Prometheus with.
+type jsonMetric struct {
+	*metrics.Metric
+	// Help is the help text of the metric.
+	Help string `json:",omitempty"`
+	// PrometheusType is the type the metric is exported to Prometheus as:
+	// counter, gauge, histogram, summary or untyped.  It's empty for text
+	// metrics, which aren't exported to Prometheus.
+	PrometheusType string `json:",omitempty"`
+}
+
+// newJSONMetric returns m with its metadata for the JSON export.
+func newJSONMetric(m *metrics.Metric) *jsonMetric {
+	j := &jsonMetric{Metric: m, PrometheusType: promTypeName(m)}
+	if m.Source != "" {
+		j.Help = fmt.Sprintf("defined at %s", m.Source)
+	}
+	return j
+}
+
+// exportJSONMetric returns m for the JSON export, with the labels of its
+// series renamed, relabeled and sanitized, and the values taken from a metric
+// reset on export, as in the other exports, or nil if
+// the relabel rules drop all of its series.  Series whose labels are
+// rewritten may have different label keys from one another, so the metric's
+// keys are those of all its exported series, and a series lacking one of
+// them has the empty string as its value.
+func (e *Exporter) exportJSONMetric(m *metrics.Metric) *jsonMetric {
+	j := newJSONMetric(m)
+	if !e.rewritesLabels(m) && !m.ResetOnExport {
+		return j
+	}
+	m.RLock()
+	defer m.RUnlock()
+	var sets []*metrics.LabelSet
+	keys := make(map[string]bool)
+	lc := make(chan *metrics.LabelSet)
+	go m.EmitLabelSets(lc)
+	for l := range lc {
+		if l = e.exportLabels(m, l); l == nil {
+			continue
+		}
+		sets = append(sets, l)
+		for k := range l.Labels {
+			keys[k] = true
+		}
+	}
+	if len(sets) == 0 && len(m.LabelValues) > 0 {
+		return nil
+	}
+	// The metric's own keys keep their order, and new ones follow, sorted.
+	var order, added []string
+	for _, k := range m.Keys {
+		if keys[k] {
+			order = append(order, k)
+			delete(keys, k)
+		}
+	}
+	for k := range keys {
+		added = append(added, k)
+	}
+	sort.Strings(added)
+	order = append(order, added...)
+	c := &metrics.Metric{
+		Name:           m.Name,
+		Program:        m.Program,
+		Kind:           m.Kind,
+		Type:           m.Type,
+		Hidden:         m.Hidden,
+		Keys:           order,
+		Buckets:        m.Buckets,
+		Window:         m.Window,
+		Precision:      m.Precision,
+		Aliases:        m.Aliases,
+		SharedBy:       m.SharedBy,
+		Source:         m.Source,
+		TimeSource:     m.TimeSource,
+		PrometheusType: m.PrometheusType,
+		InitialValue:   m.InitialValue,
+		Learner:        m.Learner,
+		ResetOnExport:  m.ResetOnExport,
+		Clock:          m.Clock,
+	}
+	for _, l := range sets {
+		values := make([]string, len(order))
+		for i, k := range order {
+			values[i] = l.Labels[k]
+		}
+		c.LabelValues = append(c.LabelValues, &metrics.LabelValue{Labels: values, Value: l.Datum})
+	}
+	j.Metric = c
+	return j
+}
+
+// exportJSONMetrics returns the exported metrics for the JSON export.  The
+// store must be read locked.
+func (e *Exporter) exportJSONMetrics() []*jsonMetric {
+	ms := make([]*jsonMetric, 0)
+	for name, ml := range e.store.Metrics {
+		if e.exported(name) {
+			for _, m := range ml {
+				if j := e.exportJSONMetric(m); j != nil {
+					ms = append(ms, j)
+				}
+			}
+		}
+	}
+	return ms
+}
+
 // HandleJSON exports the metrics in JSON format via HTTP.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	e.store.RLock()
+	ms := e.exportJSONMetrics()
+	b, err := json.MarshalIndent(ms, "", "  ")
+	e.store.RUnlock()
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -47,7 +47,8 @@ var handleJSONTests = []struct {
           "Time": 0
         }
       }
-    ]
+    ],
+    "PrometheusType": "counter"
   }
 ]`,
 	},
@@ -82,7 +83,68 @@ var handleJSONTests = []struct {
           "Time": 0
         }
       }
-    ]
+    ],
+    "PrometheusType": "counter"
+  }
+]`,
+	},
+	{"help and type",
+		[]*metrics.Metric{
+			{
+				Name:           "connections",
+				Program:        "test",
+				Kind:           metrics.Counter,
+				Source:         "test.mtail:3",
+				PrometheusType: "gauge",
+				LabelValues:    []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+			},
+		},
+		`[
+  {
+    "Name": "connections",
+    "Program": "test",
+    "Kind": 1,
+    "Type": 0,
+    "LabelValues": [
+      {
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ],
+    "Help": "defined at test.mtail:3",
+    "PrometheusType": "gauge"
+  }
+]`,
+	},
+	{"hll",
+		[]*metrics.Metric{
+			{
+				Name:        "unique_clients",
+				Program:     "test",
+				Kind:        metrics.HLL,
+				Precision:   14,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: makeHLL(14, "10.0.0.1", "10.0.0.2")}},
+			},
+		},
+		`[
+  {
+    "Name": "unique_clients",
+    "Program": "test",
+    "Kind": 8,
+    "Type": 0,
+    "LabelValues": [
+      {
+        "Value": {
+          "Value": 2,
+          "Sketch": "AQ4AAQAAAAAAAAACAHfmcgAAAAf+wpAD9IlP",
+          "Time": 0
+        }
+      }
+    ],
+    "Precision": 14,
+    "PrometheusType": "gauge"
   }
 ]`,
 	},
@@ -116,3 +178,60 @@ func TestHandleJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleJSONRelabel(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code", "path")
+	for _, lv := range [][]string{{"200", "/"}, {"404", "/healthz"}} {
+		d, _ := m.GetDatum(lv...)
+		datum.SetInt(d, 1, time.Unix(0, 0))
+	}
+	testutil.FatalIfErr(t, ms.Add(m))
+	// A metric whose only series is dropped isn't exported.
+	h := metrics.NewMetric("healthz", "prog", metrics.Counter, metrics.Int, "path")
+	d, _ := h.GetDatum("/healthz")
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	testutil.FatalIfErr(t, ms.Add(h))
+
+	rules, err := parseRelabelRules([]byte(`
+- {source_labels: [path], regex: /healthz, replacement: ""}
+- {source_labels: [code], regex: (\d).., target_label: class, replacement: "${1}xx"}
+`))
+	testutil.FatalIfErr(t, err)
+	e, err := New(ms, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.relabelRules = rules
+
+	response := httptest.NewRecorder()
+	e.HandleJSON(response, &http.Request{})
+	expected := `[
+  {
+    "Name": "requests",
+    "Program": "prog",
+    "Kind": 1,
+    "Type": 0,
+    "Keys": [
+      "code",
+      "path",
+      "class"
+    ],
+    "LabelValues": [
+      {
+        "Labels": [
+          "200",
+          "/",
+          "2xx"
+        ],
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ],
+    "PrometheusType": "counter"
+  }
+]`
+	if diff := testutil.Diff(expected, response.Body.String()); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/kafka"
+	"github.com/pkg/errors"
+)
+
+var (
+	kafkaBrokers = flag.String("kafka_brokers", "",
+		"Comma separated host:port addresses of Kafka brokers to push metrics to, as JSON messages produced to --kafka_topic.")
+	kafkaTopic = flag.String("kafka_topic", "mtail",
+		"Kafka topic to produce metrics to with --kafka_brokers.")
+	kafkaMessagePerMetric = flag.Bool("kafka_message_per_metric", false,
+		"Produce each metric to Kafka as a message of its own, rather than all the metrics of a push as one message.")
+	kafkaMaxMessageBytes = flag.Int("kafka_max_message_bytes", kafka.DefaultMaxMessageBytes,
+		"Largest batch of messages produced to a Kafka partition at once, which must not exceed the topic's max.message.bytes.  The metrics of a push are split into several messages to fit.")
+	kafkaTLS = flag.Bool("kafka_tls", false,
+		"Connect to the Kafka brokers with TLS.")
+	kafkaTLSCAFile = flag.String("kafka_tls_ca_file", "",
+		"If set, path of the PEM encoded CA certificates that the Kafka brokers' certificates must be signed by, instead of the system's.  Implies --kafka_tls.")
+	kafkaSASLMechanism = flag.String("kafka_sasl_mechanism", "",
+		"If set, the SASL mechanism to authenticate to the Kafka brokers with, one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.")
+	kafkaSASLUsername = flag.String("kafka_sasl_username", "",
+		"Username to authenticate to the Kafka brokers as with --kafka_sasl_mechanism.")
+	kafkaSASLPasswordFile = flag.String("kafka_sasl_password_file", "",
+		"Path of a file holding the password of --kafka_sasl_username.  The file is read once at startup.")
+
+	kafkaExportTotal   = expvar.NewInt("kafka_export_total")
+	kafkaExportSuccess = expvar.NewInt("kafka_export_success")
+)
+
+// kafkaProducer produces messages to a Kafka topic.
+type kafkaProducer interface {
+	Produce(ctx context.Context, topic string, values [][]byte) error
+}
+
+// newKafkaProducer returns a producer configured by the Kafka flags.
+func newKafkaProducer() (*kafka.Producer, error) {
+	c := kafka.Config{
+		Brokers:         strings.Split(*kafkaBrokers, ","),
+		Timeout:         *writeDeadline,
+		MaxMessageBytes: *kafkaMaxMessageBytes,
+	}
+	if *kafkaTLS || *kafkaTLSCAFile != "" {
+		c.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		if *kafkaTLSCAFile != "" {
+			pem, err := ioutil.ReadFile(*kafkaTLSCAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read the Kafka TLS CA certificates")
+			}
+			c.TLS.RootCAs = x509.NewCertPool()
+			if !c.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no CA certificates found in %q", *kafkaTLSCAFile)
+			}
+		}
+	}
+	if *kafkaSASLMechanism != "" {
+		var password string
+		if *kafkaSASLPasswordFile != "" {
+			b, err := ioutil.ReadFile(*kafkaSASLPasswordFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading the Kafka SASL password")
+			}
+			password = strings.TrimRight(string(b), "\r\n")
+		}
+		m, err := kafka.Mechanism(*kafkaSASLMechanism, *kafkaSASLUsername, password)
+		if err != nil {
+			return nil, err
+		}
+		c.SASL = m
+	}
+	return kafka.NewProducer(c), nil
+}
+
+// kafkaMessages returns the exported metrics encoded as JSON, in the format of
+// the JSON export: arrays of the metrics, each message as large as fits in
+// maxBytes, or each metric as a message of its own if perMetric is set.  A
+// metric too large for a message of its own is left out.
+func (e *Exporter) kafkaMessages(perMetric bool, maxBytes int) ([][]byte, error) {
+	e.store.RLock()
+	defer e.store.RUnlock()
+
+	ms := e.exportJSONMetrics()
+	if len(ms) == 0 {
+		return nil, nil
+	}
+	maxBytes -= kafka.MessageOverhead
+	var values [][]byte
+	var batch []byte
+	for _, m := range ms {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		if len(b)+2 > maxBytes {
+			glog.Warningf("Metric %s is %d bytes, too large for a Kafka message of at most %d bytes; not produced", m.Name, len(b), maxBytes)
+			continue
+		}
+		if perMetric {
+			values = append(values, b)
+			continue
+		}
+		// Each array has room for its closing bracket.
+		if batch != nil && len(batch)+1+len(b)+1 > maxBytes {
+			values = append(values, append(batch, ']'))
+			batch = nil
+		}
+		if batch == nil {
+			batch = append([]byte{'['}, b...)
+		} else {
+			batch = append(append(batch, ','), b...)
+		}
+	}
+	if batch != nil {
+		values = append(values, append(batch, ']'))
+	}
+	return values, nil
+}
+
+// pushKafka produces all the exported metrics to the Kafka topic, in a single
+// batch.
+func (e *Exporter) pushKafka(ctx context.Context) error {
+	values, err := e.kafkaMessages(e.kafkaMessagePerMetric, e.kafkaMaxMessageBytes)
+	if err != nil {
+		return errors.Wrap(err, "encoding metrics for Kafka")
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	kafkaExportTotal.Add(int64(len(values)))
+	if err := e.kafka.Produce(ctx, e.kafkaTopic, values); err != nil {
+		return errors.Wrap(err, "producing to Kafka")
+	}
+	kafkaExportSuccess.Add(int64(len(values)))
+	return nil
+}
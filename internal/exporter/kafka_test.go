@@ -0,0 +1,174 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/kafka"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/pkg/errors"
+)
+
+// mockProducer records the messages produced to it, failing the first
+// produces with the errors in errs.
+type mockProducer struct {
+	errs     []error
+	calls    int
+	topic    string
+	produced []string
+}
+
+func (p *mockProducer) Produce(ctx context.Context, topic string, values [][]byte) error {
+	p.calls++
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		return err
+	}
+	p.topic = topic
+	for _, v := range values {
+		p.produced = append(p.produced, string(v))
+	}
+	return nil
+}
+
+func TestPushKafka(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+	m = metrics.NewMetric("bar", "test", metrics.Gauge, metrics.Int, "a")
+	d, _ = m.GetDatum("1")
+	datum.SetInt(d, 2, time.Unix(0, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	const (
+		foo = `{"Name":"foo","Program":"test","Kind":1,"Type":0,"LabelValues":[{"Value":{"Value":1,"Time":0}}],"PrometheusType":"counter"}`
+		bar = `{"Name":"bar","Program":"test","Kind":2,"Type":0,"Keys":["a"],"LabelValues":[{"Labels":["1"],"Value":{"Value":2,"Time":0}}],"PrometheusType":"gauge"}`
+	)
+	for _, tc := range []struct {
+		name      string
+		perMetric bool
+		expected  []string
+	}{
+		// Metrics are pushed in store order, which isn't deterministic.
+		{"batch", false, []string{"[" + foo + "," + bar + "]", "[" + bar + "," + foo + "]"}},
+		{"per metric", true, []string{bar, foo}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := New(store)
+			testutil.FatalIfErr(t, err)
+			p := &mockProducer{}
+			e.kafka = p
+			e.kafkaTopic = "metrics"
+			e.kafkaMessagePerMetric = tc.perMetric
+
+			testutil.FatalIfErr(t, e.pushKafka(context.Background()))
+			if p.topic != "metrics" {
+				t.Errorf("expected topic metrics, got %q", p.topic)
+			}
+			if !tc.perMetric {
+				if len(p.produced) != 1 || (p.produced[0] != tc.expected[0] && p.produced[0] != tc.expected[1]) {
+					t.Errorf("expected one message of both metrics, got %q", p.produced)
+				}
+				return
+			}
+			sort.Strings(p.produced)
+			if diff := testutil.Diff(tc.expected, p.produced); diff != "" {
+				t.Errorf("produced didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestKafkaMessagesMaxBytes(t *testing.T) {
+	store := metrics.NewStore()
+	for _, name := range []string{"a", "b", "c"} {
+		m := metrics.NewMetric(name, "test", metrics.Counter, metrics.Int)
+		d, _ := m.GetDatum()
+		datum.SetInt(d, 1, time.Unix(0, 0))
+		testutil.FatalIfErr(t, store.Add(m))
+	}
+	m := metrics.NewMetric("large", "test", metrics.Counter, metrics.Int, "k")
+	d, _ := m.GetDatum(strings.Repeat("x", 200))
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	const one = `{"Name":"a","Program":"test","Kind":1,"Type":0,"LabelValues":[{"Value":{"Value":1,"Time":0}}],"PrometheusType":"counter"}`
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+	// Room for two of the small metrics in each message, but not the large one.
+	maxBytes := kafka.MessageOverhead + 2*len(one) + 3
+	values, err := e.kafkaMessages(false, maxBytes)
+	testutil.FatalIfErr(t, err)
+	var names []string
+	for _, v := range values {
+		if len(v) > maxBytes-kafka.MessageOverhead {
+			t.Errorf("message of %d bytes, expected at most %d", len(v), maxBytes-kafka.MessageOverhead)
+		}
+		var ms []struct{ Name string }
+		testutil.FatalIfErr(t, json.Unmarshal(v, &ms))
+		for _, m := range ms {
+			names = append(names, m.Name)
+		}
+	}
+	sort.Strings(names)
+	if len(values) != 2 || !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Errorf("expected a, b and c in 2 messages, got %q in %d", names, len(values))
+	}
+
+	values, err = e.kafkaMessages(true, maxBytes)
+	testutil.FatalIfErr(t, err)
+	if len(values) != 3 {
+		t.Errorf("expected 3 messages of a metric each, got %d", len(values))
+	}
+}
+
+func TestPushKafkaRetries(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	defer func(old time.Duration) { pushRetryBackoff = old }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+	e.kafkaTopic = "metrics"
+
+	// A broker that is unavailable, then has no leader for the partition, is
+	// retried until the push succeeds.
+	p := &mockProducer{errs: []error{errors.Wrap(kafka.Error(5), "no leader"), kafka.Error(6)}}
+	e.kafka = p
+	testutil.FatalIfErr(t, withRetries(context.Background(), e.pushKafka))
+	if p.calls != 3 || len(p.produced) != 1 {
+		t.Errorf("expected 1 message after 3 calls, got %d messages after %d calls", len(p.produced), p.calls)
+	}
+
+	// Retries are bounded.
+	p = &mockProducer{errs: []error{kafka.Error(5), kafka.Error(5), kafka.Error(5), kafka.Error(5), kafka.Error(5)}}
+	e.kafka = p
+	if err := withRetries(context.Background(), e.pushKafka); err == nil || p.calls != pushRetries+1 {
+		t.Errorf("expected an error after %d calls, got %d calls and error %v", pushRetries+1, p.calls, err)
+	}
+
+	// Errors that won't go away aren't retried.
+	p = &mockProducer{errs: []error{kafka.Error(10)}}
+	e.kafka = p
+	if err := withRetries(context.Background(), e.pushKafka); err == nil || p.calls != 1 {
+		t.Errorf("expected a single failed call, got %d calls and error %v", p.calls, err)
+	}
+}
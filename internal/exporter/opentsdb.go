@@ -0,0 +1,182 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	openTSDBURL = flag.String("opentsdb_url", "",
+		"URL of the OpenTSDB HTTP API put endpoint to write metrics to, e.g. http://localhost:4242/api/put.")
+
+	openTSDBExportTotal    = expvar.NewInt("opentsdb_export_total")
+	openTSDBExportSuccess  = expvar.NewInt("opentsdb_export_success")
+	openTSDBExportRejected = expvar.NewInt("opentsdb_export_rejected")
+)
+
+// openTSDBPoint is a data point in the OpenTSDB /api/put JSON format.
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBSummary is the response to a put request with the summary
+// parameter.
+type openTSDBSummary struct {
+	Failed  int64 `json:"failed"`
+	Success int64 `json:"success"`
+}
+
+var invalidOpenTSDBChars = regexp.MustCompile(`[^-a-zA-Z0-9_./\pL]`)
+
+// openTSDBName replaces the characters in s that OpenTSDB doesn't allow in
+// metric names and tags.
+func openTSDBName(s string) string {
+	return invalidOpenTSDBChars.ReplaceAllLiteralString(s, "_")
+}
+
+// openTSDBPoints returns the data points of all the exported metrics.  Labels
+// become tags, along with the program and the hostname, as OpenTSDB requires
+// at least one tag on each point.  Points that have never been updated are
+// stamped with now.  Counters are converted to deltas, and their rates added,
+// by p, if not nil.
+func (e *Exporter) openTSDBPoints(now time.Time, p *deltaPush) []openTSDBPoint {
+	e.store.RLock()
+	defer e.store.RUnlock()
+
+	var points []openTSDBPoint
+	for name, ml := range e.store.Metrics {
+		if !e.exported(name) {
+			continue
+		}
+		for _, m := range ml {
+			m.RLock()
+			if m.Kind == metrics.Text {
+				m.RUnlock()
+				continue
+			}
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				if l = e.exportLabels(m, l); l == nil {
+					continue
+				}
+				l, rate := p.apply(m, l)
+				tags := make(map[string]string, len(l.Labels)+2)
+				for k, v := range l.Labels {
+					// OpenTSDB rejects empty tag values.
+					if v != "" {
+						tags[openTSDBName(k)] = openTSDBName(v)
+					}
+				}
+				if !e.omitProgLabel {
+					tags["prog"] = openTSDBName(m.Program)
+				}
+				if _, ok := tags["host"]; !ok {
+					tags["host"] = openTSDBName(e.hostname)
+				}
+				ts := exportTime(m, l, now)
+				if ts.Unix() <= 0 {
+					ts = now
+				}
+				point := func(name string, value interface{}) {
+					points = append(points, openTSDBPoint{openTSDBName(name), ts.Unix(), value, tags})
+				}
+				for _, exportName := range exportNames(m) {
+					switch d := l.Datum.(type) {
+					case *datum.Buckets:
+						point(exportName+"_count", d.GetCount())
+						point(exportName+"_sum", d.GetSum())
+					case *datum.Float:
+						// NaN and infinities can't be encoded in JSON.
+						if v := d.Get(); !math.IsNaN(v) && !math.IsInf(v, 0) {
+							point(exportName, v)
+						}
+					case *datum.Int, *datum.Window, *datum.HLL:
+						point(exportName, datum.GetInt(d))
+					}
+					// The rate has the same labels, and so the same tags.
+					if rate != nil {
+						point(exportName+"_rate", datum.GetFloat(rate.Datum))
+					}
+				}
+			}
+			m.RUnlock()
+		}
+	}
+	return points
+}
+
+// pushOpenTSDB posts all the exported metrics to the OpenTSDB put endpoint in
+// a single batch.  Points that OpenTSDB rejects, for example because of a
+// type conflict with existing data, are counted and logged.
+func (e *Exporter) pushOpenTSDB(ctx context.Context) error {
+	now := time.Now()
+	p := e.beginPush(e.openTSDBURL, now)
+	completed := false
+	defer func() { p.end(completed) }()
+	points := e.openTSDBPoints(now, p)
+	if len(points) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(points)
+	if err != nil {
+		return errors.Wrap(err, "encoding OpenTSDB points")
+	}
+	u, err := url.Parse(e.openTSDBURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing OpenTSDB URL")
+	}
+	// Ask for a count of the failed points in the response.
+	q := u.Query()
+	q.Set("summary", "")
+	u.RawQuery = q.Encode()
+
+	openTSDBExportTotal.Add(int64(len(points)))
+	ctx, cancel := context.WithTimeout(ctx, *scrapeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "creating OpenTSDB request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: *scrapeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "posting to OpenTSDB")
+	}
+	defer resp.Body.Close()
+	var summary openTSDBSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err == nil && summary.Failed+summary.Success > 0 {
+		openTSDBExportSuccess.Add(summary.Success)
+		if summary.Failed > 0 {
+			openTSDBExportRejected.Add(summary.Failed)
+			glog.Warningf("OpenTSDB rejected %d of %d points", summary.Failed, len(points))
+		}
+	} else {
+		if resp.StatusCode/100 != 2 {
+			return errors.Errorf("OpenTSDB put failed: %s", resp.Status)
+		}
+		openTSDBExportSuccess.Add(int64(len(points)))
+	}
+	completed = true
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestPushOpenTSDB(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	store := metrics.NewStore()
+
+	m := metrics.NewMetric("requests-total", "prog", metrics.Counter, metrics.Int, "code", "path")
+	d, _ := m.GetDatum("200", "/index.html")
+	datum.SetInt(d, 37, ts)
+	testutil.FatalIfErr(t, store.Add(m))
+	latency := metrics.NewMetric("latency", "prog", metrics.Gauge, metrics.Float)
+	d, _ = latency.GetDatum()
+	datum.SetFloat(d, 0.25, ts)
+	testutil.FatalIfErr(t, store.Add(latency))
+	text := metrics.NewMetric("version", "prog", metrics.Text, metrics.String)
+	d, _ = text.GetDatum()
+	datum.SetString(d, "1.0", ts)
+	testutil.FatalIfErr(t, store.Add(text))
+
+	var body, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		body = string(b)
+		query = r.URL.RawQuery
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"failed":1,"success":1}`)
+	}))
+	defer srv.Close()
+
+	e, err := New(store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.openTSDBURL = srv.URL + "/api/put"
+
+	rejected := openTSDBExportRejected.Value()
+	testutil.FatalIfErr(t, e.pushOpenTSDB(context.Background()))
+	if query != "summary=" {
+		t.Errorf("expected summary query, got %q", query)
+	}
+	if got := openTSDBExportRejected.Value() - rejected; got != 1 {
+		t.Errorf("expected 1 rejected point, got %d", got)
+	}
+
+	// Metrics are pushed in store order, which isn't deterministic.
+	expected := []string{
+		`[{"metric":"requests-total","timestamp":1343124840,"value":37,"tags":{"code":"200","host":"gunstar","path":"/index.html","prog":"prog"}},` +
+			`{"metric":"latency","timestamp":1343124840,"value":0.25,"tags":{"host":"gunstar","prog":"prog"}}]`,
+		`[{"metric":"latency","timestamp":1343124840,"value":0.25,"tags":{"host":"gunstar","prog":"prog"}},` +
+			`{"metric":"requests-total","timestamp":1343124840,"value":37,"tags":{"code":"200","host":"gunstar","path":"/index.html","prog":"prog"}}]`,
+	}
+	if body != expected[0] && body != expected[1] {
+		t.Errorf("unexpected body:\n%s", testutil.Diff(expected[0], body))
+	}
+}
+
+func TestOpenTSDBName(t *testing.T) {
+	for _, tc := range []struct {
+		in, expected string
+	}{
+		{"foo.bar-baz_1/2", "foo.bar-baz_1/2"},
+		{"foo bar:baz", "foo_bar_baz"},
+		{"größe", "größe"},
+	} {
+		if got := openTSDBName(tc.in); got != tc.expected {
+			t.Errorf("openTSDBName(%q): expected %q, got %q", tc.in, tc.expected, got)
+		}
+	}
+}
@@ -6,34 +6,69 @@ package exporter
 import (
 	"expvar"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
 	metricExportTotal = expvar.NewInt("metric_export_total")
 )
 
+// staleNaN is the value that Prometheus uses to mark a series as stale: a NaN
+// distinguishable by its bits from the NaNs produced by arithmetic.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
 func noHyphens(s string) string {
 	return strings.Replace(s, "-", "_", -1)
 }
 
 // Describe implements the prometheus.Collector interface.
 func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(e, c)
+	// As prometheus.DescribeByCollect does, but without resetting any
+	// metrics, as describing them doesn't export them.
+	mc := make(chan prometheus.Metric)
+	go func() {
+		e.collect(mc)
+		close(mc)
+	}()
+	for m := range mc {
+		c <- m.Desc()
+	}
 }
 
 // Collect implements the prometheus.Collector interface.
 func (e *Exporter) Collect(c chan<- prometheus.Metric) {
+	// When metrics are pushed, they're reset at each push instead.
+	if !e.pushes() {
+		defer e.takeResetMetrics()()
+	}
+	e.collect(c)
+}
+
+// collect sends the exported metrics to c.
+func (e *Exporter) collect(c chan<- prometheus.Metric) {
 	e.store.RLock()
 	defer e.store.RUnlock()
 
-	for _, ml := range e.store.Metrics {
+	for name, ml := range e.store.Metrics {
+		if !e.exported(name) {
+			continue
+		}
 		lastSource := ""
 		for _, m := range ml {
 			m.RLock()
@@ -47,6 +82,9 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			lsc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lsc)
 			for ls := range lsc {
+				if ls = e.exportLabels(m, ls); ls == nil {
+					continue
+				}
 				if lastSource == "" {
 					lastSource = m.Source
 				}
@@ -60,42 +98,299 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 					keys = append(keys, k)
 					vals = append(vals, v)
 				}
-				var pM prometheus.Metric
-				var err error
-				if m.Kind == metrics.Histogram {
-					pM, err = prometheus.NewConstHistogram(
-						prometheus.NewDesc(noHyphens(m.Name),
-							fmt.Sprintf("defined at %s", lastSource), keys, nil),
-						datum.GetBucketsCount(ls.Datum),
-						datum.GetBucketsSum(ls.Datum),
-						datum.GetBucketsCumByMax(ls.Datum),
-						vals...)
-				} else {
-					pM, err = prometheus.NewConstMetric(
-						prometheus.NewDesc(noHyphens(m.Name),
-							fmt.Sprintf("defined at %s", lastSource), keys, nil),
-						promTypeForKind(m.Kind),
-						promValueForDatum(ls.Datum),
-						vals...)
+				for _, exportName := range exportNames(m) {
+					var pM prometheus.Metric
+					var err error
+					if m.Kind == metrics.Histogram && m.PrometheusType == "summary" {
+						pM, err = prometheus.NewConstSummary(
+							prometheus.NewDesc(noHyphens(exportName),
+								fmt.Sprintf("defined at %s", lastSource), keys, nil),
+							datum.GetBucketsCount(ls.Datum),
+							datum.GetBucketsSum(ls.Datum),
+							nil,
+							vals...)
+					} else if m.Kind == metrics.Histogram {
+						pM, err = prometheus.NewConstHistogram(
+							prometheus.NewDesc(noHyphens(exportName),
+								fmt.Sprintf("defined at %s", lastSource), keys, nil),
+							datum.GetBucketsCount(ls.Datum),
+							datum.GetBucketsSum(ls.Datum),
+							datum.GetBucketsCumByMax(ls.Datum),
+							vals...)
+					} else {
+						pM, err = prometheus.NewConstMetric(
+							prometheus.NewDesc(noHyphens(exportName),
+								fmt.Sprintf("defined at %s", lastSource), keys, nil),
+							promTypeForMetric(m),
+							promValueForDatum(ls.Datum),
+							vals...)
+					}
+					if err != nil {
+						glog.Warning(err)
+						continue
+					}
+					// By default no timestamp is emitted to Prometheus. Setting a
+					// timestamp is not recommended. It can lead to unexpected results
+					// if the timestamp is not updated or moved fowarded enough to avoid
+					// triggering Promtheus staleness handling.
+					// Read more in docs/faq.md
+					// Metrics timestamped with the scrape time are sent
+					// without one, so Prometheus uses the time of the scrape.
+					if e.emitTimestamp && m.TimeSource == metrics.LogTime {
+						c <- prometheus.NewMetricWithTimestamp(ls.Datum.TimeUTC(), pM)
+					} else {
+						c <- pM
+					}
 				}
-				if err != nil {
-					glog.Warning(err)
-					continue
+			}
+			if m.Kind == metrics.Window {
+				e.collectWindowDuration(c, m)
+			}
+			m.RUnlock()
+		}
+	}
+}
+
+// PrometheusHandler returns a handler serving the metrics gathered from g, as
+// promhttp does.  When serving the text format, the buckets learned by
+// adaptive histograms are appended as comments.  When serving the delimited
+// protobuf format, with stale markers enabled, the series removed from the
+// store are added with the staleness marker as their value.
+func (e *Exporter) PrometheusHandler(g prometheus.Gatherer) http.Handler {
+	h := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.Negotiate(r.Header)
+		// The other formats write the marker as an ordinary NaN, so the
+		// removed series are kept for the next protobuf scrape.
+		if e.emitStaleMarkers && format == expfmt.FmtProtoDelim {
+			mfs, err := g.Gather()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", string(format))
+			enc := expfmt.NewEncoder(w, format)
+			for _, mf := range e.addStaleMarkers(mfs) {
+				if err := enc.Encode(mf); err != nil {
+					glog.Info(err)
+					return
 				}
-				// By default no timestamp is emitted to Prometheus. Setting a
-				// timestamp is not recommended. It can lead to unexpected results
-				// if the timestamp is not updated or moved fowarded enough to avoid
-				// triggering Promtheus staleness handling.
-				// Read more in docs/faq.md
-				if e.emitTimestamp {
-					c <- prometheus.NewMetricWithTimestamp(ls.Datum.TimeUTC(), pM)
-				} else {
-					c <- pM
+			}
+			return
+		}
+		learned := e.learnedBuckets()
+		if len(learned) == 0 || format != expfmt.FmtText {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		if err := writeText(w, mfs, learned); err != nil {
+			glog.Info(err)
+		}
+	})
+}
+
+// writeText writes the metric families in the Prometheus text format,
+// followed by the comments.
+func writeText(w io.Writer, mfs []*dto.MetricFamily, comments []string) error {
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	for _, c := range comments {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// learnedBuckets returns a comment for each adaptive histogram that has
+// learned its buckets, giving them as a histogram declaration's buckets so
+// they can be copied into the program.
+func (e *Exporter) learnedBuckets() []string {
+	e.store.RLock()
+	defer e.store.RUnlock()
+	var comments []string
+	for name, ml := range e.store.Metrics {
+		if !e.exported(name) {
+			continue
+		}
+		for _, m := range ml {
+			if m.Learner == nil {
+				continue
+			}
+			bounds := m.Learner.Bounds()
+			if bounds == nil {
+				continue
+			}
+			b := make([]string, 0, len(bounds))
+			for _, max := range bounds {
+				b = append(b, strconv.FormatFloat(max, 'g', -1, 64))
+			}
+			comments = append(comments, fmt.Sprintf("# COMMENT mtail_learned_buckets %s buckets %s", noHyphens(name), strings.Join(b, ", ")))
+		}
+	}
+	sort.Strings(comments)
+	return comments
+}
+
+// addStaleMarkers takes the series removed from the store since they were
+// last taken, and adds them to the metric families mfs with the staleness
+// marker as their value, except for those already in mfs, as they have been
+// recreated since.  Series of metrics that aren't exported, and of text and
+// histogram metrics, which can't carry the marker, are dropped.
+func (e *Exporter) addStaleMarkers(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	seen := make(map[string]struct{})
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+		for _, pm := range mf.GetMetric() {
+			seen[seriesSignature(mf.GetName(), pm.GetLabel())] = struct{}{}
+		}
+	}
+	for _, s := range e.store.TakeStaleSeries() {
+		m := s.Metric
+		if !e.exported(m.Name) || m.Kind == metrics.Text || m.Kind == metrics.Histogram {
+			continue
+		}
+		ls := e.exportLabels(m, &metrics.LabelSet{Labels: s.Labels})
+		if ls == nil {
+			continue
+		}
+		var keys []string
+		var vals []string
+		if !e.omitProgLabel {
+			keys = append(keys, "prog")
+			vals = append(vals, m.Program)
+		}
+		for k, v := range ls.Labels {
+			keys = append(keys, k)
+			vals = append(vals, v)
+		}
+		for _, exportName := range exportNames(m) {
+			name := noHyphens(exportName)
+			pM, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(name, "", keys, nil),
+				promTypeForMetric(m),
+				staleNaN,
+				vals...)
+			if err != nil {
+				glog.Warning(err)
+				continue
+			}
+			pm := &dto.Metric{}
+			if err := pM.Write(pm); err != nil {
+				glog.Warning(err)
+				continue
+			}
+			// A series may have been removed more than once since the
+			// last scrape, but can only be exported once.
+			sig := seriesSignature(name, pm.GetLabel())
+			if _, ok := seen[sig]; ok {
+				continue
+			}
+			seen[sig] = struct{}{}
+			mf, ok := families[name]
+			if !ok {
+				mf = &dto.MetricFamily{
+					Name: proto.String(name),
+					Help: proto.String(fmt.Sprintf("defined at %s", m.Source)),
+					Type: dtoTypeForMetric(m),
 				}
+				families[name] = mf
+				mfs = append(mfs, mf)
 			}
-			m.RUnlock()
+			mf.Metric = append(mf.Metric, pm)
 		}
 	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs
+}
+
+// seriesSignature returns a string identifying the series of the metric
+// family name with the labels, which are sorted by name as they're gathered.
+func seriesSignature(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteString("\xff" + l.GetName() + "\xfe" + l.GetValue())
+	}
+	return b.String()
+}
+
+// collectWindowDuration emits a companion gauge describing the duration of
+// the window of a counter_window metric.
+func (e *Exporter) collectWindowDuration(c chan<- prometheus.Metric, m *metrics.Metric) {
+	var keys []string
+	var vals []string
+	if !e.omitProgLabel {
+		keys = append(keys, "prog")
+		vals = append(vals, m.Program)
+	}
+	pM, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(noHyphens(m.Name)+"_window_seconds",
+			fmt.Sprintf("window duration of %s", noHyphens(m.Name)), keys, nil),
+		prometheus.GaugeValue,
+		m.Window.Seconds(),
+		vals...)
+	if err != nil {
+		glog.Warning(err)
+		return
+	}
+	c <- pM
+}
+
+// promTypeForMetric returns the type m is exported to Prometheus as: the one
+// given by its @metric_type, or else the type of its Kind.
+func promTypeForMetric(m *metrics.Metric) prometheus.ValueType {
+	switch m.PrometheusType {
+	case "counter":
+		return prometheus.CounterValue
+	case "gauge":
+		return prometheus.GaugeValue
+	case "untyped":
+		return prometheus.UntypedValue
+	}
+	return promTypeForKind(m.Kind)
+}
+
+// promTypeName returns the name of the type m is exported to Prometheus as, or
+// "" if it isn't exported to Prometheus.
+func promTypeName(m *metrics.Metric) string {
+	switch {
+	case m.Kind == metrics.Text:
+		return ""
+	case m.Kind == metrics.Histogram && m.PrometheusType == "summary":
+		return "summary"
+	case m.Kind == metrics.Histogram:
+		return "histogram"
+	}
+	switch promTypeForMetric(m) {
+	case prometheus.CounterValue:
+		return "counter"
+	case prometheus.GaugeValue:
+		return "gauge"
+	}
+	return "untyped"
+}
+
+// dtoTypeForMetric returns the type of the metric family that the series of a
+// metric m other than a histogram are exported in.
+func dtoTypeForMetric(m *metrics.Metric) *dto.MetricType {
+	switch promTypeForMetric(m) {
+	case prometheus.CounterValue:
+		return dto.MetricType_COUNTER.Enum()
+	case prometheus.GaugeValue:
+		return dto.MetricType_GAUGE.Enum()
+	}
+	return dto.MetricType_UNTYPED.Enum()
 }
 
 func promTypeForKind(k metrics.Kind) prometheus.ValueType {
@@ -106,6 +401,12 @@ func promTypeForKind(k metrics.Kind) prometheus.ValueType {
 		return prometheus.GaugeValue
 	case metrics.Timer:
 		return prometheus.GaugeValue
+	case metrics.Window:
+		return prometheus.GaugeValue
+	case metrics.Info:
+		return prometheus.GaugeValue
+	case metrics.HLL:
+		return prometheus.GaugeValue
 	}
 	return prometheus.UntypedValue
 }
@@ -116,6 +417,10 @@ func promValueForDatum(d datum.Datum) float64 {
 		return float64(n.Get())
 	case *datum.Float:
 		return n.Get()
+	case *datum.Window:
+		return float64(n.Get())
+	case *datum.HLL:
+		return float64(n.Get())
 	}
 	return 0.
 }
@@ -4,7 +4,11 @@
 package exporter
 
 import (
+	"io"
+	"io/ioutil"
 	"math"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -12,7 +16,11 @@ import (
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 var handlePrometheusTests = []struct {
@@ -221,10 +229,138 @@ foo_bucket{a="bar",prog="test",le="2"} 2
 foo_bucket{a="bar",prog="test",le="+Inf"} 4
 foo_sum{a="bar",prog="test"} 5
 foo_count{a="bar",prog="test"} 4
+`,
+	},
+	{"counter window",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "errors_last_5m",
+				Program:     "test",
+				Kind:        metrics.Window,
+				Window:      5 * time.Minute,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: makeWindow(5*time.Minute, 3)}},
+				Source:      "location.mtail:37",
+			},
+		},
+		`# HELP errors_last_5m defined at location.mtail:37
+# TYPE errors_last_5m gauge
+errors_last_5m{prog="test"} 3
+# HELP errors_last_5m_window_seconds window duration of errors_last_5m
+# TYPE errors_last_5m_window_seconds gauge
+errors_last_5m_window_seconds{prog="test"} 300
+`,
+	},
+	{"info",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "build_info",
+				Program:     "test",
+				Kind:        metrics.Info,
+				Keys:        []string{"version", "commit"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"1.0", "abc123"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+				Source:      "location.mtail:37",
+			},
+		},
+		`# HELP build_info defined at location.mtail:37
+# TYPE build_info gauge
+build_info{commit="abc123",prog="test",version="1.0"} 1
+`,
+	},
+	{"hll",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "unique_clients",
+				Program:     "test",
+				Kind:        metrics.HLL,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: makeHLL(14, "10.0.0.1", "10.0.0.2", "10.0.0.1")}},
+				Source:      "location.mtail:37",
+			},
+		},
+		`# HELP unique_clients defined at location.mtail:37
+# TYPE unique_clients gauge
+unique_clients{prog="test"} 2
+`,
+	},
+	{"metric type untyped",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:           "foo",
+				Program:        "test",
+				Kind:           metrics.Counter,
+				PrometheusType: "untyped",
+				LabelValues:    []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		},
+		`# HELP foo defined at 
+# TYPE foo untyped
+foo{} 1
+`,
+	},
+	{"metric type gauge",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:           "foo",
+				Program:        "test",
+				Kind:           metrics.Counter,
+				PrometheusType: "gauge",
+				LabelValues:    []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(3, time.Unix(0, 0))}}},
+		},
+		`# HELP foo defined at 
+# TYPE foo gauge
+foo{} 3
+`,
+	},
+	{"metric type summary",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:           "foo",
+				Program:        "test",
+				Kind:           metrics.Histogram,
+				PrometheusType: "summary",
+				Keys:           []string{"a"},
+				LabelValues:    []*metrics.LabelValue{{Labels: []string{"bar"}, Value: makeBuckets(1.5, 0.5)}},
+				Source:         "location.mtail:37",
+			},
+		},
+		`# HELP foo defined at location.mtail:37
+# TYPE foo summary
+foo_sum{a="bar",prog="test"} 2
+foo_count{a="bar",prog="test"} 2
 `,
 	},
 }
 
+// makeBuckets returns a buckets datum with bounds 1 and 2 and the values
+// observed.
+func makeBuckets(values ...float64) datum.Datum {
+	d := datum.MakeBuckets([]datum.Range{{0, 1}, {1, 2}}, time.Unix(0, 0))
+	for _, v := range values {
+		datum.Observe(d, v, time.Unix(0, 0))
+	}
+	return d
+}
+
+// makeHLL returns an hll datum of the given precision with values added.
+func makeHLL(precision uint8, values ...string) datum.Datum {
+	d := datum.NewHLL(precision)
+	for _, v := range values {
+		datum.AddHLL(d, v, time.Unix(0, 0))
+	}
+	return d
+}
+
+// makeWindow returns a window datum with count increments in its current bucket.
+func makeWindow(window time.Duration, count int64) datum.Datum {
+	d := datum.NewWindow(window, nil)
+	datum.IncIntBy(d, count, time.Now())
+	return d
+}
+
 func TestHandlePrometheus(t *testing.T) {
 	for _, tc := range handlePrometheusTests {
 		tc := tc
@@ -248,3 +384,372 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePrometheusRenameLabel(t *testing.T) {
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "http_requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"code", "method"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"200", "GET"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+	}))
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "other",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"code"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"404"}, Value: datum.MakeInt(2, time.Unix(0, 0))}},
+	}))
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel, RenameLabel("http_requests", "code", "status_code"))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP http_requests defined at 
+# TYPE http_requests counter
+http_requests{method="GET",status_code="200"} 1
+# HELP other defined at 
+# TYPE other counter
+other{code="404"} 2
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusSanitizeLabels(t *testing.T) {
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"user-agent", "path"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"curl\x00", "/a/very/long/path"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+	}))
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel, SanitizeLabels(8, "_"))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{path="/a/very/",user_agent="curl\\x00"} 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusSanitizeLabelKeyCollision(t *testing.T) {
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"user-agent", "user.agent", "user_agent"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"a", "b", "c"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+	}))
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel, SanitizeLabels(8, "_"))
+	testutil.FatalIfErr(t, err)
+	// The key that needed no replacing wins, whatever the order of the keys.
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{user_agent="c"} 1
+`
+	for i := 0; i < 10; i++ {
+		if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSanitizeLabelsReplaceChar(t *testing.T) {
+	for _, c := range []string{"", "-", "a.b"} {
+		if _, err := New(metrics.NewStore(), SanitizeLabels(8, c)); err == nil {
+			t.Errorf("replacement %q: expected error", c)
+		}
+	}
+	if _, err := New(metrics.NewStore(), SanitizeLabels(8, "__")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHandlePrometheusInstanceLabel(t *testing.T) {
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"code"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"200"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+	}))
+	// A metric's own label takes precedence over the instance label.
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "upstream_requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		Keys:        []string{"host"},
+		LabelValues: []*metrics.LabelValue{{Labels: []string{"backend"}, Value: datum.MakeInt(2, time.Unix(0, 0))}},
+	}))
+	e, err := New(ms, Hostname("gunstar"), InstanceLabel("host"))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{code="200",host="gunstar",prog="test"} 1
+# HELP upstream_requests defined at 
+# TYPE upstream_requests counter
+upstream_requests{host="backend",prog="test"} 2
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusRelabelRules(t *testing.T) {
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:    "http_requests",
+		Program: "test",
+		Kind:    metrics.Counter,
+		Keys:    []string{"method", "path"},
+		LabelValues: []*metrics.LabelValue{
+			{Labels: []string{"GET", "/"}, Value: datum.MakeInt(1, time.Unix(0, 0))},
+			{Labels: []string{"GET", "/healthz"}, Value: datum.MakeInt(2, time.Unix(0, 0))},
+		},
+	}))
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	rulesFile := filepath.Join(tmpDir, "rules.yaml")
+	testutil.FatalIfErr(t, ioutil.WriteFile(rulesFile, []byte(`
+- {source_labels: [method], target_label: http_method, regex: "(.*)", replacement: "$1"}
+- {source_labels: [path], regex: /healthz, replacement: ""}
+`), 0600))
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel, RelabelRules(rulesFile))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP http_requests defined at 
+# TYPE http_requests counter
+http_requests{http_method="GET",method="GET",path="/"} 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusTimestampSource(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "requests",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		LabelValues: []*metrics.LabelValue{{Value: datum.MakeInt(1, ts)}},
+	}))
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "queue_length",
+		Program:     "test",
+		Kind:        metrics.Gauge,
+		TimeSource:  metrics.ScrapeTime,
+		LabelValues: []*metrics.LabelValue{{Value: datum.MakeInt(2, ts)}},
+	}))
+	for _, emit := range []bool{false, true} {
+		var opts []func(*Exporter) error
+		if emit {
+			opts = append(opts, EmitTimestamp)
+		}
+		e, err := New(ms, opts...)
+		testutil.FatalIfErr(t, err)
+		reg := prometheus.NewPedanticRegistry()
+		testutil.FatalIfErr(t, reg.Register(e))
+		mfs, err := reg.Gather()
+		testutil.FatalIfErr(t, err)
+		// Only metrics timestamped with the log time are sent with their
+		// timestamp, and only when timestamps are emitted.
+		expected := map[string]int64{
+			"queue_length": 0,
+			"requests":     0,
+		}
+		if emit {
+			expected["requests"] = ts.UnixNano() / 1e6
+		}
+		got := make(map[string]int64)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				got[mf.GetName()] = m.GetTimestampMs()
+			}
+		}
+		if diff := testutil.Diff(expected, got); diff != "" {
+			t.Errorf("emit timestamp %v: timestamps diff:\n%s", emit, diff)
+		}
+	}
+}
+
+func TestHandlePrometheusResetOnExport(t *testing.T) {
+	ms := metrics.NewStore()
+	peak := metrics.NewMetric("peak_connections", "test", metrics.Gauge, metrics.Int)
+	peak.ResetOnExport = true
+	testutil.FatalIfErr(t, ms.Add(peak))
+	running := metrics.NewMetric("max_connections", "test", metrics.Gauge, metrics.Int)
+	testutil.FatalIfErr(t, ms.Add(running))
+	e, err := New(ms, OmitProgLabel)
+	testutil.FatalIfErr(t, err)
+	reg := prometheus.NewPedanticRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+
+	observe := func(values ...int64) {
+		for _, m := range []*metrics.Metric{peak, running} {
+			d, err := m.GetDatum()
+			testutil.FatalIfErr(t, err)
+			for _, v := range values {
+				datum.MaxInt(d, v, time.Now())
+			}
+		}
+	}
+	// scrape returns the exported value of each metric.
+	scrape := func() map[string]float64 {
+		mfs, err := reg.Gather()
+		testutil.FatalIfErr(t, err)
+		got := make(map[string]float64)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				got[mf.GetName()] = m.GetGauge().GetValue()
+			}
+		}
+		return got
+	}
+	observe(3, 10, 7)
+	if diff := testutil.Diff(map[string]float64{"peak_connections": 10, "max_connections": 10}, scrape()); diff != "" {
+		t.Errorf("first scrape diff:\n%s", diff)
+	}
+	// The peak since the last scrape is lower than the running maximum.
+	observe(4, 2)
+	if diff := testutil.Diff(map[string]float64{"peak_connections": 4, "max_connections": 10}, scrape()); diff != "" {
+		t.Errorf("second scrape diff:\n%s", diff)
+	}
+	// With no observations the peak is back to its initial value.
+	if diff := testutil.Diff(map[string]float64{"peak_connections": 0, "max_connections": 10}, scrape()); diff != "" {
+		t.Errorf("third scrape diff:\n%s", diff)
+	}
+}
+
+func TestHandlePrometheusStaleMarkers(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "code")
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now())
+	d, err = m.GetDatum("500")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 2, time.Unix(0, 0))
+	testutil.FatalIfErr(t, m.ExpireDatum(time.Hour, "500"))
+	testutil.FatalIfErr(t, ms.Add(m))
+
+	e, err := New(ms, EmitStaleMarkers)
+	testutil.FatalIfErr(t, err)
+	reg := prometheus.NewPedanticRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+	h := e.PrometheusHandler(reg)
+
+	testutil.FatalIfErr(t, ms.Gc())
+
+	// The text format can't carry the marker, so the expired series is left
+	// out of it.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if body := w.Body.String(); strings.Contains(body, "NaN") || strings.Contains(body, `code="500"`) {
+		t.Errorf("unexpected expired series in text format:\n%s", body)
+	}
+
+	scrape := func() map[string]float64 {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		dec := expfmt.NewDecoder(w.Body, expfmt.ResponseFormat(w.Result().Header))
+		values := make(map[string]float64)
+		for {
+			var mf dto.MetricFamily
+			err := dec.Decode(&mf)
+			if err == io.EOF {
+				break
+			}
+			testutil.FatalIfErr(t, err)
+			for _, pm := range mf.GetMetric() {
+				for _, l := range pm.GetLabel() {
+					if l.GetName() == "code" {
+						values[l.GetValue()] = pm.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return values
+	}
+	values := scrape()
+	if len(values) != 2 || values["200"] != 1 {
+		t.Errorf("unexpected values: %v", values)
+	}
+	if v, ok := values["500"]; !ok || math.Float64bits(v) != math.Float64bits(staleNaN) {
+		t.Errorf("expected staleness marker for expired series, got %v", v)
+	}
+	// The marker is only emitted once.
+	values = scrape()
+	if _, ok := values["500"]; ok || len(values) != 1 {
+		t.Errorf("unexpected values after marking stale: %v", values)
+	}
+}
+
+func TestPrometheusHandlerLearnedBuckets(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("latency", "prog", metrics.Histogram, metrics.Buckets)
+	m.Learner = datum.NewBucketLearner(3)
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel)
+	testutil.FatalIfErr(t, err)
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+	h := e.PrometheusHandler(reg)
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		b, err := ioutil.ReadAll(w.Result().Body)
+		testutil.FatalIfErr(t, err)
+		return string(b)
+	}
+	const comment = "# COMMENT mtail_learned_buckets latency buckets 1, 1.7, 2.8, 4.6, 7.7, 13, 22, 36, 60, 100\n"
+
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.Observe(d, 1, time.Unix(0, 0))
+	datum.Observe(d, 100, time.Unix(0, 0))
+	if got := scrape(); strings.Contains(got, "mtail_learned_buckets") {
+		t.Errorf("buckets reported before they're learned:\n%s", got)
+	}
+
+	datum.Observe(d, 10, time.Unix(0, 0))
+	got := scrape()
+	if !strings.HasSuffix(got, comment) {
+		t.Errorf("expected learned buckets comment %q, got:\n%s", comment, got)
+	}
+	for _, line := range []string{`latency_bucket{le="1"} 1`, `latency_bucket{le="13"} 2`, `latency_bucket{le="100"} 3`, `latency_count 3`} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %q, got:\n%s", line, got)
+		}
+	}
+}
+
+func TestPromTypeName(t *testing.T) {
+	for _, tc := range []struct {
+		kind     metrics.Kind
+		promType string
+		expected string
+	}{
+		{metrics.Counter, "", "counter"},
+		{metrics.Counter, "untyped", "untyped"},
+		{metrics.Gauge, "", "gauge"},
+		{metrics.Timer, "", "gauge"},
+		{metrics.Histogram, "", "histogram"},
+		{metrics.Histogram, "summary", "summary"},
+		{metrics.HLL, "", "gauge"},
+		{metrics.Text, "", ""},
+	} {
+		m := &metrics.Metric{Name: "foo", Kind: tc.kind, PrometheusType: tc.promType}
+		if got := promTypeName(m); got != tc.expected {
+			t.Errorf("promTypeName(%v, %q): expected %q, got %q", tc.kind, tc.promType, tc.expected, got)
+		}
+	}
+}
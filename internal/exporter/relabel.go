@@ -0,0 +1,138 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// relabelRule rewrites or drops exported series, like an entry of Prometheus'
+// metric_relabel_configs.  The values of the source labels are joined with
+// the separator, and if the regex matches the result, the target label is set
+// to the replacement with the regex's submatches expanded, or the series is
+// dropped if the replacement is empty.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp // anchored at both ends
+	targetLabel  string
+	replacement  string
+	drop         bool // if set, matching series are not exported
+}
+
+// RelabelRules instructs the exporter to rewrite the labels of exported
+// metrics with the rules in the YAML file at path, and to drop the series
+// that the rules say to drop.
+func RelabelRules(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "reading relabel rules")
+		}
+		rules, err := parseRelabelRules(data)
+		if err != nil {
+			return errors.Wrapf(err, "parsing relabel rules in %s", path)
+		}
+		e.relabelRules = append(e.relabelRules, rules...)
+		return nil
+	}
+}
+
+// relabel applies the rules in order to the labels of a series of the metric
+// named name, which can be matched as the __name__ source label.  It returns
+// false if a rule drops the series.
+func relabel(rules []relabelRule, name string, labels map[string]string) bool {
+	for _, r := range rules {
+		values := make([]string, len(r.sourceLabels))
+		for i, k := range r.sourceLabels {
+			if k == "__name__" {
+				values[i] = name
+			} else {
+				values[i] = labels[k]
+			}
+		}
+		v := strings.Join(values, r.separator)
+		match := r.regex.FindStringSubmatchIndex(v)
+		if match == nil {
+			continue
+		}
+		if r.drop {
+			return false
+		}
+		if s := string(r.regex.ExpandString(nil, r.replacement, v, match)); s != "" {
+			labels[r.targetLabel] = s
+		} else {
+			delete(labels, r.targetLabel)
+		}
+	}
+	return true
+}
+
+// relabelConfig is a rule as written in a rules file.  The optional fields
+// are pointers, to tell them apart from empty strings.
+type relabelConfig struct {
+	SourceLabels stringList `yaml:"source_labels"`
+	Separator    *string    `yaml:"separator"`
+	Regex        *string    `yaml:"regex"`
+	TargetLabel  string     `yaml:"target_label"`
+	Replacement  *string    `yaml:"replacement"`
+}
+
+// stringList is a sequence of strings, or a single string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = []string{s}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+// parseRelabelRules parses a rules file: a YAML sequence of rules, each a
+// mapping with the fields source_labels, separator, regex, target_label and
+// replacement.
+func parseRelabelRules(data []byte) ([]relabelRule, error) {
+	var configs []relabelConfig
+	if err := yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, err
+	}
+	var rules []relabelRule
+	for i, c := range configs {
+		r := relabelRule{sourceLabels: c.SourceLabels, separator: ";", targetLabel: c.TargetLabel, replacement: "$1"}
+		regex := "(.*)"
+		if c.Separator != nil {
+			r.separator = *c.Separator
+		}
+		if c.Regex != nil {
+			regex = *c.Regex
+		}
+		if c.Replacement != nil {
+			r.replacement = *c.Replacement
+		}
+		if len(r.sourceLabels) == 0 {
+			return nil, errors.Errorf("rule %d: no source_labels", i+1)
+		}
+		var err error
+		r.regex, err = regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %d: invalid regex", i+1)
+		}
+		r.drop = c.Replacement != nil && r.replacement == ""
+		if !r.drop && r.targetLabel == "" {
+			return nil, errors.Errorf("rule %d: no target_label", i+1)
+		}
+		if r.targetLabel == "__name__" || r.targetLabel == "prog" {
+			return nil, errors.Errorf("rule %d: target_label %s can't be rewritten", i+1, r.targetLabel)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
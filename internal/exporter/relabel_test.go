@@ -0,0 +1,135 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var parseRelabelRulesTests = []struct {
+	name     string
+	rules    string
+	expected []relabelRule // with the regex as written, for comparison
+	regexes  []string
+	err      bool
+}{
+	{"flow",
+		`- {source_labels: [method], target_label: http_method, regex: "(.*)", replacement: "$1"}`,
+		[]relabelRule{{sourceLabels: []string{"method"}, separator: ";", targetLabel: "http_method", replacement: "$1"}},
+		[]string{"^(?:(.*))$"},
+		false,
+	},
+	{"block",
+		`# Rewrite the status code class.
+- source_labels: [code]
+  regex: (\d)..   # the first digit
+  target_label: class
+  replacement: ${1}xx
+- source_labels:
+  - method
+  - path
+  separator: ' '
+  regex: 'GET /healthz'
+  replacement: ''
+`,
+		[]relabelRule{
+			{sourceLabels: []string{"code"}, separator: ";", targetLabel: "class", replacement: "${1}xx"},
+			{sourceLabels: []string{"method", "path"}, separator: " ", replacement: "", drop: true},
+		},
+		[]string{`^(?:(\d)..)$`, `^(?:GET /healthz)$`},
+		false,
+	},
+	{"defaults",
+		`- source_labels: [__name__]
+  target_label: metric`,
+		[]relabelRule{{sourceLabels: []string{"__name__"}, separator: ";", targetLabel: "metric", replacement: "$1"}},
+		[]string{"^(?:(.*))$"},
+		false,
+	},
+	{"flow across lines",
+		`- {source_labels: [a, "b"],
+   target_label: 'it''s', replacement: "x#y"}`,
+		[]relabelRule{{sourceLabels: []string{"a", "b"}, separator: ";", targetLabel: "it's", replacement: "x#y"}},
+		[]string{"^(?:(.*))$"},
+		false,
+	},
+	{"unknown field", `- {source_labels: [a], target_label: b, action: keep}`, nil, nil, true},
+	{"no source labels", `- {target_label: b}`, nil, nil, true},
+	{"no target label", `- {source_labels: [a]}`, nil, nil, true},
+	{"name target", `- {source_labels: [a], target_label: __name__}`, nil, nil, true},
+	{"bad regex", `- {source_labels: [a], target_label: b, regex: "("}`, nil, nil, true},
+	{"not a sequence", `source_labels: [a]`, nil, nil, true},
+	{"unterminated", `- {source_labels: [a], target_label: "b}`, nil, nil, true},
+	{"duplicate key", `- {source_labels: [a], target_label: b, target_label: c}`, nil, nil, true},
+	{"bad indentation", "- source_labels: [a]\n    target_label: b", nil, nil, true},
+}
+
+func TestParseRelabelRules(t *testing.T) {
+	for _, tc := range parseRelabelRulesTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseRelabelRules([]byte(tc.rules))
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected an error, got rules %v", rules)
+				}
+				return
+			}
+			testutil.FatalIfErr(t, err)
+			var regexes []string
+			for i := range rules {
+				regexes = append(regexes, rules[i].regex.String())
+				rules[i].regex = nil
+			}
+			if diff := testutil.Diff(tc.expected, rules, testutil.AllowUnexported(relabelRule{})); diff != "" {
+				t.Errorf("rules didn't match:\n%s", diff)
+			}
+			if diff := testutil.Diff(tc.regexes, regexes); diff != "" {
+				t.Errorf("regexes didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	rules, err := parseRelabelRules([]byte(`
+- {source_labels: [method], target_label: http_method}
+- {source_labels: [code], regex: '(\d)..', target_label: class, replacement: '${1}xx'}
+- {source_labels: [__name__, path], regex: 'requests;/healthz', replacement: ''}
+`))
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string // nil if dropped
+	}{
+		{"rewritten",
+			map[string]string{"method": "GET", "code": "404", "path": "/"},
+			map[string]string{"http_method": "GET", "method": "GET", "code": "404", "class": "4xx", "path": "/"},
+		},
+		{"unmatched",
+			map[string]string{"code": "ok"},
+			map[string]string{"code": "ok"},
+		},
+		{"dropped",
+			map[string]string{"path": "/healthz"},
+			nil,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ok := relabel(rules, "requests", tc.labels)
+			if ok != (tc.expected != nil) {
+				t.Fatalf("expected kept %v, got %v", tc.expected != nil, ok)
+			}
+			if ok {
+				if diff := testutil.Diff(tc.expected, tc.labels); diff != "" {
+					t.Errorf("labels didn't match:\n%s", diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	remoteWriteURL = flag.String("remote_write_url", "",
+		"URL of a Prometheus remote write endpoint, such as Cortex, Thanos Receive or Mimir, to push metrics to, e.g. http://localhost:9009/api/v1/push.")
+	remoteWriteMaxSeries = flag.Int("remote_write_max_series_per_request", 500,
+		"Most series sent to the remote write endpoint in one request.  The series of a push are sent in as many requests as needed.")
+
+	remoteWriteExportTotal    = expvar.NewInt("remote_write_export_total")
+	remoteWriteExportSuccess  = expvar.NewInt("remote_write_export_success")
+	remoteWriteExportRejected = expvar.NewInt("remote_write_export_rejected")
+)
+
+// The messages of the remote write protocol, as defined by the prompb
+// package of Prometheus, for the protocol buffer package to encode.
+
+// remoteWriteRequest is a WriteRequest message.
+type remoteWriteRequest struct {
+	Timeseries []*remoteWriteSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *remoteWriteRequest) Reset()         { *m = remoteWriteRequest{} }
+func (m *remoteWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*remoteWriteRequest) ProtoMessage()    {}
+
+// remoteWriteSeries is a TimeSeries message.  The series pushed have a
+// single sample, and labels sorted by name.
+type remoteWriteSeries struct {
+	Labels  []*remoteWriteLabel  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*remoteWriteSample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *remoteWriteSeries) Reset()         { *m = remoteWriteSeries{} }
+func (m *remoteWriteSeries) String() string { return proto.CompactTextString(m) }
+func (*remoteWriteSeries) ProtoMessage()    {}
+
+// remoteWriteLabel is a Label message.
+type remoteWriteLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *remoteWriteLabel) Reset()         { *m = remoteWriteLabel{} }
+func (m *remoteWriteLabel) String() string { return proto.CompactTextString(m) }
+func (*remoteWriteLabel) ProtoMessage()    {}
+
+// remoteWriteSample is a Sample message.
+type remoteWriteSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"` // milliseconds since the epoch
+}
+
+func (m *remoteWriteSample) Reset()         { *m = remoteWriteSample{} }
+func (m *remoteWriteSample) String() string { return proto.CompactTextString(m) }
+func (*remoteWriteSample) ProtoMessage()    {}
+
+// remoteWriteSeriesOf translates the metric families into remote write time
+// series, named and labelled as Prometheus would name and label the series
+// scraped from them.  Samples without a timestamp are stamped with now.
+func remoteWriteSeriesOf(mfs []*dto.MetricFamily, now time.Time) []*remoteWriteSeries {
+	var series []*remoteWriteSeries
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ts := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...*remoteWriteLabel) {
+				labels := []*remoteWriteLabel{{Name: "__name__", Value: name}}
+				for _, l := range m.GetLabel() {
+					labels = append(labels, &remoteWriteLabel{Name: l.GetName(), Value: l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+				series = append(series, &remoteWriteSeries{labels, []*remoteWriteSample{{Value: value, Timestamp: ts}}})
+			}
+			name := mf.GetName()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					le := b.GetUpperBound()
+					inf = inf || math.IsInf(le, 1)
+					add(name+"_bucket", float64(b.GetCumulativeCount()), &remoteWriteLabel{Name: "le", Value: formatLe(le)})
+				}
+				if !inf {
+					add(name+"_bucket", float64(h.GetSampleCount()), &remoteWriteLabel{Name: "le", Value: "+Inf"})
+				}
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(name, q.GetValue(), &remoteWriteLabel{Name: "quantile", Value: strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", sm.GetSampleSum())
+				add(name+"_count", float64(sm.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// formatLe formats a bucket's upper bound as the value of its le label.
+func formatLe(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// remoteWriteError is an unsuccessful response from the remote write
+// endpoint.
+type remoteWriteError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e remoteWriteError) Error() string {
+	return fmt.Sprintf("remote write failed: %s: %s", e.status, e.body)
+}
+
+// Temporary returns true for server errors and rate limiting, after which the
+// remote write protocol has the push retried.  Other client errors mean the
+// samples were rejected, and would be again.
+func (e remoteWriteError) Temporary() bool {
+	return e.code/100 == 5 || e.code == http.StatusTooManyRequests
+}
+
+// pushRemoteWrite posts all the exported metrics to the remote write
+// endpoint, in requests of at most the maximum series each.  Counters are
+// always pushed as their totals.
+func (e *Exporter) pushRemoteWrite(ctx context.Context) error {
+	mfs, err := e.remoteWriteRegistry.Gather()
+	if err != nil {
+		return errors.Wrap(err, "gathering metrics")
+	}
+	series := remoteWriteSeriesOf(mfs, time.Now())
+	for len(series) > 0 {
+		n := len(series)
+		if *remoteWriteMaxSeries > 0 && n > *remoteWriteMaxSeries {
+			n = *remoteWriteMaxSeries
+		}
+		if err := e.postRemoteWrite(ctx, series[:n]); err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+// postRemoteWrite posts the series to the remote write endpoint in a single
+// request.
+func (e *Exporter) postRemoteWrite(ctx context.Context, series []*remoteWriteSeries) error {
+	b, err := proto.Marshal(&remoteWriteRequest{Timeseries: series})
+	if err != nil {
+		return errors.Wrap(err, "encoding remote write request")
+	}
+	body := snappy.Encode(nil, b)
+
+	remoteWriteExportTotal.Add(int64(len(series)))
+	ctx, cancel := context.WithTimeout(ctx, *scrapeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", e.remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating remote write request")
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mtail")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	client := &http.Client{Timeout: *scrapeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "posting to remote write endpoint")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err := remoteWriteError{resp.StatusCode, resp.Status, string(bytes.TrimSpace(msg))}
+		if !err.Temporary() {
+			remoteWriteExportRejected.Add(int64(len(series)))
+		}
+		return err
+	}
+	remoteWriteExportSuccess.Add(int64(len(series)))
+	return nil
+}
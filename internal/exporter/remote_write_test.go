@@ -0,0 +1,234 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// decodeWriteRequest decodes the series of a snappy compressed remote write
+// WriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []*remoteWriteSeries {
+	t.Helper()
+	b, err := snappy.Decode(nil, b)
+	testutil.FatalIfErr(t, err)
+	var req remoteWriteRequest
+	testutil.FatalIfErr(t, proto.Unmarshal(b, &req))
+	return req.Timeseries
+}
+
+func TestPushRemoteWrite(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	store := metrics.NewStore()
+
+	m := metrics.NewMetric("requests-total", "prog", metrics.Counter, metrics.Int, "code")
+	d, _ := m.GetDatum("200")
+	datum.SetInt(d, 37, ts)
+	testutil.FatalIfErr(t, store.Add(m))
+	latency := metrics.NewMetric("latency", "prog", metrics.Gauge, metrics.Float)
+	d, _ = latency.GetDatum()
+	datum.SetFloat(d, 0.25, ts)
+	testutil.FatalIfErr(t, store.Add(latency))
+	h := metrics.NewMetric("size", "prog", metrics.Histogram, metrics.Buckets)
+	h.Buckets = []datum.Range{{Min: 0, Max: 10}, {Min: 10, Max: math.Inf(+1)}}
+	d, _ = h.GetDatum()
+	d.(*datum.Buckets).Observe(5, ts)
+	d.(*datum.Buckets).Observe(50, ts)
+	testutil.FatalIfErr(t, store.Add(h))
+	text := metrics.NewMetric("version", "prog", metrics.Text, metrics.String)
+	d, _ = text.GetDatum()
+	datum.SetString(d, "1.0", ts)
+	testutil.FatalIfErr(t, store.Add(text))
+
+	var body []byte
+	header := http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		body = b
+		header = r.Header
+	}))
+	defer srv.Close()
+
+	defer testutil.TestSetFlag(t, "remote_write_url", srv.URL)()
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	testutil.FatalIfErr(t, e.pushRemoteWrite(context.Background()))
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	for k, v := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := header.Get(k); got != v {
+			t.Errorf("header %s: expected %q, got %q", k, v, got)
+		}
+	}
+
+	series := decodeWriteRequest(t, body)
+	// The samples are stamped with the time of the push.
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			if sample.Timestamp < before || sample.Timestamp > after {
+				t.Errorf("timestamp %d of %v not between %d and %d", sample.Timestamp, s.Labels, before, after)
+			}
+			sample.Timestamp = 0
+		}
+	}
+	sortRemoteWriteSeries(series)
+	prog := &remoteWriteLabel{Name: "prog", Value: "prog"}
+	sample := func(v float64) []*remoteWriteSample { return []*remoteWriteSample{{Value: v}} }
+	expected := []*remoteWriteSeries{
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "latency"}, prog}, sample(0.25)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "requests_total"}, {Name: "code", Value: "200"}, prog}, sample(37)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "size_bucket"}, {Name: "le", Value: "+Inf"}, prog}, sample(2)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "size_bucket"}, {Name: "le", Value: "10"}, prog}, sample(1)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "size_count"}, prog}, sample(2)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "size_sum"}, prog}, sample(55)},
+	}
+	if diff := testutil.Diff(expected, series); diff != "" {
+		t.Errorf("series didn't match:\n%s", diff)
+	}
+}
+
+func TestRemoteWriteSeriesOfSummary(t *testing.T) {
+	mfs := []*dto.MetricFamily{{
+		Name: proto.String("latency"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("prog"), Value: proto.String("prog")}},
+			Summary: &dto.Summary{
+				SampleCount: proto.Uint64(4),
+				SampleSum:   proto.Float64(2.5),
+				Quantile: []*dto.Quantile{
+					{Quantile: proto.Float64(0.5), Value: proto.Float64(0.25)},
+					{Quantile: proto.Float64(0.99), Value: proto.Float64(1.5)},
+				},
+			},
+			TimestampMs: proto.Int64(37000),
+		}},
+	}}
+	series := remoteWriteSeriesOf(mfs, time.Now())
+	prog := &remoteWriteLabel{Name: "prog", Value: "prog"}
+	sample := func(v float64) []*remoteWriteSample { return []*remoteWriteSample{{Value: v, Timestamp: 37000}} }
+	expected := []*remoteWriteSeries{
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "latency"}, prog, {Name: "quantile", Value: "0.5"}}, sample(0.25)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "latency"}, prog, {Name: "quantile", Value: "0.99"}}, sample(1.5)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "latency_sum"}, prog}, sample(2.5)},
+		{[]*remoteWriteLabel{{Name: "__name__", Value: "latency_count"}, prog}, sample(4)},
+	}
+	if diff := testutil.Diff(expected, series); diff != "" {
+		t.Errorf("series didn't match:\n%s", diff)
+	}
+}
+
+// sortRemoteWriteSeries sorts series by the values of their first two
+// labels, as metrics are pushed in store order, which isn't deterministic.
+func sortRemoteWriteSeries(series []*remoteWriteSeries) {
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i].Labels, series[j].Labels
+		if a[0].Value != b[0].Value {
+			return a[0].Value < b[0].Value
+		}
+		return a[1].Value < b[1].Value
+	})
+}
+
+func TestPushRemoteWriteMaxSeries(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("lines", "prog", metrics.Counter, metrics.Int, "n")
+	for _, n := range []string{"1", "2", "3", "4", "5"} {
+		d, _ := m.GetDatum(n)
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	}
+	testutil.FatalIfErr(t, store.Add(m))
+
+	var requests []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		requests = append(requests, len(decodeWriteRequest(t, b)))
+	}))
+	defer srv.Close()
+
+	defer testutil.TestSetFlag(t, "remote_write_url", srv.URL)()
+	defer testutil.TestSetFlag(t, "remote_write_max_series_per_request", "2")()
+	e, err := New(store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, e.pushRemoteWrite(context.Background()))
+	if diff := testutil.Diff([]int{2, 2, 1}, requests); diff != "" {
+		t.Errorf("series per request didn't match:\n%s", diff)
+	}
+}
+
+func TestPushRemoteWriteErrors(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("lines", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	testutil.FatalIfErr(t, store.Add(m))
+
+	defer func(old time.Duration) { pushRetryBackoff = old }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		calls    int32
+		err      bool
+		rejected int64
+	}{
+		{"server error retried", []int{503, 500, 200}, 3, false, 0},
+		{"rate limited retried", []int{429, 200}, 2, false, 0},
+		{"client error not retried", []int{400}, 1, true, 1},
+		{"retries bounded", []int{503, 503, 503, 503, 503}, int32(pushRetries + 1), true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				w.WriteHeader(tc.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			defer testutil.TestSetFlag(t, "remote_write_url", srv.URL)()
+			e, err := New(store)
+			testutil.FatalIfErr(t, err)
+			rejected := remoteWriteExportRejected.Value()
+			err = withRetries(context.Background(), e.pushRemoteWrite)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			var rwErr remoteWriteError
+			if err != nil && !errors.As(err, &rwErr) {
+				t.Errorf("expected a remote write error, got %v", err)
+			}
+			if got := atomic.LoadInt32(&calls); got != tc.calls {
+				t.Errorf("expected %d requests, got %d", tc.calls, got)
+			}
+			if got := remoteWriteExportRejected.Value() - rejected; got != tc.rejected {
+				t.Errorf("expected %d rejected series, got %d", tc.rejected, got)
+			}
+		})
+	}
+}
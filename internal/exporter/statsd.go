@@ -23,12 +23,12 @@ var (
 
 // metricToStatsd encodes a metric in the statsd text protocol format.  The
 // metric lock is held before entering this function.
-func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+func metricToStatsd(hostname, name string, m *metrics.Metric, l *metrics.LabelSet) string {
 	var t string
 	switch m.Kind {
 	case metrics.Counter:
 		t = "c" // StatsD Counter
-	case metrics.Gauge:
+	case metrics.Gauge, metrics.Window, metrics.Info, metrics.HLL:
 		t = "g" // StatsD Gauge
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
@@ -36,6 +36,6 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) str
 	return fmt.Sprintf("%s%s.%s:%s|%s",
 		*statsdPrefix,
 		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
+		formatLabels(name, l.Labels, ".", ".", "_"),
 		l.Datum.ValueString(), t)
 }
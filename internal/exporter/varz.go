@@ -26,22 +26,29 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Content-type", "text/plain")
 
-	for _, ml := range e.store.Metrics {
+	for name, ml := range e.store.Metrics {
+		if !e.exported(name) {
+			continue
+		}
 		for _, m := range ml {
 			m.RLock()
 			exportVarzTotal.Add(1)
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
 			for l := range lc {
-				line := metricToVarz(m, l, e.omitProgLabel, e.hostname)
-				fmt.Fprint(w, line)
+				if l = e.exportLabels(m, l); l == nil {
+					continue
+				}
+				for _, exportName := range exportNames(m) {
+					fmt.Fprint(w, metricToVarz(exportName, m, l, e.omitProgLabel, e.hostname))
+				}
 			}
 			m.RUnlock()
 		}
 	}
 }
 
-func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, hostname string) string {
+func metricToVarz(name string, m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, hostname string) string {
 	s := make([]string, 0, len(l.Labels)+2)
 	for k, v := range l.Labels {
 		s = append(s, fmt.Sprintf("%s=%s", k, v))
@@ -50,9 +57,11 @@ func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, ho
 	if !omitProgLabel {
 		s = append(s, fmt.Sprintf("prog=%s", m.Program))
 	}
-	s = append(s, fmt.Sprintf("instance=%s", hostname))
+	if _, ok := l.Labels["instance"]; !ok {
+		s = append(s, fmt.Sprintf("instance=%s", hostname))
+	}
 	return fmt.Sprintf(varzFormat,
-		m.Name,
+		name,
 		strings.Join(s, ","),
 		l.Datum.ValueString())
 }
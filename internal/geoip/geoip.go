@@ -0,0 +1,129 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package geoip looks up IP addresses in a MaxMind DB file, such as the
+// GeoLite2 Country, City and ASN databases, with the MaxMind DB reader.
+package geoip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+// Unknown is the value of a field of an address that isn't in the database,
+// or that has no such field.
+const Unknown = "unknown"
+
+// fields maps the short field names accepted by Lookup to their paths in the
+// records of the GeoLite2 databases.
+var fields = map[string]string{
+	"asn":       "autonomous_system_number",
+	"asn_org":   "autonomous_system_organization",
+	"city":      "city.names.en",
+	"continent": "continent.code",
+	"country":   "country.iso_code",
+}
+
+// cacheSize is the number of field values of records kept decoded.
+const cacheSize = 4096
+
+// DB is a MaxMind DB.  It is safe for concurrent use.
+type DB struct {
+	r *maxminddb.Reader
+
+	mu    sync.Mutex
+	cache *lru.Cache // Field values by cacheKey, as records are shared by many addresses.
+}
+
+// cacheKey identifies a field of the record at an offset in the data section.
+type cacheKey struct {
+	offset uintptr
+	field  string
+}
+
+// Open opens the MaxMind DB file at path.
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load GeoIP database %q", path)
+	}
+	return &DB{r: r, cache: lru.New(cacheSize)}, nil
+}
+
+// New returns the MaxMind DB contained in buf.
+func New(buf []byte) (*DB, error) {
+	r, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load GeoIP database")
+	}
+	return &DB{r: r, cache: lru.New(cacheSize)}, nil
+}
+
+// Lookup returns the value of the field of the record of the address ip, or
+// Unknown if it has no such field or isn't in the database.  The field is one
+// of asn, asn_org, city, continent or country, or the dotted path of a field
+// in the record, like "country.names.de".
+func (db *DB) Lookup(ip, field string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return Unknown
+	}
+	offset, err := db.r.LookupOffset(addr)
+	if err != nil || offset == maxminddb.NotFound {
+		return Unknown
+	}
+	key := cacheKey{offset, field}
+	db.mu.Lock()
+	v, ok := db.cache.Get(key)
+	db.mu.Unlock()
+	if ok {
+		return v.(string)
+	}
+	value := db.field(offset, field)
+	db.mu.Lock()
+	db.cache.Add(key, value)
+	db.mu.Unlock()
+	return value
+}
+
+// field decodes the record at offset and returns the value of field.
+func (db *DB) field(offset uintptr, field string) string {
+	var v interface{}
+	if err := db.r.Decode(offset, &v); err != nil {
+		return Unknown
+	}
+	path := field
+	if p, ok := fields[field]; ok {
+		path = p
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return Unknown
+		}
+		if v, ok = m[key]; !ok {
+			return Unknown
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return Unknown
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// metadataMarker precedes the metadata at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data types of the data section, as used by encode.
+const (
+	typeString = 2
+	typeUint32 = 6
+	typeMap    = 7
+)
+
+// encode appends the data section encoding of v to b.
+func encode(b []byte, v interface{}) []byte {
+	ctrl := func(b []byte, typ, size int) []byte {
+		var c byte
+		var ext []byte
+		if typ > 7 {
+			ext = []byte{byte(typ - 7)}
+		} else {
+			c = byte(typ << 5)
+		}
+		if size < 29 {
+			b = append(b, c|byte(size))
+			b = append(b, ext...)
+		} else {
+			b = append(b, c|29)
+			b = append(b, ext...)
+			b = append(b, byte(size-29))
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case string:
+		b = ctrl(b, typeString, len(v))
+		return append(b, v...)
+	case uint32:
+		n := 0
+		for x := v; x > 0; x >>= 8 {
+			n++
+		}
+		b = ctrl(b, typeUint32, n)
+		for i := n - 1; i >= 0; i-- {
+			b = append(b, byte(v>>(8*uint(i))))
+		}
+		return b
+	case map[string]interface{}:
+		b = ctrl(b, typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = encode(b, k)
+			b = encode(b, v[k])
+		}
+		return b
+	}
+	panic(v)
+}
+
+// makeDB returns a MaxMind DB with the given record size and IP version, in
+// which each network in records has its record.
+func makeDB(t *testing.T, recordSize, ipVersion int, records map[string]map[string]interface{}) []byte {
+	t.Helper()
+	const empty = -1
+	// A record is the index of a node, empty, or -2-i for the ith record.
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var offsets []int
+	networks := make([]string, 0, len(records))
+	for network := range records {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for i, network := range networks {
+		offsets = append(offsets, len(data))
+		data = encode(data, records[network])
+		_, n, err := net.ParseCIDR(network)
+		testutil.FatalIfErr(t, err)
+		ip := []byte(n.IP)
+		ones, _ := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil && ipVersion == 6 {
+			// IPv4 networks are in the ::/96 subtree of an IPv6 tree.
+			ip = append(make([]byte, 12), ip4...)
+			ones += 96
+		}
+		node := 0
+		for j := 0; j < ones; j++ {
+			bit := ip[j/8] >> (7 - uint(j%8)) & 1
+			if j == ones-1 {
+				nodes[node][bit] = -2 - i
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	count := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == empty:
+			return uint32(count)
+		case r < empty:
+			return uint32(count + 16 + offsets[-2-r])
+		}
+		return uint32(r)
+	}
+	var db []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			db = append(db, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			db = append(db, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4)|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			db = append(db, make([]byte, 8)...)
+			binary.BigEndian.PutUint32(db[len(db)-8:], l)
+			binary.BigEndian.PutUint32(db[len(db)-4:], r)
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	return encode(db, map[string]interface{}{
+		"node_count":    uint32(count),
+		"record_size":   uint32(recordSize),
+		"ip_version":    uint32(ipVersion),
+		"database_type": "mtail-Test",
+	})
+}
+
+var testRecords = map[string]map[string]interface{}{
+	"1.2.3.0/24": {
+		"country": map[string]interface{}{"iso_code": "AU", "names": map[string]interface{}{"en": "Australia", "de": "Australien"}},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Sydney"}},
+	},
+	"10.0.0.0/8": {
+		"autonomous_system_number":       uint32(64512),
+		"autonomous_system_organization": "Example Networks",
+	},
+	"2001:db8::/32": {
+		"country": map[string]interface{}{"iso_code": "NZ"},
+	},
+}
+
+func TestLookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			db, err := New(makeDB(t, recordSize, ipVersion, testRecords))
+			testutil.FatalIfErr(t, err)
+			for _, tc := range []struct {
+				ip, field, expected string
+			}{
+				{"1.2.3.4", "country", "AU"},
+				{"1.2.3.255", "city", "Sydney"},
+				{"1.2.3.4", "country.names.de", "Australien"},
+				{"1.2.3.4", "asn", Unknown},
+				{"1.2.3.4", "country.names.fr", Unknown},
+				{"1.2.3.4", "country.iso_code.x", Unknown},
+				{"1.2.4.1", "country", Unknown},
+				{"10.200.0.1", "asn", "64512"},
+				{"10.200.0.1", "asn_org", "Example Networks"},
+				{"::ffff:10.0.0.1", "asn", "64512"},
+				{"not an ip", "country", Unknown},
+				{"2001:db8::1", "country", map[int]string{4: Unknown, 6: "NZ"}[ipVersion]},
+				{"2001:db9::1", "country", Unknown},
+			} {
+				// Look up twice, to get the value from the cache.
+				for i := 0; i < 2; i++ {
+					if got := db.Lookup(tc.ip, tc.field); got != tc.expected {
+						t.Errorf("record size %d, IPv%d: Lookup(%q, %q): expected %q, got %q", recordSize, ipVersion, tc.ip, tc.field, tc.expected, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	path := filepath.Join(tmpDir, "test.mmdb")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, makeDB(t, 24, 6, testRecords), 0644))
+	db, err := Open(path)
+	testutil.FatalIfErr(t, err)
+	if got := db.Lookup("1.2.3.4", "country"); got != "AU" {
+		t.Errorf("expected AU, got %q", got)
+	}
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("not a database"), 0644))
+	if _, err := Open(path); err == nil {
+		t.Error("expected an error opening a file that isn't a database")
+	}
+	if _, err := Open(filepath.Join(tmpDir, "missing.mmdb")); err == nil {
+		t.Error("expected an error opening a missing file")
+	}
+}
+
+// testdata/test.mmdb is used by tests of the geoip() builtin.
+func TestFixture(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/test.mmdb")
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(makeDB(t, 24, 6, testRecords), b); diff != "" {
+		t.Errorf("testdata/test.mmdb is not the database of testRecords:\n%s", diff)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package kafka produces messages to a topic of a Kafka cluster, with the
+// kafka-go client.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Error is an error code returned by a broker.  Its Temporary method returns
+// true if the request may succeed when retried, for example after a
+// partition has elected a new leader.
+type Error = kafkago.Error
+
+// DefaultMaxMessageBytes is the largest batch of messages sent by default,
+// below the brokers' default message.max.bytes.
+const DefaultMaxMessageBytes = 1000000
+
+// MessageOverhead is the most bytes each message adds to the size of a batch
+// besides its value.
+const MessageOverhead = 64
+
+// unavailableError is returned when no broker can be reached.
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return "no Kafka broker available: " + e.err.Error()
+}
+
+// Temporary returns true, as the brokers may become available again.
+func (e unavailableError) Temporary() bool {
+	return true
+}
+
+// Config configures a Producer.
+type Config struct {
+	Brokers         []string      // host:port addresses of the brokers to discover the cluster from.
+	Timeout         time.Duration // Time to wait for each request to complete.
+	MaxMessageBytes int           // If positive, the largest batch of messages sent to a partition at once.
+	TLS             *tls.Config   // If not nil, the brokers are connected to with TLS.
+	SASL            sasl.Mechanism
+}
+
+// Producer produces messages to the partition leaders of a Kafka cluster.  It
+// is safe for concurrent use.
+type Producer struct {
+	w *kafkago.Writer
+}
+
+// NewProducer returns a Producer configured by c.
+func NewProducer(c Config) *Producer {
+	maxBytes := c.MaxMessageBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxMessageBytes
+	}
+	return &Producer{w: &kafkago.Writer{
+		Addr:     kafkago.TCP(c.Brokers...),
+		Balancer: &kafkago.RoundRobin{},
+		// The exporter retries pushes that fail for a temporary reason.
+		MaxAttempts: 1,
+		// Batches are bounded only by size, and sent as soon as Produce has
+		// added all its messages.
+		BatchSize:    math.MaxInt32,
+		BatchBytes:   int64(maxBytes),
+		BatchTimeout: time.Millisecond,
+		ReadTimeout:  c.Timeout,
+		WriteTimeout: c.Timeout,
+		RequiredAcks: kafkago.RequireOne,
+		Transport: &kafkago.Transport{
+			DialTimeout: c.Timeout,
+			ClientID:    "mtail",
+			TLS:         c.TLS,
+			SASL:        c.SASL,
+		},
+	}}
+}
+
+// Mechanism returns the SASL mechanism named name, one of PLAIN,
+// SCRAM-SHA-256 or SCRAM-SHA-512, that authenticates as username with
+// password.
+func Mechanism(name, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, errors.Errorf("unknown SASL mechanism %q, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", name)
+}
+
+// Produce sends values to topic, spread over its partitions in turn, in
+// batches of at most the maximum message bytes.  The batches are
+// acknowledged by the partition leaders before Produce returns.  Errors for
+// which retrying may help, such as the brokers being unavailable, have a
+// Temporary method that returns true.  Produce gives up when ctx is done.
+func (p *Producer) Produce(ctx context.Context, topic string, values [][]byte) error {
+	msgs := make([]kafkago.Message, len(values))
+	for i, v := range values {
+		msgs[i] = kafkago.Message{Topic: topic, Value: v}
+	}
+	return produceError(p.w.WriteMessages(ctx, msgs...))
+}
+
+// produceError returns the error of a write, as one that's temporary if
+// retrying the whole write may help.
+func produceError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if we, ok := err.(kafkago.WriteErrors); ok {
+		for _, e := range we {
+			if e != nil {
+				err = e
+				break
+			}
+		}
+		if n := we.Count(); n < len(we) {
+			// Retrying would produce the messages that were written again,
+			// so the error isn't temporary.
+			return errors.Errorf("%d of %d messages not produced: %s", n, len(we), err)
+		}
+	}
+	var ke Error
+	if errors.As(err, &ke) {
+		return ke
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return unavailableError{err}
+	}
+	return err
+}
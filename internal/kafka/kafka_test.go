@@ -0,0 +1,71 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package kafka
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/pkg/errors"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+func temporary(err error) bool {
+	te, ok := errors.Cause(err).(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+func TestProduceError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		temporary bool
+	}{
+		{"not leader", kafkago.NotLeaderForPartition, true},
+		{"message too large", kafkago.MessageSizeTooLarge, false},
+		{"all failed", kafkago.WriteErrors{kafkago.LeaderNotAvailable, kafkago.LeaderNotAvailable}, true},
+		// Retrying would produce the first message twice.
+		{"some failed", kafkago.WriteErrors{nil, kafkago.LeaderNotAvailable}, false},
+		{"unreachable", errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "dialing"), true},
+		{"other", errors.New("other"), false},
+	} {
+		err := produceError(tc.err)
+		if err == nil || temporary(err) != tc.temporary {
+			t.Errorf("%s: expected temporary %v, got error %v", tc.name, tc.temporary, err)
+		}
+	}
+	if err := produceError(nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMechanism(t *testing.T) {
+	for name, expected := range map[string]string{"plain": "PLAIN", "SCRAM-SHA-256": "SCRAM-SHA-256", "scram-sha-512": "SCRAM-SHA-512"} {
+		m, err := Mechanism(name, "user", "pass")
+		testutil.FatalIfErr(t, err)
+		if m.Name() != expected {
+			t.Errorf("%s: expected mechanism %s, got %s", name, expected, m.Name())
+		}
+	}
+	if _, err := Mechanism("GSSAPI", "user", "pass"); err == nil {
+		t.Error("expected an error for an unsupported mechanism")
+	}
+}
+
+func TestProduceUnavailable(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	down.Close()
+	p := NewProducer(Config{Brokers: []string{down.Addr().String()}, Timeout: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = p.Produce(ctx, "metrics", [][]byte{[]byte("a")})
+	if err == nil || !temporary(err) {
+		t.Errorf("broker down: expected temporary error, got %v", err)
+	}
+}
@@ -9,11 +9,12 @@ import "context"
 type LogLine struct {
 	Context context.Context
 
-	Filename string // The log filename that this line was read from
-	Line     string // The text of the log line itself up to the newline.
+	Filename string            // The log filename that this line was read from
+	Line     string            // The text of the log line itself up to the newline.
+	Fields   map[string]string // Structured fields of the log entry the line came from, such as a journal entry's, or nil.
 }
 
 // New creates a new LogLine object.
 func New(ctx context.Context, filename string, line string) *LogLine {
-	return &LogLine{ctx, filename, line}
+	return &LogLine{ctx, filename, line, nil}
 }
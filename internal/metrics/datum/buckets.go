@@ -6,6 +6,7 @@ package datum
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -33,6 +34,8 @@ type Buckets struct {
 	Buckets []BucketCount
 	Count   uint64
 	Sum     float64
+
+	Learner *BucketLearner // If not nil, the learner of this datum's buckets.
 }
 
 func (d *Buckets) ValueString() string {
@@ -40,13 +43,19 @@ func (d *Buckets) ValueString() string {
 }
 
 func (d *Buckets) Observe(v float64, ts time.Time) {
+	// While the buckets are being learned, the observation is held by the
+	// learner, which counts it in the buckets once they're known.
+	learning := d.Learner != nil && d.Learner.observe(d, v)
+
 	d.Lock()
 	defer d.Unlock()
 
-	for i, b := range d.Buckets {
-		if b.Range.Contains(v) {
-			d.Buckets[i].Count++
-			break
+	if !learning {
+		for i, b := range d.Buckets {
+			if b.Range.Contains(v) {
+				d.Buckets[i].Count++
+				break
+			}
 		}
 	}
 
@@ -104,3 +113,154 @@ func (d *Buckets) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(j)
 }
+
+// learnedBuckets is the number of bucket boundaries chosen by a BucketLearner.
+const learnedBuckets = 10
+
+// BucketLearner chooses the buckets of a histogram from the first
+// observations made to any of its datums.  Until enough observations have
+// been made, the datums count and sum their observations but have no buckets.
+// The buckets are then chosen to cover the observed range with boundaries
+// spaced logarithmically, the held observations are counted in them, and they
+// are fixed from then on.
+type BucketLearner struct {
+	learned int32 // Set to 1 once the buckets are learned.
+
+	mu     sync.Mutex
+	n      int        // The number of observations to learn from.
+	values []float64  // The observations held while learning.
+	owners []*Buckets // The datum of each held observation.
+	datums []*Buckets // The datums created while learning.
+	bounds []float64  // The learned bucket boundaries.
+	ranges []Range    // The learned buckets.
+}
+
+// NewBucketLearner returns a BucketLearner that learns buckets from the first
+// n observations.
+func NewBucketLearner(n int) *BucketLearner {
+	return &BucketLearner{n: n}
+}
+
+// NewBuckets returns a new Buckets datum that has the learned buckets, or will
+// have once they're learned.
+func (l *BucketLearner) NewBuckets() Datum {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ranges != nil {
+		return NewBuckets(l.ranges)
+	}
+	d := &Buckets{Learner: l}
+	d.stamp(zeroTime)
+	l.datums = append(l.datums, d)
+	return d
+}
+
+// Bounds returns the upper bounds of the learned buckets, excluding the
+// infinite one, or nil if they're still being learned.
+func (l *BucketLearner) Bounds() []float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bounds
+}
+
+// observe holds the observation v made to d if the buckets are still being
+// learned, and reports whether it did.
+func (l *BucketLearner) observe(d *Buckets, v float64) bool {
+	if atomic.LoadInt32(&l.learned) == 1 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ranges != nil {
+		return false
+	}
+	l.values = append(l.values, v)
+	l.owners = append(l.owners, d)
+	if len(l.values) >= l.n {
+		l.learn()
+	}
+	return true
+}
+
+// learn chooses the buckets from the held observations, and gives them to
+// the datums with the observations counted.  l.mu must be held.
+func (l *BucketLearner) learn() {
+	l.bounds = LearnBounds(l.values, learnedBuckets)
+	min := 0.0
+	for _, max := range l.bounds {
+		if max > min {
+			l.ranges = append(l.ranges, Range{min, max})
+			min = max
+		}
+	}
+	l.ranges = append(l.ranges, Range{min, math.Inf(+1)})
+	counts := make(map[*Buckets][]BucketCount, len(l.datums))
+	for _, d := range l.datums {
+		counts[d] = make([]BucketCount, len(l.ranges))
+		for i, r := range l.ranges {
+			counts[d][i].Range = r
+		}
+	}
+	for i, v := range l.values {
+		c := counts[l.owners[i]]
+		for j := range c {
+			if c[j].Range.Contains(v) {
+				c[j].Count++
+				break
+			}
+		}
+	}
+	for d, c := range counts {
+		d.Lock()
+		d.Buckets = c
+		d.Unlock()
+	}
+	l.values, l.owners, l.datums = nil, nil, nil
+	atomic.StoreInt32(&l.learned, 1)
+}
+
+// LearnBounds returns at most n bucket boundaries spaced logarithmically
+// between the smallest positive value and the largest value, rounded to two
+// significant figures so they're easily copied into a histogram declaration.
+// The last boundary is rounded up, so that the largest value is covered.
+func LearnBounds(values []float64, n int) []float64 {
+	lo, hi := math.Inf(+1), 0.0
+	for _, v := range values {
+		if v > 0 && v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	if hi == 0 {
+		// No positive values, so there's no range to cover.
+		return []float64{0}
+	}
+	if lo == hi || n < 2 {
+		return []float64{ceil2(hi)}
+	}
+	bounds := make([]float64, 0, n)
+	for i := 0; i < n; i++ {
+		b := round2(lo * math.Pow(hi/lo, float64(i)/float64(n-1)))
+		if i == n-1 {
+			b = ceil2(hi)
+		}
+		if len(bounds) == 0 || b > bounds[len(bounds)-1] {
+			bounds = append(bounds, b)
+		}
+	}
+	return bounds
+}
+
+// round2 rounds v to two significant figures.
+func round2(v float64) float64 {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 2, 64), 64)
+	return r
+}
+
+// ceil2 rounds v up to two significant figures.
+func ceil2(v float64) float64 {
+	scale := math.Pow(10, math.Floor(math.Log10(v))-1)
+	return round2(math.Ceil(v/scale) * scale)
+}
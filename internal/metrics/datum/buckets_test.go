@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
 )
 
 func TestBucketContains(t *testing.T) {
@@ -45,3 +46,72 @@ func TestMakeBucket(t *testing.T) {
 		t.Errorf("missing buckets from BucketsByMax: expected %d, got %v", len(r)+1, len(bs))
 	}
 }
+
+func TestLearnBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		values   []float64
+		expected []float64
+	}{
+		{"decades", []float64{1, 10, 100}, []float64{1, 1.7, 2.8, 4.6, 7.7, 13, 22, 36, 60, 100}},
+		{"largest rounded up", []float64{0.5, 1234}, []float64{0.5, 1.2, 2.8, 6.8, 16, 38, 91, 220, 520, 1300}},
+		{"narrow range", []float64{10, 10.5}, []float64{10, 11}},
+		{"one value", []float64{3.14159, 3.14159}, []float64{3.2}},
+		{"nonpositive ignored", []float64{-5, 0, 2, 20}, []float64{2, 2.6, 3.3, 4.3, 5.6, 7.2, 9.3, 12, 15, 20}},
+		{"no positive values", []float64{-1, 0}, []float64{0}},
+	} {
+		if diff := testutil.Diff(tc.expected, datum.LearnBounds(tc.values, 10)); diff != "" {
+			t.Errorf("%s: bounds didn't match:\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestBucketLearner(t *testing.T) {
+	l := datum.NewBucketLearner(4)
+	a, b := l.NewBuckets(), l.NewBuckets()
+	ts := time.Unix(37, 0)
+	datum.Observe(a, 1, ts)
+	datum.Observe(b, 100, ts)
+	datum.Observe(a, 10, ts)
+	if l.Bounds() != nil {
+		t.Errorf("buckets learned early: %v", l.Bounds())
+	}
+	if got := datum.GetBucketsCount(a); got != 2 {
+		t.Errorf("count while learning: expected 2, got %d", got)
+	}
+	if got := len(datum.GetBucketsCumByMax(a)); got != 0 {
+		t.Errorf("buckets while learning: expected none, got %d", got)
+	}
+	datum.Observe(b, 5, ts)
+	if l.Bounds() == nil {
+		t.Fatal("buckets not learned")
+	}
+
+	// The observations held while learning are counted in the buckets, and
+	// later observations are counted as they're made.
+	datum.Observe(a, 50, ts)
+	c := l.NewBuckets()
+	datum.Observe(c, 2, ts)
+	for _, tc := range []struct {
+		name     string
+		d        datum.Datum
+		expected map[float64]uint64
+	}{
+		{"a", a, map[float64]uint64{1: 1, 13: 2, 60: 3}},
+		{"b", b, map[float64]uint64{1: 0, 13: 1, 60: 1}},
+		{"c", c, map[float64]uint64{1: 0, 13: 1, 60: 1}},
+	} {
+		bs := datum.GetBucketsCumByMax(tc.d)
+		if len(bs) != 11 {
+			t.Errorf("%s: expected 11 buckets, got %v", tc.name, bs)
+		}
+		for max, count := range tc.expected {
+			if bs[max] != count {
+				t.Errorf("%s: bucket le=%g expected %d, got %d", tc.name, max, count, bs[max])
+			}
+		}
+		if bs[math.Inf(+1)] != datum.GetBucketsCount(tc.d) {
+			t.Errorf("%s: +Inf bucket %d doesn't match count %d", tc.name, bs[math.Inf(+1)], datum.GetBucketsCount(tc.d))
+		}
+	}
+}
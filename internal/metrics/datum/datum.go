@@ -41,6 +41,17 @@ func (d *BaseDatum) stamp(timestamp time.Time) {
 	}
 }
 
+// unstamp clears the timestamp, as if the Datum had never been set.
+func (d *BaseDatum) unstamp() {
+	atomic.StoreInt64(&d.Time, 0)
+}
+
+// isSet returns true if the Datum has been set since it was created or
+// reset.
+func (d *BaseDatum) isSet() bool {
+	return atomic.LoadInt64(&d.Time) != 0
+}
+
 // TimeString returns the timestamp of this Datum as a string.
 func (d *BaseDatum) TimeString() string {
 	return fmt.Sprintf("%d", atomic.LoadInt64(&d.Time)/1e9)
@@ -51,14 +62,16 @@ func (d *BaseDatum) TimeUTC() time.Time {
 	return time.Unix(tNsec/1e9, tNsec%1e9)
 }
 
-// NewInt creates a new zero integer datum.
+// NewInt creates a new zero integer datum, at the zero time as it has not
+// been set.
 func NewInt() Datum {
-	return MakeInt(0, zeroTime)
+	return &Int{}
 }
 
-// NewFloat creates a new zero floating-point datum.
+// NewFloat creates a new zero floating-point datum, at the zero time as it has
+// not been set.
 func NewFloat() Datum {
-	return MakeFloat(0., zeroTime)
+	return &Float{}
 }
 
 // NewString creates a new zero string datum.
@@ -117,6 +130,10 @@ func GetInt(d Datum) int64 {
 	switch d := d.(type) {
 	case *Int:
 		return d.Get()
+	case *Window:
+		return d.Get()
+	case *HLL:
+		return d.Get()
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -176,16 +193,38 @@ func SetString(d Datum, v string, ts time.Time) {
 	}
 }
 
+// AddHLL adds a value to an HLL Datum at time ts, or panics if the Datum is not an HLL.
+func AddHLL(d Datum, v string, ts time.Time) {
+	switch d := d.(type) {
+	case *HLL:
+		d.Add(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not an HLL", d))
+	}
+}
+
 // IncIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.
 func IncIntBy(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
 	case *Int:
 		d.IncBy(v, ts)
+	case *Window:
+		d.IncBy(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
 }
 
+// IncFloatBy increments a floating-point Datum by the provided value, at time ts, or panics if the Datum is not a Float.
+func IncFloatBy(d Datum, v float64, ts time.Time) {
+	switch d := d.(type) {
+	case *Float:
+		d.IncBy(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not a Float", d))
+	}
+}
+
 // DecIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.
 func DecIntBy(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
@@ -196,6 +235,50 @@ func DecIntBy(d Datum, v int64, ts time.Time) {
 	}
 }
 
+// MaxInt sets an integer Datum to the provided value and timestamp if the
+// value is greater than the Datum's, or panics if the Datum is not an Int.
+func MaxInt(d Datum, v int64, ts time.Time) {
+	switch d := d.(type) {
+	case *Int:
+		d.SetMax(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int", d))
+	}
+}
+
+// MinInt sets an integer Datum to the provided value and timestamp if the
+// value is less than the Datum's, or panics if the Datum is not an Int.
+func MinInt(d Datum, v int64, ts time.Time) {
+	switch d := d.(type) {
+	case *Int:
+		d.SetMin(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int", d))
+	}
+}
+
+// MaxFloat sets a floating-point Datum to the provided value and timestamp if
+// the value is greater than the Datum's, or panics if the Datum is not a Float.
+func MaxFloat(d Datum, v float64, ts time.Time) {
+	switch d := d.(type) {
+	case *Float:
+		d.SetMax(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not a Float", d))
+	}
+}
+
+// MinFloat sets a floating-point Datum to the provided value and timestamp if
+// the value is less than the Datum's, or panics if the Datum is not a Float.
+func MinFloat(d Datum, v float64, ts time.Time) {
+	switch d := d.(type) {
+	case *Float:
+		d.SetMin(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not a Float", d))
+	}
+}
+
 func GetBuckets(d Datum) *Buckets {
 	switch d := d.(type) {
 	case *Buckets:
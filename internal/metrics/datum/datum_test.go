@@ -60,3 +60,23 @@ func TestMarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxMinFloat(t *testing.T) {
+	ts := time.Now().UTC()
+	max, min := NewFloat(), NewFloat()
+	for _, v := range []float64{2.5, -1.25, 8.75, 0.5} {
+		MaxFloat(max, v, ts)
+		MinFloat(min, v, ts)
+	}
+	if r := GetFloat(max); r != 8.75 {
+		t.Errorf("max: expected 8.75, got %g", r)
+	}
+	if r := GetFloat(min); r != -1.25 {
+		t.Errorf("min: expected -1.25, got %g", r)
+	}
+	min.(*Float).Reset(0)
+	MinFloat(min, 3, ts)
+	if r := GetFloat(min); r != 3 {
+		t.Errorf("min after reset: expected 3, got %g", r)
+	}
+}
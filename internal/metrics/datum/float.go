@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -14,7 +15,8 @@ import (
 // Float describes a floating point value at a given timestamp.
 type Float struct {
 	BaseDatum
-	Valuebits uint64
+	sync.Mutex // serialises the updates that depend on whether the Float is set
+	Valuebits  uint64
 }
 
 // ValueString returns the value of the Float as a string.
@@ -28,6 +30,69 @@ func (d *Float) Set(v float64, ts time.Time) {
 	d.stamp(ts)
 }
 
+// IncBy increments the Float's value by delta, at timestamp ts.  Concurrent
+// increments are all counted.
+func (d *Float) IncBy(delta float64, ts time.Time) {
+	for {
+		old := atomic.LoadUint64(&d.Valuebits)
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&d.Valuebits, old, new) {
+			break
+		}
+	}
+	d.stamp(ts)
+}
+
+// SetMax sets the Float to v at timestamp ts if v is greater than the
+// Float's, or if the Float has not been set since it was created or reset.
+func (d *Float) SetMax(v float64, ts time.Time) {
+	d.setIf(v, ts, func(old float64) bool { return v > old })
+}
+
+// SetMin sets the Float to v at timestamp ts if v is less than the Float's,
+// or if the Float has not been set since it was created or reset.
+func (d *Float) SetMin(v float64, ts time.Time) {
+	d.setIf(v, ts, func(old float64) bool { return v < old })
+}
+
+// setIf sets the Float to v at timestamp ts if replace returns true for its
+// old value, or if it's not been set.  Concurrent updates are each compared
+// with the value left by the others, and whether the Float is set can't change
+// between the comparison and the update.
+func (d *Float) setIf(v float64, ts time.Time, replace func(old float64) bool) {
+	d.Lock()
+	defer d.Unlock()
+	for {
+		old := atomic.LoadUint64(&d.Valuebits)
+		if d.isSet() && !replace(math.Float64frombits(old)) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&d.Valuebits, old, math.Float64bits(v)) {
+			break
+		}
+	}
+	d.stamp(ts)
+}
+
+// Reset sets the Float to v as if it had just been created, so that the next
+// SetMax or SetMin sets it regardless of value.
+func (d *Float) Reset(v float64) {
+	d.Lock()
+	defer d.Unlock()
+	atomic.StoreUint64(&d.Valuebits, math.Float64bits(v))
+	d.unstamp()
+}
+
+// Take returns the value of the Float and resets it to v, as Reset does, in
+// one step, so that no update is lost in between.
+func (d *Float) Take(v float64) float64 {
+	d.Lock()
+	defer d.Unlock()
+	old := atomic.SwapUint64(&d.Valuebits, math.Float64bits(v))
+	d.unstamp()
+	return math.Float64frombits(old)
+}
+
 // Get returns the floating-point value.
 func (d *Float) Get() float64 {
 	return math.Float64frombits(atomic.LoadUint64(&d.Valuebits))
@@ -0,0 +1,50 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestHLL(t *testing.T) {
+	d := NewHLL(HighHLLPrecision).(*HLL)
+	ts := time.Unix(37, 0)
+	for _, v := range []string{"a", "b", "c", "a", "b"} {
+		AddHLL(d, v, ts)
+	}
+	if r := GetInt(d); r != 3 {
+		t.Errorf("expected an estimate of 3, got %d", r)
+	}
+	if d.TimeUTC() != ts {
+		t.Errorf("expected time %v, got %v", ts, d.TimeUTC())
+	}
+
+	b, err := json.Marshal(d)
+	testutil.FatalIfErr(t, err)
+	var j struct {
+		Value  int64
+		Sketch []byte
+		Time   int64
+	}
+	testutil.FatalIfErr(t, json.Unmarshal(b, &j))
+	s := hyperloglog.New16()
+	testutil.FatalIfErr(t, s.UnmarshalBinary(j.Sketch))
+	if j.Value != 3 || s.Estimate() != 3 || j.Time != ts.UnixNano() {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
+
+func TestNewHLLPrecision(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an unsupported precision")
+		}
+	}()
+	NewHLL(10)
+}
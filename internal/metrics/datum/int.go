@@ -6,6 +6,7 @@ package datum
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -13,7 +14,8 @@ import (
 // Int describes an integer value at a given timestamp.
 type Int struct {
 	BaseDatum
-	Value int64
+	sync.Mutex // serialises the updates that depend on whether the Int is set
+	Value      int64
 }
 
 // Set sets the value of the Int to the value at timestamp.
@@ -34,6 +36,56 @@ func (d *Int) DecBy(delta int64, timestamp time.Time) {
 	d.stamp(timestamp)
 }
 
+// SetMax sets the Int to value at timestamp if value is greater than the
+// Int's, or if the Int has not been set since it was created or reset.
+func (d *Int) SetMax(value int64, timestamp time.Time) {
+	d.setIf(value, timestamp, func(old int64) bool { return value > old })
+}
+
+// SetMin sets the Int to value at timestamp if value is less than the Int's,
+// or if the Int has not been set since it was created or reset.
+func (d *Int) SetMin(value int64, timestamp time.Time) {
+	d.setIf(value, timestamp, func(old int64) bool { return value < old })
+}
+
+// setIf sets the Int to value at timestamp if replace returns true for its
+// old value, or if it's not been set.  Concurrent updates are each compared
+// with the value left by the others, and whether the Int is set can't change
+// between the comparison and the update.
+func (d *Int) setIf(value int64, timestamp time.Time, replace func(old int64) bool) {
+	d.Lock()
+	defer d.Unlock()
+	for {
+		old := atomic.LoadInt64(&d.Value)
+		if d.isSet() && !replace(old) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&d.Value, old, value) {
+			break
+		}
+	}
+	d.stamp(timestamp)
+}
+
+// Reset sets the Int to value as if it had just been created, so that the
+// next SetMax or SetMin sets it regardless of value.
+func (d *Int) Reset(value int64) {
+	d.Lock()
+	defer d.Unlock()
+	atomic.StoreInt64(&d.Value, value)
+	d.unstamp()
+}
+
+// Take returns the value of the Int and resets it to value, as Reset does, in
+// one step, so that no update is lost in between.
+func (d *Int) Take(value int64) int64 {
+	d.Lock()
+	defer d.Unlock()
+	old := atomic.SwapInt64(&d.Value, value)
+	d.unstamp()
+	return old
+}
+
 // Get returns the value of the Int
 func (d *Int) Get() int64 {
 	return atomic.LoadInt64(&d.Value)
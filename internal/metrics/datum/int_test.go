@@ -4,6 +4,7 @@
 package datum
 
 import (
+	"sync"
 	"testing"
 	"time"
 )
@@ -38,3 +39,64 @@ func TestDecrementScalarInt(t *testing.T) {
 		t.Errorf("expected 0, got %d", r)
 	}
 }
+
+func TestSetMaxMinInt(t *testing.T) {
+	ts := time.Now().UTC()
+	max, min := &Int{}, &Int{}
+	for _, v := range []int64{-5, 3, 7, -2, 4} {
+		max.SetMax(v, ts)
+		min.SetMin(v, ts)
+	}
+	if r := max.Get(); r != 7 {
+		t.Errorf("max: expected 7, got %d", r)
+	}
+	if r := min.Get(); r != -5 {
+		t.Errorf("min: expected -5, got %d", r)
+	}
+	// After a reset the next value is taken whatever it is.
+	max.Reset(0)
+	if r := max.Get(); r != 0 {
+		t.Errorf("reset: expected 0, got %d", r)
+	}
+	max.SetMax(-3, ts)
+	if r := max.Get(); r != -3 {
+		t.Errorf("max after reset: expected -3, got %d", r)
+	}
+	max.SetMax(-4, ts)
+	if r := max.Get(); r != -3 {
+		t.Errorf("max after reset: expected -3, got %d", r)
+	}
+}
+
+func TestTakeIntConcurrent(t *testing.T) {
+	d := &Int{}
+	ts := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				d.IncBy(1, ts)
+			}
+		}()
+	}
+	// No increment is lost between taking the value and resetting it.
+	var taken int64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if taken += d.Take(0); taken != 4000 {
+				t.Errorf("expected 4000 taken, got %d", taken)
+			}
+			return
+		default:
+			taken += d.Take(0)
+		}
+	}
+}
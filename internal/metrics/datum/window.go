@@ -0,0 +1,170 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// windowBuckets is the number of buckets in the ring buffer of a Window.
+const windowBuckets = 60
+
+// maxClockLead is how far ahead of the wall clock a Clock may be advanced by
+// a log time, so that a line with a bogus future timestamp can't hold every
+// increment after it out of the window.
+const maxClockLead = 5 * time.Minute
+
+// Clock is the time that Windows are read at.  It follows the timestamps of
+// the log lines, so that increments leave a window as the time of the logs
+// passes even when they're read late or replayed, and runs on from the latest
+// timestamp at the speed of the wall clock, so that increments still leave the
+// window when no more lines arrive.
+type Clock struct {
+	mu       sync.Mutex
+	logTime  time.Time        // The latest log time observed.
+	observed time.Time        // When logTime was observed, by the wall clock.
+	now      func() time.Time // Source of the wall clock time.
+}
+
+// NewClock creates a Clock that reads the wall clock time until a log time is
+// observed.
+func NewClock() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// Observe advances the clock to the log time t, if it's later than the latest
+// log time observed.  Log times more than maxClockLead ahead of the wall clock
+// advance it only that far.
+func (c *Clock) Observe(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if limit := now.Add(maxClockLead); t.After(limit) {
+		t = limit
+	}
+	if t.After(c.logTime) {
+		c.logTime = t
+		c.observed = now
+	}
+}
+
+// Now returns the latest log time observed, plus the wall clock time that has
+// passed since it was observed.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.logTime.IsZero() {
+		return now
+	}
+	return c.logTime.Add(now.Sub(c.observed))
+}
+
+// Window describes an integer count of increments observed within a trailing
+// time window.  Increments are recorded in a ring buffer of time buckets, each
+// one sixtieth of the window wide, and buckets that fall out of the window are
+// discarded when read.
+type Window struct {
+	BaseDatum
+	sync.RWMutex
+	Width  time.Duration // Width of each bucket.
+	Counts []int64       // Count of increments in each bucket.
+	Epochs []int64       // Index since the unix epoch of the bucket width that each bucket holds.
+
+	clock *Clock // If not nil, the clock the window ends at; else the wall clock.
+}
+
+// NewWindow creates a new zero window datum covering the given window
+// duration, ending at the time of clock, or of the wall clock if clock is
+// nil.
+func NewWindow(window time.Duration, clock *Clock) Datum {
+	width := window / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &Window{
+		Width:  width,
+		Counts: make([]int64, windowBuckets),
+		Epochs: make([]int64, windowBuckets),
+		clock:  clock,
+	}
+}
+
+// IncBy adds delta to the bucket containing timestamp, or the current time if
+// timestamp is zero.  An increment older than the window, relative to the
+// latest bucket incremented, is dropped.
+func (d *Window) IncBy(delta int64, timestamp time.Time) {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if d.clock != nil {
+		d.clock.Observe(timestamp)
+	}
+	e := d.epoch(timestamp)
+	d.Lock()
+	defer d.Unlock()
+	var latest int64
+	for _, l := range d.Epochs {
+		if l > latest {
+			latest = l
+		}
+	}
+	if latest-e >= windowBuckets {
+		return
+	}
+	d.stamp(timestamp)
+	i := e % windowBuckets
+	if d.Epochs[i] != e {
+		d.Epochs[i] = e
+		d.Counts[i] = 0
+	}
+	d.Counts[i] += delta
+}
+
+func (d *Window) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(d.Width)
+}
+
+// GetAt returns the sum of the increments within the window ending at now.
+func (d *Window) GetAt(now time.Time) int64 {
+	e := d.epoch(now)
+	d.RLock()
+	defer d.RUnlock()
+	var sum int64
+	for i, c := range d.Counts {
+		if age := e - d.Epochs[i]; age >= 0 && age < windowBuckets {
+			sum += c
+		}
+	}
+	return sum
+}
+
+// Get returns the sum of the increments within the window ending now, by the
+// window's clock.
+func (d *Window) Get() int64 {
+	if d.clock != nil {
+		return d.GetAt(d.clock.Now())
+	}
+	return d.GetAt(time.Now())
+}
+
+// ValueString returns the value of the Window as a string.
+func (d *Window) ValueString() string {
+	return fmt.Sprintf("%d", d.Get())
+}
+
+// MarshalJSON returns a JSON encoding of the Window.
+func (d *Window) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Value int64
+		Time  int64
+	}{d.Get(), d.TimeUTC().UnixNano()}
+	return json.Marshal(j)
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowSlides(t *testing.T) {
+	d := NewWindow(time.Minute, nil).(*Window)
+	start := time.Unix(1000*60, 0)
+	d.IncBy(1, start)
+	d.IncBy(2, start.Add(30*time.Second))
+	if r := d.GetAt(start.Add(30 * time.Second)); r != 3 {
+		t.Errorf("expected 3 within window, got %d", r)
+	}
+	// The first increment has left the window.
+	if r := d.GetAt(start.Add(70 * time.Second)); r != 2 {
+		t.Errorf("expected 2 after first increment expired, got %d", r)
+	}
+	// Reusing a ring buffer slot discards the stale count.
+	d.IncBy(5, start.Add(2*time.Minute))
+	if r := d.GetAt(start.Add(2 * time.Minute)); r != 5 {
+		t.Errorf("expected 5 after slot reuse, got %d", r)
+	}
+	if r := d.GetAt(start.Add(4 * time.Minute)); r != 0 {
+		t.Errorf("expected 0 after window passed, got %d", r)
+	}
+}
+
+func TestWindowDropsStaleIncrements(t *testing.T) {
+	d := NewWindow(time.Minute, nil).(*Window)
+	start := time.Unix(1000*60, 0)
+	d.IncBy(1, start)
+	d.IncBy(2, start.Add(30*time.Second))
+	// An out of order increment within the window is counted.
+	d.IncBy(4, start.Add(10*time.Second))
+	if r := d.GetAt(start.Add(30 * time.Second)); r != 7 {
+		t.Errorf("expected 7 within window, got %d", r)
+	}
+	// An increment older than the window shares a ring buffer slot with the
+	// first one, but doesn't reset it.
+	d.IncBy(8, start.Add(-time.Minute))
+	if r := d.GetAt(start.Add(30 * time.Second)); r != 7 {
+		t.Errorf("expected 7 after a stale increment, got %d", r)
+	}
+	if ts := d.TimeUTC(); !ts.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("expected the timestamp of the last counted increment, got %v", ts)
+	}
+}
+
+func TestWindowClock(t *testing.T) {
+	wall := time.Unix(1600000000, 0)
+	c := NewClock()
+	c.now = func() time.Time { return wall }
+	d := NewWindow(time.Minute, c).(*Window)
+
+	// Until a log time is observed, the window ends at the wall clock time.
+	if now := c.Now(); !now.Equal(wall) {
+		t.Errorf("expected the wall clock time %v, got %v", wall, now)
+	}
+
+	// The log being read is a day old.
+	logTime := wall.Add(-24 * time.Hour)
+	d.IncBy(1, logTime)
+	d.IncBy(2, logTime.Add(30*time.Second))
+	if r := d.Get(); r != 3 {
+		t.Errorf("expected 3 within window, got %d", r)
+	}
+
+	// Lines parsed later in the log advance the clock, so the first increment
+	// leaves the window.
+	c.Observe(logTime.Add(70 * time.Second))
+	if r := d.Get(); r != 2 {
+		t.Errorf("expected 2 after the clock advanced, got %d", r)
+	}
+	// An earlier log time doesn't move the clock back.
+	c.Observe(logTime)
+	if r := d.Get(); r != 2 {
+		t.Errorf("expected 2 after an earlier log time, got %d", r)
+	}
+
+	// New increments enter the window.
+	d.IncBy(4, logTime.Add(80*time.Second))
+	if r := d.Get(); r != 6 {
+		t.Errorf("expected 6 after a new increment, got %d", r)
+	}
+
+	// Without more lines, the clock runs on with the wall clock, and the
+	// increments leave the window.
+	wall = wall.Add(40 * time.Second)
+	if r := d.Get(); r != 4 {
+		t.Errorf("expected 4 after 40s of wall clock time, got %d", r)
+	}
+	wall = wall.Add(time.Minute)
+	if r := d.Get(); r != 0 {
+		t.Errorf("expected 0 after the window passed, got %d", r)
+	}
+}
+
+func TestWindowClockFutureTime(t *testing.T) {
+	wall := time.Unix(1600000000, 0)
+	c := NewClock()
+	c.now = func() time.Time { return wall }
+	d := NewWindow(time.Minute, c).(*Window)
+
+	d.IncBy(1, wall)
+	// A line a year in the future only advances the clock maxClockLead ahead
+	// of the wall clock.
+	c.Observe(wall.AddDate(1, 0, 0))
+	if now, want := c.Now(), wall.Add(maxClockLead); !now.Equal(want) {
+		t.Errorf("expected the clock at %v, got %v", want, now)
+	}
+	// Increments at the clamped time are counted, rather than waiting a year
+	// for the window to reach them.
+	d.IncBy(2, wall.Add(maxClockLead))
+	if r := d.Get(); r != 2 {
+		t.Errorf("expected 2 within window, got %d", r)
+	}
+}
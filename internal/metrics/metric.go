@@ -39,6 +39,19 @@ const (
 	// Histogram is a Kind that observes a value and stores the value
 	// in a bucket.
 	Histogram
+
+	// Window is a Kind that counts the increments observed in a trailing
+	// time window, and is exported as a gauge.
+	Window
+
+	// Info is a Kind that describes its program or environment with a fixed
+	// set of labels.  It has a single datum, always 1, which is labelled with
+	// the values given in its declaration.
+	Info
+
+	// HLL is a Kind that estimates the number of distinct values added to it
+	// with a HyperLogLog sketch, and is exported as a gauge.
+	HLL
 )
 
 func (m Kind) String() string {
@@ -53,10 +66,29 @@ func (m Kind) String() string {
 		return "Text"
 	case Histogram:
 		return "Histogram"
+	case Window:
+		return "Window"
+	case Info:
+		return "Info"
+	case HLL:
+		return "HLL"
 	}
 	return "Unknown"
 }
 
+// TimeSource enumerates the sources of the timestamp a metric's data are
+// exported with, when exporters send timestamps.
+type TimeSource int
+
+const (
+	// LogTime is the time each datum was last updated, which is the
+	// timestamp of the log line if the program parsed one.
+	LogTime TimeSource = iota
+
+	// ScrapeTime is the time the metric is collected by an exporter.
+	ScrapeTime
+)
+
 // LabelValue is an object that names a Datum value with a list of label
 // strings.
 type LabelValue struct {
@@ -81,6 +113,28 @@ type Metric struct {
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:"-"`
 	Buckets     []datum.Range `json:",omitempty"`
+	Window      time.Duration `json:",omitempty"`
+	Precision   uint8         `json:",omitempty"` // Precision of the sketches of an HLL, or the default if zero
+	Aliases     []string      `json:",omitempty"` // Additional names to export the metric under
+	SharedBy    []string      `json:",omitempty"` // Other programs recording to this metric, guarded by the Store lock
+	TimeSource  TimeSource    `json:",omitempty"` // Source of the exported timestamp
+	// PrometheusType, if not empty, is the type the metric is exported to
+	// Prometheus as, instead of the type of its Kind.
+	PrometheusType string `json:",omitempty"`
+	// InitialValue, if not nil, is the int64 or float64 value given to each
+	// datum when it is created.
+	InitialValue interface{} `json:"-"`
+	// Learner, if not nil, learns the buckets of a histogram from its first
+	// observations, instead of them being given in Buckets.
+	Learner *datum.BucketLearner `json:"-"`
+	// ResetOnExport, if set, returns each datum to its initial value after
+	// the metric is exported, so that a running maximum or minimum covers
+	// the interval between exports.
+	ResetOnExport bool `json:",omitempty"`
+	// Clock, if not nil, is the clock that the windows of a Window metric end
+	// at, instead of the wall clock.  Programs advance it with the timestamps
+	// they parse from log lines.
+	Clock *datum.Clock `json:"-"`
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -91,6 +145,9 @@ func NewMetric(name string, prog string, kind Kind, typ Type, keys ...string) *M
 	m.Kind = kind
 	m.Type = typ
 	copy(m.Keys, keys)
+	if kind == Window {
+		m.Clock = datum.NewClock()
+	}
 	return m
 }
 
@@ -124,25 +181,90 @@ func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
 	if lv := m.FindLabelValueOrNil(labelvalues); lv != nil {
 		d = lv.Value
 	} else {
-		switch m.Type {
-		case Int:
-			d = datum.NewInt()
-		case Float:
-			d = datum.NewFloat()
-		case String:
-			d = datum.NewString()
-		case Buckets:
-			buckets := m.Buckets
-			if buckets == nil {
-				buckets = make([]datum.Range, 0)
-			}
-			d = datum.NewBuckets(buckets)
-		}
+		d = m.NewDatum()
 		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d})
 	}
 	return d, nil
 }
 
+// NewDatum returns a new datum of the Kind and Type of the Metric m, with its
+// initial value, without adding it to m.
+func (m *Metric) NewDatum() (d datum.Datum) {
+	switch {
+	case m.Kind == Window:
+		d = datum.NewWindow(m.Window, m.Clock)
+	case m.Kind == HLL:
+		d = datum.NewHLL(m.Precision)
+	case m.Type == Int:
+		d = datum.NewInt()
+	case m.Type == Float:
+		d = datum.NewFloat()
+	case m.Type == String:
+		d = datum.NewString()
+	case m.Type == Buckets && m.Learner != nil:
+		d = m.Learner.NewBuckets()
+	case m.Type == Buckets:
+		buckets := m.Buckets
+		if buckets == nil {
+			buckets = make([]datum.Range, 0)
+		}
+		d = datum.NewBuckets(buckets)
+	}
+	switch v := m.InitialValue.(type) {
+	case int64:
+		datum.SetInt(d, v, time.Unix(0, 0))
+	case float64:
+		datum.SetFloat(d, v, time.Unix(0, 0))
+	}
+	return d
+}
+
+// HasDatum returns true if the Metric m has a datum named by labelvalues.
+func (m *Metric) HasDatum(labelvalues ...string) bool {
+	if len(labelvalues) != len(m.Keys) {
+		return false
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return m.FindLabelValueOrNil(labelvalues) != nil
+}
+
+// Cardinality returns the number of label sets the Metric m has a datum for.
+func (m *Metric) Cardinality() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.LabelValues)
+}
+
+// Take returns a copy of each Int and Float datum of the Metric m, keyed by
+// the datum, and returns the datum to its initial value as if it had just been
+// created.  Each value is swapped out as it's read, so no update is lost
+// between the copy and the reset.
+func (m *Metric) Take() map[datum.Datum]datum.Datum {
+	var i int64
+	var f float64
+	switch v := m.InitialValue.(type) {
+	case int64:
+		i, f = v, float64(v)
+	case float64:
+		i, f = int64(v), v
+	}
+	m.RLock()
+	defer m.RUnlock()
+	taken := make(map[datum.Datum]datum.Datum, len(m.LabelValues))
+	for _, lv := range m.LabelValues {
+		switch d := lv.Value.(type) {
+		case *datum.Int:
+			ts := d.TimeUTC()
+			taken[d] = datum.MakeInt(d.Take(i), ts)
+		case *datum.Float:
+			ts := d.TimeUTC()
+			taken[d] = datum.MakeFloat(d.Take(f), ts)
+		}
+	}
+	return taken
+}
+
 // RemoveDatum removes the Datum described by labelvalues from the Metric m.
 func (m *Metric) RemoveDatum(labelvalues ...string) error {
 	if len(labelvalues) != len(m.Keys) {
@@ -194,7 +194,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 			return false
 		}
 
-		if diff := testutil.Diff(m, r, testutil.IgnoreUnexported(sync.RWMutex{})); diff != "" {
+		if diff := testutil.Diff(m, r, testutil.IgnoreUnexported(sync.RWMutex{}, sync.Mutex{})); diff != "" {
 			t.Errorf("Round trip wasn't stable:\n%s", diff)
 			return false
 		}
@@ -208,7 +208,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 func TestTimer(t *testing.T) {
 	m := NewMetric("test", "prog", Timer, Int)
 	n := NewMetric("test", "prog", Timer, Int)
-	diff := testutil.Diff(m, n, testutil.IgnoreUnexported(sync.RWMutex{}))
+	diff := testutil.Diff(m, n, testutil.IgnoreUnexported(sync.RWMutex{}, sync.Mutex{}))
 	if diff != "" {
 		t.Errorf("Identical metrics not the same:\n%s", diff)
 	}
@@ -246,3 +246,30 @@ func TestRemoveMetricLabelValue(t *testing.T) {
 		t.Errorf("label value still exists")
 	}
 }
+
+func TestMetricTake(t *testing.T) {
+	m := NewMetric("peak", "prog", Gauge, Int, "a")
+	m.InitialValue = int64(1)
+	ts := time.Now().UTC()
+	for _, l := range []string{"x", "y"} {
+		d, err := m.GetDatum(l)
+		testutil.FatalIfErr(t, err)
+		datum.MaxInt(d, 10, ts)
+	}
+	taken := m.Take()
+	for _, l := range []string{"x", "y"} {
+		d, err := m.GetDatum(l)
+		testutil.FatalIfErr(t, err)
+		if r := datum.GetInt(taken[d]); r != 10 {
+			t.Errorf("%s: expected 10 taken, got %d", l, r)
+		}
+		if r := datum.GetInt(d); r != 1 {
+			t.Errorf("%s: expected 1 after reset, got %d", l, r)
+		}
+		// The next maximum is taken even though it's lower.
+		datum.MaxInt(d, 0, ts)
+		if r := datum.GetInt(d); r != 0 {
+			t.Errorf("%s: expected 0, got %d", l, r)
+		}
+	}
+}
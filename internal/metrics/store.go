@@ -5,18 +5,41 @@ package metrics
 
 import (
 	"encoding/json"
+	"expvar"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
 )
 
+// seriesEvictions counts the label sets removed from metrics to keep the
+// Store within its maximum number of series.
+var seriesEvictions = expvar.NewInt("metric_series_evictions_total")
+
 // Store contains Metrics.
 type Store struct {
 	sync.RWMutex
 	Metrics map[string][]*Metric
+
+	maxSeries int64 // if positive, the maximum number of series kept, accessed atomically
+	series    int64 // the number of series at the last eviction plus those added since, accessed atomically
+
+	trackStale bool          // if set, series removed from metrics are recorded in stale
+	stale      []StaleSeries // series removed since the last TakeStaleSeries
+
+	unloaded map[*Metric]struct{} // shared metrics whose Program has been removed
+}
+
+// StaleSeries is a series removed from a metric in the Store, by expiry,
+// eviction, or the removal of its program, which exporters may mark as stale.
+type StaleSeries struct {
+	Metric *Metric           // the metric the series was removed from
+	Labels map[string]string // the labels of the series
 }
 
 // NewStore returns a new metric Store.
@@ -60,6 +83,11 @@ func (s *Store) Add(m *Metric) error {
 			if len(v.Keys) != len(m.Keys) || !reflect.DeepEqual(v.Keys, m.Keys) {
 				break
 			}
+			// Info metrics are fixed by their declaration, so the old
+			// label values are replaced rather than kept alongside.
+			if m.Kind == Info {
+				break
+			}
 			glog.V(2).Infof("v buckets: %v m.buckets: %v", v.Buckets, m.Buckets)
 
 			// Otherwise, copy everything into the new metric
@@ -83,11 +111,256 @@ func (s *Store) Add(m *Metric) error {
 	return nil
 }
 
+// FindShared returns the metric in the Store that m, declared by a program
+// being loaded, should be shared with instead of being added: a metric of the
+// same name declared by another program, or the program's own metric if
+// other programs already share it.  It returns nil if there is no such
+// metric, and an error if there is one but its declaration differs from m's.
+func (s *Store) FindShared(m *Metric) (*Metric, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, e := range s.Metrics[m.Name] {
+		if e.Program == m.Program && len(e.SharedBy) == 0 {
+			continue
+		}
+		if err := sameDeclaration(e, m); err != nil {
+			return nil, errors.Wrapf(err, "metric %s in program %s conflicts with its declaration in program %s", m.Name, m.Program, e.Program)
+		}
+		return e, nil
+	}
+	return nil, nil
+}
+
+// CheckAliases returns an error if metric m would be exported under the same
+// name as a metric of another program in the Store, where either name is an
+// alias, as the two would be exported as one metric.
+func (s *Store) CheckAliases(m *Metric) error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, a := range m.Aliases {
+		for _, e := range s.Metrics[a] {
+			if e.Program != m.Program {
+				return errors.Errorf("alias %s of metric %s in program %s is the name of a metric in program %s", a, m.Name, m.Program, e.Program)
+			}
+		}
+	}
+	for _, ml := range s.Metrics {
+		for _, e := range ml {
+			// A metric of the same name is shared, or conflicts, as found by FindShared.
+			if e.Program == m.Program || e.Name == m.Name {
+				continue
+			}
+			for _, a := range e.Aliases {
+				if a == m.Name {
+					return errors.Errorf("metric %s in program %s has the name of an alias of metric %s in program %s", m.Name, m.Program, e.Name, e.Program)
+				}
+				for _, b := range m.Aliases {
+					if a == b {
+						return errors.Errorf("alias %s of metric %s in program %s is also an alias of metric %s in program %s", a, m.Name, m.Program, e.Name, e.Program)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sameDeclaration returns an error describing the difference between the
+// declarations of metrics e and m, if any.
+func sameDeclaration(e, m *Metric) error {
+	switch {
+	case e.Kind != m.Kind:
+		return errors.Errorf("kind %v differs from %v", m.Kind, e.Kind)
+	case e.Type != m.Type:
+		return errors.Errorf("type %v differs from %v", m.Type, e.Type)
+	case !reflect.DeepEqual(e.Keys, m.Keys):
+		return errors.Errorf("keys %q differ from %q", m.Keys, e.Keys)
+	case !reflect.DeepEqual(e.Buckets, m.Buckets):
+		return errors.Errorf("buckets %v differ from %v", m.Buckets, e.Buckets)
+	case e.Window != m.Window:
+		return errors.Errorf("window %s differs from %s", m.Window, e.Window)
+	case e.Precision != m.Precision:
+		return errors.Errorf("precision %d differs from %d", m.Precision, e.Precision)
+	case e.TimeSource != m.TimeSource:
+		return errors.New("timestamp source differs")
+	case e.PrometheusType != m.PrometheusType:
+		return errors.Errorf("prometheus type %q differs from %q", m.PrometheusType, e.PrometheusType)
+	case !reflect.DeepEqual(e.Aliases, m.Aliases):
+		return errors.Errorf("aliases %q differ from %q", m.Aliases, e.Aliases)
+	}
+	return nil
+}
+
+// Share records that the program prog records to the metric m in the Store,
+// so that m is kept until all the programs using it are removed.
+func (s *Store) Share(m *Metric, prog string) {
+	s.Lock()
+	defer s.Unlock()
+	if m.Program == prog {
+		delete(s.unloaded, m)
+		return
+	}
+	for _, p := range m.SharedBy {
+		if p == prog {
+			return
+		}
+	}
+	m.SharedBy = append(m.SharedBy, prog)
+}
+
+// PublishInitialValues creates the datum of each metric in the Store that has
+// no keys, so that it is exported with its initial value before any log lines
+// are processed.  Metrics with keys are left alone, as their label values
+// aren't known until lines are processed.
+func (s *Store) PublishInitialValues() error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			if len(m.Keys) > 0 {
+				continue
+			}
+			if _, err := m.GetDatum(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveProgram removes all the metrics instantiated by the named program from
+// the Store.  A metric shared with other programs is kept, still labelled
+// with the program that declared it, until the last of them is removed.
+func (s *Store) RemoveProgram(prog string) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(prog, nil, true)
+}
+
+// ReleaseShared removes the program prog from the programs using each shared
+// metric in the Store other than those in keep, as when prog is reloaded and
+// no longer declares them.  A metric is removed once no program uses it.
+func (s *Store) ReleaseShared(prog string, keep []*Metric) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(prog, keep, false)
+}
+
+// release removes the program prog from the programs using each metric other
+// than those in keep.  The metrics declared by prog are removed too if
+// removing is set, or otherwise only if they're shared.  The Store lock is
+// held before entering this function.
+func (s *Store) release(prog string, keep []*Metric, removing bool) {
+	kept := make(map[*Metric]struct{}, len(keep))
+	for _, m := range keep {
+		kept[m] = struct{}{}
+	}
+	for name, ml := range s.Metrics {
+		remaining := ml[:0]
+		for _, m := range ml {
+			if _, ok := kept[m]; !ok {
+				for i, p := range m.SharedBy {
+					if p == prog {
+						m.SharedBy = append(m.SharedBy[:i:i], m.SharedBy[i+1:]...)
+						break
+					}
+				}
+				if m.Program == prog && (removing || len(m.SharedBy) > 0) {
+					s.unloaded[m] = struct{}{}
+				}
+			}
+			if _, ok := s.unloaded[m]; ok && len(m.SharedBy) == 0 {
+				delete(s.unloaded, m)
+				m.RLock()
+				for _, lv := range m.LabelValues {
+					s.markStale(m, lv.Labels)
+				}
+				m.RUnlock()
+				continue
+			}
+			remaining = append(remaining, m)
+		}
+		if len(remaining) == 0 {
+			delete(s.Metrics, name)
+		} else {
+			s.Metrics[name] = remaining
+		}
+	}
+}
+
+// SetMaxSeries limits the number of series, that is the label sets of all the
+// metrics, in the Store to max.  The least recently updated series of
+// dimensioned metrics over the limit are removed as new series are added, and
+// on each Gc.  Zero means no limit.
+func (s *Store) SetMaxSeries(max int) {
+	atomic.StoreInt64(&s.maxSeries, int64(max))
+}
+
+// AddedSeries records that the datum d was added to a dimensioned metric in
+// the Store as a new series, and if that takes the Store over the maximum
+// number of series, evicts the least recently updated series other than d.
+// The lock of the metric must not be held, as the Store lock is taken before
+// it.
+func (s *Store) AddedSeries(d datum.Datum) error {
+	max := atomic.LoadInt64(&s.maxSeries)
+	if max <= 0 || atomic.AddInt64(&s.series, 1) <= max {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.evictSeries(d)
+}
+
+// TrackStaleSeries sets whether the Store records the series removed from its
+// metrics, to be collected with TakeStaleSeries.
+func (s *Store) TrackStaleSeries(track bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.trackStale = track
+	if !track {
+		s.stale = nil
+	}
+}
+
+// TakeStaleSeries returns the series removed from the Store since it was last
+// called, and forgets them.
+func (s *Store) TakeStaleSeries() []StaleSeries {
+	s.Lock()
+	defer s.Unlock()
+	stale := s.stale
+	s.stale = nil
+	return stale
+}
+
+// maxStaleSeries is the most removed series the Store keeps for
+// TakeStaleSeries, so that they don't pile up if it is never called, as when
+// mtail isn't scraped.
+const maxStaleSeries = 10000
+
+// markStale records that the series of metric m with the label values labels
+// has been removed, if stale series are tracked.  If there are already
+// maxStaleSeries, the older half are forgotten.  The Store lock is held
+// before entering this function.
+func (s *Store) markStale(m *Metric, labels []string) {
+	if !s.trackStale {
+		return
+	}
+	if len(s.stale) >= maxStaleSeries {
+		n := copy(s.stale, s.stale[len(s.stale)/2:])
+		for i := n; i < len(s.stale); i++ {
+			s.stale[i] = StaleSeries{}
+		}
+		s.stale = s.stale[:n]
+	}
+	s.stale = append(s.stale, StaleSeries{m, zip(m.Keys, labels)})
+}
+
 // ClearMetrics empties the store of all metrics.
 func (s *Store) ClearMetrics() {
 	s.Lock()
 	defer s.Unlock()
 	s.Metrics = make(map[string][]*Metric)
+	s.unloaded = make(map[*Metric]struct{})
 }
 
 // MarshalJSON returns a JSON byte string representing the Store.
@@ -102,7 +375,8 @@ func (s *Store) MarshalJSON() (b []byte, err error) {
 }
 
 // Gc iterates through the Store looking for metrics that have been marked
-// for expiry, and removing them if their expiration time has passed.
+// for expiry, and removing them if their expiration time has passed.  It then
+// evicts series over the maximum, if set.
 func (s *Store) Gc() error {
 	glog.Info("Running Store.Expire()")
 	s.Lock()
@@ -110,19 +384,76 @@ func (s *Store) Gc() error {
 	now := time.Now()
 	for _, ml := range s.Metrics {
 		for _, m := range ml {
+			var expired []*LabelValue
+			m.RLock()
 			for _, lv := range m.LabelValues {
-				if lv.Expiry <= 0 {
-					continue
+				if lv.Expiry > 0 && now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
+					expired = append(expired, lv)
 				}
-				if now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
-					err := m.RemoveDatum(lv.Labels...)
-					if err != nil {
-						return err
+			}
+			m.RUnlock()
+			for _, lv := range expired {
+				s.markStale(m, lv.Labels)
+				if err := m.RemoveDatum(lv.Labels...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if atomic.LoadInt64(&s.maxSeries) > 0 {
+		return s.evictSeries(nil)
+	}
+	return nil
+}
+
+// evictSeries removes the least recently updated series, other than the one
+// with the datum keep, from the Store until it holds no more than the maximum
+// number of series.  Metrics without keys have a single series that can't
+// churn, so they count towards the maximum but are never evicted.  The Store
+// lock is held before entering this function.
+func (s *Store) evictSeries(keep datum.Datum) error {
+	type series struct {
+		m    *Metric
+		lv   *LabelValue
+		time time.Time
+	}
+	var candidates []series
+	total := 0
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			total += len(m.LabelValues)
+			if len(m.Keys) > 0 && m.Kind != Info {
+				for _, lv := range m.LabelValues {
+					if lv.Value != keep {
+						candidates = append(candidates, series{m, lv, lv.Value.TimeUTC()})
 					}
 				}
 			}
+			m.RUnlock()
+		}
+	}
+	max := atomic.LoadInt64(&s.maxSeries)
+	excess := total - int(max)
+	if excess <= 0 {
+		atomic.StoreInt64(&s.series, int64(total))
+		return nil
+	}
+	if excess > len(candidates) {
+		excess = len(candidates)
+	}
+	atomic.StoreInt64(&s.series, int64(total-excess))
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].time.Before(candidates[j].time)
+	})
+	for _, c := range candidates[:excess] {
+		s.markStale(c.m, c.lv.Labels)
+		if err := c.m.RemoveDatum(c.lv.Labels...); err != nil {
+			return err
 		}
 	}
+	seriesEvictions.Add(int64(excess))
+	glog.Warningf("Evicted %d metric series to keep within the maximum of %d", excess, max)
 	return nil
 }
 
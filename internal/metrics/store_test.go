@@ -4,6 +4,8 @@
 package metrics
 
 import (
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -132,3 +134,244 @@ func TestExpireMetric(t *testing.T) {
 		t.Logf("Store: %#v", s)
 	}
 }
+
+func TestPublishInitialValues(t *testing.T) {
+	s := NewStore()
+	scalar := NewMetric("foo", "prog", Gauge, Int)
+	testutil.FatalIfErr(t, s.Add(scalar))
+	dimensioned := NewMetric("bar", "prog", Gauge, Int, "a")
+	testutil.FatalIfErr(t, s.Add(dimensioned))
+
+	testutil.FatalIfErr(t, s.PublishInitialValues())
+	if len(scalar.LabelValues) != 1 {
+		t.Errorf("scalar metric not published: %v", scalar)
+	}
+	if len(dimensioned.LabelValues) != 0 {
+		t.Errorf("dimensioned metric published: %v", dimensioned)
+	}
+
+	// Publishing again doesn't create another datum.
+	testutil.FatalIfErr(t, s.PublishInitialValues())
+	if len(scalar.LabelValues) != 1 {
+		t.Errorf("scalar metric published twice: %v", scalar)
+	}
+}
+
+func TestMaxSeriesOnAdd(t *testing.T) {
+	s := NewStore()
+	s.SetMaxSeries(2)
+	m := NewMetric("foo", "prog", Counter, Int, "user")
+	testutil.FatalIfErr(t, s.Add(m))
+	start := time.Now()
+	for i, user := range []string{"a", "b", "c"} {
+		d, err := m.GetDatum(user)
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, s.AddedSeries(d))
+		datum.SetInt(d, 1, start.Add(time.Duration(i)*time.Second))
+	}
+	// The new series is kept, though it hasn't been updated yet.
+	d, err := m.GetDatum("d")
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, s.AddedSeries(d))
+	var users []string
+	for _, lv := range m.LabelValues {
+		users = append(users, lv.Labels[0])
+	}
+	sort.Strings(users)
+	if diff := testutil.Diff([]string{"c", "d"}, users); diff != "" {
+		t.Errorf("remaining series diff:\n%s", diff)
+	}
+}
+
+func TestFindShared(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "code")
+	testutil.FatalIfErr(t, s.Add(m))
+
+	// A program's own unshared metric is replaced as usual.
+	shared, err := s.FindShared(NewMetric("foo", "prog", Counter, Int, "code"))
+	testutil.FatalIfErr(t, err)
+	if shared != nil {
+		t.Errorf("expected no shared metric for the same program, got %v", shared)
+	}
+
+	shared, err = s.FindShared(NewMetric("foo", "prog1", Counter, Int, "code"))
+	testutil.FatalIfErr(t, err)
+	if shared != m {
+		t.Errorf("expected to share %v, got %v", m, shared)
+	}
+	s.Share(shared, "prog1")
+	s.Share(shared, "prog1")
+	if diff := testutil.Diff([]string{"prog1"}, m.SharedBy); diff != "" {
+		t.Errorf("SharedBy diff:\n%s", diff)
+	}
+
+	// Once shared, a program's own metric is shared on reload too.
+	shared, err = s.FindShared(NewMetric("foo", "prog", Counter, Int, "code"))
+	testutil.FatalIfErr(t, err)
+	if shared != m {
+		t.Errorf("expected to share %v on reload, got %v", m, shared)
+	}
+
+	for _, c := range []*Metric{
+		NewMetric("foo", "prog2", Gauge, Int, "code"),
+		NewMetric("foo", "prog2", Counter, Float, "code"),
+		NewMetric("foo", "prog2", Counter, Int, "status"),
+		NewMetric("foo", "prog2", Counter, Int),
+	} {
+		if _, err := s.FindShared(c); err == nil {
+			t.Errorf("expected conflict for %v", c)
+		}
+	}
+	scrape := NewMetric("foo", "prog2", Counter, Int, "code")
+	scrape.TimeSource = ScrapeTime
+	if _, err := s.FindShared(scrape); err == nil {
+		t.Errorf("expected conflict for %v", scrape)
+	}
+}
+
+func TestCheckAliases(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int)
+	m.Aliases = []string{"old_foo"}
+	testutil.FatalIfErr(t, s.Add(m))
+	testutil.FatalIfErr(t, s.Add(NewMetric("bar", "prog", Counter, Int)))
+
+	for _, tc := range []struct {
+		name    string
+		aliases []string
+		ok      bool
+	}{
+		{"baz", []string{"old_baz"}, true},
+		{"baz", []string{"bar"}, false},     // an alias is another program's metric name
+		{"old_foo", nil, false},             // the name is another program's alias
+		{"baz", []string{"old_foo"}, false}, // an alias is another program's alias
+		{"foo", []string{"old_foo"}, true},  // shared, as checked by FindShared
+	} {
+		c := NewMetric(tc.name, "prog1", Counter, Int)
+		c.Aliases = tc.aliases
+		if err := s.CheckAliases(c); (err == nil) != tc.ok {
+			t.Errorf("%s alias %q: expected ok %v, got error %v", tc.name, tc.aliases, tc.ok, err)
+		}
+	}
+
+	// A program's own metrics don't collide with those it's replacing.
+	c := NewMetric("old_foo", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.CheckAliases(c))
+}
+
+func TestRemoveProgramShared(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(m))
+	s.Share(m, "prog1")
+	s.Share(m, "prog2")
+
+	s.RemoveProgram("prog1")
+	if diff := testutil.Diff([]string{"prog2"}, m.SharedBy); diff != "" {
+		t.Errorf("SharedBy diff:\n%s", diff)
+	}
+	s.RemoveProgram("prog")
+	if len(s.Metrics["foo"]) != 1 || m.Program != "prog" {
+		t.Errorf("expected metric kept for prog2: %v", s.Metrics)
+	}
+	s.RemoveProgram("prog2")
+	if _, ok := s.Metrics["foo"]; ok {
+		t.Errorf("expected metric removed: %v", s.Metrics)
+	}
+}
+
+func TestReleaseShared(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(m))
+	n := NewMetric("bar", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(n))
+	s.Share(m, "prog1")
+
+	// prog1 is reloaded and still declares foo.
+	s.ReleaseShared("prog1", []*Metric{m})
+	if diff := testutil.Diff([]string{"prog1"}, m.SharedBy); diff != "" {
+		t.Errorf("SharedBy diff:\n%s", diff)
+	}
+	// prog1 is reloaded without foo.
+	s.ReleaseShared("prog1", nil)
+	if len(m.SharedBy) != 0 || len(s.Metrics["foo"]) != 1 {
+		t.Errorf("expected foo unshared and kept: %v", s.Metrics)
+	}
+
+	// prog is unloaded while prog1 shares foo, which is removed once prog1
+	// is reloaded without it.
+	s.Share(m, "prog1")
+	s.RemoveProgram("prog")
+	if len(s.Metrics["foo"]) != 1 {
+		t.Fatalf("expected foo kept for prog1: %v", s.Metrics)
+	}
+	if _, ok := s.Metrics["bar"]; ok {
+		t.Errorf("expected bar removed: %v", s.Metrics)
+	}
+	s.ReleaseShared("prog1", nil)
+	if _, ok := s.Metrics["foo"]; ok {
+		t.Errorf("expected foo removed: %v", s.Metrics)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	s := NewStore()
+	s.SetMaxSeries(4)
+	m := NewMetric("foo", "prog", Counter, Int, "user")
+	testutil.FatalIfErr(t, s.Add(m))
+	// Scalar metrics count towards the maximum, but aren't evicted.
+	scalar := NewMetric("bar", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(scalar))
+	d, err := scalar.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(0, 0))
+
+	start := time.Now()
+	for i, user := range []string{"a", "b", "c", "d", "e"} {
+		d, err := m.GetDatum(user)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, start.Add(time.Duration(i)*time.Second))
+	}
+	// Updating a series makes it the most recently updated.
+	d, err = m.GetDatum("a")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 2, start.Add(time.Minute))
+
+	evictions := seriesEvictions.Value()
+	testutil.FatalIfErr(t, s.Gc())
+	var users []string
+	for _, lv := range m.LabelValues {
+		users = append(users, lv.Labels[0])
+	}
+	sort.Strings(users)
+	if diff := testutil.Diff([]string{"a", "d", "e"}, users); diff != "" {
+		t.Errorf("remaining series diff:\n%s", diff)
+	}
+	if len(scalar.LabelValues) != 1 {
+		t.Errorf("scalar metric evicted: %v", scalar)
+	}
+	if got := seriesEvictions.Value() - evictions; got != 2 {
+		t.Errorf("expected 2 evictions, got %d", got)
+	}
+}
+
+func TestStaleSeriesBounded(t *testing.T) {
+	s := NewStore()
+	s.TrackStaleSeries(true)
+	m := NewMetric("foo", "prog", Counter, Int, "user")
+	testutil.FatalIfErr(t, s.Add(m))
+	for i := 0; i <= maxStaleSeries; i++ {
+		_, err := m.GetDatum(fmt.Sprintf("%d", i))
+		testutil.FatalIfErr(t, err)
+	}
+	s.RemoveProgram("prog")
+	stale := s.TakeStaleSeries()
+	if len(stale) > maxStaleSeries {
+		t.Fatalf("expected at most %d stale series, got %d", maxStaleSeries, len(stale))
+	}
+	if got := stale[len(stale)-1].Labels["user"]; got != fmt.Sprintf("%d", maxStaleSeries) {
+		t.Errorf("expected the latest series kept, got %q", got)
+	}
+}
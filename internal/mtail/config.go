@@ -0,0 +1,206 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+)
+
+// configReloads counts the reloads of the config file.
+var configReloads = expvar.NewInt("config_reloads_total")
+
+// ConfigFlag is a flag set in a config file.
+type ConfigFlag struct {
+	Name  string
+	Value string
+}
+
+// ReadConfig reads a config file of flags, one to a line in the form
+// name=value, where the name may be prefixed with dashes as on the
+// commandline.  A name without a value sets a boolean flag to true.  Blank
+// lines and lines beginning with # are ignored.
+func ReadConfig(r io.Reader) ([]ConfigFlag, error) {
+	var flags []ConfigFlag
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		f := ConfigFlag{Name: strings.TrimLeft(strings.TrimSpace(kv[0]), "-"), Value: "true"}
+		if len(kv) == 2 {
+			f.Value = strings.TrimSpace(kv[1])
+		}
+		if f.Name == "" {
+			return nil, errors.Errorf("%d: missing flag name in %q", n, line)
+		}
+		flags = append(flags, f)
+	}
+	return flags, scanner.Err()
+}
+
+// ReadConfigFile reads the config file at path, as described by ReadConfig.
+func ReadConfigFile(path string) ([]ConfigFlag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open config file")
+	}
+	defer f.Close()
+	flags, err := ReadConfig(f)
+	return flags, errors.Wrapf(err, "failed to read config file %q", path)
+}
+
+// configValues returns the values of each flag in the config, in order.
+// Values of flags that take lists are split on commas.
+func configValues(config []ConfigFlag) map[string][]string {
+	values := make(map[string][]string)
+	for _, f := range config {
+		values[f.Name] = append(values[f.Name], strings.Split(f.Value, ",")...)
+	}
+	return values
+}
+
+// configReloader reloads the config file when it changes, applying the
+// changes to the Server that can be made without a restart.
+type configReloader struct {
+	m           *Server
+	path        string          // absolute path of the config file
+	commandline map[string]bool // flags set on the commandline, which the config file can't change
+
+	mu     sync.Mutex
+	config []ConfigFlag // the config last applied
+	timer  *time.Timer  // if not nil, the pending reload
+}
+
+// ProcessFileEvent schedules a reload when the config file is written or
+// replaced.  Reloads are delayed until the file has been quiet for a while,
+// so that the file is read once it has been written completely.
+func (c *configReloader) ProcessFileEvent(ctx context.Context, event watcher.Event) {
+	if event.Pathname != c.path || event.Op == watcher.Delete {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(programReloadDelay, c.reload)
+}
+
+// reload reads the config file and applies the changes since it was last
+// read.
+func (c *configReloader) reload() {
+	config, err := ReadConfigFile(c.path)
+	if err != nil {
+		glog.Warningf("Not reloading config: %s", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.applyConfigChanges(configValues(c.config), configValues(config), c.commandline)
+	c.config = config
+	configReloads.Add(1)
+}
+
+// applyConfigChanges applies the changes from the old to the new values of
+// the flags in the config file, except for those set on the commandline.
+// Flags that can't be changed without a restart are logged and ignored.
+func (m *Server) applyConfigChanges(old, new map[string][]string, commandline map[string]bool) {
+	names := make(map[string]struct{})
+	for name := range old {
+		names[name] = struct{}{}
+	}
+	for name := range new {
+		names[name] = struct{}{}
+	}
+	for name := range names {
+		if commandline[name] || reflect.DeepEqual(old[name], new[name]) {
+			continue
+		}
+		if err := m.applyConfigChange(name, old[name], new[name]); err != nil {
+			glog.Warningf("Not reloading --%s: %s", name, err)
+		}
+	}
+}
+
+// applyConfigChange applies a change to the values of the named flag.
+func (m *Server) applyConfigChange(name string, old, new []string) error {
+	switch name {
+	case "logs":
+		tailed := make(map[string]bool)
+		for _, pattern := range old {
+			tailed[pattern] = true
+		}
+		for _, pattern := range new {
+			if pattern == "" || tailed[pattern] {
+				continue
+			}
+			glog.Infof("Config reload: tailing %q", pattern)
+			if err := m.t.TailPattern(pattern); err != nil {
+				glog.Warning(err)
+			}
+		}
+		for _, pattern := range new {
+			delete(tailed, pattern)
+		}
+		if len(tailed) > 0 {
+			return errors.New("logs removed from the config are tailed until mtail is restarted")
+		}
+		return nil
+	case "static_labels":
+		labels := make(map[string]string)
+		for _, l := range new {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return errors.Errorf("static label %q is not of the form key=value", l)
+			}
+			labels[kv[0]] = kv[1]
+		}
+		glog.Infof("Config reload: static labels %v", labels)
+		m.sdMu.Lock()
+		m.staticLabels = labels
+		m.sdMu.Unlock()
+		if m.sdOutputFile != "" {
+			return m.WriteServiceDiscovery()
+		}
+		return nil
+	case "metric_push_interval_seconds":
+		if len(new) == 0 {
+			return errors.New("restart mtail to use the default push interval")
+		}
+		seconds, err := strconv.Atoi(new[len(new)-1])
+		if err != nil {
+			return errors.Wrap(err, "invalid push interval")
+		}
+		interval := time.Duration(seconds) * time.Second
+		glog.Infof("Config reload: push interval %s", interval)
+		return m.e.SetPushInterval(interval)
+	}
+	return errors.New("changing this flag requires restarting mtail")
+}
+
+// startConfigReload watches the config file for changes, if it is to be
+// reloaded.  The directory containing the file is watched, so that a file
+// replaced by renaming another over it is reloaded too.
+func (m *Server) startConfigReload() error {
+	if m.configReloader == nil {
+		return nil
+	}
+	return m.w.Observe(filepath.Dir(m.configReloader.path), m.configReloader)
+}
@@ -122,7 +122,7 @@ func TestReadTestData(t *testing.T) {
 	defer f.Close()
 	store := metrics.NewStore()
 	ReadTestData(f, "reader_test", store)
-	diff := testutil.Diff(expectedMetrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}, datum.String{}))
+	diff := testutil.Diff(expectedMetrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}, sync.Mutex{}, datum.String{}))
 	if diff != "" {
 		t.Error(diff)
 		t.Logf("store contains %s", store.Metrics)
@@ -4,7 +4,11 @@
 package mtail
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"expvar"
 	"fmt"
@@ -12,10 +16,12 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -28,7 +34,6 @@ import (
 	"github.com/google/mtail/internal/watcher"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 	"go.opencensus.io/zpages"
 )
@@ -59,22 +64,36 @@ type Server struct {
 	l *vm.Loader         // l loads programs and manages the VM lifecycle.
 	e *exporter.Exporter // e manages the export of metrics from the store.
 
-	reg *prometheus.Registry
+	reg         *prometheus.Registry
+	internalReg prometheus.Registerer // registers mtail's own metrics in reg, with the internal metrics prefix
 
 	h        *http.Server
 	listener net.Listener
 
+	pprofServer   *http.Server // if not nil, serves the profiling endpoints
+	pprofListener net.Listener // if not nil, the localhost listener of the profiling endpoints
+
 	webquit   chan struct{} // Channel to signal shutdown from web UI.
 	closeQuit chan struct{} // Channel to signal shutdown from code.
 	closeOnce sync.Once     // Ensure shutdown happens only once.
 
 	bindAddress        string    // address to bind HTTP server
+	metricsPath        string    // URL path of the Prometheus metrics handler
+	jsonPath           string    // URL path of the JSON metrics handler
+	httpPrefix         string    // URL path prefix of all the handlers, if not empty
 	buildInfo          BuildInfo // go build information
 	programPath        string    // path to programs to load
 	logPathPatterns    []string  // list of patterns to watch for log files to tail
+	logPathRegexps     []string  // list of directory and filename regexps to watch for log files to tail
+	logCommands        []string  // list of commands whose output is tailed
 	ignoreRegexPattern string
+	logFileBlacklist   *regexp.Regexp // if not nil, log files whose absolute path matches are not tailed
+	logFileWhitelist   *regexp.Regexp // if not nil, only log files whose absolute path matches are tailed
+	stripControl       bool           // if set, ANSI escape sequences and control characters are stripped from log lines
 
 	oneShot      bool // if set, mtail reads log files from the beginning, once, then exits
+	noFollow     bool // if set, mtail reads log files from the beginning to their end, pushes the metrics, then exits
+	flushOnExit  bool // if set, the metrics are pushed to any collectors one last time on Close
 	compileOnly  bool // if set, mtail compiles programs then exits
 	dumpAst      bool // if set, mtail prints the program syntax tree after parse
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
@@ -83,10 +102,53 @@ type Server struct {
 	overrideLocation            *time.Location // Timezone location to use when parsing timestamps
 	expiredMetricGcTickInterval time.Duration  // Interval between expired metric removal runs
 	staleLogGcTickInterval      time.Duration  // Interval between stale log gc runs
+	logWatchdogTimeout          time.Duration  // Time without reads after which a growing log is reopened
+	staleFileThreshold          time.Duration  // Time without reads after which a log is closed
+	idleFileTimeout             time.Duration  // Time without reads after which a log's file descriptor is closed
+	logRotationCheckInterval    time.Duration  // Interval between checks of each log for rotation
+	journalctl                  string         // If set, the command to read the systemd journal with
+	journalUnits                []string       // Units whose journal entries are read, or all if empty
+	syslogAddress               string         // If set, the address to receive syslog messages over TLS on
+	syslogTLSConfig             *tls.Config    // TLS configuration of the syslog listener
+	tlsMinVersion               uint16         // Oldest TLS version accepted by the TLS listeners
+	tlsCipherSuites             []uint16       // If set, the cipher suites accepted by the TLS listeners below TLS 1.3
+	recordDelimiter             byte           // Byte that ends each record read from the logs
+	ignoreFilesOlderThan        time.Duration  // Age of the last modification after which log files are not tailed
+	maxProgs                    int            // Maximum number of programs to load, or zero for no limit
+	disableProgramWatch         bool           // if set, load programs once at startup and don't watch for changes
 	syslogUseCurrentYear        bool           // if set, use the current year for timestamps that have no year information
 	omitMetricSource            bool           // if set, do not link the source program to a metric
 	omitProgLabel               bool           // if set, do not put the program name in the metric labels
 	emitMetricTimestamp         bool           // if set, emit the metric's recorded timestamp
+	emitStaleMarkers            bool           // if set, export removed series once with the Prometheus staleness marker
+	emitInitialValues           bool           // if set, export label-free metrics as soon as programs are loaded
+	internalMetricsPrefix       string         // prefix of the names of mtail's own metrics
+	snapshotPath                string         // path to write metrics snapshots to on signal, or stderr if empty
+	unparseableLogPath          string         // path to write lines not matched by any program to, if set
+	unparseableLogMaxSize       int64          // size in bytes at which the unparseable log is rotated
+	knownEnvVars                []string       // environment variables that programs are expected to read
+	dedupWindow                 time.Duration  // window within which programs ignore repeated identical lines
+	dedupMaxLines               int            // most lines each program remembers for deduplication, if positive
+	geoipDatabase               string         // path of the MaxMind DB that programs look addresses up in
+	hashSecretFile              string         // path of the secret that programs key hashes with
+	hllPrecision                int            // precision of the sketches of hll metrics, or the default if zero
+	lineWorkers                 int            // number of copies of each program processing lines in parallel
+	lineQueueSize               int            // number of lines that can wait for a line worker, or one per worker if zero
+	lineQueuePolicy             string         // what to do with a line when the line queue is full, or block if empty
+	hostname                    string         // hostname to export metrics as, or the system's if empty
+	gracefulShutdownTimeout     time.Duration  // time to wait for shutdown to complete, or zero to wait forever
+	apiKey                      []byte         // if set, the key that requests to the management endpoints must present
+
+	sdOutputFile      string            // path to write a Prometheus service discovery file to, if set
+	sdRefreshInterval time.Duration     // interval between rewrites of the service discovery file
+	sdMu              sync.Mutex        // protects staticLabels, which may be changed by a config reload
+	staticLabels      map[string]string // labels of this instance's target in the service discovery file
+
+	configReloader *configReloader // if not nil, reloads the config file when it changes
+
+	exportOptions []func(*exporter.Exporter) error // options for the exporter, like label renames and metric filters
+
+	closeErr error // result of the shutdown, returned by every call to Close
 }
 
 // StartTailing adds each log path pattern to the tailer.
@@ -101,13 +163,42 @@ func (m *Server) StartTailing() error {
 			glog.Warning(err)
 		}
 	}
+	for _, pattern := range m.logPathRegexps {
+		glog.V(1).Infof("Tail regexp %q", pattern)
+		if err = m.t.TailRegexp(pattern); err != nil {
+			glog.Warning(err)
+		}
+	}
+	for _, command := range m.logCommands {
+		if err = m.t.TailCommand(command); err != nil {
+			return err
+		}
+	}
+	if m.journalctl != "" {
+		if err = m.t.TailJournal(m.journalctl, m.journalUnits); err != nil {
+			return err
+		}
+	}
+	if m.syslogAddress != "" {
+		m.syslogTLSConfig.MinVersion = m.tlsMinVersion
+		m.syslogTLSConfig.CipherSuites = m.tlsCipherSuites
+		if err = m.t.ListenSyslog(m.syslogAddress, m.syslogTLSConfig); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// programReloadDelay is the quiet period after a change to a program file
+// before it is reloaded, so that an editor saving a file several times in
+// quick succession causes only one reload.
+const programReloadDelay = 100 * time.Millisecond
+
 // initLoader constructs a new program loader and performs the initial load of program files in the program directory.
 func (m *Server) initLoader() error {
 	opts := []func(*vm.Loader) error{
-		vm.PrometheusRegisterer(m.reg),
+		vm.PrometheusRegisterer(m.internalReg),
+		vm.ProgramReloadDelay(programReloadDelay),
 	}
 	if m.compileOnly {
 		opts = append(opts, vm.CompileOnly)
@@ -130,9 +221,42 @@ func (m *Server) initLoader() error {
 	if m.omitMetricSource {
 		opts = append(opts, vm.OmitMetricSource)
 	}
+	if m.emitInitialValues {
+		opts = append(opts, vm.EmitInitialValues)
+	}
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if m.maxProgs > 0 {
+		opts = append(opts, vm.MaxProgs(m.maxProgs))
+	}
+	if m.disableProgramWatch {
+		opts = append(opts, vm.DisableProgramWatch)
+	}
+	if len(m.knownEnvVars) > 0 {
+		opts = append(opts, vm.KnownEnvVars(m.knownEnvVars...))
+	}
+	if m.dedupWindow > 0 {
+		opts = append(opts, vm.DedupWindow(m.dedupWindow, m.dedupMaxLines))
+	}
+	if m.geoipDatabase != "" {
+		opts = append(opts, vm.GeoIPDatabase(m.geoipDatabase))
+	}
+	if m.hashSecretFile != "" {
+		opts = append(opts, vm.HashSecretFile(m.hashSecretFile))
+	}
+	if m.hllPrecision != 0 {
+		opts = append(opts, vm.HLLPrecision(m.hllPrecision))
+	}
+	if m.lineWorkers > 1 {
+		opts = append(opts, vm.LineWorkers(m.lineWorkers))
+	}
+	if m.lineQueueSize > 0 || (m.lineQueuePolicy != "" && m.lineQueuePolicy != vm.QueueBlock) {
+		opts = append(opts, vm.LineQueue(m.lineQueueSize, m.lineQueuePolicy))
+	}
+	if m.unparseableLogPath != "" {
+		opts = append(opts, vm.UnparseableLog(m.unparseableLogPath, m.unparseableLogMaxSize))
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.programPath, m.store, m.w, opts...)
 	if err != nil {
@@ -156,27 +280,44 @@ func (m *Server) initExporter() (err error) {
 	if m.emitMetricTimestamp {
 		opts = append(opts, exporter.EmitTimestamp)
 	}
+	if m.emitStaleMarkers {
+		opts = append(opts, exporter.EmitStaleMarkers)
+	}
+	opts = append(opts, m.exportOptions...)
 	m.e, err = exporter.New(m.store, opts...)
 	if err != nil {
 		return err
 	}
 	m.reg.MustRegister(m.e)
 
-	// Create mtail_build_info metric.
+	// Create the build_info metric.
 	version.Branch = m.buildInfo.Branch
 	version.Version = m.buildInfo.Version
 	version.Revision = m.buildInfo.Revision
-	m.reg.MustRegister(version.NewCollector("mtail"))
+	m.reg.MustRegister(version.NewCollector(m.internalMetricsPrefix))
 	return nil
 }
 
 // initTailer sets up a Tailer for this Server.
 func (m *Server) initTailer() (err error) {
 	opts := []func(*tailer.Tailer) error{
-		tailer.Context(context.Background())}
-	if m.oneShot {
+		tailer.Context(context.Background()),
+		tailer.RecordDelimiter(m.recordDelimiter)}
+	if m.oneShot || m.noFollow {
 		opts = append(opts, tailer.OneShot)
 	}
+	if m.ignoreFilesOlderThan > 0 {
+		opts = append(opts, tailer.IgnoreFilesOlderThan(m.ignoreFilesOlderThan))
+	}
+	if m.logFileBlacklist != nil {
+		opts = append(opts, tailer.Blacklist(m.logFileBlacklist))
+	}
+	if m.logFileWhitelist != nil {
+		opts = append(opts, tailer.Whitelist(m.logFileWhitelist))
+	}
+	if m.stripControl {
+		opts = append(opts, tailer.StripControl)
+	}
 	m.t, err = tailer.New(m.l, m.w, opts...)
 	return
 }
@@ -189,8 +330,8 @@ const statusTemplate = `
 <body>
 <h1>mtail on {{.BindAddress}}</h1>
 <p>Build: {{.BuildInfo}}</p>
-<p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a></p>
-<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a>, <a href="/tracez">tracez</a>, <a href="/progz">progz</a></p>
+<p>Metrics: <a href="{{.Prefix}}{{.JSONPath}}">json</a>, <a href="{{.Prefix}}{{.MetricsPath}}">prometheus</a>, <a href="{{.Prefix}}/varz">varz</a></p>
+<p>Debug: <a href="{{.Prefix}}/debug/vars">debug/vars</a>, <a href="{{.Prefix}}/tracez">tracez</a>, <a href="{{.Prefix}}/progz">progz</a></p>
 `
 
 func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -203,9 +344,15 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		BindAddress string
 		BuildInfo   string
+		MetricsPath string
+		JSONPath    string
+		Prefix      string
 	}{
 		m.bindAddress,
 		m.buildInfo.String(),
+		m.metricsPath,
+		m.jsonPath,
+		m.httpPrefix,
 	}
 	w.Header().Add("Content-type", "text/html")
 	w.WriteHeader(http.StatusOK)
@@ -233,31 +380,72 @@ func New(store *metrics.Store, w watcher.Watcher, options ...func(*Server) error
 		// Using a non-pedantic registry means we can be looser with metrics that
 		// are not fully specified at startup.
 		reg: prometheus.NewRegistry(),
+
+		internalMetricsPrefix: "mtail",
+		recordDelimiter:       '\n',
+		tlsMinVersion:         tls.VersionTLS12,
+		metricsPath:           "/metrics",
+		jsonPath:              "/json",
 	}
 
 	expvarDescs := map[string]*prometheus.Desc{
+		// internal/mtail/config.go
+		"config_reloads_total": prometheus.NewDesc("config_reloads_total", "number of reloads of the config file", nil, nil),
 		// internal/tailer/file.go
-		"log_errors_total":    prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
-		"log_rotations_total": prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
-		"log_truncates_total": prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
-		"log_lines_total":     prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_errors_total":              prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
+		"log_rotations_total":           prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
+		"log_truncates_total":           prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
+		"log_lines_total":               prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_watchdog_recoveries_total": prometheus.NewDesc("log_watchdog_recoveries_total", "number of times a stuck log file was reopened by the watchdog", []string{"logfile"}, nil),
+		"tailer_open_files":             prometheus.NewDesc("tailer_open_files", "number of log files held open", nil, nil),
+		// internal/tailer/command.go
+		"command_restarts_total": prometheus.NewDesc("command_restarts_total", "number of times each command tailed with --logs_command was run again after exiting", []string{"command"}, nil),
+		// internal/tailer/tail.go
+		"tailer_stale_files_closed_total": prometheus.NewDesc("tailer_stale_files_closed_total", "number of log files closed for having no new content for longer than --stale_file_threshold", nil, nil),
 		// internal/vm/loader.go
-		"lines_total":               prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
-		"prog_loads_total":          prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
-		"prog_load_errors_total":    prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
-		"prog_runtime_errors_total": prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"lines_total":                        prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
+		"prog_loads_total":                   prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
+		"prog_load_errors_total":             prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
+		"prog_runtime_errors_total":          prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"program_lines_total":                prometheus.NewDesc("program_lines_total", "number of lines processed per program, by whether any of the program's patterns matched the line", []string{"prog", "matched"}, nil),
+		"vm_timestamp_parse_failures_total":  prometheus.NewDesc("vm_timestamp_parse_failures_total", "number of timestamps per program that strptime failed to parse", []string{"prog"}, nil),
+		"program_duplicate_lines_total":      prometheus.NewDesc("program_duplicate_lines_total", "number of lines per program suppressed as duplicates of a line seen within the dedup window", []string{"prog"}, nil),
+		"vm_stack_overflow_total":            prometheus.NewDesc("vm_stack_overflow_total", "number of lines per program abandoned because the VM stack grew deeper than --vm_max_stack_depth", []string{"prog"}, nil),
+		"program_excluded_lines_total":       prometheus.NewDesc("program_excluded_lines_total", "number of lines per program skipped because they matched an exclude pattern", []string{"prog"}, nil),
+		"vm_base64_decode_errors_total":      prometheus.NewDesc("vm_base64_decode_errors_total", "number of strings per program that base64_decode() failed to decode", []string{"prog"}, nil),
+		"vm_duration_parse_errors_total":     prometheus.NewDesc("vm_duration_parse_errors_total", "number of strings per program that duration() failed to parse", []string{"prog"}, nil),
+		"vm_accumulate_expired_total":        prometheus.NewDesc("vm_accumulate_expired_total", "number of keys per program whose accumulated fields expired before being finalized", []string{"prog"}, nil),
+		"metrics_per_program_overflow_total": prometheus.NewDesc("metrics_per_program_overflow_total", "number of new label sets per program not recorded because the program already had --max_metrics_per_program label sets", []string{"prog"}, nil),
+		"unparseable_lines_total":            prometheus.NewDesc("unparseable_lines_total", "number of lines not matched by any program", nil, nil),
+		"dropped_lines_total":                prometheus.NewDesc("dropped_lines_total", "number of lines dropped because the line queue was full", nil, nil),
+		// internal/exporter/export.go
+		"exporter_push_timeouts_total": prometheus.NewDesc("exporter_push_timeouts_total", "number of pushes to collectors that timed out", nil, nil),
+		// internal/exporter/file.go
+		"exporter_file_write_errors_total": prometheus.NewDesc("exporter_file_write_errors_total", "number of failed writes of the metrics to --output_file", nil, nil),
+		// internal/metrics/store.go
+		"metric_series_evictions_total": prometheus.NewDesc("metric_series_evictions_total", "number of metric series evicted to keep within the maximum number of series", nil, nil),
 		// internal/watcher/log_watcher.go
 		"log_watcher_errors_total": prometheus.NewDesc("log_watcher_errors_total", "number of errors received from fsnotify", nil, nil),
 	}
 	m.reg.MustRegister(
 		prometheus.NewGoCollector(),
 		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
-	// Prefix all expvar metrics with 'mtail_'
-	prometheus.WrapRegistererWithPrefix("mtail_", m.reg).MustRegister(
-		prometheus.NewExpvarCollector(expvarDescs))
 	if err := m.SetOption(options...); err != nil {
 		return nil, err
 	}
+	if m.metricsPath == m.jsonPath {
+		return nil, errors.Errorf("metrics and JSON paths must differ: %q", m.metricsPath)
+	}
+	// Prefix all of mtail's own metrics with the internal metrics prefix,
+	// 'mtail_' by default.  The counters are expvars; only the histograms of
+	// the VM are registered with Prometheus directly.
+	m.internalReg = prometheus.WrapRegistererWithPrefix(m.internalMetricsPrefix+"_", m.reg)
+	m.internalReg.MustRegister(prometheus.NewExpvarCollector(expvarDescs))
+	// The runtime errors are also exported as program_errors_total, the name
+	// alerts on program errors are written against.
+	m.internalReg.MustRegister(prometheus.NewExpvarCollector(map[string]*prometheus.Desc{
+		"prog_runtime_errors_total": prometheus.NewDesc("program_errors_total", "number of runtime errors encountered while processing lines per program", []string{"prog"}, nil),
+	}))
 	if err := m.initExporter(); err != nil {
 		return nil, err
 	}
@@ -281,16 +469,60 @@ func (m *Server) SetOption(options ...func(*Server) error) error {
 }
 
 // WriteMetrics dumps the current state of the metrics store in JSON format to
-// the io.Writer.
+// the io.Writer.  The output is the same as marshalling the store's metrics map
+// with two space indentation, but it is written one metric at a time, so that
+// a large store isn't copied into one buffer first.
 func (m *Server) WriteMetrics(w io.Writer) error {
 	m.store.RLock()
-	b, err := json.MarshalIndent(m.store.Metrics, "", "  ")
-	m.store.RUnlock()
-	if err != nil {
-		return errors.Wrap(err, "failed to marshal metrics into json")
+	defer m.store.RUnlock()
+	names := make([]string, 0, len(m.store.Metrics))
+	for name := range m.store.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	if len(names) == 0 {
+		bw.WriteString("{}")
+		return bw.Flush()
+	}
+	// Each metric is encoded into buf, which is reused, and then copied to
+	// the output without the encoder's trailing newline.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("    ", "  ")
+	bw.WriteString("{\n")
+	for i, name := range names {
+		if i > 0 {
+			bw.WriteString(",\n")
+		}
+		k, err := json.Marshal(name)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal metrics into json")
+		}
+		bw.WriteString("  ")
+		bw.Write(k)
+		ml := m.store.Metrics[name]
+		if len(ml) == 0 {
+			bw.WriteString(": []")
+			continue
+		}
+		bw.WriteString(": [\n")
+		for j, metric := range ml {
+			if j > 0 {
+				bw.WriteString(",\n")
+			}
+			buf.Reset()
+			if err := enc.Encode(metric); err != nil {
+				return errors.Wrap(err, "failed to marshal metrics into json")
+			}
+			bw.WriteString("    ")
+			bw.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		}
+		bw.WriteString("\n  ]")
 	}
-	_, err = w.Write(b)
-	return err
+	bw.WriteString("\n}")
+	return bw.Flush()
 }
 
 // Serve begins the webserver and awaits a shutdown instruction.
@@ -302,19 +534,29 @@ func (m *Server) Serve() error {
 	mux.HandleFunc("/favicon.ico", FaviconHandler)
 	mux.Handle("/", m)
 	mux.Handle("/progz", http.HandlerFunc(m.l.ProgzHandler))
-	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/trace", m.l.TraceHandler)
+	mux.HandleFunc(m.jsonPath, http.HandlerFunc(m.e.HandleJSON))
+	mux.Handle(m.metricsPath, m.e.PrometheusHandler(m.reg))
 	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
-	mux.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
+	mux.HandleFunc("/quitquitquit", m.authorize(m.handleQuit))
 	mux.Handle("/debug/vars", expvar.Handler())
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	zpages.Handle(mux, "/")
 	m.h.Handler = mux
+	if m.httpPrefix != "" {
+		root := http.NewServeMux()
+		root.Handle(m.httpPrefix+"/", http.StripPrefix(m.httpPrefix, mux))
+		root.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			http.Redirect(w, r, m.httpPrefix+"/", http.StatusFound)
+		})
+		m.h.Handler = root
+	}
 	m.e.StartMetricPush()
+	m.startServiceDiscovery()
+	m.startPprof()
 
 	errc := make(chan error, 1)
 	go func() {
@@ -326,10 +568,49 @@ func (m *Server) Serve() error {
 		}
 		errc <- err
 	}()
-	m.WaitForShutdown()
+	if err := m.WaitForShutdown(); err != nil {
+		// The HTTP server may not have shut down, so don't wait for it.
+		return err
+	}
 	return <-errc
 }
 
+// startPprof serves the profiling endpoints on their own localhost listener,
+// if one was set with PprofPort, so they aren't exposed with the metrics.
+func (m *Server) startPprof() {
+	if m.pprofListener == nil {
+		return
+	}
+	m.pprofServer = &http.Server{Handler: pprofHandler()}
+	go func() {
+		glog.Infof("Serving pprof on %s", m.pprofListener.Addr())
+		if err := m.pprofServer.Serve(m.pprofListener); err != nil && err != http.ErrServerClosed {
+			glog.Warning(err)
+		}
+	}()
+}
+
+// authorize returns a handler that calls h only for requests that present the
+// API key, if one is set, either as a bearer token in the Authorization
+// header or in the X-API-Key header.  Other requests are unauthorized.
+func (m *Server) authorize(h http.HandlerFunc) http.HandlerFunc {
+	if m.apiKey == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), m.apiKey) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
 func (m *Server) handleQuit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.Header().Add("Allow", "POST")
@@ -340,21 +621,54 @@ func (m *Server) handleQuit(w http.ResponseWriter, r *http.Request) {
 	close(m.webquit)
 }
 
-// WaitForShutdown handles shutdown requests from the system or the UI.
-func (m *Server) WaitForShutdown() {
+// WriteSnapshot writes the current state of the metrics store in JSON format to
+// the snapshot path, or to standard error if no path is set.
+func (m *Server) WriteSnapshot() error {
+	if m.snapshotPath == "" {
+		return m.WriteMetrics(os.Stderr)
+	}
+	f, err := os.Create(m.snapshotPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create snapshot file")
+	}
+	if err := m.WriteMetrics(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WaitForShutdown handles shutdown requests from the system or the UI.  It
+// also writes a snapshot of the metrics store when a snapshot signal is
+// received, and continues waiting.  It returns the error from Close.
+func (m *Server) WaitForShutdown() error {
 	n := make(chan os.Signal, 1)
 	signal.Notify(n, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-n:
-		glog.Info("Received SIGTERM, exiting...")
-	case <-m.webquit:
-		glog.Info("Received Quit from HTTP, exiting...")
-	case <-m.closeQuit:
-		glog.Info("Received quit internally, exiting...")
-	}
-	if err := m.Close(); err != nil {
-		glog.Warning(err)
+	s := make(chan os.Signal, 1)
+	if len(snapshotSignals) > 0 {
+		signal.Notify(s, snapshotSignals...)
+		defer signal.Stop(s)
+	}
+Loop:
+	for {
+		select {
+		case <-s:
+			glog.Info("Received snapshot signal, writing metrics snapshot")
+			if err := m.WriteSnapshot(); err != nil {
+				glog.Warning(err)
+			}
+		case <-n:
+			glog.Info("Received SIGTERM, exiting...")
+			break Loop
+		case <-m.webquit:
+			glog.Info("Received Quit from HTTP, exiting...")
+			break Loop
+		case <-m.closeQuit:
+			glog.Info("Received quit internally, exiting...")
+			break Loop
+		}
 	}
+	return m.Close()
 }
 
 // Close handles the graceful shutdown of this mtail instance, ensuring that it only occurs once.
@@ -362,6 +676,24 @@ func (m *Server) Close() error {
 	m.closeOnce.Do(func() {
 		glog.Info("Shutdown requested.")
 		close(m.closeQuit)
+		ctx := context.Background()
+		if m.gracefulShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, m.gracefulShutdownTimeout)
+			defer cancel()
+		}
+		m.closeErr = m.shutdown(ctx)
+	})
+	return m.closeErr
+}
+
+// shutdown stops the tailer, the programs, the exporter and the HTTP server
+// in turn.  If ctx is done first, for example because a program is stuck on
+// a line, it returns an error, leaving the rest of the shutdown running.
+func (m *Server) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 		// If we have a tailer (i.e. not in test) then signal the tailer to
 		// shut down, which will cause the watcher to shut down.
 		if m.t != nil {
@@ -376,6 +708,13 @@ func (m *Server) Close() error {
 		} else {
 			glog.V(2).Info("No loader, so not waiting for loader shutdown.")
 		}
+		// With the logs read and the programs stopped, the store holds the
+		// final metric values.
+		if m.flushOnExit && m.e != nil {
+			if err := m.e.Flush(); err != nil {
+				glog.Error(err)
+			}
+		}
 		if m.h != nil {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			if err := m.h.Shutdown(ctx); err != nil {
@@ -383,14 +722,27 @@ func (m *Server) Close() error {
 			}
 			cancel()
 		}
+		if m.pprofServer != nil {
+			// Profiles in progress would delay the shutdown by as long as
+			// they were requested for.
+			if err := m.pprofServer.Close(); err != nil {
+				glog.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
 		glog.Info("END OF LINE")
-	})
-	return nil
+		return nil
+	case <-ctx.Done():
+		glog.Warningf("Shutdown didn't complete within %s, giving up.", m.gracefulShutdownTimeout)
+		return errors.Errorf("shutdown didn't complete within %s", m.gracefulShutdownTimeout)
+	}
 }
 
 // Run starts MtailServer's primary function, in which it watches the log files
 // for changes and sends any new lines found to the virtual machines. If
-// OneShot mode is enabled, it will exit.
+// OneShot or NoFollow mode is enabled, it will exit.
 func (m *Server) Run() error {
 	if m.compileOnly {
 		glog.Info("compile-only is set, exiting")
@@ -408,9 +760,31 @@ func (m *Server) Run() error {
 		if err := m.WriteMetrics(os.Stdout); err != nil {
 			return err
 		}
+	} else if m.noFollow {
+		if err := m.Close(); err != nil {
+			return err
+		}
+		// Nothing will scrape the metrics once we've exited, so push them
+		// to any collectors if Close hasn't, and write a snapshot if a path
+		// is set.
+		if !m.flushOnExit {
+			m.e.PushMetrics()
+		}
+		if m.snapshotPath != "" {
+			if err := m.WriteSnapshot(); err != nil {
+				return err
+			}
+		}
 	} else {
 		m.store.StartGcLoop(m.expiredMetricGcTickInterval)
 		m.t.StartGcLoop(m.staleLogGcTickInterval)
+		m.t.StartWatchdogLoop(m.logWatchdogTimeout)
+		m.t.StartStaleFileLoop(m.staleFileThreshold)
+		m.t.StartIdleFileLoop(m.idleFileTimeout)
+		m.t.StartRotationCheckLoop(m.logRotationCheckInterval)
+		if err := m.startConfigReload(); err != nil {
+			return err
+		}
 		if err := m.Serve(); err != nil {
 			return err
 		}
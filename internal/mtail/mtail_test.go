@@ -4,11 +4,18 @@
 package mtail
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,9 +23,13 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/watcher"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const testProgram = "/$/ { }\n"
@@ -762,6 +773,644 @@ func TestBuildInfo(t *testing.T) {
 	}
 }
 
+func TestInternalMetricsPrefix(t *testing.T) {
+	m := startMtailServer(t, InternalMetricsPrefix("mtail_a"))
+	defer m.Close()
+	mfs, err := m.reg.Gather()
+	testutil.FatalIfErr(t, err)
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{"mtail_a_lines_total", "mtail_a_build_info"} {
+		if !names[name] {
+			t.Errorf("metric %q not found in %v", name, names)
+		}
+	}
+	if names["mtail_lines_total"] {
+		t.Errorf("default prefixed metric found in %v", names)
+	}
+}
+
+func TestProgramErrorsTotal(t *testing.T) {
+	m := startMtailServer(t)
+	defer m.Close()
+	runtimeErrors := expvar.Get("prog_runtime_errors_total").(*expvar.Map)
+	runtimeErrors.Add("errors_total_test.mtail", 1)
+	defer runtimeErrors.Add("errors_total_test.mtail", -1)
+	mfs, err := m.reg.Gather()
+	testutil.FatalIfErr(t, err)
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, pm := range mf.GetMetric() {
+			for _, l := range pm.GetLabel() {
+				if l.GetName() == "prog" && l.GetValue() == "errors_total_test.mtail" {
+					values[mf.GetName()] = pm.GetUntyped().GetValue()
+				}
+			}
+		}
+	}
+	expected := map[string]float64{"mtail_prog_runtime_errors_total": 1, "mtail_program_errors_total": 1}
+	if diff := testutil.Diff(expected, values); diff != "" {
+		t.Errorf("unexpected error counts:\n%s", diff)
+	}
+}
+
+func TestHTTPWriteTimeout(t *testing.T) {
+	m := startMtailServer(t, BindAddress("localhost", "0"), HTTPTimeouts(0, 100*time.Millisecond, 0))
+	defer m.Close()
+	// Serve a slow handler on the configured server, in place of the mux set up by Serve.
+	m.h.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	go m.h.Serve(m.listener)
+
+	resp, err := http.Get("http://" + m.Addr() + "/fast")
+	testutil.FatalIfErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("fast request: expected 200, got %s", resp.Status)
+	}
+
+	resp, err = http.Get("http://" + m.Addr() + "/slow")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("slow request: expected the write timeout to close the connection, got %s", resp.Status)
+	}
+}
+
+func TestHandlerPaths(t *testing.T) {
+	m := startMtailServer(t, BindAddress("localhost", "0"), MetricsPath("/telemetry"), JSONPath("/api/json"))
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+	defer func() {
+		testutil.FatalIfErr(t, m.Close())
+		testutil.FatalIfErr(t, <-errc)
+	}()
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + m.Addr() + path)
+		testutil.FatalIfErr(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		testutil.FatalIfErr(t, err)
+		return string(b)
+	}
+	if body := get("/telemetry"); !strings.Contains(body, "# TYPE") {
+		t.Errorf("/telemetry: expected prometheus metrics, got %q", body)
+	}
+	if body := get("/api/json"); !strings.HasPrefix(body, "[") {
+		t.Errorf("/api/json: expected JSON metrics, got %q", body)
+	}
+	// The default paths now fall through to the status page.
+	if body := get("/metrics"); strings.Contains(body, "# TYPE") {
+		t.Errorf("/metrics: expected status page, got %q", body)
+	}
+	if body := get("/"); !strings.Contains(body, `href="/telemetry"`) || !strings.Contains(body, `href="/api/json"`) {
+		t.Errorf("status page doesn't link to the configured paths: %q", body)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	dir, cleanup := testutil.TestTempDir(t)
+	defer cleanup()
+	keyFile := path.Join(dir, "api_key")
+	testutil.FatalIfErr(t, ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600))
+
+	m := startMtailServer(t, BindAddress("localhost", "0"), APIKeyFile(keyFile))
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+
+	post := func(path string, header map[string]string) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://"+m.Addr()+path, nil)
+		testutil.FatalIfErr(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		testutil.FatalIfErr(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, header := range []map[string]string{
+		nil,
+		{"X-API-Key": "wrong"},
+		{"X-API-Key": "s3cret2"},
+		{"Authorization": "Bearer wrong"},
+		{"Authorization": "Basic s3cret"},
+		{"Authorization": "Bearer wrong", "X-API-Key": "s3cret"},
+	} {
+		if code := post("/quitquitquit", header); code != http.StatusUnauthorized {
+			t.Errorf("/quitquitquit with %v: expected status 401, got %d", header, code)
+		}
+	}
+	resp, err := http.Get("http://" + m.Addr() + "/metrics")
+	testutil.FatalIfErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/metrics: expected status 200 without a key, got %d", resp.StatusCode)
+	}
+
+	if code := post("/quitquitquit", map[string]string{"X-API-Key": "s3cret"}); code != http.StatusOK {
+		t.Errorf("/quitquitquit with the key: expected status 200, got %d", code)
+	}
+	testutil.FatalIfErr(t, <-errc)
+}
+
+func TestAPIKeyBearer(t *testing.T) {
+	m := &Server{apiKey: []byte("s3cret")}
+	h := m.authorize(func(w http.ResponseWriter, r *http.Request) {})
+	for auth, expected := range map[string]int{
+		"Bearer s3cret": http.StatusOK,
+		"Bearer s3cre":  http.StatusUnauthorized,
+		"bearer s3cret": http.StatusUnauthorized,
+		"s3cret":        http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("POST", "/quitquitquit", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != expected {
+			t.Errorf("Authorization %q: expected status %d, got %d", auth, expected, w.Code)
+		}
+	}
+}
+
+func TestAPIKeyFileInvalid(t *testing.T) {
+	dir, cleanup := testutil.TestTempDir(t)
+	defer cleanup()
+	empty := path.Join(dir, "empty")
+	testutil.FatalIfErr(t, ioutil.WriteFile(empty, []byte("\n"), 0600))
+	for _, file := range []string{empty, path.Join(dir, "nonexistent")} {
+		if _, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), APIKeyFile(file)); err == nil {
+			t.Errorf("APIKeyFile(%q): expected error", file)
+		}
+	}
+}
+
+func TestPprofPort(t *testing.T) {
+	m := startMtailServer(t, BindAddress("localhost", "0"), PprofPort("0"))
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+	defer func() {
+		testutil.FatalIfErr(t, m.Close())
+		testutil.FatalIfErr(t, <-errc)
+	}()
+
+	if host, _, err := net.SplitHostPort(m.pprofListener.Addr().String()); err != nil || host != "127.0.0.1" {
+		t.Errorf("pprof listening on %s, expected localhost", m.pprofListener.Addr())
+	}
+	get := func(addr string) int {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + "/debug/pprof/cmdline")
+		testutil.FatalIfErr(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(m.pprofListener.Addr().String()); code != http.StatusOK {
+		t.Errorf("pprof listener: expected status %d, got %d", http.StatusOK, code)
+	}
+	// Nothing is registered on the default mux, which other binaries may serve.
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/debug/pprof/", nil)); pattern != "" {
+		t.Errorf("pprof registered on the default mux at %q", pattern)
+	}
+	// The main listener serves the status page instead.
+	resp, err := http.Get("http://" + m.Addr() + "/debug/pprof/cmdline")
+	testutil.FatalIfErr(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	testutil.FatalIfErr(t, err)
+	if !strings.Contains(string(b), "<h1>mtail on") {
+		t.Errorf("main listener served pprof: %q", b)
+	}
+}
+
+func TestPprofSymbol(t *testing.T) {
+	srv := httptest.NewServer(pprofHandler())
+	defer srv.Close()
+	pc := reflect.ValueOf(TestPprofSymbol).Pointer()
+	want := fmt.Sprintf("%#x github.com/google/mtail/internal/mtail.TestPprofSymbol\n", pc)
+	for _, method := range []string{"POST", "GET"} {
+		var resp *http.Response
+		var err error
+		if method == "POST" {
+			resp, err = http.Post(srv.URL+"/debug/pprof/symbol", "text/plain", strings.NewReader(fmt.Sprintf("%#x+bogus", pc)))
+		} else {
+			resp, err = http.Get(fmt.Sprintf("%s/debug/pprof/symbol?%#x", srv.URL, pc))
+		}
+		testutil.FatalIfErr(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		testutil.FatalIfErr(t, err)
+		if got := string(b); got != "num_symbols: 1\n"+want {
+			t.Errorf("%s: unexpected symbols %q, expected %q", method, got, want)
+		}
+	}
+}
+
+func TestPprofProfileWriteTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(pprofHandler())
+	srv.Config.WriteTimeout = time.Second
+	srv.Start()
+	defer srv.Close()
+	for _, path := range []string{"/debug/pprof/profile?seconds=2", "/debug/pprof/trace?seconds=2"} {
+		resp, err := http.Get(srv.URL + path)
+		testutil.FatalIfErr(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPPrefix(t *testing.T) {
+	m := startMtailServer(t, BindAddress("localhost", "0"), HTTPPrefix("/mtail/"))
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+	defer func() {
+		testutil.FatalIfErr(t, m.Close())
+		testutil.FatalIfErr(t, <-errc)
+	}()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Get("http://" + m.Addr() + path)
+		testutil.FatalIfErr(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		testutil.FatalIfErr(t, err)
+		return resp, string(b)
+	}
+	if _, body := get("/mtail/metrics"); !strings.Contains(body, "# TYPE") {
+		t.Errorf("/mtail/metrics: expected prometheus metrics, got %q", body)
+	}
+	if _, body := get("/mtail/json"); !strings.HasPrefix(body, "[") {
+		t.Errorf("/mtail/json: expected JSON metrics, got %q", body)
+	}
+	if _, body := get("/mtail/"); !strings.Contains(body, `href="/mtail/metrics"`) || !strings.Contains(body, `href="/mtail/varz"`) {
+		t.Errorf("status page doesn't link under the prefix: %q", body)
+	}
+	resp, _ := get("/")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/mtail/" {
+		t.Errorf("/: expected a redirect to /mtail/, got %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp, _ := get("/metrics"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/metrics: expected not found outside the prefix, got %s", resp.Status)
+	}
+}
+
+func TestHTTPPrefixInvalid(t *testing.T) {
+	store := metrics.NewStore()
+	if _, err := New(store, watcher.NewFakeWatcher(), HTTPPrefix("mtail")); err == nil {
+		t.Errorf("expected error for a prefix without a leading /")
+	}
+}
+
+func TestInterfaceIP(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return n
+	}
+	addrs := []net.Addr{
+		ipNet("127.0.0.1/8"),
+		ipNet("::1/128"),
+		ipNet("fe80::1/64"),
+		ipNet("2001:db8::1/64"),
+		ipNet("192.0.2.1/24"),
+		ipNet("192.0.2.2/24"),
+	}
+	for _, tc := range []struct {
+		addrs    []net.Addr
+		ipv6     bool
+		expected string
+	}{
+		{addrs, false, "192.0.2.1"},
+		{addrs, true, "2001:db8::1"},
+		// The other family is used if there's no address of the preferred one.
+		{addrs[:4], false, "2001:db8::1"},
+		{addrs[4:], true, "192.0.2.1"},
+		{addrs[:3], false, ""},
+		{nil, false, ""},
+	} {
+		ip, err := interfaceIP(tc.addrs, tc.ipv6)
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("interfaceIP(%v, %v): expected error, got %s", tc.addrs, tc.ipv6, ip)
+			}
+			continue
+		}
+		testutil.FatalIfErr(t, err)
+		if ip.String() != tc.expected {
+			t.Errorf("interfaceIP(%v, %v) = %s, expected %s", tc.addrs, tc.ipv6, ip, tc.expected)
+		}
+	}
+}
+
+func TestBindInterfaceInvalid(t *testing.T) {
+	store := metrics.NewStore()
+	if _, err := New(store, watcher.NewFakeWatcher(), BindInterface("no-such-iface0", "0", false)); err == nil {
+		t.Errorf("expected error for a missing interface")
+	}
+	// The loopback interface has only loopback addresses.
+	ifaces, err := net.Interfaces()
+	testutil.FatalIfErr(t, err)
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			if _, err := New(store, watcher.NewFakeWatcher(), BindInterface(i.Name, "0", false)); err == nil {
+				t.Errorf("expected error for loopback interface %q", i.Name)
+			}
+			break
+		}
+	}
+}
+
+func TestSyslogTLSMissingCertificate(t *testing.T) {
+	store := metrics.NewStore()
+	if _, err := New(store, watcher.NewFakeWatcher(), SyslogTLS("localhost:0", "/nonexistent/cert.pem", "/nonexistent/key.pem", "")); err == nil {
+		t.Errorf("expected error for missing certificate files")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	m, err := New(metrics.NewStore(), watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	if m.tlsMinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 by default, got %x", m.tlsMinVersion)
+	}
+	m, err = New(metrics.NewStore(), watcher.NewFakeWatcher(), TLSMinVersion("tls13"))
+	testutil.FatalIfErr(t, err)
+	if m.tlsMinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3, got %x", m.tlsMinVersion)
+	}
+	for _, version := range []string{"", "TLS12", "tls1.2", "ssl30"} {
+		if _, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), TLSMinVersion(version)); err == nil {
+			t.Errorf("TLSMinVersion(%q): expected error", version)
+		}
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	m, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), TLSCipherSuites("TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", " TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", ""))
+	testutil.FatalIfErr(t, err)
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	if diff := cmp.Diff(expected, m.tlsCipherSuites); diff != "" {
+		t.Errorf("cipher suites didn't match:\n%s", diff)
+	}
+	for _, name := range []string{"TLS_NO_SUCH_SUITE", "TLS_AES_128_GCM_SHA256"} {
+		if _, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), TLSCipherSuites(name)); err == nil {
+			t.Errorf("TLSCipherSuites(%q): expected error", name)
+		}
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	m := startMtailServer(t, BindAddress("localhost", "0"), GracefulShutdownTimeout(100*time.Millisecond))
+	errc := make(chan error, 1)
+	go func() { errc <- m.Serve() }()
+
+	// A request that's never finished keeps the HTTP server from shutting
+	// down.
+	c, err := net.Dial("tcp", m.Addr())
+	testutil.FatalIfErr(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\n"))
+	testutil.FatalIfErr(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := m.Close(); err == nil {
+		t.Error("expected an error when shutdown doesn't complete")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close waited %s, past the shutdown timeout", elapsed)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected Serve to return the shutdown error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Serve didn't return after the shutdown timeout")
+	}
+}
+
+func TestRecordDelimiter(t *testing.T) {
+	for delim, expected := range map[string]byte{`\n`: '\n', `\x00`: 0, `\000`: 0, "|": '|', `\x1e`: 0x1e} {
+		m, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), RecordDelimiter(delim))
+		testutil.FatalIfErr(t, err)
+		if m.recordDelimiter != expected {
+			t.Errorf("RecordDelimiter(%q): expected %q, got %q", delim, expected, m.recordDelimiter)
+		}
+	}
+	for _, delim := range []string{"", "||", `\0`, `\u00e9`} {
+		if _, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), RecordDelimiter(delim)); err == nil {
+			t.Errorf("RecordDelimiter(%q): expected error", delim)
+		}
+	}
+}
+
+func TestHandlerPathsInvalid(t *testing.T) {
+	for _, opt := range []func(*Server) error{
+		MetricsPath("metrics"),
+		MetricsPath("/"),
+		JSONPath(""),
+		JSONPath("/metrics"),
+	} {
+		store := metrics.NewStore()
+		if _, err := New(store, watcher.NewFakeWatcher(), opt); err == nil {
+			t.Errorf("expected error for invalid handler path")
+		}
+	}
+}
+
+func TestNoFollow(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	progDir := path.Join(workdir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	testutil.FatalIfErr(t, ioutil.WriteFile(path.Join(progDir, "lines.mtail"), []byte("counter lines_total\n/$/ {\n  lines_total++\n}\n"), 0600))
+	for name, contents := range map[string]string{"a.log": "1\n2\n", "b.log": "3\n"} {
+		testutil.FatalIfErr(t, ioutil.WriteFile(path.Join(workdir, name), []byte(contents), 0600))
+	}
+	snapshotPath := path.Join(workdir, "snapshot.json")
+
+	m, err := New(metrics.NewStore(), watcher.NewFakeWatcher(), ProgramPath(progDir),
+		LogPathPatterns(path.Join(workdir, "*.log")), NoFollow, SnapshotPath(snapshotPath))
+	testutil.FatalIfErr(t, err)
+	// Run returns once the logs have been read to their end.
+	testutil.FatalIfErr(t, m.Run())
+
+	d, err := m.store.Metrics["lines_total"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 3 {
+		t.Errorf("lines_total: expected 3, got %d", got)
+	}
+	b, err := ioutil.ReadFile(snapshotPath)
+	testutil.FatalIfErr(t, err)
+	if !strings.Contains(string(b), `"lines_total"`) {
+		t.Errorf("snapshot doesn't contain lines_total:\n%s", b)
+	}
+	select {
+	case <-m.closeQuit:
+	default:
+		t.Error("server not closed after reading the logs")
+	}
+}
+
+func TestServiceDiscoveryFile(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	sdPath := path.Join(workdir, "mtail_sd.json")
+
+	m := startMtailServer(t, BindAddress("localhost", "0"), ExportHostname("gunstar.example.com"),
+		ServiceDiscoveryFile(sdPath, 10*time.Millisecond), StaticLabels("env=prod", "team=obs"))
+	defer m.Close()
+	_, port, err := net.SplitHostPort(m.Addr())
+	testutil.FatalIfErr(t, err)
+	expected := `[
+  {
+    "targets": [
+      "gunstar.example.com:` + port + `"
+    ],
+    "labels": {
+      "env": "prod",
+      "team": "obs"
+    }
+  }
+]
+`
+	m.startServiceDiscovery()
+	b, err := ioutil.ReadFile(sdPath)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(expected, string(b)); diff != "" {
+		t.Errorf("service discovery file diff:\n%s", diff)
+	}
+	fi, err := os.Stat(sdPath)
+	testutil.FatalIfErr(t, err)
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("service discovery file mode: expected 0644, got %o", fi.Mode().Perm())
+	}
+
+	// The file is rewritten each refresh interval.
+	testutil.FatalIfErr(t, os.Remove(sdPath))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(sdPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service discovery file wasn't rewritten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []ConfigFlag
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"flags",
+			"# mtail config\n\nlogs=/var/log/a.log,/var/log/b.log\n--port = 3904\n-one_shot\nstatic_labels=env=prod\n",
+			[]ConfigFlag{{"logs", "/var/log/a.log,/var/log/b.log"}, {"port", "3904"}, {"one_shot", "true"}, {"static_labels", "env=prod"}},
+			false},
+		{"missing name", "=3904\n", nil, true},
+	} {
+		config, err := ReadConfig(strings.NewReader(tc.input))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: ReadConfig error %v, expected error %v", tc.name, err, tc.err)
+		}
+		if diff := testutil.Diff(tc.expected, config); diff != "" {
+			t.Errorf("%s: config didn't match:\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestConfigReloadOnChange(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	sdPath := path.Join(workdir, "mtail_sd.json")
+	configPath := path.Join(workdir, "mtail.conf")
+	for _, name := range []string{"a.log", "b.log"} {
+		f, err := os.Create(path.Join(workdir, name))
+		testutil.FatalIfErr(t, err)
+		f.Close()
+	}
+	writeConfig := func(config string) {
+		testutil.FatalIfErr(t, ioutil.WriteFile(configPath, []byte(config), 0644))
+	}
+	writeConfig("logs=" + path.Join(workdir, "a.log") + "\nstatic_labels=env=prod\n")
+	config, err := ReadConfigFile(configPath)
+	testutil.FatalIfErr(t, err)
+
+	m := startMtailServer(t, BindAddress("localhost", "0"), LogPathPatterns(path.Join(workdir, "a.log")),
+		ServiceDiscoveryFile(sdPath, time.Hour), StaticLabels("env=prod"), ReloadConfigOnChange(configPath, config))
+	defer m.Close()
+	testutil.FatalIfErr(t, m.startConfigReload())
+	reloads := configReloads.Value()
+
+	writeConfig("logs=" + path.Join(workdir, "a.log") + "," + path.Join(workdir, "b.log") + "\nstatic_labels=env=dev\nport=4000\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for configReloads.Value() == reloads {
+		if time.Now().After(deadline) {
+			t.Fatal("config wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logCount := expvar.Get("log_count").String(); logCount != "2" {
+		t.Errorf("log count: expected 2, got %s", logCount)
+	}
+	b, err := ioutil.ReadFile(sdPath)
+	testutil.FatalIfErr(t, err)
+	if !strings.Contains(string(b), `"env": "dev"`) {
+		t.Errorf("service discovery file doesn't have the reloaded labels:\n%s", b)
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	snapshot := path.Join(workdir, "snapshot.json")
+	m := startMtailServer(t, SnapshotPath(snapshot))
+	defer m.Close()
+
+	foo := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, err := foo.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Unix(0, 0))
+	testutil.FatalIfErr(t, m.store.Add(foo))
+
+	testutil.FatalIfErr(t, m.WriteSnapshot())
+	b, err := ioutil.ReadFile(snapshot)
+	testutil.FatalIfErr(t, err)
+	var got map[string][]*metrics.Metric
+	testutil.FatalIfErr(t, json.Unmarshal(b, &got))
+	if len(got["foo"]) != 1 || got["foo"][0].Program != "prog" {
+		t.Fatalf("snapshot missing metric foo: %s", b)
+	}
+	if v := datum.GetInt(got["foo"][0].LabelValues[0].Value); v != 37 {
+		t.Errorf("snapshot value: expected 37, got %d", v)
+	}
+}
+
 func TestFilenameRegexIgnore(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -887,3 +1536,177 @@ func TestIgnoreFolder(t *testing.T) {
 		t.Errorf("Log count not matching\n\texpected: %d\n\t: received: %s", count, expvar.Get("log_count").String())
 	}
 }
+
+func TestExportFilters(t *testing.T) {
+	m := startMtailServer(t, ExportDenyMetrics("scratch_.*"))
+	defer m.Close()
+
+	prog := `hidden counter bytes_in
+counter scratch_lines
+counter kbytes_in
+
+/(\d+)/ {
+  bytes_in += $1
+  scratch_lines++
+  kbytes_in = bytes_in / 1024
+}
+`
+	testutil.FatalIfErr(t, m.l.CompileAndRun("filter", strings.NewReader(prog)))
+	m.l.ProcessLogLine(context.Background(), logline.New(context.Background(), "log", "2048"))
+
+	mfs, err := m.reg.Gather()
+	testutil.FatalIfErr(t, err)
+	var prom []string
+	for _, mf := range mfs {
+		prom = append(prom, mf.GetName())
+	}
+	rec := httptest.NewRecorder()
+	m.e.HandleJSON(rec, httptest.NewRequest("GET", "/json", nil))
+	jsonBody := rec.Body.String()
+	rec = httptest.NewRecorder()
+	m.e.HandleVarz(rec, httptest.NewRequest("GET", "/varz", nil))
+	varzBody := rec.Body.String()
+
+	for endpoint, body := range map[string]string{
+		"/metrics": strings.Join(prom, "\n"),
+		"/json":    jsonBody,
+		"/varz":    varzBody,
+	} {
+		if !strings.Contains(body, "kbytes_in") {
+			t.Errorf("%s: derived metric kbytes_in missing:\n%s", endpoint, body)
+		}
+		if strings.Contains(strings.Replace(body, "kbytes_in", "", -1), "bytes_in") {
+			t.Errorf("%s: hidden metric bytes_in exported:\n%s", endpoint, body)
+		}
+		if strings.Contains(body, "scratch_lines") {
+			t.Errorf("%s: denied metric scratch_lines exported:\n%s", endpoint, body)
+		}
+	}
+}
+
+func TestMetricAlias(t *testing.T) {
+	m := startMtailServer(t, OmitProgLabel)
+	defer m.Close()
+
+	prog := `counter http_requests_total by code alias "requests_total"
+
+/code=(\d+)/ {
+  http_requests_total[$1]++
+}
+`
+	testutil.FatalIfErr(t, m.l.CompileAndRun("alias", strings.NewReader(prog)))
+	for _, line := range []string{"code=200", "code=200", "code=500"} {
+		m.l.ProcessLogLine(context.Background(), logline.New(context.Background(), "log", line))
+	}
+
+	mfs, err := m.reg.Gather()
+	testutil.FatalIfErr(t, err)
+	values := make(map[string]map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != "http_requests_total" && mf.GetName() != "requests_total" {
+			continue
+		}
+		values[mf.GetName()] = make(map[string]float64)
+		for _, metric := range mf.GetMetric() {
+			values[mf.GetName()][metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	expected := map[string]float64{"200": 2, "500": 1}
+	for _, name := range []string{"http_requests_total", "requests_total"} {
+		if diff := testutil.Diff(expected, values[name]); diff != "" {
+			t.Errorf("%s values diff:\n%s", name, diff)
+		}
+	}
+}
+
+func TestBackdatedMetricTimestamp(t *testing.T) {
+	m := startMtailServer(t, OmitProgLabel, EmitMetricTimestamp)
+	defer m.Close()
+
+	prog := `counter requests_total
+
+/^(\S+) request/ {
+  strptime($1, "2006-01-02T15:04:05Z07:00")
+  requests_total++
+}
+`
+	testutil.FatalIfErr(t, m.l.CompileAndRun("backdate", strings.NewReader(prog)))
+	m.l.ProcessLogLine(context.Background(), logline.New(context.Background(), "log", "2019-03-04T05:06:07Z request"))
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	expected := "requests_total 1 1551675967000\n"
+	if !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("expected %q in exposition:\n%s", expected, rec.Body.String())
+	}
+}
+
+func TestMetricTimestampSource(t *testing.T) {
+	m := startMtailServer(t, OmitProgLabel, EmitMetricTimestamp)
+	defer m.Close()
+
+	prog := `default_timestamp_source scrape
+counter requests_total timestamp_source log
+gauge queue_length
+
+/^(\S+) request queue=(\d+)/ {
+  strptime($1, "2006-01-02T15:04:05Z07:00")
+  requests_total++
+  queue_length = $2
+}
+`
+	testutil.FatalIfErr(t, m.l.CompileAndRun("source", strings.NewReader(prog)))
+	m.l.ProcessLogLine(context.Background(), logline.New(context.Background(), "log", "2019-03-04T05:06:07Z request queue=3"))
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	// The counter is timestamped with the log time, and the gauge with the
+	// scrape time, which is left to Prometheus.
+	for _, expected := range []string{"requests_total 1 1551675967000\n", "queue_length 3\n"} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("expected %q in exposition:\n%s", expected, rec.Body.String())
+		}
+	}
+}
+
+// makeLargeStore returns a store with n metrics of 10 label values each.
+func makeLargeStore(tb testing.TB, n int) *metrics.Store {
+	tb.Helper()
+	store := metrics.NewStore()
+	for i := 0; i < n; i++ {
+		m := metrics.NewMetric(fmt.Sprintf("metric_%d", i), "prog", metrics.Counter, metrics.Int, "key")
+		for j := 0; j < 10; j++ {
+			d, err := m.GetDatum(strconv.Itoa(j))
+			testutil.FatalIfErr(tb, err)
+			datum.SetInt(d, int64(i*j), time.Unix(0, 0))
+		}
+		testutil.FatalIfErr(tb, store.Add(m))
+	}
+	return store
+}
+
+func TestWriteMetrics(t *testing.T) {
+	for _, n := range []int{0, 1, 3} {
+		store := makeLargeStore(t, n)
+		testutil.FatalIfErr(t, store.Add(metrics.NewMetric("metric_0", "other", metrics.Counter, metrics.Int)))
+		m := &Server{store: store}
+		var b strings.Builder
+		testutil.FatalIfErr(t, m.WriteMetrics(&b))
+		expected, err := json.MarshalIndent(store.Metrics, "", "  ")
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(string(expected), b.String()); diff != "" {
+			t.Errorf("%d metrics: WriteMetrics diff:\n%s", n, diff)
+		}
+	}
+}
+
+func BenchmarkWriteMetrics(b *testing.B) {
+	m := &Server{store: makeLargeStore(b, 10000)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.WriteMetrics(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -4,14 +4,25 @@
 package mtail
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/jaeger"
+	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/vm"
+	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
-// ProgramPath sets the path to find mtail programs in the Server.
+// ProgramPath sets the path to find mtail programs in the Server.  The path
+// may be a comma separated list of directories.
 func ProgramPath(path string) func(*Server) error {
 	return func(m *Server) error {
 		m.programPath = path
@@ -27,6 +38,132 @@ func LogPathPatterns(patterns ...string) func(*Server) error {
 	}
 }
 
+// Journal sets the Server to read the systemd journal entries of the given
+// units, or of all units if there are none, by running the journalctl
+// command.
+func Journal(journalctl string, units ...string) func(*Server) error {
+	return func(m *Server) error {
+		if journalctl == "" {
+			return errors.New("journalctl command must be set to read the journal")
+		}
+		m.journalctl = journalctl
+		m.journalUnits = units
+		return nil
+	}
+}
+
+// SyslogTLS sets the Server to receive syslog messages over TLS on address,
+// as sent by RFC 5425 transports, presenting the certificate and key in the
+// PEM files certFile and keyFile.  If caFile is set, clients must present a
+// certificate signed by one of the CA certificates in it.
+func SyslogTLS(address, certFile, keyFile, caFile string) func(*Server) error {
+	return func(m *Server) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to load the syslog TLS certificate")
+		}
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return errors.Wrap(err, "failed to read the syslog TLS CA certificates")
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.Errorf("no CA certificates found in %q", caFile)
+			}
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		m.syslogAddress = address
+		m.syslogTLSConfig = config
+		return nil
+	}
+}
+
+// tlsVersions maps the names accepted by TLSMinVersion to TLS versions.
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// TLSMinVersion sets the oldest TLS version that the Server's TLS listeners
+// accept, one of "tls10", "tls11", "tls12" or "tls13".  The default is TLS
+// 1.2.
+func TLSMinVersion(version string) func(*Server) error {
+	return func(m *Server) error {
+		v, ok := tlsVersions[version]
+		if !ok {
+			return errors.Errorf("unknown TLS version %q, expecting one of tls10, tls11, tls12 or tls13", version)
+		}
+		m.tlsMinVersion = v
+		return nil
+	}
+}
+
+// TLSCipherSuites sets the cipher suites that the Server's TLS listeners
+// accept for TLS 1.2 and earlier, by name, like
+// TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384.  The cipher suites of TLS 1.3 can't
+// be configured.
+func TLSCipherSuites(names ...string) func(*Server) error {
+	return func(m *Server) error {
+		suites := make(map[string]*tls.CipherSuite)
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[s.Name] = s
+		}
+		m.tlsCipherSuites = nil
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			s, ok := suites[name]
+			if !ok {
+				return errors.Errorf("unknown TLS cipher suite %q", name)
+			}
+			if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+				return errors.Errorf("TLS cipher suite %q is only used by TLS 1.3, whose cipher suites can't be configured", name)
+			}
+			m.tlsCipherSuites = append(m.tlsCipherSuites, s.ID)
+		}
+		return nil
+	}
+}
+
+// RecordDelimiter sets the byte that ends each record read from the logs,
+// instead of a newline.  It's given as a single character, or a Go escape
+// sequence like `\x00` for binary delimiters.
+func RecordDelimiter(delim string) func(*Server) error {
+	return func(m *Server) error {
+		s, err := strconv.Unquote(`"` + delim + `"`)
+		if err != nil || len(s) != 1 {
+			return errors.Errorf("invalid record delimiter %q: must be a single byte", delim)
+		}
+		m.recordDelimiter = s[0]
+		return nil
+	}
+}
+
+// LogPathRegexps sets the directory and filename regular expressions to find log paths in the Server.
+func LogPathRegexps(patterns ...string) func(*Server) error {
+	return func(m *Server) error {
+		m.logPathRegexps = patterns
+		return nil
+	}
+}
+
+// LogCommands sets the commands whose standard output is tailed as logs.
+func LogCommands(commands ...string) func(*Server) error {
+	return func(m *Server) error {
+		m.logCommands = commands
+		return nil
+	}
+}
+
 // IgnoreRegexPattern sets the regex pattern to ignore files.
 func IgnoreRegexPattern(pattern string) func(*Server) error {
 	return func(m *Server) error {
@@ -35,6 +172,47 @@ func IgnoreRegexPattern(pattern string) func(*Server) error {
 	}
 }
 
+// IgnoreFilesOlderThan sets the age of the last modification of log files
+// beyond which they aren't tailed when expanding log path patterns.
+func IgnoreFilesOlderThan(age time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		m.ignoreFilesOlderThan = age
+		return nil
+	}
+}
+
+// LogFileBlacklist sets a regular expression matching the absolute paths of
+// log files that aren't tailed when expanding log path patterns.
+func LogFileBlacklist(pattern string) func(*Server) error {
+	return func(m *Server) error {
+		if pattern == "" {
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrap(err, "invalid log file blacklist")
+		}
+		m.logFileBlacklist = re
+		return nil
+	}
+}
+
+// LogFileWhitelist sets a regular expression that the absolute paths of log
+// files must match to be tailed when expanding log path patterns.
+func LogFileWhitelist(pattern string) func(*Server) error {
+	return func(m *Server) error {
+		if pattern == "" {
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrap(err, "invalid log file whitelist")
+		}
+		m.logFileWhitelist = re
+		return nil
+	}
+}
+
 // BindAddress sets the HTTP server address in Server.
 func BindAddress(address, port string) func(*Server) error {
 	return func(m *Server) error {
@@ -45,6 +223,137 @@ func BindAddress(address, port string) func(*Server) error {
 	}
 }
 
+// PprofPort sets the Server to serve the profiling endpoints of
+// net/http/pprof under /debug/pprof on port, listening only on localhost.
+// They aren't served on the main HTTP listener.
+func PprofPort(port string) func(*Server) error {
+	return func(m *Server) error {
+		var err error
+		m.pprofListener, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		return errors.Wrap(err, "failed to listen for pprof")
+	}
+}
+
+// BindInterface sets the Server to listen on the first non-loopback unicast
+// IP address of the network interface named iface, on port.  IPv4 addresses
+// are preferred, or IPv6 addresses if ipv6 is set; an address of the other
+// family is used if the interface has none of the preferred one.
+func BindInterface(iface, port string, ipv6 bool) func(*Server) error {
+	return func(m *Server) error {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find interface %q", iface)
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return errors.Wrapf(err, "failed to list addresses of interface %q", iface)
+		}
+		ip, err := interfaceIP(addrs, ipv6)
+		if err != nil {
+			return errors.Wrapf(err, "interface %q", iface)
+		}
+		return BindAddress(ip.String(), port)(m)
+	}
+}
+
+// interfaceIP returns the first non-loopback unicast IP address in addrs,
+// preferring IPv6 addresses if ipv6 is set, or IPv4 otherwise.  Link-local
+// addresses are skipped, as they can't be listened on without a zone.
+func interfaceIP(addrs []net.Addr, ipv6 bool) (net.IP, error) {
+	var other net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := n.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if (ip.To4() == nil) == ipv6 {
+			return ip, nil
+		}
+		if other == nil {
+			other = ip
+		}
+	}
+	if other == nil {
+		return nil, errors.New("no non-loopback unicast address")
+	}
+	return other, nil
+}
+
+// HTTPTimeouts sets the HTTP server's timeouts for reading a request, writing
+// a response, and waiting for the next request on a keep-alive connection.
+// Zero means no timeout.
+func HTTPTimeouts(read, write, idle time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if read < 0 || write < 0 || idle < 0 {
+			return errors.Errorf("HTTP timeouts must not be negative: read %s, write %s, idle %s", read, write, idle)
+		}
+		m.h.ReadTimeout = read
+		m.h.WriteTimeout = write
+		m.h.IdleTimeout = idle
+		return nil
+	}
+}
+
+// HTTPMaxHeaderBytes sets the maximum size of the HTTP request headers the
+// server reads.  Zero means the net/http default of 1MB.
+func HTTPMaxHeaderBytes(n int) func(*Server) error {
+	return func(m *Server) error {
+		if n < 0 {
+			return errors.Errorf("HTTP max header bytes must not be negative: %d", n)
+		}
+		m.h.MaxHeaderBytes = n
+		return nil
+	}
+}
+
+// MetricsPath sets the URL path that the Prometheus metrics are served at.
+func MetricsPath(path string) func(*Server) error {
+	return func(m *Server) error {
+		if err := checkHandlerPath(path); err != nil {
+			return err
+		}
+		m.metricsPath = path
+		return nil
+	}
+}
+
+// JSONPath sets the URL path that the JSON metrics are served at.
+func JSONPath(path string) func(*Server) error {
+	return func(m *Server) error {
+		if err := checkHandlerPath(path); err != nil {
+			return err
+		}
+		m.jsonPath = path
+		return nil
+	}
+}
+
+// HTTPPrefix sets a URL path prefix that all the HTTP endpoints are served
+// under, for running behind a reverse proxy that routes requests by path.
+func HTTPPrefix(prefix string) func(*Server) error {
+	return func(m *Server) error {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return errors.Errorf("invalid HTTP prefix %q: must start with /", prefix)
+		}
+		m.httpPrefix = prefix
+		return nil
+	}
+}
+
+// checkHandlerPath returns an error if path can't be used for a metrics
+// handler.  The root path is the status page.
+func checkHandlerPath(path string) error {
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		return errors.Errorf("invalid handler path %q: must start with / and not be the root", path)
+	}
+	return nil
+}
+
 // SetBuildInfo sets the mtail program build information in the Server.
 func SetBuildInfo(info BuildInfo) func(*Server) error {
 	return func(m *Server) error {
@@ -69,6 +378,18 @@ func ExpiredMetricGcTickInterval(interval time.Duration) func(*Server) error {
 	}
 }
 
+// MaxMetricSeries limits the number of series in the metrics store, evicting
+// the least recently updated as new series are added.
+func MaxMetricSeries(max int) func(*Server) error {
+	return func(m *Server) error {
+		if max < 0 {
+			return errors.Errorf("invalid maximum number of metric series %d", max)
+		}
+		m.store.SetMaxSeries(max)
+		return nil
+	}
+}
+
 // StaleLogGcTickInterval sets the interval to run ticker to remove stale log handles.
 func StaleLogGcTickInterval(interval time.Duration) func(*Server) error {
 	return func(m *Server) error {
@@ -77,12 +398,233 @@ func StaleLogGcTickInterval(interval time.Duration) func(*Server) error {
 	}
 }
 
+// LogWatchdogTimeout sets the time after which a log file that has had no
+// reads while still growing is reopened.  Zero disables the watchdog.
+func LogWatchdogTimeout(timeout time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		m.logWatchdogTimeout = timeout
+		return nil
+	}
+}
+
+// StaleFileThreshold sets the time after which a log file that has had no
+// reads is closed, until it is modified or created again.  Zero disables
+// closing stale files.
+func StaleFileThreshold(threshold time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if threshold < 0 {
+			return errors.Errorf("invalid stale file threshold %s", threshold)
+		}
+		m.staleFileThreshold = threshold
+		return nil
+	}
+}
+
+// IdleFileTimeout sets the time after which the file descriptor of a log file
+// that has had no reads is closed, until it is modified again.  The file is
+// still watched.  Zero disables closing idle files.
+func IdleFileTimeout(timeout time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if timeout < 0 {
+			return errors.Errorf("invalid idle file timeout %s", timeout)
+		}
+		m.idleFileTimeout = timeout
+		return nil
+	}
+}
+
+// LogRotationCheckInterval sets the interval between checks of each log file
+// for rotation or truncation.  Zero disables the checks, leaving rotations to
+// be noticed from the watcher's events alone.
+func LogRotationCheckInterval(interval time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		m.logRotationCheckInterval = interval
+		return nil
+	}
+}
+
+// DedupWindow sets the window within which each program ignores a log line
+// identical to one it has already processed from the same log.  Zero disables
+// deduplication.  Each program remembers at most maxLines lines; zero means no
+// limit.
+func DedupWindow(window time.Duration, maxLines int) func(*Server) error {
+	return func(m *Server) error {
+		if window < 0 {
+			return errors.Errorf("dedup window must not be negative: %s", window)
+		}
+		if maxLines < 0 {
+			return errors.Errorf("dedup max lines must not be negative: %d", maxLines)
+		}
+		m.dedupWindow = window
+		m.dedupMaxLines = maxLines
+		return nil
+	}
+}
+
+// LineWorkers sets the number of copies of each program that process lines
+// in parallel.  Lines may then be processed out of order.  One processes
+// lines one at a time, in order.
+func LineWorkers(n int) func(*Server) error {
+	return func(m *Server) error {
+		if n < 1 {
+			return errors.Errorf("line workers must be at least 1: %d", n)
+		}
+		m.lineWorkers = n
+		return nil
+	}
+}
+
+// LineQueue sets the number of lines that can wait for a line worker, or one
+// per line worker if size is zero, and what's done with a line that arrives
+// when they're all waiting: "block" waits for room, while "drop-oldest" and
+// "drop-newest" drop a line and count it.  Without a line queue, a single line
+// worker processes each line as it's read.
+func LineQueue(size int, policy string) func(*Server) error {
+	return func(m *Server) error {
+		if size < 0 {
+			return errors.Errorf("line queue size must not be negative: %d", size)
+		}
+		switch policy {
+		case vm.QueueBlock, vm.QueueDropOldest, vm.QueueDropNewest:
+		default:
+			return errors.Errorf("unknown line queue policy %q, expecting %q, %q or %q", policy, vm.QueueBlock, vm.QueueDropOldest, vm.QueueDropNewest)
+		}
+		m.lineQueueSize = size
+		m.lineQueuePolicy = policy
+		return nil
+	}
+}
+
+// MaxProgs limits the number of programs the Server loads.  Zero means no limit.
+func MaxProgs(n int) func(*Server) error {
+	return func(m *Server) error {
+		if n < 0 {
+			return errors.Errorf("max programs must not be negative: %d", n)
+		}
+		m.maxProgs = n
+		return nil
+	}
+}
+
+// GeoIPDatabase sets the path of the MaxMind DB file, such as a GeoLite2
+// database, that programs look addresses up in with geoip().
+func GeoIPDatabase(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.geoipDatabase = path
+		return nil
+	}
+}
+
+// HashSecretFile sets the path of the file holding the secret that programs
+// key the hashes they compute with hash() with.
+func HashSecretFile(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.hashSecretFile = path
+		return nil
+	}
+}
+
+// APIKeyFile reads the key that requests to the management endpoints, like
+// /quitquitquit, must present from the file at path.  A trailing newline is
+// not part of the key.
+func APIKeyFile(path string) func(*Server) error {
+	return func(m *Server) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "reading API key")
+		}
+		key := strings.TrimRight(string(b), "\r\n")
+		if key == "" {
+			return errors.Errorf("API key file %q is empty", path)
+		}
+		m.apiKey = []byte(key)
+		return nil
+	}
+}
+
+// HLLPrecision sets the precision of the sketches of hll metrics, 14 or 16.
+// The higher precision estimates more accurately, in more memory.
+func HLLPrecision(precision int) func(*Server) error {
+	return func(m *Server) error {
+		m.hllPrecision = precision
+		return nil
+	}
+}
+
+// KnownEnvVars sets the names of the environment variables that programs are
+// expected to read with getenv().  Programs reading any other variable are
+// warned about when they are loaded.
+func KnownEnvVars(names ...string) func(*Server) error {
+	return func(m *Server) error {
+		m.knownEnvVars = names
+		return nil
+	}
+}
+
+// UnparseableLog sets the Server to write lines that aren't matched by any
+// program to the file at path, rotating it when it grows past maxSizeMB
+// megabytes.
+func UnparseableLog(path string, maxSizeMB int) func(*Server) error {
+	return func(m *Server) error {
+		if path == "" {
+			return errors.New("unparseable log needs a path")
+		}
+		if maxSizeMB < 0 {
+			return errors.Errorf("unparseable log max size must not be negative: %d", maxSizeMB)
+		}
+		m.unparseableLogPath = path
+		m.unparseableLogMaxSize = int64(maxSizeMB) << 20
+		return nil
+	}
+}
+
+// DisableProgramWatch sets the Server to load programs once at startup, and
+// not to reload them when the program files change.
+func DisableProgramWatch(m *Server) error {
+	m.disableProgramWatch = true
+	return nil
+}
+
 // OneShot sets one-shot mode in the Server.
 func OneShot(m *Server) error {
 	m.oneShot = true
 	return nil
 }
 
+// NoFollow sets the Server to read the logs to their end and exit, instead of
+// following them.
+func NoFollow(m *Server) error {
+	m.noFollow = true
+	return nil
+}
+
+// StripControl sets the Server to strip ANSI escape sequences, such as colours,
+// and other control characters from log lines before programs see them.
+func StripControl(m *Server) error {
+	m.stripControl = true
+	return nil
+}
+
+// FlushOnExit sets the Server to push the metrics to any collectors one last
+// time when it is closed.
+func FlushOnExit(m *Server) error {
+	m.flushOnExit = true
+	return nil
+}
+
+// GracefulShutdownTimeout sets the time that Close waits for the shutdown of
+// the tailer, programs, exporter and HTTP server to complete before giving
+// up with an error.  Zero waits for as long as they take.
+func GracefulShutdownTimeout(timeout time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if timeout < 0 {
+			return errors.Errorf("graceful shutdown timeout must not be negative: %s", timeout)
+		}
+		m.gracefulShutdownTimeout = timeout
+		return nil
+	}
+}
+
 // CompileOnly sets compile-only mode in the Server.
 func CompileOnly(m *Server) error {
 	m.compileOnly = true
@@ -131,6 +673,209 @@ func EmitMetricTimestamp(m *Server) error {
 	return nil
 }
 
+// EmitStaleMarkers tells the Server to export series removed from the store,
+// by expiry, eviction, or the unloading of their program, once more with the
+// Prometheus staleness marker as their value, to scrapes in the protobuf
+// format.
+func EmitStaleMarkers(m *Server) error {
+	m.emitStaleMarkers = true
+	return nil
+}
+
+// EmitInitialValues tells the Server to export metrics without keys with their
+// initial values as soon as programs are loaded.
+func EmitInitialValues(m *Server) error {
+	m.emitInitialValues = true
+	return nil
+}
+
+// ExportLabelRenames instructs the Server to rename label keys of metrics on
+// export.  Each rename is of the form `metric:from=to`, and renames the label
+// key from to to on the metric named metric.
+func ExportLabelRenames(renames ...string) func(*Server) error {
+	return func(m *Server) error {
+		for _, r := range renames {
+			parts := strings.SplitN(r, ":", 2)
+			if len(parts) != 2 {
+				return errors.Errorf("label rename %q is not of the form metric:from=to", r)
+			}
+			keys := strings.SplitN(parts[1], "=", 2)
+			if len(keys) != 2 {
+				return errors.Errorf("label rename %q is not of the form metric:from=to", r)
+			}
+			m.exportOptions = append(m.exportOptions, exporter.RenameLabel(parts[0], keys[0], keys[1]))
+		}
+		return nil
+	}
+}
+
+// ExportRelabelRules instructs the Server to rewrite the labels of exported
+// metrics, and drop series, with the relabel rules in the YAML file at path.
+// An empty path applies no rules.
+func ExportRelabelRules(path string) func(*Server) error {
+	return func(m *Server) error {
+		if path != "" {
+			m.exportOptions = append(m.exportOptions, exporter.RelabelRules(path))
+		}
+		return nil
+	}
+}
+
+// ExportAllowMetrics instructs the Server to export only the metrics whose
+// names match the regular expression pattern.  An empty pattern allows all
+// metrics.
+func ExportAllowMetrics(pattern string) func(*Server) error {
+	return func(m *Server) error {
+		if pattern != "" {
+			m.exportOptions = append(m.exportOptions, exporter.AllowMetrics(pattern))
+		}
+		return nil
+	}
+}
+
+// ExportDenyMetrics instructs the Server not to export the metrics whose
+// names match the regular expression pattern.  An empty pattern denies no
+// metrics.
+func ExportDenyMetrics(pattern string) func(*Server) error {
+	return func(m *Server) error {
+		if pattern != "" {
+			m.exportOptions = append(m.exportOptions, exporter.DenyMetrics(pattern))
+		}
+		return nil
+	}
+}
+
+// ExportHostname sets the hostname that metrics are exported as, in the
+// instance label and to collectd.  An empty hostname means the system's.
+func ExportHostname(hostname string) func(*Server) error {
+	return func(m *Server) error {
+		if hostname != "" {
+			m.hostname = hostname
+			m.exportOptions = append(m.exportOptions, exporter.Hostname(hostname))
+		}
+		return nil
+	}
+}
+
+// ExportDeltaCounters instructs the Server to push counters to collectors as
+// the change in their value since the last push.  Prometheus is always served
+// the cumulative values.
+func ExportDeltaCounters(m *Server) error {
+	m.exportOptions = append(m.exportOptions, exporter.DeltaCounters)
+	return nil
+}
+
+// ExportCounterRates instructs the Server to push a gauge with the rate per
+// second of each counter whose name matches the regular expression pattern,
+// named with a "_rate" suffix.  An empty pattern pushes no rates.
+func ExportCounterRates(pattern string) func(*Server) error {
+	return func(m *Server) error {
+		if pattern != "" {
+			m.exportOptions = append(m.exportOptions, exporter.RateCounters(pattern))
+		}
+		return nil
+	}
+}
+
+// ExportInstanceLabel instructs the Server to add a label with the given key
+// and the hostname as its value to every exported metric.  An empty key adds
+// no label.
+func ExportInstanceLabel(key string) func(*Server) error {
+	return func(m *Server) error {
+		if key != "" {
+			m.exportOptions = append(m.exportOptions, exporter.InstanceLabel(key))
+		}
+		return nil
+	}
+}
+
+// SanitizeLabels instructs the Server to clean up the labels of metrics on
+// export, escaping null bytes and truncating label values to maxValueLength
+// characters, and replacing invalid characters in label keys with
+// replaceChar.
+func SanitizeLabels(maxValueLength int, replaceChar string) func(*Server) error {
+	return func(m *Server) error {
+		m.exportOptions = append(m.exportOptions, exporter.SanitizeLabels(maxValueLength, replaceChar))
+		return nil
+	}
+}
+
+// InternalMetricsPrefix sets the prefix of the names of mtail's own metrics
+// exported to Prometheus, such as `mtail_lines_total`.
+func InternalMetricsPrefix(prefix string) func(*Server) error {
+	return func(m *Server) error {
+		if prefix == "" {
+			return errors.New("internal metrics prefix must not be empty")
+		}
+		m.internalMetricsPrefix = prefix
+		return nil
+	}
+}
+
+// ServiceDiscoveryFile sets the Server to write a Prometheus file-based
+// service discovery file to path, with this instance as its target, and to
+// rewrite it every refreshInterval.
+func ServiceDiscoveryFile(path string, refreshInterval time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if path == "" {
+			return errors.New("service discovery file needs a path")
+		}
+		if refreshInterval <= 0 {
+			return errors.Errorf("service discovery refresh interval must be positive: %s", refreshInterval)
+		}
+		m.sdOutputFile = path
+		m.sdRefreshInterval = refreshInterval
+		return nil
+	}
+}
+
+// StaticLabels sets the labels, each of the form key=value, of this instance's
+// target in the service discovery file.
+func StaticLabels(labels ...string) func(*Server) error {
+	return func(m *Server) error {
+		for _, l := range labels {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return errors.Errorf("static label %q is not of the form key=value", l)
+			}
+			if m.staticLabels == nil {
+				m.staticLabels = make(map[string]string)
+			}
+			m.staticLabels[kv[0]] = kv[1]
+		}
+		return nil
+	}
+}
+
+// ReloadConfigOnChange sets the Server to reload the config file at path,
+// which it was configured from with config, when it changes.  Changes to the
+// logs, static labels and push interval are applied; changes to other flags
+// are logged, and ignored until mtail is restarted.  Changes to the flags
+// named in commandline are ignored, as the commandline takes precedence.
+func ReloadConfigOnChange(path string, config []ConfigFlag, commandline ...string) func(*Server) error {
+	return func(m *Server) error {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find config file %q", path)
+		}
+		c := &configReloader{m: m, path: absPath, config: config, commandline: make(map[string]bool)}
+		for _, name := range commandline {
+			c.commandline[name] = true
+		}
+		m.configReloader = c
+		return nil
+	}
+}
+
+// SnapshotPath sets the path that metrics snapshots are written to when mtail
+// receives SIGUSR1.  If empty, snapshots are written to standard error.
+func SnapshotPath(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.snapshotPath = path
+		return nil
+	}
+}
+
 // JaegerReporter creates a new jaeger reporter that sends to the given Jaeger endpoint address.
 func JaegerReporter(jaegerEndpoint string) func(*Server) error {
 	return func(m *Server) error {
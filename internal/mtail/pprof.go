@@ -0,0 +1,164 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The profiling handlers are served from runtime/pprof directly rather than
+// net/http/pprof, as importing that registers them on http.DefaultServeMux,
+// which would expose them on any binary serving the default mux, like mdot.
+// They follow net/http/pprof, except that the seconds parameter of a named
+// profile like heap isn't supported: net/http/pprof serves the difference
+// between two profiles taken that far apart, which needs its internal
+// profile parser.
+
+// pprofHandler returns a handler for the profiling endpoints under /debug/pprof.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprofIndex)
+	mux.HandleFunc("/debug/pprof/cmdline", pprofCmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprofProfile)
+	mux.HandleFunc("/debug/pprof/symbol", pprofSymbol)
+	mux.HandleFunc("/debug/pprof/trace", pprofTrace)
+	return mux
+}
+
+// pprofSeconds returns the duration in the seconds parameter of r, or def if
+// it's not set.
+func pprofSeconds(r *http.Request, def int) time.Duration {
+	sec, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || sec <= 0 {
+		sec = def
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// pprofExceedsWriteTimeout reports whether a profile taken over d would be cut
+// off by the write timeout of the server serving r, and if so serves an error.
+func pprofExceedsWriteTimeout(w http.ResponseWriter, r *http.Request, d time.Duration) bool {
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok || srv.WriteTimeout == 0 || d < srv.WriteTimeout {
+		return false
+	}
+	http.Error(w, "profile duration exceeds server's WriteTimeout", http.StatusBadRequest)
+	return true
+}
+
+// pprofWait waits for d, or until the request is cancelled.
+func pprofWait(r *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+// pprofIndex serves the named profile, or a list of the profiles if none is named.
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/"); name != "" {
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("Unknown profile %q", name), http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if name == "heap" && r.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		if debug != 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		if err := p.WriteTo(w, debug); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<html><head><title>/debug/pprof/</title></head><body><p>Profiles:</p><table>")
+	for _, p := range pprof.Profiles() {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<tr><td>%d</td><td><a href=\"%s?debug=1\">%s</a></td></tr>\n", p.Count(), name, name)
+	}
+	fmt.Fprintln(w, "</table><p><a href=\"goroutine?debug=2\">full goroutine stack dump</a></p></body></html>")
+}
+
+// pprofCmdline serves the command line, with arguments separated by NUL bytes.
+func pprofCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// pprofProfile serves a CPU profile taken over the seconds parameter, 30 by default.
+func pprofProfile(w http.ResponseWriter, r *http.Request) {
+	d := pprofSeconds(r, 30)
+	if pprofExceedsWriteTimeout(w, r, d) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, fmt.Sprintf("Could not enable CPU profiling: %s", err), http.StatusInternalServerError)
+		return
+	}
+	pprofWait(r, d)
+	pprof.StopCPUProfile()
+}
+
+// pprofTrace serves an execution trace taken over the seconds parameter, 1 by default.
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	d := pprofSeconds(r, 1)
+	if pprofExceedsWriteTimeout(w, r, d) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, fmt.Sprintf("Could not enable tracing: %s", err), http.StatusInternalServerError)
+		return
+	}
+	pprofWait(r, d)
+	trace.Stop()
+}
+
+// pprofSymbol looks up the names of the program counters posted, or given as
+// the query, separated by '+', as the pprof tool expects.
+func pprofSymbol(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	b := []byte(r.URL.RawQuery)
+	if r.Method == http.MethodPost {
+		var err error
+		if b, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// As from net/http/pprof: the pprof tool only checks that the count is
+	// nonzero, to tell that symbols can be looked up.
+	fmt.Fprintln(w, "num_symbols: 1")
+	for _, word := range strings.Split(string(b), "+") {
+		pc, err := strconv.ParseUint(strings.TrimSpace(word), 0, 64)
+		if err != nil {
+			continue
+		}
+		if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+			fmt.Fprintf(w, "%#x %s\n", pc, f.Name())
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package programtest runs the tests embedded in mtail programs.
+//
+// A test is a block of comments in a program file, beginning with a "test:"
+// comment naming it, followed by "input:" comments with the log lines to
+// process and "expect:" comments with the metrics expected afterwards, in the
+// golden format used by the integration tests:
+//
+//	# test: counts requests by code
+//	# input: GET / 200
+//	# input: GET /missing 404
+//	# expect: counter requests_total 2
+//	# expect: counter responses_total {code=404} 1
+//
+// Each test is run against a fresh in-memory store, by reading its input to
+// the end as in one-shot mode.  Only the values of the expected metrics are
+// compared; other metrics and timestamps are ignored.
+package programtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/mtail/golden"
+	"github.com/google/mtail/internal/vm"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+)
+
+// Test is an example embedded in a program of the log lines it reads and
+// the metrics expected after it has processed them.
+type Test struct {
+	Name   string
+	Line   int      // Line of the program the test begins on.
+	Input  []string // Log lines to process.
+	Expect []string // Expected metrics, in the golden format.
+}
+
+// Comment prefixes of the parts of a test.
+const (
+	testPrefix   = "test:"
+	inputPrefix  = "input:"
+	expectPrefix = "expect:"
+)
+
+// Parse returns the tests embedded in the program text read from r.  A "test:"
+// comment without any expectations is taken to be an ordinary comment, and is
+// skipped with a warning.
+func Parse(r io.Reader) ([]*Test, error) {
+	var (
+		tests []*Test
+		t     *Test
+	)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			t = nil
+			continue
+		}
+		line = strings.TrimLeft(strings.TrimPrefix(line, "#"), " \t")
+		switch {
+		case strings.HasPrefix(line, testPrefix):
+			t = &Test{Name: strings.TrimSpace(strings.TrimPrefix(line, testPrefix)), Line: n}
+			tests = append(tests, t)
+		case strings.HasPrefix(line, inputPrefix):
+			if t == nil {
+				return nil, errors.Errorf("%d: input outside of a test", n)
+			}
+			t.Input = append(t.Input, strings.TrimPrefix(strings.TrimPrefix(line, inputPrefix), " "))
+		case strings.HasPrefix(line, expectPrefix):
+			if t == nil {
+				return nil, errors.Errorf("%d: expectation outside of a test", n)
+			}
+			t.Expect = append(t.Expect, strings.TrimSpace(strings.TrimPrefix(line, expectPrefix)))
+		default:
+			t = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	valid := tests[:0]
+	for _, t := range tests {
+		if len(t.Expect) == 0 {
+			glog.Warningf("%d: skipping test %q, as it has no expectations", t.Line, t.Name)
+			continue
+		}
+		valid = append(valid, t)
+	}
+	return valid, nil
+}
+
+// Run runs the tests of the programs in programPath, a program file or
+// directory, or a comma separated list of them, writing a report of each
+// test to w.  It returns the number of tests that failed.
+func Run(programPath string, w io.Writer) (failed int, err error) {
+	for _, path := range strings.Split(programPath, ",") {
+		if path == "" {
+			continue
+		}
+		s, err := os.Stat(path)
+		if err != nil {
+			return failed, errors.Wrapf(err, "failed to stat %q", path)
+		}
+		files := []string{path}
+		if s.IsDir() {
+			fis, err := ioutil.ReadDir(path)
+			if err != nil {
+				return failed, errors.Wrapf(err, "failed to list programs in %q", path)
+			}
+			files = files[:0]
+			for _, fi := range fis {
+				if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || filepath.Ext(fi.Name()) != ".mtail" {
+					continue
+				}
+				files = append(files, filepath.Join(path, fi.Name()))
+			}
+		}
+		for _, file := range files {
+			n, err := RunFile(file, w)
+			failed += n
+			if err != nil {
+				return failed, err
+			}
+		}
+	}
+	return failed, nil
+}
+
+// RunFile runs the tests of the program file at path, writing a report of
+// each test to w.  It returns the number of tests that failed.
+func RunFile(path string, w io.Writer) (failed int, err error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	tests, err := Parse(strings.NewReader(string(text)))
+	if err != nil {
+		return 0, errors.Wrap(err, path)
+	}
+	for _, t := range tests {
+		diff, err := t.run(filepath.Base(path), string(text))
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(w, "--- FAIL: %s:%d: %s\n    %s\n", path, t.Line, t.Name, strings.Replace(err.Error(), "\n", "\n    ", -1))
+		case len(diff) > 0:
+			failed++
+			fmt.Fprintf(w, "--- FAIL: %s:%d: %s\n", path, t.Line, t.Name)
+			for _, l := range diff {
+				fmt.Fprintf(w, "    %s\n", l)
+			}
+		default:
+			fmt.Fprintf(w, "--- PASS: %s:%d: %s\n", path, t.Line, t.Name)
+		}
+	}
+	return failed, nil
+}
+
+// run runs the test against the program, returning the differences between
+// the expected and actual metrics, as lines of "-expected" and "+actual".
+func (t *Test) run(name, program string) ([]string, error) {
+	store := metrics.NewStore()
+	l, err := vm.NewLoader("", store, watcher.NewFakeWatcher(), vm.OverrideLocation(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if err := l.CompileAndRun(name, strings.NewReader(program)); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	for _, line := range t.Input {
+		l.ProcessLogLine(ctx, logline.New(ctx, "test", line))
+	}
+
+	expected := metrics.NewStore()
+	golden.ReadTestData(strings.NewReader(strings.Join(t.Expect, "\n")), name, expected)
+	var diff []string
+	for _, e := range sortedMetrics(expected) {
+		a := golden.FindMetricOrNil(store, e.Name)
+		for _, lv := range e.LabelValues {
+			if len(lv.Labels) != len(e.Keys) {
+				return nil, errors.Errorf("expectation of %s has labels without values", e.Name)
+			}
+			want := formatDatum(e, e.Keys, lv)
+			if a == nil {
+				diff = append(diff, "-"+want, "+"+e.Name+" not found")
+				continue
+			}
+			labels, err := reorder(e.Keys, lv.Labels, a.Keys)
+			if err != nil {
+				diff = append(diff, "-"+want, "+"+err.Error())
+				continue
+			}
+			alv := a.FindLabelValueOrNil(labels)
+			if alv == nil {
+				diff = append(diff, "-"+want, "+"+want[:strings.LastIndex(want, " ")]+" not found")
+				continue
+			}
+			if got := formatDatum(a, e.Keys, &metrics.LabelValue{Labels: lv.Labels, Value: alv.Value}); got != want {
+				diff = append(diff, "-"+want, "+"+got)
+			}
+		}
+	}
+	return diff, nil
+}
+
+// reorder returns the label values of a series with the given keys in the
+// order of the keys of another metric.
+func reorder(keys, values, order []string) ([]string, error) {
+	if len(keys) != len(order) {
+		return nil, errors.Errorf("labels %q, not %q", order, keys)
+	}
+	byKey := make(map[string]string, len(keys))
+	for i, k := range keys {
+		byKey[k] = values[i]
+	}
+	labels := make([]string, len(order))
+	for i, k := range order {
+		v, ok := byKey[k]
+		if !ok {
+			return nil, errors.Errorf("labels %q, not %q", order, keys)
+		}
+		labels[i] = v
+	}
+	return labels, nil
+}
+
+// formatDatum formats a series of m in the golden format, with its labels
+// in the order of keys.
+func formatDatum(m *metrics.Metric, keys []string, lv *metrics.LabelValue) string {
+	s := strings.ToLower(m.Kind.String()) + " " + m.Name
+	if len(keys) > 0 {
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			pairs[i] = k + "=" + lv.Labels[i]
+		}
+		s += " {" + strings.Join(pairs, ",") + "}"
+	}
+	return s + " " + lv.Value.ValueString()
+}
+
+// sortedMetrics returns the metrics of the store sorted by name.
+func sortedMetrics(store *metrics.Store) []*metrics.Metric {
+	var ms []*metrics.Metric
+	for _, ml := range store.Metrics {
+		ms = append(ms, ml...)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	return ms
+}
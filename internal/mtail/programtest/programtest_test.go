@@ -0,0 +1,80 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package programtest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestParse(t *testing.T) {
+	tests, err := Parse(strings.NewReader(`counter c
+# test: one
+#   input: a b
+# input:  c
+# expect: counter c 2
+
+# test: two
+# expect: counter c 0
+/x/ { c++ }
+
+# test: not a test, as it has no expectations
+# input: d
+`))
+	testutil.FatalIfErr(t, err)
+	expected := []*Test{
+		{"one", 2, []string{"a b", " c"}, []string{"counter c 2"}},
+		{"two", 7, nil, []string{"counter c 0"}},
+	}
+	if diff := testutil.Diff(expected, tests); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, program := range []string{
+		"# input: a\n",
+		"# test: interrupted\n# input: a\ncounter c\n# expect: counter c 1\n",
+	} {
+		if _, err := Parse(strings.NewReader(program)); err == nil {
+			t.Errorf("Parse(%q): expected error", program)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		failed   int
+		expected []string
+	}{
+		{"testdata/pass.mtail", 0, []string{
+			"--- PASS: testdata/pass.mtail:6: counts requests by code\n",
+			"--- PASS: testdata/pass.mtail:18: ignores other lines\n",
+		}},
+		{"testdata/fail.mtail", 1, []string{
+			"--- FAIL: testdata/fail.mtail:4: counts requests by code\n" +
+				"    -counter responses_total {code=200} 2\n" +
+				"    +counter responses_total {code=200} 1\n" +
+				"    -counter responses_total {code=500} 1\n" +
+				"    +counter responses_total {code=500} not found\n",
+		}},
+		{"testdata", 1, nil},
+	} {
+		var out bytes.Buffer
+		failed, err := Run(tc.path, &out)
+		testutil.FatalIfErr(t, err)
+		if failed != tc.failed {
+			t.Errorf("%s: expected %d failures, got %d:\n%s", tc.path, tc.failed, failed, out.String())
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(out.String(), e) {
+				t.Errorf("%s: expected output to contain %q, got:\n%s", tc.path, e, out.String())
+			}
+		}
+	}
+}
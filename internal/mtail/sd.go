@@ -0,0 +1,119 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// sdTargetGroup is a group of targets in the Prometheus file-based service
+// discovery format.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdTarget returns the host:port address that this instance is scraped at.
+func (m *Server) sdTarget() (string, error) {
+	if m.listener == nil {
+		return "", errors.New("no HTTP listener to advertise")
+	}
+	_, port, err := net.SplitHostPort(m.listener.Addr().String())
+	if err != nil {
+		return "", errors.Wrap(err, "getting listener port")
+	}
+	host := m.hostname
+	if host == "" {
+		host, err = fqdn()
+		if err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// fqdn returns the fully qualified domain name of this host, or its hostname
+// if that can't be looked up.
+func fqdn() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "getting hostname")
+	}
+	if strings.Contains(host, ".") {
+		return host, nil
+	}
+	if cname, err := net.LookupCNAME(host); err == nil && cname != "" {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+	return host, nil
+}
+
+// WriteServiceDiscovery writes a Prometheus file-based service discovery file
+// with this instance as its only target to the service discovery path.  The
+// file is replaced atomically, so Prometheus never reads a partial file.
+func (m *Server) WriteServiceDiscovery() error {
+	target, err := m.sdTarget()
+	if err != nil {
+		return err
+	}
+	m.sdMu.Lock()
+	b, err := json.MarshalIndent([]sdTargetGroup{{Targets: []string{target}, Labels: m.staticLabels}}, "", "  ")
+	m.sdMu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "marshalling service discovery targets")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(m.sdOutputFile), "."+filepath.Base(m.sdOutputFile))
+	if err != nil {
+		return errors.Wrap(err, "creating service discovery file")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing service discovery file")
+	}
+	// TempFile creates the file readable only by us.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing service discovery file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "writing service discovery file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), m.sdOutputFile), "replacing service discovery file")
+}
+
+// startServiceDiscovery writes the service discovery file, and rewrites it
+// each refresh interval until the Server is closed.
+func (m *Server) startServiceDiscovery() {
+	if m.sdOutputFile == "" {
+		return
+	}
+	write := func() {
+		if err := m.WriteServiceDiscovery(); err != nil {
+			glog.Warning(err)
+		}
+	}
+	write()
+	go func() {
+		ticker := time.NewTicker(m.sdRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write()
+			case <-m.closeQuit:
+				return
+			}
+		}
+	}()
+}
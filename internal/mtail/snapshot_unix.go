@@ -0,0 +1,16 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"syscall"
+)
+
+// snapshotSignals are the signals that cause a snapshot of the metrics store
+// to be written.
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
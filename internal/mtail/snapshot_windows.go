@@ -0,0 +1,10 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import "os"
+
+// snapshotSignals are the signals that cause a snapshot of the metrics store
+// to be written.  There is no SIGUSR1 on Windows.
+var snapshotSignals = []os.Signal{}
@@ -0,0 +1,228 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+var (
+	// commandRestarts counts the number of times each command was run again
+	// after it exited.
+	commandRestarts = expvar.NewMap("command_restarts_total")
+)
+
+const (
+	// maxCommandLineSize is the longest line that can be read from a command.
+	maxCommandLineSize = 1 << 20
+
+	// commandRestartDelay is the delay before a command that exited is run
+	// again.  It doubles each time the command exits soon after starting, up
+	// to maxCommandRestartDelay.
+	commandRestartDelay    = time.Second
+	maxCommandRestartDelay = time.Minute
+)
+
+// Command runs a command and reads the lines it writes to its standard
+// output as log lines, with the command line as their filename.  What it
+// writes to its standard error is written to mtail's log.  When following,
+// the command is run again whenever it exits, after a delay that grows while
+// it keeps exiting soon after starting.
+type Command struct {
+	name   string   // the command line, the filename of the lines read
+	path   string   // path of the command
+	args   []string // arguments to the command
+	follow bool     // if set, run the command again when it exits; else run it once
+	llp    logline.Processor
+
+	restartDelay time.Duration // initial delay before running the command again
+
+	mu     sync.Mutex // protects cmd and closed
+	cmd    *exec.Cmd
+	closed bool
+	quit   chan struct{} // closed when the Command is closed
+	done   chan struct{} // closed when the command won't be run again
+}
+
+// NewCommand returns a Command that runs the command line, which is split
+// into the command and its arguments at spaces.
+func NewCommand(command string, follow bool, llp logline.Processor) (*Command, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("no command to run")
+	}
+	return &Command{
+		name:         command,
+		path:         fields[0],
+		args:         fields[1:],
+		follow:       follow,
+		llp:          llp,
+		restartDelay: commandRestartDelay,
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// Start runs the command and reads its output until it exits, in the
+// background if following.
+func (c *Command) Start(ctx context.Context) error {
+	cmd, stdout, err := c.start()
+	if err != nil {
+		return err
+	}
+	glog.Infof("Reading the output of %s", c.name)
+	if !c.follow {
+		defer close(c.done)
+		c.read(ctx, cmd, stdout)
+		return nil
+	}
+	go c.loop(ctx, cmd, stdout)
+	return nil
+}
+
+// start runs the command, returning it and its standard output.
+func (c *Command) start() (*exec.Cmd, io.Reader, error) {
+	cmd := exec.Command(c.path, c.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Stderr = &stderrLog{name: c.name}
+	setProcessGroup(cmd)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, errors.Errorf("%s is closed", c.name)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to run %s", c.name)
+	}
+	c.cmd = cmd
+	return cmd, stdout, nil
+}
+
+// read reads the lines of stdout until the command exits.
+func (c *Command) read(ctx context.Context, cmd *exec.Cmd, stdout io.Reader) {
+	if err := readCommand(ctx, c.name, stdout, c.llp); err != nil {
+		logErrors.Add(c.name, 1)
+		glog.Infof("Error reading the output of %s: %s", c.name, err)
+		// The command can't write any more once nothing is reading.
+		if err := killCommand(cmd); err != nil {
+			glog.V(1).Info(err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		glog.Infof("%s exited: %s", c.name, err)
+	} else {
+		glog.Infof("%s exited", c.name)
+	}
+	cmd.Stderr.(*stderrLog).Flush()
+}
+
+// loop reads the output of cmd, and runs the command again each time it
+// exits until the Command is closed.
+func (c *Command) loop(ctx context.Context, cmd *exec.Cmd, stdout io.Reader) {
+	defer close(c.done)
+	delay := c.restartDelay
+	for {
+		if cmd != nil {
+			started := time.Now()
+			c.read(ctx, cmd, stdout)
+			if time.Since(started) > maxCommandRestartDelay {
+				delay = c.restartDelay
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.quit:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxCommandRestartDelay {
+			delay = maxCommandRestartDelay
+		}
+		var err error
+		if cmd, stdout, err = c.start(); err != nil {
+			logErrors.Add(c.name, 1)
+			glog.Info(err)
+			continue
+		}
+		commandRestarts.Add(c.name, 1)
+	}
+}
+
+// Close stops the command, and waits for the lines it wrote to be read.
+func (c *Command) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	if c.cmd != nil {
+		if err := killCommand(c.cmd); err != nil {
+			glog.V(1).Info(err)
+		}
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+// readCommand reads lines from r and sends each to llp, with the filename
+// name.
+func readCommand(ctx context.Context, name string, r io.Reader, llp logline.Processor) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxCommandLineSize)
+	for s.Scan() {
+		llp.ProcessLogLine(ctx, logline.New(ctx, name, strings.TrimSuffix(s.Text(), "\r")))
+		lineCount.Add(name, 1)
+	}
+	return s.Err()
+}
+
+// stderrLog writes the lines written to it to mtail's log, prefixed with the
+// name of the command that wrote them.
+type stderrLog struct {
+	name string
+	buf  []byte
+}
+
+func (l *stderrLog) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		glog.Infof("%s: %s", l.name, l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) > maxCommandLineSize {
+		l.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush writes the rest of a line that wasn't ended by a newline.
+func (l *stderrLog) Flush() {
+	if len(l.buf) > 0 {
+		glog.Infof("%s: %s", l.name, l.buf)
+	}
+	l.buf = nil
+}
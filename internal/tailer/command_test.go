@@ -0,0 +1,124 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestReadCommand(t *testing.T) {
+	llp := NewStubProcessor()
+	llp.Add(4)
+	testutil.FatalIfErr(t, readCommand(context.Background(), "cmd", strings.NewReader("a\r\nb\n\nc"), llp))
+	llp.Wait()
+	expected := []*logline.LogLine{
+		{nil, "cmd", "a", nil},
+		{nil, "cmd", "b", nil},
+		{nil, "cmd", "", nil},
+		{nil, "cmd", "c", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+// writeFakeCommand writes a script to dir that counts the times it has been
+// run, and writes two lines and a line to standard error and exits the first
+// two times, and writes nothing afterwards.
+func writeFakeCommand(t *testing.T, dir string) string {
+	t.Helper()
+	count := filepath.Join(dir, "count")
+	script := "#!/bin/sh\n" +
+		"n=$(cat " + count + " 2>/dev/null || echo 0)\n" +
+		"n=$((n+1))\n" +
+		"echo $n > " + count + "\n" +
+		"if [ $n -le 2 ]; then\n" +
+		"  echo \"run $n $1\"\n" +
+		"  echo \"error $n\" >&2\n" +
+		"  echo \"run $n $2\"\n" +
+		"fi\n"
+	command := filepath.Join(dir, "command")
+	testutil.FatalIfErr(t, ioutil.WriteFile(command, []byte(script), 0755))
+	return command
+}
+
+func TestTailCommand(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	testutil.FatalIfErr(t, ta.SetOption(OneShot))
+	command := writeFakeCommand(t, dir) + " first  second"
+
+	// In one-shot mode the command is run once.
+	llp.Add(2)
+	testutil.FatalIfErr(t, ta.TailCommand(command))
+	llp.Wait()
+	testutil.FatalIfErr(t, ta.Close())
+	testutil.FatalIfErr(t, w.Close())
+
+	expected := []*logline.LogLine{
+		{nil, command, "run 1 first", nil},
+		{nil, command, "run 1 second", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestCommandRestart(t *testing.T) {
+	dir, cleanup := testutil.TestTempDir(t)
+	defer cleanup()
+	command := writeFakeCommand(t, dir) + " first second"
+
+	llp := NewStubProcessor()
+	c, err := NewCommand(command, true, llp)
+	testutil.FatalIfErr(t, err)
+	c.restartDelay = 10 * time.Millisecond
+	restarts := commandRestartCount(command)
+
+	llp.Add(4)
+	testutil.FatalIfErr(t, c.Start(context.Background()))
+	llp.Wait()
+	testutil.FatalIfErr(t, c.Close())
+
+	expected := []*logline.LogLine{
+		{nil, command, "run 1 first", nil},
+		{nil, command, "run 1 second", nil},
+		{nil, command, "run 2 first", nil},
+		{nil, command, "run 2 second", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if got := commandRestartCount(command) - restarts; got < 1 {
+		t.Errorf("expected the command to be restarted, got %d restarts", got)
+	}
+}
+
+// commandRestartCount returns the number of times command has been restarted.
+func commandRestartCount(command string) int64 {
+	if v, ok := commandRestarts.Get(command).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestTailCommandNotFound(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+	for _, command := range []string{"", "  ", filepath.Join(dir, "nonexistent")} {
+		if err := ta.TailCommand(command); err == nil {
+			t.Errorf("TailCommand(%q): expected error", command)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package tailer
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup has cmd run in a process group of its own, so that the
+// processes it starts, like those of a shell pipeline, are killed with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killCommand kills the process group of the started cmd.
+func killCommand(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
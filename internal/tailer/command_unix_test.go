@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package tailer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestCommandCloseKillsChildren(t *testing.T) {
+	dir, cleanup := testutil.TestTempDir(t)
+	defer cleanup()
+	// The command starts a child that outlives it unless it's killed too,
+	// and writes its pid.
+	command := filepath.Join(dir, "command")
+	script := "#!/bin/sh\nsleep 600 &\necho $!\nwait\n"
+	testutil.FatalIfErr(t, ioutil.WriteFile(command, []byte(script), 0755))
+
+	llp := NewStubProcessor()
+	c, err := NewCommand(command, true, llp)
+	testutil.FatalIfErr(t, err)
+	llp.Add(1)
+	testutil.FatalIfErr(t, c.Start(context.Background()))
+	llp.Wait()
+	testutil.FatalIfErr(t, c.Close())
+
+	pid, err := strconv.Atoi(llp.result[0].Line)
+	testutil.FatalIfErr(t, err)
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid, 0) == nil; {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child %d of the command still running after Close", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
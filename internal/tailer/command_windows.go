@@ -0,0 +1,16 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "os/exec"
+
+// setProcessGroup does nothing, as there are no process groups to kill on
+// Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killCommand kills the process of the started cmd.  The processes it
+// started are left running.
+func killCommand(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
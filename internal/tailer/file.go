@@ -9,9 +9,10 @@ import (
 	"expvar"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
@@ -28,26 +29,37 @@ var (
 	logTruncs = expvar.NewMap("log_truncates_total")
 	// lineCount counts the numbre of lines read per log file
 	lineCount = expvar.NewMap("log_lines_total")
+	// logRecoveries counts the number of times the watchdog reopened a stuck log file
+	logRecoveries = expvar.NewMap("log_watchdog_recoveries_total")
+	// openFiles records the number of log files held open
+	openFiles = expvar.NewInt("tailer_open_files")
 )
 
 // File provides an abstraction over files and named pipes being tailed
 // by `mtail`.
 type File struct {
-	name     string    // Given name for the file (possibly relative, used for displau)
-	pathname string    // Full absolute path of the file used internally
-	lastRead time.Time // time of the last read received on this handle
-	regular  bool      // Remember if this is a regular file (or a pipe)
+	lastRead int64  // time in Unix nanoseconds of the last read received on this handle, accessed atomically
+	name     string // Given name for the file (possibly relative, used for displau)
+	pathname string // Full absolute path of the file used internally
+	regular  bool   // Remember if this is a regular file (or a pipe)
 	file     *os.File
 	partial  *bytes.Buffer
+	delim    byte              // byte that ends each record
 	llp      logline.Processor // processor to receive LogLines
+
+	idleFI     os.FileInfo // if file is nil, the file info of the file when closeIdle closed it
+	idleOffset int64       // if file is nil, the offset read up to when closeIdle closed it
+
+	mu sync.Mutex // serialises reads between watcher events and the periodic checks
 }
 
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
 // that mtail believes it's seen this pathname before, indicating we should
 // retry on error to open the file. `seekToStart` indicates that the file
 // should be tailed from offset 0, not EOF; the latter is true for rotated
-// files and for files opened when mtail is in oneshot mode.
-func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool) (*File, error) {
+// files and for files opened when mtail is in oneshot mode.  `delim` is the
+// byte that ends each record, usually a newline.
+func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool, delim byte) (*File, error) {
 	glog.V(2).Infof("file.New(%s, %v)", pathname, seekToStart)
 	f, err := open(absPath, false)
 	if err != nil {
@@ -57,6 +69,7 @@ func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool)
 	if err != nil {
 		// Stat failed, log error and return.
 		logErrors.Add(absPath, 1)
+		closeFile(f)
 		return nil, errors.Wrapf(err, "Failed to stat %q", absPath)
 	}
 	regular := false
@@ -68,15 +81,26 @@ func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool)
 			seekWhence = io.SeekCurrent
 		}
 		if _, err := f.Seek(0, seekWhence); err != nil {
+			closeFile(f)
 			return nil, errors.Wrapf(err, "Seek failed on %q", absPath)
 		}
 		// Named pipes are the same as far as we're concerned, but we can't seek them.
 		fallthrough
 	case m&os.ModeType == os.ModeNamedPipe:
 	default:
+		closeFile(f)
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, time.Now(), regular, f, bytes.NewBufferString(""), llp}, nil
+	return &File{
+		name:     pathname,
+		pathname: absPath,
+		lastRead: time.Now().UnixNano(),
+		regular:  regular,
+		file:     f,
+		partial:  bytes.NewBufferString(""),
+		delim:    delim,
+		llp:      llp,
+	}, nil
 }
 
 func open(pathname string, seenBefore bool) (*os.File, error) {
@@ -108,13 +132,30 @@ Retry:
 		return nil, err
 	}
 	glog.V(2).Infof("open succeeded %s", pathname)
+	openFiles.Add(1)
 	return f, nil
 }
 
+// closeFile closes a file opened by open.
+func closeFile(f *os.File) error {
+	openFiles.Add(-1)
+	return f.Close()
+}
+
 // Follow reads from the file until EOF.  It tracks log rotations (i.e new inode or device).
 func (f *File) Follow(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.Follow")
 	defer span.End()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.follow(ctx)
+}
+
+// follow implements Follow; f.mu is assumed to be held.
+func (f *File) follow(ctx context.Context) error {
+	if err := f.reacquire(ctx); err != nil {
+		return err
+	}
 	s1, err := f.file.Stat()
 	if err != nil {
 		glog.V(1).Infof("Stat failed on %q: %s", f.name, err)
@@ -127,6 +168,11 @@ func (f *File) Follow(ctx context.Context) error {
 	s2, err := os.Stat(f.pathname)
 	if err != nil {
 		glog.Infof("Stat failed on %q: %s", f.Pathname(), err)
+		if os.IsNotExist(err) {
+			// The file has been deleted.  Read what was written to it
+			// before then; it's reopened as a rotation if it's recreated.
+			return f.Read(ctx)
+		}
 		return nil
 	}
 	if !os.SameFile(s1, s2) {
@@ -157,12 +203,177 @@ func (f *File) doRotation(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := closeFile(f.file); err != nil {
+		glog.V(1).Info(err)
+	}
 	f.file = newFile
 	return nil
 }
 
-// Read blocks of 4096 bytes from the File, sending LogLines as newlines are
-// encountered.  If EOF is read, the partial line is stored to be concatenated
+// closeIdle closes the file handle, remembering where it was read up to, to
+// release its file descriptor while the file isn't being written to.  The
+// file is opened again by reacquire when it's next followed.
+func (f *File) closeIdle() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to stat %q", f.pathname)
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.pathname)
+	}
+	if err := closeFile(f.file); err != nil {
+		return err
+	}
+	f.file = nil
+	f.idleFI = fi
+	f.idleOffset = offset
+	glog.V(1).Infof("Closed idle file %s", f.pathname)
+	return nil
+}
+
+// reacquire opens a file closed by closeIdle again, at the offset it was read
+// up to if it's the same file and hasn't been truncated, or at the start of
+// the file that has replaced it, as after a rotation.  f.mu is assumed to be
+// held.
+func (f *File) reacquire(ctx context.Context) error {
+	if f.file != nil {
+		return nil
+	}
+	_, span := trace.StartSpan(ctx, "file.reacquire")
+	defer span.End()
+	newFile, err := open(f.pathname, true /*seenBefore*/)
+	if err != nil {
+		return err
+	}
+	fi, err := newFile.Stat()
+	if err != nil {
+		closeFile(newFile)
+		return errors.Wrapf(err, "Failed to stat %q", f.pathname)
+	}
+	if os.SameFile(f.idleFI, fi) && fi.Size() >= f.idleOffset {
+		if _, err := newFile.Seek(f.idleOffset, io.SeekStart); err != nil {
+			closeFile(newFile)
+			return errors.Wrapf(err, "Seek failed on %q", f.pathname)
+		}
+	} else if !os.SameFile(f.idleFI, fi) {
+		logRotations.Add(f.name, 1)
+	} else {
+		logTruncs.Add(f.name, 1)
+	}
+	glog.V(1).Infof("Reopened idle file %s", f.pathname)
+	f.file = newFile
+	f.idleFI = nil
+	return nil
+}
+
+// idleChanged returns true if the file closed by closeIdle has since been
+// written to, rotated or truncated.  f.mu is assumed to be held.
+func (f *File) idleChanged() (bool, error) {
+	fi, err := os.Stat(f.pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !os.SameFile(f.idleFI, fi) || fi.Size() != f.idleOffset, nil
+}
+
+// checkRotation follows the file if it has been rotated or truncated, i.e.
+// if the pathname now names a different file or is shorter than the read
+// offset of the handle.  Files that have been deleted are left alone until
+// they are recreated.
+func (f *File) checkRotation(ctx context.Context) error {
+	if !f.regular {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		changed, err := f.idleChanged()
+		if err != nil || !changed {
+			return err
+		}
+		return f.follow(ctx)
+	}
+	fi, err := os.Stat(f.pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cur, err := f.file.Stat()
+	if err == nil && os.SameFile(cur, fi) {
+		offset, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if fi.Size() >= offset {
+			return nil
+		}
+	}
+	return f.follow(ctx)
+}
+
+// stuck returns true if the file on disk has grown past the read offset of
+// the handle, i.e. there are bytes waiting that haven't been read.
+func (f *File) stuck() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return false, nil
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(f.pathname)
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() > offset, nil
+}
+
+// reopen closes the file handle and opens the file again at the same offset,
+// to recover a handle that has stopped delivering reads, then reads the
+// remaining content.
+func (f *File) reopen(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "file.reopen")
+	defer span.End()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return f.follow(ctx)
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	newFile, err := open(f.pathname, true /*seenBefore*/)
+	if err != nil {
+		return err
+	}
+	if _, err := newFile.Seek(offset, io.SeekStart); err != nil {
+		closeFile(newFile)
+		return errors.Wrapf(err, "Seek failed on %q", f.pathname)
+	}
+	if err := closeFile(f.file); err != nil {
+		glog.Info(err)
+	}
+	f.file = newFile
+	logRecoveries.Add(f.name, 1)
+	return f.Read(ctx)
+}
+
+// Read blocks of 4096 bytes from the File, sending LogLines as record
+// delimiters are encountered.  If EOF is read, the partial line is stored to be concatenated
 // to on the next call.  At EOF, checks for truncation and resets the file
 // offset if so.
 func (f *File) Read(ctx context.Context) error {
@@ -200,25 +411,22 @@ func (f *File) Read(ctx context.Context) error {
 			return io.EOF
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				f.partial.WriteRune(rune)
-			default:
-				f.sendLine(ctx)
+		for rest := b; len(rest) > 0; {
+			i := bytes.IndexByte(rest, f.delim)
+			if i < 0 {
+				f.partial.Write(rest)
+				break
 			}
+			f.partial.Write(rest[:i])
+			f.sendLine(ctx)
+			rest = rest[i+1:]
 		}
 
 		// Return on any error, including EOF.
 		if err != nil {
 			// Update the last read time if we were able to read anything.
 			if totalBytes > 0 {
-				f.lastRead = time.Now()
+				f.setLastReadTime(time.Now())
 			}
 			return err
 		}
@@ -229,7 +437,7 @@ func (f *File) Read(ctx context.Context) error {
 func (f *File) sendLine(ctx context.Context) {
 	ctx, span := trace.StartSpan(ctx, "file.sendLine")
 	defer span.End()
-	f.llp.ProcessLogLine(ctx, logline.New(ctx, f.name, f.partial.String()))
+	f.llp.ProcessLogLine(ctx, logline.New(ctx, f.name, validUTF8(f.partial.Bytes())))
 	lineCount.Add(f.name, 1)
 	glog.V(2).Info("Line sent")
 	// reset partial accumulator
@@ -272,20 +480,68 @@ func (f *File) checkForTruncate(ctx context.Context) (bool, error) {
 }
 
 func (f *File) Stat() (os.FileInfo, error) {
+	if f.file == nil {
+		return f.idleFI, nil
+	}
 	return f.file.Stat()
 }
 
+// resume seeks the file to offset, where it was read up to before it was
+// closed, if it is the same file as fi and hasn't been truncated since.
+func (f *File) resume(fi os.FileInfo, offset int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, cur) || cur.Size() < offset {
+		return nil
+	}
+	_, err = f.file.Seek(offset, io.SeekStart)
+	return errors.Wrapf(err, "Seek failed on %q", f.Pathname())
+}
+
+// position returns the file info of the open file and the offset read up to.
+func (f *File) position() (os.FileInfo, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return f.idleFI, f.idleOffset, nil
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed to stat %q", f.pathname)
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Seek failed on %q", f.pathname)
+	}
+	return fi, offset, nil
+}
+
 func (f *File) Close(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.Close")
 	defer span.End()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.partial.Len() > 0 {
 		f.sendLine(ctx)
 	}
-	return f.file.Close()
+	if f.file == nil {
+		return nil
+	}
+	return closeFile(f.file)
 }
 
 func (f *File) LastReadTime() time.Time {
-	return f.lastRead
+	return time.Unix(0, atomic.LoadInt64(&f.lastRead))
+}
+
+// setLastReadTime records t as the time of the last read, which is read
+// without holding the File's lock.
+func (f *File) setLastReadTime(t time.Time) {
+	atomic.StoreInt64(&f.lastRead, t.UnixNano())
 }
 
 func (f *File) Pathname() string {
@@ -26,7 +26,7 @@ func TestReadPartial(t *testing.T) {
 	llp := NewStubProcessor()
 
 	fd := testutil.TestOpenFile(t, logfile)
-	f, err := NewFile(logfile, logfile, llp, false)
+	f, err := NewFile(logfile, logfile, llp, false, '\n')
 	testutil.FatalIfErr(t, err)
 
 	err = f.Read(context.Background())
@@ -66,7 +66,7 @@ func TestReadPartial(t *testing.T) {
 	}
 	llp.Wait()
 	expected := []*logline.LogLine{
-		{context.TODO(), logfile, "ohi"},
+		{context.TODO(), logfile, "ohi", nil},
 	}
 	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 	if diff != "" {
@@ -74,6 +74,41 @@ func TestReadPartial(t *testing.T) {
 	}
 }
 
+func TestReadRecordDelimiter(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+
+	llp := NewStubProcessor()
+
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	f, err := NewFile(logfile, logfile, llp, false, 0)
+	testutil.FatalIfErr(t, err)
+
+	// Newlines are part of NUL delimited records, and bytes that aren't valid
+	// UTF-8 are replaced.
+	testutil.WriteString(t, fd, "id=1\nop=put\x00id=2 \xff\x00id=3")
+	llp.Add(2)
+	err = f.Read(context.Background())
+	if err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	llp.Wait()
+	expected := []*logline.LogLine{
+		{context.TODO(), logfile, "id=1\nop=put", nil},
+		{context.TODO(), logfile, "id=2 \ufffd", nil},
+	}
+	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	if diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if f.partial.String() != "id=3" {
+		t.Errorf("partial record not expected: %q", f.partial)
+	}
+}
+
 func TestOpenRetries(t *testing.T) {
 	// Can't force a permission denied error if run as root.
 	testutil.SkipIfRoot(t)
@@ -86,7 +121,7 @@ func TestOpenRetries(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := NewFile(logfile, logfile, nil, false); err == nil || !os.IsPermission(err) {
+	if _, err := NewFile(logfile, logfile, nil, false, '\n'); err == nil || !os.IsPermission(err) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
 }
@@ -111,7 +146,7 @@ func TestOpenPipe(t *testing.T) {
 
 	p.WriteString("1\n")
 	llp.Add(1)
-	f, err := NewFile(logpipe, logpipe, llp, false)
+	f, err := NewFile(logpipe, logpipe, llp, false, '\n')
 	testutil.FatalIfErr(t, err)
 	err = f.Read(context.Background())
 	if err != io.EOF {
@@ -130,7 +165,7 @@ func TestOpenSocket(t *testing.T) {
 
 	logsock := filepath.Join(tmpDir, "sock")
 
-	f, err := NewSocket(logsock, logsock, llp)
+	f, err := NewSocket(logsock, logsock, llp, '\n')
 	testutil.FatalIfErr(t, err)
 
 	l, err := net.DialUnix("unixgram", nil, &net.UnixAddr{logsock, "unixgram"})
@@ -147,7 +182,7 @@ func TestOpenSocket(t *testing.T) {
 		t.Errorf("partial line not empty: %q", f.partial)
 	}
 	expected := []*logline.LogLine{
-		{context.TODO(), logsock, "adf"},
+		{context.TODO(), logsock, "adf", nil},
 	}
 	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 	if diff != "" {
@@ -0,0 +1,172 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// JournalName is the log filename of the lines read from the systemd journal,
+// as returned by getfilename().
+const JournalName = "journald"
+
+// maxJournalEntrySize is the largest journal entry, in JSON, that can be read.
+const maxJournalEntrySize = 1 << 20
+
+// Journal reads the entries of the systemd journal, by running journalctl to
+// follow the journal in JSON format.  The message of each entry is sent as a
+// log line, with all the entry's fields.
+type Journal struct {
+	journalctl string   // path of the journalctl command
+	units      []string // if not empty, only entries of these units are read
+	follow     bool     // if set, follow the journal; else read the entries up to now and stop
+	llp        logline.Processor
+
+	mu   sync.Mutex // protects cmd
+	cmd  *exec.Cmd
+	done chan struct{} // closed when the entries have all been read
+}
+
+// NewJournal returns a Journal that runs the journalctl command to read the
+// entries of the given units, or of all units if there are none.
+func NewJournal(journalctl string, units []string, follow bool, llp logline.Processor) *Journal {
+	return &Journal{
+		journalctl: journalctl,
+		units:      units,
+		follow:     follow,
+		llp:        llp,
+		done:       make(chan struct{}),
+	}
+}
+
+// args returns the arguments to journalctl.  Only entries written after the
+// journal is opened are read when following, as for log files.
+func (j *Journal) args() []string {
+	args := []string{"--output=json", "--no-pager"}
+	if j.follow {
+		args = append(args, "--follow", "--lines=0")
+	}
+	for _, u := range j.units {
+		args = append(args, "--unit="+u)
+	}
+	return args
+}
+
+// Start runs journalctl and reads its entries until it exits, in the
+// background if the journal is being followed.
+func (j *Journal) Start(ctx context.Context) error {
+	cmd := exec.Command(j.journalctl, j.args()...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to run %s", j.journalctl)
+	}
+	glog.Infof("Reading the journal with %s %s", j.journalctl, strings.Join(j.args(), " "))
+	j.mu.Lock()
+	j.cmd = cmd
+	j.mu.Unlock()
+	read := func() {
+		defer close(j.done)
+		if err := readJournal(ctx, stdout, j.llp); err != nil {
+			logErrors.Add(JournalName, 1)
+			glog.Info(err)
+		}
+		if err := cmd.Wait(); err != nil {
+			glog.Infof("%s exited: %s", j.journalctl, err)
+		}
+	}
+	if !j.follow {
+		read()
+		return nil
+	}
+	go read()
+	return nil
+}
+
+// Close stops journalctl, and waits for the entries it wrote to be read.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	cmd := j.cmd
+	j.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		glog.V(1).Info(err)
+	}
+	<-j.done
+	return nil
+}
+
+// readJournal reads journal entries from r, one JSON object per line as
+// written by `journalctl --output=json`, and sends the message of each to
+// llp.  A message of several lines is sent as that many log lines.
+func readJournal(ctx context.Context, r io.Reader, llp logline.Processor) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxJournalEntrySize)
+	for s.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			logErrors.Add(JournalName, 1)
+			glog.V(1).Infof("Invalid journal entry %q: %s", s.Text(), err)
+			continue
+		}
+		fields := make(map[string]string, len(entry))
+		for k, v := range entry {
+			if f, ok := journalFieldValue(v); ok {
+				fields[k] = f
+			}
+		}
+		message, ok := fields["MESSAGE"]
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(message, "\n"), "\n") {
+			llp.ProcessLogLine(ctx, &logline.LogLine{Context: ctx, Filename: JournalName, Line: line, Fields: fields})
+			lineCount.Add(JournalName, 1)
+		}
+	}
+	return s.Err()
+}
+
+// journalFieldValue returns the value of a field of a journal entry in JSON as
+// a string.  journalctl writes fields that aren't valid UTF-8 as arrays of
+// bytes, and fields that appear more than once as arrays of values, of which
+// the first is used.  Null fields, which are too large to be written, are
+// absent.
+func journalFieldValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		if len(v) == 0 {
+			return "", false
+		}
+		if _, ok := v[0].(float64); !ok {
+			return journalFieldValue(v[0])
+		}
+		b := make([]byte, 0, len(v))
+		for _, c := range v {
+			n, ok := c.(float64)
+			if !ok {
+				return "", false
+			}
+			b = append(b, byte(n))
+		}
+		return string(b), true
+	}
+	return "", false
+}
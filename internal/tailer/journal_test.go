@@ -0,0 +1,88 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// fakeJournal is the output of `journalctl --output=json` for a few entries.
+const fakeJournal = `{"__CURSOR":"s=1","_SYSTEMD_UNIT":"nginx.service","PRIORITY":"6","_PID":"42","MESSAGE":"GET / 200"}
+{"__CURSOR":"s=2","_SYSTEMD_UNIT":"sshd.service","PRIORITY":"4","MESSAGE":"first\nsecond\n"}
+{"__CURSOR":"s=3","_SYSTEMD_UNIT":"app.service","MESSAGE":[98,105,110,255],"_HOSTNAME":["a","b"]}
+{"__CURSOR":"s=4","_SYSTEMD_UNIT":"app.service","CODE_LINE":null}
+not json
+{"__CURSOR":"s=5","_SYSTEMD_UNIT":"nginx.service","MESSAGE":"GET /a 404","BLOB":null}
+`
+
+var fakeJournalLines = []*logline.LogLine{
+	{nil, JournalName, "GET / 200", map[string]string{"__CURSOR": "s=1", "_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "6", "_PID": "42", "MESSAGE": "GET / 200"}},
+	{nil, JournalName, "first", map[string]string{"__CURSOR": "s=2", "_SYSTEMD_UNIT": "sshd.service", "PRIORITY": "4", "MESSAGE": "first\nsecond\n"}},
+	{nil, JournalName, "second", map[string]string{"__CURSOR": "s=2", "_SYSTEMD_UNIT": "sshd.service", "PRIORITY": "4", "MESSAGE": "first\nsecond\n"}},
+	{nil, JournalName, "bin\xff", map[string]string{"__CURSOR": "s=3", "_SYSTEMD_UNIT": "app.service", "MESSAGE": "bin\xff", "_HOSTNAME": "a"}},
+	{nil, JournalName, "GET /a 404", map[string]string{"__CURSOR": "s=5", "_SYSTEMD_UNIT": "nginx.service", "MESSAGE": "GET /a 404"}},
+}
+
+func TestReadJournal(t *testing.T) {
+	llp := NewStubProcessor()
+	llp.Add(len(fakeJournalLines))
+	testutil.FatalIfErr(t, readJournal(context.Background(), strings.NewReader(fakeJournal), llp))
+	llp.Wait()
+	if diff := testutil.Diff(fakeJournalLines, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+// writeFakeJournalctl writes a script to dir that records its arguments and
+// writes fakeJournal like journalctl, then waits to be killed if follow is
+// set.
+func writeFakeJournalctl(t *testing.T, dir string, follow bool) string {
+	t.Helper()
+	journal := filepath.Join(dir, "journal.json")
+	testutil.FatalIfErr(t, ioutil.WriteFile(journal, []byte(fakeJournal), 0644))
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat " + journal + "\n"
+	if follow {
+		script += "exec sleep 60\n"
+	}
+	journalctl := filepath.Join(dir, "journalctl")
+	testutil.FatalIfErr(t, ioutil.WriteFile(journalctl, []byte(script), 0755))
+	return journalctl
+}
+
+func TestTailJournal(t *testing.T) {
+	for _, oneShot := range []bool{true, false} {
+		ta, llp, w, dir, cleanup := makeTestTail(t)
+		defer cleanup()
+		if oneShot {
+			testutil.FatalIfErr(t, ta.SetOption(OneShot))
+		}
+		journalctl := writeFakeJournalctl(t, dir, !oneShot)
+
+		llp.Add(len(fakeJournalLines))
+		testutil.FatalIfErr(t, ta.TailJournal(journalctl, []string{"nginx.service", "sshd.service"}))
+		llp.Wait()
+		testutil.FatalIfErr(t, ta.Close())
+		testutil.FatalIfErr(t, w.Close())
+
+		if diff := testutil.Diff(fakeJournalLines, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+			t.Errorf("oneShot %v: result didn't match:\n%s", oneShot, diff)
+		}
+		args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+		testutil.FatalIfErr(t, err)
+		expected := "--output=json --no-pager --unit=nginx.service --unit=sshd.service\n"
+		if !oneShot {
+			expected = "--output=json --no-pager --follow --lines=0 --unit=nginx.service --unit=sshd.service\n"
+		}
+		if diff := testutil.Diff(expected, string(args)); diff != "" {
+			t.Errorf("oneShot %v: journalctl arguments diff:\n%s", oneShot, diff)
+		}
+	}
+}
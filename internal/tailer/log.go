@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 
@@ -25,11 +27,28 @@ type Log interface {
 	Pathname() string             // Return the filesystem full pathname of the log source.
 }
 
+// validUTF8 returns the record b as a string, with each byte that isn't part
+// of valid UTF-8 replaced by U+FFFD.
+func validUTF8(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	var s strings.Builder
+	s.Grow(len(b))
+	for len(b) > 0 {
+		r, width := utf8.DecodeRune(b)
+		s.WriteRune(r)
+		b = b[width:]
+	}
+	return s.String()
+}
+
 // NewLog returns an implementation of the Log interface that handles the given
 // pathname.  `llp' is a logline.Processor that recieves the bytes when read by
 // Read().  `seekToStart' indicates that the log should be read from the
-// beginning if possible, for files opened when in OneShot mode.
-func NewLog(pathname string, llp logline.Processor, seekToStart bool) (Log, error) {
+// beginning if possible, for files opened when in OneShot mode.  `delim' is
+// the byte that ends each record.
+func NewLog(pathname string, llp logline.Processor, seekToStart bool, delim byte) (Log, error) {
 	glog.V(2).Infof("tailer.NewLog(%s, %v)", pathname, seekToStart)
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
@@ -41,12 +60,12 @@ func NewLog(pathname string, llp logline.Processor, seekToStart bool) (Log, erro
 	}
 	switch m := fi.Mode(); {
 	case m.IsRegular() || m&os.ModeType == os.ModeNamedPipe:
-		return NewFile(pathname, absPath, llp, seekToStart)
+		return NewFile(pathname, absPath, llp, seekToStart, delim)
 	case m&os.ModeType == os.ModeSocket:
 		if seekToStart {
 			glog.V(2).Infof("ignoring seekToStart=%v as %q is a socket", seekToStart, absPath)
 		}
-		return NewSocket(pathname, absPath, llp)
+		return NewSocket(pathname, absPath, llp, delim)
 	default:
 		return nil, fmt.Errorf("don't know how to open %q", absPath)
 	}
@@ -7,8 +7,8 @@ import (
 	"bytes"
 	"context"
 	"net"
+	"sync/atomic"
 	"time"
-	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
@@ -17,27 +17,29 @@ import (
 
 // Socket provides an abstraction over unix sockets being tailed by `mtail'.
 type Socket struct {
+	lastRead int64 // time in Unix nanoseconds of the last read, accessed atomically
 	name     string
 	pathname string
-	lastRead time.Time
 	sock     net.Conn
 	partial  *bytes.Buffer
+	delim    byte // byte that ends each record
 	llp      logline.Processor
 }
 
 // NewSocket returns a new Socket named by the given pathname.
-// `llp' is a logline Processor that receivres the bytes when read by Read().
-func NewSocket(pathname, absPath string, llp logline.Processor) (*Socket, error) {
+// `llp' is a logline Processor that receivres the bytes when read by Read(),
+// split into records ending in `delim'.
+func NewSocket(pathname, absPath string, llp logline.Processor, delim byte) (*Socket, error) {
 	glog.V(2).Infof("tailer.NewSocket(%s)", absPath)
 	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{absPath, "unixgram"})
 	if err != nil {
 		return nil, err
 	}
-	return &Socket{pathname, absPath, time.Now(), c, bytes.NewBufferString(""), llp}, nil
+	return &Socket{time.Now().UnixNano(), pathname, absPath, c, bytes.NewBufferString(""), delim, llp}, nil
 }
 
 func (s *Socket) LastReadTime() time.Time {
-	return s.lastRead
+	return time.Unix(0, atomic.LoadInt64(&s.lastRead))
 }
 
 func (s *Socket) Name() string {
@@ -77,23 +79,20 @@ func (s *Socket) Read(ctx context.Context) error {
 			return nil
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				s.partial.WriteRune(rune)
-			default:
-				glog.Infof("sendline")
-				s.sendLine(ctx)
+		for rest := b; len(rest) > 0; {
+			i := bytes.IndexByte(rest, s.delim)
+			if i < 0 {
+				s.partial.Write(rest)
+				break
 			}
+			s.partial.Write(rest[:i])
+			glog.V(2).Infof("sendline")
+			s.sendLine(ctx)
+			rest = rest[i+1:]
 		}
 		if err != nil {
 			if totalBytes > 0 {
-				s.lastRead = time.Now()
+				atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
 			}
 			return err
 		}
@@ -103,8 +102,8 @@ func (s *Socket) Read(ctx context.Context) error {
 func (s *Socket) sendLine(ctx context.Context) {
 	ctx, span := trace.StartSpan(ctx, "Socket.sendLine")
 	defer span.End()
-	glog.Infof("Sending a line %q", s.partial.String())
-	s.llp.ProcessLogLine(ctx, logline.New(ctx, s.name, s.partial.String()))
+	glog.V(2).Infof("Sending a line %q", s.partial.String())
+	s.llp.ProcessLogLine(ctx, logline.New(ctx, s.name, validUTF8(s.partial.Bytes())))
 	lineCount.Add(s.name, 1)
 	s.partial.Reset()
 }
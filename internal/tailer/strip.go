@@ -0,0 +1,61 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// ansiSequence matches ANSI escape sequences: control sequences such as the
+// SGR sequences that set colours, operating system commands such as those
+// that set terminal titles, ended by BEL or ST, and other two byte escapes.
+var ansiSequence = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)?|[ -/]*[0-~])`)
+
+// isControl returns true for the control characters that are stripped from
+// lines.  Tabs and newlines, which may be in a record when the record
+// delimiter isn't a newline, are kept.
+func isControl(r rune) bool {
+	return r != '\t' && r != '\n' && unicode.IsControl(r)
+}
+
+// stripControl returns line without ANSI escape sequences and other control
+// characters.
+func stripControl(line string) string {
+	if strings.IndexFunc(line, isControl) < 0 {
+		return line
+	}
+	line = ansiSequence.ReplaceAllLiteralString(line, "")
+	return strings.Map(func(r rune) rune {
+		if isControl(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// controlStripper is a logline.Processor that strips ANSI escape sequences
+// and control characters from each line before passing it on.
+type controlStripper struct {
+	llp logline.Processor
+}
+
+func (s controlStripper) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
+	line.Line = stripControl(line.Line)
+	s.llp.ProcessLogLine(ctx, line)
+}
+
+// StripControl sets the tailer to strip ANSI escape sequences, such as
+// colours, and other control characters from the lines it reads, before they
+// are processed.
+func StripControl(t *Tailer) error {
+	if _, ok := t.llp.(controlStripper); !ok {
+		t.llp = controlStripper{t.llp}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+var stripControlTests = []struct {
+	name     string
+	line     string
+	expected string
+}{
+	{"plain", "GET /index.html 200", "GET /index.html 200"},
+	{"tabs", "a\tb", "a\tb"},
+	{"colour", "\x1b[1;31mERROR\x1b[0m disk full", "ERROR disk full"},
+	{"reset", "\x1b[mdone", "done"},
+	{"256 colour", "\x1b[38;5;208mwarn\x1b[39m", "warn"},
+	{"cursor", "\x1b[2K\x1b[1Gprogress 50%", "progress 50%"},
+	{"title", "\x1b]0;build\x07ok", "ok"},
+	{"title st", "\x1b]2;build\x1b\\ok", "ok"},
+	{"charset", "\x1b(Bok", "ok"},
+	{"keypad", "\x1b=ok", "ok"},
+	{"controls", "a\rb\x00c\x7fd\bok", "abcdok"},
+	{"c1", "a\u009bb", "ab"},
+	{"unicode", "café \x1b[32m✓\x1b[0m", "café ✓"},
+	{"truncated", "ok\x1b[", "ok"},
+}
+
+func TestStripControl(t *testing.T) {
+	for _, tc := range stripControlTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := stripControl(tc.line); got != tc.expected {
+				t.Errorf("stripControl(%q): expected %q, got %q", tc.line, tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTailStripControl(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(llp, w, Context(context.Background()), StripControl)
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	llp.Add(2)
+	testutil.WriteString(t, f, "\x1b[32mINFO\x1b[0m started\r\n\x1b[1;31mERROR\x1b[0m disk full\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "INFO started", nil},
+		{context.Background(), logfile, "ERROR disk full", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// SyslogName is the log filename of the lines received as syslog messages,
+// as returned by getfilename().
+const SyslogName = "syslog"
+
+const (
+	// maxSyslogMessageSize is the largest syslog message that can be
+	// received, well above the 8192 octets RFC 5425 asks receivers to take.
+	maxSyslogMessageSize = 64 << 10
+	// maxSyslogConns is the most syslog connections read at once.
+	maxSyslogConns = 256
+	// syslogIdleTimeout is how long a syslog connection, or its TLS
+	// handshake, may go without sending anything before it's closed.
+	syslogIdleTimeout = 5 * time.Minute
+)
+
+// Syslog receives syslog messages over TLS, as sent by RFC 5425 transports,
+// and sends each message as a log line.
+type Syslog struct {
+	listener net.Listener
+	llp      logline.Processor
+
+	idleTimeout time.Duration // how long a connection may be idle before it's closed
+	slots       chan struct{} // holds a value for each connection being read, up to its capacity
+
+	mu     sync.Mutex // protects conns and closed
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup // counts the accept loop and connections being read
+}
+
+// NewSyslog returns a Syslog listening for TLS connections on addr, with
+// config, which must have a certificate.
+func NewSyslog(addr string, config *tls.Config, llp logline.Processor) (*Syslog, error) {
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for syslog on %s", addr)
+	}
+	return &Syslog{
+		listener:    l,
+		llp:         llp,
+		idleTimeout: syslogIdleTimeout,
+		slots:       make(chan struct{}, maxSyslogConns),
+		conns:       make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the Syslog is listening on.
+func (s *Syslog) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start accepts connections and reads their messages in the background.
+func (s *Syslog) Start(ctx context.Context) {
+	glog.Infof("Receiving syslog over TLS on %s", s.listener.Addr())
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := s.listener.Accept()
+			if err != nil {
+				glog.V(1).Infof("Stopped accepting syslog connections: %s", err)
+				return
+			}
+			select {
+			case s.slots <- struct{}{}:
+			default:
+				glog.V(1).Infof("Refusing syslog connection from %s, as %d are already open", c.RemoteAddr(), cap(s.slots))
+				if err := c.Close(); err != nil {
+					glog.V(1).Info(err)
+				}
+				continue
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				if err := c.Close(); err != nil {
+					glog.V(1).Info(err)
+				}
+				return
+			}
+			s.conns[c] = struct{}{}
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer func() { <-s.slots }()
+				if err := readSyslog(ctx, idleReader{c, s.idleTimeout}, s.llp); err != nil {
+					logErrors.Add(SyslogName, 1)
+					glog.Infof("syslog connection from %s: %s", c.RemoteAddr(), err)
+				}
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+				if err := c.Close(); err != nil {
+					glog.V(1).Info(err)
+				}
+			}()
+		}
+	}()
+}
+
+// Close stops accepting connections, closes the open ones, and waits for the
+// messages received to be read.
+func (s *Syslog) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		if err := c.Close(); err != nil {
+			glog.V(1).Info(err)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// idleReader reads from a connection, closing it if a read doesn't complete
+// within the timeout.
+type idleReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (r idleReader) Read(b []byte) (int, error) {
+	if err := r.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.Conn.Read(b)
+}
+
+// readSyslog reads syslog messages from r, each framed by its length in
+// octets as in RFC 5425, and sends each to llp.  A message of several lines
+// is sent as that many log lines.
+func readSyslog(ctx context.Context, r io.Reader, llp logline.Processor) error {
+	br := bufio.NewReader(r)
+	for {
+		n, err := readSyslogLength(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return errors.Wrap(err, "reading message")
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(msg), "\n"), "\n") {
+			llp.ProcessLogLine(ctx, logline.New(ctx, SyslogName, line))
+			lineCount.Add(SyslogName, 1)
+		}
+	}
+}
+
+// readSyslogLength reads the length of the next message, the decimal number
+// of octets followed by a space.  It returns io.EOF if there are no more
+// messages.
+func readSyslogLength(br *bufio.Reader) (int, error) {
+	n := 0
+	for i := 0; ; i++ {
+		c, err := br.ReadByte()
+		if err == io.EOF && i == 0 {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "reading message length")
+		}
+		if c == ' ' && i > 0 {
+			break
+		}
+		if c < '0' || c > '9' || n > maxSyslogMessageSize {
+			return 0, errors.Errorf("invalid message length at %q", c)
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n == 0 || n > maxSyslogMessageSize {
+		return 0, errors.Errorf("invalid message length %d", n)
+	}
+	return n, nil
+}
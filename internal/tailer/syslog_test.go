@@ -0,0 +1,175 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestReadSyslog(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []string
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"messages",
+			"33 <34>1 - host app - - - started up12 <13>1 - - a\n",
+			[]string{"<34>1 - host app - - - started up", "<13>1 - - a"}, false},
+		{"multiline message", "12 <13>1 a\nb c\n", []string{"<13>1 a", "b c"}, false},
+		{"bad length", "x1 a", nil, true},
+		{"zero length", "0 a", nil, true},
+		{"missing length", " a", nil, true},
+		{"too long", "99999999 a", nil, true},
+		{"just too long", "65537 a", nil, true},
+		{"short message", "3 <34>1 a", []string{"<34"}, true},
+		{"truncated message", "10 <34>", nil, true},
+	} {
+		llp := NewStubProcessor()
+		llp.Add(len(tc.expected))
+		err := readSyslog(context.Background(), strings.NewReader(tc.input), llp)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: readSyslog error %v, expected error %v", tc.name, err, tc.err)
+		}
+		var lines []string
+		for _, ll := range llp.result {
+			if ll.Filename != SyslogName {
+				t.Errorf("%s: filename %q, expected %q", tc.name, ll.Filename, SyslogName)
+			}
+			lines = append(lines, ll.Line)
+		}
+		if diff := testutil.Diff(tc.expected, lines); diff != "" {
+			t.Errorf("%s: lines didn't match:\n%s", tc.name, diff)
+		}
+	}
+}
+
+// makeCert returns a certificate for 127.0.0.1, signed by parent with
+// parentKey, or self-signed if parent is nil.
+func makeCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.FatalIfErr(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	testutil.FatalIfErr(t, err)
+	cert, err := x509.ParseCertificate(der)
+	testutil.FatalIfErr(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestSyslogTLS(t *testing.T) {
+	ca, caCert := makeCert(t, "ca", true, nil, nil)
+	server, _ := makeCert(t, "server", false, caCert, ca.PrivateKey.(*ecdsa.PrivateKey))
+	client, _ := makeCert(t, "client", false, caCert, ca.PrivateKey.(*ecdsa.PrivateKey))
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	llp := NewStubProcessor()
+	s, err := NewSyslog("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, llp)
+	testutil.FatalIfErr(t, err)
+	s.Start(context.Background())
+
+	llp.Add(2)
+	c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{client}})
+	testutil.FatalIfErr(t, err)
+	_, err = c.Write([]byte("24 <34>1 - host app - - - a24 <34>1 - host app - - - b"))
+	testutil.FatalIfErr(t, err)
+	llp.Wait()
+
+	// A client without a certificate is refused.
+	c2, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		if _, err = c2.Write([]byte("24 <34>1 - host app - - - c")); err == nil {
+			_, err = c2.Read(make([]byte, 1))
+		}
+		c2.Close()
+	}
+	if err == nil {
+		t.Error("expected a client without a certificate to be refused")
+	}
+
+	// Close closes the connections that are still open.
+	testutil.FatalIfErr(t, s.Close())
+	c.Close()
+
+	expected := []*logline.LogLine{
+		{context.Background(), SyslogName, "<34>1 - host app - - - a", nil},
+		{context.Background(), SyslogName, "<34>1 - host app - - - b", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestSyslogLimits(t *testing.T) {
+	server, cert := makeCert(t, "server", false, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	llp := NewStubProcessor()
+	s, err := NewSyslog("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{server}}, llp)
+	testutil.FatalIfErr(t, err)
+	s.idleTimeout = 50 * time.Millisecond
+	s.slots = make(chan struct{}, 1)
+	s.Start(context.Background())
+	defer s.Close()
+
+	// A second connection is refused while the first is open.
+	c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool})
+	testutil.FatalIfErr(t, err)
+	defer c.Close()
+	llp.Add(1)
+	_, err = c.Write([]byte("1 a"))
+	testutil.FatalIfErr(t, err)
+	llp.Wait()
+	c2, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		_, err = c2.Read(make([]byte, 1))
+		c2.Close()
+	}
+	if err == nil {
+		t.Error("expected the second connection to be refused")
+	}
+
+	// The first is closed once it's idle.
+	testutil.FatalIfErr(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the idle connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("idle connection not closed by the server")
+	}
+}
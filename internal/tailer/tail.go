@@ -12,10 +12,12 @@ package tailer
 
 import (
 	"context"
+	"crypto/tls"
 	"expvar"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -33,6 +35,8 @@ import (
 var (
 	// logCount records the number of logs that are being tailed
 	logCount = expvar.NewInt("log_count")
+	// staleFilesClosed counts the number of log files closed for having no new content
+	staleFilesClosed = expvar.NewInt("tailer_stale_files_closed_total")
 )
 
 // Tailer receives notification of changes from a Watcher and extracts new log
@@ -43,14 +47,30 @@ type Tailer struct {
 	ctx context.Context
 	llp logline.Processor
 
-	handlesMu sync.RWMutex   // protects `handles'
-	handles   map[string]Log // Log handles for each pathname.
+	handlesMu  sync.RWMutex         // protects `handles' and `staleFiles'
+	handles    map[string]Log       // Log handles for each pathname.
+	staleFiles map[string]staleFile // Files closed by CloseStaleFiles, by pathname.
 
 	globPatternsMu     sync.RWMutex        // protects `globPatterns'
 	globPatterns       map[string]struct{} // glob patterns to match newly created logs in dir paths against
 	ignoreRegexPattern *regexp.Regexp
 
+	dirRegexpsMu sync.RWMutex                // protects `dirRegexps'
+	dirRegexps   map[string][]*regexp.Regexp // filename regexps to match newly created logs in each directory against
+
 	oneShot bool
+
+	delim byte // byte that ends each record read from the logs
+
+	ignoreOlderThan time.Duration // if positive, files last modified longer ago than this are not tailed
+
+	blacklist *regexp.Regexp // if not nil, files whose absolute path matches are not tailed
+	whitelist *regexp.Regexp // if not nil, only files whose absolute path matches are tailed
+
+	journal *Journal // if not nil, the systemd journal being read
+	syslog  *Syslog  // if not nil, the syslog listener receiving messages
+
+	commands []*Command // commands whose output is being read
 }
 
 // OneShot puts the tailer in one-shot mode.
@@ -59,6 +79,15 @@ func OneShot(t *Tailer) error {
 	return nil
 }
 
+// RecordDelimiter sets the byte that ends each record read from the logs,
+// instead of a newline.
+func RecordDelimiter(delim byte) func(*Tailer) error {
+	return func(t *Tailer) error {
+		t.delim = delim
+		return nil
+	}
+}
+
 // Context sets the context of the tailer
 func Context(ctx context.Context) func(*Tailer) error {
 	return func(t *Tailer) error {
@@ -67,6 +96,38 @@ func Context(ctx context.Context) func(*Tailer) error {
 	}
 }
 
+// IgnoreFilesOlderThan sets the tailer to ignore files last modified longer
+// ago than age when expanding log patterns.  An ignored file is picked up if
+// it is modified later, like a newly created file.
+func IgnoreFilesOlderThan(age time.Duration) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if age < 0 {
+			return errors.Errorf("invalid file age %s", age)
+		}
+		t.ignoreOlderThan = age
+		return nil
+	}
+}
+
+// Blacklist sets the tailer to not tail files whose absolute path matches re
+// when expanding log patterns.
+func Blacklist(re *regexp.Regexp) func(*Tailer) error {
+	return func(t *Tailer) error {
+		t.blacklist = re
+		return nil
+	}
+}
+
+// Whitelist sets the tailer to only tail files whose absolute path matches
+// re when expanding log patterns.  Files matching the blacklist are not tailed
+// even if they match the whitelist.
+func Whitelist(re *regexp.Regexp) func(*Tailer) error {
+	return func(t *Tailer) error {
+		t.whitelist = re
+		return nil
+	}
+}
+
 // New creates a new Tailer.
 func New(llp logline.Processor, w watcher.Watcher, options ...func(*Tailer) error) (*Tailer, error) {
 	if w == nil {
@@ -76,7 +137,10 @@ func New(llp logline.Processor, w watcher.Watcher, options ...func(*Tailer) erro
 		llp:          llp,
 		w:            w,
 		handles:      make(map[string]Log),
+		staleFiles:   make(map[string]staleFile),
 		globPatterns: make(map[string]struct{}),
+		dirRegexps:   make(map[string][]*regexp.Regexp),
+		delim:        '\n',
 	}
 	if err := t.SetOption(options...); err != nil {
 		return nil, err
@@ -176,6 +240,74 @@ func (t *Tailer) TailPattern(pattern string) error {
 	return nil
 }
 
+// TailRegexp registers a directory and filename regular expression to be
+// tailed.  The directory part of pattern names the directory to watch, and the
+// final path element is a regular expression that must match the whole
+// filename of a log in that directory for it to be tailed.  All existing
+// matching files are opened, and matching files created later in that
+// directory are picked up by the directory watch.
+func (t *Tailer) TailRegexp(pattern string) error {
+	dir, err := filepath.Abs(filepath.Dir(pattern))
+	if err != nil {
+		return err
+	}
+	re, err := regexp.Compile("^(?:" + filepath.Base(pattern) + ")$")
+	if err != nil {
+		return errors.Wrapf(err, "invalid filename regexp in %q", pattern)
+	}
+	glog.V(2).Infof("TailRegexp: %s in %s", re, dir)
+	t.dirRegexpsMu.Lock()
+	t.dirRegexps[dir] = append(t.dirRegexps[dir], re)
+	t.dirRegexpsMu.Unlock()
+	if err := t.w.Observe(dir, t); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	matches := 0
+	for _, fi := range fis {
+		if !re.MatchString(fi.Name()) {
+			continue
+		}
+		pathname := filepath.Join(dir, fi.Name())
+		ignore, err := t.Ignore(pathname)
+		if err != nil {
+			return err
+		}
+		if ignore {
+			continue
+		}
+		matches++
+		if err := t.TailPath(pathname); err != nil {
+			return errors.Wrapf(err, "attempting to tail %q", pathname)
+		}
+	}
+	// Error if there are no matches, but if they show up later, they'll get picked up by the directory watch set above.
+	if matches == 0 {
+		return errors.Errorf("No matches for regexp %q in %q", re, dir)
+	}
+	return nil
+}
+
+// matchesDirRegexp reports whether pathname is matched by a filename regexp
+// registered for its directory.
+func (t *Tailer) matchesDirRegexp(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.dirRegexpsMu.RLock()
+	defer t.dirRegexpsMu.RUnlock()
+	for _, re := range t.dirRegexps[filepath.Dir(absPath)] {
+		if re.MatchString(filepath.Base(absPath)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Tailer) Ignore(pathname string) (bool, error) {
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
@@ -190,6 +322,18 @@ func (t *Tailer) Ignore(pathname string) (bool, error) {
 		glog.V(2).Infof("ignore path %q because it is a folder", pathname)
 		return true, nil
 	}
+	if t.blacklist != nil && t.blacklist.MatchString(absPath) {
+		glog.V(2).Infof("ignore path %q because it matches the blacklist %q", pathname, t.blacklist)
+		return true, nil
+	}
+	if t.whitelist != nil && !t.whitelist.MatchString(absPath) {
+		glog.V(2).Infof("ignore path %q because it doesn't match the whitelist %q", pathname, t.whitelist)
+		return true, nil
+	}
+	if t.ignoreOlderThan > 0 && time.Since(fi.ModTime()) > t.ignoreOlderThan {
+		glog.V(2).Infof("ignore path %q because it was last modified at %s", pathname, fi.ModTime())
+		return true, nil
+	}
 	return t.ignoreRegexPattern != nil && t.ignoreRegexPattern.MatchString(fi.Name()), nil
 }
 
@@ -229,6 +373,9 @@ func (t *Tailer) TailPath(pathname string) error {
 func (t *Tailer) ProcessFileEvent(ctx context.Context, event watcher.Event) {
 	ctx, span := trace.StartSpan(ctx, "Tailer.ProcessFileEvent")
 	defer span.End()
+	if event.Op == watcher.Delete {
+		t.forgetStale(event.Pathname)
+	}
 	fd, ok := t.handleForPath(event.Pathname)
 	if !ok {
 		glog.V(1).Infof("No file handle found for %q, but is being watched", event.Pathname)
@@ -272,7 +419,7 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 	if err := t.watchDirname(pathname); err != nil {
 		return err
 	}
-	f, err := NewLog(pathname, t.llp, seekToStart || t.oneShot)
+	f, err := NewLog(pathname, t.llp, seekToStart || t.oneShot, t.delim)
 	if err != nil {
 		// Doesn't exist yet. We're watching the directory, so we'll pick it up
 		// again on create; return successfully.
@@ -282,6 +429,11 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 		}
 		return err
 	}
+	if f, ok := f.(*File); ok {
+		if err := t.resumeStale(f); err != nil {
+			glog.Info(err)
+		}
+	}
 	glog.V(2).Infof("Adding a file watch on %q", f.Pathname())
 	if err := t.w.Observe(f.Pathname(), t); err != nil {
 		return err
@@ -338,11 +490,94 @@ func (t *Tailer) handleCreateGlob(ctx context.Context, pathname string) {
 		glog.V(2).Infof("started tailing %q", pathname)
 		return
 	}
+	if t.matchesDirRegexp(pathname) {
+		ignore, err := t.Ignore(pathname)
+		if err != nil {
+			glog.Warningf("Unexpected bad pathname %q", pathname)
+			return
+		}
+		if ignore {
+			glog.V(2).Infof("%q is ignored", pathname)
+			return
+		}
+		glog.V(1).Infof("New file %q matched existing filename regexp", pathname)
+		if err := t.openLogPath(pathname, true); err != nil {
+			glog.Infof("Failed to tail new file %q: %s", pathname, err)
+		}
+		return
+	}
 	glog.V(2).Infof("did not start tailing %q", pathname)
 }
 
-// Close signals termination to the watcher.
+// TailJournal reads the entries of the systemd journal of the given units, or
+// of all units if there are none, by running the journalctl command.  The
+// journal is followed from now on, or in one-shot mode the entries up to now
+// are read.
+func (t *Tailer) TailJournal(journalctl string, units []string) error {
+	if t.journal != nil {
+		return errors.New("the journal is already being read")
+	}
+	j := NewJournal(journalctl, units, !t.oneShot, t.llp)
+	if err := j.Start(t.ctx); err != nil {
+		return err
+	}
+	t.journal = j
+	logCount.Add(1)
+	return nil
+}
+
+// ListenSyslog receives syslog messages over TLS on addr, with config, which
+// must have a certificate, as sent by RFC 5425 transports.
+func (t *Tailer) ListenSyslog(addr string, config *tls.Config) error {
+	if t.syslog != nil {
+		return errors.New("syslog is already being received")
+	}
+	s, err := NewSyslog(addr, config, t.llp)
+	if err != nil {
+		return err
+	}
+	s.Start(t.ctx)
+	t.syslog = s
+	logCount.Add(1)
+	return nil
+}
+
+// TailCommand reads the lines that a command writes to its standard output,
+// with the command line as their filename.  The command line is split into
+// the command and its arguments at spaces, and isn't run by a shell.  The
+// command is run again whenever it exits, or in one-shot mode it's run once
+// and its output is read until it exits.
+func (t *Tailer) TailCommand(command string) error {
+	c, err := NewCommand(command, !t.oneShot, t.llp)
+	if err != nil {
+		return err
+	}
+	if err := c.Start(t.ctx); err != nil {
+		return err
+	}
+	t.commands = append(t.commands, c)
+	logCount.Add(1)
+	return nil
+}
+
+// Close signals termination to the watcher, and stops reading the journal,
+// the output of commands and receiving syslog messages.
 func (t *Tailer) Close() error {
+	for _, c := range t.commands {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	if t.journal != nil {
+		if err := t.journal.Close(); err != nil {
+			return err
+		}
+	}
+	if t.syslog != nil {
+		if err := t.syslog.Close(); err != nil {
+			glog.V(1).Info(err)
+		}
+	}
 	if err := t.w.Close(); err != nil {
 		return err
 	}
@@ -365,6 +600,7 @@ const tailerTemplate = `
 <th>rotations</th>
 <th>truncations</th>
 <th>lines read</th>
+<th>watchdog recoveries</th>
 </tr>
 {{range $name, $val := $.Handles}}
 <tr>
@@ -373,6 +609,7 @@ const tailerTemplate = `
 <td>{{index $.Rotations $name}}</td>
 <td>{{index $.Truncs $name}}</td>
 <td>{{index $.Lines $name}}</td>
+<td>{{index $.Recoveries $name}}</td>
 </tr>
 {{end}}
 </table>
@@ -390,12 +627,13 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	t.globPatternsMu.RLock()
 	defer t.globPatternsMu.RUnlock()
 	data := struct {
-		Handles   map[string]Log
-		Patterns  map[string]struct{}
-		Rotations map[string]string
-		Lines     map[string]string
-		Errors    map[string]string
-		Truncs    map[string]string
+		Handles    map[string]Log
+		Patterns   map[string]struct{}
+		Rotations  map[string]string
+		Lines      map[string]string
+		Errors     map[string]string
+		Truncs     map[string]string
+		Recoveries map[string]string
 	}{
 		t.handles,
 		t.globPatterns,
@@ -403,6 +641,7 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
+		make(map[string]string),
 	}
 	for _, pair := range []struct {
 		v *expvar.Map
@@ -412,6 +651,7 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		{logRotations, data.Rotations},
 		{logTruncs, data.Truncs},
 		{lineCount, data.Lines},
+		{logRecoveries, data.Recoveries},
 	} {
 		pair.v.Do(func(kv expvar.KeyValue) {
 			pair.m[kv.Key] = kv.Value.String()
@@ -438,6 +678,223 @@ func (t *Tailer) Gc() error {
 	return nil
 }
 
+// Watchdog reopens the file handles that have had no reads for longer than
+// timeout while the file on disk has kept growing, to recover from
+// filesystems that stop delivering reads to an open handle.
+func (t *Tailer) Watchdog(timeout time.Duration) error {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	for _, v := range t.handles {
+		f, ok := v.(*File)
+		if !ok || !f.regular {
+			continue
+		}
+		if time.Since(f.LastReadTime()) <= timeout {
+			continue
+		}
+		stuck, err := f.stuck()
+		if err != nil {
+			glog.V(1).Infof("Couldn't check %q for new data: %s", f.Pathname(), err)
+			continue
+		}
+		if !stuck {
+			continue
+		}
+		glog.Infof("No reads from %s in %s while it grew, reopening", f.Pathname(), timeout)
+		if err := f.reopen(t.ctx); err != nil && err != io.EOF {
+			glog.Info(err)
+		}
+	}
+	return nil
+}
+
+// staleFile records where a file closed by CloseStaleFiles was read up to.
+type staleFile struct {
+	fi     os.FileInfo
+	offset int64
+}
+
+// CloseStaleFiles closes the log files that have had no reads for longer
+// than threshold, and stops watching them, so that files deleted while still
+// held open by their writer don't hold on to a file descriptor.  A closed
+// file is opened again when the watch on its directory sees it created or
+// modified.  Closed files that have since been deleted are forgotten.
+func (t *Tailer) CloseStaleFiles(threshold time.Duration) error {
+	t.handlesMu.Lock()
+	defer t.handlesMu.Unlock()
+	for k := range t.staleFiles {
+		if _, err := os.Stat(k); os.IsNotExist(err) {
+			delete(t.staleFiles, k)
+		}
+	}
+	for k, v := range t.handles {
+		f, ok := v.(*File)
+		if !ok || !f.regular {
+			continue
+		}
+		if time.Since(f.LastReadTime()) <= threshold {
+			continue
+		}
+		fi, offset, err := f.position()
+		if err != nil {
+			glog.Info(err)
+			continue
+		}
+		glog.Infof("No reads from %s in %s, closing it", f.Pathname(), threshold)
+		if err := t.w.Unobserve(f.Pathname(), t); err != nil {
+			glog.V(1).Info(err)
+		}
+		if err := f.Close(t.ctx); err != nil {
+			glog.Info(err)
+		}
+		delete(t.handles, k)
+		t.staleFiles[k] = staleFile{fi, offset}
+		logCount.Add(-1)
+		staleFilesClosed.Add(1)
+	}
+	return nil
+}
+
+// CloseIdleFiles closes the file descriptors of the log files that have had no
+// reads for longer than timeout, to limit the number of files held open when
+// tailing many mostly idle logs.  Unlike CloseStaleFiles the files are still
+// watched, and each is opened again, reading on from where it was closed, when
+// it's next modified.
+func (t *Tailer) CloseIdleFiles(timeout time.Duration) error {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	for _, v := range t.handles {
+		f, ok := v.(*File)
+		if !ok || !f.regular {
+			continue
+		}
+		if time.Since(f.LastReadTime()) <= timeout {
+			continue
+		}
+		if err := f.closeIdle(); err != nil {
+			glog.Info(err)
+		}
+	}
+	return nil
+}
+
+// resumeStale seeks a newly opened file to where it was read up to when it
+// was closed by CloseStaleFiles, if it is the same file and hasn't been
+// truncated.  A file that has been replaced is read from where it was opened.
+func (t *Tailer) resumeStale(f *File) error {
+	t.handlesMu.Lock()
+	s, ok := t.staleFiles[f.Pathname()]
+	delete(t.staleFiles, f.Pathname())
+	t.handlesMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return f.resume(s.fi, s.offset)
+}
+
+// forgetStale forgets where the file at pathname, if it was closed by
+// CloseStaleFiles, was read up to, as it has been deleted.
+func (t *Tailer) forgetStale(pathname string) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return
+	}
+	t.handlesMu.Lock()
+	defer t.handlesMu.Unlock()
+	delete(t.staleFiles, absPath)
+}
+
+// CheckRotations checks each log file for rotation or truncation, and follows
+// the files that have been, so that rotations are noticed even when the
+// watcher misses the events for them.
+func (t *Tailer) CheckRotations() error {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	for _, v := range t.handles {
+		f, ok := v.(*File)
+		if !ok {
+			continue
+		}
+		if err := f.checkRotation(t.ctx); err != nil && err != io.EOF {
+			glog.Info(err)
+		}
+	}
+	return nil
+}
+
+// StartRotationCheckLoop runs a permanent goroutine to check the log files
+// for rotation every interval.
+func (t *Tailer) StartRotationCheckLoop(interval time.Duration) {
+	if interval <= 0 {
+		glog.Info("Log rotation checks disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting log rotation check loop every %s", interval.String())
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := t.CheckRotations(); err != nil {
+				glog.Info(err)
+			}
+		}
+	}()
+}
+
+// StartStaleFileLoop runs a permanent goroutine to close the log files that
+// have had no reads for longer than threshold, checking every threshold.
+func (t *Tailer) StartStaleFileLoop(threshold time.Duration) {
+	if threshold <= 0 {
+		glog.Info("Stale file closing disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting stale file loop every %s", threshold.String())
+		ticker := time.NewTicker(threshold)
+		for range ticker.C {
+			if err := t.CloseStaleFiles(threshold); err != nil {
+				glog.Info(err)
+			}
+		}
+	}()
+}
+
+// StartIdleFileLoop runs a permanent goroutine to close the file descriptors
+// of the log files that have had no reads for longer than timeout, checking
+// every timeout.
+func (t *Tailer) StartIdleFileLoop(timeout time.Duration) {
+	if timeout <= 0 {
+		glog.Info("Idle file closing disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting idle file loop every %s", timeout.String())
+		ticker := time.NewTicker(timeout)
+		for range ticker.C {
+			if err := t.CloseIdleFiles(timeout); err != nil {
+				glog.Info(err)
+			}
+		}
+	}()
+}
+
+// StartWatchdogLoop runs a permanent goroutine to recover stuck log files,
+// checking every timeout.
+func (t *Tailer) StartWatchdogLoop(timeout time.Duration) {
+	if timeout <= 0 {
+		glog.Info("Log watchdog disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting log watchdog loop every %s", timeout.String())
+		ticker := time.NewTicker(timeout)
+		for range ticker.C {
+			if err := t.Watchdog(timeout); err != nil {
+				glog.Info(err)
+			}
+		}
+	}()
+}
+
 // StartExpiryLoop runs a permanent goroutine to expire metrics every duration.
 func (t *Tailer) StartGcLoop(duration time.Duration) {
 	if duration <= 0 {
@@ -5,8 +5,11 @@ package tailer
 
 import (
 	"context"
+	"expvar"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"testing"
 	"time"
 
@@ -71,10 +74,10 @@ func TestHandleLogUpdate(t *testing.T) {
 	}
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
+		{context.Background(), logfile, "a", nil},
+		{context.Background(), logfile, "b", nil},
+		{context.Background(), logfile, "c", nil},
+		{context.Background(), logfile, "d", nil},
 	}
 	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -121,11 +124,11 @@ func TestHandleLogTruncate(t *testing.T) {
 	}
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
-		{context.Background(), logfile, "e"},
+		{context.Background(), logfile, "a", nil},
+		{context.Background(), logfile, "b", nil},
+		{context.Background(), logfile, "c", nil},
+		{context.Background(), logfile, "d", nil},
+		{context.Background(), logfile, "e", nil},
 	}
 	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -166,7 +169,7 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "ab"},
+		{context.Background(), logfile, "ab", nil},
 	}
 	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 	if diff != "" {
@@ -283,8 +286,8 @@ func TestHandleLogRotate(t *testing.T) {
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "1"},
-		{context.Background(), logfile, "2"},
+		{context.Background(), logfile, "1", nil},
+		{context.Background(), logfile, "2", nil},
 	}
 	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 	if diff != "" {
@@ -328,8 +331,8 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "1"},
-		{context.Background(), logfile, "2"},
+		{context.Background(), logfile, "1", nil},
+		{context.Background(), logfile, "2", nil},
 	}
 	diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 	if diff != "" {
@@ -370,7 +373,7 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	}
 	ta.handlesMu.RUnlock()
 	ta.handlesMu.Lock()
-	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 + time.Minute)
+	ta.handles[log1].(*File).setLastReadTime(time.Now().Add(-time.Hour*24 + time.Minute))
 	ta.handlesMu.Unlock()
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
@@ -381,7 +384,7 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	}
 	ta.handlesMu.RUnlock()
 	ta.handlesMu.Lock()
-	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 - time.Minute)
+	ta.handles[log1].(*File).setLastReadTime(time.Now().Add(-time.Hour*24 - time.Minute))
 	ta.handlesMu.Unlock()
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
@@ -393,3 +396,428 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	ta.handlesMu.RUnlock()
 	glog.Info("good")
 }
+
+func TestTailRegexp(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	for _, name := range []string{"app-20200101.log", "app-20200101.log.gz", "other.log"} {
+		f := testutil.TestOpenFile(t, filepath.Join(dir, name))
+		defer f.Close()
+	}
+	if err := ta.TailRegexp(filepath.Join(dir, `app-\d{8}\.log`)); err != nil {
+		t.Fatal(err)
+	}
+
+	newMatch := filepath.Join(dir, "app-20200102.log")
+	f := testutil.TestOpenFile(t, newMatch)
+	defer f.Close()
+	w.InjectCreate(newMatch)
+	newNonMatch := filepath.Join(dir, "app-20200102.log.gz")
+	f = testutil.TestOpenFile(t, newNonMatch)
+	defer f.Close()
+	w.InjectCreate(newNonMatch)
+
+	for name, expected := range map[string]bool{
+		"app-20200101.log":    true,
+		"app-20200101.log.gz": false,
+		"other.log":           false,
+		"app-20200102.log":    true,
+		"app-20200102.log.gz": false,
+	} {
+		if got := ta.hasHandle(filepath.Join(dir, name)); got != expected {
+			t.Errorf("tailing %q: expected %v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestTailWatchdog(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// Write to the file without injecting an update, so the tailer sees the
+	// file grow but never reads from it.
+	llp.Add(2)
+	testutil.WriteString(t, f, "a\nb\n")
+	time.Sleep(10 * time.Millisecond)
+
+	testutil.FatalIfErr(t, ta.Watchdog(5*time.Millisecond))
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "a", nil},
+		{context.Background(), logfile, "b", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if r := logRecoveries.Get(logfile); r == nil || r.String() != "1" {
+		t.Errorf("expected 1 recovery, got %v", r)
+	}
+
+	// Nothing is waiting to be read, so the watchdog leaves the file alone.
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.Watchdog(5*time.Millisecond))
+	if r := logRecoveries.Get(logfile); r == nil || r.String() != "1" {
+		t.Errorf("expected still 1 recovery, got %v", r)
+	}
+}
+
+func TestTailIgnoreFilesOlderThan(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+	testutil.FatalIfErr(t, ta.SetOption(IgnoreFilesOlderThan(time.Hour)))
+
+	old := filepath.Join(dir, "old.log")
+	f := testutil.TestOpenFile(t, old)
+	defer f.Close()
+	lastYear := time.Now().Add(-365 * 24 * time.Hour)
+	testutil.FatalIfErr(t, os.Chtimes(old, lastYear, lastYear))
+	fresh := filepath.Join(dir, "fresh.log")
+	f = testutil.TestOpenFile(t, fresh)
+	defer f.Close()
+
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "*.log")))
+	if !ta.hasHandle(fresh) {
+		t.Errorf("expected %q to be tailed", fresh)
+	}
+	if ta.hasHandle(old) {
+		t.Errorf("expected %q not to be tailed", old)
+	}
+
+	// The old file is picked up once it's modified, when the watch on its
+	// directory reports the update.
+	now := time.Now()
+	testutil.FatalIfErr(t, os.Chtimes(old, now, now))
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Update, Pathname: old})
+	if !ta.hasHandle(old) {
+		t.Errorf("expected %q to be tailed after modification", old)
+	}
+}
+
+func TestTailBlacklistWhitelist(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []func(*Tailer) error
+		expected map[string]bool
+	}{
+		{"blacklist", []func(*Tailer) error{Blacklist(regexp.MustCompile(`\.(old|bak)$`))},
+			map[string]bool{"a.log": true, "b.log": true, "a.log.old": false, "a.log.bak": false, "new.log": true, "new.log.old": false}},
+		{"whitelist", []func(*Tailer) error{Whitelist(regexp.MustCompile(`/a\.`))},
+			map[string]bool{"a.log": true, "b.log": false, "a.log.old": true, "a.log.bak": true, "new.log": false, "new.log.old": false}},
+		{"both", []func(*Tailer) error{Blacklist(regexp.MustCompile(`\.old$`)), Whitelist(regexp.MustCompile(`/a\.`))},
+			map[string]bool{"a.log": true, "b.log": false, "a.log.old": false, "a.log.bak": true, "new.log": false, "new.log.old": false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ta, _, w, dir, cleanup := makeTestTail(t)
+			defer cleanup()
+			defer w.Close()
+			testutil.FatalIfErr(t, ta.SetOption(tc.opts...))
+
+			for _, name := range []string{"a.log", "b.log", "a.log.old", "a.log.bak"} {
+				f := testutil.TestOpenFile(t, filepath.Join(dir, name))
+				defer f.Close()
+			}
+			testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "*")))
+
+			// Files created later are filtered the same way.
+			for _, name := range []string{"new.log", "new.log.old"} {
+				pathname := filepath.Join(dir, name)
+				f := testutil.TestOpenFile(t, pathname)
+				defer f.Close()
+				w.InjectCreate(pathname)
+			}
+
+			for name, expected := range tc.expected {
+				if got := ta.hasHandle(filepath.Join(dir, name)); got != expected {
+					t.Errorf("tailing %q: expected %v, got %v", name, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTailOneShotRecordDelimiter(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("a\x00b\nc\x00"), 0600))
+
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(llp, w, Context(context.Background()), OneShot, RecordDelimiter(0))
+	testutil.FatalIfErr(t, err)
+	llp.Add(2)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	llp.Wait()
+	expected := []*logline.LogLine{
+		{context.TODO(), logfile, "a", nil},
+		{context.TODO(), logfile, "b\nc", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailCheckRotations(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	count := func(v *expvar.Map) string {
+		if c := v.Get(logfile); c != nil {
+			return c.String()
+		}
+		return "0"
+	}
+	rotations, truncs := count(logRotations), count(logTruncs)
+
+	// Nothing has changed, so the check reads nothing.
+	testutil.FatalIfErr(t, ta.CheckRotations())
+
+	// Rotate the file without injecting any events; the check finds the new
+	// file and reads both.
+	llp.Add(2)
+	testutil.WriteString(t, f, "1\n")
+	testutil.FatalIfErr(t, f.Close())
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+	f = testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "2\n")
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	llp.Wait()
+	if r := count(logRotations); r == rotations {
+		t.Errorf("expected a rotation, still %s", r)
+	}
+	rotations = count(logRotations)
+
+	// Truncate the file without injecting any events; the check seeks back
+	// to the start, so the next update reads from there.
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err := f.Seek(0, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	llp.Add(1)
+	testutil.WriteString(t, f, "3\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+	if tr := count(logTruncs); tr == truncs {
+		t.Errorf("expected a truncation, still %s", tr)
+	}
+
+	// Delete the file.  The lines written before the delete are read on the
+	// delete event, and the file is reopened when it's recreated.
+	llp.Add(2)
+	testutil.WriteString(t, f, "4\n")
+	testutil.FatalIfErr(t, f.Close())
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	w.InjectDelete(logfile)
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "5\n")
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	llp.Wait()
+	if r := count(logRotations); r == rotations {
+		t.Errorf("expected a rotation after recreation, still %s", r)
+	}
+
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "1", nil},
+		{context.Background(), logfile, "2", nil},
+		{context.Background(), logfile, "3", nil},
+		{context.Background(), logfile, "4", nil},
+		{context.Background(), logfile, "5", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailCloseStaleFiles(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "old\n")
+	testutil.FatalIfErr(t, ta.TailPattern(logfile))
+
+	closed := staleFilesClosed.Value()
+	testutil.FatalIfErr(t, ta.CloseStaleFiles(time.Hour))
+	if !ta.hasHandle(logfile) {
+		t.Fatalf("expected %q to be tailed", logfile)
+	}
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseStaleFiles(5*time.Millisecond))
+	if ta.hasHandle(logfile) {
+		t.Errorf("expected %q to be closed", logfile)
+	}
+	if got := staleFilesClosed.Value() - closed; got != 1 {
+		t.Errorf("expected 1 stale file closed, got %d", got)
+	}
+
+	// The same file is read from where it was closed when the watch on its
+	// directory reports it's modified.
+	llp.Add(1)
+	testutil.WriteString(t, f, "a\n")
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Update, Pathname: logfile})
+	llp.Wait()
+	if !ta.hasHandle(logfile) {
+		t.Errorf("expected %q to be tailed again", logfile)
+	}
+
+	// A file that replaces it is read from the start.
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseStaleFiles(5*time.Millisecond))
+	f.Close()
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	llp.Add(1)
+	testutil.WriteString(t, f, "b\n")
+	w.InjectCreate(logfile)
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "a", nil},
+		{context.Background(), logfile, "b", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if got := staleFilesClosed.Value() - closed; got != 2 {
+		t.Errorf("expected 2 stale files closed, got %d", got)
+	}
+}
+
+func TestTailForgetsDeletedStaleFiles(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	staleFiles := func() int {
+		ta.handlesMu.RLock()
+		defer ta.handlesMu.RUnlock()
+		return len(ta.staleFiles)
+	}
+	var logfiles []string
+	for _, name := range []string{"a", "b"} {
+		logfile := filepath.Join(dir, name)
+		f := testutil.TestOpenFile(t, logfile)
+		testutil.WriteString(t, f, "old\n")
+		f.Close()
+		testutil.FatalIfErr(t, ta.TailPattern(logfile))
+		logfiles = append(logfiles, logfile)
+	}
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseStaleFiles(5*time.Millisecond))
+	if got := staleFiles(); got != 2 {
+		t.Fatalf("expected 2 stale files, got %d", got)
+	}
+
+	// A delete event forgets the file.
+	testutil.FatalIfErr(t, os.Remove(logfiles[0]))
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Delete, Pathname: logfiles[0]})
+	if got := staleFiles(); got != 1 {
+		t.Errorf("expected 1 stale file after delete event, got %d", got)
+	}
+	// A file deleted without an event is forgotten on the next check.
+	testutil.FatalIfErr(t, os.Remove(logfiles[1]))
+	testutil.FatalIfErr(t, ta.CloseStaleFiles(5*time.Millisecond))
+	if got := staleFiles(); got != 0 {
+		t.Errorf("expected no stale files, got %d", got)
+	}
+}
+
+func TestTailCloseIdleFiles(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "old\n")
+	testutil.FatalIfErr(t, ta.TailPattern(logfile))
+	h, ok := ta.handleForPath(logfile)
+	if !ok {
+		t.Fatalf("expected %q to be tailed", logfile)
+	}
+	lf := h.(*File)
+
+	open := openFiles.Value()
+	testutil.FatalIfErr(t, ta.CloseIdleFiles(time.Hour))
+	if lf.file == nil {
+		t.Fatalf("expected %q to be open", logfile)
+	}
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseIdleFiles(5*time.Millisecond))
+	if lf.file != nil {
+		t.Errorf("expected the file descriptor of %q to be closed", logfile)
+	}
+	if !ta.hasHandle(logfile) {
+		t.Errorf("expected %q to still be tailed", logfile)
+	}
+	if got := openFiles.Value() - open; got != -1 {
+		t.Errorf("expected 1 fewer open file, got %d", got)
+	}
+
+	// The file is reopened where it was closed when it's modified.
+	llp.Add(1)
+	testutil.WriteString(t, f, "a\n")
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Update, Pathname: logfile})
+	llp.Wait()
+	if lf.file == nil {
+		t.Errorf("expected %q to be open again", logfile)
+	}
+	if got := openFiles.Value() - open; got != 0 {
+		t.Errorf("expected as many open files as before, got %d more", got)
+	}
+
+	// A write whose event was missed is read by the rotation check.
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseIdleFiles(5*time.Millisecond))
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	if lf.file != nil {
+		t.Errorf("expected %q to stay closed while it's unchanged", logfile)
+	}
+	llp.Add(1)
+	testutil.WriteString(t, f, "b\n")
+	testutil.FatalIfErr(t, ta.CheckRotations())
+	llp.Wait()
+
+	// A file that replaces it is read from the start.
+	time.Sleep(10 * time.Millisecond)
+	testutil.FatalIfErr(t, ta.CloseIdleFiles(5*time.Millisecond))
+	f.Close()
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	llp.Add(1)
+	testutil.WriteString(t, f, "c\n")
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Update, Pathname: logfile})
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "a", nil},
+		{context.Background(), logfile, "b", nil},
+		{context.Background(), logfile, "c", nil},
+	}
+	if diff := testutil.Diff(expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context")); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
@@ -11,15 +11,19 @@ import (
 // TestSetFlag sets the value of the commandline flag, and returns a cleanup function that restores the flag value.
 func TestSetFlag(tb testing.TB, name, value string) func() {
 	tb.Helper()
-	val := flag.Lookup(name)
+	f := flag.Lookup(name)
+	var old string
+	if f != nil {
+		old = f.Value.String()
+	}
 
 	if err := flag.Set(name, value); err != nil {
 		tb.Fatal(err)
 	}
 
 	return func() {
-		if val != nil {
-			if err := flag.Set(name, val.Value.String()); err != nil {
+		if f != nil {
+			if err := flag.Set(name, old); err != nil {
 				tb.Fatal(err)
 			}
 		}
@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package accesslog parses the lines of web server access logs into named
+// fields.  Formats are written like nginx's log_format directive, with
+// variables such as $remote_addr standing for the fields, and the common and
+// combined log formats are predefined.
+package accesslog
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// formats are the predefined formats, by name.
+var formats = map[string]string{
+	"common":   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+}
+
+// aliases are shorter names for the fields of the predefined formats.
+var aliases = map[string]string{
+	"bytes":      "body_bytes_sent",
+	"referer":    "http_referer",
+	"user_agent": "http_user_agent",
+}
+
+// variable matches a variable in a format, like $status or ${status}.
+var variable = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// unescaper undoes the escaping of quotes in quoted fields.
+var unescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+
+// Format is a compiled access log format.
+type Format struct {
+	re     *regexp.Regexp
+	quoted []bool // whether each submatch of re is a quoted field
+}
+
+// Compile parses an access log format, which is either the name of a
+// predefined format, "common" or "combined", or a format string like nginx's
+// log_format.  Each variable matches up to the first character of the text
+// that follows it, or the end of the quotes if it is quoted, so variables must
+// be separated by some text.
+func Compile(format string) (*Format, error) {
+	if f, ok := formats[format]; ok {
+		format = f
+	}
+	locs := variable.FindAllStringSubmatchIndex(format, -1)
+	if len(locs) == 0 {
+		return nil, errors.Errorf("no variables in access log format %q", format)
+	}
+	f := &Format{quoted: []bool{false}}
+	seen := make(map[string]struct{})
+	var b strings.Builder
+	b.WriteString("^")
+	prev := 0
+	for i, loc := range locs {
+		before := format[prev:loc[0]]
+		b.WriteString(regexp.QuoteMeta(before))
+		var name string
+		if loc[2] >= 0 {
+			name = format[loc[2]:loc[3]]
+		} else {
+			name = format[loc[4]:loc[5]]
+		}
+		if _, ok := seen[name]; ok {
+			return nil, errors.Errorf("variable $%s appears more than once in access log format %q", name, format)
+		}
+		seen[name] = struct{}{}
+		end := len(format)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		after := format[loc[1]:end]
+		if after == "" && end < len(format) {
+			return nil, errors.Errorf("variable $%s isn't separated from the next in access log format %q", name, format)
+		}
+		quoted := strings.HasSuffix(before, `"`) && strings.HasPrefix(after, `"`)
+		var pattern string
+		switch {
+		case quoted:
+			pattern = `(?:[^"\\]|\\.)*`
+		case after == "":
+			pattern = `\S*`
+		default:
+			r, _ := utf8.DecodeRuneInString(after)
+			pattern = `[^` + regexp.QuoteMeta(string(r)) + `]*`
+		}
+		b.WriteString(`(?P<` + name + `>` + pattern + `)`)
+		f.quoted = append(f.quoted, quoted)
+		prev = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(format[prev:]))
+	var err error
+	f.re, err = regexp.Compile(b.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "compiling access log format %q", format)
+	}
+	return f, nil
+}
+
+// Parse returns the fields of line by variable name, along with the aliases of
+// the predefined formats' fields, or nil if line doesn't match the format.
+// Quoted fields have their escaped quotes and backslashes unescaped.
+func (f *Format) Parse(line string) map[string]string {
+	m := f.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	fields := make(map[string]string, len(m)+len(aliases))
+	for i, name := range f.re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		if f.quoted[i] {
+			fields[name] = unescaper.Replace(m[i])
+		} else {
+			fields[name] = m[i]
+		}
+	}
+	for alias, name := range aliases {
+		if v, ok := fields[name]; ok {
+			if _, ok := fields[alias]; !ok {
+				fields[alias] = v
+			}
+		}
+	}
+	return fields
+}
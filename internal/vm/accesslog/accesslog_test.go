@@ -0,0 +1,108 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package accesslog
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var parseTests = []struct {
+	name     string
+	format   string
+	line     string
+	expected map[string]string
+}{
+	{"combined",
+		"combined",
+		`192.0.2.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+		map[string]string{
+			"remote_addr":     "192.0.2.1",
+			"remote_user":     "frank",
+			"time_local":      "10/Oct/2000:13:55:36 -0700",
+			"request":         "GET /apache_pb.gif HTTP/1.0",
+			"status":          "200",
+			"body_bytes_sent": "2326",
+			"bytes":           "2326",
+			"http_referer":    "http://www.example.com/start.html",
+			"referer":         "http://www.example.com/start.html",
+			"http_user_agent": "Mozilla/4.08 [en] (Win98; I ;Nav)",
+			"user_agent":      "Mozilla/4.08 [en] (Win98; I ;Nav)",
+		},
+	},
+	{"combined escaped quotes",
+		"combined",
+		`2001:db8::1 - - [10/Oct/2000:13:55:36 -0700] "GET /search?q=\"mtail\" HTTP/1.1" 404 0 "-" "curl/7.68.0 \"custom\" \\o/"`,
+		map[string]string{
+			"remote_addr":     "2001:db8::1",
+			"remote_user":     "-",
+			"time_local":      "10/Oct/2000:13:55:36 -0700",
+			"request":         `GET /search?q="mtail" HTTP/1.1`,
+			"status":          "404",
+			"body_bytes_sent": "0",
+			"bytes":           "0",
+			"http_referer":    "-",
+			"referer":         "-",
+			"http_user_agent": `curl/7.68.0 "custom" \o/`,
+			"user_agent":      `curl/7.68.0 "custom" \o/`,
+		},
+	},
+	{"common",
+		"common",
+		`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "POST /form HTTP/1.1" 302 -`,
+		map[string]string{
+			"remote_addr":     "192.0.2.1",
+			"remote_user":     "-",
+			"time_local":      "10/Oct/2000:13:55:36 -0700",
+			"request":         "POST /form HTTP/1.1",
+			"status":          "302",
+			"body_bytes_sent": "-",
+			"bytes":           "-",
+		},
+	},
+	{"custom",
+		`$remote_addr [${time_local}] "$request" $status $request_time upstream=$upstream_addr`,
+		`192.0.2.1 [10/Oct/2000:13:55:36 -0700] "GET / HTTP/2.0" 200 0.005 upstream=10.0.0.1:8080`,
+		map[string]string{
+			"remote_addr":   "192.0.2.1",
+			"time_local":    "10/Oct/2000:13:55:36 -0700",
+			"request":       "GET / HTTP/2.0",
+			"status":        "200",
+			"request_time":  "0.005",
+			"upstream_addr": "10.0.0.1:8080",
+		},
+	},
+	{"no match",
+		"combined",
+		`not an access log line`,
+		nil,
+	},
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range parseTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Compile(tc.format)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, f.Parse(tc.line)); diff != "" {
+				t.Errorf("Parse(%q) diff:\n%s", tc.line, diff)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, format := range []string{
+		"",
+		"no variables",
+		"$status$body_bytes_sent",
+		"$status $status",
+	} {
+		if _, err := Compile(format); err == nil {
+			t.Errorf("Compile(%q): expected error", format)
+		}
+	}
+}
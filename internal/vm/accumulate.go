@@ -0,0 +1,103 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sync"
+	"time"
+)
+
+// accumulation is the fields stored under a key by accumulate statements.
+type accumulation struct {
+	fields map[string]string
+	time   time.Time // When the fields were last stored.
+}
+
+// accumulator holds the fields stored by a program's accumulate statements,
+// by key, until a finalize block takes them.  Fields that aren't taken within
+// the TTL of being stored are forgotten, so that sequences of lines that are
+// never completed don't grow it without bound.
+type accumulator struct {
+	ttl time.Duration    // If positive, how long fields are kept for.
+	now func() time.Time // Source of the current time.
+
+	mu      sync.Mutex               // guards access to the fields below
+	entries map[string]*accumulation // fields stored, by key
+	swept   time.Time                // when expired entries were last removed
+}
+
+// newAccumulator creates an accumulator that keeps fields for ttl.
+func newAccumulator(ttl time.Duration) *accumulator {
+	return &accumulator{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*accumulation),
+	}
+}
+
+// Store adds fields to those stored under key, replacing fields of the same
+// name, and restarts their TTL.  It returns the number of entries that
+// expired.
+func (a *accumulator) Store(key string, fields map[string]string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	expired := a.sweep(now)
+	e, ok := a.entries[key]
+	if ok && a.expired(e, now) {
+		ok = false
+		expired++
+	}
+	if !ok {
+		e = &accumulation{fields: make(map[string]string, len(fields))}
+		a.entries[key] = e
+	}
+	for name, value := range fields {
+		e.fields[name] = value
+	}
+	e.time = now
+	return expired
+}
+
+// Take removes and returns the fields stored under key, and true if there
+// were any that hadn't expired.  It also returns the number of entries that
+// expired.
+func (a *accumulator) Take(key string) (map[string]string, bool, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	expired := a.sweep(now)
+	e, ok := a.entries[key]
+	if !ok {
+		return nil, false, expired
+	}
+	delete(a.entries, key)
+	if a.expired(e, now) {
+		return nil, false, expired + 1
+	}
+	return e.fields, true, expired
+}
+
+// expired returns true if the entry was stored longer ago than the TTL.
+func (a *accumulator) expired(e *accumulation, now time.Time) bool {
+	return a.ttl > 0 && now.Sub(e.time) >= a.ttl
+}
+
+// sweep removes the entries stored longer ago than the TTL, and returns how
+// many it removed.  To keep the cost of storing down it only looks at them
+// once every half TTL.
+func (a *accumulator) sweep(now time.Time) int {
+	if a.ttl <= 0 || now.Sub(a.swept) < a.ttl/2 {
+		return 0
+	}
+	a.swept = now
+	n := 0
+	for key, e := range a.entries {
+		if a.expired(e, now) {
+			delete(a.entries, key)
+			n++
+		}
+	}
+	return n
+}
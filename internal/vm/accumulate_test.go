@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAccumulatorStoreTake(t *testing.T) {
+	a := newAccumulator(0)
+	if n := a.Store("1", map[string]string{"method": "GET", "path": "/"}); n != 0 {
+		t.Errorf("expected no expired entries, got %d", n)
+	}
+	a.Store("1", map[string]string{"path": "/index.html", "user": "alice"})
+	a.Store("2", map[string]string{"method": "POST"})
+
+	fields, ok, _ := a.Take("1")
+	if !ok {
+		t.Fatal("expected fields under key 1")
+	}
+	expected := map[string]string{"method": "GET", "path": "/index.html", "user": "alice"}
+	if diff := cmp.Diff(expected, fields); diff != "" {
+		t.Errorf("fields didn't match:\n%s", diff)
+	}
+	if _, ok, _ := a.Take("1"); ok {
+		t.Error("expected key 1 to be taken only once")
+	}
+	if _, ok, _ := a.Take("3"); ok {
+		t.Error("expected no fields under key 3")
+	}
+	if fields, ok, _ := a.Take("2"); !ok || fields["method"] != "POST" {
+		t.Errorf("expected method POST under key 2, got %v, %v", fields, ok)
+	}
+}
+
+func TestAccumulatorTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newAccumulator(time.Minute)
+	a.now = func() time.Time { return now }
+
+	a.Store("old", map[string]string{"a": "1"})
+	a.Store("replaced", map[string]string{"a": "1"})
+	now = now.Add(20 * time.Second)
+	a.Store("kept", map[string]string{"a": "1"})
+
+	now = now.Add(50 * time.Second)
+	// Storing under an expired key starts over, and counts the old fields as
+	// expired; the sweep has already removed it, along with "old".
+	if n := a.Store("replaced", map[string]string{"b": "2"}); n != 2 {
+		t.Errorf("expected 2 expired entries, got %d", n)
+	}
+	if fields, ok, _ := a.Take("replaced"); !ok || fields["a"] != "" || fields["b"] != "2" {
+		t.Errorf("expected only b under key replaced, got %v, %v", fields, ok)
+	}
+	if _, ok, _ := a.Take("old"); ok {
+		t.Error("expected key old to have expired")
+	}
+	if _, ok, n := a.Take("kept"); !ok || n != 0 {
+		t.Errorf("expected key kept to be there, got %v and %d expired", ok, n)
+	}
+
+	// Between sweeps, an expired key is still noticed when it's taken.
+	a.Store("late", map[string]string{"a": "1"})
+	now = now.Add(time.Minute)
+	a.swept = now
+	if _, ok, n := a.Take("late"); ok || n != 1 {
+		t.Errorf("expected key late to have expired, got %v and %d expired", ok, n)
+	}
+}
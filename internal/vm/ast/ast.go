@@ -59,6 +59,8 @@ type CondStmt struct {
 	Truth Node
 	Else  Node
 	Scope *symbol.Scope // a conditional expression can cause new variables to be defined
+
+	Foreach bool // Truth is executed once for every match of the Cond pattern
 }
 
 func (n *CondStmt) Pos() *position.Position {
@@ -204,14 +206,45 @@ func (n *IndexedExpr) SetType(t types.Type) {
 }
 
 type VarDecl struct {
-	P            position.Position
-	Name         string
-	Hidden       bool
-	Keys         []string
-	Buckets      []float64
-	Kind         metrics.Kind
-	ExportedName string
-	Symbol       *symbol.Symbol
+	P              position.Position
+	Name           string
+	Hidden         bool
+	Keys           []string
+	StaticKeys     []string // Labels with a fixed value, given in StaticValues.
+	StaticValues   []string
+	Buckets        []float64
+	Kind           metrics.Kind
+	ExportedName   string
+	Aliases        []string      // Additional names the metric is exported under.
+	Sample         *SampleSpec   // If not nil, increments to this metric are sampled.
+	Adaptive       bool          // If set, the histogram's buckets are learned from its first observations.
+	Learn          *LearnSpec    // If not nil, how an adaptive histogram learns its buckets.
+	Window         time.Duration // Duration of the trailing window of a counter_window.
+	Init           Node          // If not nil, the literal initial value of each datum.
+	Values         []Node        // Label values of an info metric, one for each of Keys.
+	Timestamp      string        // Source of the exported timestamp, "log" or "scrape", if given.
+	PrometheusType string        // Type the metric is exported to Prometheus as, if given by @metric_type.
+	ResetOnExport  bool          // If set, the metric is reset to its initial value after each export.
+	Symbol         *symbol.Symbol
+
+	// TimeSource is the source of the exported timestamp, as given or the
+	// program's default, set by the checker.
+	TimeSource metrics.TimeSource
+}
+
+// LearnSpec is the `@learn_from(N)` attribute of an adaptive histogram,
+// which learns its buckets from its first N observations.
+type LearnSpec struct {
+	Count int64
+}
+
+// SampleSpec describes the sampling of increments to a metric.  A Rate of N
+// means only one in N increments is performed, and is scaled by N to
+// compensate.  If Random is set, each increment is sampled with probability
+// 1/N instead of deterministically every Nth increment.
+type SampleSpec struct {
+	Rate   int64
+	Random bool
 }
 
 func (n *VarDecl) Pos() *position.Position {
@@ -381,6 +414,71 @@ func (n *DelStmt) Type() types.Type {
 	return types.None
 }
 
+// FileLabelsStmt matches the filename of each log line against a pattern,
+// whose named capture groups label all the metrics of the program.
+type FileLabelsStmt struct {
+	P       position.Position
+	Pattern Node
+}
+
+func (n *FileLabelsStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *FileLabelsStmt) Type() types.Type {
+	return types.None
+}
+
+// FormatsExpr matches the line against alternative patterns, the formats of
+// the line, each named by a tag and capturing the same named groups.  The
+// first that matches sets the capture groups of the block it's the condition
+// of.
+type FormatsExpr struct {
+	P        position.Position
+	Tags     []string
+	Patterns []Node
+
+	Index int // The index of the first format's regular expression, which the match result is stored at.
+}
+
+func (n *FormatsExpr) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *FormatsExpr) Type() types.Type {
+	return types.Pattern
+}
+
+// ExcludeStmt stops the program on lines that match a pattern, before any of
+// its other patterns are tried.
+type ExcludeStmt struct {
+	P       position.Position
+	Pattern Node
+}
+
+func (n *ExcludeStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *ExcludeStmt) Type() types.Type {
+	return types.None
+}
+
+// TimestampStmt sets the source of the exported timestamp of the metrics
+// declared after it that don't set their own.
+type TimestampStmt struct {
+	P      position.Position
+	Source string
+}
+
+func (n *TimestampStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *TimestampStmt) Type() types.Type {
+	return types.None
+}
+
 type ConvExpr struct {
 	N Node
 
@@ -417,6 +515,39 @@ func (n *Error) Type() types.Type {
 	return types.Error
 }
 
+// AccumulateStmt stores the values of the named capture groups in scope under
+// a key, for a finalize block with the same key on a later line to read.
+type AccumulateStmt struct {
+	P   position.Position
+	Key Node
+
+	Fields []*symbol.Symbol // The named capture groups stored, in order of name; set by the checker.
+}
+
+func (n *AccumulateStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *AccumulateStmt) Type() types.Type {
+	return types.None
+}
+
+// FinalizeExpr takes the capture groups stored under a key by accumulate
+// statements, for the block it's the condition of to read with accumulated().
+// It's true if any were stored.
+type FinalizeExpr struct {
+	P   position.Position
+	Key Node
+}
+
+func (n *FinalizeExpr) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *FinalizeExpr) Type() types.Type {
+	return types.Bool
+}
+
 type StopStmt struct {
 	P position.Position
 }
@@ -76,13 +76,28 @@ func Walk(v Visitor, node Node) Node {
 	case *ConvExpr:
 		n.N = Walk(v, n.N)
 
+	case *FileLabelsStmt:
+		n.Pattern = Walk(v, n.Pattern)
+
+	case *ExcludeStmt:
+		n.Pattern = Walk(v, n.Pattern)
+
+	case *FormatsExpr:
+		n.Patterns = walknodelist(v, n.Patterns)
+
+	case *AccumulateStmt:
+		n.Key = Walk(v, n.Key)
+
+	case *FinalizeExpr:
+		n.Key = Walk(v, n.Key)
+
 	case *PatternExpr:
 		n.Expr = Walk(v, n.Expr)
 
 	case *PatternFragment:
 		n.Expr = Walk(v, n.Expr)
 
-	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt:
+	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt, *TimestampStmt:
 		// These nodes are terminals, thus have no children to walk.
 
 	default:
@@ -0,0 +1,288 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+var (
+	checkBaseline  = flag.Bool("vm_bench_check", false, "Compare the VM line throughput benchmark against the stored baseline, and fail if it regressed.")
+	recordBaseline = flag.Bool("vm_bench_record", false, "Record the VM line throughput benchmark results as the stored baseline.")
+	baselineSlack  = flag.Float64("vm_bench_slack", 0.2, "Fraction by which the VM line throughput benchmark may be worse than the baseline before it's a regression.")
+)
+
+const baselineFile = "testdata/throughput_baseline.json"
+
+// throughputProgram is representative of the programs run in production:
+// one pattern with several capture groups, a timestamp, dimensioned and
+// scalar counters, and a histogram.
+const throughputProgram = `counter requests by method, code
+counter bytes_total
+histogram latency_ms buckets 10, 50, 100, 500, 1000
+counter unmatched
+
+/^(?P<date>\S+ \S+) (?P<host>\S+) (?P<method>[A-Z]+) (?P<path>\S+) (?P<code>\d{3}) (?P<bytes>\d+) (?P<latency>\d+)ms$/ {
+  strptime($date, "2006-01-02 15:04:05")
+  requests[$method, $code]++
+  bytes_total += $bytes
+  latency_ms = $latency
+} else {
+  unmatched++
+}
+`
+
+// throughputCorpus returns n synthetic log lines for throughputProgram.  The
+// corpus is the same on every call, and one line in twenty doesn't match.
+func throughputCorpus(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	methods := []string{"GET", "GET", "GET", "POST", "PUT", "DELETE"}
+	codes := []string{"200", "200", "200", "200", "301", "404", "500"}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	lines := make([]string, n)
+	for i := range lines {
+		if i%20 == 19 {
+			lines[i] = fmt.Sprintf("kernel: [%d.%06d] eth0: link up", i, r.Intn(1000000))
+			continue
+		}
+		lines[i] = fmt.Sprintf("%s host%d %s /api/v1/items/%d %s %d %dms",
+			start.Add(time.Duration(i)*time.Second).Format("2006-01-02 15:04:05"),
+			r.Intn(8),
+			methods[r.Intn(len(methods))],
+			r.Intn(10000),
+			codes[r.Intn(len(codes))],
+			r.Intn(100000),
+			r.Intn(2000))
+	}
+	return lines
+}
+
+// BenchmarkLineThroughput runs throughputProgram over the synthetic corpus, one
+// line per iteration, through the full match and record path of the VM.
+func BenchmarkLineThroughput(b *testing.B) {
+	v, err := Compile("throughput", strings.NewReader(throughputProgram), false, false, false, time.UTC)
+	if err != nil {
+		b.Fatal(err)
+	}
+	corpus := throughputCorpus(1000)
+	lines := make([]*logline.LogLine, len(corpus))
+	ctx := context.Background()
+	for i, l := range corpus {
+		lines[i] = logline.New(ctx, "throughput.log", l)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		v.ProcessLogLine(ctx, lines[i%len(lines)])
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lines/s")
+	if v.RuntimeErrorString() != "" {
+		b.Fatal(v.RuntimeErrorString())
+	}
+}
+
+// prefilterPrograms each count the lines of one service, which the prefilter
+// rejects by their literal prefixes.
+var prefilterPrograms = map[string]string{
+	"sshd.mtail":    "counter sshd_logins by user\n/sshd\\[\\d+\\]: Accepted \\S+ for (?P<user>\\S+)/ {\n  sshd_logins[$user]++\n}\n",
+	"cron.mtail":    "counter cron_jobs by user\n/CRON\\[\\d+\\]: \\((?P<user>\\S+)\\) CMD/ {\n  cron_jobs[$user]++\n}\n",
+	"postfix.mtail": "counter postfix_sent\n/postfix\\/smtp\\[\\d+\\]: .* status=sent/ {\n  postfix_sent++\n}\n",
+	"sudo.mtail":    "counter sudo_commands\n/sudo: .* COMMAND=/ {\n  sudo_commands++\n}\n",
+	"ntpd.mtail":    "counter ntpd_syncs\n/ntpd\\[\\d+\\]: synchronized to/ {\n  ntpd_syncs++\n}\n",
+}
+
+// prefilterCorpus returns n synthetic syslog lines, of which one in twenty is
+// matched by one of prefilterPrograms.
+func prefilterCorpus(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	matching := []string{
+		"sshd[%d]: Accepted publickey for user%d from 192.0.2.1",
+		"CRON[%d]: (user%d) CMD (run-parts /etc/cron.hourly)",
+		"postfix/smtp[%d]: 1A2B3C: to=<user%d@example.com>, status=sent (250 OK)",
+		"sudo: user%[2]d : TTY=pts/%[1]d ; PWD=/ ; USER=root ; COMMAND=/bin/true",
+		"ntpd[%d]: synchronized to 192.0.2.%d, stratum 2",
+	}
+	lines := make([]string, n)
+	for i := range lines {
+		if i%20 == 19 {
+			lines[i] = fmt.Sprintf(matching[r.Intn(len(matching))], r.Intn(100000), r.Intn(10))
+			continue
+		}
+		lines[i] = fmt.Sprintf("kernel: [%d.%06d] audit: type=%d audit(%d.%03d:%d): pid=%d uid=0 auid=4294967295 ses=4294967295 msg='op=PAM:session_open'",
+			i, r.Intn(1000000), 1100+r.Intn(10), 1577836800+i, r.Intn(1000), r.Intn(100000), r.Intn(100000))
+	}
+	return lines
+}
+
+// BenchmarkLoaderPrefilter runs prefilterPrograms over a stream of mostly
+// unmatched lines, with and without the prefilter, to show the work saved by
+// not running the programs that can't match a line.
+func BenchmarkLoaderPrefilter(b *testing.B) {
+	corpus := prefilterCorpus(1000)
+	ctx := context.Background()
+	lines := make([]*logline.LogLine, len(corpus))
+	for i, l := range corpus {
+		lines[i] = logline.New(ctx, "syslog", l)
+	}
+	for _, noPrefilter := range []bool{false, true} {
+		name := "prefilter"
+		if noPrefilter {
+			name = "no prefilter"
+		}
+		b.Run(name, func(b *testing.B) {
+			l, err := NewLoader("", metrics.NewStore(), watcher.NewFakeWatcher())
+			if err != nil {
+				b.Fatal(err)
+			}
+			l.noPrefilter = noPrefilter
+			for name, prog := range prefilterPrograms {
+				if err := l.CompileAndRun(name, strings.NewReader(prog)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				l.ProcessLogLine(ctx, lines[i%len(lines)])
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lines/s")
+		})
+	}
+}
+
+// throughputResult is the stored baseline of BenchmarkLineThroughput.
+type throughputResult struct {
+	NsPerLine     int64
+	AllocsPerLine int64
+}
+
+// TestLineThroughputBaseline guards against regressions in the VM's line
+// throughput.  With --vm_bench_check it runs BenchmarkLineThroughput and fails
+// if it is slower or allocates more than the stored baseline allows; with
+// --vm_bench_record it replaces the baseline.  Timings depend on the machine,
+// so record the baseline on the machine that checks it.
+func TestLineThroughputBaseline(t *testing.T) {
+	if !*checkBaseline && !*recordBaseline {
+		t.Skip("neither --vm_bench_check nor --vm_bench_record set")
+	}
+	r := testing.Benchmark(BenchmarkLineThroughput)
+	got := throughputResult{r.NsPerOp(), r.AllocsPerOp()}
+	t.Logf("%d ns/line, %d allocs/line, %.0f lines/s", got.NsPerLine, got.AllocsPerLine, r.Extra["lines/s"])
+	if *recordBaseline {
+		b, err := json.MarshalIndent(got, "", "  ")
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ioutil.WriteFile(baselineFile, append(b, '\n'), 0644))
+		return
+	}
+	b, err := ioutil.ReadFile(baselineFile)
+	testutil.FatalIfErr(t, err)
+	var want throughputResult
+	testutil.FatalIfErr(t, json.Unmarshal(b, &want))
+	if limit := float64(want.NsPerLine) * (1 + *baselineSlack); float64(got.NsPerLine) > limit {
+		t.Errorf("line throughput regressed: %d ns/line, baseline %d ns/line", got.NsPerLine, want.NsPerLine)
+	}
+	if limit := float64(want.AllocsPerLine) * (1 + *baselineSlack); float64(got.AllocsPerLine) > limit {
+		t.Errorf("allocations regressed: %d allocs/line, baseline %d allocs/line", got.AllocsPerLine, want.AllocsPerLine)
+	}
+}
+
+// BenchmarkLoaderLineWorkers runs throughputProgram over the lines of one log
+// with increasing numbers of line workers, to show the scaling of a single
+// busy log over several cores.
+func BenchmarkLoaderLineWorkers(b *testing.B) {
+	corpus := throughputCorpus(1000)
+	ctx := context.Background()
+	lines := make([]*logline.LogLine, len(corpus))
+	for i, l := range corpus {
+		lines[i] = logline.New(ctx, "throughput.log", l)
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			l, err := NewLoader("", metrics.NewStore(), watcher.NewFakeWatcher(), LineWorkers(workers), OverrideLocation(time.UTC))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := l.CompileAndRun("throughput", strings.NewReader(throughputProgram)); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				l.ProcessLogLine(ctx, lines[i%len(lines)])
+			}
+			// Wait for the queued lines to be processed.
+			l.Close()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lines/s")
+		})
+	}
+}
+
+// BenchmarkStringIntern runs a program recording 10K distinct hosts, each seen
+// with two status codes, with and without --vm_string_intern, and reports
+// the heap retained by the recorded metrics.  Without interning, each label
+// set stores its own copy of its host, and keeps the line it was matched in
+// alive.
+func BenchmarkStringIntern(b *testing.B) {
+	const prog = `counter requests by host, code
+/^(?P<host>\S+) \S+ (?P<code>\d{3})$/ {
+  requests[$host, $code]++
+}
+`
+	const hosts = 10000
+	codes := []string{"200", "404"}
+	ctx := context.Background()
+	for _, intern := range []bool{false, true} {
+		name := "no intern"
+		if intern {
+			name = "intern"
+		}
+		b.Run(name, func(b *testing.B) {
+			defer testutil.TestSetFlag(b, "vm_string_intern", fmt.Sprint(intern))()
+			b.ReportAllocs()
+			var retained uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				store := metrics.NewStore()
+				l, err := NewLoader("", store, watcher.NewFakeWatcher())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := l.CompileAndRun("intern", strings.NewReader(prog)); err != nil {
+					b.Fatal(err)
+				}
+				for _, code := range codes {
+					for h := 0; h < hosts; h++ {
+						line := fmt.Sprintf("host%05d.example.com /api/v1/items/%d %s", h, h, code)
+						l.ProcessLogLine(ctx, logline.New(ctx, "intern.log", line))
+					}
+				}
+				l.Close()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+		})
+	}
+}
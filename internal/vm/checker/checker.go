@@ -5,17 +5,23 @@ package checker
 
 import (
 	"fmt"
+	"math"
 	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/vm/accesslog"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/strptime"
 	"github.com/google/mtail/internal/vm/symbol"
 	"github.com/google/mtail/internal/vm/types"
+	"github.com/google/mtail/internal/vm/xpath"
 )
 
 const kMaxRegexpLen = 1024
@@ -27,14 +33,54 @@ type checker struct {
 	decoScopes []*symbol.Scope // A stack of scopes used for resolving symbols in decorated nodes
 
 	errors errors.ErrorList
+
+	knownEnvVars map[string]struct{} // If not nil, getenv() of any other variable is warned about.
+
+	infoSymbols map[*symbol.Symbol]struct{} // Symbols of info metrics, which can't be used in expressions.
+	hllSymbols  map[*symbol.Symbol]struct{} // Symbols of hll metrics, which can only be added to with hll_add().
+
+	declaredMetrics bool                // Set once the first metric declaration is seen.
+	fileLabels      map[string]struct{} // Names of the filename labels of all metrics, if declared.
+	matchedLines    bool                // Set once the first block acting on lines is seen at the top of the program.
+	inFormats       bool                // Set while checking the patterns of a formats block, which declares their capture groups itself.
+	inFinalize      bool                // Set while checking a finalize block, whose accumulated fields can be read.
+
+	defaultTimestamp string // Source of the exported timestamp of metrics that don't give one, if declared.
+
+	exportNames map[string]exportName // The metric exported under each name and alias declared so far.
+}
+
+// exportName is a metric that a name is exported under, and whether the name
+// is an alias.
+type exportName struct {
+	metric string
+	alias  bool
+}
+
+// KnownEnvVars sets the names of the environment variables that programs are
+// expected to read with getenv().  Reading any other variable is logged as a
+// warning.  If no names are given, any variable may be read.
+func KnownEnvVars(names ...string) func(*checker) {
+	return func(c *checker) {
+		if len(names) == 0 {
+			return
+		}
+		c.knownEnvVars = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			c.knownEnvVars[name] = struct{}{}
+		}
+	}
 }
 
 // Check performs a semantic check of the astNode, and returns a potentially
 // modified astNode and either a list of errors found, or nil if the program is
 // semantically valid.  At the completion of Check, the symbol table and type
 // annotation are also complete.
-func Check(node ast.Node) (ast.Node, error) {
+func Check(node ast.Node, options ...func(*checker)) (ast.Node, error) {
 	c := &checker{}
+	for _, option := range options {
+		option(c)
+	}
 	node = ast.Walk(c, node)
 	if len(c.errors) > 0 {
 		return node, c.errors
@@ -53,6 +99,16 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return c, n
 
 	case *ast.CondStmt:
+		if c.scope.Parent == nil {
+			c.matchedLines = true
+		}
+		if _, ok := n.Cond.(*ast.FinalizeExpr); ok {
+			if c.inFinalize {
+				c.errors.Add(n.Cond.Pos(), "Can't finalize inside a finalize block.\n\tTry moving this block out of the enclosing finalize block.")
+				return nil, n
+			}
+			c.inFinalize = true
+		}
 		n.Scope = symbol.NewScope(c.scope)
 		c.scope = n.Scope
 		glog.V(2).Infof("Created new scope %v in condstmt", n.Scope)
@@ -78,11 +134,20 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return c, n
 
 	case *ast.VarDecl:
+		c.declaredMetrics = true
 		n.Symbol = symbol.NewSymbol(n.Name, symbol.VarSymbol, n.Pos())
 		if alt := c.scope.Insert(n.Symbol); alt != nil {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of metric `%s' previously declared at %s", n.Name, alt.Pos))
 			return nil, n
 		}
+		if n.Kind != metrics.Info {
+			for _, k := range n.Keys {
+				if _, ok := c.fileLabels[k]; ok {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Key `%s' of metric `%s' is already a filename label.", k, n.Name))
+					return nil, n
+				}
+			}
+		}
 		var rType types.Type
 		switch n.Kind {
 		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram:
@@ -91,6 +156,20 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			rType = types.NewVariable()
 		case metrics.Text:
 			rType = types.String
+		case metrics.Window:
+			rType = types.Int
+		case metrics.HLL:
+			// Reading an hll metric gives its estimate.
+			rType = types.Int
+			if c.hllSymbols == nil {
+				c.hllSymbols = make(map[*symbol.Symbol]struct{})
+			}
+			c.hllSymbols[n.Symbol] = struct{}{}
+		case metrics.Info:
+			if !c.checkInfoDecl(n) {
+				return nil, n
+			}
+			rType = types.Int
 		default:
 			c.errors.Add(n.Pos(), fmt.Sprintf("internal compiler error: unrecognised Kind %v for declNode %v", n.Kind, n))
 			return nil, n
@@ -99,6 +178,107 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify buckets for non-histogram metric `%s'.", n.Name))
 			return nil, n
 		}
+		if n.Kind == metrics.Window && n.Window <= 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("No window duration specified for counter_window `%s'.", n.Name))
+			return nil, n
+		}
+		if n.Window > 0 && n.Kind != metrics.Window {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify a window duration for non-counter_window metric `%s'.", n.Name))
+			return nil, n
+		}
+		timestamp := n.Timestamp
+		if timestamp == "" {
+			timestamp = c.defaultTimestamp
+		} else if !checkTimestampSource(timestamp) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Unknown timestamp source `%s' for metric `%s'.\n\tTry `log' or `scrape'.", n.Timestamp, n.Name))
+			return nil, n
+		}
+		if timestamp == "scrape" {
+			n.TimeSource = metrics.ScrapeTime
+		}
+		name := n.Name
+		if n.ExportedName != "" {
+			name = n.ExportedName
+		}
+		for i, a := range n.Aliases {
+			if a == name {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Alias `%s' of metric `%s' is the same as its name.", a, n.Name))
+				return nil, n
+			}
+			for _, b := range n.Aliases[:i] {
+				if a == b {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Duplicate alias `%s' of metric `%s'.", a, n.Name))
+					return nil, n
+				}
+			}
+		}
+		if !c.checkExportNames(n, name) {
+			return nil, n
+		}
+		for i, k := range n.StaticKeys {
+			for _, l := range append(n.Keys[:len(n.Keys):len(n.Keys)], n.StaticKeys[:i]...) {
+				if k == l {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Duplicate label `%s' of metric `%s'.", k, n.Name))
+					return nil, n
+				}
+			}
+		}
+		if n.Init != nil {
+			if n.Kind != metrics.Gauge {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify an initial value for non-gauge metric `%s'.", n.Name))
+				return nil, n
+			}
+			// A float initial value makes the gauge a float; an integer one
+			// doesn't constrain it, as ints promote to floats.
+			if _, ok := n.Init.(*ast.FloatLit); ok {
+				if err := types.Unify(rType, types.Float); err != nil {
+					c.errors.Add(n.Pos(), err.Error())
+					return nil, n
+				}
+			}
+		}
+		if n.Adaptive && len(n.Buckets) > 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify buckets for histogram_adaptive metric `%s'; they're learned.", n.Name))
+			return nil, n
+		}
+		if n.Learn != nil {
+			if !n.Adaptive {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify @learn_from for non-histogram_adaptive metric `%s'.", n.Name))
+				return nil, n
+			}
+			if n.Learn.Count < 1 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Number of observations to learn buckets from for metric `%s' must be positive.", n.Name))
+				return nil, n
+			}
+		}
+		if n.PrometheusType != "" {
+			if n.Kind == metrics.Text {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify @metric_type for text metric `%s'; text metrics aren't exported to Prometheus.", n.Name))
+				return nil, n
+			}
+			if !checkPrometheusType(n.Kind, n.PrometheusType) {
+				valid := "`counter', `gauge' or `untyped'"
+				if n.Kind == metrics.Histogram {
+					valid = "`histogram' or `summary'"
+				}
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't export metric `%s' to Prometheus as @metric_type `%s'.\n\tTry %s.", n.Name, n.PrometheusType, valid))
+				return nil, n
+			}
+		}
+		if n.ResetOnExport && n.Kind != metrics.Gauge {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify @reset_on_export for non-gauge metric `%s'.", n.Name))
+			return nil, n
+		}
+		if n.Sample != nil {
+			if n.Kind != metrics.Counter {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify a sample rate for non-counter metric `%s'.", n.Name))
+				return nil, n
+			}
+			if n.Sample.Rate < 1 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Sample rate for metric `%s' must be positive.", n.Name))
+				return nil, n
+			}
+		}
 		if len(n.Keys) > 0 {
 			// One type per key
 			keyTypes := make([]types.Type, 0, len(n.Keys))
@@ -117,6 +297,11 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		if n.Symbol == nil {
 			if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
 				glog.V(2).Infof("found varsymbol sym %v", sym)
+				if _, ok := c.infoSymbols[sym]; ok {
+					// Leave the symbol unresolved so no further errors are reported.
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't use info metric `%s' in an expression; info metrics are immutable.", n.Name))
+					return nil, n
+				}
 				sym.Used = true
 				n.Symbol = sym
 			} else if sym := c.scope.Lookup(n.Name, symbol.PatternSymbol); sym != nil {
@@ -148,7 +333,39 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.decoScopes = append(c.decoScopes, symbol.NewScope(nil))
 		return c, n
 
+	case *ast.FormatsExpr:
+		c.inFormats = true
+		return c, n
+
+	case *ast.ExcludeStmt:
+		switch {
+		case c.scope.Parent != nil:
+			c.errors.Add(n.Pos(), "Can't exclude lines inside a block.\n\tTry moving `exclude' to the top of the program.")
+			return nil, n
+		case c.matchedLines:
+			c.errors.Add(n.Pos(), "Lines must be excluded before any patterns are matched.\n\tTry moving `exclude' above the first pattern block.")
+			return nil, n
+		}
+		pe, ok := n.Pattern.(*ast.PatternExpr)
+		if !ok {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Internal error: exclude pattern is not a pattern: %#v", n.Pattern))
+			return nil, n
+		}
+		// The pattern is evaluated here rather than after walking it, as its
+		// capture groups are never stored so aren't declared.
+		ev := &patternEvaluator{scope: c.scope, errors: &c.errors}
+		pe = ast.Walk(ev, pe).(*ast.PatternExpr)
+		if ev.pattern.String() == "" {
+			return nil, n
+		}
+		pe.Pattern = ev.pattern.String()
+		c.parseRegex(pe.Pattern, pe)
+		return nil, n
+
 	case *ast.DecoStmt:
+		if c.scope.Parent == nil {
+			c.matchedLines = true
+		}
 		if sym := c.scope.Lookup(n.Name, symbol.DecoSymbol); sym != nil {
 			if sym.Binding == nil {
 				c.errors.Add(n.Pos(), fmt.Sprintf("Internal error: Decorator %q not bound to its definition.", n.Name))
@@ -201,6 +418,105 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	return c, node
 }
 
+// checkExportNames checks that the metric declared by n, exported as name,
+// isn't exported under the same name as another metric where either name is
+// an alias, and records its names for the declarations that follow.
+func (c *checker) checkExportNames(n *ast.VarDecl, name string) bool {
+	if n.Hidden {
+		return true
+	}
+	if c.exportNames == nil {
+		c.exportNames = make(map[string]exportName)
+	}
+	names := append([]string{name}, n.Aliases...)
+	for i, e := range names {
+		if other, ok := c.exportNames[e]; ok && (i > 0 || other.alias) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Metric `%s' is exported as `%s', which metric `%s' is already exported as.", n.Name, e, other.metric))
+			return false
+		}
+	}
+	for i, e := range names {
+		c.exportNames[e] = exportName{n.Name, i > 0}
+	}
+	return true
+}
+
+// checkInfoDecl checks the labels of an info metric declaration, which must
+// be unique, and have values that are fixed when the program is loaded.  It
+// returns false if errors were found.
+func (c *checker) checkInfoDecl(n *ast.VarDecl) bool {
+	// Info metrics aren't used by the program, only exported.
+	n.Symbol.Used = true
+	ok := true
+	for i, k := range n.Keys {
+		for _, j := range n.Keys[:i] {
+			if k == j {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Duplicate label `%s' of info metric `%s'.", k, n.Name))
+				ok = false
+			}
+		}
+		n.Values[i] = ast.Walk(c, n.Values[i])
+		switch v := n.Values[i].(type) {
+		case *ast.StringLit:
+		case *ast.BuiltinExpr:
+			if v.Name != "getenv" {
+				c.errors.Add(v.Pos(), fmt.Sprintf("Value of label `%s' of info metric `%s' must be a string constant or getenv(), not %s().", k, n.Name, v.Name))
+				ok = false
+			} else if types.Equals(v.Type(), types.Error) {
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		return false
+	}
+	if c.infoSymbols == nil {
+		c.infoSymbols = make(map[*symbol.Symbol]struct{})
+	}
+	c.infoSymbols[n.Symbol] = struct{}{}
+	return true
+}
+
+// isHLL returns true if id refers to an hll metric.
+func (c *checker) isHLL(id *ast.IdTerm) bool {
+	if id.Symbol == nil {
+		return false
+	}
+	_, ok := c.hllSymbols[id.Symbol]
+	return ok
+}
+
+// checkNotHLL returns false and adds an error if n, the target of an
+// assignment or increment, is an hll metric.
+func (c *checker) checkNotHLL(n ast.Node) bool {
+	if ix, ok := n.(*ast.IndexedExpr); ok {
+		n = ix.Lhs
+	}
+	if id, ok := n.(*ast.IdTerm); ok && c.isHLL(id) {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Can't assign to hll metric `%s'.\n\tTry using `hll_add()'.", id.Name))
+		return false
+	}
+	return true
+}
+
+// checkTimestampSource returns true if source names a source of the exported
+// timestamp of a metric: the time of the log line that last updated it, or
+// the time it's scraped.
+func checkTimestampSource(source string) bool {
+	return source == "log" || source == "scrape"
+}
+
+// checkPrometheusType returns true if a metric of kind k can be exported to
+// Prometheus as type typ.  Histograms can only be exported with their
+// buckets, or as a summary of their count and sum; other metrics have a single
+// value.
+func checkPrometheusType(k metrics.Kind, typ string) bool {
+	if k == metrics.Histogram {
+		return typ == "histogram" || typ == "summary"
+	}
+	return typ == "counter" || typ == "gauge" || typ == "untyped"
+}
+
 // checkSymbolUsage emits errors if any eligible symbols in the current scope
 // are not marked as used.
 func (c *checker) checkSymbolUsage() {
@@ -236,9 +552,13 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		condOK := false
 
 		switch cond := n.Cond.(type) {
-		case *ast.BinaryExpr, *ast.PatternExpr, *ast.PatternFragment, *ast.OtherwiseStmt:
+		case *ast.BinaryExpr, *ast.PatternExpr, *ast.PatternFragment, *ast.OtherwiseStmt, *ast.FormatsExpr:
 			condOK = true
 
+		case *ast.FinalizeExpr:
+			condOK = true
+			c.inFinalize = false
+
 		case *ast.IndexedExpr:
 			// Usage of a Pattern const shows up as an IndexedExpr because we can't tell them apart from identifiers yet.
 			if cond.Type() == types.Pattern {
@@ -399,12 +719,26 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				glog.V(2).Infof("Emitting convnode %+v", conv)
 			}
 
-		case parser.ASSIGN, parser.ADD_ASSIGN:
+		case parser.ASSIGN, parser.ADD_ASSIGN, parser.MAX_ASSIGN, parser.MIN_ASSIGN:
 			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
 			glog.V(2).Infof("lt %q, rt %q", lT, rT)
 			rType = lT
+			// Adding a string, like a capture group that isn't known to be
+			// numeric, to a variable that isn't a string, or comparing one
+			// with it for max= and min=, converts it to a number at runtime,
+			// which is a runtime error if it isn't one.
+			if n.Op != parser.ASSIGN && types.Equals(types.String, rT) && !types.Equals(types.String, lT) {
+				ct := types.Int
+				if types.Equals(types.Float, lT) {
+					ct = types.Float
+				}
+				conv := &ast.ConvExpr{N: n.Rhs}
+				conv.SetType(ct)
+				n.Rhs = conv
+				rT = ct
+			}
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := types.LeastUpperBound(lT, rT)
 			err := types.Unify(rType, t)
@@ -414,6 +748,15 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				n.SetType(types.Error)
 				return n
 			}
+			if !c.checkNotHLL(n.Lhs) {
+				n.SetType(types.Error)
+				return n
+			}
+			if (n.Op == parser.MAX_ASSIGN || n.Op == parser.MIN_ASSIGN) && types.Equals(types.String, t) {
+				c.errors.Add(n.Pos(), "Can't take the maximum or minimum of a string.\n\tTry assigning to a numeric metric.")
+				n.SetType(types.Error)
+				return n
+			}
 			switch v := n.Lhs.(type) {
 			case *ast.IdTerm:
 				v.Lvalue = true
@@ -476,6 +819,10 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			}
 			n.SetType(rType)
 		case parser.INC, parser.DEC:
+			if !c.checkNotHLL(n.Expr) {
+				n.SetType(types.Error)
+				return n
+			}
 			// First check what sort of expression it is
 			switch v := n.Expr.(type) {
 			case *ast.IdTerm:
@@ -594,6 +941,20 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		return n
 
 	case *ast.BuiltinExpr:
+		switch n.Name {
+		case "bucket":
+			c.checkBucket(n)
+			return n
+		case "collapse":
+			c.checkCollapse(n)
+			return n
+		case "debug_print":
+			c.checkDebugPrint(n)
+			return n
+		case "hash":
+			c.checkHash(n)
+			return n
+		}
 		typs := []types.Type{}
 		if args, ok := n.Args.(*ast.ExprList); ok {
 			for _, arg := range args.Children {
@@ -624,6 +985,17 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			// defined at compile time, we can verify it can be use as a format
 			// string by parsing itself.
 			if f, ok := n.Args.(*ast.ExprList).Children[1].(*ast.StringLit); ok {
+				// POSIX format strings are translated to the equivalent Go
+				// layout.
+				if strptime.IsFormat(f.Text) {
+					layout, err := strptime.Layout(f.Text)
+					if err != nil {
+						c.errors.Add(f.Pos(), fmt.Sprintf("invalid strptime format string %q: %s", f.Text, err))
+						n.SetType(types.Error)
+						return n
+					}
+					f.Text = layout
+				}
 				// Layout strings can contain an underscore to indicate a digit
 				// field if the layout field can contain two digits; but they
 				// won't parse themselves.  Zulu Timezones in the layout need
@@ -642,12 +1014,95 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
-		case "tolower":
+		case "getenv":
+			// The variable is read at compile time, so its name must be a
+			// constant.
+			s, ok := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit)
+			if !ok {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a string constant for argument 1 of getenv().")
+				n.SetType(types.Error)
+				return n
+			}
+			if c.knownEnvVars != nil {
+				if _, ok := c.knownEnvVars[s.Text]; !ok {
+					glog.Warningf("%s: getenv() of unknown environment variable %q", n.Pos(), s.Text)
+				}
+			}
+
+		case "accesslog":
+			// The format is compiled at check time, so it must be a constant.
+			s, ok := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit)
+			if !ok {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a string constant for argument 1 of accesslog().")
+				n.SetType(types.Error)
+				return n
+			}
+			if _, err := accesslog.Compile(s.Text); err != nil {
+				c.errors.Add(s.Pos(), err.Error())
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "hll_add":
+			arg := n.Args.(*ast.ExprList).Children[0]
+			id, ok := arg.(*ast.IdTerm)
+			if ix, isIndexed := arg.(*ast.IndexedExpr); isIndexed {
+				id, ok = ix.Lhs.(*ast.IdTerm)
+			}
+			if !ok || !c.isHLL(id) {
+				c.errors.Add(arg.Pos(), "Expecting an hll metric for argument 1 of hll_add().")
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+
+		case "tolower", "decode_uri_component", "encode_uri_component", "base64_decode", "base64_encode":
+			if !types.Equals(fn.Args[0], types.String) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of %s(), not %v.", n.Name, fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "accumulated":
+			if !c.inFinalize {
+				c.errors.Add(n.Pos(), "Can't read accumulated fields outside a finalize block.\n\tTry using accumulated() inside `finalize(key) { ... }'.")
+				n.SetType(types.Error)
+				return n
+			}
+			if _, ok := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit); !ok {
+				c.errors.Add(n.Args.Pos(), "Expecting a string constant naming a capture group for argument 1 of accumulated().")
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "xml_extract":
+			// The path is compiled at check time, so it must be a constant.
+			args := n.Args.(*ast.ExprList).Children
 			if !types.Equals(fn.Args[0], types.String) {
-				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of tolower(), not %v.", fn.Args[0]))
+				c.errors.Add(args[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of xml_extract(), not %v.", fn.Args[0]))
+				n.SetType(types.Error)
+				return n
+			}
+			s, ok := args[1].(*ast.StringLit)
+			if !ok {
+				c.errors.Add(args[1].Pos(), "Expecting a string constant for argument 2 of xml_extract().")
 				n.SetType(types.Error)
 				return n
 			}
+			if _, err := xpath.Compile(s.Text); err != nil {
+				c.errors.Add(s.Pos(), err.Error())
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "json_extract":
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				if !types.Equals(fn.Args[i], types.String) {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a String for argument %d of json_extract(), not %v.", i+1, fn.Args[i]))
+					n.SetType(types.Error)
+					return n
+				}
+			}
 		}
 		return n
 
@@ -659,9 +1114,18 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			return n
 		}
 		n.Pattern = pe.pattern.String()
+		if c.inFormats {
+			c.parseRegex(n.Pattern, n)
+			return n
+		}
 		c.checkRegex(n.Pattern, n)
 		return n
 
+	case *ast.FormatsExpr:
+		c.inFormats = false
+		c.checkFormats(n)
+		return n
+
 	case *ast.PatternFragment:
 		// Evaluate the expression.
 		pe := &patternEvaluator{scope: c.scope, errors: &c.errors}
@@ -672,6 +1136,72 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		n.Pattern = pe.pattern.String()
 		return n
 
+	case *ast.FileLabelsStmt:
+		pe, ok := n.Pattern.(*ast.PatternExpr)
+		if !ok || pe.Pattern == "" {
+			return n
+		}
+		switch {
+		case c.scope.Parent != nil:
+			c.errors.Add(n.Pos(), "Can't declare filename labels inside a block.\n\tTry moving `filename_labels' to the top of the program.")
+			return n
+		case c.fileLabels != nil:
+			c.errors.Add(n.Pos(), "Filename labels are already declared.")
+			return n
+		case c.declaredMetrics:
+			c.errors.Add(n.Pos(), "Filename labels must be declared before any metrics.\n\tTry moving `filename_labels' to the top of the program.")
+			return n
+		}
+		reAst, err := syntax.Parse(pe.Pattern, syntax.Perl)
+		if err != nil {
+			// Already reported by checkRegex.
+			return n
+		}
+		c.fileLabels = make(map[string]struct{})
+		for _, name := range reAst.CapNames() {
+			if name == "" {
+				continue
+			}
+			c.fileLabels[name] = struct{}{}
+			// The capture groups are used by every metric.
+			if sym := c.scope.Lookup(name, symbol.CaprefSymbol); sym != nil {
+				sym.Used = true
+			}
+		}
+		if len(c.fileLabels) == 0 {
+			c.errors.Add(n.Pos(), "No named capture groups in the filename labels pattern.\n\tTry using `(?P<name>...)' to name each label.")
+		}
+		return n
+
+	case *ast.TimestampStmt:
+		switch {
+		case !checkTimestampSource(n.Source):
+			c.errors.Add(n.Pos(), fmt.Sprintf("Unknown timestamp source `%s'.\n\tTry `log' or `scrape'.", n.Source))
+		case c.scope.Parent != nil:
+			c.errors.Add(n.Pos(), "Can't set the default timestamp source inside a block.\n\tTry moving `default_timestamp_source' to the top of the program.")
+		case c.defaultTimestamp != "":
+			c.errors.Add(n.Pos(), "Default timestamp source is already set.")
+		case c.declaredMetrics:
+			c.errors.Add(n.Pos(), "Default timestamp source must be set before any metrics are declared.\n\tTry moving `default_timestamp_source' to the top of the program.")
+		default:
+			c.defaultTimestamp = n.Source
+		}
+		return n
+
+	case *ast.AccumulateStmt:
+		if !c.checkAccumulateKey(n.Key, "accumulate") {
+			return n
+		}
+		n.Fields = c.namedCaprefs()
+		for _, sym := range n.Fields {
+			sym.Used = true
+		}
+		return n
+
+	case *ast.FinalizeExpr:
+		c.checkAccumulateKey(n.Key, "finalize")
+		return n
+
 	case *ast.DelStmt:
 		if ix, ok := n.N.(*ast.IndexedExpr); ok {
 			if len(ix.Index.(*ast.ExprList).Children) == 0 {
@@ -687,15 +1217,26 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 	return node
 }
 
-// checkRegex is a helper method to compile and check a regular expression, and
-// to generate its capture groups as symbols.
-func (c *checker) checkRegex(pattern string, n ast.Node) {
+// parseRegex is a helper method to check and parse a regular expression.  It
+// returns nil if the pattern is invalid, after reporting the error.
+func (c *checker) parseRegex(pattern string, n ast.Node) *syntax.Regexp {
 	plen := len(pattern)
 	if plen > kMaxRegexpLen {
 		c.errors.Add(n.Pos(), fmt.Sprintf("Exceeded maximum regular expression pattern length of %d bytes with %d.\n\tExcessively long patterns are likely to cause compilation and runtime performance problems.", kMaxRegexpLen, plen))
-		return
+		return nil
 	}
-	if reAst, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+	reAst, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		c.errors.Add(n.Pos(), err.Error())
+		return nil
+	}
+	return reAst
+}
+
+// checkRegex is a helper method to compile and check a regular expression, and
+// to generate its capture groups as symbols.
+func (c *checker) checkRegex(pattern string, n ast.Node) {
+	if reAst := c.parseRegex(pattern, n); reAst != nil {
 		// We reserve the names of the capturing groups as declarations
 		// of those symbols, so that future CAPREF tokens parsed can
 		// retrieve their value.  By recording them in the symbol table, we
@@ -718,10 +1259,97 @@ func (c *checker) checkRegex(pattern string, n ast.Node) {
 			}
 			glog.V(2).Infof("Added capref %v to scope %v", sym, c.scope)
 		}
-	} else {
-		c.errors.Add(n.Pos(), err.Error())
+	}
+}
+
+// checkFormats checks that the formats of a block have distinct tags and
+// capture the same named groups, and generates those groups as symbols.  The
+// whole match is `$0', followed in the block's match result by the named
+// groups in order of name, and `$format', the tag of the format that matched.
+func (c *checker) checkFormats(n *ast.FormatsExpr) {
+	if len(n.Tags) == 0 {
+		c.errors.Add(n.Pos(), "No formats in this block.\n\tTry adding a format like `name /pattern/'.")
 		return
 	}
+	res := make([]*syntax.Regexp, len(n.Patterns))
+	tags := make(map[string]struct{}, len(n.Tags))
+	for i, p := range n.Patterns {
+		if _, ok := tags[n.Tags[i]]; ok {
+			c.errors.Add(p.Pos(), fmt.Sprintf("Format `%s' is already defined in this block.", n.Tags[i]))
+			return
+		}
+		tags[n.Tags[i]] = struct{}{}
+		pe, ok := p.(*ast.PatternExpr)
+		if !ok || pe.Pattern == "" {
+			return
+		}
+		reAst, err := syntax.Parse(pe.Pattern, syntax.Perl)
+		if err != nil {
+			// Already reported by parseRegex.
+			return
+		}
+		res[i] = reAst
+	}
+	groups := make(map[string]int)
+	var names []string
+	for i, name := range res[0].CapNames() {
+		if name == "" {
+			continue
+		}
+		if name == "format" {
+			c.errors.Add(n.Patterns[0].Pos(), "Capture group `format' is reserved for the tag of the format that matched.\n\tTry using another name for the capture group.")
+			return
+		}
+		groups[name] = i
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, reAst := range res[1:] {
+		tag, p := n.Tags[i+1], n.Patterns[i+1]
+		own := make(map[string]struct{})
+		for _, name := range reAst.CapNames() {
+			if name == "" {
+				continue
+			}
+			own[name] = struct{}{}
+			if _, ok := groups[name]; !ok {
+				c.errors.Add(p.Pos(), fmt.Sprintf("Format `%s' captures `%s', which format `%s' doesn't.\n\tEvery format in a block must capture the same named groups.", tag, name, n.Tags[0]))
+			}
+		}
+		for _, name := range names {
+			if _, ok := own[name]; !ok {
+				c.errors.Add(p.Pos(), fmt.Sprintf("Format `%s' doesn't capture `%s', which format `%s' does.\n\tEvery format in a block must capture the same named groups.", tag, name, n.Tags[0]))
+			}
+		}
+	}
+	// Only the names are declared, as the groups' numbers differ between
+	// formats.
+	declare := func(addr int, name string, t types.Type) *symbol.Symbol {
+		sym := symbol.NewSymbol(name, symbol.CaprefSymbol, n.Pos())
+		sym.Type = t
+		sym.Binding = n
+		sym.Addr = addr
+		if alt := c.scope.Insert(sym); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
+		}
+		glog.V(2).Infof("Added capref %v to scope %v", sym, c.scope)
+		return sym
+	}
+	declare(0, "0", types.String)
+	for i, name := range names {
+		// The group's type is inferred if every format agrees on it.
+		t := types.InferCaprefType(res[0], groups[name])
+		for _, reAst := range res[1:] {
+			for j, other := range reAst.CapNames() {
+				if other == name && !types.Equals(t, types.InferCaprefType(reAst, j)) {
+					t = types.String
+				}
+			}
+		}
+		declare(i+1, name, t)
+	}
+	// Like `$0', the tag isn't user-defined so isn't warned about if unused.
+	declare(len(names)+1, "format", types.String).Used = true
 }
 
 // patternEvaluator is a helper that performs concatenation of pattern
@@ -765,3 +1393,166 @@ func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 func (p *patternEvaluator) VisitAfter(n ast.Node) ast.Node {
 	return n
 }
+
+// checkBucket checks a call to the variadic builtin bucket(), which takes a
+// numeric value followed by one or more numeric literal boundaries in
+// increasing order, and returns the label of the range the value falls in.
+func (c *checker) checkBucket(n *ast.BuiltinExpr) {
+	args, ok := n.Args.(*ast.ExprList)
+	if !ok || len(args.Children) < 2 {
+		c.errors.Add(n.Pos(), "call to `bucket': expecting a value and at least one boundary.")
+		n.SetType(types.Error)
+		return
+	}
+	valueType := args.Children[0].Type()
+	if types.IsComplete(valueType) && !types.Equals(valueType, types.Int) && !types.Equals(valueType, types.Float) && !types.Equals(valueType, types.String) {
+		c.errors.Add(args.Children[0].Pos(), fmt.Sprintf("Expecting a number for argument 1 of bucket(), not %v.", valueType))
+		n.SetType(types.Error)
+		return
+	}
+	last := math.Inf(-1)
+	for _, arg := range args.Children[1:] {
+		var b float64
+		switch v := arg.(type) {
+		case *ast.IntLit:
+			b = float64(v.I)
+		case *ast.FloatLit:
+			b = v.F
+		default:
+			c.errors.Add(arg.Pos(), "Boundaries of bucket() must be numeric literals.")
+			n.SetType(types.Error)
+			return
+		}
+		if b <= last {
+			c.errors.Add(arg.Pos(), "Boundaries of bucket() must be in increasing order.")
+			n.SetType(types.Error)
+			return
+		}
+		last = b
+	}
+	n.SetType(types.String)
+}
+
+// checkCollapse checks a call to the variadic builtin collapse(), which takes
+// a path followed by any number of string literal path templates, and returns
+// the path collapsed to a template.
+func (c *checker) checkCollapse(n *ast.BuiltinExpr) {
+	args, ok := n.Args.(*ast.ExprList)
+	if !ok || len(args.Children) < 1 {
+		c.errors.Add(n.Pos(), "call to `collapse': expecting a path and optional templates.")
+		n.SetType(types.Error)
+		return
+	}
+	if err := types.Unify(types.String, args.Children[0].Type()); err != nil {
+		c.errors.Add(args.Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of collapse(), not %v.", args.Children[0].Type()))
+		n.SetType(types.Error)
+		return
+	}
+	for _, arg := range args.Children[1:] {
+		s, ok := arg.(*ast.StringLit)
+		if !ok {
+			c.errors.Add(arg.Pos(), "Templates of collapse() must be string literals.")
+			n.SetType(types.Error)
+			return
+		}
+		if !strings.HasPrefix(s.Text, "/") {
+			c.errors.Add(arg.Pos(), fmt.Sprintf("Template %q of collapse() must begin with a slash.", s.Text))
+			n.SetType(types.Error)
+			return
+		}
+	}
+	n.SetType(types.String)
+}
+
+// checkDebugPrint checks that the first argument of a call to debug_print()
+// is a format string.  The values that follow it may be of any type.
+func (c *checker) checkDebugPrint(n *ast.BuiltinExpr) {
+	args, ok := n.Args.(*ast.ExprList)
+	if !ok || len(args.Children) < 1 {
+		c.errors.Add(n.Pos(), "call to `debug_print': expecting a format string and optional values.")
+		n.SetType(types.Error)
+		return
+	}
+	if !types.Equals(args.Children[0].Type(), types.String) {
+		c.errors.Add(args.Children[0].Pos(), fmt.Sprintf("Expecting a format string for argument 1 of debug_print(), not %v.", args.Children[0].Type()))
+		n.SetType(types.Error)
+		return
+	}
+	n.SetType(types.None)
+}
+
+// checkAccumulateKey checks that the key of an accumulate statement or a
+// finalize block is a string or a number, and returns false if it isn't.
+func (c *checker) checkAccumulateKey(n ast.Node, keyword string) bool {
+	t := n.Type()
+	if types.Equals(t, types.String) || types.Equals(t, types.Int) || types.Equals(t, types.Float) {
+		return true
+	}
+	if !types.IsErrorType(t) {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Can't use %v as the key of %s.\n\tTry using a capture group that identifies the sequence of lines.", t, keyword))
+	}
+	return false
+}
+
+// namedCaprefs returns the symbols of the named capture groups visible in the
+// current scope, in order of name.  Inner groups hide outer groups of the same
+// name.
+func (c *checker) namedCaprefs() []*symbol.Symbol {
+	seen := make(map[string]*symbol.Symbol)
+	for scope := c.scope; scope != nil; scope = scope.Parent {
+		for name, sym := range scope.Symbols {
+			if sym.Kind != symbol.CaprefSymbol || name != sym.Name {
+				continue
+			}
+			if _, err := strconv.Atoi(name); err == nil {
+				continue
+			}
+			if _, ok := seen[name]; !ok {
+				seen[name] = sym
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	syms := make([]*symbol.Symbol, len(names))
+	for i, name := range names {
+		syms[i] = seen[name]
+	}
+	return syms
+}
+
+// hashAlgorithms are the algorithms that hash() computes.
+var hashAlgorithms = map[string]bool{"md5": true, "sha1": true, "sha256": true, "sha512": true}
+
+// checkHash checks a call to the builtin hash(), which takes a string and an
+// optional algorithm, and returns the hash of the string.
+func (c *checker) checkHash(n *ast.BuiltinExpr) {
+	args, ok := n.Args.(*ast.ExprList)
+	if !ok || len(args.Children) < 1 || len(args.Children) > 2 {
+		c.errors.Add(n.Pos(), "call to `hash': expecting a string and an optional algorithm.")
+		n.SetType(types.Error)
+		return
+	}
+	if err := types.Unify(types.String, args.Children[0].Type()); err != nil {
+		c.errors.Add(args.Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of hash(), not %v.", args.Children[0].Type()))
+		n.SetType(types.Error)
+		return
+	}
+	if len(args.Children) == 2 {
+		s, ok := args.Children[1].(*ast.StringLit)
+		if !ok {
+			c.errors.Add(args.Children[1].Pos(), "The algorithm of hash() must be a string literal.")
+			n.SetType(types.Error)
+			return
+		}
+		if !hashAlgorithms[s.Text] {
+			c.errors.Add(args.Children[1].Pos(), fmt.Sprintf("Unknown hash algorithm %q.\n\tTry one of \"md5\", \"sha1\", \"sha256\" or \"sha512\".", s.Text))
+			n.SetType(types.Error)
+			return
+		}
+	}
+	n.SetType(types.String)
+}
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/checker"
@@ -111,6 +112,11 @@ counter bar by a, b
 		[]string{
 			"bad strptime format:1:33-53: invalid time format string \"2017-10-16 06:50:25\"", "\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice."}},
 
+	{"bad posix strptime format",
+		`strptime("2017-10-16", "%Y-%m-%Q")
+`,
+		[]string{"bad posix strptime format:1:24-33: invalid strptime format string \"%Y-%m-%Q\": unsupported conversion %Q"}},
+
 	{"undefined const regex",
 		"/foo / + X + / bar/ {}\n",
 		[]string{"undefined const regex:1:10: Identifier `X' not declared.", "\tTry adding `const X /.../' earlier in the program."}},
@@ -168,6 +174,313 @@ foo = $1
 }`,
 		[]string{"counter with buckets:1:9-11: Can't specify buckets for non-histogram metric `foo'."}},
 
+	{"counter window without duration",
+		`counter_window foo
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"counter window without duration:1:16-18: No window duration specified for counter_window `foo'."}},
+
+	{"counter with window duration",
+		`counter foo 5m
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"counter with window duration:1:9-11: Can't specify a window duration for non-counter_window metric `foo'."}},
+
+	{"assign to hll",
+		`hll foo
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"assign to hll:3:1-3: Can't assign to hll metric `foo'.", "\tTry using `hll_add()'."}},
+
+	{"increment hll",
+		`hll foo by a
+/(\d)/ {
+foo[$1]++
+}`,
+		[]string{"increment hll:3:1-3: Can't assign to hll metric `foo'.", "\tTry using `hll_add()'."}},
+
+	{"hll_add to counter",
+		`counter foo
+/(\d)/ {
+hll_add(foo, $1)
+}`,
+		[]string{"hll_add to counter:3:9-11: Expecting an hll metric for argument 1 of hll_add()."}},
+
+	{"gauge with sample rate",
+		`gauge foo sample 10
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"gauge with sample rate:1:7-9: Can't specify a sample rate for non-counter metric `foo'."}},
+
+	{"counter with initial value",
+		`counter foo = 3
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"counter with initial value:1:9-11: Can't specify an initial value for non-gauge metric `foo'."}},
+
+	{"getenv of non-constant",
+		`text t
+/(.*)/ {
+  t = getenv($1)
+}`,
+		[]string{"getenv of non-constant:3:14-15: Expecting a string constant for argument 1 of getenv()."}},
+
+	{"accesslog of non-constant format",
+		`counter c by status
+/(.*)/ {
+  c[accesslog($1, "status")]++
+}`,
+		[]string{"accesslog of non-constant format:3:15-16: Expecting a string constant for argument 1 of accesslog()."}},
+
+	{"accesslog invalid format",
+		`counter c by status
+// {
+  c[accesslog("$status$bytes", "status")]++
+}`,
+		[]string{"accesslog invalid format:3:15-29: variable $status isn't separated from the next in access log format \"$status$bytes\""}},
+
+	{"alias same as name",
+		`counter foo as "bar" alias "bar"
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"alias same as name:1:9-11: Alias `bar' of metric `foo' is the same as its name."}},
+
+	{"duplicate alias",
+		`counter foo alias bar, bar
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"duplicate alias:1:9-11: Duplicate alias `bar' of metric `foo'."}},
+
+	{"alias is another metric's name",
+		`counter bar
+counter foo alias bar
+/(\d)/ {
+foo = $1
+bar = $1
+}`,
+		[]string{"alias is another metric's name:2:9-11: Metric `foo' is exported as `bar', which metric `bar' is already exported as."}},
+
+	{"name is another metric's alias",
+		`counter foo alias "baz"
+counter bar as "baz"
+/(\d)/ {
+foo = $1
+bar = $1
+}`,
+		[]string{"name is another metric's alias:2:9-11: Metric `bar' is exported as `baz', which metric `foo' is already exported as."}},
+
+	{"alias is another metric's alias",
+		`counter foo alias qux
+counter bar alias qux
+/(\d)/ {
+foo = $1
+bar = $1
+}`,
+		[]string{"alias is another metric's alias:2:9-11: Metric `bar' is exported as `qux', which metric `foo' is already exported as."}},
+
+	{"adaptive histogram with buckets",
+		`histogram_adaptive foo buckets 1, 2
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"adaptive histogram with buckets:1:20-22: Can't specify buckets for histogram_adaptive metric `foo'; they're learned."}},
+
+	{"learn_from non-adaptive",
+		`histogram foo buckets 1, 2 @learn_from(10)
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"learn_from non-adaptive:1:11-13: Can't specify @learn_from for non-histogram_adaptive metric `foo'."}},
+
+	{"learn_from zero",
+		`histogram_adaptive foo @learn_from(0)
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"learn_from zero:1:20-22: Number of observations to learn buckets from for metric `foo' must be positive."}},
+
+	{"reset_on_export counter",
+		`counter foo @reset_on_export
+/(\d+)/ {
+  foo max= $1
+}`,
+		[]string{"reset_on_export counter:1:9-11: Can't specify @reset_on_export for non-gauge metric `foo'."}},
+
+	{"max of string",
+		`text foo
+/(\w+)/ {
+  foo max= $1
+}`,
+		[]string{"max of string:3:3-13: Can't take the maximum or minimum of a string.",
+			"\tTry assigning to a numeric metric."}},
+
+	{"metric_type of text",
+		`text foo @metric_type("untyped")
+/(\w+)/ {
+foo = $1
+}`,
+		[]string{"metric_type of text:1:6-8: Can't specify @metric_type for text metric `foo'; text metrics aren't exported to Prometheus."}},
+
+	{"metric_type unknown",
+		`counter foo @metric_type("meter")
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"metric_type unknown:1:9-11: Can't export metric `foo' to Prometheus as @metric_type `meter'.",
+			"\tTry `counter', `gauge' or `untyped'."}},
+
+	{"metric_type histogram of counter",
+		`counter foo @metric_type("histogram")
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"metric_type histogram of counter:1:9-11: Can't export metric `foo' to Prometheus as @metric_type `histogram'.",
+			"\tTry `counter', `gauge' or `untyped'."}},
+
+	{"metric_type gauge of histogram",
+		`histogram foo buckets 1, 2 @metric_type("gauge")
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"metric_type gauge of histogram:1:11-13: Can't export metric `foo' to Prometheus as @metric_type `gauge'.",
+			"\tTry `histogram' or `summary'."}},
+
+	{"static label same as key",
+		`counter foo by service, service: "web"
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"static label same as key:1:9-11: Duplicate label `service' of metric `foo'."}},
+
+	{"duplicate static label",
+		`counter foo by service: "web", service: "api"
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"duplicate static label:1:9-11: Duplicate label `service' of metric `foo'."}},
+
+	{"info duplicate label",
+		`info build_info { version: "1.0", version: "2.0" }
+`,
+		[]string{"info duplicate label:1:6-15: Duplicate label `version' of info metric `build_info'."}},
+
+	{"info value not getenv",
+		`info build_info { version: tolower("V") }
+`,
+		[]string{"info value not getenv:1:39: Value of label `version' of info metric `build_info' must be a string constant or getenv(), not tolower()."}},
+
+	{"info mutated",
+		`info build_info { version: "1.0" }
+/foo/ {
+  build_info++
+}`,
+		[]string{"info mutated:3:3-12: Can't use info metric `build_info' in an expression; info metrics are immutable."}},
+
+	{"bucket boundaries out of order",
+		`counter foo by range
+/(\d+)/ {
+foo[bucket($1, 500, 100)]++
+}`,
+		[]string{"bucket boundaries out of order:3:21-23: Boundaries of bucket() must be in increasing order."}},
+
+	{"bucket without boundaries",
+		`counter foo by range
+/(\d+)/ {
+foo[bucket($1)]++
+}`,
+		[]string{"bucket without boundaries:3:14: call to `bucket': expecting a value and at least one boundary."}},
+
+	{"collapse template not a literal",
+		`counter foo by path
+/(\S+) (\S+)/ {
+foo[collapse($1, $2)]++
+}`,
+		[]string{"collapse template not a literal:3:18-19: Templates of collapse() must be string literals."}},
+
+	{"collapse template without slash",
+		`counter foo by path
+/(\S+)/ {
+foo[collapse($1, "user/:id")]++
+}`,
+		[]string{"collapse template without slash:3:18-27: Template \"user/:id\" of collapse() must begin with a slash."}},
+
+	{"debug_print format not a string",
+		`/(\d+)/ {
+  debug_print($1 + 1, $1)
+}`,
+		[]string{"debug_print format not a string:2:15-20: Expecting a format string for argument 1 of debug_print(), not Int."}},
+
+	{"hash unknown algorithm",
+		`counter foo by user
+/(\S+)/ {
+foo[hash($1, "crc32")]++
+}`,
+		[]string{"hash unknown algorithm:3:14-20: Unknown hash algorithm \"crc32\".", "\tTry one of \"md5\", \"sha1\", \"sha256\" or \"sha512\"."}},
+
+	{"hash algorithm not a literal",
+		`counter foo by user
+/(\S+) (\S+)/ {
+foo[hash($1, $2)]++
+}`,
+		[]string{"hash algorithm not a literal:3:14-15: The algorithm of hash() must be a string literal."}},
+
+	{"hash too many arguments",
+		`counter foo by user
+/(\S+)/ {
+foo[hash($1, "md5", "sha1")]++
+}`,
+		[]string{"hash too many arguments:3:27: call to `hash': expecting a string and an optional algorithm."}},
+
+	{"accumulated outside finalize",
+		`counter foo by method
+/(?P<method>\S+)/ {
+foo[accumulated("method")]++
+}`,
+		[]string{"accumulated outside finalize:3:25: Can't read accumulated fields outside a finalize block.", "\tTry using accumulated() inside `finalize(key) { ... }'."}},
+
+	{"accumulated not a literal",
+		`counter foo by method
+/(?P<id>\d+) (?P<method>\S+)/ {
+finalize($id) {
+foo[accumulated($method)]++
+}
+}`,
+		[]string{"accumulated not a literal:4:17-23: Expecting a string constant naming a capture group for argument 1 of accumulated()."}},
+
+	{"nested finalize",
+		`counter foo
+/(?P<id>\d+)/ {
+foo++
+finalize($id) {
+finalize($id) {
+foo++
+}
+}
+}`,
+		[]string{"nested finalize:5:1-13: Can't finalize inside a finalize block.", "\tTry moving this block out of the enclosing finalize block."}},
+
+	{"accumulate key not a value",
+		`counter foo
+/(\d+)/ {
+accumulate(bool(1))
+foo++
+}`,
+		[]string{"accumulate key not a value:3:18: Can't use Bool as the key of accumulate.", "\tTry using a capture group that identifies the sequence of lines."}},
+
+	{"zero sample rate",
+		`counter foo sample 0
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"zero sample rate:1:9-11: Sample rate for metric `foo' must be positive."}},
+
 	{"next outside of decorator",
 		`def x{
 next
@@ -239,9 +552,139 @@ l++=l
 		`tolower(2)
 `, []string{"tolower non string:1:9: Expecting a String for argument 1 of tolower(), not Int."}},
 
+	{"json_extract non string path",
+		`json_extract("{}", 2)
+`, []string{"json_extract non string path:1:20: Expecting a String for argument 2 of json_extract(), not Int."}},
+
+	{"xml_extract non constant path",
+		`xml_extract("<a/>", getfilename())
+`, []string{"xml_extract non constant path:1:33: Expecting a string constant for argument 2 of xml_extract()."}},
+
+	{"xml_extract invalid path",
+		`xml_extract("<a/>", "/a/b[")
+`, []string{"xml_extract invalid path:1:21-27: invalid XPath \"/a/b[\": expression must evaluate to a node-set"}},
+
+	{"decode_uri_component non string",
+		`decode_uri_component(2)
+`, []string{"decode_uri_component non string:1:22: Expecting a String for argument 1 of decode_uri_component(), not Int."}},
+
 	{"dec non var",
 		`strptime("", "")--
 `, []string{"dec non var:1:16: Expecting a variable here."}},
+
+	{"filename labels after metric",
+		`counter requests
+filename_labels /(?P<tenant>\w+)/
+`, []string{
+			"filename labels after metric:1:9-16: Declaration of variable `requests' here is never used.",
+			"filename labels after metric:2:1-33: Filename labels must be declared before any metrics.",
+			"\tTry moving `filename_labels' to the top of the program."}},
+
+	{"filename labels in block",
+		`// {
+  filename_labels /(?P<tenant>\w+)/
+}
+`, []string{
+			"filename labels in block:2:3-35: Can't declare filename labels inside a block.",
+			"\tTry moving `filename_labels' to the top of the program."}},
+
+	{"exclude in block",
+		`// {
+  exclude /healthz/
+}
+`, []string{
+			"exclude in block:2:3-19: Can't exclude lines inside a block.",
+			"\tTry moving `exclude' to the top of the program."}},
+
+	{"exclude after pattern",
+		`counter requests
+/GET/ {
+  requests++
+}
+exclude /healthz/
+`, []string{
+			"exclude after pattern:5:1-17: Lines must be excluded before any patterns are matched.",
+			"\tTry moving `exclude' above the first pattern block."}},
+
+	{"formats with different groups",
+		`formats {
+  legacy /(?P<code>\d+) (?P<path>\S+)/
+  current /path=(?P<path>\S+) size=(?P<size>\d+)/
+} {
+}
+`, []string{
+			"formats with different groups:3:3-49: Format `current' captures `size', which format `legacy' doesn't.",
+			"\tEvery format in a block must capture the same named groups.",
+			"formats with different groups:3:3-49: Format `current' doesn't capture `code', which format `legacy' does.",
+			"\tEvery format in a block must capture the same named groups."}},
+
+	{"formats with the same tag",
+		`formats {
+  a /(?P<x>\d+)/
+  a /x=(?P<x>\d+)/
+} {
+}
+`, []string{
+			"formats with the same tag:3:3-18: Format `a' is already defined in this block."}},
+
+	{"formats capturing format",
+		`formats {
+  a /(?P<format>\w+)/
+} {
+}
+`, []string{
+			"formats capturing format:2:3-21: Capture group `format' is reserved for the tag of the format that matched.",
+			"\tTry using another name for the capture group."}},
+
+	{"formats unnamed group",
+		`formats {
+  a /(\d+)/
+} {
+  $1
+}
+`, []string{
+			"formats unnamed group:4:3-4: Capture group `$1' was not defined by a regular expression visible to this scope.",
+			"\tCheck that there are at least 1 pairs of parentheses."}},
+
+	{"filename labels without names",
+		`filename_labels /tenant-(\w+)/
+`, []string{
+			"filename labels without names:1:1-30: No named capture groups in the filename labels pattern.",
+			"\tTry using `(?P<name>...)' to name each label."}},
+
+	{"filename label is a key",
+		`filename_labels /(?P<tenant>\w+)/
+counter requests by tenant
+`, []string{
+			"filename label is a key:2:9-16: Key `tenant' of metric `requests' is already a filename label.",
+			"filename label is a key:2:9-16: Declaration of variable `requests' here is never used."}},
+
+	{"unknown timestamp source",
+		`counter requests timestamp_source parse
+`, []string{
+			"unknown timestamp source:1:9-16: Unknown timestamp source `parse' for metric `requests'.",
+			"\tTry `log' or `scrape'.",
+			"unknown timestamp source:1:9-16: Declaration of variable `requests' here is never used."}},
+
+	{"unknown default timestamp source",
+		`default_timestamp_source now
+`, []string{
+			"unknown default timestamp source:1:1-28: Unknown timestamp source `now'.",
+			"\tTry `log' or `scrape'."}},
+
+	{"default timestamp source after metric",
+		`counter requests
+default_timestamp_source scrape
+`, []string{
+			"default timestamp source after metric:1:9-16: Declaration of variable `requests' here is never used.",
+			"default timestamp source after metric:2:1-31: Default timestamp source must be set before any metrics are declared.",
+			"\tTry moving `default_timestamp_source' to the top of the program."}},
+
+	{"default timestamp source twice",
+		`default_timestamp_source scrape
+default_timestamp_source log
+`, []string{
+			"default timestamp source twice:2:1-28: Default timestamp source is already set."}},
 }
 
 func TestCheckInvalidPrograms(t *testing.T) {
@@ -284,6 +727,43 @@ var checkerValidPrograms = []struct {
 /(.*)/ {
   foo += $1
 }
+`,
+	},
+
+	{"metric types",
+		`counter requests @metric_type("untyped")
+counter bytes @metric_type("gauge")
+histogram_adaptive latency @metric_type("summary")
+/(\d+) (\d+)/ {
+  requests++
+  bytes += $1
+  latency = $2
+}
+`,
+	},
+
+	{"hll add",
+		`hll unique_clients by vhost
+gauge clients
+/(?P<vhost>\S+) (?P<ip>\S+) (?P<port>\d+)/ {
+  hll_add(unique_clients[$vhost], $ip)
+  hll_add(unique_clients["ports"], $port)
+  clients = unique_clients[$vhost]
+}
+`,
+	},
+	{"info metric",
+		`info build_info {
+  version: "1.0",
+  host: getenv("HOSTNAME")
+}
+`,
+	},
+	{"accesslog",
+		`counter requests by status
+/ HTTP\/1\.1" / {
+  requests[accesslog("combined", "status")]++
+}
 `,
 	},
 	{"shadowed positionals",
@@ -348,6 +828,10 @@ var checkerValidPrograms = []struct {
 
 	{"strptime format", `
 strptime("2006-01-02 15:04:05", "2006-01-02 15:04:05")
+`},
+
+	{"strptime posix format", `
+strptime("2019-03-04 05:06:07", "%Y-%m-%d %H:%M:%S")
 `},
 
 	{"string concat", `
@@ -437,6 +921,45 @@ histogram foo buckets 1, 2, 3
 /(\d+)/ {
   foo = $1
 }`},
+
+	{"filename labels", `
+filename_labels /tenant-(?P<tenant>[^\/]+)\//
+counter requests by code
+/(?P<code>\d+)/ {
+  requests[$code]++
+}`},
+
+	{"exclude", `
+counter requests
+exclude /healthz/
+def syslog {
+  /(?P<date>\w+) (?P<line>.*)/ {
+    next
+  }
+}
+exclude /^DEBUG/
+@syslog {
+  /GET/ {
+    requests++
+  }
+}`},
+
+	{"debug_print", `
+counter requests by code
+/(?P<code>\d+) (?P<path>\S+)/ {
+  debug_print("code %d for %s, %d so far", $code, $path, requests[$code])
+  debug_print("no values")
+  requests[$code]++
+}`},
+
+	{"timestamp source", `
+default_timestamp_source scrape
+counter requests by code timestamp_source log
+gauge queue_length
+/(?P<code>\d+) (?P<queued>\d+)/ {
+  requests[$code]++
+  queue_length = $queued
+}`},
 }
 
 func TestCheckValidPrograms(t *testing.T) {
@@ -505,3 +1028,35 @@ func TestCheckTypeExpressions(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckTimestampSourceLeavesDecl(t *testing.T) {
+	prog := `default_timestamp_source scrape
+counter requests
+counter errors timestamp_source log
+/x/ {
+  requests++
+  errors++
+}
+`
+	root, err := parser.Parse("timestamp", strings.NewReader(prog))
+	testutil.FatalIfErr(t, err)
+	root, err = checker.Check(root)
+	testutil.FatalIfErr(t, err)
+	var decls []*ast.VarDecl
+	for _, n := range root.(*ast.StmtList).Children {
+		if d, ok := n.(*ast.VarDecl); ok {
+			decls = append(decls, d)
+		}
+	}
+	if len(decls) != 2 {
+		t.Fatalf("expected 2 declarations, got %d", len(decls))
+	}
+	// The default is recorded as the time source, and not written back to
+	// the declaration as if it were given.
+	if decls[0].Timestamp != "" || decls[0].TimeSource != metrics.ScrapeTime {
+		t.Errorf("requests: timestamp %q, time source %v", decls[0].Timestamp, decls[0].TimeSource)
+	}
+	if decls[1].Timestamp != "log" || decls[1].TimeSource != metrics.LogTime {
+		t.Errorf("errors: timestamp %q, time source %v", decls[1].Timestamp, decls[1].TimeSource)
+	}
+}
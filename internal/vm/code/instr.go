@@ -12,6 +12,14 @@ type Instr struct {
 	SourceLine int // Line number of the original source file, zero-based numbering.
 }
 
+// Formats is the operand of an Fmatch instruction, matching the formats of a
+// block in order.
+type Formats struct {
+	Index  int      // The index of the first format's regular expression, and of the match result.
+	Tags   []string // The tag of each format.
+	Groups [][]int  // The offsets in each format's match of the block's named capture groups.
+}
+
 // debug print for instructions
 func (i Instr) String() string {
 	return fmt.Sprintf("{%s %v %d}", opNames[i.Opcode], i.Operand, i.SourceLine)
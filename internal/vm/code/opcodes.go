@@ -8,9 +8,15 @@ type Opcode int
 
 const (
 	Bad        Opcode = iota // Invalid instruction, indicates a bug in the generator.
+	Nop                      // Do nothing.
 	Stop                     // Stop the program, ending processing of this input.
 	Match                    // Match a regular expression against input, and set the match register.
 	Smatch                   // Match a regular expression against top of stack, and set the match register.
+	Exclude                  // Match the regular expression at operand against input, and stop the program if it matches.
+	Accumulate               // Pop a value for each capture group name in operand and a key, and store the values by name under the key.
+	Finalize                 // Pop a key, take the values stored under it for Accget to read, and push true if there were any.
+	Accget                   // Pop a capture group name, and push the value of the group taken by Finalize.
+	Fmatch                   // Match the formats at operand against input in turn, and set the match register from the first that matches.
 	Cmp                      // Compare two values on the stack and set the match register.
 	Jnm                      // Jump if no match.
 	Jm                       // Jump if match.
@@ -21,10 +27,13 @@ const (
 	Timestamp                // Return value of timestamp register onto TOS.
 	Settime                  // Set timestamp register to value at TOS.
 	Push                     // Push operand onto stack
+	Pop                      // Pop `operand` values off the stack and discard them.
 	Capref                   // Push capture group reference at operand onto stack
 	Str                      // Push string constant at operand onto stack
 	Sset                     // Set a string variable value.
 	Iset                     // Set a variable value
+	Imax                     // Pop a value and a datum, and set the datum to the value if it's greater.
+	Imin                     // Pop a value and a datum, and set the datum to the value if it's less.
 	Iadd                     // Add top values on stack and push to stack
 	Isub                     // Subtract top value from second top value on stack, and push to stack.
 	Imul                     // Multiply top values on stack and push to stack
@@ -44,7 +53,16 @@ const (
 	Fget                     // Pop a datum off the stack, and push its float value back on the stack.
 	Sget                     // Pop a datum off the stack, and push its string value back on the stack.
 	Tolower                  // Convert the string at the top of the stack to lowercase.
+	Decodeuri                // Pop a string, and push it URL-decoded, leaving invalid escapes as they are.
+	Encodeuri                // Pop a string, and push it URL-encoded for use in a query.
+	Base64dec                // Pop a base64-encoded string, and push it decoded, or "" if it's invalid.
+	Base64enc                // Pop a string, and push it base64-encoded.
+	Jsonget                  // Pop a path and a JSON string, and push the value at the path in the JSON as a string.
+	Xmlget                   // Pop an XPath and an XML string, and push the value of the first node the path selects in the XML.
 	Length                   // Compute the length of a string.
+	Crc32                    // Pop a string, and push its IEEE CRC-32 checksum.
+	Fnv32                    // Pop a string, and push its 32-bit FNV-1a hash.
+	Duration                 // Pop a duration string, and push its number of seconds, or 0 if it's not a duration.
 	Cat                      // string concatenation
 	Setmatched               // Set "matched" flag
 	Otherwise                // Only match if "matched" flag is false.
@@ -59,8 +77,18 @@ const (
 	Fmod
 	Fpow
 	Fset // Floating point assignment
+	Fmax // Pop a value and a datum, and set the floating point datum to the value if it's greater.
+	Fmin // Pop a value and a datum, and set the floating point datum to the value if it's less.
+	Finc // Pop a delta and a datum, add the delta to the floating point datum atomically, and push its new value.
 
 	Getfilename // Push input.Filename onto the stack.
+	Logfmt      // Pop a key, and push its value in the input line parsed as logfmt, or the empty string if the key is absent.
+	Journal     // Pop a field name, and push the value of that field of the input line's journal entry, or the empty string if it has none.
+	Accesslog   // Pop a field name and an access log format, and push the field's value in the input line parsed with the format, or the empty string if the line doesn't match.
+	Geoip       // Pop a field name and an IP address, and push the field of the address's record in the GeoIP database, or "unknown" if it has none.
+	Hash        // Pop an algorithm if `operand` is 2, and a string, and push the hex-encoded hash of the string.
+	Hlladd      // Pop a value and an hll datum, and add the value, as a string, to the datum's sketch.
+	Debugprint  // Pop `operand`-1 values and a format string, and write the formatted values to the debug log.
 
 	// Conversions
 	I2f // int to float
@@ -74,13 +102,30 @@ const (
 	Fcmp // floating point compare
 	Scmp // string compare
 
+	// Sampling
+	Sample  // Push true if this is every `operand`th visit to this instruction, else false.
+	Rsample // Push true with probability 1/`operand`, else false.
+
+	Bucket   // Pop `operand`-1 boundaries and a value, and push the label of the range the value falls in.
+	Collapse // Pop `operand`-1 path templates and a path, and push the path collapsed to the first matching template, or with its identifier segments replaced by ":id".
+
+	// Iterating over every match of a regular expression
+	Findall   // Find all matches of the regular expression at operand in the input, for iteration by Nextmatch.
+	Nextmatch // Set the match register to the next match of the regular expression at operand and push true, or push false if there are no more.
+
 	lastOpcode
 )
 
 var opNames = map[Opcode]string{
+	Nop:         "nop",
 	Stop:        "stop",
 	Match:       "match",
 	Smatch:      "smatch",
+	Exclude:     "exclude",
+	Accumulate:  "accumulate",
+	Finalize:    "finalize",
+	Accget:      "accget",
+	Fmatch:      "fmatch",
 	Cmp:         "cmp",
 	Jnm:         "jnm",
 	Jm:          "jm",
@@ -90,10 +135,13 @@ var opNames = map[Opcode]string{
 	Timestamp:   "timestamp",
 	Settime:     "settime",
 	Push:        "push",
+	Pop:         "pop",
 	Capref:      "capref",
 	Str:         "str",
 	Sset:        "sset",
 	Iset:        "iset",
+	Imax:        "imax",
+	Imin:        "imin",
 	Iadd:        "iadd",
 	Isub:        "isub",
 	Imul:        "imul",
@@ -113,7 +161,16 @@ var opNames = map[Opcode]string{
 	Fget:        "fget",
 	Sget:        "sget",
 	Tolower:     "tolower",
+	Decodeuri:   "decodeuri",
+	Encodeuri:   "encodeuri",
+	Base64dec:   "base64dec",
+	Base64enc:   "base64enc",
+	Jsonget:     "jsonget",
+	Xmlget:      "xmlget",
 	Length:      "length",
+	Crc32:       "crc32",
+	Fnv32:       "fnv32",
+	Duration:    "duration",
 	Cat:         "cat",
 	Setmatched:  "setmatched",
 	Otherwise:   "otherwise",
@@ -125,7 +182,17 @@ var opNames = map[Opcode]string{
 	Fmod:        "fmod",
 	Fpow:        "fpow",
 	Fset:        "fset",
+	Fmax:        "fmax",
+	Fmin:        "fmin",
+	Finc:        "finc",
 	Getfilename: "getfilename",
+	Logfmt:      "logfmt",
+	Journal:     "journal",
+	Accesslog:   "accesslog",
+	Geoip:       "geoip",
+	Hash:        "hash",
+	Hlladd:      "hlladd",
+	Debugprint:  "debugprint",
 	I2f:         "i2f",
 	S2i:         "s2i",
 	S2f:         "s2f",
@@ -134,6 +201,12 @@ var opNames = map[Opcode]string{
 	Icmp:        "icmp",
 	Fcmp:        "fcmp",
 	Scmp:        "scmp",
+	Sample:      "sample",
+	Rsample:     "rsample",
+	Bucket:      "bucket",
+	Collapse:    "collapse",
+	Findall:     "findall",
+	Nextmatch:   "nextmatch",
 }
 
 func (o Opcode) String() string {
@@ -6,7 +6,9 @@ package codegen
 import (
 	"fmt"
 	"math"
+	"os"
 	"regexp"
+	"sort"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,11 +33,37 @@ type codegen struct {
 
 	l     []int           // Label table for recording jump destinations.
 	decos []*ast.DecoStmt // Decorator stack to unwind when entering decorated blocks.
+
+	samples map[*symbol.Symbol]*ast.SampleSpec // Sample specifications of sampled metrics.
+	labels  map[*symbol.Symbol][]int           // Indexes in the string table of the static label values of each metric.
+
+	fileLabels *fileLabels // The filename labels of all the metrics, if declared.
+
+	debugPrint bool // If set, debug_print() calls are compiled, else they're compiled to a nop.
+}
+
+// fileLabels describes the labels that a program takes from the capture
+// groups of a pattern matched against the filename of each line.
+type fileLabels struct {
+	index  int      // index of the pattern in the object's regexps
+	groups []int    // capture group of each label
+	names  []string // name of each label
+}
+
+// DebugPrint sets whether the code generator compiles calls to debug_print().
+// If not, they're compiled to a nop without evaluating their arguments.
+func DebugPrint(enabled bool) func(*codegen) {
+	return func(c *codegen) {
+		c.debugPrint = enabled
+	}
 }
 
 // CodeGen is the function that compiles the program to bytecode and data.
-func CodeGen(name string, n ast.Node) (*object.Object, error) {
-	c := &codegen{name: name}
+func CodeGen(name string, n ast.Node, options ...func(*codegen)) (*object.Object, error) {
+	c := &codegen{name: name, samples: make(map[*symbol.Symbol]*ast.SampleSpec), labels: make(map[*symbol.Symbol][]int)}
+	for _, option := range options {
+		option(c)
+	}
 	_ = ast.Walk(c, n)
 	c.writeJumps()
 	if len(c.errors) > 0 {
@@ -70,6 +98,147 @@ func (c *codegen) pc() int {
 	return len(c.obj.Program) - 1
 }
 
+// compilePattern compiles the regular expression of n into the object's
+// regexp constants, storing its location in n.Index.  It returns false if the
+// pattern doesn't compile.
+func (c *codegen) compilePattern(n *ast.PatternExpr) bool {
+	re, err := regexp.Compile(n.Pattern)
+	if err != nil {
+		c.errorf(n.Pos(), "%s", err)
+		return false
+	}
+	c.obj.Regexps = append(c.obj.Regexps, re)
+	// Store the location of this regular expression in the patterNode
+	n.Index = len(c.obj.Regexps) - 1
+	return true
+}
+
+// foreach emits a loop that executes the body of n once for every match of
+// its pattern in the input line.
+func (c *codegen) foreach(n *ast.CondStmt) (ast.Visitor, ast.Node) {
+	p, ok := n.Cond.(*ast.PatternExpr)
+	if !ok {
+		c.errorf(n.Pos(), "foreach condition is not a pattern: %#v", n.Cond)
+		return nil, n
+	}
+	if !c.compilePattern(p) {
+		return nil, n
+	}
+	lLoop := c.newLabel()
+	lEnd := c.newLabel()
+	c.emit(p, code.Findall, p.Index)
+	c.setLabel(lLoop)
+	c.emit(p, code.Nextmatch, p.Index)
+	c.emit(n, code.Jnm, lEnd)
+	// Set matched flag false for children.
+	c.emit(n, code.Setmatched, false)
+	n.Truth = ast.Walk(c, n.Truth)
+	// Re-set matched flag to true for rest of current block.
+	c.emit(n, code.Setmatched, true)
+	c.emit(n, code.Jmp, lLoop)
+	c.setLabel(lEnd)
+	return nil, n
+}
+
+// accumulateKey emits the key of an accumulate statement or a finalize block,
+// as a string.
+func (c *codegen) accumulateKey(n ast.Node) {
+	ast.Walk(c, n)
+	if types.Equals(n.Type(), types.Float) {
+		c.emit(n, code.F2s, nil)
+	} else if types.Equals(n.Type(), types.Int) {
+		c.emit(n, code.I2s, nil)
+	}
+}
+
+// formats compiles the patterns of a formats block and emits the instruction
+// that matches them.  The block's match result holds the whole match,
+// followed by the named capture groups in order of name, and the tag of the
+// format that matched.
+func (c *codegen) formats(n *ast.FormatsExpr) {
+	f := &code.Formats{Index: len(c.obj.Regexps), Tags: n.Tags}
+	var names []string
+	for i, p := range n.Patterns {
+		pe, ok := p.(*ast.PatternExpr)
+		if !ok {
+			c.errorf(n.Pos(), "format %q is not a pattern: %#v", n.Tags[i], p)
+			return
+		}
+		if !c.compilePattern(pe) {
+			return
+		}
+		re := c.obj.Regexps[pe.Index]
+		if names == nil {
+			for _, name := range re.SubexpNames() {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+		}
+		groups := make([]int, len(names))
+		for j, name := range names {
+			for k, subexp := range re.SubexpNames() {
+				if subexp == name {
+					groups[j] = k
+				}
+			}
+		}
+		f.Groups = append(f.Groups, groups)
+	}
+	n.Index = f.Index
+	c.emit(n, code.Fmatch, f)
+}
+
+// sampleSpec returns the sample specification of the metric referenced by n,
+// or nil if that metric is not sampled.
+func (c *codegen) sampleSpec(n ast.Node) *ast.SampleSpec {
+	switch v := n.(type) {
+	case *ast.IndexedExpr:
+		return c.sampleSpec(v.Lhs)
+	case *ast.IdTerm:
+		if v.Symbol != nil {
+			return c.samples[v.Symbol]
+		}
+	}
+	return nil
+}
+
+// emitSampledInc emits an increment of the datum on the stack that only
+// occurs for the sampled fraction of executions, and is scaled by the sample
+// rate.  If hasDelta is set, the unscaled delta is on the stack above the
+// datum.  Either way the operands are consumed, so a sampled increment in a
+// loop doesn't grow the stack.
+func (c *codegen) emitSampledInc(n ast.Node, s *ast.SampleSpec, hasDelta bool) {
+	lSkip := c.newLabel()
+	lEnd := c.newLabel()
+	if s.Random {
+		c.emit(n, code.Rsample, s.Rate)
+	} else {
+		c.emit(n, code.Sample, s.Rate)
+	}
+	c.emit(n, code.Jnm, lSkip)
+	c.emit(n, code.Push, s.Rate)
+	if hasDelta {
+		c.emit(n, code.Imul, nil)
+	}
+	c.emit(n, code.Inc, 0)
+	// Discard the new value that Inc pushes.
+	c.emit(n, code.Pop, 1)
+	c.emit(n, code.Jmp, lEnd)
+	c.setLabel(lSkip)
+	if hasDelta {
+		c.emit(n, code.Pop, 2)
+	} else {
+		c.emit(n, code.Pop, 1)
+	}
+	c.setLabel(lEnd)
+}
+
+// defaultLearnFrom is the number of observations an adaptive histogram
+// learns its buckets from, if not given with @learn_from.
+const defaultLearnFrom = 1000
+
 func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	switch n := node.(type) {
 
@@ -101,14 +270,26 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 			dtyp = metrics.Int
 		}
-		m := metrics.NewMetric(name, c.name, n.Kind, dtyp, n.Keys...)
+		// Static labels follow the keys indexed by the program, and are
+		// followed by the filename labels.
+		keys := append(n.Keys[:len(n.Keys):len(n.Keys)], n.StaticKeys...)
+		if c.fileLabels != nil && n.Kind != metrics.Info {
+			keys = append(keys, c.fileLabels.names...)
+		}
+		m := metrics.NewMetric(name, c.name, n.Kind, dtyp, keys...)
 		m.SetSource(n.Pos().String())
+		m.Aliases = n.Aliases
+		m.PrometheusType = n.PrometheusType
+		m.ResetOnExport = n.ResetOnExport
+		m.TimeSource = n.TimeSource
 		// Scalar counters can be initialized to zero.  Dimensioned counters we
 		// don't know the values of the labels yet.  Gauges and Timers we can't
-		// assume start at zero.
-		if len(n.Keys) == 0 && n.Kind == metrics.Counter {
+		// assume start at zero.  A metric with only static labels is scalar,
+		// as the values of all its labels are known.
+		scalar := len(m.Keys) == len(n.StaticKeys)
+		if scalar && n.Kind == metrics.Counter {
 			// Calling GetDatum here causes the storage to be allocated.
-			d, err := m.GetDatum()
+			d, err := m.GetDatum(n.StaticValues...)
 			if err != nil {
 				c.errorf(n.Pos(), "%s", err)
 				return nil, n
@@ -125,7 +306,40 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 		}
 
-		if n.Kind == metrics.Histogram {
+		if n.Init != nil {
+			switch v := n.Init.(type) {
+			case *ast.IntLit:
+				if dtyp == metrics.Float {
+					m.InitialValue = float64(v.I)
+				} else {
+					m.InitialValue = v.I
+				}
+			case *ast.FloatLit:
+				m.InitialValue = v.F
+			}
+			// Scalar gauges are created now so they're exported with their
+			// initial value before any log lines are processed.
+			if scalar {
+				if _, err := m.GetDatum(n.StaticValues...); err != nil {
+					c.errorf(n.Pos(), "%s", err)
+					return nil, n
+				}
+			}
+		}
+
+		if n.Kind == metrics.Histogram && n.Adaptive {
+			learnFrom := defaultLearnFrom
+			if n.Learn != nil {
+				learnFrom = int(n.Learn.Count)
+			}
+			m.Learner = datum.NewBucketLearner(learnFrom)
+			if scalar {
+				if _, err := m.GetDatum(n.StaticValues...); err != nil {
+					c.errorf(n.Pos(), "%s", err)
+					return nil, n
+				}
+			}
+		} else if n.Kind == metrics.Histogram {
 			if len(n.Buckets) < 2 {
 				c.errorf(n.Pos(), "a histogram need at least two boundaries")
 				return nil, n
@@ -150,9 +364,9 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 			m.Buckets = append(m.Buckets, datum.Range{min, math.Inf(+1)})
 
-			if len(n.Keys) == 0 {
+			if scalar {
 				// Calling GetDatum here causes the storage to be allocated.
-				_, err := m.GetDatum()
+				_, err := m.GetDatum(n.StaticValues...)
 				if err != nil {
 					c.errorf(n.Pos(), "%s", err)
 					return nil, n
@@ -160,13 +374,45 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 		}
 
+		if n.Kind == metrics.Info {
+			// An info metric's single datum is created now, labelled with the
+			// values from its declaration as of when the program is loaded.
+			values := make([]string, 0, len(n.Values))
+			for _, v := range n.Values {
+				switch v := v.(type) {
+				case *ast.StringLit:
+					values = append(values, v.Text)
+				case *ast.BuiltinExpr:
+					// The checker only permits getenv() here.
+					values = append(values, os.Getenv(v.Args.(*ast.ExprList).Children[0].(*ast.StringLit).Text))
+				}
+			}
+			d, err := m.GetDatum(values...)
+			if err != nil {
+				c.errorf(n.Pos(), "%s", err)
+				return nil, n
+			}
+			datum.SetInt(d, 1, time.Now())
+		}
+
 		m.Hidden = n.Hidden
+		m.Window = n.Window
+		if n.Sample != nil {
+			c.samples[n.Symbol] = n.Sample
+		}
+		for _, v := range n.StaticValues {
+			c.obj.Strings = append(c.obj.Strings, v)
+			c.labels[n.Symbol] = append(c.labels[n.Symbol], len(c.obj.Strings)-1)
+		}
 		n.Symbol.Binding = m
 		n.Symbol.Addr = len(c.obj.Metrics)
 		c.obj.Metrics = append(c.obj.Metrics, m)
 		return nil, n
 
 	case *ast.CondStmt:
+		if n.Foreach {
+			return c.foreach(n)
+		}
 		lElse := c.newLabel()
 		lEnd := c.newLabel()
 		if n.Cond != nil {
@@ -188,15 +434,24 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.setLabel(lEnd)
 		return nil, n
 
+	case *ast.BuiltinExpr:
+		if n.Name == "getenv" {
+			// Environment variables are read once at compile time, and
+			// stored as string constants.
+			name := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit).Text
+			c.obj.Strings = append(c.obj.Strings, os.Getenv(name))
+			c.emit(n, code.Str, len(c.obj.Strings)-1)
+			return nil, n
+		}
+		if n.Name == "debug_print" && !c.debugPrint {
+			c.emit(n, code.Nop, nil)
+			return nil, n
+		}
+
 	case *ast.PatternExpr:
-		re, err := regexp.Compile(n.Pattern)
-		if err != nil {
-			c.errorf(n.Pos(), "%s", err)
+		if !c.compilePattern(n) {
 			return nil, n
 		}
-		c.obj.Regexps = append(c.obj.Regexps, re)
-		// Store the location of this regular expression in the patterNode
-		n.Index = len(c.obj.Regexps) - 1
 		c.emit(n, code.Match, n.Index)
 
 	case *ast.StringLit:
@@ -220,8 +475,19 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.errorf(n.Pos(), "No metric bound to identifier %q", n.Name)
 			return nil, n
 		}
-		c.emit(n, code.Mload, n.Symbol.Addr)
 		m := n.Symbol.Binding.(*metrics.Metric)
+		// Static labels follow any keys pushed by an enclosing index.
+		for _, i := range c.labels[n.Symbol] {
+			c.emit(n, code.Str, i)
+		}
+		// Filename labels follow those.
+		if c.fileLabels != nil && m.Kind != metrics.Info {
+			for _, g := range c.fileLabels.groups {
+				c.emit(n, code.Push, c.fileLabels.index)
+				c.emit(n, code.Capref, g)
+			}
+		}
+		c.emit(n, code.Mload, n.Symbol.Addr)
 		c.emit(n, code.Dload, len(m.Keys))
 
 		if !n.Lvalue {
@@ -248,10 +514,17 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.errorf(n.Pos(), "No regular expression bound to capref %q", n.Name)
 			return nil, n
 		}
-		rn := n.Symbol.Binding.(*ast.PatternExpr)
-		// rn.index contains the index of the compiled regular expression object
-		// in the re slice of the object code
-		c.emit(n, code.Push, rn.Index)
+		// The index of the compiled regular expression object in the re
+		// slice of the object code locates the match result.
+		switch rn := n.Symbol.Binding.(type) {
+		case *ast.PatternExpr:
+			c.emit(n, code.Push, rn.Index)
+		case *ast.FormatsExpr:
+			c.emit(n, code.Push, rn.Index)
+		default:
+			c.errorf(n.Pos(), "capref %q bound to %T", n.Name, rn)
+			return nil, n
+		}
 		// n.Symbol.Addr is the capture group offset
 		c.emit(n, code.Capref, n.Symbol.Addr)
 		if types.Equals(n.Type(), types.Float) {
@@ -304,6 +577,72 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.OtherwiseStmt:
 		c.emit(n, code.Otherwise, nil)
 
+	case *ast.FileLabelsStmt:
+		p, ok := n.Pattern.(*ast.PatternExpr)
+		if !ok {
+			c.errorf(n.Pos(), "filename labels pattern is not a pattern: %#v", n.Pattern)
+			return nil, n
+		}
+		if !c.compilePattern(p) {
+			return nil, n
+		}
+		// Lines from files whose names don't match can't be labelled, so the
+		// program stops.
+		lMatch := c.newLabel()
+		c.emit(n, code.Getfilename, nil)
+		c.emit(n, code.Smatch, p.Index)
+		c.emit(n, code.Jm, lMatch)
+		c.emit(n, code.Stop, nil)
+		c.setLabel(lMatch)
+		c.fileLabels = &fileLabels{index: p.Index}
+		for i, name := range c.obj.Regexps[p.Index].SubexpNames() {
+			if name != "" {
+				c.fileLabels.groups = append(c.fileLabels.groups, i)
+				c.fileLabels.names = append(c.fileLabels.names, name)
+			}
+		}
+		return nil, n
+
+	case *ast.ExcludeStmt:
+		p, ok := n.Pattern.(*ast.PatternExpr)
+		if !ok {
+			c.errorf(n.Pos(), "exclude pattern is not a pattern: %#v", n.Pattern)
+			return nil, n
+		}
+		if !c.compilePattern(p) {
+			return nil, n
+		}
+		c.emit(n, code.Exclude, p.Index)
+		return nil, n
+
+	case *ast.FormatsExpr:
+		c.formats(n)
+		return nil, n
+
+	case *ast.AccumulateStmt:
+		c.accumulateKey(n.Key)
+		names := make([]string, len(n.Fields))
+		for i, sym := range n.Fields {
+			names[i] = sym.Name
+			switch rn := sym.Binding.(type) {
+			case *ast.PatternExpr:
+				c.emit(n, code.Push, rn.Index)
+			case *ast.FormatsExpr:
+				c.emit(n, code.Push, rn.Index)
+			default:
+				c.errorf(n.Pos(), "capref %q bound to %T", sym.Name, rn)
+				return nil, n
+			}
+			c.emit(n, code.Capref, sym.Addr)
+		}
+		c.emit(n, code.Accumulate, names)
+		return nil, n
+
+	case *ast.FinalizeExpr:
+		c.accumulateKey(n.Key)
+		c.emit(n, code.Finalize, nil)
+		return nil, n
+
 	case *ast.DelStmt:
 		if n.Expiry > 0 {
 			c.emit(n, code.Push, n.Expiry)
@@ -347,7 +686,7 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			return nil, n
 
 		case parser.ADD_ASSIGN:
-			if !types.Equals(n.Type(), types.Int) {
+			if types.Equals(n.Type(), types.String) {
 				// Double-emit the lhs so that it can be assigned to
 				ast.Walk(c, n.Lhs)
 			}
@@ -378,6 +717,10 @@ var typedOperators = map[int]map[types.Type]code.Opcode{
 	parser.ASSIGN: {types.Int: code.Iset,
 		types.Float:  code.Fset,
 		types.String: code.Sset},
+	parser.MAX_ASSIGN: {types.Int: code.Imax,
+		types.Float: code.Fmax},
+	parser.MIN_ASSIGN: {types.Int: code.Imin,
+		types.Float: code.Fmin},
 }
 
 func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
@@ -394,13 +737,32 @@ func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
 }
 
 var builtin = map[string]code.Opcode{
-	"getfilename": code.Getfilename,
-	"len":         code.Length,
-	"settime":     code.Settime,
-	"strptime":    code.Strptime,
-	"strtol":      code.S2i,
-	"timestamp":   code.Timestamp,
-	"tolower":     code.Tolower,
+	"accesslog":            code.Accesslog,
+	"accumulated":          code.Accget,
+	"base64_decode":        code.Base64dec,
+	"base64_encode":        code.Base64enc,
+	"bucket":               code.Bucket,
+	"collapse":             code.Collapse,
+	"crc32":                code.Crc32,
+	"debug_print":          code.Debugprint,
+	"decode_uri_component": code.Decodeuri,
+	"duration":             code.Duration,
+	"encode_uri_component": code.Encodeuri,
+	"fnv32":                code.Fnv32,
+	"geoip":                code.Geoip,
+	"hash":                 code.Hash,
+	"hll_add":              code.Hlladd,
+	"getfilename":          code.Getfilename,
+	"journalfield":         code.Journal,
+	"json_extract":         code.Jsonget,
+	"len":                  code.Length,
+	"logfmt":               code.Logfmt,
+	"settime":              code.Settime,
+	"strptime":             code.Strptime,
+	"strtol":               code.S2i,
+	"timestamp":            code.Timestamp,
+	"tolower":              code.Tolower,
+	"xml_extract":          code.Xmlget,
 }
 
 func (c *codegen) VisitAfter(node ast.Node) ast.Node {
@@ -431,7 +793,11 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 	case *ast.UnaryExpr:
 		switch n.Op {
 		case parser.INC:
-			c.emit(n, code.Inc, nil)
+			if s := c.sampleSpec(n.Expr); s != nil {
+				c.emitSampledInc(n, s, false)
+			} else {
+				c.emit(n, code.Inc, nil)
+			}
 		case parser.DEC:
 			c.emit(n, code.Dec, nil)
 		case parser.NOT:
@@ -488,8 +854,16 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			// When operand is not nil, inc pops the delta from the stack.
 			switch {
 			case types.Equals(n.Type(), types.Int):
-				c.emit(n, code.Inc, 0)
-			case types.Equals(n.Type(), types.Float), types.Equals(n.Type(), types.String):
+				if s := c.sampleSpec(n.Lhs); s != nil {
+					c.emitSampledInc(n, s, true)
+				} else {
+					c.emit(n, code.Inc, 0)
+				}
+			case types.Equals(n.Type(), types.Float):
+				// The datum is incremented in one instruction, so that
+				// concurrent increments aren't lost.
+				c.emit(n, code.Finc, nil)
+			case types.Equals(n.Type(), types.String):
 				// Already walked the lhs and rhs of this expression
 				opcode, err := getOpcodeForType(parser.PLUS, n.Type())
 				if err != nil {
@@ -508,7 +882,7 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				c.errorf(n.Pos(), "invalid type for add-assignment: %v", n.Type())
 				return n
 			}
-		case parser.PLUS, parser.MINUS, parser.MUL, parser.DIV, parser.MOD, parser.POW, parser.ASSIGN:
+		case parser.PLUS, parser.MINUS, parser.MUL, parser.DIV, parser.MOD, parser.POW, parser.ASSIGN, parser.MAX_ASSIGN, parser.MIN_ASSIGN:
 			opcode, err := getOpcodeForType(n.Op, n.Type())
 			if err != nil {
 				c.errorf(n.Pos(), "%s", err)
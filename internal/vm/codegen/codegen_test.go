@@ -41,6 +41,42 @@ var testCodeGenPrograms = []struct {
 			{code.Dload, 0, 1},
 			{code.Inc, nil, 1},
 			{code.Setmatched, true, 1}}},
+	{"sampled counter",
+		"counter lines_total sample 10\n/$/ { lines_total++\n }\n",
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 13, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 1},
+			{code.Dload, 0, 1},
+			{code.Sample, int64(10), 1},
+			{code.Jnm, 11, 1},
+			{code.Push, int64(10), 1},
+			{code.Inc, 0, 1},
+			{code.Pop, 1, 1},
+			{code.Jmp, 12, 1},
+			{code.Pop, 1, 1},
+			{code.Setmatched, true, 1}}},
+	{"randomly sampled counter add",
+		"counter bytes_total sample random 4\n/(\\d+)/ { bytes_total += $1\n }\n",
+		[]code.Instr{
+			{code.Match, 0, 1},
+			{code.Jnm, 17, 1},
+			{code.Setmatched, false, 1},
+			{code.Mload, 0, 1},
+			{code.Dload, 0, 1},
+			{code.Push, 0, 1},
+			{code.Capref, 1, 1},
+			{code.S2i, nil, 1},
+			{code.Rsample, int64(4), 1},
+			{code.Jnm, 15, 1},
+			{code.Push, int64(4), 1},
+			{code.Imul, nil, 1},
+			{code.Inc, 0, 1},
+			{code.Pop, 1, 1},
+			{code.Jmp, 16, 1},
+			{code.Pop, 2, 1},
+			{code.Setmatched, true, 1}}},
 	{"strptime and capref",
 		"counter foo\n" +
 			"/(.*)/ { strptime($1, \"2006-01-02T15:04:05\")\n" +
@@ -335,6 +371,16 @@ a["string"]++
 			{code.Mload, 0, 2},
 			{code.Dload, 1, 2},
 			{code.Inc, nil, 2}}},
+	{"static label", `
+counter a by b, c: "x"
+a["string"]++
+`,
+		[]code.Instr{
+			{code.Str, 1, 2},
+			{code.Str, 0, 2},
+			{code.Mload, 0, 2},
+			{code.Dload, 2, 2},
+			{code.Inc, nil, 2}}},
 	{"strtol", `
 strtol("deadbeef", 16)
 `,
@@ -361,6 +407,22 @@ otherwise {
 			{code.Dload, 0, 3},
 			{code.Inc, nil, 3},
 			{code.Setmatched, true, 4}}},
+	{"foreach", `
+counter a
+foreach /\d+/ {
+	a++
+}
+`,
+		[]code.Instr{
+			{code.Findall, 0, 2},
+			{code.Nextmatch, 0, 2},
+			{code.Jnm, 9, 2},
+			{code.Setmatched, false, 2},
+			{code.Mload, 0, 3},
+			{code.Dload, 0, 3},
+			{code.Inc, nil, 3},
+			{code.Setmatched, true, 2},
+			{code.Jmp, 1, 2}}},
 	{"cond else",
 		`counter foo
 counter bar
@@ -422,6 +484,88 @@ del a["string"] after 1h
 			{code.Mload, 0, 2},
 			{code.Expire, 1, 2}},
 	},
+	{"filename labels", `
+filename_labels /(?P<tenant>\w+)\.log/
+counter a by b
+del a["string"]
+`,
+		[]code.Instr{
+			{code.Getfilename, nil, 1},
+			{code.Smatch, 0, 1},
+			{code.Jm, 4, 1},
+			{code.Stop, nil, 1},
+			{code.Str, 0, 3},
+			{code.Push, 0, 3},
+			{code.Capref, 1, 3},
+			{code.Mload, 0, 3},
+			{code.Del, 2, 3}},
+	},
+	{"exclude", `
+counter a
+exclude /healthz/
+/GET/ {
+  a++
+}
+`,
+		[]code.Instr{
+			{code.Exclude, 0, 2},
+			{code.Match, 1, 3},
+			{code.Jnm, 8, 3},
+			{code.Setmatched, false, 3},
+			{code.Mload, 0, 4},
+			{code.Dload, 0, 4},
+			{code.Inc, nil, 4},
+			{code.Setmatched, true, 3}},
+	},
+	{"max and min", `
+gauge peak
+gauge low
+/(\d+) (\d+\.\d+)/ {
+  peak max= $1
+  low min= $2
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 3},
+			{code.Jnm, 16, 3},
+			{code.Setmatched, false, 3},
+			{code.Mload, 0, 4},
+			{code.Dload, 0, 4},
+			{code.Push, 0, 4},
+			{code.Capref, 1, 4},
+			{code.S2i, nil, 4},
+			{code.Imax, nil, 4},
+			{code.Mload, 1, 5},
+			{code.Dload, 0, 5},
+			{code.Push, 0, 5},
+			{code.Capref, 2, 5},
+			{code.S2f, nil, 5},
+			{code.Fmin, nil, 5},
+			{code.Setmatched, true, 3}},
+	},
+	{"formats", `
+counter a by b
+formats {
+  x /(?P<c>\d+) (?P<b>\w+)/
+  y /b=(?P<b>\w+)/ + / c=(?P<c>\d+)/
+} {
+  a[$b] += $c
+}
+`,
+		[]code.Instr{
+			{code.Fmatch, &code.Formats{Index: 0, Tags: []string{"x", "y"}, Groups: [][]int{{2, 1}, {1, 2}}}, 2},
+			{code.Jnm, 12, 2},
+			{code.Setmatched, false, 2},
+			{code.Push, 0, 6},
+			{code.Capref, 1, 6},
+			{code.Mload, 0, 6},
+			{code.Dload, 1, 6},
+			{code.Push, 0, 6},
+			{code.Capref, 2, 6},
+			{code.S2i, nil, 6},
+			{code.Inc, 0, 6},
+			{code.Setmatched, true, 2}},
+	},
 	{"types", `
 gauge i
 gauge f
@@ -464,6 +608,34 @@ getfilename()
 		},
 	},
 
+	{"logfmt", `
+logfmt("level")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Logfmt, 1, 1},
+		},
+	},
+
+	{"accesslog", `
+accesslog("combined", "status")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Str, 1, 1},
+			{code.Accesslog, 2, 1},
+		},
+	},
+
+	{"journalfield", `
+journalfield("_SYSTEMD_UNIT")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Journal, 1, 1},
+		},
+	},
+
 	{"dimensioned counter",
 		`counter c by a,b,c
 /(\d) (\d) (\d)/ {
@@ -645,17 +817,14 @@ gauge foo
 `,
 		[]code.Instr{
 			{code.Match, 0, 2},
-			{code.Jnm, 13, 2},
+			{code.Jnm, 10, 2},
 			{code.Setmatched, false, 2},
 			{code.Mload, 0, 3},
 			{code.Dload, 0, 3},
-			{code.Mload, 0, 3},
-			{code.Dload, 0, 3},
 			{code.Push, 0, 3},
 			{code.Capref, 1, 3},
 			{code.S2f, nil, 3},
-			{code.Fadd, nil, 3},
-			{code.Fset, nil, 3},
+			{code.Finc, nil, 3},
 			{code.Setmatched, true, 2},
 		}},
 	{"match expression", `
@@ -869,6 +1038,16 @@ stop
 		{code.Stop, nil, 2},
 		{code.Setmatched, true, 1},
 	}},
+	{"debug_print disabled", `
+/(\d+)/ {
+  debug_print("got %s", $1)
+}`, []code.Instr{
+		{code.Match, 0, 1},
+		{code.Jnm, 5, 1},
+		{code.Setmatched, false, 1},
+		{code.Nop, nil, 2},
+		{code.Setmatched, true, 1},
+	}},
 
 	{"nested decorators",
 		`def b {
@@ -910,3 +1089,28 @@ func TestCodegen(t *testing.T) {
 		})
 	}
 }
+
+func TestCodegenDebugPrint(t *testing.T) {
+	ast, err := parser.Parse("debug_print", strings.NewReader(`
+/(\S+)/ {
+  debug_print("got %s", $1)
+}`))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("debug_print", ast, codegen.DebugPrint(true))
+	testutil.FatalIfErr(t, err)
+	expected := []code.Instr{
+		{code.Match, 0, 1},
+		{code.Jnm, 8, 1},
+		{code.Setmatched, false, 1},
+		{code.Str, 0, 2},
+		{code.Push, 0, 2},
+		{code.Capref, 1, 2},
+		{code.Debugprint, 2, 2},
+		{code.Setmatched, true, 1},
+	}
+	if diff := testutil.Diff(expected, obj.Program, testutil.AllowUnexported(code.Instr{})); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -5,21 +5,20 @@ package vm
 
 import (
 	"io"
-	"path/filepath"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/codegen"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/prefilter"
 )
 
 // Compile compiles a program from the input into a virtual machine or a list
 // of compile errors.  It takes the program's name and the metric store as
-// additional arguments to build the virtual machine.
-func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
-	name = filepath.Base(name)
-
+// additional arguments to build the virtual machine.  If knownEnvVars is not
+// empty, getenv() of any other environment variable is warned about.
+func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location, knownEnvVars ...string) (*VM, error) {
 	ast, err := parser.Parse(name, input)
 	if err != nil {
 		return nil, err
@@ -29,7 +28,7 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 		glog.Infof("%s AST:\n%s", name, s.Dump(ast))
 	}
 
-	if ast, err = checker.Check(ast); err != nil {
+	if ast, err = checker.Check(ast, checker.KnownEnvVars(knownEnvVars...)); err != nil {
 		return nil, err
 	}
 	if emitAstTypes {
@@ -38,11 +37,17 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 		glog.Infof("%s AST with Type Annotation:\n%s", name, s.Dump(ast))
 	}
 
-	obj, err := codegen.CodeGen(name, ast)
+	obj, err := codegen.CodeGen(name, ast, codegen.DebugPrint(*debugVM))
 	if err != nil {
 		return nil, err
 	}
 
 	vm := New(name, obj, syslogUseCurrentYear, loc)
+	vm.literals = prefilter.Literals(ast)
+	if *debugVM {
+		if vm.debugOut, err = openDebugLog(*debugLogFile); err != nil {
+			return nil, err
+		}
+	}
 	return vm, nil
 }
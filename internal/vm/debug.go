@@ -0,0 +1,52 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// debugLog is a writer that debug_print() writes to, shared by every program
+// that writes to the same file, so that lines written by line workers at the
+// same time don't interleave.
+type debugLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *debugLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+var (
+	debugLogsMu sync.Mutex
+	debugLogs   = make(map[string]*debugLog) // by path, "" for standard error
+)
+
+// openDebugLog returns the debug log that writes to the file at path, opening
+// the file for appending the first time it's asked for, or to standard error
+// if path is empty.
+func openDebugLog(path string) (io.Writer, error) {
+	debugLogsMu.Lock()
+	defer debugLogsMu.Unlock()
+	if l, ok := debugLogs[path]; ok {
+		return l, nil
+	}
+	l := &debugLog{w: os.Stderr}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open the debug log")
+		}
+		l.w = f
+	}
+	debugLogs[path] = l
+	return l, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupKey identifies a log line by its content and the log it came from.
+type dedupKey struct {
+	filename string
+	line     string
+}
+
+// dedupEntry records when a line was processed, and whether it matched.
+type dedupEntry struct {
+	key     dedupKey
+	time    time.Time
+	done    chan struct{} // closed once the line has been processed
+	matched bool          // set before done is closed
+}
+
+// Done records whether the line matched, once it has been processed.
+func (e *dedupEntry) Done(matched bool) {
+	e.matched = matched
+	close(e.done)
+}
+
+// Matched waits for the line to be processed, and returns whether it matched.
+func (e *dedupEntry) Matched() bool {
+	<-e.done
+	return e.matched
+}
+
+// deduper remembers the log lines processed within a time window, so that
+// identical lines seen again within the window can be suppressed.  Suppressed
+// lines don't extend the window, so a line that keeps repeating is processed
+// once per window.  At most maxLines lines are remembered; beyond that the
+// oldest are forgotten before their window has passed.
+type deduper struct {
+	window   time.Duration
+	maxLines int              // If positive, the most lines remembered.
+	now      func() time.Time // Source of the current time.
+
+	mu    sync.Mutex               // guards access to the fields below
+	seen  map[dedupKey]*dedupEntry // lines processed within the window
+	order []*dedupEntry            // entries of seen, oldest first
+}
+
+// newDeduper creates a deduper that suppresses lines seen within window,
+// remembering at most maxLines of them if maxLines is positive.
+func newDeduper(window time.Duration, maxLines int) *deduper {
+	return &deduper{
+		window:   window,
+		maxLines: maxLines,
+		now:      time.Now,
+		seen:     make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// Begin returns the entry of the line with key and true if it was processed
+// within the window.  Otherwise it remembers the line in a new entry, which
+// the caller marks Done once it has processed the line, and returns false.
+// The check and the record are one step, so that line workers seeing the same
+// line at once process it only once.
+func (d *deduper) Begin(key dedupKey) (e *dedupEntry, dup bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.expire(now)
+	if e, ok := d.seen[key]; ok {
+		return e, true
+	}
+	e = &dedupEntry{key: key, time: now, done: make(chan struct{})}
+	d.seen[key] = e
+	d.order = append(d.order, e)
+	for d.maxLines > 0 && len(d.seen) > d.maxLines {
+		d.forgetOldest()
+	}
+	return e, false
+}
+
+// expire forgets the lines processed longer ago than the window.
+func (d *deduper) expire(now time.Time) {
+	for len(d.order) > 0 && now.Sub(d.order[0].time) >= d.window {
+		d.forgetOldest()
+	}
+}
+
+// forgetOldest forgets the line processed longest ago.
+func (d *deduper) forgetOldest() {
+	e := d.order[0]
+	d.order = d.order[1:]
+	if d.seen[e.key] == e {
+		delete(d.seen, e.key)
+	}
+}
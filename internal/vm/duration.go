@@ -0,0 +1,29 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDuration returns the number of seconds in a duration written like Go's
+// `1h2m3.5s`, `300µs` or `12ms`, and false if s isn't one.  Space around and
+// within the duration is ignored, microseconds may be written `us`, and a
+// number without a unit is a number of seconds.
+func parseDuration(s string) (float64, bool) {
+	s = strings.Join(strings.Fields(s), "")
+	if s == "" {
+		return 0, false
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+var parseDurationTests = []struct {
+	in       string
+	expected float64
+	ok       bool
+}{
+	{"12ms", 0.012, true},
+	{"1.5s", 1.5, true},
+	{"300µs", 0.0003, true},
+	{"300μs", 0.0003, true},
+	{"300us", 0.0003, true},
+	{"250ns", 0.00000025, true},
+	{"2m", 120, true},
+	{"1h", 3600, true},
+	{"1m30s", 90, true},
+	{"1s500ms", 1.5, true},
+	{"-1.5s", -1.5, true},
+	{" 12 ms ", 0.012, true},
+	{"0", 0, true},
+	{"0.25", 0.25, true},
+	{"", 0, false},
+	{"ms", 0, false},
+	{"12", 12, true},
+	{"12 parsecs", 0, false},
+	{"1.5.s", 0, false},
+	{"-", 0, false},
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range parseDurationTests {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			got, ok := parseDuration(tc.in)
+			if ok != tc.ok || got != tc.expected {
+				t.Errorf("parseDuration(%q): expected %g, %v, got %g, %v", tc.in, tc.expected, tc.ok, got, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+)
+
+// hashFuncs are the hash functions of the algorithms hash() computes, by name.
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashString returns the hex-encoded hash of s with the named algorithm, as
+// an HMAC keyed with secret if it's not empty.  The result is truncated to
+// n hex digits if n is positive.
+func hashString(s, algorithm string, secret []byte, n int) string {
+	f, ok := hashFuncs[algorithm]
+	if !ok {
+		f = sha256.New
+	}
+	var h hash.Hash
+	if len(secret) > 0 {
+		h = hmac.New(f, secret)
+	} else {
+		h = f()
+	}
+	h.Write([]byte(s)) // nolint:errcheck
+	sum := hex.EncodeToString(h.Sum(nil))
+	if n > 0 && n < len(sum) {
+		sum = sum[:n]
+	}
+	return sum
+}
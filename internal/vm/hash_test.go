@@ -0,0 +1,36 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+var hashStringTests = []struct {
+	name      string
+	algorithm string
+	secret    string
+	n         int
+	expected  string
+}{
+	{"sha256", "sha256", "", 0, "2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90"},
+	{"sha256 truncated", "sha256", "", 16, "2bd806c97f0e00af"},
+	{"md5", "md5", "", 0, "6384e2b2184bcbf58eccf10ca7a6563c"},
+	{"sha1", "sha1", "", 8, "522b276a"},
+	{"sha512", "sha512", "", 16, "408b27d3097eea5a"},
+	{"longer than hash", "md5", "", 100, "6384e2b2184bcbf58eccf10ca7a6563c"},
+	{"hmac", "sha256", "s3cret", 0, "765542af1f1d587bc60c218dca532a258f56b9c21a427cc819de2a1ff6d3e146"},
+	{"hmac md5", "md5", "s3cret", 16, "75881059b4ba3bc6"},
+}
+
+func TestHashString(t *testing.T) {
+	for _, tc := range hashStringTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hashString("alice", tc.algorithm, []byte(tc.secret), tc.n); got != tc.expected {
+				t.Errorf("hashString(%q, %q, %q, %d): expected %q, got %q", "alice", tc.algorithm, tc.secret, tc.n, tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sync"
+)
+
+// interner stores one copy of each distinct string given to it.  Label values
+// and text values recorded by a program are interned, so that a value repeated
+// across many label sets is stored once, and values captured from log lines
+// don't keep the rest of the line alive.  Strings are never removed, so the
+// table grows with the number of distinct values seen.
+type interner struct {
+	strings sync.Map // string to its stored copy
+}
+
+// intern returns the stored copy of s, storing a copy of it first if it hasn't
+// been seen.
+func (i *interner) intern(s string) string {
+	if c, ok := i.strings.Load(s); ok {
+		return c.(string)
+	}
+	// Copy s so the stored string doesn't refer to the line it was matched in.
+	c := string([]byte(s))
+	v, _ := i.strings.LoadOrStore(c, c)
+	return v.(string)
+}
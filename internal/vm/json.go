@@ -0,0 +1,122 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// parsedJSON is a string parsed as a JSON document.
+type parsedJSON struct {
+	src string
+	doc interface{}
+	err error
+}
+
+// parseJSON parses s as a JSON document, keeping numbers as they are written.
+func parseJSON(s string) *parsedJSON {
+	p := &parsedJSON{src: s}
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	p.err = d.Decode(&p.doc)
+	return p
+}
+
+// jsonExtract returns the value at path in doc, or "" if there is none.  The
+// path is a dot separated list of object keys and array indexes, optionally
+// starting with `$`, like `$.request.headers.host` or `items[0].id`.  Strings
+// are returned without their quotes, numbers and booleans as they're written,
+// null as "", and objects as JSON.  Arrays are returned as JSON if joinArrays
+// is set, and as their first element otherwise.
+func jsonExtract(doc interface{}, path string, joinArrays bool) string {
+	steps, ok := parseJSONPath(path)
+	if !ok {
+		return ""
+	}
+	for _, step := range steps {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			if doc, ok = n[step]; !ok {
+				return ""
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(n) {
+				return ""
+			}
+			doc = n[i]
+		default:
+			return ""
+		}
+	}
+	return jsonString(doc, joinArrays)
+}
+
+// parseJSONPath splits a json_extract() path into its steps, returning false
+// if it's malformed.
+func parseJSONPath(path string) ([]string, bool) {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil, true
+	}
+	var steps []string
+	for _, field := range strings.Split(path, ".") {
+		// A field may be followed by any number of indexes, like `a[0][1]`.
+		key := field
+		if i := strings.IndexByte(field, '['); i >= 0 {
+			key = field[:i]
+			field = field[i:]
+		} else {
+			field = ""
+		}
+		switch {
+		case key != "":
+			steps = append(steps, key)
+		case field == "":
+			// An empty field, like `a..b`.
+			return nil, false
+		}
+		for field != "" {
+			end := strings.IndexByte(field, ']')
+			if field[0] != '[' || end < 0 {
+				return nil, false
+			}
+			steps = append(steps, field[1:end])
+			field = field[end+1:]
+		}
+	}
+	return steps, true
+}
+
+// jsonString formats a JSON value as json_extract() returns it.
+func jsonString(v interface{}, joinArrays bool) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return n
+	case json.Number:
+		return n.String()
+	case bool:
+		return strconv.FormatBool(n)
+	case []interface{}:
+		if !joinArrays {
+			if len(n) == 0 {
+				return ""
+			}
+			return jsonString(n[0], joinArrays)
+		}
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
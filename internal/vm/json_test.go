@@ -0,0 +1,68 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+const jsonTestDoc = `{
+  "level": "info",
+  "status": 200,
+  "latency": 0.25,
+  "cached": false,
+  "user": null,
+  "request": {"method": "GET", "headers": {"host": "example.com", "x-id": "<1&2>"}},
+  "tags": ["web", "frontend"],
+  "items": [{"id": 7}, {"id": 8}],
+  "empty": [],
+  "big": 12345678901234567890
+}`
+
+var jsonExtractTests = []struct {
+	path       string
+	joinArrays bool
+	expected   string
+}{
+	{"level", false, "info"},
+	{"$.level", false, "info"},
+	{"status", false, "200"},
+	{"latency", false, "0.25"},
+	{"cached", false, "false"},
+	{"user", false, ""},
+	{"big", false, "12345678901234567890"},
+	{"$.request.method", false, "GET"},
+	{"request.headers.host", false, "example.com"},
+	{"request.headers", false, `{"host":"example.com","x-id":"<1&2>"}`},
+	{"tags", false, "web"},
+	{"tags", true, `["web","frontend"]`},
+	{"tags[1]", false, "frontend"},
+	{"tags.1", false, "frontend"},
+	{"items[1].id", false, "8"},
+	{"items", false, `{"id":7}`},
+	{"empty", false, ""},
+	{"empty", true, "[]"},
+	{"missing", false, ""},
+	{"request.missing", false, ""},
+	{"level.missing", false, ""},
+	{"tags[2]", false, ""},
+	{"tags[x]", false, ""},
+	{"tags[0", false, ""},
+	{"request..method", false, ""},
+}
+
+func TestJSONExtract(t *testing.T) {
+	p := parseJSON(jsonTestDoc)
+	if p.err != nil {
+		t.Fatal(p.err)
+	}
+	for _, tc := range jsonExtractTests {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			if got := jsonExtract(p.doc, tc.path, tc.joinArrays); got != tc.expected {
+				t.Errorf("jsonExtract(%q, %v): expected %q, got %q", tc.path, tc.joinArrays, tc.expected, got)
+			}
+		})
+	}
+}
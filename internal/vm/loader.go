@@ -12,6 +12,7 @@ package vm
 
 import (
 	"context"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"html/template"
@@ -21,8 +22,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -30,8 +33,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/trace"
 
+	"github.com/google/mtail/internal/geoip"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/prefilter"
 	"github.com/google/mtail/internal/watcher"
 )
 
@@ -43,35 +49,103 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors_total")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors_total")
+	// progLines counts the lines processed per program, in a map per program
+	// keyed by whether any of the program's patterns matched the line.
+	progLines   = expvar.NewMap("program_lines_total")
+	progLinesMu sync.Mutex // serialises adding a program to progLines
+	// timestampParseFailures counts the timestamps per program that strptime
+	// failed to parse.
+	timestampParseFailures = expvar.NewMap("vm_timestamp_parse_failures_total")
+	// programDuplicateLines counts the lines per program ignored as duplicates
+	// of a line processed within --dedup_window.
+	programDuplicateLines = expvar.NewMap("program_duplicate_lines_total")
+	// stackOverflows counts the lines per program abandoned because the VM
+	// stack grew deeper than --vm_max_stack_depth.
+	stackOverflows = expvar.NewMap("vm_stack_overflow_total")
+	// programExcludedLines counts the lines per program skipped because they
+	// matched an exclude pattern.
+	programExcludedLines = expvar.NewMap("program_excluded_lines_total")
+	// base64DecodeErrors counts the strings per program that base64_decode()
+	// failed to decode.
+	base64DecodeErrors = expvar.NewMap("vm_base64_decode_errors_total")
+	// durationParseErrors counts the strings per program that duration()
+	// failed to parse.
+	durationParseErrors = expvar.NewMap("vm_duration_parse_errors_total")
+	// accumulateExpired counts the keys per program whose accumulated fields
+	// expired before being finalized.
+	accumulateExpired = expvar.NewMap("vm_accumulate_expired_total")
+	// metricsOverflows counts the new label sets per program not recorded
+	// because the program already had --max_metrics_per_program label sets.
+	metricsOverflows = expvar.NewMap("metrics_per_program_overflow_total")
+	// UnparseableLineCount counts the number of lines that weren't matched by
+	// any program.
+	UnparseableLineCount = expvar.NewInt("unparseable_lines_total")
+	// DroppedLineCount counts the number of lines dropped because the line
+	// queue was full.
+	DroppedLineCount = expvar.NewInt("dropped_lines_total")
+)
+
+// Policies for a line arriving when the line queue is full.
+const (
+	QueueBlock      = "block"       // Wait for room in the queue.
+	QueueDropOldest = "drop-oldest" // Drop the line that has waited longest, to make room.
+	QueueDropNewest = "drop-newest" // Drop the arriving line.
 )
 
 const (
 	fileExt = ".mtail"
 )
 
-// LoadAllPrograms loads all programs in a directory and starts watching the
-// directory for filesystem changes.  Any compile errors are stored for later retrieival.
+// LoadAllPrograms loads all programs in each program directory and starts
+// watching the directories for filesystem changes, unless program watching is
+// disabled.  The program path may name several directories separated by
+// commas; directories that don't exist are skipped with a warning, unless none
+// of them exist.  Any compile errors are stored for later retrieival.
 // This function returns an error if an internal error occurs.
 func (l *Loader) LoadAllPrograms() error {
-	s, err := os.Stat(l.programPath)
-	if err != nil {
-		return errors.Wrapf(err, "failed to stat %q", l.programPath)
+	var lastErr error
+	loaded := 0
+	for _, programPath := range strings.Split(l.programPath, ",") {
+		if programPath == "" {
+			continue
+		}
+		s, err := os.Stat(programPath)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "failed to stat %q", programPath)
+			glog.Warning(lastErr)
+			continue
+		}
+		loaded++
+		if err := l.loadProgramPath(programPath, s); err != nil {
+			return err
+		}
+	}
+	if loaded == 0 && lastErr != nil {
+		return lastErr
 	}
-	if err = l.w.Observe(l.programPath, l); err != nil {
-		glog.Infof("Failed to add watch on %q but continuing: %s", l.programPath, err)
+	return nil
+}
+
+// loadProgramPath loads the program at programPath, or all the programs in it
+// if it is a directory, and starts watching it.
+func (l *Loader) loadProgramPath(programPath string, s os.FileInfo) error {
+	if !l.disableProgramWatch {
+		if err := l.w.Observe(programPath, l); err != nil {
+			glog.Infof("Failed to add watch on %q but continuing: %s", programPath, err)
+		}
 	}
 	switch {
 	case s.IsDir():
-		fis, rerr := ioutil.ReadDir(l.programPath)
+		fis, rerr := ioutil.ReadDir(programPath)
 		if rerr != nil {
-			return errors.Wrapf(rerr, "Failed to list programs in %q", l.programPath)
+			return errors.Wrapf(rerr, "Failed to list programs in %q", programPath)
 		}
 
 		for _, fi := range fis {
 			if fi.IsDir() {
 				continue
 			}
-			err = l.LoadProgram(path.Join(l.programPath, fi.Name()))
+			err := l.LoadProgram(path.Join(programPath, fi.Name()))
 			if err != nil {
 				if l.errorsAbort {
 					return err
@@ -80,7 +154,7 @@ func (l *Loader) LoadAllPrograms() error {
 			}
 		}
 	default:
-		err = l.LoadProgram(l.programPath)
+		err := l.LoadProgram(programPath)
 		if err != nil {
 			if l.errorsAbort {
 				return err
@@ -91,18 +165,46 @@ func (l *Loader) LoadAllPrograms() error {
 	return nil
 }
 
+// programName returns the name of the program loaded from pathname, which is
+// its basename, unless a program of that name has already been loaded from
+// another directory, in which case it is the whole pathname.
+func (l *Loader) programName(pathname string) string {
+	name := filepath.Base(pathname)
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	if _, ok := l.programFiles[pathname]; ok {
+		return pathname
+	}
+	if p, ok := l.programFiles[name]; ok && p != pathname {
+		return pathname
+	}
+	return name
+}
+
 // LoadProgram loads or reloads a program from the full pathname programPath.  The name of
-// the program is the basename of the file.
+// the program is the basename of the file, or the full pathname if a program
+// of the same basename was loaded from another directory.
 func (l *Loader) LoadProgram(programPath string) error {
-	name := filepath.Base(programPath)
-	if strings.HasPrefix(name, ".") {
+	base := filepath.Base(programPath)
+	if strings.HasPrefix(base, ".") {
 		glog.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
 		return nil
 	}
-	if filepath.Ext(name) != fileExt {
+	if filepath.Ext(base) != fileExt {
 		glog.V(2).Infof("Skipping %s due to file extension.", programPath)
 		return nil
 	}
+	name := l.programName(programPath)
+	if l.maxProgs > 0 {
+		l.handleMu.RLock()
+		_, loaded := l.handles[name]
+		count := len(l.handles)
+		l.handleMu.RUnlock()
+		if !loaded && count >= l.maxProgs {
+			glog.Warningf("Skipping %s because the maximum of %d programs are already loaded.", programPath, l.maxProgs)
+			return nil
+		}
+	}
 	f, err := os.OpenFile(programPath, os.O_RDONLY, 0600)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
@@ -113,6 +215,9 @@ func (l *Loader) LoadProgram(programPath string) error {
 			glog.Warning(err)
 		}
 	}()
+	l.handleMu.Lock()
+	l.programFiles[name] = programPath
+	l.handleMu.Unlock()
 	l.programErrorMu.Lock()
 	defer l.programErrorMu.Unlock()
 	l.programErrors[name] = l.CompileAndRun(name, f)
@@ -138,7 +243,7 @@ const loaderTemplate = `
 </tr>
 <tr>
 {{range $name, $errors := $.Errors}}
-<td><a href="/progz?prog={{$name}}">{{$name}}</a></td>
+<td><a href="progz?prog={{$name}}">{{$name}}</a></td>
 <td>
 {{if $errors}}
 {{$errors}}
@@ -198,7 +303,7 @@ func (l *Loader) WriteStatusHTML(w io.Writer) error {
 // the same name remains running.
 func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	glog.V(2).Infof("CompileAndRun %s", name)
-	v, errs := Compile(name, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation)
+	v, errs := Compile(name, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation, l.knownEnvVars...)
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("compile failed for %s:\n%s", name, errs)
@@ -212,9 +317,51 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode(name))
 	}
 
-	// Load the metrics from the compilation into the global metric storage for export.
 	for _, m := range v.m {
+		if m.Kind == metrics.HLL {
+			m.Precision = l.hllPrecision
+		}
+	}
+
+	// The new program is compiled into a shadow VM above, while lines continue
+	// to be processed by the old VM.  Taking the write lock waits for lines
+	// in flight in ProcessLogLine to complete, and holds off new ones, so that
+	// no line is processed by the old VM after its metrics have been copied
+	// into the new VM's metrics in the store, and no line sees the new
+	// metrics without the new VM.
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+
+	// A metric declared the same way by several programs is shared by them,
+	// rather than each adding its own.  Find the shared metrics before
+	// changing the store, so that a conflicting declaration leaves it as it
+	// was.
+	shared := make([]*metrics.Metric, len(v.m))
+	for i, m := range v.m {
+		if m.Hidden {
+			continue
+		}
+		s, err := l.ms.FindShared(m)
+		if err == nil {
+			err = l.ms.CheckAliases(m)
+		}
+		if err != nil {
+			ProgLoadErrors.Add(name, 1)
+			return errors.Wrapf(err, "compile failed for %s", name)
+		}
+		shared[i] = s
+	}
+	// On reload, stop sharing the metrics the program no longer declares.
+	l.ms.ReleaseShared(name, shared)
+
+	// Load the metrics from the compilation into the global metric storage for export.
+	for i, m := range v.m {
 		if !m.Hidden {
+			if shared[i] != nil {
+				l.ms.Share(shared[i], name)
+				v.m[i] = shared[i]
+				continue
+			}
 			if l.omitMetricSource {
 				m.Source = ""
 			}
@@ -225,6 +372,17 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		}
 	}
 
+	// The shared metrics replacing the program's own have their clocks, and
+	// may already have label sets.
+	v.clocks = windowClocks(v.m)
+	atomic.StoreInt64(&v.labelSets.n, v.countLabelSets())
+
+	if l.emitInitialValues {
+		if err := l.ms.PublishInitialValues(); err != nil {
+			return err
+		}
+	}
+
 	ProgLoads.Add(name, 1)
 	glog.Infof("Loaded program %s", name)
 
@@ -232,13 +390,35 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		return nil
 	}
 
-	l.handleMu.Lock()
-	defer l.handleMu.Unlock()
-
+	if l.dedupWindow > 0 {
+		v.dedup = newDeduper(l.dedupWindow, l.dedupMaxLines)
+	}
+	v.geoip = l.geoipDB
+	v.hashSecret = l.hashSecret
+	v.store = l.ms
+	for k := 1; k < l.lineWorkers; k++ {
+		v.copies = append(v.copies, v.clone())
+	}
 	l.handles[name] = v
+	l.buildPrefilter()
 	return nil
 }
 
+// buildPrefilter indexes the literals of the loaded programs, so that lines
+// are only run through the programs that may act on them.  handleMu is
+// assumed to be held.
+func (l *Loader) buildPrefilter() {
+	if l.noPrefilter {
+		l.prefilter = nil
+		return
+	}
+	literals := make(map[string][]string, len(l.handles))
+	for name, v := range l.handles {
+		literals[name] = v.Literals()
+	}
+	l.prefilter = prefilter.New(literals)
+}
+
 // Loader handles the lifecycle of programs and virtual machines, by watching
 // the configured program source directory, compiling changes to programs, and
 // managing the virtual machines.
@@ -246,10 +426,14 @@ type Loader struct {
 	ms          *metrics.Store        // pointer to metrics.Store to pass to compiler
 	w           watcher.Watcher       // watches for program changes
 	reg         prometheus.Registerer // plce to reg metrics
-	programPath string                // Path that contains mtail programs.
+	programPath string                // Comma separated paths that contain mtail programs.
+
+	handleMu     sync.RWMutex      // guards accesses to handles and programFiles
+	handles      map[string]*VM    // map of program names to virtual machines
+	programFiles map[string]string // map of program names to the pathnames they were loaded from
+	prefilter    *prefilter.Filter // index of the literals of the programs in handles
 
-	handleMu sync.RWMutex   // guards accesses to handles
-	handles  map[string]*VM // map of program names to virtual machines
+	noPrefilter bool // Run every program on every line, for comparison in benchmarks.
 
 	programErrorMu sync.RWMutex     // guards access to programErrors
 	programErrors  map[string]error // errors from the last compile attempt of the program
@@ -262,6 +446,36 @@ type Loader struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	emitInitialValues    bool // Publish label-free metrics to the store as soon as they're loaded.
+	maxProgs             int  // Maximum number of programs to load, or zero for no limit.
+
+	knownEnvVars []string // Environment variables that programs are expected to read.
+
+	disableProgramWatch bool                     // Don't watch the program path for changes.
+	reloadDelay         time.Duration            // Quiet period after a program change before it is reloaded.
+	reloadTimersMu      sync.Mutex               // guards access to reloadTimers and reloadEvents
+	reloadTimers        map[string]*time.Timer   // pending reloads by program pathname
+	reloadEvents        map[string]watcher.Event // events to handle when each pending reload fires
+
+	unparseablePath    string          // If set, lines not matched by any program are written to this file.
+	unparseableMaxSize int64           // Size in bytes to rotate the unparseable log at.
+	unparseable        *unparseableLog // Writer of the unparseable log.
+
+	dedupWindow   time.Duration // If nonzero, programs suppress lines identical to one seen within this window.
+	dedupMaxLines int           // If positive, the most lines each program remembers for deduplication.
+
+	geoipDB *geoip.DB // If set, the database programs look addresses up in with geoip().
+
+	hashSecret []byte // If set, the key of the HMACs programs compute with hash().
+
+	hllPrecision uint8 // If nonzero, the precision of the sketches of hll metrics.
+
+	lineWorkers     int                   // If greater than one, the number of copies of each program processing lines in parallel.
+	lineQueueSize   int                   // If positive, the number of lines that can wait for a line worker, else lineWorkers.
+	lineQueuePolicy string                // What to do with a line when lines is full, QueueBlock if empty.
+	linesMu         sync.RWMutex          // guards sends to and the closing of lines
+	lines           chan *logline.LogLine // If not nil, lines waiting for a line worker.
+	workersDone     sync.WaitGroup        // counts the running line workers
 }
 
 // OverrideLocation sets the timezone location for the VM.
@@ -314,6 +528,172 @@ func OmitMetricSource(l *Loader) error {
 	return nil
 }
 
+// EmitInitialValues instructs the Loader to publish the initial values of all
+// metrics without keys once a program is loaded, before any log lines are
+// processed.
+func EmitInitialValues(l *Loader) error {
+	l.emitInitialValues = true
+	return nil
+}
+
+// KnownEnvVars sets the names of the environment variables that programs are
+// expected to read with getenv().  Programs reading any other variable are
+// warned about when compiled.
+func KnownEnvVars(names ...string) func(*Loader) error {
+	return func(l *Loader) error {
+		l.knownEnvVars = names
+		return nil
+	}
+}
+
+// MaxProgs limits the number of programs the Loader will load to n.  When
+// loading a directory of programs, the first n in alphabetical order are
+// loaded.  Zero means no limit.
+func MaxProgs(n int) func(*Loader) error {
+	return func(l *Loader) error {
+		if n < 0 {
+			return errors.Errorf("max programs must not be negative: %d", n)
+		}
+		l.maxProgs = n
+		return nil
+	}
+}
+
+// DisableProgramWatch instructs the Loader to load programs once, and not to
+// watch the program path for changes.
+func DisableProgramWatch(l *Loader) error {
+	l.disableProgramWatch = true
+	return nil
+}
+
+// ProgramReloadDelay sets the quiet period the Loader waits for after a
+// program file changes before reloading it, so that several changes in quick
+// succession cause only one reload.  Zero reloads immediately.
+func ProgramReloadDelay(delay time.Duration) func(*Loader) error {
+	return func(l *Loader) error {
+		if delay < 0 {
+			return errors.Errorf("program reload delay must not be negative: %s", delay)
+		}
+		l.reloadDelay = delay
+		return nil
+	}
+}
+
+// UnparseableLog instructs the Loader to write lines that aren't matched by
+// any program to the file at path.  The file is rotated when it would grow
+// past maxSize bytes; zero means it is never rotated.
+func UnparseableLog(path string, maxSize int64) func(*Loader) error {
+	return func(l *Loader) error {
+		if path == "" {
+			return errors.New("unparseable log needs a path")
+		}
+		if maxSize < 0 {
+			return errors.Errorf("unparseable log max size must not be negative: %d", maxSize)
+		}
+		l.unparseablePath = path
+		l.unparseableMaxSize = maxSize
+		return nil
+	}
+}
+
+// DedupWindow instructs the Loader to have each program ignore lines from a
+// log that are identical to a line it processed from that log within window.
+// Zero disables deduplication.  Each program remembers at most maxLines lines,
+// forgetting the oldest first; zero means no limit.
+func DedupWindow(window time.Duration, maxLines int) func(*Loader) error {
+	return func(l *Loader) error {
+		if window < 0 {
+			return errors.Errorf("dedup window must not be negative: %s", window)
+		}
+		if maxLines < 0 {
+			return errors.Errorf("dedup max lines must not be negative: %d", maxLines)
+		}
+		l.dedupWindow = window
+		l.dedupMaxLines = maxLines
+		return nil
+	}
+}
+
+// GeoIPDatabase loads the MaxMind DB file at path, such as a GeoLite2
+// database, for programs to look addresses up in with geoip().  The file is
+// read once, when the Loader is created.
+func GeoIPDatabase(path string) func(*Loader) error {
+	return func(l *Loader) error {
+		db, err := geoip.Open(path)
+		if err != nil {
+			return err
+		}
+		l.geoipDB = db
+		return nil
+	}
+}
+
+// HashSecretFile reads the secret that programs key the hashes they compute
+// with hash() with, making them HMACs, from the file at path.  A trailing
+// newline is not part of the secret.  The file is read once, when the Loader
+// is created.
+func HashSecretFile(path string) func(*Loader) error {
+	return func(l *Loader) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "reading hash secret")
+		}
+		secret := strings.TrimRight(string(b), "\r\n")
+		if secret == "" {
+			return errors.Errorf("hash secret file %q is empty", path)
+		}
+		l.hashSecret = []byte(secret)
+		return nil
+	}
+}
+
+// HLLPrecision sets the precision of the sketches of hll metrics, either
+// datum.DefaultHLLPrecision or datum.HighHLLPrecision.
+func HLLPrecision(precision int) func(*Loader) error {
+	return func(l *Loader) error {
+		if precision != datum.DefaultHLLPrecision && precision != datum.HighHLLPrecision {
+			return errors.Errorf("hll precision must be %d or %d: %d", datum.DefaultHLLPrecision, datum.HighHLLPrecision, precision)
+		}
+		l.hllPrecision = uint8(precision)
+		return nil
+	}
+}
+
+// LineWorkers sets the Loader to process lines with n copies of each program
+// running in parallel, rather than one line at a time.  Lines, even from the
+// same log, may be processed out of order.
+func LineWorkers(n int) func(*Loader) error {
+	return func(l *Loader) error {
+		if n < 1 {
+			return errors.Errorf("line workers must be at least 1: %d", n)
+		}
+		l.lineWorkers = n
+		return nil
+	}
+}
+
+// LineQueue sets the Loader to queue lines for the line workers, with room for
+// size lines, or one per line worker if size is zero, rather than processing
+// them as they arrive when there's one line worker.  The policy is what's done
+// with a line that arrives when the queue is full: QueueBlock waits for room,
+// slowing down the log readers, while QueueDropOldest and QueueDropNewest drop
+// a line and count it in DroppedLineCount.
+func LineQueue(size int, policy string) func(*Loader) error {
+	return func(l *Loader) error {
+		if size < 0 {
+			return errors.Errorf("line queue size must not be negative: %d", size)
+		}
+		switch policy {
+		case QueueBlock, QueueDropOldest, QueueDropNewest:
+		default:
+			return errors.Errorf("unknown line queue policy %q, expecting %q, %q or %q", policy, QueueBlock, QueueDropOldest, QueueDropNewest)
+		}
+		l.lineQueueSize = size
+		l.lineQueuePolicy = policy
+		return nil
+	}
+}
+
 // PrometheusRegisterer passes in a registry for setting up exported metrics.
 func PrometheusRegisterer(reg prometheus.Registerer) func(l *Loader) error {
 	return func(l *Loader) error {
@@ -332,7 +712,10 @@ func NewLoader(programPath string, store *metrics.Store, w watcher.Watcher, opti
 		w:             w,
 		programPath:   programPath,
 		handles:       make(map[string]*VM),
+		programFiles:  make(map[string]string),
 		programErrors: make(map[string]error),
+		reloadTimers:  make(map[string]*time.Timer),
+		reloadEvents:  make(map[string]watcher.Event),
 	}
 	if err := l.SetOption(options...); err != nil {
 		return nil, err
@@ -340,9 +723,42 @@ func NewLoader(programPath string, store *metrics.Store, w watcher.Watcher, opti
 	if l.reg != nil {
 		l.reg.MustRegister(lineProcessingDurations)
 	}
+	if l.unparseablePath != "" {
+		var err error
+		l.unparseable, err = newUnparseableLog(l.unparseablePath, l.unparseableMaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if l.lineWorkers > 1 || l.lineQueueSize > 0 || (l.lineQueuePolicy != "" && l.lineQueuePolicy != QueueBlock) {
+		l.startLineWorkers()
+	}
 	return l, nil
 }
 
+// startLineWorkers starts the goroutines that process lines in parallel,
+// each with its own copy of every program.
+func (l *Loader) startLineWorkers() {
+	if l.lineWorkers < 1 {
+		l.lineWorkers = 1
+	}
+	size := l.lineQueueSize
+	if size == 0 {
+		size = l.lineWorkers
+	}
+	lines := make(chan *logline.LogLine, size)
+	l.lines = lines
+	for k := 0; k < l.lineWorkers; k++ {
+		l.workersDone.Add(1)
+		go func(k int) {
+			defer l.workersDone.Done()
+			for ll := range lines {
+				l.processLogLine(ll.Context, ll, k)
+			}
+		}(k)
+	}
+}
+
 // SetOption takes one or more option functions and applies them in order to Loader.
 func (l *Loader) SetOption(options ...func(*Loader) error) error {
 	for _, option := range options {
@@ -357,6 +773,38 @@ func (l *Loader) ProcessFileEvent(ctx context.Context, event watcher.Event) {
 	ctx, span := trace.StartSpan(ctx, "Loader.ProcessFileEvent")
 	defer span.End()
 
+	if l.reloadDelay <= 0 {
+		l.handleFileEvent(ctx, event)
+		return
+	}
+	// Restart the quiet period for this program on each event, so only the
+	// last of a burst of events is handled.  A create followed by updates is
+	// still handled as a create.
+	l.reloadTimersMu.Lock()
+	defer l.reloadTimersMu.Unlock()
+	pathname := event.Pathname
+	if prev, ok := l.reloadEvents[pathname]; ok && prev.Op == watcher.Create && event.Op == watcher.Update {
+		event.Op = watcher.Create
+	}
+	l.reloadEvents[pathname] = event
+	if t, ok := l.reloadTimers[pathname]; ok {
+		t.Reset(l.reloadDelay)
+		return
+	}
+	l.reloadTimers[pathname] = time.AfterFunc(l.reloadDelay, func() {
+		l.reloadTimersMu.Lock()
+		e, ok := l.reloadEvents[pathname]
+		delete(l.reloadEvents, pathname)
+		delete(l.reloadTimers, pathname)
+		l.reloadTimersMu.Unlock()
+		if ok {
+			l.handleFileEvent(context.Background(), e)
+		}
+	})
+}
+
+// handleFileEvent loads, reloads, or unloads the program named in event.
+func (l *Loader) handleFileEvent(ctx context.Context, event watcher.Event) {
 	switch event.Op {
 	case watcher.Delete:
 		l.UnloadProgram(event.Pathname)
@@ -382,36 +830,124 @@ func (l *Loader) Close() {
 	if err := l.w.Close(); err != nil {
 		glog.Infof("error closing watcher: %s", err)
 	}
+	l.reloadTimersMu.Lock()
+	for pathname, t := range l.reloadTimers {
+		t.Stop()
+		delete(l.reloadTimers, pathname)
+		delete(l.reloadEvents, pathname)
+	}
+	l.reloadTimersMu.Unlock()
+	// Finish processing the lines queued for the line workers.
+	l.linesMu.Lock()
+	if l.lines != nil {
+		close(l.lines)
+		l.lines = nil
+	}
+	l.linesMu.Unlock()
+	l.workersDone.Wait()
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	for prog := range l.handles {
 		delete(l.handles, prog)
 	}
+	l.prefilter = nil
+	for prog := range l.programFiles {
+		delete(l.programFiles, prog)
+	}
+	if l.unparseable != nil {
+		if err := l.unparseable.Close(); err != nil {
+			glog.Info(err)
+		}
+	}
 }
 
-// ProcessLogLine satisfies the LogLine.Processor interface.
+// ProcessLogLine satisfies the LogLine.Processor interface.  With more than
+// one line worker, or a line queue, the line is queued for the workers and
+// processed asynchronously.
 func (l *Loader) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	LineCount.Add(1)
+	l.linesMu.RLock()
+	if l.lines != nil {
+		l.queueLine(ll)
+		l.linesMu.RUnlock()
+		return
+	}
+	l.linesMu.RUnlock()
+	l.processLogLine(ctx, ll, 0)
+}
+
+// queueLine sends the line to the line workers, following the line queue
+// policy if the queue is full.  linesMu must be held.
+func (l *Loader) queueLine(ll *logline.LogLine) {
+	switch l.lineQueuePolicy {
+	case QueueDropNewest:
+		select {
+		case l.lines <- ll:
+		default:
+			DroppedLineCount.Add(1)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case l.lines <- ll:
+				return
+			default:
+			}
+			select {
+			case <-l.lines:
+				DroppedLineCount.Add(1)
+			default:
+			}
+		}
+	default:
+		l.lines <- ll
+	}
+}
+
+// processLogLine runs the line through the programs, with the copies of
+// line worker k.
+func (l *Loader) processLogLine(ctx context.Context, ll *logline.LogLine, k int) {
 	ctx, span := trace.StartSpan(ctx, "Loader.ProcessLogLine")
 	defer span.End()
-	LineCount.Add(1)
 	l.handleMu.RLock()
 	defer l.handleMu.RUnlock()
-	for prog := range l.handles {
-		l.handles[prog].ProcessLogLine(ctx, ll)
+	matched := false
+	candidates := l.prefilter.Scan(ll.Line)
+	for prog, v := range l.handles {
+		if !candidates.Runs(prog) {
+			v.SkipLine()
+			continue
+		}
+		if v.worker(k).ProcessLogLine(ctx, ll) {
+			matched = true
+		}
+	}
+	if !matched {
+		UnparseableLineCount.Add(1)
+		if l.unparseable != nil {
+			if err := l.unparseable.WriteLine(ll.Line); err != nil {
+				glog.Info(err)
+			}
+		}
 	}
 }
 
 // UnloadProgram removes the named program from the watcher to prevent future
-// updates, and terminates any currently running VM goroutine.
+// updates, terminates any currently running VM goroutine, and removes the
+// program's metrics from the store.
 func (l *Loader) UnloadProgram(pathname string) {
 	if err := l.w.Unobserve(pathname, l); err != nil {
 		glog.V(2).Infof("Remove watch on %s failed: %s", pathname, err)
 	}
-	name := filepath.Base(pathname)
+	name := l.programName(pathname)
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
+	delete(l.programFiles, name)
 	if _, ok := l.handles[name]; ok {
 		delete(l.handles, name)
+		l.buildPrefilter()
+		l.ms.RemoveProgram(name)
+		glog.Infof("Unloaded program %s", name)
 	}
 }
 
@@ -438,3 +974,53 @@ func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprintf(w, "</ul>")
 }
+
+// TraceLine processes the line with a copy of each program that records to
+// empty copies of its metrics, and returns the traces of the programs, sorted
+// by name.  Every program is run, even those the prefilter would skip, and
+// the programs' metrics are unaffected.
+func (l *Loader) TraceLine(ll *logline.LogLine) []*Trace {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	traces := make([]*Trace, 0, len(l.handles))
+	for _, v := range l.handles {
+		traces = append(traces, v.Trace(ll))
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Program < traces[j].Program })
+	return traces
+}
+
+// maxTraceLineSize is the largest line TraceHandler accepts.
+const maxTraceLineSize = 1 << 20
+
+// TraceHandler traces the processing of the line in the body of a POST
+// request, and responds with the traces of the programs as JSON.  The
+// filename query parameter sets the name of the log the line is taken to be
+// from.
+func (l *Loader) TraceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a log line to trace", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTraceLineSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	line := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	if strings.Contains(line, "\n") {
+		http.Error(w, "Only one line can be traced", http.StatusBadRequest)
+		return
+	}
+	ll := logline.New(r.Context(), r.URL.Query().Get("filename"), line)
+	j, err := json.MarshalIndent(l.TraceLine(ll), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if _, err := w.Write(j); err != nil {
+		glog.Info(err)
+	}
+}
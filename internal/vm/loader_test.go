@@ -5,13 +5,26 @@ package vm
 
 import (
 	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/watcher"
 )
@@ -49,6 +62,46 @@ func TestCompileAndRun(t *testing.T) {
 	l.handleMu.Unlock()
 }
 
+func TestReloadDoesNotDropLines(t *testing.T) {
+	// Each line creates a new label set, so a line processed by the old VM
+	// after its metrics are replaced in the store would be lost.
+	prog := `counter lines by n
+/(\d+)/ {
+  lines[$1]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("reload", strings.NewReader(prog)))
+
+	const lineCount = 10000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < lineCount; i++ {
+			l.ProcessLogLine(context.Background(), logline.New(context.Background(), "reload", fmt.Sprintf("%d", i)))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		testutil.FatalIfErr(t, l.CompileAndRun("reload", strings.NewReader(prog)))
+	}
+	wg.Wait()
+	l.Close()
+
+	if len(store.Metrics["lines"]) != 1 {
+		t.Fatalf("expected one lines metric, got %v", store.Metrics["lines"])
+	}
+	var total int64
+	for _, lv := range store.Metrics["lines"][0].LabelValues {
+		total += datum.GetInt(lv.Value)
+	}
+	if total != lineCount {
+		t.Errorf("lines in: %d, lines counted: %d", lineCount, total)
+	}
+}
+
 var testProcessEvents = []struct {
 	name             string
 	events           []watcher.Event
@@ -170,3 +223,899 @@ func TestLoadProg(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadAllProgramsMaxProgs(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	for _, name := range []string{"c.mtail", "a.mtail", "b.mtail"} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, testProgram)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	l, err := NewLoader(tmpDir, metrics.NewStore(), watcher.NewFakeWatcher(), MaxProgs(2))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	l.handleMu.RLock()
+	programs := make(map[string]struct{})
+	for program := range l.handles {
+		programs[program] = struct{}{}
+	}
+	l.handleMu.RUnlock()
+	expected := map[string]struct{}{"a.mtail": {}, "b.mtail": {}}
+	if diff := testutil.Diff(expected, programs); diff != "" {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+
+	// Reloading an already loaded program is still allowed.
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "a.mtail")))
+	l.handleMu.RLock()
+	if _, ok := l.handles["a.mtail"]; !ok {
+		t.Errorf("a.mtail not reloaded: %v", l.handles)
+	}
+	l.handleMu.RUnlock()
+}
+
+func TestLoadAllProgramsMultipleDirs(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	shared := path.Join(tmpDir, "shared")
+	service := path.Join(tmpDir, "service")
+	for _, name := range []string{path.Join(shared, "a.mtail"), path.Join(shared, "b.mtail"), path.Join(service, "b.mtail"), path.Join(service, "c.mtail")} {
+		testutil.FatalIfErr(t, os.MkdirAll(path.Dir(name), 0700))
+		f := testutil.TestOpenFile(t, name)
+		testutil.WriteString(t, f, testProgram)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	// A missing directory is skipped.
+	l, err := NewLoader(strings.Join([]string{shared, path.Join(tmpDir, "missing"), service}, ","), metrics.NewStore(), watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	programs := func() map[string]struct{} {
+		l.handleMu.RLock()
+		defer l.handleMu.RUnlock()
+		programs := make(map[string]struct{})
+		for program := range l.handles {
+			programs[program] = struct{}{}
+		}
+		return programs
+	}
+	serviceB := path.Join(service, "b.mtail")
+	expected := map[string]struct{}{"a.mtail": {}, "b.mtail": {}, serviceB: {}, "c.mtail": {}}
+	if diff := testutil.Diff(expected, programs()); diff != "" {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+	// The program's metrics are labelled with its full name.
+	l.handleMu.RLock()
+	if name := l.handles[serviceB].name; name != serviceB {
+		t.Errorf("program name: expected %q, got %q", serviceB, name)
+	}
+	l.handleMu.RUnlock()
+
+	// Reloading and unloading keep the names apart.
+	testutil.FatalIfErr(t, l.LoadProgram(serviceB))
+	l.UnloadProgram(path.Join(shared, "b.mtail"))
+	testutil.FatalIfErr(t, l.LoadProgram(serviceB))
+	expected = map[string]struct{}{"a.mtail": {}, serviceB: {}, "c.mtail": {}}
+	if diff := testutil.Diff(expected, programs()); diff != "" {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+
+	// It's an error if none of the directories exist.
+	l, err = NewLoader(path.Join(tmpDir, "missing"), metrics.NewStore(), watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	if err := l.LoadAllPrograms(); err == nil {
+		t.Error("expected error loading from a missing directory")
+	}
+}
+
+func TestProgramReloadDelay(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	l, err := NewLoader(tmpDir, metrics.NewStore(), watcher.NewFakeWatcher(), ProgramReloadDelay(50*time.Millisecond))
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+
+	progPath := path.Join(tmpDir, "debounce.mtail")
+	f := testutil.TestOpenFile(t, progPath)
+	testutil.WriteString(t, f, testProgram)
+	testutil.FatalIfErr(t, f.Close())
+
+	startLoads := expvarIntOrZero(ProgLoads.Get("debounce.mtail"))
+	l.ProcessFileEvent(context.Background(), watcher.Event{watcher.Create, progPath})
+	for i := 0; i < 4; i++ {
+		l.ProcessFileEvent(context.Background(), watcher.Event{watcher.Update, progPath})
+	}
+	l.handleMu.RLock()
+	_, loaded := l.handles["debounce.mtail"]
+	l.handleMu.RUnlock()
+	if loaded {
+		t.Errorf("program loaded before the reload delay")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	l.handleMu.RLock()
+	_, loaded = l.handles["debounce.mtail"]
+	l.handleMu.RUnlock()
+	if !loaded {
+		t.Errorf("program not loaded after the reload delay")
+	}
+	if loads := expvarIntOrZero(ProgLoads.Get("debounce.mtail")) - startLoads; loads != 1 {
+		t.Errorf("expected 1 load, got %d", loads)
+	}
+}
+
+func expvarIntOrZero(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
+
+func TestUnloadProgramRemovesMetrics(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("unload.mtail", strings.NewReader("counter foo\n/$/ {\n  foo++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("other.mtail", strings.NewReader("counter bar\n/$/ {\n  bar++\n}\n")))
+	if len(store.Metrics["foo"]) != 1 {
+		t.Fatalf("metric not loaded: %v", store.Metrics)
+	}
+
+	l.UnloadProgram("unload.mtail")
+	if _, ok := store.Metrics["foo"]; ok {
+		t.Errorf("metric of unloaded program still in store: %v", store.Metrics)
+	}
+	if len(store.Metrics["bar"]) != 1 {
+		t.Errorf("metric of other program removed: %v", store.Metrics)
+	}
+}
+
+func TestMaxSeriesOnNewLabelSet(t *testing.T) {
+	store := metrics.NewStore()
+	store.SetMaxSeries(2)
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("users.mtail", strings.NewReader("counter requests by user\n/(\\w+)/ {\n  requests[$1]++\n}\n")))
+	for _, user := range []string{"a", "b", "c"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", user))
+	}
+	if got := store.Metrics["requests"][0].Cardinality(); got != 2 {
+		t.Errorf("expected 2 series, got %d", got)
+	}
+}
+
+func TestSharedMetrics(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	prog := "counter requests by code\n/(\\d+)/ {\n  requests[$1]++\n}\n"
+	testutil.FatalIfErr(t, l.CompileAndRun("shared.mtail", strings.NewReader(prog)))
+	testutil.FatalIfErr(t, l.CompileAndRun("/etc/mtail/service/shared.mtail", strings.NewReader(prog)))
+	if len(store.Metrics["requests"]) != 1 {
+		t.Fatalf("expected one shared metric: %v", store.Metrics)
+	}
+
+	// A conflicting declaration fails to load, and leaves the store alone.
+	if err := l.CompileAndRun("conflict.mtail", strings.NewReader("counter requests by status\n/(\\d+)/ {\n  requests[$1]++\n}\n")); err == nil {
+		t.Error("expected conflicting declaration to fail")
+	}
+	if len(store.Metrics["requests"]) != 1 {
+		t.Fatalf("conflicting metric added: %v", store.Metrics)
+	}
+
+	// Both programs record to the metric.
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "200"))
+	d, err := store.Metrics["requests"][0].GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 2 {
+		t.Errorf("requests: expected 2, got %d", got)
+	}
+
+	// The metric outlives the program that declared it first.
+	l.UnloadProgram("shared.mtail")
+	if len(store.Metrics["requests"]) != 1 || store.Metrics["requests"][0].Program != "shared.mtail" {
+		t.Fatalf("shared metric not kept: %v", store.Metrics)
+	}
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "200"))
+	if got := datum.GetInt(d); got != 3 {
+		t.Errorf("requests: expected 3, got %d", got)
+	}
+}
+
+func TestUnparseableLog(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logPath := path.Join(tmpDir, "unparseable.log")
+
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), UnparseableLog(logPath, 12))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("foo.mtail", strings.NewReader("counter foo\n/^foo/ {\n  foo++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("bar.mtail", strings.NewReader("counter bar\n/^bar/ {\n  bar++\n}\n")))
+
+	start := UnparseableLineCount.Value()
+	for _, line := range []string{"foo 1", "baz 2", "bar 3", "quux 4"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	l.Close()
+
+	if got := UnparseableLineCount.Value() - start; got != 2 {
+		t.Errorf("unparseable lines: expected 2, got %d", got)
+	}
+	for name, expected := range map[string]string{logPath + ".1": "baz 2\n", logPath: "quux 4\n"} {
+		b, err := ioutil.ReadFile(name)
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, string(b)); diff != "" {
+			t.Errorf("%s contents diff:\n%s", name, diff)
+		}
+	}
+}
+
+func TestUnparseableLogMatchedWithoutPatterns(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logPath := path.Join(tmpDir, "unparseable.log")
+
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), UnparseableLog(logPath, 0))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("logfmt.mtail", strings.NewReader("counter levels by level\nlevels[logfmt(\"level\")]++\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("accesslog.mtail", strings.NewReader("counter codes by code\ncodes[accesslog(\"common\", \"status\")]++\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("smatch.mtail", strings.NewReader("counter app\ngetfilename() =~ /^app/ {\n  app++\n}\n")))
+
+	for _, tc := range []struct{ filename, line string }{
+		{"test", "level=info msg=hi"},
+		{"test", `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 2326`},
+		{"app.log", "anything"},
+		{"test", "none of the above"},
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), tc.filename, tc.line))
+	}
+	l.Close()
+
+	b, err := ioutil.ReadFile(logPath)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff("none of the above\n", string(b)); diff != "" {
+		t.Errorf("%s contents diff:\n%s", logPath, diff)
+	}
+}
+
+func TestUnparseableLogRotateFailure(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logPath := path.Join(tmpDir, "unparseable.log")
+	// The file can't be renamed over a directory that isn't empty.
+	testutil.FatalIfErr(t, os.MkdirAll(path.Join(logPath+".1", "x"), 0755))
+
+	u, err := newUnparseableLog(logPath, 12)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, u.WriteLine("line 1"))
+	// The lines are still written to the file that couldn't be rotated.
+	for _, line := range []string{"line 2", "line 3"} {
+		if err := u.WriteLine(line); err == nil {
+			t.Errorf("%s: expected a rotation error", line)
+		}
+	}
+	testutil.FatalIfErr(t, u.Close())
+
+	b, err := ioutil.ReadFile(logPath)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff("line 1\nline 2\nline 3\n", string(b)); diff != "" {
+		t.Errorf("%s contents diff:\n%s", logPath, diff)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), DedupWindow(5*time.Second, 0))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("dedup.mtail", strings.NewReader("counter foo\n/^foo/ {\n  foo++\n}\n")))
+
+	now := time.Unix(0, 0)
+	l.handles["dedup.mtail"].dedup.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		elapsed  time.Duration
+		filename string
+		line     string
+	}{
+		{0, "a", "foo 1"},
+		{time.Second, "a", "foo 1"}, // duplicate within the window
+		{time.Second, "b", "foo 1"}, // same line from another log
+		{2 * time.Second, "a", "foo 2"},
+		{4 * time.Second, "a", "foo 1"},  // duplicate, doesn't extend the window
+		{5 * time.Second, "a", "foo 1"},  // outside the window
+		{6 * time.Second, "a", "foo 1"},  // duplicate of the line above
+		{20 * time.Second, "a", "foo 2"}, // long after the first
+	} {
+		now = time.Unix(0, 0).Add(tc.elapsed)
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), tc.filename, tc.line))
+	}
+
+	d, err := store.Metrics["foo"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 5 {
+		t.Errorf("foo: expected 5, got %d", got)
+	}
+	if got := expvarValue(programDuplicateLines, "dedup.mtail"); got != 3 {
+		t.Errorf("duplicate lines: expected 3, got %g", got)
+	}
+}
+
+func TestDedupMaxLines(t *testing.T) {
+	d := newDeduper(time.Minute, 2)
+	for _, line := range []string{"a", "b", "c"} {
+		e, _ := d.Begin(dedupKey{"log", line})
+		e.Done(true)
+	}
+	if len(d.seen) != 2 {
+		t.Errorf("expected 2 lines remembered, got %d", len(d.seen))
+	}
+	// The oldest line is forgotten, within the window.
+	for _, line := range []string{"b", "c"} {
+		if e, dup := d.Begin(dedupKey{"log", line}); !dup || !e.Matched() {
+			t.Errorf("%s: expected a matched duplicate", line)
+		}
+	}
+	if _, dup := d.Begin(dedupKey{"log", "a"}); dup {
+		t.Error("a: expected not a duplicate")
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	d := newDeduper(time.Minute, 0)
+	var wg sync.WaitGroup
+	var processed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, dup := d.Begin(dedupKey{"log", "a"})
+			if dup {
+				if !e.Matched() {
+					t.Error("expected the duplicate to have matched")
+				}
+				return
+			}
+			atomic.AddInt32(&processed, 1)
+			e.Done(true)
+		}()
+	}
+	wg.Wait()
+	if processed != 1 {
+		t.Errorf("expected the line processed once, got %d", processed)
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("get.mtail", strings.NewReader("counter gets\n/^GET (\\S+)/ {\n  gets++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("all.mtail", strings.NewReader("counter lines\nlines++\n")))
+	if got := l.handles["get.mtail"].Literals(); len(got) != 1 || got[0] != "GET " {
+		t.Errorf("expected literal \"GET \", got %q", got)
+	}
+	if got := l.handles["all.mtail"].Literals(); got != nil {
+		t.Errorf("expected no literals, got %q", got)
+	}
+
+	skipped := expvarValue(progLines, "get.mtail", "false")
+	for _, line := range []string{"GET /", "POST /", "PUT /", "GET /a"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	for name, expected := range map[string]int64{"gets": 2, "lines": 4} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, got)
+		}
+	}
+	// The skipped lines are still counted as lines the program didn't match.
+	if got := expvarValue(progLines, "get.mtail", "false") - skipped; got != 2 {
+		t.Errorf("unmatched lines: expected 2, got %g", got)
+	}
+
+	// Unloading a program removes it from the prefilter, which then has
+	// nothing to say about it.
+	if l.prefilter.Scan("POST /").Runs("get.mtail") {
+		t.Error("expected get.mtail to be filtered")
+	}
+	l.UnloadProgram("get.mtail")
+	if !l.prefilter.Scan("POST /").Runs("get.mtail") {
+		t.Error("expected get.mtail to be gone from the prefilter")
+	}
+}
+
+func TestStrptimePOSIXFormat(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), OverrideLocation(time.UTC))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("strptime.mtail", strings.NewReader(`counter lines
+/^(?P<date>\S+ \S+) / {
+  strptime($date, "%Y-%m-%d %H:%M:%S")
+  lines++
+}
+`)))
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "2019-03-04 05:06:07 ok"))
+	d, err := store.Metrics["lines"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got, expected := d.TimeUTC(), time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC); !got.Equal(expected) {
+		t.Errorf("lines timestamp: expected %s, got %s", expected, got)
+	}
+
+	for _, line := range []string{"bad date ok", "bad date ok"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	// A timestamp that fails to parse leaves the timestamp unset, and the
+	// rest of the program still runs for those lines.
+	if got := datum.GetInt(d); got != 3 {
+		t.Errorf("lines: expected 3, got %d", got)
+	}
+	if s := l.handles["strptime.mtail"].RuntimeErrorString(); s != "" {
+		t.Errorf("unexpected runtime error: %s", s)
+	}
+	// Each failure is counted, as failures aren't memoized.
+	if got := expvarValue(timestampParseFailures, "strptime.mtail"); got != 2 {
+		t.Errorf("timestamp parse failures: expected 2, got %g", got)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	defer func(old int) { *maxStackDepth = old }(*maxStackDepth)
+	*maxStackDepth = 4
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("overflow.mtail", strings.NewReader(`counter lines
+counter total
+/ok/ {
+  lines++
+}
+/(\d+)/ {
+  total += 1 + (2 + (3 + (4 + $1)))
+}
+`)))
+	for _, line := range []string{"ok", "5", "ok"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	// The line that overflowed the stack was abandoned, and the lines after
+	// it were processed.
+	for name, expected := range map[string]int64{"lines": 2, "total": 0} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, got)
+		}
+	}
+	if got := expvarValue(stackOverflows, "overflow.mtail"); got != 1 {
+		t.Errorf("stack overflows: expected 1, got %g", got)
+	}
+}
+
+func TestMaxMetricsPerProgram(t *testing.T) {
+	defer testutil.TestSetFlag(t, "max_metrics_per_program", "3")()
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("cardinality.mtail", strings.NewReader(`counter lines
+counter requests by code
+counter bytes by host
+/^(?P<host>\S+) (?P<code>\d+)/ {
+  lines++
+  requests[$code]++
+  bytes[$host]++
+}
+`)))
+	for _, line := range []string{"web1 200", "web2 200", "web3 500", "web1 200", "web1 404"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	// The metric without labels doesn't count against the limit, and is
+	// updated by every line.
+	d, err := store.Metrics["lines"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 5 {
+		t.Errorf("lines: expected 5, got %d", got)
+	}
+	// The first line creates two label sets and the second one more, so the
+	// new label sets of the later lines aren't recorded, while the existing
+	// ones are still updated.
+	expected := map[string]map[string]int64{
+		"requests": {"200": 3},
+		"bytes":    {"web1": 3, "web2": 1},
+	}
+	for name, want := range expected {
+		got := make(map[string]int64)
+		for _, lv := range store.Metrics[name][0].LabelValues {
+			got[lv.Labels[0]] = datum.GetInt(lv.Value)
+		}
+		if diff := testutil.Diff(want, got); diff != "" {
+			t.Errorf("%s: unexpected label sets:\n%s", name, diff)
+		}
+	}
+	// web3 and 500 from the third line, and 404 from the last.
+	if got := expvarValue(metricsOverflows, "cardinality.mtail"); got != 3 {
+		t.Errorf("overflows: expected 3, got %g", got)
+	}
+}
+
+func TestMaxMetricsPerProgramAfterDelete(t *testing.T) {
+	defer testutil.TestSetFlag(t, "max_metrics_per_program", "2")()
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("cardinality_del.mtail", strings.NewReader(`counter requests by code
+/^del (?P<code>\d+)/ {
+  del requests[$code]
+  stop
+}
+/^(?P<code>\d+)/ {
+  requests[$code]++
+}
+`)))
+	// 404 isn't recorded at the limit, but is once a label set is deleted and
+	// the label sets are counted again.
+	for _, line := range []string{"200", "500", "404", "del 200"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	atomic.StoreInt64(&l.handles["cardinality_del.mtail"].labelSets.counted, 0)
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "404"))
+	got := make(map[string]int64)
+	for _, lv := range store.Metrics["requests"][0].LabelValues {
+		got[lv.Labels[0]] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"500": 1, "404": 1}, got); diff != "" {
+		t.Errorf("unexpected label sets:\n%s", diff)
+	}
+	if got := expvarValue(metricsOverflows, "cardinality_del.mtail"); got != 1 {
+		t.Errorf("overflows: expected 1, got %g", got)
+	}
+}
+
+func TestDebugPrint(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logPath := path.Join(tmpDir, "debug.log")
+	defer testutil.TestSetFlag(t, "debug_log_file", logPath)()
+	prog := `counter requests by code
+/(?P<code>\d+) (?P<path>\S+)/ {
+  debug_print("code %d for %s", $code, $path)
+  requests[$code]++
+}
+`
+	for _, enabled := range []bool{false, true} {
+		func() {
+			defer testutil.TestSetFlag(t, "debug_vm", fmt.Sprint(enabled))()
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, watcher.NewFakeWatcher())
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("debug.mtail", strings.NewReader(prog)))
+			for _, line := range []string{"200 /a", "404 /b"} {
+				l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+			}
+			l.Close()
+			// The rest of the program runs whether or not debug_print() is
+			// compiled.
+			if got := len(store.Metrics["requests"][0].LabelValues); got != 2 {
+				t.Errorf("debug_vm=%v: expected 2 label sets, got %d", enabled, got)
+			}
+		}()
+		if !enabled {
+			// Without --debug_vm, the debug log isn't even opened.
+			if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+				t.Errorf("debug log exists without --debug_vm: %v", err)
+			}
+		}
+	}
+	got, err := ioutil.ReadFile(logPath)
+	testutil.FatalIfErr(t, err)
+	expected := "debug.mtail:3: code 200 for /a\ndebug.mtail:3: code 404 for /b\n"
+	if diff := testutil.Diff(expected, string(got)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestStringIntern(t *testing.T) {
+	defer testutil.TestSetFlag(t, "vm_string_intern", "true")()
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("intern.mtail", strings.NewReader(`counter requests by host, code
+/^(?P<host>\S+) (?P<code>\d+)/ {
+  requests[$host, $code]++
+}
+`)))
+	for _, line := range []string{"web1 200", "web1 500", "web1 200"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	m := store.Metrics["requests"][0]
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("expected 2 label sets, got %v", m.LabelValues)
+	}
+	// The host of both label sets was matched in different lines, but is
+	// stored once.
+	a, b := m.LabelValues[0].Labels[0], m.LabelValues[1].Labels[0]
+	if a != "web1" || b != "web1" {
+		t.Fatalf("expected host web1, got %q and %q", a, b)
+	}
+	if (*reflect.StringHeader)(unsafe.Pointer(&a)).Data != (*reflect.StringHeader)(unsafe.Pointer(&b)).Data {
+		t.Errorf("host label values weren't interned")
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("requests.mtail", strings.NewReader(`counter requests by method, code
+counter bytes_total
+counter writes
+
+/^(?P<method>[A-Z]+) (?P<code>\d{3}) (?P<bytes>\S+)$/ {
+  requests[$method][$code]++
+  bytes_total += $bytes
+  $method =~ /^(PUT|POST)$/ {
+    writes++
+  }
+}
+`)))
+	testutil.FatalIfErr(t, l.CompileAndRun("other.mtail", strings.NewReader(`counter kernel
+/kernel: / {
+  kernel++
+}
+`)))
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "access.log", "GET 200 100"))
+
+	for _, tc := range []struct {
+		name     string
+		line     string
+		expected []*Trace
+	}{
+		{"matched",
+			"GET 200 1024\n",
+			[]*Trace{
+				{Program: "other.mtail", Patterns: []PatternTrace{{Pattern: "kernel: "}}},
+				{Program: "requests.mtail",
+					Matched: true,
+					Patterns: []PatternTrace{
+						{Pattern: `^(?P<method>[A-Z]+) (?P<code>\d{3}) (?P<bytes>\S+)$`,
+							Matched:  true,
+							Captures: map[string]string{"1": "GET", "method": "GET", "2": "200", "code": "200", "3": "1024", "bytes": "1024"}},
+						{Pattern: "^(PUT|POST)$"},
+					},
+					Updates: []UpdateTrace{
+						{Metric: "requests", Labels: map[string]string{"method": "GET", "code": "200"}, Value: "1"},
+						{Metric: "bytes_total", Value: "1024"},
+					}},
+			},
+		},
+		{"runtime error",
+			"POST 503 -",
+			[]*Trace{
+				{Program: "other.mtail", Patterns: []PatternTrace{{Pattern: "kernel: "}}},
+				{Program: "requests.mtail",
+					Matched: true,
+					Patterns: []PatternTrace{
+						{Pattern: `^(?P<method>[A-Z]+) (?P<code>\d{3}) (?P<bytes>\S+)$`,
+							Matched:  true,
+							Captures: map[string]string{"1": "POST", "method": "POST", "2": "503", "code": "503", "3": "-", "bytes": "-"}},
+					},
+					Updates: []UpdateTrace{
+						{Metric: "requests", Labels: map[string]string{"method": "POST", "code": "503"}, Value: "1"},
+					},
+					Errors: []string{`strconv.ParseInt: parsing "-": invalid syntax`}},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			l.TraceHandler(rec, httptest.NewRequest("POST", "/trace?filename=access.log", strings.NewReader(tc.line)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+			}
+			var traces []*Trace
+			testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &traces))
+			if diff := testutil.Diff(tc.expected, traces); diff != "" {
+				t.Errorf("traces didn't match:\n%s", diff)
+			}
+		})
+	}
+
+	// The real metrics only record the line that was processed.
+	for name, expected := range map[string]int64{"bytes_total": 100, "writes": 0} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, got)
+		}
+	}
+	if got := len(store.Metrics["requests"][0].LabelValues); got != 1 {
+		t.Errorf("requests: expected 1 label set, got %d", got)
+	}
+	if got := expvarValue(progRuntimeErrors, "requests.mtail"); got != 0 {
+		t.Errorf("errors: expected 0, got %g", got)
+	}
+
+	rec := httptest.NewRecorder()
+	l.TraceHandler(rec, httptest.NewRequest("GET", "/trace", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	l.TraceHandler(rec, httptest.NewRequest("POST", "/trace", strings.NewReader("one\ntwo\n")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("two lines: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestTraceLeavesStoreAndSamples(t *testing.T) {
+	store := metrics.NewStore()
+	store.SetMaxSeries(1)
+	l, err := NewLoader("", store, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("sampled.mtail", strings.NewReader(`counter requests by code
+counter lines_total sample 10
+/^(?P<code>\d{3})$/ {
+  requests[$code]++
+  lines_total++
+}
+`)))
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "200"))
+	samples := func() (n int64) {
+		for _, c := range l.handles["sampled.mtail"].samples {
+			n += atomic.LoadInt64(c)
+		}
+		return
+	}
+	if got := samples(); got != 1 {
+		t.Fatalf("expected 1 sample visit, got %d", got)
+	}
+
+	rec := httptest.NewRecorder()
+	l.TraceHandler(rec, httptest.NewRequest("POST", "/trace", strings.NewReader("500")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	if got := samples(); got != 1 {
+		t.Errorf("expected the trace not to visit the samples, got %d visits", got)
+	}
+	// The traced label set isn't counted in the store's series, so the real
+	// one isn't evicted, and a real line for another label set evicts it.
+	lvs := store.Metrics["requests"][0].LabelValues
+	if len(lvs) != 1 || lvs[0].Labels[0] != "200" {
+		t.Fatalf("expected only the real label set 200, got %v", lvs)
+	}
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "404"))
+	lvs = store.Metrics["requests"][0].LabelValues
+	if len(lvs) != 1 || lvs[0].Labels[0] != "404" {
+		t.Errorf("expected the series cap to keep only 404, got %v", lvs)
+	}
+}
+
+func TestLineWorkersMatchSerial(t *testing.T) {
+	prog := throughputProgram + `gauge latency_total_ms
+/ (?P<latency>\d+)ms$/ {
+  latency_total_ms += float($latency)
+}
+`
+	corpus := throughputCorpus(5000)
+	run := func(workers int) *metrics.Store {
+		store := metrics.NewStore()
+		l, err := NewLoader("", store, watcher.NewFakeWatcher(), LineWorkers(workers), OverrideLocation(time.UTC))
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, l.CompileAndRun("throughput", strings.NewReader(prog)))
+		for _, line := range corpus {
+			l.ProcessLogLine(context.Background(), logline.New(context.Background(), "throughput.log", line))
+		}
+		l.Close()
+		return store
+	}
+	// values returns the value of every series in the store; timestamps
+	// depend on the order the lines were processed in, so are left out.
+	values := func(store *metrics.Store) map[string]string {
+		v := make(map[string]string)
+		for name, ml := range store.Metrics {
+			for _, m := range ml {
+				for _, lv := range m.LabelValues {
+					key := name + fmt.Sprint(lv.Labels)
+					if b, ok := lv.Value.(*datum.Buckets); ok {
+						v[key] = fmt.Sprintf("%d %g %v", datum.GetBucketsCount(b), datum.GetBucketsSum(b), datum.GetBucketsCumByMax(b))
+						continue
+					}
+					v[key] = lv.Value.ValueString()
+				}
+			}
+		}
+		return v
+	}
+	serial := values(run(1))
+	if len(serial) == 0 {
+		t.Fatal("serial run recorded no metrics")
+	}
+	if diff := testutil.Diff(serial, values(run(4))); diff != "" {
+		t.Errorf("parallel run didn't match serial run:\n%s", diff)
+	}
+}
+
+func TestLineQueuePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    string
+		processed []string
+		dropped   int64
+	}{
+		{QueueBlock, []string{"1", "2", "3", "4", "5"}, 0},
+		{QueueDropOldest, []string{"1", "4", "5"}, 2},
+		{QueueDropNewest, []string{"1", "2", "3"}, 2},
+	} {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, watcher.NewFakeWatcher(), LineQueue(2, tc.policy))
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("queue", strings.NewReader(`counter lines by n
+/(?P<n>\d+)/ {
+  lines[$n]++
+}
+`)))
+			process := func(line string) {
+				l.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+			}
+			dropped := DroppedLineCount.Value()
+
+			// Hold up the line worker, as a slow program would, once it has
+			// taken the first line from the queue.
+			l.handleMu.Lock()
+			process("1")
+			for len(l.lines) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			// Two lines fill the queue, and the next two arrive when it's
+			// full.
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				for _, line := range []string{"2", "3", "4", "5"} {
+					process(line)
+				}
+			}()
+			if tc.policy == QueueBlock {
+				select {
+				case <-sent:
+					t.Error("lines were queued while the queue was full")
+				case <-time.After(100 * time.Millisecond):
+				}
+			} else {
+				<-sent
+			}
+			l.handleMu.Unlock()
+			<-sent
+			l.Close()
+
+			var processed []string
+			for _, lv := range store.Metrics["lines"][0].LabelValues {
+				processed = append(processed, lv.Labels[0])
+			}
+			if diff := testutil.Diff(tc.processed, processed); diff != "" {
+				t.Errorf("processed lines:\n%s", diff)
+			}
+			if got := DroppedLineCount.Value() - dropped; got != tc.dropped {
+				t.Errorf("dropped lines: expected %d, got %d", tc.dropped, got)
+			}
+		})
+	}
+}
+
+func TestLineQueueInvalid(t *testing.T) {
+	for _, option := range []func(*Loader) error{
+		LineQueue(-1, QueueBlock),
+		LineQueue(10, "drop-random"),
+	} {
+		if _, err := NewLoader("", metrics.NewStore(), watcher.NewFakeWatcher(), option); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strconv"
+)
+
+// parseLogfmt parses a line of logfmt formatted key=value pairs, like
+// `level=info msg="request done" dur=12ms`, into a map of keys to values.
+// Values may be double quoted, with backslash escapes as in Go string
+// literals.  A key with no `=` has an empty value.  If a key appears more than
+// once, the last value wins.  Malformed input is skipped up to the next space.
+func parseLogfmt(line string) map[string]string {
+	kv := make(map[string]string)
+	i := 0
+	for i < len(line) {
+		// Skip the space between pairs.
+		if line[i] <= ' ' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			i = skipToSpace(line, i)
+			continue
+		}
+		if i >= len(line) || line[i] != '=' {
+			// A bare key.
+			kv[key] = ""
+			if i < len(line) && line[i] == '"' {
+				i = skipToSpace(line, i)
+			}
+			continue
+		}
+		i++ // Skip the '='.
+		if i < len(line) && line[i] == '"' {
+			start = i
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(line) {
+				// Unterminated quote; take the rest of the line as is.
+				kv[key] = line[start+1:]
+				break
+			}
+			i++ // Skip the closing quote.
+			value, err := strconv.Unquote(line[start:i])
+			if err != nil {
+				// Invalid escapes; take the text between the quotes as is.
+				value = line[start+1 : i-1]
+			}
+			kv[key] = value
+			continue
+		}
+		start = i
+		i = skipToSpace(line, i)
+		kv[key] = line[start:i]
+	}
+	return kv
+}
+
+// skipToSpace returns the index of the first space in line at or after i, or
+// the length of the line if there is none.
+func skipToSpace(line string, i int) int {
+	for i < len(line) && line[i] > ' ' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var logfmtTests = []struct {
+	name     string
+	line     string
+	expected map[string]string
+}{
+	{"empty", "", map[string]string{}},
+	{"bare values",
+		"level=info dur=12ms path=/foo",
+		map[string]string{"level": "info", "dur": "12ms", "path": "/foo"}},
+	{"quoted value with spaces",
+		`level=info msg="request done" dur=12ms`,
+		map[string]string{"level": "info", "msg": "request done", "dur": "12ms"}},
+	{"escaped quotes",
+		`msg="she said \"hi\"" user=bob`,
+		map[string]string{"msg": `she said "hi"`, "user": "bob"}},
+	{"escaped backslash and newline",
+		`path="C:\\temp" err="line one\nline two"`,
+		map[string]string{"path": `C:\temp`, "err": "line one\nline two"}},
+	{"empty values",
+		`a= b="" c`,
+		map[string]string{"a": "", "b": "", "c": ""}},
+	{"extra whitespace",
+		"  a=1 \t b=2  ",
+		map[string]string{"a": "1", "b": "2"}},
+	{"repeated key",
+		"a=1 a=2",
+		map[string]string{"a": "2"}},
+	{"unterminated quote",
+		`a=1 msg="oops`,
+		map[string]string{"a": "1", "msg": "oops"}},
+	{"invalid escape",
+		`msg="bad \q escape" a=1`,
+		map[string]string{"msg": `bad \q escape`, "a": "1"}},
+	{"malformed",
+		`=x "quoted" a=1`,
+		map[string]string{"a": "1"}},
+}
+
+func TestParseLogfmt(t *testing.T) {
+	for _, tc := range logfmtTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := testutil.Diff(tc.expected, parseLogfmt(tc.line)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
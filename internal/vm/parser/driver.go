@@ -95,7 +95,7 @@ func (p *parser) Lex(lval *mtailSymType) int {
 			p.Error(fmt.Sprintf("%s", err))
 			return INVALID
 		}
-	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW, MOD, CONCAT, MATCH, NOT_MATCH:
+	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, MAX_ASSIGN, MIN_ASSIGN, POW, MOD, CONCAT, MATCH, NOT_MATCH:
 		lval.op = int(p.t.Kind)
 	default:
 		lval.text = p.t.Spelling
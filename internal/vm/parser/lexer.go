@@ -17,38 +17,79 @@ import (
 
 // List of keywords.  Keep this list sorted!
 var keywords = map[string]Kind{
-	"after":     AFTER,
-	"as":        AS,
-	"buckets":   BUCKETS,
-	"by":        BY,
-	"const":     CONST,
-	"counter":   COUNTER,
-	"def":       DEF,
-	"del":       DEL,
-	"else":      ELSE,
-	"gauge":     GAUGE,
-	"hidden":    HIDDEN,
-	"histogram": HISTOGRAM,
-	"next":      NEXT,
-	"otherwise": OTHERWISE,
-	"stop":      STOP,
-	"text":      TEXT,
-	"timer":     TIMER,
+	"accumulate":               ACCUMULATE,
+	"after":                    AFTER,
+	"alias":                    ALIAS,
+	"as":                       AS,
+	"buckets":                  BUCKETS,
+	"by":                       BY,
+	"const":                    CONST,
+	"counter":                  COUNTER,
+	"counter_window":           COUNTER_WINDOW,
+	"def":                      DEF,
+	"default_timestamp_source": DEFAULT_TIMESTAMP_SOURCE,
+	"del":                      DEL,
+	"else":                     ELSE,
+	"exclude":                  EXCLUDE,
+	"filename_labels":          FILENAME_LABELS,
+	"finalize":                 FINALIZE,
+	"foreach":                  FOREACH,
+	"formats":                  FORMATS,
+	"gauge":                    GAUGE,
+	"hidden":                   HIDDEN,
+	"histogram":                HISTOGRAM,
+	"histogram_adaptive":       HISTOGRAM_ADAPTIVE,
+	"hll":                      HLL,
+	"info":                     INFO,
+	"next":                     NEXT,
+	"otherwise":                OTHERWISE,
+	"random":                   RANDOM,
+	"sample":                   SAMPLE,
+	"stop":                     STOP,
+	"text":                     TEXT,
+	"timer":                    TIMER,
+	"timestamp_source":         TIMESTAMP_SOURCE,
+}
+
+// Identifiers that are assignment operators when followed by `='.
+var assignOps = map[string]Kind{
+	"max": MAX_ASSIGN,
+	"min": MIN_ASSIGN,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
+	"accesslog",
+	"accumulated",
+	"base64_decode",
+	"base64_encode",
 	"bool",
+	"bucket",
+	"collapse",
+	"crc32",
+	"debug_print",
+	"decode_uri_component",
+	"duration",
+	"encode_uri_component",
 	"float",
+	"fnv32",
+	"geoip",
+	"getenv",
 	"getfilename",
+	"hash",
+	"hll_add",
 	"int",
+	"journalfield",
+	"json_extract",
 	"len",
+	"logfmt",
 	"settime",
 	"string",
 	"strptime",
 	"strtol",
 	"timestamp",
 	"tolower",
+	"xml_extract",
 }
 
 // Dictionary returns a list of all keywords and builtins of the language.
@@ -230,6 +271,9 @@ func lexProg(l *Lexer) stateFn {
 	case r == ',':
 		l.accept()
 		l.emit(COMMA)
+	case r == ':':
+		l.accept()
+		l.emit(COLON)
 	case r == '-':
 		l.accept()
 		switch r = l.next(); {
@@ -534,6 +578,15 @@ Loop:
 			break Loop
 		}
 	}
+	// `max=' and `min=' are assignment operators, but `max == x' compares.
+	if op, ok := assignOps[l.text.String()]; ok {
+		if b, _ := l.input.Peek(2); len(b) > 0 && b[0] == '=' && (len(b) == 1 || b[1] != '=') {
+			l.next()
+			l.accept()
+			l.emit(op)
+			return lexProg
+		}
+	}
 	if r, ok := keywords[l.text.String()]; ok {
 		l.emit(r)
 	} else if r := sort.SearchStrings(builtins, l.text.String()); r >= 0 && r < len(builtins) && builtins[r] == l.text.String() {
@@ -594,6 +647,19 @@ Loop:
 			break Loop
 		}
 	}
+	// learn_from, metric_type and reset_on_export are attributes of a
+	// declaration, not decorators.
+	switch l.text.String() {
+	case "learn_from":
+		l.emit(LEARN_FROM)
+		return lexProg
+	case "metric_type":
+		l.emit(METRIC_TYPE)
+		return lexProg
+	case "reset_on_export":
+		l.emit(RESET_ON_EXPORT)
+		return lexProg
+	}
 	l.emit(DECO)
 	return lexProg
 }
@@ -29,7 +29,7 @@ var lexerTests = []lexerTest{
 		{EOF, "", position.Position{"comment", 0, 9, 9}}}},
 	{"comment not at col 1", "  # comment", []Token{
 		{EOF, "", position.Position{"comment not at col 1", 0, 11, 11}}}},
-	{"punctuation", "{}()[],", []Token{
+	{"punctuation", "{}()[],:", []Token{
 		{LCURLY, "{", position.Position{"punctuation", 0, 0, 0}},
 		{RCURLY, "}", position.Position{"punctuation", 0, 1, 1}},
 		{LPAREN, "(", position.Position{"punctuation", 0, 2, 2}},
@@ -37,7 +37,8 @@ var lexerTests = []lexerTest{
 		{LSQUARE, "[", position.Position{"punctuation", 0, 4, 4}},
 		{RSQUARE, "]", position.Position{"punctuation", 0, 5, 5}},
 		{COMMA, ",", position.Position{"punctuation", 0, 6, 6}},
-		{EOF, "", position.Position{"punctuation", 0, 7, 7}}}},
+		{COLON, ":", position.Position{"punctuation", 0, 7, 7}},
+		{EOF, "", position.Position{"punctuation", 0, 8, 8}}}},
 	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ ** % || && =~ !~ --", []Token{
 		{MINUS, "-", position.Position{"operators", 0, 0, 0}},
 		{PLUS, "+", position.Position{"operators", 0, 2, 2}},
@@ -67,7 +68,7 @@ var lexerTests = []lexerTest{
 		{DEC, "--", position.Position{"operators", 0, 63, 64}},
 		{EOF, "", position.Position{"operators", 0, 65, 65}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\n", []Token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\nsample\nrandom\ncounter_window\nforeach\nalias\ninfo\nhll\nexclude\nformats\naccumulate\nfinalize\n", []Token{
 			{COUNTER, "counter", position.Position{"keywords", 0, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 1, 7, -1}},
 			{GAUGE, "gauge", position.Position{"keywords", 1, 0, 4}},
@@ -102,9 +103,31 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position.Position{"keywords", 16, 9, -1}},
 			{BUCKETS, "buckets", position.Position{"keywords", 16, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 17, 7, -1}},
-			{EOF, "", position.Position{"keywords", 17, 0, 0}}}},
+			{SAMPLE, "sample", position.Position{"keywords", 17, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 18, 6, -1}},
+			{RANDOM, "random", position.Position{"keywords", 18, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 19, 6, -1}},
+			{COUNTER_WINDOW, "counter_window", position.Position{"keywords", 19, 0, 13}},
+			{NL, "\n", position.Position{"keywords", 20, 14, -1}},
+			{FOREACH, "foreach", position.Position{"keywords", 20, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 21, 7, -1}},
+			{ALIAS, "alias", position.Position{"keywords", 21, 0, 4}},
+			{NL, "\n", position.Position{"keywords", 22, 5, -1}},
+			{INFO, "info", position.Position{"keywords", 22, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 23, 4, -1}},
+			{HLL, "hll", position.Position{"keywords", 23, 0, 2}},
+			{NL, "\n", position.Position{"keywords", 24, 3, -1}},
+			{EXCLUDE, "exclude", position.Position{"keywords", 24, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 25, 7, -1}},
+			{FORMATS, "formats", position.Position{"keywords", 25, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 26, 7, -1}},
+			{ACCUMULATE, "accumulate", position.Position{"keywords", 26, 0, 9}},
+			{NL, "\n", position.Position{"keywords", 27, 10, -1}},
+			{FINALIZE, "finalize", position.Position{"keywords", 27, 0, 7}},
+			{NL, "\n", position.Position{"keywords", 28, 8, -1}},
+			{EOF, "", position.Position{"keywords", 28, 0, 0}}}},
 	{"builtins",
-		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\n", []Token{
+		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\nhll_add\ndecode_uri_component\nencode_uri_component\nbase64_decode\nbase64_encode\njson_extract\nxml_extract\nhash\ncrc32\nfnv32\nduration\naccumulated\n", []Token{
 			{BUILTIN, "strptime", position.Position{"builtins", 0, 0, 7}},
 			{NL, "\n", position.Position{"builtins", 1, 8, -1}},
 			{BUILTIN, "timestamp", position.Position{"builtins", 1, 0, 8}},
@@ -127,7 +150,31 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position.Position{"builtins", 10, 5, -1}},
 			{BUILTIN, "string", position.Position{"builtins", 10, 0, 5}},
 			{NL, "\n", position.Position{"builtins", 11, 6, -1}},
-			{EOF, "", position.Position{"builtins", 11, 0, 0}}}},
+			{BUILTIN, "hll_add", position.Position{"builtins", 11, 0, 6}},
+			{NL, "\n", position.Position{"builtins", 12, 7, -1}},
+			{BUILTIN, "decode_uri_component", position.Position{"builtins", 12, 0, 19}},
+			{NL, "\n", position.Position{"builtins", 13, 20, -1}},
+			{BUILTIN, "encode_uri_component", position.Position{"builtins", 13, 0, 19}},
+			{NL, "\n", position.Position{"builtins", 14, 20, -1}},
+			{BUILTIN, "base64_decode", position.Position{"builtins", 14, 0, 12}},
+			{NL, "\n", position.Position{"builtins", 15, 13, -1}},
+			{BUILTIN, "base64_encode", position.Position{"builtins", 15, 0, 12}},
+			{NL, "\n", position.Position{"builtins", 16, 13, -1}},
+			{BUILTIN, "json_extract", position.Position{"builtins", 16, 0, 11}},
+			{NL, "\n", position.Position{"builtins", 17, 12, -1}},
+			{BUILTIN, "xml_extract", position.Position{"builtins", 17, 0, 10}},
+			{NL, "\n", position.Position{"builtins", 18, 11, -1}},
+			{BUILTIN, "hash", position.Position{"builtins", 18, 0, 3}},
+			{NL, "\n", position.Position{"builtins", 19, 4, -1}},
+			{BUILTIN, "crc32", position.Position{"builtins", 19, 0, 4}},
+			{NL, "\n", position.Position{"builtins", 20, 5, -1}},
+			{BUILTIN, "fnv32", position.Position{"builtins", 20, 0, 4}},
+			{NL, "\n", position.Position{"builtins", 21, 5, -1}},
+			{BUILTIN, "duration", position.Position{"builtins", 21, 0, 7}},
+			{NL, "\n", position.Position{"builtins", 22, 8, -1}},
+			{BUILTIN, "accumulated", position.Position{"builtins", 22, 0, 10}},
+			{NL, "\n", position.Position{"builtins", 23, 11, -1}},
+			{EOF, "", position.Position{"builtins", 23, 0, 0}}}},
 	{"numbers", "1 23 3.14 1.61.1 -1 -1.0 1h 0d 3d -1.5h 15m 24h0m0s 1e3 1e-3 .11 123.456e7", []Token{
 		{INTLITERAL, "1", position.Position{"numbers", 0, 0, 0}},
 		{INTLITERAL, "23", position.Position{"numbers", 0, 2, 3}},
@@ -191,6 +238,24 @@ var lexerTests = []lexerTest{
 	{"decorator", `@foo`, []Token{
 		{DECO, "foo", position.Position{"decorator", 0, 0, 3}},
 		{EOF, "", position.Position{"decorator", 0, 4, 4}}}},
+	{"metric type", `@metric_type("untyped")`, []Token{
+		{METRIC_TYPE, "metric_type", position.Position{"metric type", 0, 0, 11}},
+		{LPAREN, "(", position.Position{"metric type", 0, 12, 12}},
+		{STRING, "untyped", position.Position{"metric type", 0, 13, 21}},
+		{RPAREN, ")", position.Position{"metric type", 0, 22, 22}},
+		{EOF, "", position.Position{"metric type", 0, 23, 23}}}},
+	{"reset on export", `@reset_on_export`, []Token{
+		{RESET_ON_EXPORT, "reset_on_export", position.Position{"reset on export", 0, 0, 15}},
+		{EOF, "", position.Position{"reset on export", 0, 16, 16}}}},
+	{"max and min assignment", "a max= b min= max == min", []Token{
+		{ID, "a", position.Position{"max and min assignment", 0, 0, 0}},
+		{MAX_ASSIGN, "max=", position.Position{"max and min assignment", 0, 2, 5}},
+		{ID, "b", position.Position{"max and min assignment", 0, 7, 7}},
+		{MIN_ASSIGN, "min=", position.Position{"max and min assignment", 0, 9, 12}},
+		{ID, "max", position.Position{"max and min assignment", 0, 14, 16}},
+		{EQ, "==", position.Position{"max and min assignment", 0, 18, 19}},
+		{ID, "min", position.Position{"max and min assignment", 0, 21, 23}},
+		{EOF, "", position.Position{"max and min assignment", 0, 24, 24}}}},
 	{"large program",
 		"/(?P<date>[[:digit:]-\\/ ])/ {\n" +
 			"  strptime($date, \"%Y/%m/%d %H:%M:%S\")\n" +
@@ -29,6 +29,8 @@ type mtailSymType struct {
 	n        ast.Node
 	kind     metrics.Kind
 	duration time.Duration
+	sample   *ast.SampleSpec
+	learn    *ast.LearnSpec
 }
 
 const INVALID = 57346
@@ -37,63 +39,84 @@ const GAUGE = 57348
 const TIMER = 57349
 const TEXT = 57350
 const HISTOGRAM = 57351
-const AFTER = 57352
-const AS = 57353
-const BY = 57354
-const CONST = 57355
-const HIDDEN = 57356
-const DEF = 57357
-const DEL = 57358
-const NEXT = 57359
-const OTHERWISE = 57360
-const ELSE = 57361
-const STOP = 57362
-const BUCKETS = 57363
-const BUILTIN = 57364
-const REGEX = 57365
-const STRING = 57366
-const CAPREF = 57367
-const CAPREF_NAMED = 57368
-const ID = 57369
-const DECO = 57370
-const INTLITERAL = 57371
-const FLOATLITERAL = 57372
-const DURATIONLITERAL = 57373
-const INC = 57374
-const DEC = 57375
-const DIV = 57376
-const MOD = 57377
-const MUL = 57378
-const MINUS = 57379
-const PLUS = 57380
-const POW = 57381
-const SHL = 57382
-const SHR = 57383
-const LT = 57384
-const GT = 57385
-const LE = 57386
-const GE = 57387
-const EQ = 57388
-const NE = 57389
-const BITAND = 57390
-const XOR = 57391
-const BITOR = 57392
-const NOT = 57393
-const AND = 57394
-const OR = 57395
-const ADD_ASSIGN = 57396
-const ASSIGN = 57397
-const CONCAT = 57398
-const MATCH = 57399
-const NOT_MATCH = 57400
-const LCURLY = 57401
-const RCURLY = 57402
-const LPAREN = 57403
-const RPAREN = 57404
-const LSQUARE = 57405
-const RSQUARE = 57406
-const COMMA = 57407
-const NL = 57408
+const HISTOGRAM_ADAPTIVE = 57352
+const COUNTER_WINDOW = 57353
+const HLL = 57354
+const AFTER = 57355
+const ALIAS = 57356
+const AS = 57357
+const BY = 57358
+const CONST = 57359
+const HIDDEN = 57360
+const DEF = 57361
+const DEL = 57362
+const NEXT = 57363
+const OTHERWISE = 57364
+const ELSE = 57365
+const FOREACH = 57366
+const FORMATS = 57367
+const FILENAME_LABELS = 57368
+const EXCLUDE = 57369
+const STOP = 57370
+const ACCUMULATE = 57371
+const FINALIZE = 57372
+const BUCKETS = 57373
+const SAMPLE = 57374
+const RANDOM = 57375
+const INFO = 57376
+const TIMESTAMP_SOURCE = 57377
+const DEFAULT_TIMESTAMP_SOURCE = 57378
+const LEARN_FROM = 57379
+const METRIC_TYPE = 57380
+const RESET_ON_EXPORT = 57381
+const BUILTIN = 57382
+const REGEX = 57383
+const STRING = 57384
+const CAPREF = 57385
+const CAPREF_NAMED = 57386
+const ID = 57387
+const DECO = 57388
+const INTLITERAL = 57389
+const FLOATLITERAL = 57390
+const DURATIONLITERAL = 57391
+const INC = 57392
+const DEC = 57393
+const DIV = 57394
+const MOD = 57395
+const MUL = 57396
+const MINUS = 57397
+const PLUS = 57398
+const POW = 57399
+const SHL = 57400
+const SHR = 57401
+const LT = 57402
+const GT = 57403
+const LE = 57404
+const GE = 57405
+const EQ = 57406
+const NE = 57407
+const BITAND = 57408
+const XOR = 57409
+const BITOR = 57410
+const NOT = 57411
+const AND = 57412
+const OR = 57413
+const ADD_ASSIGN = 57414
+const MAX_ASSIGN = 57415
+const MIN_ASSIGN = 57416
+const ASSIGN = 57417
+const CONCAT = 57418
+const MATCH = 57419
+const NOT_MATCH = 57420
+const LCURLY = 57421
+const RCURLY = 57422
+const LPAREN = 57423
+const RPAREN = 57424
+const LSQUARE = 57425
+const RSQUARE = 57426
+const COMMA = 57427
+const COLON = 57428
+const NL = 57429
 
 var mtailToknames = [...]string{
 	"$end",
@@ -105,7 +128,11 @@ var mtailToknames = [...]string{
 	"TIMER",
 	"TEXT",
 	"HISTOGRAM",
+	"HISTOGRAM_ADAPTIVE",
+	"COUNTER_WINDOW",
+	"HLL",
 	"AFTER",
+	"ALIAS",
 	"AS",
 	"BY",
 	"CONST",
@@ -115,8 +142,22 @@ var mtailToknames = [...]string{
 	"NEXT",
 	"OTHERWISE",
 	"ELSE",
+	"FOREACH",
+	"FORMATS",
+	"FILENAME_LABELS",
+	"EXCLUDE",
 	"STOP",
+	"ACCUMULATE",
+	"FINALIZE",
 	"BUCKETS",
+	"SAMPLE",
+	"RANDOM",
+	"INFO",
+	"TIMESTAMP_SOURCE",
+	"DEFAULT_TIMESTAMP_SOURCE",
+	"LEARN_FROM",
+	"METRIC_TYPE",
+	"RESET_ON_EXPORT",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
@@ -150,6 +191,8 @@ var mtailToknames = [...]string{
 	"AND",
 	"OR",
 	"ADD_ASSIGN",
+	"MAX_ASSIGN",
+	"MIN_ASSIGN",
 	"ASSIGN",
 	"CONCAT",
 	"MATCH",
@@ -161,6 +204,7 @@ var mtailToknames = [...]string{
 	"LSQUARE",
 	"RSQUARE",
 	"COMMA",
+	"COLON",
 	"NL",
 }
 var mtailStatenames = [...]string{}
@@ -169,9 +213,9 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:651
+//line parser.y:908
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
 	return mtaillex.(*parser).t.Pos
 }
@@ -189,151 +233,209 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
-	-1, 24,
-	66, 21,
-	-2, 66,
-	-1, 107,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
+	19, 160,
+	25, 160,
+	29, 160,
+	30, 160,
+	36, 160,
+	46, 160,
+	52, 160,
+	-2, 103,
+	-1, 30,
+	87, 33,
+	-2, 80,
+	-1, 136,
+	19, 160,
+	25, 160,
+	29, 160,
+	30, 160,
+	36, 160,
+	46, 160,
+	52, 160,
+	-2, 103,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 233
+const mtailLast = 343
 
 var mtailAct = [...]int{
 
-	158, 21, 92, 64, 44, 29, 28, 43, 42, 27,
-	26, 30, 47, 93, 14, 41, 24, 91, 123, 46,
-	19, 154, 152, 153, 153, 88, 106, 53, 52, 168,
-	22, 167, 50, 51, 63, 89, 49, 13, 50, 51,
-	31, 28, 127, 94, 87, 49, 11, 25, 2, 20,
-	10, 15, 90, 12, 165, 33, 13, 36, 34, 35,
-	45, 60, 38, 39, 45, 11, 25, 142, 20, 10,
-	15, 113, 12, 105, 33, 114, 36, 34, 35, 45,
-	140, 38, 39, 161, 40, 80, 81, 103, 83, 82,
-	124, 124, 104, 133, 37, 50, 51, 112, 107, 16,
-	85, 86, 1, 40, 66, 68, 67, 131, 126, 28,
-	29, 28, 162, 37, 100, 101, 99, 130, 16, 102,
-	136, 24, 146, 28, 28, 19, 141, 143, 145, 144,
-	151, 150, 156, 155, 147, 148, 132, 149, 69, 116,
-	73, 74, 75, 76, 77, 78, 117, 97, 96, 70,
-	71, 61, 79, 118, 98, 166, 119, 120, 121, 171,
-	170, 122, 164, 163, 62, 95, 48, 65, 169, 128,
-	60, 33, 129, 36, 34, 35, 45, 84, 38, 39,
-	33, 115, 36, 34, 35, 45, 72, 38, 39, 33,
-	18, 36, 34, 35, 45, 157, 38, 39, 160, 111,
-	40, 159, 110, 70, 71, 138, 137, 134, 135, 40,
-	37, 125, 54, 109, 9, 139, 8, 7, 108, 37,
-	55, 56, 57, 58, 59, 6, 32, 23, 37, 17,
+	27, 256, 152, 213, 33, 114, 18, 63, 35, 50,
+	48, 28, 47, 135, 49, 134, 52, 54, 71, 245,
+	36, 135, 263, 85, 32, 69, 34, 68, 209, 70,
+	62, 266, 259, 246, 202, 111, 236, 115, 53, 203,
+	30, 13, 202, 201, 202, 238, 237, 235, 253, 252,
+	113, 39, 116, 42, 40, 41, 51, 261, 44, 45,
+	87, 89, 88, 207, 84, 229, 224, 34, 128, 131,
+	208, 126, 112, 87, 89, 88, 210, 137, 254, 65,
+	46, 141, 127, 39, 37, 42, 40, 41, 51, 206,
+	44, 45, 43, 154, 66, 67, 39, 110, 42, 40,
+	41, 51, 143, 44, 45, 211, 156, 101, 102, 144,
+	138, 59, 153, 153, 189, 155, 145, 66, 67, 146,
+	147, 148, 149, 150, 43, 46, 151, 159, 240, 161,
+	66, 67, 2, 157, 239, 165, 158, 43, 163, 65,
+	228, 164, 35, 87, 89, 88, 166, 132, 108, 109,
+	192, 119, 118, 194, 195, 196, 197, 188, 34, 51,
+	34, 130, 199, 198, 205, 191, 200, 204, 190, 193,
+	34, 34, 34, 34, 30, 13, 181, 180, 179, 104,
+	105, 106, 103, 125, 140, 218, 94, 95, 96, 97,
+	98, 99, 231, 182, 183, 142, 262, 186, 136, 184,
+	187, 178, 60, 232, 17, 122, 123, 121, 57, 223,
+	124, 174, 56, 58, 234, 233, 248, 15, 31, 55,
+	26, 14, 19, 222, 20, 162, 11, 12, 16, 61,
+	91, 92, 91, 92, 25, 59, 258, 185, 257, 247,
+	39, 249, 42, 40, 41, 51, 244, 44, 45, 225,
+	226, 251, 250, 243, 17, 241, 242, 227, 216, 260,
+	215, 255, 153, 214, 264, 265, 129, 15, 31, 46,
+	26, 14, 19, 139, 20, 133, 11, 12, 16, 1,
+	167, 43, 221, 220, 25, 83, 173, 22, 82, 172,
+	39, 219, 42, 40, 41, 51, 171, 44, 45, 81,
+	74, 75, 76, 77, 78, 73, 79, 80, 90, 100,
+	120, 117, 64, 86, 107, 93, 24, 170, 217, 46,
+	177, 176, 169, 72, 21, 160, 212, 168, 230, 7,
+	175, 43, 10, 9, 8, 6, 38, 22, 29, 23,
 	5, 4, 3,
 }
 var mtailPact = [...]int{
 
-	-1000, -1000, 52, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, 37, -1000, -1000, -14, -23, -1000, -39, 215, 136,
-	167, 56, -1000, -1000, 117, -1000, 98, -1000, 28, 34,
-	60, 6, -38, -26, -1000, -1000, -1000, 158, -1000, -1000,
-	158, 110, -1000, -1000, 80, -1000, -1000, 73, -40, -1000,
-	-1000, -1000, -1000, -1000, 175, -1000, -1000, -1000, -1000, -1000,
-	-1000, 44, -23, 171, -1000, -40, -1000, -1000, -1000, -1000,
-	-1000, -1000, -40, -1000, -1000, -1000, -1000, -1000, -1000, -40,
-	-1000, -1000, -40, -40, -40, -1000, -1000, -40, 158, 149,
-	-20, 27, -1000, 117, -1000, -40, -1000, -1000, -40, -1000,
-	-1000, -1000, -1000, 6, -23, 158, -1000, 33, 194, -1000,
-	-1000, -1000, 57, -23, -1000, 36, 158, 158, 167, 158,
-	158, 158, 37, -42, 56, -1000, -41, -1000, 158, 158,
-	-1000, 56, -1000, -1000, -1000, -1000, -1000, 174, 59, 133,
-	20, -1000, -1000, 98, 60, -1000, -1000, 43, 43, 110,
-	-1000, -1000, -1000, 158, -1000, 80, -1000, -34, -1000, -1000,
-	-1000, -1000, -36, -1000, -1000, -1000, 56, 174, 130, -1000,
-	-1000, -1000,
+	-1000, -1000, 250, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 183, -1000, 114, -1000, -1000, 60, 0,
+	-1000, 0, -1000, -69, 295, 243, 43, 77, -1000, -1000,
+	180, -1000, 126, -1000, 30, 107, 90, 41, -48, -9,
+	-1000, -1000, -1000, 56, -1000, -1000, 56, 96, -1000, -1000,
+	153, -1000, -1000, 59, -1000, 138, -10, 3, -13, -1000,
+	116, 0, -1000, 252, -74, -1000, -1000, -1000, -1000, 0,
+	-1000, -1000, 243, 243, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, 2, -1000, -1000, 182, -1000, -74, -1000, -1000, -1000,
+	-1000, -1000, -1000, -74, -1000, -1000, -1000, -1000, -1000, -1000,
+	-74, -1000, -1000, -74, -74, -74, -74, -74, -1000, -1000,
+	-74, 56, 11, 24, -1000, 180, -1000, -74, -1000, -1000,
+	-74, -1000, -1000, -1000, -1000, -1000, 56, -1000, 56, 184,
+	0, -1000, 41, 0, 56, -1000, 200, -1000, 162, -1000,
+	162, -74, 65, 56, 56, 43, 56, 56, 56, 56,
+	56, 114, -41, 77, -1000, -43, -1000, 56, 56, 7,
+	-17, -6, 53, -1000, -1000, 77, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, 218,
+	216, 218, 235, 176, -15, 202, 95, -16, 218, -1000,
+	126, 90, -1000, -1000, 47, 47, 47, 47, 96, -1000,
+	-1000, -1000, 56, -1000, 153, -1000, -1000, 0, -1000, -1000,
+	-1000, -1000, -38, -50, -1000, -1000, -1000, -39, -1000, -40,
+	-1000, -1000, -1000, 87, 81, -1000, -1000, 208, -1000, 211,
+	-66, -53, 77, -1000, -1000, 218, 174, 218, 204, -1000,
+	-33, -1000, -1000, -34, -2, -74, 196, -54, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, 218, -1000, -1000, -24, 154,
+	-64, 56, -1000, 196, -51, -1000, -1000,
 }
 var mtailPgo = [...]int{
 
-	0, 48, 232, 18, 12, 231, 230, 229, 3, 4,
-	15, 13, 2, 227, 10, 11, 1, 14, 226, 7,
-	40, 9, 225, 218, 217, 216, 8, 30, 214, 213,
-	212, 208, 0, 207, 195, 190, 186, 177, 167, 166,
-	165, 154, 152, 138, 120, 112, 102, 73, 17, 97,
+	0, 132, 342, 2, 7, 341, 340, 339, 23, 9,
+	12, 37, 5, 338, 24, 20, 0, 6, 336, 14,
+	84, 4, 335, 110, 334, 333, 10, 11, 332, 273,
+	330, 329, 328, 1, 327, 326, 325, 324, 323, 322,
+	3, 321, 320, 318, 317, 316, 315, 314, 313, 312,
+	311, 310, 309, 308, 296, 291, 289, 286, 279, 38,
+	15, 266,
 }
 var mtailR1 = [...]int{
 
-	0, 46, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 5, 5, 5, 6, 6, 4,
-	7, 7, 13, 13, 17, 17, 17, 17, 39, 39,
-	16, 16, 38, 38, 38, 14, 14, 36, 36, 36,
-	36, 36, 36, 15, 15, 37, 37, 10, 10, 27,
-	27, 27, 42, 42, 21, 20, 20, 20, 40, 40,
-	9, 9, 41, 41, 41, 41, 12, 12, 11, 11,
-	43, 43, 8, 8, 8, 8, 8, 8, 8, 8,
-	8, 18, 18, 19, 3, 3, 26, 22, 35, 35,
-	23, 23, 23, 23, 29, 29, 30, 30, 30, 30,
-	30, 33, 34, 34, 31, 44, 45, 45, 45, 45,
-	24, 25, 28, 28, 32, 32, 48, 49, 47, 47,
+	0, 58, 1, 1, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 5,
+	5, 5, 5, 5, 5, 37, 36, 36, 36, 6,
+	6, 4, 7, 7, 13, 13, 13, 13, 17, 17,
+	17, 17, 49, 49, 16, 16, 48, 48, 48, 14,
+	14, 46, 46, 46, 46, 46, 46, 15, 15, 47,
+	47, 10, 10, 27, 27, 27, 52, 52, 21, 20,
+	20, 20, 50, 50, 9, 9, 51, 51, 51, 51,
+	12, 12, 11, 11, 53, 53, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 18, 18, 19, 3, 3,
+	26, 22, 22, 45, 45, 23, 23, 23, 23, 23,
+	23, 23, 23, 23, 23, 23, 23, 29, 29, 38,
+	38, 38, 38, 38, 38, 38, 31, 32, 32, 33,
+	33, 34, 35, 35, 35, 35, 43, 43, 39, 44,
+	54, 55, 55, 55, 55, 30, 30, 30, 30, 41,
+	56, 56, 57, 42, 24, 25, 28, 28, 40, 40,
+	59, 61, 60, 60,
 }
 var mtailR2 = [...]int{
 
 	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	1, 3, 1, 1, 4, 2, 2, 1, 2, 3,
-	1, 1, 4, 4, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 4, 1, 1, 1,
-	1, 1, 1, 1, 4, 1, 1, 1, 4, 1,
-	4, 4, 1, 1, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 1, 2, 1, 2,
-	1, 1, 1, 3, 4, 1, 1, 1, 3, 1,
-	1, 1, 4, 1, 1, 3, 5, 3, 0, 1,
-	2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 2, 1, 3, 2, 2, 1, 1, 3, 3,
-	4, 3, 4, 2, 1, 1, 0, 0, 0, 1,
+	1, 2, 2, 3, 1, 3, 1, 5, 1, 4,
+	2, 2, 3, 6, 2, 5, 0, 2, 3, 1,
+	2, 3, 1, 1, 4, 4, 4, 4, 1, 1,
+	4, 4, 1, 1, 1, 4, 1, 1, 1, 1,
+	4, 1, 1, 1, 1, 1, 1, 1, 4, 1,
+	1, 1, 4, 1, 4, 4, 1, 1, 1, 1,
+	4, 4, 1, 1, 1, 4, 1, 1, 1, 1,
+	1, 2, 1, 2, 1, 1, 1, 3, 4, 1,
+	1, 1, 3, 1, 1, 1, 4, 1, 1, 3,
+	5, 3, 3, 0, 1, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 7, 3, 6, 1,
+	4, 2, 1, 3, 3, 5, 1, 3, 2, 2,
+	2, 1, 1, 3, 3, 2, 2, 3, 3, 2,
+	2, 3, 4, 4, 4, 3, 4, 2, 1, 1,
+	0, 0, 0, 1,
 }
 var mtailChk = [...]int{
 
-	-1000, -46, -1, -2, -5, -6, -22, -24, -25, -28,
-	17, 13, 20, 4, -17, 18, 66, -7, -35, -48,
-	16, -16, -27, -13, -11, 14, -14, -21, -8, -12,
-	-15, -20, -18, 22, 25, 26, 24, 61, 29, 30,
-	51, -10, -26, -19, -9, 27, -19, -4, -39, 59,
-	52, 53, -4, 66, -30, 5, 6, 7, 8, 9,
-	34, 15, 28, -11, -8, -38, 48, 50, 49, -43,
-	32, 33, -36, 42, 43, 44, 45, 46, 47, -42,
-	57, 58, 55, 54, -37, 40, 41, 38, 63, 61,
-	-17, -48, -12, -11, -12, -40, 38, 37, -41, 36,
-	34, 35, 39, -20, 19, -47, 66, -1, -23, -29,
-	27, 24, -49, 27, -4, 10, -47, -47, -47, -47,
-	-47, -47, -47, -3, -16, 62, -3, 62, -47, -47,
-	-4, -16, -27, 60, -33, -31, -44, 12, 11, 21,
-	23, -4, 31, -14, -15, -21, -8, -17, -17, -10,
-	-26, -19, 64, 65, 62, -9, -12, -34, -32, 27,
-	24, 24, -45, 30, 29, 34, -16, 65, 65, -32,
-	30, 29,
+	-1000, -58, -1, -2, -5, -6, -22, -31, -24, -25,
+	-28, 26, 27, -59, 21, 17, 28, 4, -17, 22,
+	24, -37, 87, -7, -45, 34, 20, -16, -27, -13,
+	-11, 18, -14, -21, -8, -12, -15, -20, -18, 40,
+	43, 44, 42, 81, 47, 48, 69, -10, -26, -19,
+	-9, 45, -21, -59, -21, 36, 29, 25, 30, 52,
+	19, 46, -19, -4, -49, 79, 70, 71, -4, -21,
+	-4, 87, -38, 10, 5, 6, 7, 8, 9, 11,
+	12, -29, 45, 42, -11, -8, -48, 66, 68, 67,
+	-53, 50, 51, -46, 60, 61, 62, 63, 64, 65,
+	-52, 77, 78, 75, 72, 73, 74, -47, 58, 59,
+	56, 83, 81, -17, -12, -11, -12, -50, 56, 55,
+	-51, 54, 52, 53, 57, 45, 81, 79, 81, -61,
+	45, -4, -20, 23, -60, 87, -1, -4, -23, -29,
+	-23, 79, 13, -60, -60, -60, -60, -60, -60, -60,
+	-60, -60, -3, -16, 82, -3, 82, -60, -60, -16,
+	-36, -16, 41, -4, -4, -16, -27, 80, -34, -39,
+	-44, -54, -56, -57, 49, -30, -41, -42, 39, 16,
+	15, 14, 31, 32, 37, 75, 35, 38, -60, 49,
+	-14, -15, -21, -8, -17, -17, -17, -17, -10, -26,
+	-19, 84, 85, 82, -9, -12, 82, 80, 87, 45,
+	82, 52, -35, -40, 45, 42, 42, -43, -40, -55,
+	48, 47, 47, 33, 81, 47, 48, 55, 45, 81,
+	-32, -40, -16, -4, -21, 85, 86, 85, 85, 47,
+	47, 47, 48, 42, -60, 85, 86, -40, 42, -40,
+	48, 47, 82, 82, 80, -60, -33, 42, 40, 86,
+	-40, 81, 42, 86, -3, -33, 82,
 }
 var mtailDef = [...]int{
 
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	10, 0, 12, 13, 0, 0, 17, 0, 0, 0,
-	0, 24, 25, 20, -2, 89, 30, 49, 68, 60,
-	35, 54, 72, 0, 75, 76, 77, 116, 79, 80,
-	0, 43, 55, 81, 47, 83, 116, 15, 118, 2,
-	28, 29, 16, 18, 0, 96, 97, 98, 99, 100,
-	117, 0, 0, 113, 68, 118, 32, 33, 34, 69,
-	70, 71, 118, 37, 38, 39, 40, 41, 42, 118,
-	52, 53, 118, 118, 118, 45, 46, 118, 0, 0,
-	0, 0, 60, 66, 67, 118, 58, 59, 118, 62,
-	63, 64, 65, 11, 0, 116, 119, -2, 87, 93,
-	94, 95, 0, 0, 111, 0, 0, 0, 116, 116,
-	116, 0, 116, 0, 84, 73, 0, 78, 0, 0,
-	14, 26, 27, 19, 90, 91, 92, 0, 0, 0,
-	0, 110, 112, 31, 36, 50, 51, 22, 23, 44,
-	56, 57, 82, 0, 74, 48, 61, 101, 102, 114,
-	115, 104, 105, 106, 107, 86, 85, 0, 0, 103,
-	108, 109,
+	10, 160, 160, 0, 14, 0, 16, 18, 0, 0,
+	160, 0, 29, 0, 0, 0, 0, 38, 39, 32,
+	-2, 104, 44, 63, 82, 74, 49, 68, 86, 0,
+	89, 90, 91, 160, 93, 94, 0, 57, 69, 95,
+	61, 97, 11, 0, 12, 0, 0, 0, 0, 161,
+	0, 0, 160, 20, 162, 2, 42, 43, 21, 0,
+	24, 30, 0, 0, 119, 120, 121, 122, 123, 124,
+	125, 0, 117, 118, 157, 82, 162, 46, 47, 48,
+	83, 84, 85, 162, 51, 52, 53, 54, 55, 56,
+	162, 66, 67, 162, 162, 162, 162, 162, 59, 60,
+	162, 0, 0, 0, 74, 80, 81, 162, 72, 73,
+	162, 76, 77, 78, 79, 13, 0, 26, 0, 0,
+	0, 155, 15, 0, 160, 163, -2, 22, 101, 116,
+	102, 162, 0, 0, 0, 160, 160, 160, 160, 160,
+	0, 160, 0, 98, 87, 0, 92, 0, 0, 0,
+	0, 0, 0, 154, 19, 40, 41, 31, 105, 106,
+	107, 108, 109, 110, 111, 112, 113, 114, 115, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 156,
+	45, 50, 64, 65, 34, 35, 36, 37, 58, 70,
+	71, 96, 0, 88, 62, 75, 17, 0, 27, 160,
+	25, 100, 131, 132, 158, 159, 138, 139, 136, 140,
+	141, 142, 150, 0, 0, 145, 146, 0, 149, 0,
+	162, 0, 99, 23, 28, 0, 0, 0, 0, 151,
+	0, 147, 148, 0, 0, 162, 0, 134, 133, 137,
+	143, 144, 152, 153, 126, 0, 127, 129, 0, 0,
+	0, 0, 135, 0, 0, 128, 130,
 }
 var mtailTok1 = [...]int{
 
@@ -347,7 +449,9 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
-	62, 63, 64, 65, 66,
+	62, 63, 64, 65, 66, 67, 68, 69, 70, 71,
+	72, 73, 74, 75, 76, 77, 78, 79, 80, 81,
+	82, 83, 84, 85, 86, 87,
 }
 var mtailTok3 = [...]int{
 	0,
@@ -358,12 +462,12 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{112, 4, "unexpected end of file, expecting '/' to end regex"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{14, 63, "unexpected indexing of an expression"},
-	{14, 66, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
+	{129, 4, "unexpected end of file, expecting '/' to end regex"},
+	{24, 1, "unexpected end of file, expecting '}' to end block"},
+	{24, 1, "unexpected end of file, expecting '}' to end block"},
+	{24, 1, "unexpected end of file, expecting '}' to end block"},
+	{18, 83, "unexpected indexing of an expression"},
+	{18, 87, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
 }
 
 //line yaccpar:1
@@ -699,19 +803,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:91
+//line parser.y:98
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:98
+//line parser.y:105
 		{
 			mtailVAL.n = &ast.StmtList{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:102
+//line parser.y:109
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -720,711 +824,1013 @@ mtaildefault:
 		}
 	case 4:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:112
+//line parser.y:119
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:114
+//line parser.y:121
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:116
+//line parser.y:123
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:118
+//line parser.y:125
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:120
+//line parser.y:127
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:122
+//line parser.y:129
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 10:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:124
+//line parser.y:131
 		{
-			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 11:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:133
+		{
+			mtailVAL.n = &ast.FileLabelsStmt{P: *mtailDollar[2].n.Pos(), Pattern: mtailDollar[2].n}
+		}
+	case 12:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:137
+		{
+			mtailVAL.n = &ast.ExcludeStmt{P: *mtailDollar[2].n.Pos(), Pattern: mtailDollar[2].n}
+		}
+	case 13:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:141
+		{
+			mp := markedpos(mtaillex)
+			tp := tokenpos(mtaillex)
+			mtailVAL.n = &ast.TimestampStmt{P: *ast.MergePosition(&mp, &tp), Source: mtailDollar[3].text}
+		}
+	case 14:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:147
+		{
+			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+		}
+	case 15:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:128
+//line parser.y:151
 		{
 			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
 		}
-	case 12:
+	case 16:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:132
+//line parser.y:155
 		{
 			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
 		}
-	case 13:
+	case 17:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:159
+		{
+			mp := markedpos(mtaillex)
+			tp := tokenpos(mtaillex)
+			mtailVAL.n = &ast.AccumulateStmt{P: *ast.MergePosition(&mp, &tp), Key: mtailDollar[4].n}
+		}
+	case 18:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:136
+//line parser.y:165
 		{
 			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 14:
+	case 19:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:143
+//line parser.y:172
 		{
-			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil, false}
 		}
-	case 15:
+	case 20:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:147
+//line parser.y:176
 		{
 			if mtailDollar[1].n != nil {
-				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
+				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil, false}
 			} else {
 				mtailVAL.n = mtailDollar[2].n
 			}
 		}
-	case 16:
+	case 21:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:155
+//line parser.y:184
 		{
 			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
-			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
+			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil, false}
 		}
-	case 17:
+	case 22:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:189
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[2].n, mtailDollar[3].n, nil, nil, true}
+		}
+	case 23:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:193
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[4].n, mtailDollar[6].n, nil, nil, false}
+		}
+	case 24:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:197
+		{
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil, false}
+		}
+	case 25:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:204
+		{
+			mp := markedpos(mtaillex)
+			tp := tokenpos(mtaillex)
+			mtailVAL.n = &ast.FinalizeExpr{P: *ast.MergePosition(&mp, &tp), Key: mtailDollar[4].n}
+		}
+	case 26:
+		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
+//line parser.y:213
+		{
+			// Reduced before the patterns, so the marked position is still that
+			// of the keyword.
+			mtailVAL.n = &ast.FormatsExpr{P: markedpos(mtaillex)}
+		}
+	case 27:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:219
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 28:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:223
+		{
+			f := mtailDollar[1].n.(*ast.FormatsExpr)
+			f.Tags = append(f.Tags, mtailDollar[2].text)
+			f.Patterns = append(f.Patterns, mtailDollar[3].n)
+			mtailVAL.n = f
+		}
+	case 29:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:163
+//line parser.y:233
 		{
 			mtailVAL.n = nil
 		}
-	case 18:
+	case 30:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:165
+//line parser.y:235
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 19:
+	case 31:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:170
+//line parser.y:240
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 20:
+	case 32:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:177
+//line parser.y:247
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 21:
+	case 33:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:179
+//line parser.y:249
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 22:
+	case 34:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:184
+//line parser.y:254
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 23:
+	case 35:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:188
+//line parser.y:258
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 24:
+	case 36:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:262
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+		}
+	case 37:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:266
+		{
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+		}
+	case 38:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:195
+//line parser.y:273
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 25:
+	case 39:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:197
+//line parser.y:275
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 26:
+	case 40:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:199
+//line parser.y:277
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 27:
+	case 41:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:203
+//line parser.y:281
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 28:
+	case 42:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:210
+//line parser.y:288
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 29:
+	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:212
+//line parser.y:290
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 30:
+	case 44:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:217
+//line parser.y:295
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 31:
+	case 45:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:219
+//line parser.y:297
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 32:
+	case 46:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:226
+//line parser.y:304
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 33:
+	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:228
+//line parser.y:306
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 34:
+	case 48:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:230
+//line parser.y:308
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 35:
+	case 49:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:235
+//line parser.y:313
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 36:
+	case 50:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:237
+//line parser.y:315
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 37:
+	case 51:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:244
+//line parser.y:322
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 38:
+	case 52:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:246
+//line parser.y:324
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 39:
+	case 53:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:248
+//line parser.y:326
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 40:
+	case 54:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:250
+//line parser.y:328
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 41:
+	case 55:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:252
+//line parser.y:330
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 42:
+	case 56:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:254
+//line parser.y:332
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 43:
+	case 57:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:259
+//line parser.y:337
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 44:
+	case 58:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:261
+//line parser.y:339
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 45:
+	case 59:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:268
+//line parser.y:346
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 46:
+	case 60:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:270
+//line parser.y:348
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 47:
+	case 61:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:275
+//line parser.y:353
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 48:
+	case 62:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:277
+//line parser.y:355
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 49:
+	case 63:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:284
+//line parser.y:362
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 50:
+	case 64:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:286
+//line parser.y:364
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 51:
+	case 65:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:290
+//line parser.y:368
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 52:
+	case 66:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:297
+//line parser.y:375
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 53:
+	case 67:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:299
+//line parser.y:377
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 54:
+	case 68:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:304
+//line parser.y:382
 		{
 			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
 		}
-	case 55:
+	case 69:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:311
+//line parser.y:389
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 56:
+	case 70:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:313
+//line parser.y:391
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 57:
+	case 71:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:317
+//line parser.y:395
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 58:
+	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:324
+//line parser.y:402
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 59:
+	case 73:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:326
+//line parser.y:404
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 60:
+	case 74:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:331
+//line parser.y:409
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 61:
+	case 75:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:333
+//line parser.y:411
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 62:
+	case 76:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:340
+//line parser.y:418
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 63:
+	case 77:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:342
+//line parser.y:420
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 64:
+	case 78:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:344
+//line parser.y:422
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 65:
+	case 79:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:346
+//line parser.y:424
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 66:
+	case 80:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:351
+//line parser.y:429
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 67:
+	case 81:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:353
+//line parser.y:431
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
-	case 68:
+	case 82:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:360
+//line parser.y:438
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 69:
+	case 83:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:362
+//line parser.y:440
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
 		}
-	case 70:
+	case 84:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:369
+//line parser.y:447
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 71:
+	case 85:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:371
+//line parser.y:449
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 72:
+	case 86:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:376
+//line parser.y:454
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 73:
+	case 87:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:378
+//line parser.y:456
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
 		}
-	case 74:
+	case 88:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:382
+//line parser.y:460
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
 		}
-	case 75:
+	case 89:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:386
+//line parser.y:464
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
 		}
-	case 76:
+	case 90:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:390
+//line parser.y:468
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
 		}
-	case 77:
+	case 91:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:394
+//line parser.y:472
 		{
 			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 78:
+	case 92:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:398
+//line parser.y:476
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 79:
+	case 93:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:402
+//line parser.y:480
 		{
 			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
 		}
-	case 80:
+	case 94:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:406
+//line parser.y:484
 		{
 			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
 		}
-	case 81:
+	case 95:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:413
+//line parser.y:491
 		{
 			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
 		}
-	case 82:
+	case 96:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:417
+//line parser.y:495
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
 				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
 				mtailDollar[3].n.(*ast.ExprList).Children...)
 		}
-	case 83:
+	case 97:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:427
+//line parser.y:505
 		{
 			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
 		}
-	case 84:
+	case 98:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:434
+//line parser.y:512
 		{
 			mtailVAL.n = &ast.ExprList{}
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
 		}
-	case 85:
+	case 99:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:439
+//line parser.y:517
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
 		}
-	case 86:
+	case 100:
 		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-//line parser.y:447
+//line parser.y:525
 		{
 			mp := markedpos(mtaillex)
 			tp := tokenpos(mtaillex)
 			pos := ast.MergePosition(&mp, &tp)
 			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
 		}
-	case 87:
+	case 101:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:457
+//line parser.y:535
 		{
 			mtailVAL.n = mtailDollar[3].n
 			d := mtailVAL.n.(*ast.VarDecl)
 			d.Kind = mtailDollar[2].kind
 			d.Hidden = mtailDollar[1].flag
 		}
-	case 88:
+	case 102:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:542
+		{
+			mtailVAL.n = mtailDollar[3].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = metrics.Histogram
+			d.Adaptive = true
+			d.Hidden = mtailDollar[1].flag
+		}
+	case 103:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:467
+//line parser.y:553
 		{
 			mtailVAL.flag = false
 		}
-	case 89:
+	case 104:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:471
+//line parser.y:557
 		{
 			mtailVAL.flag = true
 		}
-	case 90:
+	case 105:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:478
+//line parser.y:564
 		{
 			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.VarDecl).Keys = mtailDollar[2].texts
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Keys = mtailDollar[2].n.(*ast.VarDecl).Keys
+			d.StaticKeys = mtailDollar[2].n.(*ast.VarDecl).StaticKeys
+			d.StaticValues = mtailDollar[2].n.(*ast.VarDecl).StaticValues
 		}
-	case 91:
+	case 106:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:483
+//line parser.y:572
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
 		}
-	case 92:
+	case 107:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:488
+//line parser.y:577
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Aliases = mtailDollar[2].texts
+		}
+	case 108:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:582
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
 		}
-	case 93:
+	case 109:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:587
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Sample = mtailDollar[2].sample
+		}
+	case 110:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:592
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Learn = mtailDollar[2].learn
+		}
+	case 111:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:597
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Window = mtailDollar[2].duration
+		}
+	case 112:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:602
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Init = mtailDollar[2].n
+		}
+	case 113:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:607
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Timestamp = mtailDollar[2].text
+		}
+	case 114:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:612
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).PrometheusType = mtailDollar[2].text
+		}
+	case 115:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:617
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).ResetOnExport = true
+		}
+	case 116:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:493
+//line parser.y:622
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 94:
+	case 117:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:500
+//line parser.y:629
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 95:
+	case 118:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:504
+//line parser.y:633
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 96:
+	case 119:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:511
+//line parser.y:640
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 97:
+	case 120:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:515
+//line parser.y:644
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 98:
+	case 121:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:519
+//line parser.y:648
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 99:
+	case 122:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:523
+//line parser.y:652
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 100:
+	case 123:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:527
+//line parser.y:656
 		{
 			mtailVAL.kind = metrics.Histogram
 		}
-	case 101:
+	case 124:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:660
+		{
+			mtailVAL.kind = metrics.Window
+		}
+	case 125:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:664
+		{
+			mtailVAL.kind = metrics.HLL
+		}
+	case 126:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:671
+		{
+			mtailVAL.n = mtailDollar[5].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.P = mtailDollar[2].n.(*ast.VarDecl).P
+			d.Name = mtailDollar[2].n.(*ast.VarDecl).Name
+			d.Kind = metrics.Info
+		}
+	case 127:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:682
+		{
+			mtailVAL.n = &ast.VarDecl{Keys: []string{mtailDollar[1].text}, Values: []ast.Node{mtailDollar[3].n}}
+		}
+	case 128:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:686
+		{
+			mtailVAL.n = mtailDollar[1].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Keys = append(d.Keys, mtailDollar[4].text)
+			d.Values = append(d.Values, mtailDollar[6].n)
+		}
+	case 129:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:696
+		{
+			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
+		}
+	case 130:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:700
+		{
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
+		}
+	case 131:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:534
+//line parser.y:707
 		{
-			mtailVAL.texts = mtailDollar[2].texts
+			mtailVAL.n = mtailDollar[2].n
 		}
-	case 102:
+	case 132:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:716
+		{
+			mtailVAL.n = &ast.VarDecl{Keys: []string{mtailDollar[1].text}}
+		}
+	case 133:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:720
+		{
+			mtailVAL.n = &ast.VarDecl{StaticKeys: []string{mtailDollar[1].text}, StaticValues: []string{mtailDollar[3].text}}
+		}
+	case 134:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:724
+		{
+			mtailVAL.n = mtailDollar[1].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Keys = append(d.Keys, mtailDollar[3].text)
+		}
+	case 135:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:730
+		{
+			mtailVAL.n = mtailDollar[1].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.StaticKeys = append(d.StaticKeys, mtailDollar[3].text)
+			d.StaticValues = append(d.StaticValues, mtailDollar[5].text)
+		}
+	case 136:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:541
+//line parser.y:740
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 103:
+	case 137:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:546
+//line parser.y:745
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 104:
+	case 138:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:554
+//line parser.y:753
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 105:
+	case 139:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:760
+		{
+			mtailVAL.texts = mtailDollar[2].texts
+		}
+	case 140:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:561
+//line parser.y:767
 		{
 			mtailVAL.floats = mtailDollar[2].floats
 		}
-	case 106:
+	case 141:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:567
+//line parser.y:773
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[1].floatVal)
 		}
-	case 107:
+	case 142:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:572
+//line parser.y:778
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[1].intVal))
 		}
-	case 108:
+	case 143:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:577
+//line parser.y:783
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[3].floatVal)
 		}
-	case 109:
+	case 144:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:582
+//line parser.y:788
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[3].intVal))
 		}
-	case 110:
+	case 145:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:795
+		{
+			mtailVAL.n = &ast.IntLit{P: tokenpos(mtaillex), I: mtailDollar[2].intVal}
+		}
+	case 146:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:799
+		{
+			mtailVAL.n = &ast.FloatLit{P: tokenpos(mtaillex), F: mtailDollar[2].floatVal}
+		}
+	case 147:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:803
+		{
+			mtailVAL.n = &ast.IntLit{P: tokenpos(mtaillex), I: -mtailDollar[3].intVal}
+		}
+	case 148:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:807
+		{
+			mtailVAL.n = &ast.FloatLit{P: tokenpos(mtaillex), F: -mtailDollar[3].floatVal}
+		}
+	case 149:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:814
+		{
+			mtailVAL.text = mtailDollar[2].text
+		}
+	case 150:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:821
+		{
+			mtailVAL.sample = &ast.SampleSpec{Rate: mtailDollar[2].intVal}
+		}
+	case 151:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:825
+		{
+			mtailVAL.sample = &ast.SampleSpec{Rate: mtailDollar[3].intVal, Random: true}
+		}
+	case 152:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:589
+//line parser.y:832
+		{
+			mtailVAL.learn = &ast.LearnSpec{Count: mtailDollar[3].intVal}
+		}
+	case 153:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:839
+		{
+			mtailVAL.text = mtailDollar[3].text
+		}
+	case 154:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:846
 		{
 			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[4].n}
 		}
-	case 111:
+	case 155:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:596
+//line parser.y:853
 		{
 			mtailVAL.n = &ast.DecoStmt{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
 		}
-	case 112:
+	case 156:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:603
+//line parser.y:860
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n, Expiry: mtailDollar[4].duration}
 		}
-	case 113:
+	case 157:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:607
+//line parser.y:864
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n}
 		}
-	case 114:
+	case 158:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:613
+//line parser.y:870
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 115:
+	case 159:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:617
+//line parser.y:874
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 116:
+	case 160:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:627
+//line parser.y:884
 		{
 			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 117:
+	case 161:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:637
+//line parser.y:894
 		{
 			mtaillex.(*parser).inRegex()
 		}
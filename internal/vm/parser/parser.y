@@ -27,26 +27,33 @@ import (
     n ast.Node
     kind metrics.Kind
     duration time.Duration
+    sample *ast.SampleSpec
+    learn *ast.LearnSpec
 }
 
 %type <n> stmt_list stmt arg_expr_list compound_statement conditional_statement expression_statement
 %type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr
 %type <n> rel_expr shift_expr bitwise_expr logical_expr indexed_expr id_expr concat_expr pattern_expr
 %type <n> declaration decl_attribute_spec decorator_declaration decoration_statement regex_pattern match_expr
-%type <n> delete_statement var_name_spec
+%type <n> delete_statement var_name_spec init_spec info_declaration info_label_list info_value
+%type <n> by_spec by_label_list format_list finalize_expr
 %type <kind> type_spec
-%type <text> as_spec id_or_string
-%type <texts> by_spec by_expr_list
+%type <text> as_spec id_or_string timestamp_spec metric_type_spec
+%type <texts> by_expr_list alias_spec
 %type <flag> hide_spec
 %type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op postfix_op
 %type <floats> buckets_spec buckets_list
+%type <sample> sample_spec
+%type <learn> learn_spec
 // Tokens and types are defined here.
 // Invalid input
 %token <text> INVALID
 // Types
-%token COUNTER GAUGE TIMER TEXT HISTOGRAM
+%token COUNTER GAUGE TIMER TEXT HISTOGRAM HISTOGRAM_ADAPTIVE COUNTER_WINDOW HLL
 // Reserved words
-%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS
+%token AFTER ALIAS AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE FOREACH FORMATS FILENAME_LABELS EXCLUDE STOP ACCUMULATE FINALIZE BUCKETS SAMPLE RANDOM INFO TIMESTAMP_SOURCE DEFAULT_TIMESTAMP_SOURCE
+// Attributes
+%token LEARN_FROM METRIC_TYPE RESET_ON_EXPORT
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -65,12 +72,12 @@ import (
 %token <op> SHL SHR
 %token <op> LT GT LE GE EQ NE
 %token <op> BITAND XOR BITOR NOT AND OR
-%token <op> ADD_ASSIGN ASSIGN
+%token <op> ADD_ASSIGN MAX_ASSIGN MIN_ASSIGN ASSIGN
 %token <op> CONCAT
 %token <op> MATCH NOT_MATCH
 // Punctuation
 %token LCURLY RCURLY LPAREN RPAREN LSQUARE RSQUARE
-%token COMMA
+%token COMMA COLON
 %token NL
 
 %start start
@@ -114,12 +121,28 @@ stmt
   { $$ = $1 }
   | declaration
   { $$ = $1 }
+  | info_declaration
+  { $$ = $1 }
   | decorator_declaration
   { $$ = $1 }
   | decoration_statement
   { $$ = $1 }
   | delete_statement
   { $$ = $1 }
+  | FILENAME_LABELS pattern_expr
+  {
+    $$ = &ast.FileLabelsStmt{P: *$2.Pos(), Pattern: $2}
+  }
+  | EXCLUDE pattern_expr
+  {
+    $$ = &ast.ExcludeStmt{P: *$2.Pos(), Pattern: $2}
+  }
+  | mark_pos DEFAULT_TIMESTAMP_SOURCE ID
+  {
+    mp := markedpos(mtaillex)
+    tp := tokenpos(mtaillex)
+    $$ = &ast.TimestampStmt{P: *ast.MergePosition(&mp, &tp), Source: $3}
+  }
   | NEXT
   {
     $$ = &ast.NextStmt{tokenpos(mtaillex)}
@@ -132,6 +155,12 @@ stmt
   {
     $$ = &ast.StopStmt{tokenpos(mtaillex)}
   }
+  | mark_pos ACCUMULATE LPAREN bitwise_expr RPAREN
+  {
+    mp := markedpos(mtaillex)
+    tp := tokenpos(mtaillex)
+    $$ = &ast.AccumulateStmt{P: *ast.MergePosition(&mp, &tp), Key: $4}
+  }
   | INVALID
   {
     $$ = &ast.Error{tokenpos(mtaillex), $1}
@@ -141,12 +170,12 @@ stmt
 conditional_statement
   : logical_expr compound_statement ELSE compound_statement
   {
-    $$ = &ast.CondStmt{$1, $2, $4, nil}
+    $$ = &ast.CondStmt{$1, $2, $4, nil, false}
   }
   | logical_expr compound_statement
   {
     if $1 != nil {
-      $$ = &ast.CondStmt{$1, $2, nil, nil}
+      $$ = &ast.CondStmt{$1, $2, nil, nil, false}
     } else {
       $$ = $2
     }
@@ -154,7 +183,48 @@ conditional_statement
   | OTHERWISE compound_statement
   {
     o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
-    $$ = &ast.CondStmt{o, $2, nil, nil}
+    $$ = &ast.CondStmt{o, $2, nil, nil, false}
+  }
+  | FOREACH pattern_expr compound_statement
+  {
+    $$ = &ast.CondStmt{$2, $3, nil, nil, true}
+  }
+  | mark_pos FORMATS LCURLY format_list RCURLY compound_statement
+  {
+    $$ = &ast.CondStmt{$4, $6, nil, nil, false}
+  }
+  | finalize_expr compound_statement
+  {
+    $$ = &ast.CondStmt{$1, $2, nil, nil, false}
+  }
+  ;
+
+finalize_expr
+  : mark_pos FINALIZE LPAREN bitwise_expr RPAREN
+  {
+    mp := markedpos(mtaillex)
+    tp := tokenpos(mtaillex)
+    $$ = &ast.FinalizeExpr{P: *ast.MergePosition(&mp, &tp), Key: $4}
+  }
+  ;
+
+format_list
+  : /* empty */
+  {
+    // Reduced before the patterns, so the marked position is still that
+    // of the keyword.
+    $$ = &ast.FormatsExpr{P: markedpos(mtaillex)}
+  }
+  | format_list NL
+  {
+    $$ = $1
+  }
+  | format_list ID pattern_expr
+  {
+    f := $1.(*ast.FormatsExpr)
+    f.Tags = append(f.Tags, $2)
+    f.Patterns = append(f.Patterns, $3)
+    $$ = f
   }
   ;
 
@@ -188,6 +258,14 @@ assign_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
+  | unary_expr MAX_ASSIGN opt_nl logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
+  }
+  | unary_expr MIN_ASSIGN opt_nl logical_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
+  }
   ;
 
 logical_expr
@@ -460,6 +538,14 @@ declaration
     d.Kind = $2
     d.Hidden = $1
   }
+  | hide_spec HISTOGRAM_ADAPTIVE decl_attribute_spec
+  {
+    $$ = $3
+    d := $$.(*ast.VarDecl)
+    d.Kind = metrics.Histogram
+    d.Adaptive = true
+    d.Hidden = $1
+  }
   ;
 
 hide_spec
@@ -477,18 +563,61 @@ decl_attribute_spec
   : decl_attribute_spec by_spec
   {
     $$ = $1
-    $$.(*ast.VarDecl).Keys = $2
+    d := $$.(*ast.VarDecl)
+    d.Keys = $2.(*ast.VarDecl).Keys
+    d.StaticKeys = $2.(*ast.VarDecl).StaticKeys
+    d.StaticValues = $2.(*ast.VarDecl).StaticValues
   }
   | decl_attribute_spec as_spec
   {
     $$ = $1
     $$.(*ast.VarDecl).ExportedName = $2
   }
+  | decl_attribute_spec alias_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Aliases = $2
+  }
   | decl_attribute_spec buckets_spec
   {
     $$ = $1
     $$.(*ast.VarDecl).Buckets = $2
   }
+  | decl_attribute_spec sample_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Sample = $2
+  }
+  | decl_attribute_spec learn_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Learn = $2
+  }
+  | decl_attribute_spec DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Window = $2
+  }
+  | decl_attribute_spec init_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Init = $2
+  }
+  | decl_attribute_spec timestamp_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Timestamp = $2
+  }
+  | decl_attribute_spec metric_type_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).PrometheusType = $2
+  }
+  | decl_attribute_spec RESET_ON_EXPORT
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).ResetOnExport = true
+  }
   | var_name_spec
   {
     $$ = $1
@@ -527,15 +656,85 @@ type_spec
   {
     $$ = metrics.Histogram
   }
+  | COUNTER_WINDOW
+  {
+    $$ = metrics.Window
+  }
+  | HLL
+  {
+    $$ = metrics.HLL
+  }
+  ;
+
+info_declaration
+  : INFO var_name_spec LCURLY opt_nl info_label_list opt_nl RCURLY
+  {
+    $$ = $5
+    d := $$.(*ast.VarDecl)
+    d.P = $2.(*ast.VarDecl).P
+    d.Name = $2.(*ast.VarDecl).Name
+    d.Kind = metrics.Info
+  }
+  ;
+
+info_label_list
+  : id_or_string COLON info_value
+  {
+    $$ = &ast.VarDecl{Keys: []string{$1}, Values: []ast.Node{$3}}
+  }
+  | info_label_list COMMA opt_nl id_or_string COLON info_value
+  {
+    $$ = $1
+    d := $$.(*ast.VarDecl)
+    d.Keys = append(d.Keys, $4)
+    d.Values = append(d.Values, $6)
+  }
+  ;
+
+info_value
+  : STRING
+  {
+    $$ = &ast.StringLit{tokenpos(mtaillex), $1}
+  }
+  | BUILTIN LPAREN arg_expr_list RPAREN
+  {
+    $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $3}
+  }
   ;
 
 by_spec
-  : BY by_expr_list
+  : BY by_label_list
   {
     $$ = $2
   }
   ;
 
+// Labels are either indexed by the program, or have the fixed value given in
+// the declaration.
+by_label_list
+  : id_or_string
+  {
+    $$ = &ast.VarDecl{Keys: []string{$1}}
+  }
+  | id_or_string COLON STRING
+  {
+    $$ = &ast.VarDecl{StaticKeys: []string{$1}, StaticValues: []string{$3}}
+  }
+  | by_label_list COMMA id_or_string
+  {
+    $$ = $1
+    d := $$.(*ast.VarDecl)
+    d.Keys = append(d.Keys, $3)
+  }
+  | by_label_list COMMA id_or_string COLON STRING
+  {
+    $$ = $1
+    d := $$.(*ast.VarDecl)
+    d.StaticKeys = append(d.StaticKeys, $3)
+    d.StaticValues = append(d.StaticValues, $5)
+  }
+  ;
+
 by_expr_list
   : id_or_string
   {
@@ -556,6 +755,13 @@ as_spec
   }
   ;
 
+alias_spec
+  : ALIAS by_expr_list
+  {
+    $$ = $2
+  }
+  ;
+
 buckets_spec
   : BUCKETS buckets_list
   {
@@ -584,6 +790,57 @@ buckets_list
     $$ = append($$, float64($3))
   }
 
+init_spec
+  : ASSIGN INTLITERAL
+  {
+    $$ = &ast.IntLit{P: tokenpos(mtaillex), I: $2}
+  }
+  | ASSIGN FLOATLITERAL
+  {
+    $$ = &ast.FloatLit{P: tokenpos(mtaillex), F: $2}
+  }
+  | ASSIGN MINUS INTLITERAL
+  {
+    $$ = &ast.IntLit{P: tokenpos(mtaillex), I: -$3}
+  }
+  | ASSIGN MINUS FLOATLITERAL
+  {
+    $$ = &ast.FloatLit{P: tokenpos(mtaillex), F: -$3}
+  }
+  ;
+
+timestamp_spec
+  : TIMESTAMP_SOURCE ID
+  {
+    $$ = $2
+  }
+  ;
+
+sample_spec
+  : SAMPLE INTLITERAL
+  {
+    $$ = &ast.SampleSpec{Rate: $2}
+  }
+  | SAMPLE RANDOM INTLITERAL
+  {
+    $$ = &ast.SampleSpec{Rate: $3, Random: true}
+  }
+  ;
+
+learn_spec
+  : LEARN_FROM LPAREN INTLITERAL RPAREN
+  {
+    $$ = &ast.LearnSpec{Count: $3}
+  }
+  ;
+
+metric_type_spec
+  : METRIC_TYPE LPAREN STRING RPAREN
+  {
+    $$ = $3
+  }
+  ;
+
 decorator_declaration
   : mark_pos DEF ID compound_statement
   {
@@ -28,12 +28,36 @@ var parserTests = []struct {
 	{"declare counter string name",
 		"counter lines_total as \"line-count\"\n"},
 
+	{"declare alias",
+		"counter requests_total alias \"http-requests\", old_requests\n"},
+
+	{"declare info",
+		"info build_info { version: \"1.0\", commit: \"abc123\" }\n"},
+
+	{"declare info multiline",
+		"info build_info {\n  version: \"1.0\",\n  host: getenv(\"HOSTNAME\")\n}\n"},
+
 	{"declare dimensioned counter",
 		"counter foo by bar\n"},
 
 	{"declare multi-dimensioned counter",
 		"counter foo by bar, baz, quux\n"},
 
+	{"declare counter with static labels",
+		"counter foo by service: \"web\", bar, \"zone\": \"eu\"\n"},
+
+	{"declare adaptive histogram",
+		"histogram_adaptive foo by code @learn_from(500)\n"},
+
+	{"declare counter with metric type",
+		"counter foo by code @metric_type(\"untyped\")\n"},
+
+	{"declare gauge reset on export",
+		"gauge foo by code @reset_on_export\n"},
+
+	{"declare gauge with only static labels",
+		"gauge foo by service: \"web\" = 1\n"},
+
 	{"declare hidden counter",
 		"hidden counter foo\n"},
 
@@ -55,6 +79,26 @@ var parserTests = []struct {
 	{"declare histogram reversed syntax ",
 		"histogram foo buckets 0, 1, 2 by code\n"},
 
+	{"declare sampled counter",
+		"counter foo sample 10\n"},
+	{"declare randomly sampled counter",
+		"counter foo by code sample random 100\n"},
+
+	{"declare gauge with initial value",
+		"gauge temperature = -273.15\n"},
+	{"declare gauge by with initial value",
+		"gauge queue_length by queue = 10\n"},
+
+	{"declare counter window",
+		"counter_window errors_last_5m 5m0s\n"},
+	{"declare counter window by",
+		"counter_window errors_last_5m 5m0s by code\n"},
+
+	{"declare hll",
+		"hll unique_clients by vhost\n"},
+	{"hll add",
+		"hll unique_clients\n/(\\S+)/ {\n  hll_add(unique_clients, $1)\n}\n"},
+
 	{"simple pattern action",
 		"/foo/ {}\n"},
 
@@ -133,6 +177,10 @@ var parserTests = []struct {
 		"counter var\n" +
 			"/foo/ {\n  var += 2\n}\n"},
 
+	{"max and min operators",
+		"gauge peak\ngauge low\n" +
+			"/(\\d+)/ {\n  peak max= $1\n  low min= $1\n}\n"},
+
 	{"additive",
 		"counter time_total\n" +
 			"/(?P<foo>.*)/ {\n" +
@@ -248,6 +296,9 @@ foo = 3.14
 	{"simple else clause",
 		"/foo/ {} else {}"},
 
+	{"foreach",
+		"foreach /(\\d+)/ {\n}"},
+
 	{"nested else clause",
 		"/foo/ { / bar/ {}  } else { /quux/ {} else {} }"},
 
@@ -325,6 +376,47 @@ $foo =~ X {
 // {
   stop
 }`},
+
+	{"filename labels", `
+filename_labels /tenant-(?P<tenant>[^\/]+)\//
+counter requests
+`},
+
+	{"exclude", `
+exclude /GET \/healthz /
+counter requests
+/GET/ {
+  requests++
+}
+`},
+
+	{"formats", `
+counter requests by path, code
+formats {
+  legacy /^(?P<code>\d{3}) (?P<path>\S+)$/
+  current /^path=(?P<path>\S+) status=(?P<code>\d{3})$/ + /$/
+} {
+  requests[$path][$code]++
+}
+`},
+
+	{"accumulate and finalize", `
+counter requests by method
+/^START (?P<id>\S+) (?P<method>\S+)$/ {
+  accumulate($id)
+}
+/^END (?P<id>\S+)$/ {
+  finalize($id) {
+    requests[accumulated("method")]++
+  }
+}
+`},
+
+	{"timestamp source", `
+default_timestamp_source scrape
+counter requests by code timestamp_source log
+gauge queue_length
+`},
 }
 
 func TestParserRoundTrip(t *testing.T) {
@@ -114,6 +114,10 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("=")
 		case ADD_ASSIGN:
 			s.emit("+=")
+		case MAX_ASSIGN:
+			s.emit("max=")
+		case MIN_ASSIGN:
+			s.emit("min=")
 		case MOD:
 			s.emit("%")
 		case CONCAT:
@@ -148,6 +152,8 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("timer ")
 		case metrics.Text:
 			s.emit("text ")
+		case metrics.Info:
+			s.emit("info ")
 		}
 		s.emit(v.Name)
 		if len(v.Keys) > 0 {
@@ -192,12 +198,30 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.ConvExpr:
 		s.emit("conv")
 
+	case *ast.FileLabelsStmt:
+		s.emit("filename_labels")
+
+	case *ast.ExcludeStmt:
+		s.emit("exclude")
+
+	case *ast.FormatsExpr:
+		s.emit("formats " + strings.Join(v.Tags, ", "))
+
+	case *ast.TimestampStmt:
+		s.emit("default_timestamp_source " + v.Source)
+
 	case *ast.Error:
 		s.emit(fmt.Sprintf("error %q", v.Spelling))
 
 	case *ast.StopStmt:
 		s.emit("stop")
 
+	case *ast.AccumulateStmt:
+		s.emit("accumulate")
+
+	case *ast.FinalizeExpr:
+		s.emit("finalize")
+
 	case *ast.DecoDecl:
 		s.emit(fmt.Sprintf("%q", v.Name))
 		s.newline()
@@ -68,6 +68,9 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 	case *ast.CondStmt:
+		if v.Foreach {
+			u.emit("foreach ")
+		}
 		if v.Cond != nil {
 			ast.Walk(u, v.Cond)
 		}
@@ -139,6 +142,10 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit(" = ")
 		case ADD_ASSIGN:
 			u.emit(" += ")
+		case MAX_ASSIGN:
+			u.emit(" max= ")
+		case MIN_ASSIGN:
+			u.emit(" min= ")
 		case MOD:
 			u.emit(" % ")
 		case CONCAT:
@@ -174,6 +181,18 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 	case *ast.VarDecl:
+		if v.Kind == metrics.Info {
+			u.emit("info " + v.Name + " {")
+			for i, k := range v.Keys {
+				if i > 0 {
+					u.emit(",")
+				}
+				u.emit(" " + k + ": ")
+				ast.Walk(u, v.Values[i])
+			}
+			u.emit(" }")
+			break
+		}
 		switch v.Kind {
 		case metrics.Counter:
 			u.emit("counter ")
@@ -184,11 +203,33 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		case metrics.Text:
 			u.emit("text ")
 		case metrics.Histogram:
-			u.emit("histogram ")
+			if v.Adaptive {
+				u.emit("histogram_adaptive ")
+			} else {
+				u.emit("histogram ")
+			}
+		case metrics.Window:
+			u.emit("counter_window ")
+		case metrics.HLL:
+			u.emit("hll ")
 		}
 		u.emit(v.Name)
-		if len(v.Keys) > 0 {
-			u.emit(" by " + strings.Join(v.Keys, ", "))
+		if v.Window > 0 {
+			u.emit(" " + v.Window.String())
+		}
+		if len(v.Keys) > 0 || len(v.StaticKeys) > 0 {
+			labels := append([]string{}, v.Keys...)
+			for i, k := range v.StaticKeys {
+				labels = append(labels, fmt.Sprintf("%s: %q", k, v.StaticValues[i]))
+			}
+			u.emit(" by " + strings.Join(labels, ", "))
+		}
+		if len(v.Aliases) > 0 {
+			aliases := make([]string, 0, len(v.Aliases))
+			for _, a := range v.Aliases {
+				aliases = append(aliases, fmt.Sprintf("%q", a))
+			}
+			u.emit(" alias " + strings.Join(aliases, ", "))
 		}
 		if len(v.Buckets) > 0 {
 			buckets := strings.Builder{}
@@ -198,6 +239,29 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			}
 			u.emit(buckets.String()[:buckets.Len()-2])
 		}
+		if v.Learn != nil {
+			u.emit(fmt.Sprintf(" @learn_from(%d)", v.Learn.Count))
+		}
+		if v.Init != nil {
+			u.emit(" = ")
+			ast.Walk(u, v.Init)
+		}
+		if v.Sample != nil {
+			if v.Sample.Random {
+				u.emit(fmt.Sprintf(" sample random %d", v.Sample.Rate))
+			} else {
+				u.emit(fmt.Sprintf(" sample %d", v.Sample.Rate))
+			}
+		}
+		if v.Timestamp != "" {
+			u.emit(" timestamp_source " + v.Timestamp)
+		}
+		if v.PrometheusType != "" {
+			u.emit(fmt.Sprintf(" @metric_type(%q)", v.PrometheusType))
+		}
+		if v.ResetOnExport {
+			u.emit(" @reset_on_export")
+		}
 
 	case *ast.UnaryExpr:
 		switch v.Op {
@@ -256,6 +320,32 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.ConvExpr:
 		ast.Walk(u, v.N)
 
+	case *ast.FileLabelsStmt:
+		u.emit("filename_labels ")
+		ast.Walk(u, v.Pattern)
+		u.newline()
+
+	case *ast.ExcludeStmt:
+		u.emit("exclude ")
+		ast.Walk(u, v.Pattern)
+		u.newline()
+
+	case *ast.FormatsExpr:
+		u.emit("formats {")
+		u.newline()
+		u.indent()
+		for i, tag := range v.Tags {
+			u.emit(tag + " ")
+			ast.Walk(u, v.Patterns[i])
+			u.newline()
+		}
+		u.outdent()
+		u.emit("}")
+
+	case *ast.TimestampStmt:
+		u.emit("default_timestamp_source " + v.Source)
+		u.newline()
+
 	case *ast.PatternExpr:
 		ast.Walk(u, v.Expr)
 
@@ -267,6 +357,17 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		u.emit("stop")
 
+	case *ast.AccumulateStmt:
+		u.emit("accumulate(")
+		ast.Walk(u, v.Key)
+		u.emit(")")
+		u.newline()
+
+	case *ast.FinalizeExpr:
+		u.emit("finalize(")
+		ast.Walk(u, v.Key)
+		u.emit(")")
+
 	default:
 		panic(fmt.Sprintf("unfound undefined type %T", n))
 	}
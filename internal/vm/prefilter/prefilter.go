@@ -0,0 +1,253 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package prefilter rejects log lines that a program can't act on without
+// running it.  Literals finds the literal text that a line must contain for a
+// program's patterns to match it, and a Filter indexes the literals of many
+// programs so that the programs that may act on a line are found with a single
+// scan of it.
+package prefilter
+
+import (
+	"regexp/syntax"
+
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+// Literals returns strings of which at least one is contained in every line
+// that the program n acts on, or nil if there are none.  That's only known for
+// programs whose top level is made of declarations and pattern blocks without
+// an else, as any other statement may act on any line; the patterns of those
+// blocks must each have a literal that every match contains.
+func Literals(n ast.Node) []string {
+	l, ok := n.(*ast.StmtList)
+	if !ok {
+		return nil
+	}
+	var lits []string
+	for _, c := range l.Children {
+		switch s := c.(type) {
+		case *ast.VarDecl, *ast.DecoDecl, *ast.PatternFragment, *ast.FileLabelsStmt, *ast.ExcludeStmt, *ast.TimestampStmt:
+			// Declarations don't act on lines, and filename_labels and
+			// exclude only stop the program.
+		case *ast.CondStmt:
+			if s.Else != nil {
+				return nil
+			}
+			cl := condLiterals(s.Cond)
+			if cl == nil {
+				return nil
+			}
+			lits = append(lits, cl...)
+		default:
+			return nil
+		}
+	}
+	return lits
+}
+
+// condLiterals returns strings of which at least one is contained in every
+// line for which the condition n is true, or nil if there are none.
+func condLiterals(n ast.Node) []string {
+	switch c := n.(type) {
+	case *ast.PatternExpr:
+		if lit := patternLiteral(c.Pattern); lit != "" {
+			return []string{lit}
+		}
+	case *ast.FormatsExpr:
+		// Like an OR of the formats.
+		var lits []string
+		for _, p := range c.Patterns {
+			l := condLiterals(p)
+			if l == nil {
+				return nil
+			}
+			lits = append(lits, l...)
+		}
+		return lits
+	case *ast.ConvExpr:
+		return condLiterals(c.N)
+	case *ast.BinaryExpr:
+		lhs, rhs := condLiterals(c.Lhs), condLiterals(c.Rhs)
+		switch c.Op {
+		case parser.AND:
+			// Either side's literals will do; prefer the one that's found
+			// in fewer lines, by guessing that's the one with fewer.
+			if lhs == nil || (rhs != nil && len(rhs) < len(lhs)) {
+				return rhs
+			}
+			return lhs
+		case parser.OR:
+			if lhs != nil && rhs != nil {
+				return append(lhs, rhs...)
+			}
+		}
+	}
+	return nil
+}
+
+// patternLiteral returns the longest literal string contained in every match
+// of the regular expression pattern, or "" if there is none.
+func patternLiteral(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return requiredLiteral(re.Simplify())
+}
+
+// requiredLiteral returns the longest literal string contained in every match
+// of re, or "" if there is none.
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals in a concatenation join into a longer literal.
+		var best, run string
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run += string(sub.Rune)
+				continue
+			}
+			if len(run) > len(best) {
+				best = run
+			}
+			run = ""
+			if lit := requiredLiteral(sub); len(lit) > len(best) {
+				best = lit
+			}
+		}
+		if len(run) > len(best) {
+			best = run
+		}
+		return best
+	}
+	return ""
+}
+
+// Filter is an index of the literals of programs, built as an Aho-Corasick
+// automaton over the bytes of the literals.
+type Filter struct {
+	nodes []node         // nodes of the automaton; the root is node 0
+	progs map[string]int // index of each program that the filter applies to
+}
+
+// node is a state of the automaton.
+type node struct {
+	next  map[byte]int // transitions of the trie of literals
+	fail  int          // state of the longest proper suffix that is in the trie
+	progs []int        // programs with a literal that ends at this state
+}
+
+// New returns a Filter for the programs, given each program's literals as
+// returned by Literals.  Programs without literals are always run.
+func New(literals map[string][]string) *Filter {
+	f := &Filter{nodes: []node{{}}, progs: make(map[string]int)}
+	for prog, lits := range literals {
+		if len(lits) == 0 {
+			continue
+		}
+		p := len(f.progs)
+		f.progs[prog] = p
+		for _, lit := range lits {
+			s := 0
+			for i := 0; i < len(lit); i++ {
+				next, ok := f.nodes[s].next[lit[i]]
+				if !ok {
+					if f.nodes[s].next == nil {
+						f.nodes[s].next = make(map[byte]int)
+					}
+					next = len(f.nodes)
+					f.nodes[s].next[lit[i]] = next
+					f.nodes = append(f.nodes, node{})
+				}
+				s = next
+			}
+			f.nodes[s].progs = append(f.nodes[s].progs, p)
+		}
+	}
+	// Set the failure transitions breadth first, so that each node's output
+	// includes the programs of the literals that are suffixes of it.
+	queue := make([]int, 0, len(f.nodes))
+	for _, child := range f.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for b, child := range f.nodes[s].next {
+			fail := f.nodes[s].fail
+			for {
+				if next, ok := f.nodes[fail].next[b]; ok {
+					fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = f.nodes[fail].fail
+			}
+			f.nodes[child].fail = fail
+			f.nodes[child].progs = append(f.nodes[child].progs, f.nodes[fail].progs...)
+			queue = append(queue, child)
+		}
+	}
+	return f
+}
+
+// Candidates is the result of scanning a line with a Filter.
+type Candidates struct {
+	f     *Filter
+	found []bool // whether a literal of each program is in the line
+}
+
+// Scan returns the programs that may act on line.  A nil Filter runs every
+// program.
+func (f *Filter) Scan(line string) Candidates {
+	if f == nil || len(f.progs) == 0 {
+		return Candidates{}
+	}
+	c := Candidates{f: f, found: make([]bool, len(f.progs))}
+	remaining := len(f.progs)
+	s := 0
+	for i := 0; i < len(line) && remaining > 0; i++ {
+		for {
+			if next, ok := f.nodes[s].next[line[i]]; ok {
+				s = next
+				break
+			}
+			if s == 0 {
+				break
+			}
+			s = f.nodes[s].fail
+		}
+		for _, p := range f.nodes[s].progs {
+			if !c.found[p] {
+				c.found[p] = true
+				remaining--
+			}
+		}
+	}
+	return c
+}
+
+// Runs returns false if the program named prog can't act on the scanned line,
+// and so needn't be run on it.
+func (c Candidates) Runs(prog string) bool {
+	if c.f == nil {
+		return true
+	}
+	p, ok := c.f.progs[prog]
+	return !ok || c.found[p]
+}
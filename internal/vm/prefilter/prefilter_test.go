@@ -0,0 +1,116 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package prefilter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/checker"
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+var literalsTests = []struct {
+	name     string
+	prog     string
+	expected []string
+}{
+	{"literal",
+		"counter a\n/foo/ {\n  a++\n}\n",
+		[]string{"foo"}},
+	{"longest literal",
+		"counter a\n/^(\\d+) GET (\\S+) HTTP\\/1\\.1$/ {\n  a++\n}\n",
+		[]string{" HTTP/1.1"}},
+	{"several blocks",
+		"counter a\n/foo/ {\n  a++\n}\n/bar\\d+/ {\n  a++\n}\n",
+		[]string{"foo", "bar"}},
+	{"capture and repetition",
+		"counter a\n/(error)+: (x{2})/ {\n  a++\n}\n",
+		[]string{"error"}},
+	{"and",
+		"counter a\ngetfilename() == \"x\" && /foo/ {\n  a++\n}\n",
+		[]string{"foo"}},
+	{"or",
+		"counter a\n/foo/ || getfilename() == \"x\" {\n  a++\n}\n",
+		nil},
+	{"fragment",
+		"const X /foo/\ncounter a\n// + X + /\\d/ {\n  a++\n}\n",
+		[]string{"foo"}},
+	{"case folded",
+		"counter a\n/(?i)foo/ {\n  a++\n}\n",
+		nil},
+	{"alternation",
+		"counter a\n/foo|bar/ {\n  a++\n}\n",
+		nil},
+	{"optional",
+		"counter a\n/x(foo)?/ {\n  a++\n}\n",
+		[]string{"x"}},
+	{"else",
+		"counter a\n/foo/ {\n  a++\n} else {\n  a++\n}\n",
+		nil},
+	{"unconditional",
+		"counter a\na++\n",
+		nil},
+	{"not a pattern",
+		"counter a\ngetfilename() == \"x\" {\n  a++\n}\n",
+		nil},
+	{"formats",
+		"counter a\nformats {\n  x /foo (?P<n>\\d+)/\n  y /n=(?P<n>\\d+)/\n} {\n  a++\n}\n",
+		[]string{"foo ", "n="}},
+	{"format without a literal",
+		"counter a\nformats {\n  x /foo (?P<n>\\d+)/\n  y /(?P<n>\\d+)/\n} {\n  a++\n}\n",
+		nil},
+	{"one block without a literal",
+		"counter a\n/foo/ {\n  a++\n}\n/.*/ {\n  a++\n}\n",
+		nil},
+}
+
+func TestLiterals(t *testing.T) {
+	for _, tc := range literalsTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := parser.Parse(tc.name, strings.NewReader(tc.prog))
+			testutil.FatalIfErr(t, err)
+			n, err = checker.Check(n)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, Literals(n)); diff != "" {
+				t.Errorf("Literals diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := New(map[string][]string{
+		"a":      {"he", "she"},
+		"b":      {"hers"},
+		"c":      {"his"},
+		"always": nil,
+	})
+	for _, tc := range []struct {
+		line     string
+		expected map[string]bool
+	}{
+		{"", map[string]bool{"a": false, "b": false, "c": false, "always": true}},
+		{"ushers", map[string]bool{"a": true, "b": true, "c": false, "always": true}},
+		{"this", map[string]bool{"a": false, "b": false, "c": true, "always": true}},
+		{"ahishe", map[string]bool{"a": true, "b": false, "c": true, "always": true}},
+		{"hxrs", map[string]bool{"a": false, "b": false, "c": false, "always": true}},
+	} {
+		c := f.Scan(tc.line)
+		got := make(map[string]bool)
+		for prog := range tc.expected {
+			got[prog] = c.Runs(prog)
+		}
+		if diff := testutil.Diff(tc.expected, got); diff != "" {
+			t.Errorf("Scan(%q) diff:\n%s", tc.line, diff)
+		}
+	}
+
+	var nilFilter *Filter
+	if !nilFilter.Scan("x").Runs("a") {
+		t.Error("nil filter should run every program")
+	}
+}
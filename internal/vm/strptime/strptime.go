@@ -0,0 +1,99 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package strptime translates the POSIX strptime format strings familiar from
+// C, Python and Ruby, like "%Y-%m-%d %H:%M:%S", into the reference time
+// layouts of Go's time package.
+package strptime
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// conversions are the Go layouts of the supported conversion specifications.
+// Locale dependent conversions are those of the POSIX locale.
+var conversions = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'c': "Mon Jan _2 15:04:05 2006",
+	'd': "02",
+	'D': "01/02/06",
+	'e': "_2",
+	'f': "999999999",
+	'F': "2006-01-02",
+	'h': "Jan",
+	'H': "15",
+	'I': "03",
+	'j': "002",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'R': "15:04",
+	'S': "05",
+	'T': "15:04:05",
+	'x': "01/02/06",
+	'X': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+}
+
+// reserved are the substrings of literal text that Go would read as part of
+// a layout.  Go layouts have no escapes, so formats containing them can't be
+// translated.
+var reserved = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "Jan", "Mon", "MST", "PM", "pm"}
+
+// IsFormat returns true if format is a POSIX format string, rather than a Go
+// layout, as it contains a conversion specification.
+func IsFormat(format string) bool {
+	return strings.Contains(format, "%")
+}
+
+// Layout returns the Go layout equivalent to the POSIX format string format.
+// Unsupported conversions, and literal text that Go would read as part of the
+// layout, are errors.
+func Layout(format string) (string, error) {
+	var b, literal strings.Builder
+	flush := func() error {
+		s := literal.String()
+		literal.Reset()
+		for _, r := range reserved {
+			if strings.Contains(s, r) {
+				return errors.Errorf("literal text %q can't be used in a format, as it contains %q", s, r)
+			}
+		}
+		b.WriteString(s)
+		return nil
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", errors.New("format ends with an incomplete conversion")
+		}
+		if format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		layout, ok := conversions[format[i]]
+		if !ok {
+			return "", errors.Errorf("unsupported conversion %%%c", format[i])
+		}
+		if err := flush(); err != nil {
+			return "", err
+		}
+		b.WriteString(layout)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
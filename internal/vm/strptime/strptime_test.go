@@ -0,0 +1,86 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package strptime
+
+import (
+	"testing"
+	"time"
+)
+
+var layoutTests = []struct {
+	format   string
+	layout   string
+	value    string
+	expected time.Time
+}{
+	{"%Y-%m-%d %H:%M:%S",
+		"2006-01-02 15:04:05",
+		"2019-03-04 05:06:07",
+		time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)},
+	{"%Y-%m-%dT%H:%M:%S.%f%z",
+		"2006-01-02T15:04:05.999999999-0700",
+		"2019-03-04T05:06:07.25+0000",
+		time.Date(2019, 3, 4, 5, 6, 7, 250000000, time.UTC)},
+	{"%d/%b/%Y:%T %z",
+		"02/Jan/2006:15:04:05 -0700",
+		"10/Oct/2000:13:55:36 +0000",
+		time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC)},
+	{"%b %e %H:%M:%S",
+		"Jan _2 15:04:05",
+		"Mar  4 05:06:07",
+		time.Date(0, 3, 4, 5, 6, 7, 0, time.UTC)},
+	{"%a, %d %B %y %I:%M %p",
+		"Mon, 02 January 06 03:04 PM",
+		"Mon, 04 March 19 05:06 PM",
+		time.Date(2019, 3, 4, 17, 6, 0, 0, time.UTC)},
+	{"%F %R %%",
+		"2006-01-02 15:04 %",
+		"2019-03-04 05:06 %",
+		time.Date(2019, 3, 4, 5, 6, 0, 0, time.UTC)},
+}
+
+func TestLayout(t *testing.T) {
+	for _, tc := range layoutTests {
+		if !IsFormat(tc.format) {
+			t.Errorf("IsFormat(%q) = false", tc.format)
+		}
+		layout, err := Layout(tc.format)
+		if err != nil {
+			t.Errorf("Layout(%q): %s", tc.format, err)
+			continue
+		}
+		if layout != tc.layout {
+			t.Errorf("Layout(%q) = %q, expected %q", tc.format, layout, tc.layout)
+		}
+		tm, err := time.Parse(layout, tc.value)
+		if err != nil {
+			t.Errorf("time.Parse(%q, %q): %s", layout, tc.value, err)
+			continue
+		}
+		if !tm.Equal(tc.expected) {
+			t.Errorf("time.Parse(%q, %q) = %s, expected %s", layout, tc.value, tm, tc.expected)
+		}
+	}
+}
+
+func TestLayoutErrors(t *testing.T) {
+	for _, format := range []string{
+		"%Y-%m-%d %",
+		"%s",
+		"%Y %Q",
+		"level=1 %H:%M",
+		"%H:%M Monday",
+		"%H:%M 100%%",
+	} {
+		if layout, err := Layout(format); err == nil {
+			t.Errorf("Layout(%q) = %q, expected error", format, layout)
+		}
+	}
+}
+
+func TestIsFormat(t *testing.T) {
+	if IsFormat("2006-01-02 15:04:05") {
+		t.Error("IsFormat of a Go layout = true")
+	}
+}
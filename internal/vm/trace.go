@@ -0,0 +1,170 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// Trace describes how a program processed a log line.
+type Trace struct {
+	Program  string
+	Matched  bool           // Whether any of the program's patterns matched the line.
+	Patterns []PatternTrace `json:",omitempty"` // The patterns the program tried, in order.
+	Updates  []UpdateTrace  `json:",omitempty"` // The values the program recorded, in the order first recorded.
+	Errors   []string       `json:",omitempty"` // Runtime errors, which stop the program processing the line.
+}
+
+// PatternTrace describes an attempt to match a pattern.
+type PatternTrace struct {
+	Pattern  string
+	Matched  bool
+	Captures map[string]string `json:",omitempty"` // Capture groups of a match, by number and by name.
+}
+
+// UpdateTrace describes a value recorded by a program.  As the line is
+// processed with empty metrics, the value is that recorded by this line
+// alone, such as 1 for an increment.
+type UpdateTrace struct {
+	Metric string
+	Labels map[string]string `json:",omitempty"`
+	Value  string
+}
+
+// tracer records the processing of a line by a VM.
+type tracer struct {
+	trace   *Trace
+	updated []datum.Datum            // Datums written to, in the order first written.
+	seen    map[datum.Datum]struct{} // The elements of updated.
+}
+
+// match records the match m of re, nil if it didn't match.
+func (tr *tracer) match(re *regexp.Regexp, m []string) {
+	p := PatternTrace{Pattern: re.String(), Matched: m != nil}
+	if len(m) > 1 {
+		p.Captures = make(map[string]string)
+		names := re.SubexpNames()
+		for i := 1; i < len(m); i++ {
+			p.Captures[strconv.Itoa(i)] = m[i]
+			if names[i] != "" {
+				p.Captures[names[i]] = m[i]
+			}
+		}
+	}
+	tr.trace.Patterns = append(tr.trace.Patterns, p)
+}
+
+// update records a write to d.
+func (tr *tracer) update(d datum.Datum) {
+	if _, ok := tr.seen[d]; ok {
+		return
+	}
+	tr.seen[d] = struct{}{}
+	tr.updated = append(tr.updated, d)
+}
+
+// updates returns the values written to the datums of ms.
+func (tr *tracer) updates(ms []*metrics.Metric) []UpdateTrace {
+	found := make(map[datum.Datum]UpdateTrace, len(tr.updated))
+	for _, m := range ms {
+		m.RLock()
+		for _, lv := range m.LabelValues {
+			if _, ok := tr.seen[lv.Value]; !ok {
+				continue
+			}
+			u := UpdateTrace{Metric: m.Name, Value: lv.Value.ValueString()}
+			if len(m.Keys) > 0 {
+				u.Labels = make(map[string]string, len(m.Keys))
+				for i, k := range m.Keys {
+					u.Labels[k] = lv.Labels[i]
+				}
+			}
+			found[lv.Value] = u
+		}
+		m.RUnlock()
+	}
+	var updates []UpdateTrace
+	for _, d := range tr.updated {
+		// A datum written to and then deleted isn't reported.
+		if u, ok := found[d]; ok {
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
+
+// shadowMetric returns a new metric with the declaration of m and no values.
+func shadowMetric(m *metrics.Metric) *metrics.Metric {
+	m.RLock()
+	defer m.RUnlock()
+	s := metrics.NewMetric(m.Name, m.Program, m.Kind, m.Type, m.Keys...)
+	s.Hidden = m.Hidden
+	s.Buckets = m.Buckets
+	s.Window = m.Window
+	s.Precision = m.Precision
+	s.InitialValue = m.InitialValue
+	if m.Learner != nil {
+		// Observations to a histogram still learning its buckets are only
+		// counted, so as not to feed the real learner.
+		if bounds := m.Learner.Bounds(); bounds != nil {
+			min := 0.0
+			for _, max := range bounds {
+				if max > min {
+					s.Buckets = append(s.Buckets, datum.Range{Min: min, Max: max})
+					min = max
+				}
+			}
+			s.Buckets = append(s.Buckets, datum.Range{Min: min, Max: math.Inf(+1)})
+		} else {
+			s.Learner = datum.NewBucketLearner(math.MaxInt32)
+		}
+	}
+	return s
+}
+
+// Trace processes the line with a copy of the program that records to empty
+// copies of its metrics, and returns a description of the patterns it tried
+// and the values it recorded.  The program's metrics, and the counters of its
+// lines and errors, are unaffected.
+func (v *VM) Trace(line *logline.LogLine) *Trace {
+	c := v.clone()
+	c.dedup = nil
+	c.interned = nil
+	// New label sets aren't counted as series in the store, which might evict
+	// real ones, and sampled increments don't advance the program's counts.
+	c.store = nil
+	c.samples = make(map[int]*int64, len(v.samples))
+	for pc := range v.samples {
+		c.samples[pc] = new(int64)
+	}
+	// The line is processed without the fields accumulated from other lines,
+	// and without storing its own.
+	c.accum = newAccumulator(0)
+	c.m = make([]*metrics.Metric, len(v.m))
+	for i, m := range v.m {
+		c.m[i] = shadowMetric(m)
+	}
+	c.clocks = windowClocks(c.m)
+	c.labelSets = &labelSetCount{} // The shadow metrics start without label sets.
+	tr := &Trace{Program: v.name}
+	c.tracer = &tracer{trace: tr, seen: make(map[datum.Datum]struct{})}
+	t := c.newThread(line)
+	for t.pc < len(c.prog) && !c.terminate {
+		i := c.prog[t.pc]
+		t.pc++
+		c.execute(t, i)
+		if t.overflow {
+			c.errorf("stack depth exceeded %d", t.maxDepth)
+		}
+	}
+	tr.Matched = t.lineMatched
+	tr.Updates = c.tracer.updates(c.m)
+	return tr
+}
@@ -198,17 +198,40 @@ var (
 
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewVariable(), Int),
-	"bool":        Function(NewVariable(), Bool),
-	"float":       Function(NewVariable(), Float),
-	"string":      Function(NewVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	// bucket is variadic in its boundaries, collapse in its templates, and
+	// debug_print in its values, hash takes an optional algorithm, and they
+	// are checked specially.
+	"bucket":               Function(NewVariable(), Float, String),
+	"collapse":             Function(String, String, String),
+	"debug_print":          Function(String, NewVariable(), None),
+	"hash":                 Function(String, String, String),
+	"int":                  Function(NewVariable(), Int),
+	"bool":                 Function(NewVariable(), Bool),
+	"float":                Function(NewVariable(), Float),
+	"string":               Function(NewVariable(), String),
+	"timestamp":            Function(Int),
+	"len":                  Function(String, Int),
+	"crc32":                Function(String, Int),
+	"fnv32":                Function(String, Int),
+	"duration":             Function(String, Float),
+	"settime":              Function(Int, None),
+	"strptime":             Function(String, String, None),
+	"strtol":               Function(String, Int, Int),
+	"tolower":              Function(String, String),
+	"decode_uri_component": Function(String, String),
+	"encode_uri_component": Function(String, String),
+	"base64_decode":        Function(String, String),
+	"base64_encode":        Function(String, String),
+	"getfilename":          Function(String),
+	"getenv":               Function(String, String),
+	"logfmt":               Function(String, String),
+	"json_extract":         Function(String, String, String),
+	"xml_extract":          Function(String, String, String),
+	"journalfield":         Function(String, String),
+	"accesslog":            Function(String, String, String),
+	"geoip":                Function(String, String, String),
+	"hll_add":              Function(Int, NewVariable(), None),
+	"accumulated":          Function(String, String),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
@@ -0,0 +1,136 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// unparseableFlushDelay is how long a line written to the unparseable log may
+// stay in the write buffer before it is flushed to disk.
+const unparseableFlushDelay = time.Second
+
+// unparseableLog writes lines that weren't matched by any program to a file,
+// for later analysis.  When the file would grow past maxSize bytes, it is
+// rotated to the same name with a `.1` suffix, replacing any previous one.
+type unparseableLog struct {
+	path    string // Path of the file to write to.
+	maxSize int64  // Size in bytes to rotate the file at, or zero for never.
+
+	mu           sync.Mutex    // guards access to the fields below
+	f            *os.File      // The open file.
+	w            *bufio.Writer // Buffered writer of f.
+	size         int64         // Number of bytes written to f, including those in w.
+	flushPending bool          // A flush of w has been scheduled.
+}
+
+// newUnparseableLog opens the file at path for appending unparseable lines to.
+func newUnparseableLog(path string, maxSize int64) (*unparseableLog, error) {
+	u := &unparseableLog{path: path, maxSize: maxSize}
+	if err := u.open(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// open opens the file at u.path, and sets up the buffered writer.
+func (u *unparseableLog) open() error {
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "opening unparseable log %q", u.path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "stat of unparseable log %q", u.path)
+	}
+	u.f = f
+	u.w = bufio.NewWriter(f)
+	u.size = fi.Size()
+	return nil
+}
+
+// WriteLine appends line to the file, rotating it first if it would grow past
+// the maximum size.  If the rotation fails but the file is still open, the line
+// is appended anyway, and the rotation error returned.
+func (u *unparseableLog) WriteLine(line string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.f == nil {
+		return errors.Errorf("unparseable log %q is closed", u.path)
+	}
+	n := int64(len(line) + 1)
+	var rerr error
+	if u.maxSize > 0 && u.size > 0 && u.size+n > u.maxSize {
+		if rerr = u.rotate(); rerr != nil && u.f == nil {
+			return rerr
+		}
+	}
+	if _, err := u.w.WriteString(line + "\n"); err != nil {
+		return errors.Wrapf(err, "writing to unparseable log %q", u.path)
+	}
+	u.size += n
+	if !u.flushPending {
+		u.flushPending = true
+		time.AfterFunc(unparseableFlushDelay, u.flush)
+	}
+	return rerr
+}
+
+// flush writes out any buffered lines.
+func (u *unparseableLog) flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.flushPending = false
+	if u.f == nil {
+		return
+	}
+	if err := u.w.Flush(); err != nil {
+		glog.Infof("error flushing unparseable log %q: %s", u.path, err)
+	}
+}
+
+// rotate closes the current file, renames it, and opens a new one in its place.
+// If the file can't be renamed, it's reopened, so that later lines are still
+// written to it.
+func (u *unparseableLog) rotate() error {
+	if err := u.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(u.path, u.path+".1"); err != nil {
+		if oerr := u.open(); oerr != nil {
+			glog.Info(oerr)
+		}
+		return errors.Wrapf(err, "rotating unparseable log %q", u.path)
+	}
+	glog.V(1).Infof("Rotated unparseable log %q", u.path)
+	return u.open()
+}
+
+// close flushes and closes the current file.
+func (u *unparseableLog) close() error {
+	err := u.w.Flush()
+	if cerr := u.f.Close(); err == nil {
+		err = cerr
+	}
+	u.f = nil
+	u.w = nil
+	return errors.Wrapf(err, "closing unparseable log %q", u.path)
+}
+
+// Close flushes any buffered lines and closes the file.
+func (u *unparseableLog) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.f == nil {
+		return nil
+	}
+	return u.close()
+}
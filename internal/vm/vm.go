@@ -8,24 +8,36 @@ package vm
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"math"
+	"math/rand"
+	"net/url"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/internal/geoip"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/accesslog"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/object"
+	"github.com/google/mtail/internal/vm/xpath"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/trace"
@@ -33,7 +45,6 @@ import (
 
 var (
 	lineProcessingDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: "mtail",
 		Subsystem: "vm",
 		Name:      "line_processing_duration_seconds",
 		Help:      "VM line processing time distribution in seconds.",
@@ -41,14 +52,36 @@ var (
 	}, []string{"prog"})
 
 	runtimeLogError = flag.Bool("vm_logs_runtime_errors", true, "Enables logging of runtime errors to the standard log.  Set to false to only have the errors printed to the HTTP console.")
+	maxStackDepth   = flag.Int("vm_max_stack_depth", 1000, "Maximum depth of the VM stack.  Processing of a line is abandoned when a program's stack would grow deeper.  0 means no limit.")
+	stringIntern    = flag.Bool("vm_string_intern", false, "Store one copy of each distinct label value and text value recorded by a program, to reduce memory use when values repeat across many label sets.")
+	jsonArrayJoin   = flag.Bool("json_array_join", false, "Make json_extract() return a whole array as JSON, rather than its first element.")
+	xmlMaxSize      = flag.Int("xml_max_size", 64*1024, "Maximum size in bytes of the XML that xml_extract() parses.  Larger strings give \"\".  0 means no limit.")
+	hashTruncateLen = flag.Int("hash_truncate_len", 16, "Number of hex digits of the hash that hash() returns.  0 means the whole hash.")
+	accumulateTTL   = flag.Duration("accumulate_ttl", time.Minute, "How long the fields stored by an accumulate statement are kept for a finalize block with the same key to take.  0 means they're kept until taken.")
+	maxLabelSets    = flag.Int("max_metrics_per_program", 0, "Maximum number of label sets each program records across its metrics with labels.  Updates to new label sets beyond it are not recorded, while existing label sets are still updated.  0 means no limit.")
+	debugVM         = flag.Bool("debug_vm", false, "Compile the debug_print() statements of programs, which otherwise do nothing, to write to standard error or --debug_log_file.  For developing programs, not for production use.")
+	debugLogFile    = flag.String("debug_log_file", "", "File that debug_print() statements append to when --debug_vm is set, instead of standard error.")
+	base64URLSafe   = flag.Bool("base64_url_safe", false, "Use the URL-safe base64 alphabet, with - and _ in place of + and /, in base64_decode() and base64_encode().")
 )
 
 type thread struct {
-	pc      int              // Program counter.
-	matched bool             // Flag set if any match has been found.
-	matches map[int][]string // Match result variables.
-	time    time.Time        // Time register.
-	stack   []interface{}    // Data stack.
+	pc          int              // Program counter.
+	matched     bool             // Flag set if any match has been found.
+	lineMatched bool             // Flag set if any pattern, logfmt key or access log format has matched the input line.
+	matches     map[int][]string // Match result variables.
+	time        time.Time        // Time register.
+	stack       []interface{}    // Data stack.
+	maxDepth    int              // If nonzero, the maximum depth of the stack.
+	overflow    bool             // Flag set if a push would have exceeded maxDepth.
+
+	pending map[int][][]string // Matches not yet visited by a foreach loop.
+	logfmt  map[string]string  // The input line parsed as logfmt, once a program has asked for it.
+	json    *parsedJSON        // The string json_extract() last looked up in.
+	xml     *parsedXML         // The string xml_extract() last looked up in.
+
+	accesslog map[string]map[string]string // The input line parsed with each access log format a program has asked for.
+
+	finalized map[string]string // The fields taken by the enclosing finalize block.
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -63,8 +96,13 @@ type VM struct {
 	str []string          // String constants
 	m   []*metrics.Metric // Metrics accessible to this program.
 
+	clocks []*datum.Clock // Clocks of the window metrics in m, advanced to the time of each line.
+
 	timeMemos *lru.Cache // memo of time string parse results
 
+	samples map[int]*int64 // Count of visits to each sample instruction, by address, shared by the line workers.
+	rand    *rand.Rand     // Source of randomness for random sampling.
+
 	t *thread // Current thread of execution
 
 	input *logline.LogLine // Log line input to this round of execution.
@@ -78,10 +116,51 @@ type VM struct {
 
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
+
+	dedup *deduper // If set, suppresses lines identical to one recently processed.
+
+	accessLogFormats map[string]*accesslog.Format // Access log formats compiled by this program, by format string.
+
+	geoip *geoip.DB // If set, the database geoip() looks addresses up in.
+
+	accum *accumulator // Fields stored by accumulate statements, by key.
+
+	hashTruncateLen int    // If positive, the number of hex digits of the hash that hash() returns.
+	hashSecret      []byte // If set, hash() computes an HMAC keyed with it.
+
+	literals []string // If not nil, every line the program acts on contains one of these.
+
+	maxStackDepth int // If nonzero, the maximum depth of the stack.
+
+	maxLabelSets int            // If positive, the maximum number of label sets recorded across the program's metrics with labels.
+	labelSets    *labelSetCount // The number of label sets across the program's metrics with labels.
+	overflowed   *sync.Once     // Warns the first time a label set isn't recorded because of maxLabelSets.
+
+	store *metrics.Store // If set, the store the program's metrics are in, told of each new label set.
+
+	interned *interner // If set, label values and text values are interned in it.
+
+	debugOut io.Writer // If set, where debug_print() writes.
+
+	base64Enc *base64.Encoding // Encoding of base64_encode(), with padding.
+	base64Dec *base64.Encoding // Encoding of base64_decode(), without padding, which is stripped first.
+
+	jsonArrayJoin bool // If set, json_extract() returns whole arrays rather than their first element.
+
+	xmlMaxSize int                    // If positive, the maximum size of the XML xml_extract() parses.
+	xpaths     map[string]*xpath.Path // Paths compiled by this program, by path.
+
+	tracer *tracer // If set, the processing of the line is recorded in it instead of in the program's counters.
+
+	copies []*VM // Copies of this VM run by the Loader's line workers other than the first.
 }
 
 // Push a value onto the stack
 func (t *thread) Push(value interface{}) {
+	if t.maxDepth > 0 && len(t.stack) >= t.maxDepth {
+		t.overflow = true
+		return
+	}
 	t.stack = append(t.stack, value)
 }
 
@@ -93,8 +172,85 @@ func (t *thread) Pop() (value interface{}) {
 	return
 }
 
+// getDatum returns the datum of m named by keys, creating it if needed.  If
+// the program already has maxLabelSets label sets, a new one is not recorded:
+// a datum not added to m is returned instead, so that the rest of the action
+// still runs.  A new label set is added to the store's count of series, which
+// may evict others.
+func (v *VM) getDatum(m *metrics.Metric, keys []string) (datum.Datum, error) {
+	if (v.maxLabelSets <= 0 && v.store == nil) || len(keys) == 0 || m.HasDatum(keys...) {
+		return m.GetDatum(keys...)
+	}
+	if v.maxLabelSets > 0 && !v.reserveLabelSet() {
+		if v.tracer == nil {
+			metricsOverflows.Add(v.name, 1)
+			v.overflowed.Do(func() {
+				glog.Warningf("%s: not recording %s%q, as the program already has the maximum of %d label sets; further label sets not recorded are counted in metrics_per_program_overflow_total", v.name, m.Name, keys, v.maxLabelSets)
+			})
+		}
+		return m.NewDatum(), nil
+	}
+	d, err := m.GetDatum(keys...)
+	if err != nil || v.store == nil || m.Hidden {
+		return d, err
+	}
+	return d, v.store.AddedSeries(d)
+}
+
+// labelSetRecount is the shortest time between counts of a program's label
+// sets at maxLabelSets.
+const labelSetRecount = time.Second
+
+// labelSetCount is the number of label sets of a program, shared by its line
+// workers.
+type labelSetCount struct {
+	n       int64 // The number at the last count plus those added since, accessed atomically.
+	counted int64 // When the label sets were last counted, in Unix nanoseconds, accessed atomically.
+}
+
+// reserveLabelSet adds a new label set to the program's count, and returns
+// false if the program already has maxLabelSets.  Label sets removed by del,
+// expiry or the store's eviction aren't subtracted, so at maxLabelSets the
+// metrics are counted again, but at most once each labelSetRecount, so that a
+// burst of new label sets isn't slowed by counting them.
+func (v *VM) reserveLabelSet() bool {
+	c, max := v.labelSets, int64(v.maxLabelSets)
+	if atomic.AddInt64(&c.n, 1) <= max {
+		return true
+	}
+	atomic.AddInt64(&c.n, -1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&c.counted)
+	if now-last < int64(labelSetRecount) || !atomic.CompareAndSwapInt64(&c.counted, last, now) {
+		return false
+	}
+	n := v.countLabelSets()
+	if n >= max {
+		atomic.StoreInt64(&c.n, n)
+		return false
+	}
+	atomic.StoreInt64(&c.n, n+1)
+	return true
+}
+
+// countLabelSets returns the number of label sets across the program's
+// metrics with labels.
+func (v *VM) countLabelSets() (n int64) {
+	for _, m := range v.m {
+		if len(m.Keys) > 0 {
+			n += int64(m.Cardinality())
+		}
+	}
+	return
+}
+
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
+	if v.tracer != nil {
+		v.tracer.trace.Errors = append(v.tracer.trace.Errors, fmt.Sprintf(format, args...))
+		v.terminate = true
+		return
+	}
 	i := v.prog[v.t.pc-1]
 	progRuntimeErrors.Add(v.name, 1)
 	v.runtimeErrorMu.Lock()
@@ -153,6 +309,8 @@ func (t *thread) PopFloat() (float64, error) {
 		return n, nil
 	case int:
 		return float64(n), nil
+	case int64:
+		return float64(n), nil
 	case string:
 		r, err := strconv.ParseFloat(n, 64)
 		if err != nil {
@@ -165,6 +323,134 @@ func (t *thread) PopFloat() (float64, error) {
 	return 0, errors.Errorf("unexpected float type %T %q", val, val)
 }
 
+// bucketLabel returns the label of the range that val falls in, given the
+// increasing boundaries bounds: "<b0" below the first boundary, "b0-b1"
+// between two boundaries, and "bn+" at or above the last.
+func bucketLabel(val float64, bounds []float64) string {
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if val < bounds[0] {
+		return "<" + format(bounds[0])
+	}
+	for j := 1; j < len(bounds); j++ {
+		if val < bounds[j] {
+			return format(bounds[j-1]) + "-" + format(bounds[j])
+		}
+	}
+	return format(bounds[len(bounds)-1]) + "+"
+}
+
+// collapsePath returns path, without any query string, collapsed to the first
+// of templates that matches it.  A template matches a path with as many
+// segments, where each of the template's ":name" segments matches any
+// non-empty segment and the others match themselves.  If no template
+// matches, the path's segments that look like identifiers, being all digits,
+// UUIDs, or hexadecimal strings with a digit and at least 8 characters, are
+// replaced by ":id".
+func collapsePath(path string, templates []string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+Templates:
+	for _, template := range templates {
+		ts := strings.Split(template, "/")
+		if len(ts) != len(segments) {
+			continue
+		}
+		for j, s := range ts {
+			if strings.HasPrefix(s, ":") {
+				if segments[j] == "" {
+					continue Templates
+				}
+			} else if s != segments[j] {
+				continue Templates
+			}
+		}
+		return template
+	}
+	for j, s := range segments {
+		if isIdentifier(s) {
+			segments[j] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIdentifier returns true if the path segment s looks like an identifier:
+// all digits, a UUID, or a hexadecimal string of at least 8 characters with
+// at least one digit.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits, hex, dashes := 0, 0, 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'f', r >= 'A' && r <= 'F':
+			hex++
+		case r == '-':
+			dashes++
+		default:
+			return false
+		}
+	}
+	switch {
+	case digits == len(s):
+		return true
+	case dashes == 4 && len(s) == 36:
+		return s[8] == '-' && s[13] == '-' && s[18] == '-' && s[23] == '-'
+	case dashes == 0:
+		return len(s) >= 8 && digits > 0
+	}
+	return false
+}
+
+// decodeURIComponent returns s with its percent-encoded bytes decoded, and
+// plus signs replaced by spaces, as url.QueryUnescape does.  A percent sign
+// that doesn't start a valid escape is left as it is, and s is returned
+// unchanged if decoding it would not give valid UTF-8.
+func decodeURIComponent(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '+':
+			b = append(b, ' ')
+		case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b = append(b, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 2
+		default:
+			b = append(b, s[i])
+		}
+	}
+	if !utf8.Valid(b) {
+		return s
+	}
+	return string(b)
+}
+
+// isHex returns true if c is a hexadecimal digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unhex returns the value of the hexadecimal digit c.
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
 func compareInt(a, b int64, opnd int) (bool, error) {
 	switch opnd {
 	case -1:
@@ -286,7 +572,8 @@ func compare(a, b interface{}, opnd int) (bool, error) {
 	return false, errors.Errorf("cannot compare %T %q with %T %q", a, a, b, b)
 }
 
-// ParseTime performs location and syslog-year aware timestamp parsing.
+// ParseTime performs location and syslog-year aware timestamp parsing.  A
+// value that fails to parse is counted, and gives the zero time.
 func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 	var err error
 	if v.loc != nil {
@@ -295,8 +582,11 @@ func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 		tm, err = time.Parse(layout, value)
 	}
 	if err != nil {
-		v.errorf("strptime (%v, %v, %v) failed: %s", layout, value, v.loc, err)
-		return
+		if v.tracer == nil {
+			timestampParseFailures.Add(v.name, 1)
+		}
+		glog.V(1).Infof("%s: strptime (%v, %v, %v) failed: %s", v.name, layout, value, v.loc, err)
+		return time.Time{}
 	}
 	// Hack for yearless syslog.
 	if tm.Year() == 0 && v.syslogUseCurrentYear {
@@ -311,6 +601,30 @@ func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 	return
 }
 
+// observeTime advances the clocks of the program's window metrics to the
+// timestamp t of the line being processed, so that their windows follow the
+// time of the log rather than of the wall clock.
+func (v *VM) observeTime(t time.Time) {
+	for _, c := range v.clocks {
+		c.Observe(t)
+	}
+}
+
+// windowClocks returns the distinct clocks of the window metrics in ms.
+func windowClocks(ms []*metrics.Metric) (clocks []*datum.Clock) {
+	seen := make(map[*datum.Clock]struct{})
+	for _, m := range ms {
+		if m.Clock == nil {
+			continue
+		}
+		if _, ok := seen[m.Clock]; !ok {
+			seen[m.Clock] = struct{}{}
+			clocks = append(clocks, m.Clock)
+		}
+	}
+	return
+}
+
 // execute performs an instruction cycle in the VM. acting on the instruction
 // i in thread t.
 func (v *VM) execute(t *thread, i code.Instr) {
@@ -337,13 +651,120 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// where i.opnd == the matched re index
 		index := i.Operand.(int)
 		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
+		if t.matches[index] != nil {
+			t.lineMatched = true
+		}
+		if v.tracer != nil {
+			v.tracer.match(v.re[index], t.matches[index])
+		}
 		t.Push(t.matches[index] != nil)
 
+	case code.Findall:
+		// Find every match of the regex in the input, to be stepped through
+		// by Nextmatch.
+		index := i.Operand.(int)
+		t.pending[index] = v.re[index].FindAllStringSubmatch(v.input.Line, -1)
+		if t.pending[index] != nil {
+			t.lineMatched = true
+		}
+		if v.tracer != nil && t.pending[index] == nil {
+			v.tracer.match(v.re[index], nil)
+		}
+
+	case code.Nextmatch:
+		// Store the next pending match of the regex in the match register, and
+		// push whether there was one.
+		index := i.Operand.(int)
+		if len(t.pending[index]) == 0 {
+			t.Push(false)
+			break
+		}
+		t.matches[index] = t.pending[index][0]
+		t.pending[index] = t.pending[index][1:]
+		if v.tracer != nil {
+			v.tracer.match(v.re[index], t.matches[index])
+		}
+		t.Push(true)
+
+	case code.Exclude:
+		// Stop if the line matches the regex.  The match isn't stored, and
+		// doesn't count as the program matching the line.
+		index := i.Operand.(int)
+		m := v.re[index].FindStringSubmatch(v.input.Line)
+		if v.tracer != nil {
+			v.tracer.match(v.re[index], m)
+		}
+		if m != nil {
+			if v.tracer == nil {
+				programExcludedLines.Add(v.name, 1)
+			}
+			v.terminate = true
+		}
+
+	case code.Accumulate:
+		// Pop the fields and the key, and store the fields under the key.
+		names := i.Operand.([]string)
+		fields := make(map[string]string, len(names))
+		for j := len(names) - 1; j >= 0; j-- {
+			fields[names[j]] = t.Pop().(string)
+		}
+		key := t.Pop().(string)
+		expired := v.accum.Store(key, fields)
+		if expired > 0 && v.tracer == nil {
+			accumulateExpired.Add(v.name, int64(expired))
+		}
+
+	case code.Finalize:
+		// Take the fields stored under the key for the block to read.
+		key := t.Pop().(string)
+		fields, ok, expired := v.accum.Take(key)
+		if expired > 0 && v.tracer == nil {
+			accumulateExpired.Add(v.name, int64(expired))
+		}
+		t.finalized = fields
+		t.Push(ok)
+
+	case code.Accget:
+		name := t.Pop().(string)
+		t.Push(t.finalized[name])
+
+	case code.Fmatch:
+		// Match each format's regex against input in turn.  The first that
+		// matches fills the match register of the block with the whole
+		// match, the block's named groups, and the format's tag.
+		f := i.Operand.(*code.Formats)
+		t.matches[f.Index] = nil
+		for j, tag := range f.Tags {
+			re := v.re[f.Index+j]
+			m := re.FindStringSubmatch(v.input.Line)
+			if v.tracer != nil {
+				v.tracer.match(re, m)
+			}
+			if m == nil {
+				continue
+			}
+			result := make([]string, 0, len(f.Groups[j])+2)
+			result = append(result, m[0])
+			for _, g := range f.Groups[j] {
+				result = append(result, m[g])
+			}
+			t.matches[f.Index] = append(result, tag)
+			t.lineMatched = true
+			break
+		}
+		t.Push(t.matches[f.Index] != nil)
+
 	case code.Smatch:
 		// match regex against item on the stack
 		index := i.Operand.(int)
 		line := t.Pop().(string)
 		t.matches[index] = v.re[index].FindStringSubmatch(line)
+		if t.matches[index] != nil {
+			t.lineMatched = true
+		}
+		if v.tracer != nil {
+			v.tracer.match(v.re[index], t.matches[index])
+		}
 		t.Push(t.matches[index] != nil)
 
 	case code.Cmp:
@@ -436,6 +857,22 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.Jmp:
 		t.pc = i.Operand.(int)
 
+	case code.Pop:
+		for n := i.Operand.(int); n > 0; n-- {
+			t.Pop()
+		}
+
+	case code.Sample:
+		// Push true on every operand'th visit to this instruction, starting with the first.
+		rate := i.Operand.(int64)
+		n := atomic.AddInt64(v.samples[t.pc-1], 1) - 1
+		t.Push(n%rate == 0)
+
+	case code.Rsample:
+		// Push true with probability 1/operand.
+		rate := i.Operand.(int64)
+		t.Push(v.rand.Int63n(rate) == 0)
+
 	case code.Inc:
 		// Increment a datum
 		var delta int64 = 1
@@ -450,12 +887,33 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.IncIntBy(n, delta, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
 			return
 		}
 
+	case code.Finc:
+		// Increment a floating point datum
+		delta, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			datum.IncFloatBy(n, delta, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
+			t.Push(datum.GetFloat(n))
+		} else {
+			v.errorf("Unexpected type to increment: %T %q", n, n)
+			return
+		}
+
 	case code.Dec:
 		// Decrement a datum
 		var delta int64 = 1
@@ -470,6 +928,9 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.DecIntBy(n, delta, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
@@ -485,6 +946,9 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.SetInt(n, value, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
 		} else {
 			v.errorf("Unexpected type to iset: %T %q", n, n)
 			return
@@ -499,11 +963,56 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.SetFloat(n, value, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
 		} else {
 			v.errorf("Unexpected type to fset: %T %q", n, n)
 			return
 		}
 
+	case code.Imax, code.Imin:
+		// Set a datum to the value if it's beyond the datum's
+		value, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			if i.Opcode == code.Imax {
+				datum.MaxInt(n, value, t.time)
+			} else {
+				datum.MinInt(n, value, t.time)
+			}
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
+		} else {
+			v.errorf("Unexpected type to %s: %T %q", i.Opcode, n, n)
+			return
+		}
+
+	case code.Fmax, code.Fmin:
+		// Set a floating point datum to the value if it's beyond the datum's
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			if i.Opcode == code.Fmax {
+				datum.MaxFloat(n, value, t.time)
+			} else {
+				datum.MinFloat(n, value, t.time)
+			}
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
+		} else {
+			v.errorf("Unexpected type to %s: %T %q", i.Opcode, n, n)
+			return
+		}
+
 	case code.Sset:
 		// Set a string datum
 		value, ok := t.Pop().(string)
@@ -511,8 +1020,14 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("Value on stack was not a string: %T %q", value, value)
 			return
 		}
+		if v.interned != nil {
+			value = v.interned.intern(value)
+		}
 		if n, ok := t.Pop().(datum.Datum); ok {
 			datum.SetString(n, value, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
 		} else {
 			v.errorf("Unexpected type to sset: %T %q", n, n)
 			return
@@ -540,11 +1055,17 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		if cached, ok := v.timeMemos.Get(ts); !ok {
 			tm := v.ParseTime(layout, ts)
+			// Failures aren't memoized, so that each is counted, and leave
+			// the time register as it was.
+			if tm.IsZero() {
+				break
+			}
 			v.timeMemos.Add(ts, tm)
 			t.time = tm
 		} else {
 			t.time = cached.(time.Time)
 		}
+		v.observeTime(t.time)
 
 	case code.Timestamp:
 		// Put the time register onto the stack, unless it's zero in which case use system time.
@@ -564,6 +1085,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		t.time = time.Unix(ts, 0).UTC()
+		v.observeTime(t.time)
 
 	case code.Capref:
 		// Put a capture group reference onto the stack.
@@ -680,11 +1202,14 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		for a := index - 1; a >= 0; a-- {
 			s := t.Pop().(string)
 			//fmt.Printf("s: %v\n", s)
+			if v.interned != nil {
+				s = v.interned.intern(s)
+			}
 			keys[a] = s
 			//fmt.Printf("Keys: %v\n", keys)
 		}
 		//fmt.Printf("Keys: %v\n", keys)
-		d, err := m.GetDatum(keys...)
+		d, err := v.getDatum(m, keys)
 		if err != nil {
 			v.errorf("dload (GetDatum) failed: %s", err)
 			return
@@ -740,6 +1265,34 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		s := t.Pop().(string)
 		t.Push(strings.ToLower(s))
 
+	case code.Decodeuri:
+		// URL-decode a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(decodeURIComponent(s))
+
+	case code.Encodeuri:
+		// URL-encode a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(url.QueryEscape(s))
+
+	case code.Base64dec:
+		// Base64-decode a string from TOS, and push result back.
+		s := t.Pop().(string)
+		b, err := v.base64Dec.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			if v.tracer == nil {
+				base64DecodeErrors.Add(v.name, 1)
+			}
+			t.Push("")
+			return
+		}
+		t.Push(string(b))
+
+	case code.Base64enc:
+		// Base64-encode a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(v.base64Enc.EncodeToString([]byte(s)))
+
 	case code.Length:
 		// Compute the length of a string from TOS, and push result back.
 		val := t.Pop()
@@ -750,6 +1303,27 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(len(s))
 
+	case code.Crc32:
+		// Compute the checksum of a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(int64(crc32.ChecksumIEEE([]byte(s))))
+
+	case code.Fnv32:
+		// Compute the hash of a string from TOS, and push result back.
+		s := t.Pop().(string)
+		h := fnv.New32a()
+		h.Write([]byte(s)) // nolint:errcheck
+		t.Push(int64(h.Sum32()))
+
+	case code.Duration:
+		// Parse a duration from TOS, and push its seconds back.
+		s := t.Pop().(string)
+		d, ok := parseDuration(s)
+		if !ok && v.tracer == nil {
+			durationParseErrors.Add(v.name, 1)
+		}
+		t.Push(d)
+
 	case code.S2i:
 		base := int64(10)
 		var err error
@@ -769,6 +1343,38 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(i)
 
+	case code.Bucket:
+		// Pop the boundaries and the value, and push the label of the range
+		// the value falls in.
+		bounds := make([]float64, i.Operand.(int)-1)
+		for j := len(bounds) - 1; j >= 0; j-- {
+			b, err := t.PopFloat()
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+			bounds[j] = b
+		}
+		val, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(bucketLabel(val, bounds))
+
+	case code.Collapse:
+		// Pop the templates and the path, and push the collapsed path.
+		templates := make([]string, i.Operand.(int)-1)
+		for j := len(templates) - 1; j >= 0; j-- {
+			templates[j] = t.Pop().(string)
+		}
+		path, ok := t.Pop().(string)
+		if !ok {
+			v.errorf("collapse: path is not a string")
+			return
+		}
+		t.Push(collapsePath(path, templates))
+
 	case code.S2f:
 		str := t.Pop().(string)
 		f, err := strconv.ParseFloat(str, 64)
@@ -812,6 +1418,155 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.Getfilename:
 		t.Push(v.input.Filename)
 
+	case code.Logfmt:
+		// The line is parsed at most once, when a key is first looked up.
+		key := t.Pop().(string)
+		if t.logfmt == nil {
+			t.logfmt = parseLogfmt(v.input.Line)
+		}
+		value, ok := t.logfmt[key]
+		if ok {
+			t.lineMatched = true
+		}
+		t.Push(value)
+
+	case code.Jsonget:
+		// The JSON string is parsed at most once while it is looked up in
+		// repeatedly, as when extracting several fields of a line.
+		path := t.Pop().(string)
+		s := t.Pop().(string)
+		if t.json == nil || t.json.src != s {
+			t.json = parseJSON(s)
+		}
+		if t.json.err != nil {
+			t.Push("")
+			return
+		}
+		t.Push(jsonExtract(t.json.doc, path, v.jsonArrayJoin))
+
+	case code.Xmlget:
+		// The XML string is parsed at most once while it is looked up in
+		// repeatedly, as when extracting several fields of a line.
+		path := t.Pop().(string)
+		s := t.Pop().(string)
+		p, ok := v.xpaths[path]
+		if !ok {
+			var err error
+			p, err = xpath.Compile(path)
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+			if v.xpaths == nil {
+				v.xpaths = make(map[string]*xpath.Path)
+			}
+			v.xpaths[path] = p
+		}
+		if v.xmlMaxSize > 0 && len(s) > v.xmlMaxSize {
+			glog.Warningf("xml_extract() in %s: XML of %d bytes is larger than --xml_max_size %d", v.name, len(s), v.xmlMaxSize)
+			t.Push("")
+			return
+		}
+		if t.xml == nil || t.xml.src != s {
+			t.xml = parseXML(s)
+			if t.xml.err != nil {
+				glog.Warningf("xml_extract() in %s: invalid XML: %s", v.name, t.xml.err)
+			}
+		}
+		if t.xml.err != nil {
+			t.Push("")
+			return
+		}
+		value, _ := p.Eval(t.xml.doc)
+		t.Push(value)
+
+	case code.Journal:
+		t.Push(v.input.Fields[t.Pop().(string)])
+
+	case code.Accesslog:
+		// The line is parsed at most once per format, when a field is first
+		// looked up.
+		field := t.Pop().(string)
+		format := t.Pop().(string)
+		fields, ok := t.accesslog[format]
+		if !ok {
+			f, ok := v.accessLogFormats[format]
+			if !ok {
+				var err error
+				f, err = accesslog.Compile(format)
+				if err != nil {
+					v.errorf("%s", err)
+					return
+				}
+				if v.accessLogFormats == nil {
+					v.accessLogFormats = make(map[string]*accesslog.Format)
+				}
+				v.accessLogFormats[format] = f
+			}
+			fields = f.Parse(v.input.Line)
+			if t.accesslog == nil {
+				t.accesslog = make(map[string]map[string]string)
+			}
+			t.accesslog[format] = fields
+		}
+		if fields != nil {
+			t.lineMatched = true
+		}
+		t.Push(fields[field])
+
+	case code.Geoip:
+		field := t.Pop().(string)
+		ip := t.Pop().(string)
+		if v.geoip == nil {
+			t.Push(geoip.Unknown)
+			return
+		}
+		t.Push(v.geoip.Lookup(ip, field))
+
+	case code.Hash:
+		algorithm := "sha256"
+		if i.Operand.(int) == 2 {
+			algorithm = t.Pop().(string)
+		}
+		s := t.Pop().(string)
+		t.Push(hashString(s, algorithm, v.hashSecret, v.hashTruncateLen))
+
+	case code.Debugprint:
+		args := make([]interface{}, i.Operand.(int)-1)
+		for a := len(args) - 1; a >= 0; a-- {
+			args[a] = t.Pop()
+		}
+		format := t.Pop().(string)
+		if v.debugOut != nil && v.tracer == nil {
+			fmt.Fprintf(v.debugOut, "%s:%d: %s\n", v.name, i.SourceLine+1, fmt.Sprintf(format, args...))
+		}
+
+	case code.Nop:
+
+	case code.Hlladd:
+		// Numbers are added as their canonical text.
+		var value string
+		switch val := t.Pop().(type) {
+		case string:
+			value = val
+		case int64:
+			value = strconv.FormatInt(val, 10)
+		case float64:
+			value = strconv.FormatFloat(val, 'g', -1, 64)
+		default:
+			v.errorf("Unexpected type to hlladd: %T %q", val, val)
+			return
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			datum.AddHLL(n, value, t.time)
+			if v.tracer != nil {
+				v.tracer.update(n)
+			}
+		} else {
+			v.errorf("Unexpected type to hlladd: %T %q", n, n)
+			return
+		}
+
 	case code.Cat:
 		s1 := t.Pop().(string)
 		s2 := t.Pop().(string)
@@ -824,20 +1579,28 @@ func (v *VM) execute(t *thread, i code.Instr) {
 
 // ProcessLogLine handles the incoming lines by running a fetch-execute cycle
 // on the VM bytecode with the line as input to the program, until termination.
-func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
+// It returns true if any of the program's patterns matched the line.
+func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) (matched bool) {
 	ctx, span := trace.StartSpan(ctx, "VM.ProcessLogLine")
 	defer span.End()
 	span.AddAttributes(trace.StringAttribute("vm.prog", v.name))
+	if v.dedup != nil {
+		e, dup := v.dedup.Begin(dedupKey{line.Filename, line.Line})
+		if dup {
+			programDuplicateLines.Add(v.name, 1)
+			return e.Matched()
+		}
+		defer func() {
+			e.Done(matched)
+		}()
+	}
 	start := time.Now()
+	t := v.newThread(line)
 	defer func() {
 		lineProcessingDurations.WithLabelValues(v.name).Observe(time.Since(start).Seconds())
+		countProgLine(v.name, t.lineMatched)
+		matched = t.lineMatched
 	}()
-	t := new(thread)
-	t.matched = false
-	v.t = t
-	v.input = line
-	t.stack = make([]interface{}, 0)
-	t.matches = make(map[int][]string, len(v.re))
 	_, span1 := trace.StartSpan(ctx, "execute loop")
 	defer span1.End()
 	for {
@@ -848,6 +1611,10 @@ func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 		i := v.prog[t.pc]
 		t.pc++
 		v.execute(t, i)
+		if t.overflow {
+			stackOverflows.Add(v.name, 1)
+			v.errorf("stack depth exceeded %d", t.maxDepth)
+		}
 		if v.terminate {
 			span1.AddAttributes(trace.BoolAttribute("vm.terminated", true))
 			// Terminate only stops this invocation on this line of input; reset the terminate flag.
@@ -857,19 +1624,117 @@ func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 	}
 }
 
+// newThread returns a new thread of execution for processing the line.
+func (v *VM) newThread(line *logline.LogLine) *thread {
+	t := &thread{
+		stack:    make([]interface{}, 0),
+		maxDepth: v.maxStackDepth,
+		matches:  make(map[int][]string, len(v.re)),
+		pending:  make(map[int][][]string),
+	}
+	v.t = t
+	v.input = line
+	return t
+}
+
+// Literals returns strings of which at least one is contained in every line
+// that the program acts on, or nil if that isn't known.
+func (v *VM) Literals() []string {
+	return v.literals
+}
+
+// SkipLine records that a line wasn't run through the program because it
+// contains none of the program's literals.
+func (v *VM) SkipLine() {
+	countProgLine(v.name, false)
+}
+
+// countProgLine counts a line processed by the program prog in progLines,
+// under whether any of its patterns matched the line.
+func countProgLine(prog string, matched bool) {
+	m, ok := progLines.Get(prog).(*expvar.Map)
+	if !ok {
+		progLinesMu.Lock()
+		if m, ok = progLines.Get(prog).(*expvar.Map); !ok {
+			m = new(expvar.Map).Init()
+			progLines.Set(prog, m)
+		}
+		progLinesMu.Unlock()
+	}
+	m.Add(strconv.FormatBool(matched), 1)
+}
+
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
-	return &VM{
+	v := &VM{
 		name:                 name,
 		re:                   obj.Regexps,
 		str:                  obj.Strings,
 		m:                    obj.Metrics,
+		clocks:               windowClocks(obj.Metrics),
 		prog:                 obj.Program,
 		timeMemos:            lru.New(64),
+		samples:              make(map[int]*int64),
+		rand:                 rand.New(rand.NewSource(time.Now().UnixNano())),
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
+		maxStackDepth:        *maxStackDepth,
+		maxLabelSets:         *maxLabelSets,
+		jsonArrayJoin:        *jsonArrayJoin,
+		xmlMaxSize:           *xmlMaxSize,
+		hashTruncateLen:      *hashTruncateLen,
+		accum:                newAccumulator(*accumulateTTL),
+		labelSets:            &labelSetCount{},
+		overflowed:           &sync.Once{},
+	}
+	for pc, i := range v.prog {
+		if i.Opcode == code.Sample {
+			v.samples[pc] = new(int64)
+		}
+	}
+	if *stringIntern {
+		v.interned = &interner{}
+	}
+	v.base64Enc = base64.StdEncoding
+	if *base64URLSafe {
+		v.base64Enc = base64.URLEncoding
+	}
+	v.base64Dec = v.base64Enc.WithPadding(base64.NoPadding)
+	return v
+}
+
+// clone returns a copy of the VM that can process lines concurrently with it.
+// The copy shares the program and its metrics, the deduplicator, the sample
+// counts, the GeoIP database, the hash secret, the accumulated fields, the
+// string intern table, the label set count and overflow warning and the debug
+// log, but has its own execution state.
+func (v *VM) clone() *VM {
+	c := New(v.name, &object.Object{Program: v.prog, Regexps: v.re, Strings: v.str, Metrics: v.m}, v.syslogUseCurrentYear, v.loc)
+	c.dedup = v.dedup
+	c.samples = v.samples
+	c.literals = v.literals
+	c.HardCrash = v.HardCrash
+	c.maxStackDepth = v.maxStackDepth
+	c.maxLabelSets = v.maxLabelSets
+	c.labelSets = v.labelSets
+	c.overflowed = v.overflowed
+	c.store = v.store
+	c.geoip = v.geoip
+	c.hashSecret = v.hashSecret
+	c.accum = v.accum
+	c.interned = v.interned
+	c.debugOut = v.debugOut
+	return c
+}
+
+// worker returns the copy of the VM run by line worker k, or the VM itself
+// for the first worker.
+func (v *VM) worker(k int) *VM {
+	if k == 0 {
+		return v
 	}
+	return v.copies[k-1]
 }
 
 // DumpByteCode emits the program disassembly and program objects to a string.
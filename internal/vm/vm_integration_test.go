@@ -7,10 +7,14 @@ import (
 	"bufio"
 	"context"
 	"expvar"
+	"fmt"
 	"math"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
@@ -19,6 +23,23 @@ import (
 	"github.com/google/mtail/internal/watcher"
 )
 
+// expvarValue returns the value of the counter in m under keys, a key for each
+// level of nested maps, or 0 if there's none.
+func expvarValue(m *expvar.Map, keys ...string) float64 {
+	var v expvar.Var = m
+	for _, k := range keys {
+		mv, ok := v.(*expvar.Map)
+		if !ok {
+			return 0
+		}
+		v = mv.Get(k)
+	}
+	if i, ok := v.(*expvar.Int); ok {
+		return float64(i.Value())
+	}
+	return 0
+}
+
 var vmTests = []struct {
 	name    string
 	prog    string
@@ -217,9 +238,1153 @@ func TestVmEndToEnd(t *testing.T) {
 				}
 			}
 			// t.Logf("Store is %v", store)
-			if d := testutil.Diff(tc.metrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time")); d != "" {
+			if d := testutil.Diff(tc.metrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}, sync.Mutex{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time")); d != "" {
 				t.Errorf("Store didn't match:\n%s", d)
 			}
 		})
 	}
 }
+
+func TestSampledCounters(t *testing.T) {
+	prog := `counter exact
+counter deterministic sample 10
+counter randomised sample random 10
+
+/$/ {
+  exact++
+  deterministic++
+  randomised++
+}
+`
+	// The line workers share the sample counts, so sampling is as exact
+	// with several as with one.
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort, LineWorkers(workers))
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("sample", strings.NewReader(prog)))
+			const lines = 10000
+			for i := 0; i < lines; i++ {
+				l.ProcessLogLine(context.Background(), logline.New(context.Background(), "sample", "line"))
+			}
+			l.Close()
+
+			get := func(name string) int64 {
+				t.Helper()
+				d, err := store.Metrics[name][0].GetDatum()
+				testutil.FatalIfErr(t, err)
+				return datum.GetInt(d)
+			}
+			exact := get("exact")
+			if exact != lines {
+				t.Fatalf("exact count: expected %d, got %d", lines, exact)
+			}
+			if got := get("deterministic"); got != exact {
+				t.Errorf("deterministic sampled count: expected %d, got %d", exact, got)
+			}
+			// The standard deviation of the scaled random count is about 3% of the
+			// true count, so this tolerance is around five sigma.
+			if got := get("randomised"); math.Abs(float64(got-exact)) > 0.15*float64(exact) {
+				t.Errorf("random sampled count %d not within tolerance of %d", got, exact)
+			}
+		})
+	}
+}
+
+func TestCounterWindow(t *testing.T) {
+	prog := `counter_window errors_last_5m 5m by code
+
+/error (\d+)/ {
+  errors_last_5m[$1]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("window", strings.NewReader(prog)))
+	for _, line := range []string{"error 500", "ok", "error 500", "error 404"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "window", line))
+	}
+	l.Close()
+
+	m := store.Metrics["errors_last_5m"][0]
+	if m.Kind != metrics.Window || m.Window != 5*time.Minute {
+		t.Fatalf("unexpected metric declaration: %v", m)
+	}
+	for code, expected := range map[string]int64{"500": 2, "404": 1} {
+		d, err := m.GetDatum(code)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("errors_last_5m[%s]: expected %d, got %d", code, expected, got)
+		}
+	}
+}
+
+func TestCounterWindowLogTime(t *testing.T) {
+	prog := `counter_window errors_last_1m 1m
+
+/^(?P<date>\S+) (?P<msg>.*)$/ {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  $msg =~ /^error/ {
+    errors_last_1m++
+  }
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("window", strings.NewReader(prog)))
+	process := func(line string) {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "window", line))
+	}
+	get := func() int64 {
+		d, err := store.Metrics["errors_last_1m"][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		return datum.GetInt(d)
+	}
+
+	// The log is years old, so the window follows the time of its lines
+	// rather than the wall clock.
+	process("2020-06-01T12:00:00Z error one")
+	process("2020-06-01T12:00:20Z error two")
+	process("2020-06-01T12:00:40Z ok")
+	if got := get(); got != 2 {
+		t.Errorf("expected 2 errors within the window, got %d", got)
+	}
+	process("2020-06-01T12:01:10Z ok")
+	if got := get(); got != 1 {
+		t.Errorf("expected 1 error after the first left the window, got %d", got)
+	}
+	process("2020-06-01T12:01:15Z error three")
+	if got := get(); got != 2 {
+		t.Errorf("expected 2 errors after a new one, got %d", got)
+	}
+	process("2020-06-01T12:03:00Z ok")
+	if got := get(); got != 0 {
+		t.Errorf("expected no errors after the window passed, got %d", got)
+	}
+	l.Close()
+}
+
+func TestHLL(t *testing.T) {
+	prog := `hll unique_clients by vhost
+
+/^(?P<vhost>\S+) (?P<ip>\S+)$/ {
+  hll_add(unique_clients[$vhost], $ip)
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort, HLLPrecision(16))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("hll", strings.NewReader(prog)))
+	for _, line := range []string{"a 10.0.0.1", "a 10.0.0.2", "a 10.0.0.1", "b 10.0.0.1", "bogus"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "hll", line))
+	}
+	l.Close()
+
+	m := store.Metrics["unique_clients"][0]
+	if m.Kind != metrics.HLL || m.Precision != 16 {
+		t.Fatalf("unexpected metric declaration: %v", m)
+	}
+	for vhost, expected := range map[string]int64{"a": 2, "b": 1} {
+		d, err := m.GetDatum(vhost)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("unique_clients[%s]: expected %d, got %d", vhost, expected, got)
+		}
+	}
+}
+
+func TestAddCapturedAmount(t *testing.T) {
+	prog := `counter bytes_total
+counter bytes_by_method by method
+gauge seconds_total
+
+/^(?P<method>[A-Z]+) bytes=(?P<bytes>\S+) seconds=(?P<seconds>\S+)$/ {
+  bytes_total += $bytes
+  bytes_by_method[$method] += $bytes
+  seconds_total += float($seconds)
+  seconds_total += $seconds
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("amounts.mtail", strings.NewReader(prog)))
+	for _, line := range []string{
+		"GET bytes=1024 seconds=0.5",
+		"POST bytes=300 seconds=1",
+		"GET bytes=76 seconds=0.25",
+		"GET bytes=- seconds=2",
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "amounts", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		name     string
+		labels   []string
+		expected int64
+	}{
+		{"bytes_total", nil, 1400},
+		{"bytes_by_method", []string{"GET"}, 1100},
+		{"bytes_by_method", []string{"POST"}, 300},
+	} {
+		d, err := store.Metrics[tc.name][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("%s%v: expected %d, got %d", tc.name, tc.labels, tc.expected, got)
+		}
+	}
+	d, err := store.Metrics["seconds_total"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetFloat(d); got != 3.5 {
+		t.Errorf("seconds_total: expected 3.5, got %g", got)
+	}
+	// The line with a non-numeric amount is a runtime error, and isn't added.
+	if got := expvarValue(progRuntimeErrors, "amounts.mtail"); got != 1 {
+		t.Errorf("errors: expected 1, got %g", got)
+	}
+}
+
+func TestGaugeInitialValue(t *testing.T) {
+	prog := `gauge temperature = -273.15
+gauge queue_length by queue = 10
+
+/(\w+) (\d+)/ {
+  queue_length[$1] += $2
+}
+/temp (\S+)/ {
+  temperature = $1
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("init", strings.NewReader(prog)))
+
+	temperature := store.Metrics["temperature"][0]
+	if len(temperature.LabelValues) != 1 {
+		t.Fatalf("temperature not created at declaration: %v", temperature)
+	}
+	if got := datum.GetFloat(temperature.LabelValues[0].Value); got != -273.15 {
+		t.Errorf("temperature: expected -273.15, got %g", got)
+	}
+
+	queueLength := store.Metrics["queue_length"][0]
+	if len(queueLength.LabelValues) != 0 {
+		t.Errorf("queue_length created before any log lines: %v", queueLength)
+	}
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "init", "incoming 5"))
+	l.Close()
+	d, err := queueLength.GetDatum("incoming")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 15 {
+		t.Errorf("queue_length[incoming]: expected 15, got %d", got)
+	}
+}
+
+func TestCountByBucket(t *testing.T) {
+	prog := `counter request_latency by range
+
+/latency (\d+)/ {
+  request_latency[bucket($1, 0, 100, 500)]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("bucket", strings.NewReader(prog)))
+	for _, line := range []string{"latency 0", "latency 50", "latency 99", "latency 100", "latency 499", "latency 500", "latency 9000"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "bucket", line))
+	}
+	l.Close()
+
+	m := store.Metrics["request_latency"][0]
+	for label, expected := range map[string]int64{"0-100": 3, "100-500": 2, "500+": 2} {
+		d, err := m.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("request_latency[%s]: expected %d, got %d", label, expected, got)
+		}
+	}
+	if len(m.LabelValues) != 3 {
+		t.Errorf("unexpected buckets: %v", m.LabelValues)
+	}
+}
+
+func TestCollapsePaths(t *testing.T) {
+	prog := `counter requests_total by path
+
+/GET (\S+)/ {
+  requests_total[collapse($1, "/user/:id/orders/:id")]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("collapse", strings.NewReader(prog)))
+	for _, line := range []string{
+		"GET /user/12345/orders/67890",
+		"GET /user/42/orders/7",
+		"GET /user/alice/orders/first?page=1",
+		"GET /item/1001",
+		"GET /item/1002",
+		"GET /about",
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "collapse", line))
+	}
+	l.Close()
+
+	m := store.Metrics["requests_total"][0]
+	for label, expected := range map[string]int64{"/user/:id/orders/:id": 3, "/item/:id": 2, "/about": 1} {
+		d, err := m.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("requests_total[%s]: expected %d, got %d", label, expected, got)
+		}
+	}
+	if len(m.LabelValues) != 3 {
+		t.Errorf("unexpected paths: %v", m.LabelValues)
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	prog := `counter requests_total by service: "web", method, code
+counter lines_total by service: "web"
+
+/(\S+) (\d+)/ {
+  requests_total[$1][$2]++
+}
+// {
+  lines_total++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("static", strings.NewReader(prog)))
+	for _, line := range []string{"GET 200", "GET 404", "POST 200", "GET 200"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "static", line))
+	}
+	l.Close()
+
+	m := store.Metrics["requests_total"][0]
+	if diff := testutil.Diff([]string{"method", "code", "service"}, m.Keys); diff != "" {
+		t.Errorf("requests_total keys didn't match:\n%s", diff)
+	}
+	for _, lv := range m.LabelValues {
+		if lv.Labels[2] != "web" {
+			t.Errorf("requests_total%v: expected service label \"web\"", lv.Labels)
+		}
+	}
+	for labels, expected := range map[[2]string]int64{{"GET", "200"}: 2, {"GET", "404"}: 1, {"POST", "200"}: 1} {
+		d, err := m.GetDatum(labels[0], labels[1], "web")
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("requests_total%v: expected %d, got %d", labels, expected, got)
+		}
+	}
+	if len(m.LabelValues) != 3 {
+		t.Errorf("unexpected series: %v", m.LabelValues)
+	}
+	d, err := store.Metrics["lines_total"][0].GetDatum("web")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 4 {
+		t.Errorf("lines_total: expected 4, got %d", got)
+	}
+}
+
+func TestAdaptiveHistogram(t *testing.T) {
+	prog := `histogram_adaptive latency_ms by code @learn_from(4)
+
+/(\d+) (\d+)ms/ {
+  latency_ms[$1] = $2
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("adaptive", strings.NewReader(prog)))
+	for _, line := range []string{"200 1ms", "500 100ms", "200 10ms", "200 3ms", "404 20ms"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "adaptive", line))
+	}
+	l.Close()
+
+	m := store.Metrics["latency_ms"][0]
+	if diff := testutil.Diff([]float64{1, 1.7, 2.8, 4.6, 7.7, 13, 22, 36, 60, 100}, m.Learner.Bounds()); diff != "" {
+		t.Errorf("learned buckets didn't match:\n%s", diff)
+	}
+	for code, expected := range map[string]map[float64]uint64{
+		"200": {1: 1, 2.8: 1, 4.6: 2, 13: 3, math.Inf(+1): 3},
+		"500": {60: 0, 100: 1, math.Inf(+1): 1},
+		"404": {13: 0, 22: 1, math.Inf(+1): 1},
+	} {
+		d, err := m.GetDatum(code)
+		testutil.FatalIfErr(t, err)
+		bs := datum.GetBucketsCumByMax(d)
+		for max, count := range expected {
+			if bs[max] != count {
+				t.Errorf("latency_ms[%s] bucket le=%g: expected %d, got %d", code, max, count, bs[max])
+			}
+		}
+	}
+}
+
+func TestForeachMatch(t *testing.T) {
+	prog := `counter errors_total
+counter errors_by_code by code
+
+foreach /error=(\d+)/ {
+  errors_total++
+  errors_by_code[$1]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("foreach", strings.NewReader(prog)))
+	for _, line := range []string{"error=404 error=500 error=404", "no errors here"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "foreach", line))
+	}
+	l.Close()
+
+	d, err := store.Metrics["errors_total"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 3 {
+		t.Errorf("errors_total: expected 3, got %d", got)
+	}
+	m := store.Metrics["errors_by_code"][0]
+	for label, expected := range map[string]int64{"404": 2, "500": 1} {
+		d, err := m.GetDatum(label)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != expected {
+			t.Errorf("errors_by_code[%s]: expected %d, got %d", label, expected, got)
+		}
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	defer os.Unsetenv("MTAIL_TEST_DATACENTER")
+	testutil.FatalIfErr(t, os.Setenv("MTAIL_TEST_DATACENTER", "us-east-1"))
+	testutil.FatalIfErr(t, os.Unsetenv("MTAIL_TEST_UNSET"))
+	prog := `counter requests by datacenter, unset
+
+/$/ {
+  requests[getenv("MTAIL_TEST_DATACENTER"), getenv("MTAIL_TEST_UNSET")]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("getenv", strings.NewReader(prog)))
+	// The environment is read when the program is compiled, not per line.
+	testutil.FatalIfErr(t, os.Setenv("MTAIL_TEST_DATACENTER", "changed"))
+	l.ProcessLogLine(context.Background(), logline.New(context.Background(), "getenv", "line"))
+	l.Close()
+
+	d, err := store.Metrics["requests"][0].GetDatum("us-east-1", "")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 1 {
+		t.Errorf("requests[us-east-1, \"\"]: expected 1, got %d", got)
+	}
+	if n := len(store.Metrics["requests"][0].LabelValues); n != 1 {
+		t.Errorf("expected 1 label value, got %d: %v", n, store.Metrics["requests"][0].LabelValues)
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	prog := `counter requests by level, msg
+counter bytes_total
+
+/^level=/ {
+  requests[logfmt("level"), logfmt("msg")]++
+  bytes_total += int(logfmt("bytes"))
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("logfmt", strings.NewReader(prog)))
+	for _, line := range []string{
+		`level=info msg="request done" bytes=100`,
+		`level=error msg="said \"no\"" bytes=20`,
+		`level=info bytes=3 msg="request done"`,
+		`level=warn bytes=0`,
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "logfmt", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{
+		{[]string{"info", "request done"}, 2},
+		{[]string{"error", `said "no"`}, 1},
+		{[]string{"warn", ""}, 1},
+	} {
+		d, err := store.Metrics["requests"][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("requests%q: expected %d, got %d", tc.labels, tc.expected, got)
+		}
+	}
+	d, err := store.Metrics["bytes_total"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 123 {
+		t.Errorf("bytes_total: expected 123, got %d", got)
+	}
+}
+
+func TestAccesslog(t *testing.T) {
+	prog := `counter requests by status, method
+counter bytes_total
+
+// {
+  requests[accesslog("combined", "status"), accesslog("$remote_addr - $remote_user [$time_local] \"$method $uri $protocol\"", "method")]++
+  bytes_total += int(accesslog("combined", "bytes"))
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("accesslog", strings.NewReader(prog)))
+	for _, line := range []string{
+		`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 100 "-" "curl/7.68.0"`,
+		`192.0.2.2 - bob [10/Oct/2000:13:55:37 -0700] "POST /missing HTTP/1.1" 404 20 "http://example.com/" "Mozilla/5.0 (X11; Linux x86_64)"`,
+		`192.0.2.1 - - [10/Oct/2000:13:55:38 -0700] "GET /search?q=\"a b\" HTTP/1.1" 200 3 "-" "say \"hi\""`,
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "accesslog", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{
+		{[]string{"200", "GET"}, 2},
+		{[]string{"404", "POST"}, 1},
+	} {
+		d, err := store.Metrics["requests"][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("requests%q: expected %d, got %d", tc.labels, tc.expected, got)
+		}
+	}
+	d, err := store.Metrics["bytes_total"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 123 {
+		t.Errorf("bytes_total: expected 123, got %d", got)
+	}
+}
+
+func TestGeoip(t *testing.T) {
+	prog := `counter requests by country, asn
+
+/^(?P<ip>\S+) / {
+  requests[geoip($ip, "country"), geoip($ip, "asn")]++
+}
+`
+	for _, tc := range []struct {
+		name     string
+		opts     []func(*Loader) error
+		expected map[[2]string]int64
+	}{
+		{"database", []func(*Loader) error{GeoIPDatabase("../geoip/testdata/test.mmdb")}, map[[2]string]int64{
+			{"AU", "unknown"}:      2,
+			{"unknown", "64512"}:   1,
+			{"NZ", "unknown"}:      1,
+			{"unknown", "unknown"}: 2,
+		}},
+		{"no database", nil, map[[2]string]int64{
+			{"unknown", "unknown"}: 6,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, watcher.NewFakeWatcher(), append(tc.opts, ErrorsAbort)...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("geoip", strings.NewReader(prog)))
+			for _, line := range []string{
+				"1.2.3.4 GET /",
+				"1.2.3.200 GET /",
+				"10.1.2.3 GET /",
+				"2001:db8::1 GET /",
+				"192.0.2.1 GET /",
+				"bogus GET /",
+			} {
+				l.ProcessLogLine(context.Background(), logline.New(context.Background(), "geoip", line))
+			}
+			l.Close()
+
+			for labels, expected := range tc.expected {
+				d, err := store.Metrics["requests"][0].GetDatum(labels[0], labels[1])
+				testutil.FatalIfErr(t, err)
+				if got := datum.GetInt(d); got != expected {
+					t.Errorf("requests%q: expected %d, got %d", labels, expected, got)
+				}
+			}
+		})
+	}
+	if _, err := NewLoader("", metrics.NewStore(), watcher.NewFakeWatcher(), GeoIPDatabase("missing.mmdb")); err == nil {
+		t.Error("expected an error loading a missing GeoIP database")
+	}
+}
+
+func TestHash(t *testing.T) {
+	prog := `counter requests by user, client
+
+/^(?P<user>\S+) (?P<ip>\S+)$/ {
+  requests[hash($user), hash($ip, "md5")]++
+}
+`
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	secretFile := path.Join(tmpDir, "secret")
+	f := testutil.TestOpenFile(t, secretFile)
+	testutil.WriteString(t, f, "s3cret\n")
+	f.Close()
+
+	for _, tc := range []struct {
+		name     string
+		opts     []func(*Loader) error
+		expected [2]string
+	}{
+		{"plain", nil, [2]string{"2bd806c97f0e00af", "6384e2b2184bcbf5"}},
+		{"hmac", []func(*Loader) error{HashSecretFile(secretFile)}, [2]string{"765542af1f1d587b", "75881059b4ba3bc6"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, watcher.NewFakeWatcher(), append(tc.opts, ErrorsAbort)...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("hash", strings.NewReader(prog)))
+			l.ProcessLogLine(context.Background(), logline.New(context.Background(), "hash", "alice alice"))
+			l.Close()
+
+			d, err := store.Metrics["requests"][0].GetDatum(tc.expected[0], tc.expected[1])
+			testutil.FatalIfErr(t, err)
+			if got := datum.GetInt(d); got != 1 {
+				t.Errorf("requests%q: expected 1, got %d", tc.expected, got)
+			}
+		})
+	}
+	if _, err := NewLoader("", metrics.NewStore(), watcher.NewFakeWatcher(), HashSecretFile(path.Join(tmpDir, "missing"))); err == nil {
+		t.Error("expected an error reading a missing hash secret file")
+	}
+}
+
+func TestHashBuckets(t *testing.T) {
+	prog := `counter fnv by shard
+counter crc by shard
+
+/^session=(?P<id>\S+)$/ {
+  fnv[fnv32($id) % 4]++
+  crc[string(crc32($id) % 4)]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("buckets", strings.NewReader(prog)))
+	for _, id := range []string{"a1", "b2", "c3", "d4", "e5"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "buckets", "session="+id))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		metric   string
+		shard    string
+		expected int64
+	}{
+		{"fnv", "1", 2},
+		{"fnv", "3", 3},
+		{"crc", "1", 2},
+		{"crc", "2", 2},
+		{"crc", "3", 1},
+	} {
+		d, err := store.Metrics[tc.metric][0].GetDatum(tc.shard)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("%s[%q]: expected %d, got %d", tc.metric, tc.shard, tc.expected, got)
+		}
+	}
+}
+
+func TestAccumulateFinalize(t *testing.T) {
+	prog := `counter requests by method, status
+
+/^(?P<id>\d+) START (?P<method>\S+) (?P<path>\S+)$/ {
+  accumulate($id)
+}
+/^(?P<id>\d+) END (?P<status>\d{3})$/ {
+  finalize($id) {
+    requests[accumulated("method"), $status]++
+  }
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("accumulate", strings.NewReader(prog)))
+	for _, line := range []string{
+		"1 START GET /",
+		"2 START POST /login",
+		"3 START GET /favicon.ico",
+		"2 END 302",
+		"1 END 200",
+		"1 END 200", // Already finalized.
+		"4 END 500", // Never started.
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "accumulate", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		method, status string
+		expected       int64
+	}{
+		{"GET", "200", 1},
+		{"POST", "302", 1},
+	} {
+		d, err := store.Metrics["requests"][0].GetDatum(tc.method, tc.status)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("requests[%q, %q]: expected %d, got %d", tc.method, tc.status, tc.expected, got)
+		}
+	}
+	if got := len(store.Metrics["requests"][0].LabelValues); got != 2 {
+		t.Errorf("expected 2 label values, got %d", got)
+	}
+}
+
+func TestJournalfield(t *testing.T) {
+	prog := `counter requests by unit, code
+
+/ (?P<code>\d{3})$/ {
+  requests[journalfield("_SYSTEMD_UNIT"), $code]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("journal", strings.NewReader(prog)))
+	ctx := context.Background()
+	for _, ll := range []*logline.LogLine{
+		{ctx, "journald", "GET / 200", map[string]string{"_SYSTEMD_UNIT": "nginx.service"}},
+		{ctx, "journald", "GET /a 404", map[string]string{"_SYSTEMD_UNIT": "nginx.service"}},
+		{ctx, "journald", "GET / 200", map[string]string{"_SYSTEMD_UNIT": "app.service"}},
+		{ctx, "log", "GET / 200", nil},
+	} {
+		l.ProcessLogLine(ctx, ll)
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{
+		{[]string{"nginx.service", "200"}, 1},
+		{[]string{"nginx.service", "404"}, 1},
+		{[]string{"app.service", "200"}, 1},
+		{[]string{"", "200"}, 1},
+	} {
+		d, err := store.Metrics["requests"][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("requests%q: expected %d, got %d", tc.labels, tc.expected, got)
+		}
+	}
+}
+
+func TestInfoMetric(t *testing.T) {
+	defer os.Unsetenv("MTAIL_TEST_COMMIT")
+	testutil.FatalIfErr(t, os.Setenv("MTAIL_TEST_COMMIT", "abc123"))
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	for _, version := range []string{"1.0", "1.1"} {
+		prog := "info build_info { version: \"" + version + "\", commit: getenv(\"MTAIL_TEST_COMMIT\") }\n"
+		testutil.FatalIfErr(t, l.CompileAndRun("info", strings.NewReader(prog)))
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "info", "line"))
+
+		// The info metric is replaced on reload, not merged with the old one.
+		if n := len(store.Metrics["build_info"]); n != 1 {
+			t.Fatalf("expected 1 build_info metric, got %d", n)
+		}
+		m := store.Metrics["build_info"][0]
+		if diff := testutil.Diff([]string{"version", "commit"}, m.Keys); diff != "" {
+			t.Errorf("build_info keys diff:\n%s", diff)
+		}
+		if n := len(m.LabelValues); n != 1 {
+			t.Fatalf("expected 1 label value, got %d: %v", n, m.LabelValues)
+		}
+		if diff := testutil.Diff([]string{version, "abc123"}, m.LabelValues[0].Labels); diff != "" {
+			t.Errorf("build_info labels diff:\n%s", diff)
+		}
+		if got := datum.GetInt(m.LabelValues[0].Value); got != 1 {
+			t.Errorf("build_info: expected 1, got %d", got)
+		}
+	}
+	l.Close()
+}
+
+func TestProgramLinesAndErrors(t *testing.T) {
+	prog := `counter total
+/^(\S+) t$/ {
+  total += $1
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("counts.mtail", strings.NewReader(prog)))
+	for _, line := range []string{"2020 t", "abc t", "2021 t", "nope"} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "counts", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"matched lines", expvarValue(progLines, "counts.mtail", "true"), 3},
+		{"unmatched lines", expvarValue(progLines, "counts.mtail", "false"), 1},
+		{"errors", expvarValue(progRuntimeErrors, "counts.mtail"), 1},
+	} {
+		if tc.got != tc.expected {
+			t.Errorf("%s: expected %g, got %g", tc.name, tc.expected, tc.got)
+		}
+	}
+}
+
+func TestFilenameLabels(t *testing.T) {
+	prog := `filename_labels /\/logs\/tenant-(?P<tenant>[^\/]+)\//
+counter requests
+counter responses by code
+
+/ (?P<code>\d+)$/ {
+  requests++
+  responses[$code]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("filename_labels", strings.NewReader(prog)))
+	for _, line := range []struct {
+		filename, text string
+	}{
+		{"/logs/tenant-acme/app.log", "GET / 200"},
+		{"/logs/tenant-acme/app.log", "GET /missing 404"},
+		{"/logs/tenant-globex/app.log", "GET / 200"},
+		// Lines from files that don't match aren't counted.
+		{"/logs/system/app.log", "GET / 200"},
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), line.filename, line.text))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		name     string
+		labels   []string
+		expected int64
+	}{
+		{"requests", []string{"acme"}, 2},
+		{"requests", []string{"globex"}, 1},
+		{"responses", []string{"200", "acme"}, 1},
+		{"responses", []string{"404", "acme"}, 1},
+		{"responses", []string{"200", "globex"}, 1},
+	} {
+		m := store.Metrics[tc.name][0]
+		d, err := m.GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("%s%q: expected %d, got %d", tc.name, tc.labels, tc.expected, got)
+		}
+	}
+	if n := len(store.Metrics["requests"][0].LabelValues); n != 2 {
+		t.Errorf("expected 2 tenants, got %d", n)
+	}
+}
+
+func TestJSONExtractLines(t *testing.T) {
+	prog := `counter requests by method, status
+counter request_bytes by host
+
+/^(?P<json>{.*})$/ {
+  requests[json_extract($json, "$.request.method")][json_extract($json, "$.status")]++
+  request_bytes[json_extract($json, "request.headers.host")] += json_extract($json, "bytes")
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("json.mtail", strings.NewReader(prog)))
+	for _, line := range []string{
+		`{"status": 200, "bytes": 512, "request": {"method": "GET", "headers": {"host": "a.example.com"}}}`,
+		`{"request": {"headers": {"host": "a.example.com"}, "method": "POST"}, "bytes": 128, "status": 201}`,
+		`{"status": 200, "bytes": 64, "request": {"method": "GET", "headers": {"host": "b.example.com"}}}`,
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "json", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		name     string
+		labels   []string
+		expected int64
+	}{
+		{"requests", []string{"GET", "200"}, 2},
+		{"requests", []string{"POST", "201"}, 1},
+		{"request_bytes", []string{"a.example.com"}, 640},
+		{"request_bytes", []string{"b.example.com"}, 64},
+	} {
+		d, err := store.Metrics[tc.name][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("%s%q: expected %d, got %d", tc.name, tc.labels, tc.expected, got)
+		}
+	}
+}
+
+func TestXMLExtractLines(t *testing.T) {
+	prog := `counter messages by severity, subsystem
+
+/^(?P<xml><.*>)$/ {
+  messages[xml_extract($xml, "/record/@level")][xml_extract($xml, "//subsystem")]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("xml.mtail", strings.NewReader(prog)))
+	for _, line := range []string{
+		`<record level="Error"><source><subsystem>JDBC</subsystem></source><message>Connection lost</message></record>`,
+		`<record level="Info"><source><subsystem>JDBC</subsystem></source><message>Reconnected</message></record>`,
+		`<record level="Error"><source><subsystem>JDBC</subsystem></source><message>Timeout</message></record>`,
+		`<record level="Error"><source><subsystem>JDBC</subsystem></source>`,
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "xml", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		labels   []string
+		expected int64
+	}{
+		{[]string{"Error", "JDBC"}, 2},
+		{[]string{"Info", "JDBC"}, 1},
+		// The truncated record isn't valid XML.
+		{[]string{"", ""}, 1},
+	} {
+		d, err := store.Metrics["messages"][0].GetDatum(tc.labels...)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("messages%q: expected %d, got %d", tc.labels, tc.expected, got)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	prog := `counter requests by path
+counter lines
+
+exclude /GET \/healthz /
+exclude /^DEBUG /
+
+/.*/ {
+  lines++
+}
+/GET (\S+) / {
+  requests[$1]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("exclude.mtail", strings.NewReader(prog)))
+	for _, line := range []string{
+		"GET /healthz 200",
+		"GET /index.html 200",
+		"DEBUG GET /index.html 200",
+		"GET /index.html 304",
+		"GET /healthz 200",
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "exclude", line))
+	}
+	l.Close()
+
+	if got := datum.GetInt(store.Metrics["lines"][0].LabelValues[0].Value); got != 2 {
+		t.Errorf("lines: expected 2, got %d", got)
+	}
+	d, err := store.Metrics["requests"][0].GetDatum("/index.html")
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(d); got != 2 {
+		t.Errorf("requests[/index.html]: expected 2, got %d", got)
+	}
+	if n := len(store.Metrics["requests"][0].LabelValues); n != 1 {
+		t.Errorf("expected 1 path, got %d", n)
+	}
+	if got := expvarValue(programExcludedLines, "exclude.mtail"); got != 3 {
+		t.Errorf("excluded lines: expected 3, got %g", got)
+	}
+	if got := expvarValue(progLines, "exclude.mtail", "true"); got != 2 {
+		t.Errorf("matched lines: expected 2, got %g", got)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	prog := `counter requests by path, code
+counter bytes by path
+counter lines by format
+
+formats {
+  legacy /^(?P<code>\d{3}) (?P<path>\S+) (?P<size>\d+)$/
+  current /^path=(?P<path>\S+) status=(?P<code>\d{3}) bytes=(?P<size>\d+)$/
+} {
+  requests[$path][$code]++
+  bytes[$path] += $size
+  lines[$format]++
+}
+`
+	// run processes the lines with the program, and returns the values of
+	// the request and byte counters.
+	run := func(name string, lines []string) (map[string]int64, *metrics.Store) {
+		store := metrics.NewStore()
+		l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, l.CompileAndRun(name, strings.NewReader(prog)))
+		for _, line := range lines {
+			l.ProcessLogLine(context.Background(), logline.New(context.Background(), name, line))
+		}
+		l.Close()
+		values := make(map[string]int64)
+		for _, metric := range []string{"requests", "bytes"} {
+			for _, lv := range store.Metrics[metric][0].LabelValues {
+				values[metric+strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+			}
+		}
+		return values, store
+	}
+	legacy, legacyStore := run("legacy.mtail", []string{
+		"200 /index.html 512",
+		"404 /missing 0",
+		"200 /index.html 512",
+		"not a request",
+	})
+	current, currentStore := run("current.mtail", []string{
+		"path=/index.html status=200 bytes=512",
+		"path=/missing status=404 bytes=0",
+		"path=/index.html status=200 bytes=512",
+		"not a request",
+	})
+	if diff := testutil.Diff(legacy, current); diff != "" {
+		t.Errorf("metrics differ between formats:\n%s", diff)
+	}
+	if len(legacy) != 4 {
+		t.Errorf("expected 4 values, got %v", legacy)
+	}
+	for _, tc := range []struct {
+		store  *metrics.Store
+		format string
+	}{
+		{legacyStore, "legacy"},
+		{currentStore, "current"},
+	} {
+		d, err := tc.store.Metrics["lines"][0].GetDatum(tc.format)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != 3 {
+			t.Errorf("lines[%s]: expected 3, got %d", tc.format, got)
+		}
+	}
+}
+
+func TestMaxMin(t *testing.T) {
+	prog := `gauge peak_connections
+gauge min_latency by server
+
+/connections=(\d+)/ {
+  peak_connections max= $1
+}
+/server=(?P<server>\w+) latency=(?P<latency>\d+\.\d+)/ {
+  min_latency[$server] min= $latency
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("maxmin.mtail", strings.NewReader(prog)))
+	for _, line := range []string{
+		"connections=12",
+		"server=a latency=0.5",
+		"connections=40",
+		"server=a latency=0.25",
+		"connections=7",
+		"server=b latency=1.5",
+		"server=a latency=0.75",
+	} {
+		l.ProcessLogLine(context.Background(), logline.New(context.Background(), "maxmin", line))
+	}
+	l.Close()
+
+	if got := datum.GetInt(store.Metrics["peak_connections"][0].LabelValues[0].Value); got != 40 {
+		t.Errorf("peak_connections: expected 40, got %d", got)
+	}
+	// The first minimum of each server is taken, though the datum starts at 0.
+	for server, expected := range map[string]float64{"a": 0.25, "b": 1.5} {
+		d, err := store.Metrics["min_latency"][0].GetDatum(server)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); got != expected {
+			t.Errorf("min_latency[%s]: expected %g, got %g", server, expected, got)
+		}
+	}
+}
+
+func TestStopFirstMatchWins(t *testing.T) {
+	prog := `counter routes by route
+
+/^GET \/api\// {
+  routes["api"]++
+  stop
+}
+/^GET \/api\/admin/ {
+  routes["admin"]++
+  stop
+}
+/^GET / {
+  routes["other"]++
+}
+`
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, watcher.NewFakeWatcher(), ErrorsAbort)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("routes", strings.NewReader(prog)))
+	ctx := context.Background()
+	for _, line := range []string{"GET /api/users", "GET /api/admin/users", "GET /index.html"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, "log", line))
+	}
+	l.Close()
+
+	for _, tc := range []struct {
+		route    string
+		expected int64
+	}{
+		// The first matching block stops the program, so later blocks
+		// that also match don't run.
+		{"api", 2},
+		{"admin", 0},
+		{"other", 1},
+	} {
+		m := store.Metrics["routes"][0]
+		if lv := m.FindLabelValueOrNil([]string{tc.route}); lv == nil {
+			if tc.expected != 0 {
+				t.Errorf("routes[%q]: expected %d, got none", tc.route, tc.expected)
+			}
+		} else if got := datum.GetInt(lv.Value); got != tc.expected {
+			t.Errorf("routes[%q]: expected %d, got %d", tc.route, tc.expected, got)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package vm
 import (
 	"context"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,7 +34,7 @@ var instructions = []struct {
 		[]string{},
 		[]interface{}{},
 		[]interface{}{true},
-		thread{pc: 0, matches: map[int][]string{0: {"aaaab"}}},
+		thread{pc: 0, lineMatched: true, matches: map[int][]string{0: {"aaaab"}}},
 	},
 	{"cmp lt",
 		code.Instr{code.Cmp, -1, 0},
@@ -211,6 +212,69 @@ var instructions = []struct {
 		[]interface{}{"mIxeDCasE"},
 		[]interface{}{"mixedcase"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"decodeuri",
+		code.Instr{code.Decodeuri, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"caf%C3%A9+au+lait%2Fnoir"},
+		[]interface{}{"café au lait/noir"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"decodeuri invalid escapes",
+		code.Instr{code.Decodeuri, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"100%+off%2x%"},
+		[]interface{}{"100% off%2x%"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"decodeuri invalid utf8",
+		code.Instr{code.Decodeuri, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"%ff%fe"},
+		[]interface{}{"%ff%fe"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"encodeuri",
+		code.Instr{code.Encodeuri, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"café au lait/noir"},
+		[]interface{}{"caf%C3%A9+au+lait%2Fnoir"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64dec",
+		code.Instr{code.Base64dec, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"eyJzdWIiOiIxMjM0In0="},
+		[]interface{}{`{"sub":"1234"}`},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64dec unpadded",
+		code.Instr{code.Base64dec, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"eyJzdWIiOiIxMjM0In0"},
+		[]interface{}{`{"sub":"1234"}`},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64dec invalid",
+		code.Instr{code.Base64dec, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"not base64!"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"base64enc",
+		code.Instr{code.Base64enc, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"subjects?_d>"},
+		[]interface{}{"c3ViamVjdHM/X2Q+"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"collapse",
+		code.Instr{code.Collapse, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/user/12345/orders", "/user/:id/orders", "/item/:sku"},
+		[]interface{}{"/user/:id/orders"},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"length",
 		code.Instr{code.Length, 0, 0},
 		[]*regexp.Regexp{},
@@ -225,6 +289,20 @@ var instructions = []struct {
 		[]interface{}{""},
 		[]interface{}{0},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"crc32",
+		code.Instr{code.Crc32, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"hello"},
+		[]interface{}{int64(907060870)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"fnv32",
+		code.Instr{code.Fnv32, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"hello"},
+		[]interface{}{int64(1335831723)},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"shl",
 		code.Instr{code.Shl, 0, 0},
 		[]*regexp.Regexp{},
@@ -414,6 +492,20 @@ var instructions = []struct {
 		[]interface{}{},
 		[]interface{}{testFilename},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"logfmt",
+		code.Instr{code.Logfmt, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"aaaab"},
+		[]interface{}{""},
+		thread{pc: 0, lineMatched: true, matches: map[int][]string{}, logfmt: map[string]string{"aaaab": ""}}},
+	{"journal",
+		code.Instr{code.Journal, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"_SYSTEMD_UNIT"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"i2s",
 		code.Instr{code.I2s, nil, 0},
 		[]*regexp.Regexp{},
@@ -460,6 +552,31 @@ var instructions = []struct {
 
 const testFilename = "test"
 
+func TestCollapsePath(t *testing.T) {
+	templates := []string{"/user/:user/orders/:order", "/static/:file"}
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/user/12345/orders/67890", "/user/:user/orders/:order"},
+		{"/user/alice/orders/abc?page=2", "/user/:user/orders/:order"},
+		{"/user//orders/1", "/user//orders/:id"},
+		{"/static/app.js", "/static/:file"},
+		{"/static/js/app.js", "/static/js/app.js"},
+		{"/item/42", "/item/:id"},
+		{"/item/42/", "/item/:id/"},
+		{"/session/0a1b2c3d4e5f", "/session/:id"},
+		{"/session/deadbeefcafe", "/session/deadbeefcafe"},
+		{"/doc/123e4567-e89b-12d3-a456-426614174000/edit", "/doc/:id/edit"},
+		{"/v2/api", "/v2/api"},
+		{"/", "/"},
+	} {
+		if got := collapsePath(tc.path, templates); got != tc.expected {
+			t.Errorf("collapsePath(%q) = %q, expected %q", tc.path, got, tc.expected)
+		}
+	}
+}
+
 // Testcode.Instrs tests that each instruction behaves as expected through one
 // instruction cycle.
 func TestInstrs(t *testing.T) {
@@ -713,6 +830,25 @@ func TestDatumSetInstrs(t *testing.T) {
 	if d.ValueString() != "3.1" {
 		t.Errorf("Unexpected value %v", d)
 	}
+	// finc
+	v = makeVM(code.Instr{code.Finc, nil, 0}, m)
+	d, err = m[1].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.t.Push(d)
+	v.t.Push(0.5)
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatalf("Execution failed, see info log.")
+	}
+	d, err = m[1].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ValueString() != "4.6" {
+		t.Errorf("Unexpected value %v", d)
+	}
 }
 
 func TestStrptimeWithTimezone(t *testing.T) {
@@ -742,6 +878,119 @@ func TestStrptimeWithoutTimezone(t *testing.T) {
 	}
 }
 
+func TestDuration(t *testing.T) {
+	obj := &object.Object{Program: []code.Instr{{code.Duration, 0, 0}}}
+	v := New("duration", obj, true, nil)
+	v.t = new(thread)
+	v.t.stack = make([]interface{}, 0)
+
+	before := expvarValue(durationParseErrors, "duration")
+	for _, tc := range []struct {
+		in       string
+		expected float64
+	}{
+		{"12ms", 0.012},
+		{"1m30s", 90},
+		{"soon", 0},
+	} {
+		v.t.Push(tc.in)
+		v.execute(v.t, obj.Program[0])
+		if got := v.t.Pop().(float64); got != tc.expected {
+			t.Errorf("duration(%q): expected %g, got %g", tc.in, tc.expected, got)
+		}
+	}
+	if got := expvarValue(durationParseErrors, "duration") - before; got != 1 {
+		t.Errorf("expected 1 parse error, got %g", got)
+	}
+}
+
+func TestBase64URLSafe(t *testing.T) {
+	defer testutil.TestSetFlag(t, "base64_url_safe", "true")()
+	obj := &object.Object{Program: []code.Instr{{code.Base64dec, 0, 0}, {code.Base64enc, 0, 0}}}
+	v := New("base64urlsafe", obj, true, nil)
+	v.t = new(thread)
+	v.t.stack = make([]interface{}, 0)
+
+	before := expvarValue(base64DecodeErrors, "base64urlsafe")
+	for _, tc := range []struct {
+		in, expected string
+	}{
+		{"-_9-", "\xfb\xff~"},
+		{"+/9+", ""}, // The standard alphabet isn't accepted.
+	} {
+		v.t.Push(tc.in)
+		v.execute(v.t, obj.Program[0])
+		if got := v.t.Pop().(string); got != tc.expected {
+			t.Errorf("base64_decode(%q): expected %q, got %q", tc.in, tc.expected, got)
+		}
+	}
+	if got := expvarValue(base64DecodeErrors, "base64urlsafe") - before; got != 1 {
+		t.Errorf("expected 1 decode error, got %g", got)
+	}
+
+	v.t.Push("\xfb\xff~")
+	v.execute(v.t, obj.Program[1])
+	if got := v.t.Pop().(string); got != "-_9-" {
+		t.Errorf("base64_encode: expected %q, got %q", "-_9-", got)
+	}
+}
+
+func TestJsonget(t *testing.T) {
+	defer testutil.TestSetFlag(t, "json_array_join", "true")()
+	obj := &object.Object{Program: []code.Instr{{code.Jsonget, 0, 0}}}
+	v := New("jsonget", obj, true, nil)
+	v.t = new(thread)
+	v.t.stack = make([]interface{}, 0)
+
+	for _, tc := range []struct {
+		doc, path, expected string
+	}{
+		{`{"req": {"method": "GET"}, "tags": ["a", "b"]}`, "$.req.method", "GET"},
+		{`{"req": {"method": "GET"}, "tags": ["a", "b"]}`, "tags", `["a","b"]`},
+		{`{"req": {"method": "PUT"}}`, "req.method", "PUT"},
+		{`{"req": `, "req", ""},
+	} {
+		v.t.Push(tc.doc)
+		v.t.Push(tc.path)
+		v.execute(v.t, obj.Program[0])
+		if got := v.t.Pop().(string); got != tc.expected {
+			t.Errorf("json_extract(%q, %q): expected %q, got %q", tc.doc, tc.path, tc.expected, got)
+		}
+		if v.t.json.src != tc.doc {
+			t.Errorf("json_extract(%q, %q): parsed %q", tc.doc, tc.path, v.t.json.src)
+		}
+	}
+}
+
+func TestXmlget(t *testing.T) {
+	defer testutil.TestSetFlag(t, "xml_max_size", "40")()
+	obj := &object.Object{Program: []code.Instr{{code.Xmlget, 0, 0}}}
+	v := New("xmlget", obj, true, nil)
+	v.t = new(thread)
+	v.t.stack = make([]interface{}, 0)
+
+	for _, tc := range []struct {
+		doc, path, expected string
+	}{
+		{`<event id="7"><user>alice</user></event>`, "/event/@id", "7"},
+		{`<event id="7"><user>alice</user></event>`, "//user", "alice"},
+		{`<event id="7"><user>alice</user></event>`, "/event/missing", ""},
+		{`<event id="7"><user>alice</user>`, "/event/@id", ""},
+		// Larger than --xml_max_size.
+		{`<event id="7"><user>alice liddell</user></event>`, "/event/@id", ""},
+	} {
+		v.t.Push(tc.doc)
+		v.t.Push(tc.path)
+		v.execute(v.t, obj.Program[0])
+		if v.terminate {
+			t.Fatalf("xml_extract(%q, %q): execution failed: %s", tc.doc, tc.path, v.RuntimeErrorString())
+		}
+		if got := v.t.Pop().(string); got != tc.expected {
+			t.Errorf("xml_extract(%q, %q): expected %q, got %q", tc.doc, tc.path, tc.expected, got)
+		}
+	}
+}
+
 // code.Instructions with datum retrieve
 func TestDatumFetchInstrs(t *testing.T) {
 	var m []*metrics.Metric
@@ -868,3 +1117,26 @@ func TestTimestampInstr(t *testing.T) {
 		t.Errorf("Expecting timestamp to be %s, was %s", newT, tos)
 	}
 }
+
+func TestSampledIncStackDepth(t *testing.T) {
+	prog := `counter deterministic sample 10
+counter randomised sample random 10
+
+foreach /x/ {
+  deterministic++
+  randomised += 2
+}
+`
+	v, err := Compile("sampled", strings.NewReader(prog), false, false, false, time.UTC)
+	testutil.FatalIfErr(t, err)
+	line := logline.New(context.Background(), "sampled", strings.Repeat("x", 2000))
+	for i := 0; i < 10; i++ {
+		v.ProcessLogLine(context.Background(), line)
+		if n := len(v.t.stack); n != 0 {
+			t.Fatalf("stack depth after line %d: expected 0, got %d", i, n)
+		}
+	}
+	if s := v.RuntimeErrorString(); s != "" {
+		t.Errorf("unexpected runtime error: %s", s)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"github.com/google/mtail/internal/vm/xpath"
+)
+
+// parsedXML is a string parsed as an XML document.
+type parsedXML struct {
+	src string
+	doc *xpath.Node
+	err error
+}
+
+// parseXML parses s as an XML document.
+func parseXML(s string) *parsedXML {
+	p := &parsedXML{src: s}
+	p.doc, p.err = xpath.Parse(s)
+	return p
+}
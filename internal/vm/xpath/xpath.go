@@ -0,0 +1,260 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package xpath evaluates XPath 1.0 expressions on XML documents, with the
+// antchfx/xpath package, to extract the elements and attributes of XML log
+// lines.  Documents are parsed with encoding/xml into a tree that the
+// expressions navigate.  Namespaced names are matched by the prefix they're
+// declared with in the document, like `/event/@wl:server`, and names in the
+// default namespace without one.
+package xpath
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	antchfx "github.com/antchfx/xpath"
+	"github.com/pkg/errors"
+)
+
+// Node is a node of a parsed XML document: the document itself, an element,
+// or the text in an element.
+type Node struct {
+	Type     antchfx.NodeType
+	Prefix   string // The namespace prefix of an element.
+	Name     string // The local name of an element.
+	Attr     []Attr
+	Text     string // The text of a text node.
+	Parent   *Node
+	Children []*Node
+
+	index int // The position of the node among the children of its parent.
+}
+
+// Attr is an attribute of an element.
+type Attr struct {
+	Prefix string
+	Name   string
+	Value  string
+}
+
+// Parse parses an XML document.
+func Parse(s string) (*Node, error) {
+	doc := &Node{Type: antchfx.RootNode}
+	// Names are resolved to their namespace URLs by the decoder, and mapped
+	// back to the prefixes declared for them.
+	prefixes := map[string]string{"xmlns": "xmlns", "http://www.w3.org/XML/1998/namespace": "xml"}
+	top := doc
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					prefixes[a.Value] = a.Name.Local
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					prefixes[a.Value] = ""
+				}
+			}
+			n := &Node{Type: antchfx.ElementNode, Prefix: prefixes[t.Name.Space], Name: t.Name.Local}
+			for _, a := range t.Attr {
+				n.Attr = append(n.Attr, Attr{Prefix: prefixes[a.Name.Space], Name: a.Name.Local, Value: a.Value})
+			}
+			top.add(n)
+			top = n
+		case xml.EndElement:
+			top = top.Parent
+		case xml.CharData:
+			if top == doc {
+				// Whitespace around the root element.
+				continue
+			}
+			top.add(&Node{Type: antchfx.TextNode, Text: string(t)})
+		case xml.Comment:
+			top.add(&Node{Type: antchfx.CommentNode, Text: string(t)})
+		}
+	}
+	for _, c := range doc.Children {
+		if c.Type == antchfx.ElementNode {
+			return doc, nil
+		}
+	}
+	return nil, errors.New("no root element in XML document")
+}
+
+// add appends c to the children of n.
+func (n *Node) add(c *Node) {
+	c.Parent = n
+	c.index = len(n.Children)
+	n.Children = append(n.Children, c)
+}
+
+// String returns the string value of n: the text it contains, at any depth.
+func (n *Node) String() string {
+	if n.Type == antchfx.TextNode || n.Type == antchfx.CommentNode {
+		return n.Text
+	}
+	var b strings.Builder
+	n.writeText(&b)
+	return b.String()
+}
+
+func (n *Node) writeText(b *strings.Builder) {
+	for _, c := range n.Children {
+		switch c.Type {
+		case antchfx.TextNode:
+			b.WriteString(c.Text)
+		case antchfx.ElementNode:
+			c.writeText(b)
+		}
+	}
+}
+
+// navigator moves over the nodes of a document, and the attributes of its
+// elements, as an antchfx.NodeNavigator.
+type navigator struct {
+	root, cur *Node
+	attr      int // The index of the current attribute of cur, or -1 if on cur itself.
+}
+
+func (n *navigator) NodeType() antchfx.NodeType {
+	if n.attr >= 0 {
+		return antchfx.AttributeNode
+	}
+	return n.cur.Type
+}
+
+func (n *navigator) LocalName() string {
+	if n.attr >= 0 {
+		return n.cur.Attr[n.attr].Name
+	}
+	return n.cur.Name
+}
+
+func (n *navigator) Prefix() string {
+	if n.attr >= 0 {
+		return n.cur.Attr[n.attr].Prefix
+	}
+	return n.cur.Prefix
+}
+
+func (n *navigator) Value() string {
+	if n.attr >= 0 {
+		return n.cur.Attr[n.attr].Value
+	}
+	return n.cur.String()
+}
+
+func (n *navigator) Copy() antchfx.NodeNavigator {
+	c := *n
+	return &c
+}
+
+func (n *navigator) MoveToRoot() {
+	n.cur, n.attr = n.root, -1
+}
+
+func (n *navigator) MoveToParent() bool {
+	if n.attr >= 0 {
+		n.attr = -1
+		return true
+	}
+	if n.cur.Parent == nil {
+		return false
+	}
+	n.cur = n.cur.Parent
+	return true
+}
+
+func (n *navigator) MoveToNextAttribute() bool {
+	if n.attr+1 >= len(n.cur.Attr) {
+		return false
+	}
+	n.attr++
+	return true
+}
+
+func (n *navigator) MoveToChild() bool {
+	if n.attr >= 0 || len(n.cur.Children) == 0 {
+		return false
+	}
+	n.cur = n.cur.Children[0]
+	return true
+}
+
+func (n *navigator) MoveToFirst() bool {
+	if n.attr >= 0 || n.cur.Parent == nil || n.cur.index == 0 {
+		return false
+	}
+	n.cur = n.cur.Parent.Children[0]
+	return true
+}
+
+func (n *navigator) MoveToNext() bool {
+	if n.attr >= 0 || n.cur.Parent == nil || n.cur.index+1 >= len(n.cur.Parent.Children) {
+		return false
+	}
+	n.cur = n.cur.Parent.Children[n.cur.index+1]
+	return true
+}
+
+func (n *navigator) MoveToPrevious() bool {
+	if n.attr >= 0 || n.cur.Parent == nil || n.cur.index == 0 {
+		return false
+	}
+	n.cur = n.cur.Parent.Children[n.cur.index-1]
+	return true
+}
+
+func (n *navigator) MoveTo(other antchfx.NodeNavigator) bool {
+	o, ok := other.(*navigator)
+	if !ok || o.root != n.root {
+		return false
+	}
+	*n = *o
+	return true
+}
+
+// Path is a compiled XPath expression.
+type Path struct {
+	expr *antchfx.Expr
+}
+
+// Compile parses an XPath expression.
+func Compile(path string) (*Path, error) {
+	expr, err := antchfx.Compile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid XPath %q", path)
+	}
+	return &Path{expr}, nil
+}
+
+// Eval returns the value of the path evaluated on doc: the string value of
+// the first node it selects, or a number, boolean or string it computes.  It
+// returns false if the path selects no nodes.
+func (p *Path) Eval(doc *Node) (string, bool) {
+	switch v := p.expr.Evaluate(&navigator{root: doc, cur: doc, attr: -1}).(type) {
+	case *antchfx.NodeIterator:
+		if !v.MoveNext() {
+			return "", false
+		}
+		return v.Current().Value(), true
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
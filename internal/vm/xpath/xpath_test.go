@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package xpath
+
+import (
+	"testing"
+)
+
+const testDoc = `<?xml version="1.0"?>
+<event xmlns:wl="http://www.bea.com/ns/weblogic" severity="Error" wl:server="AdminServer">
+  <user id="42">alice</user>
+  <request method="GET"><path>/login</path><status>500</status></request>
+  <items>
+    <item sku="a1">first</item>
+    <item sku="b2">second <b>bold</b></item>
+  </items>
+  <items>
+    <item sku="c3">third</item>
+  </items>
+</event>`
+
+var evalTests = []struct {
+	path     string
+	expected string
+	ok       bool
+}{
+	{"/event/@severity", "Error", true},
+	{"/event/@wl:server", "AdminServer", true},
+	{"/event/@server", "", false},
+	{"/event/user", "alice", true},
+	{"/event/user/@id", "42", true},
+	{"/event/user/text()", "alice", true},
+	{"//path", "/login", true},
+	{"//request/@method", "GET", true},
+	{"/event/request/status", "500", true},
+	{"/event/*/path", "/login", true},
+	{"//item", "first", true},
+	{"//item[2]", "second bold", true},
+	{"//item[2]/text()", "second ", true},
+	{"/event/items[2]/item", "third", true},
+	{"//item[@sku='c3']", "third", true},
+	{`//item[@sku="b2"]/b`, "bold", true},
+	{"//item[@sku]/@sku", "a1", true},
+	{"//item[3]", "", false},
+	{"//item[@sku='z9']", "", false},
+	{"/event/missing", "", false},
+	{"/user", "", false},
+	{"//user/@missing", "", false},
+	{"//@sku", "a1", true},
+	{"//item[last()]", "second bold", true},
+	{"/event/items/item[contains(., 'bold')]/@sku", "b2", true},
+	{"count(//item)", "3", true},
+	{"//status > 499", "true", true},
+	{"concat(//user, '@', //path)", "alice@/login", true},
+}
+
+func TestEval(t *testing.T) {
+	doc, err := Parse(testDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range evalTests {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			p, err := Compile(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := p.Eval(doc)
+			if got != tc.expected || ok != tc.ok {
+				t.Errorf("expected %q, %v, got %q, %v", tc.expected, tc.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, path := range []string{
+		"",
+		"/event/",
+		"/event//",
+		"/event/user[@id",
+		"/event/user[@id='42'",
+		"/event/user[",
+		"/event/@",
+	} {
+		if _, err := Compile(path); err == nil {
+			t.Errorf("Compile(%q): expected error", path)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, doc := range []string{
+		"",
+		"not xml",
+		"<event><user></event>",
+		"<event>",
+	} {
+		if _, err := Parse(doc); err == nil {
+			t.Errorf("Parse(%q): expected error", doc)
+		}
+	}
+}